@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// errUndeliverableAddress is returned when the carrier can't deliver to an address
+var errUndeliverableAddress = errors.New("the address is not deliverable")
+
+// addressVerifier is implemented by carriers that can check an address is deliverable
+type addressVerifier interface {
+	// VerifyAddress returns the address as the carrier writes it, or an error wrapping
+	// errUndeliverableAddress
+	VerifyAddress(ctx context.Context, address PostalAddress) (*PostalAddress, error)
+}
+
+// countryCodes are the ISO 3166-1 alpha-2 country codes
+var countryCodes = makeSet(strings.Fields(`
+	AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ
+	BR BS BT BV BW BY BZ CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ DE DJ DK DM
+	DO DZ EC EE EG EH ER ES ET FI FJ FK FM FO FR GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS
+	GT GU GW GY HK HM HN HR HT HU ID IE IL IM IN IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN
+	KP KR KW KY KZ LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK ML MM MN MO MP MQ
+	MR MS MT MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF PG PH PK PL PM
+	PN PR PS PT PW PY QA RE RO RS RU RW SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV
+	SX SY SZ TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI
+	VN VU WF WS YE YT ZA ZM ZW
+`))
+
+// addressFormat is how a country writes its postal codes and regions
+type addressFormat struct {
+	// PostalCode matches a valid postal code after normalizePostalCode; nil means the
+	// country has no postal codes we check
+	PostalCode *regexp.Regexp
+	// Separator goes before the last SeparatorFromEnd characters of the postal code, e.g.
+	// " " and 3 for "SW1A 1AA"; 0 leaves the code as written
+	SeparatorFromEnd int
+	Separator        string
+	// Regions maps region codes to their names; when set, the region is required and must
+	// be one of them
+	Regions map[string]string
+}
+
+var addressFormats = map[string]addressFormat{
+	"US": {PostalCode: regexp.MustCompile(`^\d{5}(-\d{4})?$`), Regions: usStates},
+	"CA": {PostalCode: regexp.MustCompile(`^[A-Z]\d[A-Z] \d[A-Z]\d$`), SeparatorFromEnd: 3, Separator: " ", Regions: canadianProvinces},
+	"AU": {PostalCode: regexp.MustCompile(`^\d{4}$`), Regions: australianStates},
+	"GB": {PostalCode: regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? \d[A-Z]{2}$`), SeparatorFromEnd: 3, Separator: " "},
+	"IE": {PostalCode: regexp.MustCompile(`^[A-Z]\d[\dW] [A-Z\d]{4}$`), SeparatorFromEnd: 4, Separator: " "},
+	"NL": {PostalCode: regexp.MustCompile(`^\d{4} [A-Z]{2}$`), SeparatorFromEnd: 2, Separator: " "},
+	"PL": {PostalCode: regexp.MustCompile(`^\d{2}-\d{3}$`), SeparatorFromEnd: 3, Separator: "-"},
+	"PT": {PostalCode: regexp.MustCompile(`^\d{4}-\d{3}$`), SeparatorFromEnd: 3, Separator: "-"},
+	"SE": {PostalCode: regexp.MustCompile(`^\d{3} \d{2}$`), SeparatorFromEnd: 2, Separator: " "},
+	"BR": {PostalCode: regexp.MustCompile(`^\d{5}-\d{3}$`), SeparatorFromEnd: 3, Separator: "-"},
+	"JP": {PostalCode: regexp.MustCompile(`^\d{3}-\d{4}$`), SeparatorFromEnd: 4, Separator: "-"},
+	"DE": {PostalCode: regexp.MustCompile(`^\d{5}$`)},
+	"FR": {PostalCode: regexp.MustCompile(`^\d{5}$`)},
+	"ES": {PostalCode: regexp.MustCompile(`^\d{5}$`)},
+	"IT": {PostalCode: regexp.MustCompile(`^\d{5}$`)},
+	"FI": {PostalCode: regexp.MustCompile(`^\d{5}$`)},
+	"ID": {PostalCode: regexp.MustCompile(`^\d{5}$`)},
+	"MY": {PostalCode: regexp.MustCompile(`^\d{5}$`)},
+	"MX": {PostalCode: regexp.MustCompile(`^\d{5}$`)},
+	"BE": {PostalCode: regexp.MustCompile(`^\d{4}$`)},
+	"AT": {PostalCode: regexp.MustCompile(`^\d{4}$`)},
+	"CH": {PostalCode: regexp.MustCompile(`^\d{4}$`)},
+	"DK": {PostalCode: regexp.MustCompile(`^\d{4}$`)},
+	"NO": {PostalCode: regexp.MustCompile(`^\d{4}$`)},
+	"NZ": {PostalCode: regexp.MustCompile(`^\d{4}$`)},
+	"PH": {PostalCode: regexp.MustCompile(`^\d{4}$`)},
+	"IN": {PostalCode: regexp.MustCompile(`^\d{6}$`)},
+	"SG": {PostalCode: regexp.MustCompile(`^\d{6}$`)},
+	"CN": {PostalCode: regexp.MustCompile(`^\d{6}$`)},
+}
+
+var usStates = map[string]string{
+	"AL": "Alabama", "AK": "Alaska", "AZ": "Arizona", "AR": "Arkansas", "CA": "California",
+	"CO": "Colorado", "CT": "Connecticut", "DE": "Delaware", "DC": "District of Columbia",
+	"FL": "Florida", "GA": "Georgia", "HI": "Hawaii", "ID": "Idaho", "IL": "Illinois",
+	"IN": "Indiana", "IA": "Iowa", "KS": "Kansas", "KY": "Kentucky", "LA": "Louisiana",
+	"ME": "Maine", "MD": "Maryland", "MA": "Massachusetts", "MI": "Michigan", "MN": "Minnesota",
+	"MS": "Mississippi", "MO": "Missouri", "MT": "Montana", "NE": "Nebraska", "NV": "Nevada",
+	"NH": "New Hampshire", "NJ": "New Jersey", "NM": "New Mexico", "NY": "New York",
+	"NC": "North Carolina", "ND": "North Dakota", "OH": "Ohio", "OK": "Oklahoma", "OR": "Oregon",
+	"PA": "Pennsylvania", "RI": "Rhode Island", "SC": "South Carolina", "SD": "South Dakota",
+	"TN": "Tennessee", "TX": "Texas", "UT": "Utah", "VT": "Vermont", "VA": "Virginia",
+	"WA": "Washington", "WV": "West Virginia", "WI": "Wisconsin", "WY": "Wyoming",
+	// Military post offices
+	"AA": "Armed Forces Americas", "AE": "Armed Forces Europe", "AP": "Armed Forces Pacific",
+}
+
+var canadianProvinces = map[string]string{
+	"AB": "Alberta", "BC": "British Columbia", "MB": "Manitoba", "NB": "New Brunswick",
+	"NL": "Newfoundland and Labrador", "NS": "Nova Scotia", "NT": "Northwest Territories",
+	"NU": "Nunavut", "ON": "Ontario", "PE": "Prince Edward Island", "QC": "Quebec",
+	"SK": "Saskatchewan", "YT": "Yukon",
+}
+
+var australianStates = map[string]string{
+	"ACT": "Australian Capital Territory", "NSW": "New South Wales", "NT": "Northern Territory",
+	"QLD": "Queensland", "SA": "South Australia", "TAS": "Tasmania", "VIC": "Victoria",
+	"WA": "Western Australia",
+}
+
+func makeSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// normalizeRegionAndPostalCode checks the region and postal code against the country's
+// format and returns them as the country writes them: regions as codes ("New York" -> "NY")
+// and postal codes uppercased with their separator ("k1a0b1" -> "K1A 0B1"). Unless complete,
+// an empty region or postal code is accepted, as when only estimating shipping.
+func normalizeRegionAndPostalCode(country, region, postalCode string, complete bool) (string, string, error) {
+	region = strings.ToUpper(region)
+	if !countryCodes[country] {
+		return region, postalCode, handlers.FieldErrorf("country", "country %q is not a known country code", country)
+	}
+	format, ok := addressFormats[country]
+	if !ok {
+		return region, postalCode, nil
+	}
+
+	if format.Regions != nil && (region != "" || complete) {
+		code, ok := findRegion(format.Regions, region)
+		if !ok {
+			return region, postalCode, handlers.FieldErrorf("region", "region must be a %s state or province code", country)
+		}
+		region = code
+	}
+
+	if format.PostalCode != nil && (postalCode != "" || complete) {
+		postalCode = normalizePostalCode(format, postalCode)
+		if !format.PostalCode.MatchString(postalCode) {
+			return region, postalCode, handlers.FieldErrorf("postal_code", "postal_code is not a valid %s postal code", country)
+		}
+	}
+
+	return region, postalCode, nil
+}
+
+// findRegion returns the code of the region given by its code or name
+func findRegion(regions map[string]string, region string) (string, bool) {
+	if _, ok := regions[region]; ok {
+		return region, true
+	}
+	for code, name := range regions {
+		if strings.ToUpper(name) == region {
+			return code, true
+		}
+	}
+	return "", false
+}
+
+func normalizePostalCode(format addressFormat, postalCode string) string {
+	postalCode = strings.ToUpper(postalCode)
+	if format.SeparatorFromEnd == 0 {
+		return postalCode
+	}
+	// Customers write the separator, a different one or none at all
+	compact := strings.NewReplacer(" ", "", "-", "").Replace(postalCode)
+	if len(compact) <= format.SeparatorFromEnd {
+		return postalCode
+	}
+	i := len(compact) - format.SeparatorFromEnd
+	return compact[:i] + format.Separator + compact[i:]
+}
+
+// verifyAddress asks the carrier, when it can, whether it delivers to the address and adopts
+// the carrier's spelling of it. An unreachable carrier doesn't keep customers from saving
+// addresses; they were already checked against the country's format.
+func verifyAddress(ctx context.Context, address *PostalAddress) error {
+	verifier, ok := shippingCarrier.(addressVerifier)
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	verified, err := verifier.VerifyAddress(ctx, *address)
+	if errors.Is(err, errUndeliverableAddress) {
+		return err
+	}
+	if err != nil {
+		log.Println("Error verifying address:", err)
+		return nil
+	}
+	if verified.Line1 == "" || verified.City == "" {
+		return nil
+	}
+
+	// The name and phone are the customer's; the carrier only corrects where it goes
+	address.Line1 = verified.Line1
+	address.Line2 = verified.Line2
+	address.City = verified.City
+	address.Region = verified.Region
+	address.PostalCode = verified.PostalCode
+	return nil
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const (
+	addressTypeShipping = "shipping"
+	addressTypeBilling  = "billing"
+)
+
+var errShippingAddressNotFound = handlers.NewFieldError("shipping_address_id", "shipping_address_id is not one of your addresses")
+var errBillingAddressNotFound = handlers.NewFieldError("billing_address_id", "billing_address_id is not one of your addresses")
+
+// PostalAddress is where a package can be delivered. Country is a 2-letter code like "US";
+// Region is the state or province code.
+type PostalAddress struct {
+	Name       string `json:"name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	Region     string `json:"region,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+	Country    string `json:"country"`
+	Phone      string `json:"phone,omitempty"`
+}
+
+// Address is an entry in the customer's address book. The customer always has one default
+// shipping and one default billing address once they have saved any address.
+type Address struct {
+	ID int `json:"address_id"`
+	PostalAddress
+	DefaultShipping bool      `json:"default_shipping"`
+	DefaultBilling  bool      `json:"default_billing"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type AddressRequest struct {
+	PostalAddress
+	DefaultShipping bool `json:"default_shipping"`
+	DefaultBilling  bool `json:"default_billing"`
+}
+
+// OrderAddressRequest picks the addresses an order is shipped and billed to from the
+// customer's address book
+type OrderAddressRequest struct {
+	// ShippingAddressID defaults to the customer's default shipping address
+	ShippingAddressID int `json:"shipping_address_id"`
+	// BillingAddressID defaults to the default billing address, or else the shipping address
+	BillingAddressID int `json:"billing_address_id"`
+	// PickupLocationID has the order collected at a pickup location instead of shipped; the
+	// shipping address is then ignored and the billing address is optional
+	PickupLocationID int `json:"pickup_location_id"`
+}
+
+// CUSTOMER ADDRESSES
+func CustomerAddressesHandler(w http.ResponseWriter, r *http.Request) {
+	addresses, err := getAddresses(r.Context(), getCustomerID(r))
+	if err != nil {
+		log.Println("Error retrieving addresses:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, addresses)
+}
+
+func CustomerCreateAddressHandler(w http.ResponseWriter, r *http.Request) {
+	addressRequest, ok := readAddressRequest(w, r)
+	if !ok {
+		return
+	}
+
+	address, err := saveAddress(r.Context(), getCustomerID(r), 0, addressRequest)
+	if err != nil {
+		log.Println("Error creating address:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, address)
+}
+
+func CustomerUpdateAddressHandler(w http.ResponseWriter, r *http.Request) {
+	addressID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid address ID")
+		return
+	}
+
+	addressRequest, ok := readAddressRequest(w, r)
+	if !ok {
+		return
+	}
+
+	address, err := saveAddress(r.Context(), getCustomerID(r), addressID, addressRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Address not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error updating address:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, address)
+}
+
+// CustomerDeleteAddressHandler deletes an address. Orders keep their own copy of the
+// addresses they were placed with, so they are not affected.
+func CustomerDeleteAddressHandler(w http.ResponseWriter, r *http.Request) {
+	addressID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid address ID")
+		return
+	}
+
+	err = deleteAddress(r.Context(), getCustomerID(r), addressID)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Address not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error deleting address:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func readAddressRequest(w http.ResponseWriter, r *http.Request) (AddressRequest, bool) {
+	var addressRequest AddressRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return addressRequest, false
+	}
+
+	err = json.Unmarshal(body, &addressRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return addressRequest, false
+	}
+
+	err = validateAddress(&addressRequest.PostalAddress)
+	if err == nil {
+		err = verifyAddress(r.Context(), &addressRequest.PostalAddress)
+	}
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return addressRequest, false
+	}
+
+	return addressRequest, true
+}
+
+// validateAddress trims and normalizes the address and checks it against its country's
+// postal code and region formats
+func validateAddress(address *PostalAddress) error {
+	address.Name = strings.TrimSpace(address.Name)
+	address.Line1 = strings.TrimSpace(address.Line1)
+	address.Line2 = strings.TrimSpace(address.Line2)
+	address.City = strings.TrimSpace(address.City)
+	address.Region = strings.TrimSpace(address.Region)
+	address.PostalCode = strings.TrimSpace(address.PostalCode)
+	address.Country = strings.ToUpper(strings.TrimSpace(address.Country))
+	address.Phone = strings.TrimSpace(address.Phone)
+
+	switch {
+	case address.Name == "" || len(address.Name) > 255:
+		return handlers.NewFieldError("name", "name is required and must be at most 255 characters")
+	case address.Line1 == "" || len(address.Line1) > 255:
+		return handlers.NewFieldError("line1", "line1 is required and must be at most 255 characters")
+	case len(address.Line2) > 255:
+		return handlers.NewFieldError("line2", "line2 must be at most 255 characters")
+	case address.City == "" || len(address.City) > 100:
+		return handlers.NewFieldError("city", "city is required and must be at most 100 characters")
+	case len(address.Region) > 100:
+		return handlers.NewFieldError("region", "region must be at most 100 characters")
+	case len(address.PostalCode) > 20:
+		return handlers.NewFieldError("postal_code", "postal_code must be at most 20 characters")
+	case len(address.Country) != 2:
+		return handlers.NewFieldError("country", "country must be a 2-letter country code")
+	case len(address.Phone) > 50:
+		return handlers.NewFieldError("phone", "phone must be at most 50 characters")
+	}
+
+	var err error
+	address.Region, address.PostalCode, err = normalizeRegionAndPostalCode(address.Country, address.Region, address.PostalCode, true)
+	return err
+}
+
+// saveAddress inserts a new address when addressID is 0, otherwise updates the customer's
+// address. Making it a default takes the flag from the customer's other addresses.
+func saveAddress(ctx context.Context, customerID, addressID int, req AddressRequest) (*Address, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Saves of the same customer's addresses are serialized, so there is one default of each kind
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM customers WHERE id = $1 FOR UPDATE", customerID); err != nil {
+		return nil, err
+	}
+
+	if req.DefaultShipping {
+		_, err := tx.ExecContext(ctx, "UPDATE addresses SET is_default_shipping = FALSE WHERE customer_id = $1 AND id <> $2", customerID, addressID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if req.DefaultBilling {
+		_, err := tx.ExecContext(ctx, "UPDATE addresses SET is_default_billing = FALSE WHERE customer_id = $1 AND id <> $2", customerID, addressID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a := req.PostalAddress
+	if addressID == 0 {
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO addresses (customer_id, name, line1, line2, city, region, postal_code, country, phone, is_default_shipping, is_default_billing)
+			VALUES ($1, $2, $3, NULLIF($4, ''), $5, NULLIF($6, ''), NULLIF($7, ''), $8, NULLIF($9, ''), $10, $11)
+			RETURNING id
+		`, customerID, a.Name, a.Line1, a.Line2, a.City, a.Region, a.PostalCode, a.Country, a.Phone,
+			req.DefaultShipping, req.DefaultBilling).Scan(&addressID)
+	} else {
+		err = tx.QueryRowContext(ctx, `
+			UPDATE addresses
+			SET name = $1, line1 = $2, line2 = NULLIF($3, ''), city = $4, region = NULLIF($5, ''),
+				postal_code = NULLIF($6, ''), country = $7, phone = NULLIF($8, ''),
+				is_default_shipping = $9, is_default_billing = $10
+			WHERE id = $11 AND customer_id = $12
+			RETURNING id
+		`, a.Name, a.Line1, a.Line2, a.City, a.Region, a.PostalCode, a.Country, a.Phone,
+			req.DefaultShipping, req.DefaultBilling, addressID, customerID).Scan(&addressID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ensureDefaultAddresses(ctx, tx, customerID, addressID); err != nil {
+		return nil, err
+	}
+
+	address, err := getAddress(ctx, tx, customerID, addressID)
+	if err != nil {
+		return nil, err
+	}
+
+	return address, tx.Commit()
+}
+
+// deleteAddress deletes the customer's address. When it was a default, the most recently
+// added remaining address takes its place.
+func deleteAddress(ctx context.Context, customerID, addressID int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM customers WHERE id = $1 FOR UPDATE", customerID); err != nil {
+		return err
+	}
+
+	var deleted int
+	err = tx.QueryRowContext(ctx, "DELETE FROM addresses WHERE id = $1 AND customer_id = $2 RETURNING id", addressID, customerID).Scan(&deleted)
+	if err != nil {
+		return err
+	}
+
+	if err := ensureDefaultAddresses(ctx, tx, customerID, 0); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ensureDefaultAddresses makes an address the default shipping and billing address when the
+// customer has none. The preferred address is picked first, then the newest.
+func ensureDefaultAddresses(ctx context.Context, tx *sql.Tx, customerID, preferredID int) error {
+	for _, column := range []string{"is_default_shipping", "is_default_billing"} {
+		_, err := tx.ExecContext(ctx, `
+			UPDATE addresses SET `+column+` = TRUE
+			WHERE id = (
+				SELECT id FROM addresses
+				WHERE customer_id = $1
+				ORDER BY id = $2 DESC, created_at DESC, id DESC
+				LIMIT 1
+			) AND NOT EXISTS (
+				SELECT 1 FROM addresses WHERE customer_id = $1 AND `+column+`
+			)
+		`, customerID, preferredID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const addressColumnsSQL = `
+	id, name, line1, COALESCE(line2, ''), city, COALESCE(region, ''), COALESCE(postal_code, ''),
+	country, COALESCE(phone, ''), is_default_shipping, is_default_billing, created_at
+`
+
+func scanAddress(row interface{ Scan(...interface{}) error }) (*Address, error) {
+	address := &Address{}
+	a := &address.PostalAddress
+	err := row.Scan(&address.ID, &a.Name, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode,
+		&a.Country, &a.Phone, &address.DefaultShipping, &address.DefaultBilling, &address.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return address, nil
+}
+
+func getAddress(ctx context.Context, tx *sql.Tx, customerID, addressID int) (*Address, error) {
+	return scanAddress(tx.QueryRowContext(ctx, "SELECT "+addressColumnsSQL+" FROM addresses WHERE id = $1 AND customer_id = $2", addressID, customerID))
+}
+
+func getAddresses(ctx context.Context, customerID int) ([]Address, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+addressColumnsSQL+`
+		FROM addresses
+		WHERE customer_id = $1
+		ORDER BY is_default_shipping DESC, created_at DESC, id DESC
+	`, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := make([]Address, 0)
+	for rows.Next() {
+		address, err := scanAddress(rows)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, *address)
+	}
+
+	return addresses, rows.Err()
+}
+
+// resolve fills in the default addresses and checks that both belong to the customer. It
+// returns the destination of the shipping address, or of the pickup location, which the order
+// is taxed and shipped by.
+func (req *OrderAddressRequest) resolve(ctx context.Context, customerID int) (*Destination, error) {
+	if req.PickupLocationID != 0 {
+		destination, err := pickupDestination(ctx, req.PickupLocationID)
+		if err != nil {
+			return nil, err
+		}
+		req.ShippingAddressID = 0
+		return destination, req.resolveBilling(ctx, customerID)
+	}
+
+	var shipping PostalAddress
+	err := db.QueryRowContext(ctx, `
+		SELECT id, name, line1, COALESCE(line2, ''), city, COALESCE(region, ''), COALESCE(postal_code, ''), country, COALESCE(phone, '')
+		FROM addresses
+		WHERE customer_id = $1 AND (id = $2 OR ($2 = 0 AND is_default_shipping))
+	`, customerID, req.ShippingAddressID).Scan(&req.ShippingAddressID, &shipping.Name, &shipping.Line1, &shipping.Line2,
+		&shipping.City, &shipping.Region, &shipping.PostalCode, &shipping.Country, &shipping.Phone)
+	if isNoRows(err) && req.ShippingAddressID == 0 {
+		return nil, handlers.NewFieldError("shipping_address_id", "shipping_address_id is required; add an address at /customer/addresses first")
+	}
+	if isNoRows(err) {
+		return nil, errShippingAddressNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Addresses saved before they were checked as they are now could be undeliverable
+	if err := validateAddress(&shipping); err != nil {
+		return nil, handlers.FieldErrorf("shipping_address_id", "shipping address %d: %v; update it at /customer/addresses", req.ShippingAddressID, err)
+	}
+	destination := &Destination{Country: shipping.Country, Region: shipping.Region, PostalCode: shipping.PostalCode}
+
+	return destination, req.resolveBilling(ctx, customerID)
+}
+
+// resolveBilling fills in the default billing address, falling back to the shipping address,
+// which is 0 for pickup orders
+func (req *OrderAddressRequest) resolveBilling(ctx context.Context, customerID int) error {
+	err := db.QueryRowContext(ctx, `
+		SELECT id FROM addresses
+		WHERE customer_id = $1 AND (id = $2 OR ($2 = 0 AND is_default_billing))
+	`, customerID, req.BillingAddressID).Scan(&req.BillingAddressID)
+	if isNoRows(err) && req.BillingAddressID == 0 {
+		req.BillingAddressID = req.ShippingAddressID
+		return nil
+	}
+	if isNoRows(err) {
+		return errBillingAddressNotFound
+	}
+	return err
+}
+
+// saveOrderAddresses copies the chosen addresses onto the order, so editing or deleting them
+// in the address book later doesn't change where the order goes
+func saveOrderAddresses(ctx context.Context, tx *sql.Tx, orderID, customerID int, req OrderAddressRequest) error {
+	for _, address := range []struct {
+		Type string
+		ID   int
+		Err  error
+	}{
+		{addressTypeShipping, req.ShippingAddressID, errShippingAddressNotFound},
+		{addressTypeBilling, req.BillingAddressID, errBillingAddressNotFound},
+	} {
+		// Pickup orders have no shipping address, and need no billing address
+		if address.ID == 0 {
+			continue
+		}
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO order_addresses (order_id, type, name, line1, line2, city, region, postal_code, country, phone)
+			SELECT $1, $2, name, line1, line2, city, region, postal_code, country, phone
+			FROM addresses
+			WHERE id = $3 AND customer_id = $4
+		`, orderID, address.Type, address.ID, customerID)
+		if err != nil {
+			return err
+		}
+		// The address was deleted after the order was validated
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return address.Err
+		}
+	}
+	return nil
+}
+
+// addOrderAddresses sets the shipping and billing addresses of the orders
+func addOrderAddresses(ctx context.Context, orders map[int]*OrderWithProducts) error {
+	orderIDs := make([]int, 0, len(orders))
+	for orderID := range orders {
+		orderIDs = append(orderIDs, orderID)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT order_id, type, name, line1, COALESCE(line2, ''), city, COALESCE(region, ''),
+			   COALESCE(postal_code, ''), country, COALESCE(phone, '')
+		FROM order_addresses
+		WHERE order_id = ANY($1)
+	`, pq.Array(orderIDs))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID int
+		var addressType string
+		a := &PostalAddress{}
+		if err := rows.Scan(&orderID, &addressType, &a.Name, &a.Line1, &a.Line2, &a.City, &a.Region,
+			&a.PostalCode, &a.Country, &a.Phone); err != nil {
+			return err
+		}
+		switch addressType {
+		case addressTypeShipping:
+			orders[orderID].ShippingAddress = a
+		case addressTypeBilling:
+			orders[orderID].BillingAddress = a
+		}
+	}
+
+	return rows.Err()
+}
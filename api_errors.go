@@ -0,0 +1,17 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// NotFoundHandler answers requests no route matches
+func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	handlers.WriteError(w, http.StatusNotFound, "Not Found")
+}
+
+// MethodNotAllowedHandler answers requests for a route that doesn't take their method
+func MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	handlers.WriteError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const apiKeyPrefix = "sc_"
+
+// customerOnlyPermissions act on the authenticated customer and can't be granted to API keys
+var customerOnlyPermissions = map[string]bool{
+	PermPlaceOrder:    true,
+	PermViewOwnOrders: true,
+}
+
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type CreateAPIKeyResponse struct {
+	APIKey
+	// Key is only returned once, when the key is created
+	Key string `json:"key"`
+}
+
+// ADMIN API KEYS
+func AdminCreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var createRequest CreateAPIKeyRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &createRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	var fieldErr *handlers.FieldError
+	if err := validateAPIKeyScopes(r.Context(), createRequest); errors.As(err, &fieldErr) {
+		handlers.WriteValidationError(w, err)
+		return
+	} else if err != nil {
+		log.Println("Error validating API key scopes:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// Callers can only grant the scopes they hold themselves: an API key its own scopes, and a
+	// customer their role's permissions
+	for _, scope := range createRequest.Scopes {
+		held, err := requestHasPermission(r, scope)
+		if err != nil {
+			log.Println("Error checking permission:", err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		if !held {
+			handlers.WriteError(w, http.StatusForbidden, fmt.Sprintf("you can't grant the %q scope you don't hold", scope))
+			return
+		}
+	}
+
+	response, err := createAPIKey(r.Context(), createRequest.Name, createRequest.Scopes, getCustomerID(r))
+	if err != nil {
+		log.Println("Error creating API key:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, response)
+}
+
+func AdminAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := getAPIKeys(r.Context())
+	if err != nil {
+		log.Println("Error retrieving API keys:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, keys)
+}
+
+func AdminRevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid API key ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", keyID)
+	if err != nil {
+		log.Println("Error revoking API key:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "API key not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("API key revoked"))
+}
+
+func validateAPIKeyScopes(ctx context.Context, req CreateAPIKeyRequest) error {
+	if strings.TrimSpace(req.Name) == "" {
+		return handlers.NewFieldError("name", "name is required")
+	}
+	if len(req.Scopes) == 0 {
+		return handlers.NewFieldError("scopes", "at least one scope is required")
+	}
+
+	for _, scope := range req.Scopes {
+		if customerOnlyPermissions[scope] {
+			return handlers.FieldErrorf("scopes", "scope %q can't be granted to an API key", scope)
+		}
+
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM permissions WHERE name = $1)", scope).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return handlers.FieldErrorf("scopes", "unknown scope %q", scope)
+		}
+	}
+
+	return nil
+}
+
+// createAPIKey saves a new key; createdBy is 0 when another API key creates it
+func createAPIKey(ctx context.Context, name string, scopes []string, createdBy int) (*CreateAPIKeyResponse, error) {
+	secret, err := generateToken(24)
+	if err != nil {
+		return nil, err
+	}
+	key := apiKeyPrefix + secret
+
+	response := &CreateAPIKeyResponse{
+		APIKey: APIKey{
+			Name:   strings.TrimSpace(name),
+			Prefix: key[:len(apiKeyPrefix)+8],
+			Scopes: scopes,
+		},
+		Key: key,
+	}
+
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO api_keys (name, key_hash, prefix, scopes, created_by)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0))
+		RETURNING id, created_at
+	`, response.Name, hashToken(key), response.Prefix, pq.Array(scopes), createdBy).Scan(&response.ID, &response.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func getAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, name, prefix, scopes, created_at, last_used_at, revoked_at
+		FROM api_keys
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]APIKey, 0)
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, pq.Array(&key.Scopes),
+			&key.CreatedAt, &key.LastUsedAt, &key.RevokedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// apiKeyHasScope checks that the key exists, isn't revoked and was granted the permission
+func apiKeyHasScope(ctx context.Context, key, permission string) (bool, error) {
+	var keyID int
+	err := db.QueryRowContext(ctx, `
+		SELECT id FROM api_keys
+		WHERE key_hash = $1 AND revoked_at IS NULL AND $2 = ANY(scopes)
+	`, hashToken(key), permission).Scan(&keyID)
+	if isNoRows(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = NOW() WHERE id = $1", keyID)
+	if err != nil {
+		log.Println("Error updating API key usage:", err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWT settings, loaded from environment variables by loadJWTConfig
+var jwtConfig struct {
+	// Secret signs every newly issued token
+	Secret []byte
+	// PreviousSecrets are still accepted for verification so tokens survive a secret rotation
+	PreviousSecrets [][]byte
+	// TTL is how long an issued token stays valid
+	TTL time.Duration
+}
+
+// Claims carried by every token issued by the API
+type Claims struct {
+	CustomerID int    `json:"customer_id"`
+	Role       string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+func loadJWTConfig() {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		log.Fatal("JWT_SECRET must be set")
+	}
+	jwtConfig.Secret = []byte(secret)
+
+	// Comma separated list of old secrets, kept around while tokens signed with them expire
+	jwtConfig.PreviousSecrets = nil
+	for _, s := range strings.Split(os.Getenv("JWT_PREVIOUS_SECRETS"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			jwtConfig.PreviousSecrets = append(jwtConfig.PreviousSecrets, []byte(s))
+		}
+	}
+
+	jwtConfig.TTL = 15 * time.Minute
+	if ttl := os.Getenv("JWT_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Invalid JWT_TTL %q: %v", ttl, err)
+		}
+		jwtConfig.TTL = d
+	}
+}
+
+// IssueToken signs a new token for the given customer and role
+func IssueToken(customerID int, role string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(jwtConfig.TTL)
+
+	claims := Claims{
+		CustomerID: customerID,
+		Role:       role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtConfig.Secret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// ParseToken verifies the signature and expiry of a token and returns its claims.
+// The current secret is tried first, then any previous secrets.
+func ParseToken(tokenString string) (*Claims, error) {
+	keys := jwt.VerificationKeySet{Keys: []jwt.VerificationKey{jwtConfig.Secret}}
+	for _, secret := range jwtConfig.PreviousSecrets {
+		keys.Keys = append(keys.Keys, secret)
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(*jwt.Token) (interface{}, error) {
+		return keys, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.CustomerID == 0 || claims.Role == "" {
+		return nil, errors.New("token is missing customer ID or role")
+	}
+
+	return claims, nil
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+// claimsFromContext returns the claims stored by AuthMiddleware, if any
+func claimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*Claims)
+	return claims, ok
+}
+
+// generateToken returns a random hex encoded token of n bytes
+func generateToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the SHA-256 hex digest stored in place of a secret token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
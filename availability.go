@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const (
+	availabilityInStock    = "in_stock"
+	availabilityLowStock   = "low_stock"
+	availabilityOutOfStock = "out_of_stock"
+)
+
+type Availability struct {
+	ProductID int    `json:"product_id"`
+	InStock   bool   `json:"in_stock"`
+	Status    string `json:"status"`
+}
+
+// availabilityCache keeps availability in memory for inventoryConfig.AvailabilityCacheTTL,
+// so storefronts polling the endpoint don't reach Postgres on every request
+var availabilityCache = struct {
+	sync.Mutex
+	entries map[int]availabilityCacheEntry
+}{entries: make(map[int]availabilityCacheEntry)}
+
+type availabilityCacheEntry struct {
+	availability Availability
+	expiresAt    time.Time
+}
+
+// PRODUCT AVAILABILITY
+func ProductAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	availability, err := getAvailability(r.Context(), productID)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error retrieving product availability:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(inventoryConfig.AvailabilityCacheTTL.Seconds())))
+	handlers.WriteJSON(w, http.StatusOK, availability)
+}
+
+// getAvailability returns the cached availability, loading it from the database when missing or expired
+func getAvailability(ctx context.Context, productID int) (Availability, error) {
+	now := time.Now()
+
+	availabilityCache.Lock()
+	entry, ok := availabilityCache.entries[productID]
+	availabilityCache.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.availability, nil
+	}
+
+	var stock int
+	err := db.QueryRowContext(ctx, "SELECT stock FROM products WHERE id = $1", productID).Scan(&stock)
+	if err != nil {
+		return Availability{}, err
+	}
+
+	availability := Availability{ProductID: productID, InStock: stock > 0, Status: availabilityInStock}
+	switch {
+	case stock <= 0:
+		availability.Status = availabilityOutOfStock
+	case stock < inventoryConfig.LowStockThreshold:
+		availability.Status = availabilityLowStock
+	}
+
+	availabilityCache.Lock()
+	availabilityCache.entries[productID] = availabilityCacheEntry{availability: availability, expiresAt: now.Add(inventoryConfig.AvailabilityCacheTTL)}
+	availabilityCache.Unlock()
+
+	return availability, nil
+}
+
+// pruneAvailabilityCache drops expired entries so the cache doesn't keep every product ever requested
+func pruneAvailabilityCache() {
+	now := time.Now()
+
+	availabilityCache.Lock()
+	defer availabilityCache.Unlock()
+	for productID, entry := range availabilityCache.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(availabilityCache.entries, productID)
+		}
+	}
+}
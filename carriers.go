@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errLabelExists = errors.New("shipment already has a label")
+var errNoShippingAddress = errors.New("the order has no shipping address")
+
+// ShippingCarrier buys postage through a carrier API
+type ShippingCarrier interface {
+	// BuyLabel buys a label for the parcel at the carrier's cheapest rate, or at the named
+	// service's rate when one is given
+	BuyLabel(ctx context.Context, label LabelRequest) (*ShippingLabel, error)
+}
+
+// LabelRequest is the parcel a label is bought for
+type LabelRequest struct {
+	ShipmentID int
+	From       PostalAddress
+	To         PostalAddress
+	Parcel     Parcel
+	Service    string
+}
+
+// Parcel is a package's weight in kg and, when known, its dimensions in cm
+type Parcel struct {
+	Weight float64 `json:"weight"`
+	Length float64 `json:"length"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// ShippingLabel is a bought label
+type ShippingLabel struct {
+	Carrier        string
+	Service        string
+	TrackingNumber string
+	LabelURL       string
+	Cost           float64
+	Currency       string
+	// Reference is the carrier API's ID for the shipment
+	Reference string
+}
+
+type LabelPurchaseRequest struct {
+	// Service picks the carrier's service, e.g. "Priority"; the cheapest is bought when empty
+	Service string `json:"service"`
+	// Parcel overrides the parcel, whose weight is otherwise that of the shipped items
+	Parcel *Parcel `json:"parcel"`
+}
+
+// Carrier settings, loaded from environment variables by loadCarrierConfig
+var carrierConfig = struct {
+	// ShipFrom is the return address printed on labels
+	ShipFrom PostalAddress
+}{}
+
+// shippingCarrier is the enabled carrier API, nil when none is configured
+var shippingCarrier ShippingCarrier
+
+func loadCarrierConfig() {
+	carrierConfig.ShipFrom = PostalAddress{
+		Name:       os.Getenv("SHIP_FROM_NAME"),
+		Line1:      os.Getenv("SHIP_FROM_LINE1"),
+		Line2:      os.Getenv("SHIP_FROM_LINE2"),
+		City:       os.Getenv("SHIP_FROM_CITY"),
+		Region:     os.Getenv("SHIP_FROM_REGION"),
+		PostalCode: os.Getenv("SHIP_FROM_POSTAL_CODE"),
+		Country:    os.Getenv("SHIP_FROM_COUNTRY"),
+		Phone:      os.Getenv("SHIP_FROM_PHONE"),
+	}
+
+	if key := os.Getenv("EASYPOST_API_KEY"); key != "" {
+		if err := validateAddress(&carrierConfig.ShipFrom); err != nil {
+			log.Fatalf("Invalid SHIP_FROM address: %v", err)
+		}
+		shippingCarrier = newEasyPostCarrier(key, os.Getenv("EASYPOST_WEBHOOK_SECRET"))
+	}
+}
+
+// ADMIN SHIPPING LABELS
+// AdminBuyShippingLabelHandler buys a label for the shipment from the carrier and stores its
+// URL and cost. The carrier's tracking number is kept unless the shipment already has one.
+func AdminBuyShippingLabelHandler(w http.ResponseWriter, r *http.Request) {
+	shipmentID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid shipment ID")
+		return
+	}
+
+	var labelRequest LabelPurchaseRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	// The body is optional; it only picks the service and parcel
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &labelRequest); err != nil {
+			log.Println("Error decoding JSON:", err)
+			handlers.WriteInvalidJSON(w)
+			return
+		}
+	}
+
+	labelRequest.Service = strings.TrimSpace(labelRequest.Service)
+	var validationErr error
+	switch {
+	case len(labelRequest.Service) > 100:
+		validationErr = handlers.NewFieldError("service", "service must be at most 100 characters")
+	case labelRequest.Parcel != nil && labelRequest.Parcel.Weight <= 0:
+		validationErr = handlers.NewFieldError("parcel.weight", "parcel.weight must be more than 0")
+	case labelRequest.Parcel != nil && (labelRequest.Parcel.Length < 0 || labelRequest.Parcel.Width < 0 || labelRequest.Parcel.Height < 0):
+		validationErr = handlers.NewFieldError("parcel", "parcel dimensions must not be negative")
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return
+	}
+
+	if shippingCarrier == nil {
+		handlers.WriteError(w, http.StatusServiceUnavailable, "No shipping carrier is configured")
+		return
+	}
+
+	shipment, err := buyShippingLabel(r.Context(), shipmentID, labelRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Shipment not found")
+		return
+	}
+	if err == errLabelExists {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err == errNoShippingAddress {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Error buying label for shipment %d: %v", shipmentID, err)
+		handlers.WriteError(w, http.StatusBadGateway, "Shipping carrier error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, shipment)
+}
+
+// buyShippingLabel buys the label while holding the shipment's row, so two requests can't
+// both pay for one
+func buyShippingLabel(ctx context.Context, shipmentID int, req LabelPurchaseRequest) (*Shipment, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	shipment := &Shipment{ID: shipmentID}
+	var labelURL sql.NullString
+	err = tx.QueryRowContext(ctx, `
+		SELECT order_id, COALESCE(tracking_number, ''), shipped_at, label_url
+		FROM shipments
+		WHERE id = $1
+		FOR UPDATE
+	`, shipmentID).Scan(&shipment.OrderID, &shipment.TrackingNumber, &shipment.ShippedAt, &labelURL)
+	if err != nil {
+		return nil, err
+	}
+	if labelURL.Valid {
+		return nil, errLabelExists
+	}
+
+	label := LabelRequest{ShipmentID: shipmentID, From: carrierConfig.ShipFrom, Service: req.Service}
+	to := &label.To
+	err = tx.QueryRowContext(ctx, `
+		SELECT name, line1, COALESCE(line2, ''), city, COALESCE(region, ''), COALESCE(postal_code, ''), country, COALESCE(phone, '')
+		FROM order_addresses
+		WHERE order_id = $1 AND type = $2
+	`, shipment.OrderID, addressTypeShipping).Scan(&to.Name, &to.Line1, &to.Line2, &to.City, &to.Region, &to.PostalCode, &to.Country, &to.Phone)
+	if isNoRows(err) {
+		return nil, errNoShippingAddress
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Parcel != nil {
+		label.Parcel = *req.Parcel
+	} else {
+		err = tx.QueryRowContext(ctx, `
+			SELECT COALESCE(SUM(`+shippingWeightSQL+` * si.quantity), 0)
+			FROM shipment_items si
+			JOIN products p ON si.product_id = p.id
+			WHERE si.shipment_id = $1
+		`, shipmentID).Scan(&label.Parcel.Weight)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	bought, err := shippingCarrier.BuyLabel(ctx, label)
+	if err != nil {
+		return nil, err
+	}
+
+	shipment.Carrier = bought.Carrier
+	shipment.Service = bought.Service
+	shipment.LabelURL = bought.LabelURL
+	shipment.LabelCost = roundCents(bought.Cost)
+	shipment.LabelCurrency = bought.Currency
+	if shipment.TrackingNumber == "" {
+		shipment.TrackingNumber = bought.TrackingNumber
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE shipments
+		SET carrier = $1, service = $2, label_url = $3, label_cost = $4, label_currency = $5,
+			label_reference = $6, tracking_number = NULLIF($7, '')
+		WHERE id = $8
+	`, shipment.Carrier, shipment.Service, shipment.LabelURL, shipment.LabelCost, shipment.LabelCurrency,
+		bought.Reference, shipment.TrackingNumber, shipmentID)
+	if err != nil {
+		// The label is paid for at the carrier, so it must not get lost
+		log.Printf("Error saving label %s (%s) of shipment %d: %v", bought.Reference, bought.LabelURL, shipmentID, err)
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error saving label %s (%s) of shipment %d: %v", bought.Reference, bought.LabelURL, shipmentID, err)
+		return nil, err
+	}
+
+	shipment.Items, err = getShipmentItems(ctx, shipmentID)
+	if err != nil {
+		return nil, err
+	}
+	return shipment, nil
+}
+
+func getShipmentItems(ctx context.Context, shipmentID int) ([]ShipmentItem, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT product_id, variant_id, quantity
+		FROM shipment_items
+		WHERE shipment_id = $1
+		ORDER BY product_id, variant_id NULLS FIRST
+	`, shipmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]ShipmentItem, 0)
+	for rows.Next() {
+		var item ShipmentItem
+		if err := rows.Scan(&item.ProductID, &item.VariantID, &item.Quantity); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
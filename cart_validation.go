@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const (
+	cartIssuePriceChanged      = "price_changed"
+	cartIssueInsufficientStock = "insufficient_stock"
+	cartIssueOutOfStock        = "out_of_stock"
+	// cartIssueShippingRestricted is only checked when validating for a country
+	cartIssueShippingRestricted = "shipping_restricted"
+)
+
+// CartItemCheck reports what changed for one cart item since it was added or last validated
+type CartItemCheck struct {
+	ItemID    int      `json:"item_id"`
+	ProductID int      `json:"product_id"`
+	VariantID *int     `json:"variant_id,omitempty"`
+	Quantity  int      `json:"quantity"`
+	Issues    []string `json:"issues"`
+	// PreviousPrice is only set when the price changed
+	PreviousPrice *float64 `json:"previous_price,omitempty"`
+	Price         float64  `json:"price"`
+	// Available is the product's stock, shared by all variants of the product in the cart
+	Available int `json:"available"`
+}
+
+type CartValidation struct {
+	// Valid is true when the cart has items and none of them has an issue
+	Valid bool            `json:"valid"`
+	Items []CartItemCheck `json:"items"`
+	Cart  *Cart           `json:"cart"`
+}
+
+// CART VALIDATION
+// ValidateCartHandler re-checks every cart item against current prices and stock before checkout,
+// and with ?country= whether it can ship there. The current prices are remembered, so validating
+// again only reports newer changes.
+func ValidateCartHandler(w http.ResponseWriter, r *http.Request) {
+	country := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("country")))
+	if country != "" && !countryCodes[country] {
+		handlers.WriteFieldError(w, "country", "country must be a 2-letter country code")
+		return
+	}
+
+	owner, err := resolveCartOwner(w, r, false)
+	var validation *CartValidation
+	if err == nil {
+		validation, err = validateCart(r.Context(), owner, country)
+	}
+	if err != nil {
+		log.Println("Error validating cart:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, validation)
+}
+
+func validateCart(ctx context.Context, owner cartOwner, country string) (*CartValidation, error) {
+	cart, err := getCart(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	units := make(map[int]int)
+	productIDs := make([]int, 0, len(cart.Items))
+	for _, item := range cart.Items {
+		if _, ok := units[item.Product.ID]; !ok {
+			productIDs = append(productIDs, item.Product.ID)
+		}
+		units[item.Product.ID] += item.Quantity
+	}
+	stock, err := getProductStock(ctx, productIDs)
+	if err != nil {
+		return nil, err
+	}
+	restrictedIDs, err := cartRestrictedProductIDs(ctx, cart, country)
+	if err != nil {
+		return nil, err
+	}
+	restricted := make(map[int]bool, len(restrictedIDs))
+	for _, productID := range restrictedIDs {
+		restricted[productID] = true
+	}
+
+	validation := &CartValidation{Valid: len(cart.Items) > 0, Items: make([]CartItemCheck, 0, len(cart.Items)), Cart: cart}
+	for _, item := range cart.Items {
+		check := CartItemCheck{
+			ItemID:    item.ID,
+			ProductID: item.Product.ID,
+			Quantity:  item.Quantity,
+			Issues:    make([]string, 0),
+			Price:     item.Product.Price,
+			Available: stock[item.Product.ID],
+		}
+		if item.Product.Variant != nil {
+			check.VariantID = &item.Product.Variant.ID
+		}
+
+		if item.seenPrice != nil && *item.seenPrice != item.Product.Price {
+			check.Issues = append(check.Issues, cartIssuePriceChanged)
+			check.PreviousPrice = item.seenPrice
+		}
+		switch {
+		case check.Available <= 0:
+			check.Issues = append(check.Issues, cartIssueOutOfStock)
+		case check.Available < units[item.Product.ID]:
+			check.Issues = append(check.Issues, cartIssueInsufficientStock)
+		}
+		if restricted[item.Product.ID] {
+			check.Issues = append(check.Issues, cartIssueShippingRestricted)
+		}
+
+		if len(check.Issues) > 0 {
+			validation.Valid = false
+		}
+		if item.seenPrice == nil || *item.seenPrice != item.Product.Price {
+			if _, err := db.ExecContext(ctx, "UPDATE cart_items SET unit_price = $1 WHERE id = $2", item.Product.Price, item.ID); err != nil {
+				return nil, err
+			}
+		}
+		validation.Items = append(validation.Items, check)
+	}
+
+	return validation, nil
+}
+
+// getProductStock returns the current stock of each product
+func getProductStock(ctx context.Context, productIDs []int) (map[int]int, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, stock FROM products WHERE id = ANY($1)", pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stock := make(map[int]int)
+	for rows.Next() {
+		var productID, quantity int
+		if err := rows.Scan(&productID, &quantity); err != nil {
+			return nil, err
+		}
+		stock[productID] = quantity
+	}
+
+	return stock, rows.Err()
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errCartEmpty = errors.New("cart is empty")
+
+// Cart settings, loaded from environment variables by loadCartConfig
+var cartConfig = struct {
+	// Retention is how long a cart is kept after an item was last added to it
+	Retention time.Duration
+}{
+	Retention: 30 * 24 * time.Hour,
+}
+
+// maxCartItemQuantity caps a single cart line so typos like 1000 instead of 10 are caught early
+const maxCartItemQuantity = 999
+
+type Cart struct {
+	ID       int        `json:"cart_id"`
+	Name     string     `json:"name,omitempty"`
+	Items    []CartItem `json:"items"`
+	Subtotal float64    `json:"subtotal"`
+	// CouponCode is the coupon applied with /cart/apply-coupon, which takes nothing off while it
+	// doesn't apply to the cart
+	CouponCode string `json:"coupon_code,omitempty"`
+	// Promotions are the automatic promotions the cart gets
+	Promotions []AppliedPromotion `json:"promotions,omitempty"`
+	// Discount is what the promotions and coupon take off the subtotal
+	Discount float64 `json:"discount"`
+}
+
+// CartItem is one line of a cart. Product.Price is the current (variant) price.
+type CartItem struct {
+	ID        int     `json:"item_id"`
+	Product   Product `json:"product"`
+	Quantity  int     `json:"quantity"`
+	LineTotal float64 `json:"line_total"`
+	// seenPrice is the price when the item was added or last validated, nil for older items
+	seenPrice *float64
+}
+
+type CartItemRequest struct {
+	ProductID int  `json:"product_id"`
+	VariantID *int `json:"variant_id"`
+	Quantity  int  `json:"quantity"`
+}
+
+type CartCheckoutRequest struct {
+	ReservationToken string `json:"reservation_token"`
+	OrderAddressRequest
+	// Destination is the shipping address's
+	Destination    *Destination    `json:"-"`
+	ShippingMethod string          `json:"shipping_method"`
+	RedeemPoints   int             `json:"redeem_points"`
+	Payment        *PaymentRequest `json:"payment"`
+}
+
+func loadCartConfig() {
+	if v := os.Getenv("CART_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid CART_RETENTION %q", v)
+		}
+		cartConfig.Retention = d
+	}
+}
+
+// CART
+func CartHandler(w http.ResponseWriter, r *http.Request) {
+	owner, err := resolveCartOwner(w, r, false)
+	if err != nil {
+		log.Println("Error resolving cart:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeCart(r.Context(), w, http.StatusOK, owner)
+}
+
+// AddCartItemHandler adds the product to the cart, or raises its quantity if it is already there
+func AddCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	var itemRequest CartItemRequest
+	err = json.Unmarshal(body, &itemRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+	if itemRequest.Quantity == 0 {
+		itemRequest.Quantity = 1
+	}
+
+	line := OrderLineRequest{ProductID: itemRequest.ProductID, VariantID: itemRequest.VariantID, Quantity: itemRequest.Quantity}
+	err = validateOrderLines(r.Context(), []OrderLineRequest{line})
+	if err == nil && itemRequest.Quantity > maxCartItemQuantity {
+		err = handlers.FieldErrorf("quantity", "quantity must be at most %d", maxCartItemQuantity)
+	}
+	if err != nil && isOrderValidationError(err) {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err != nil {
+		log.Println("Error validating item:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// Guests get their cart cookie with the first item
+	owner, err := resolveCartOwner(w, r, true)
+	var cartID int
+	if err == nil {
+		cartID, err = getOrCreateCartID(r.Context(), owner)
+	}
+	if err == nil {
+		err = addCartItem(r.Context(), cartID, itemRequest)
+	}
+	if err != nil {
+		log.Println("Error adding cart item:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeCart(r.Context(), w, http.StatusCreated, owner)
+}
+
+// UpdateCartItemHandler sets the quantity of a cart item; quantity 0 removes it
+func UpdateCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.Atoi(mux.Vars(r)["itemID"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid item ID")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	var itemRequest CartItemRequest
+	err = json.Unmarshal(body, &itemRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+	if itemRequest.Quantity < 0 || itemRequest.Quantity > maxCartItemQuantity {
+		handlers.WriteValidationError(w, handlers.FieldErrorf("quantity", "quantity must be between 0 and %d", maxCartItemQuantity))
+		return
+	}
+
+	owner, err := resolveCartOwner(w, r, false)
+	var cartID int
+	if err == nil {
+		cartID, err = findCartID(r.Context(), owner)
+	}
+
+	var result sql.Result
+	if err == nil && itemRequest.Quantity == 0 {
+		result, err = db.ExecContext(r.Context(), "DELETE FROM cart_items WHERE id = $1 AND cart_id = $2", itemID, cartID)
+	} else if err == nil {
+		result, err = db.ExecContext(r.Context(), "UPDATE cart_items SET quantity = $1 WHERE id = $2 AND cart_id = $3", itemRequest.Quantity, itemID, cartID)
+	}
+	if !writeCartItemResult(w, result, err) {
+		return
+	}
+
+	writeCart(r.Context(), w, http.StatusOK, owner)
+}
+
+func DeleteCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.Atoi(mux.Vars(r)["itemID"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid item ID")
+		return
+	}
+
+	owner, err := resolveCartOwner(w, r, false)
+	var cartID int
+	if err == nil {
+		cartID, err = findCartID(r.Context(), owner)
+	}
+
+	var result sql.Result
+	if err == nil {
+		result, err = db.ExecContext(r.Context(), "DELETE FROM cart_items WHERE id = $1 AND cart_id = $2", itemID, cartID)
+	}
+	if !writeCartItemResult(w, result, err) {
+		return
+	}
+
+	writeCart(r.Context(), w, http.StatusOK, owner)
+}
+
+// CartCheckoutHandler places an order for everything in the active cart and empties it
+func CartCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	checkoutRequest, ok := readCartCheckoutRequest(w, r)
+	if !ok {
+		return
+	}
+
+	customerID := getCustomerID(r)
+	// A guest cart still in the cookie is merged first, so checkout sees everything the customer added
+	if err := mergeGuestCart(w, r, customerID); err != nil {
+		log.Println("Error merging guest cart:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeCartCheckout(w, r, cartOwner{CustomerID: customerID}, checkoutRequest)
+}
+
+func readCartCheckoutRequest(w http.ResponseWriter, r *http.Request) (CartCheckoutRequest, bool) {
+	var checkoutRequest CartCheckoutRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return checkoutRequest, false
+	}
+	// The body is optional; it only carries the reservation token, shipping details and payment
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &checkoutRequest); err != nil {
+			log.Println("Error decoding JSON:", err)
+			handlers.WriteInvalidJSON(w)
+			return checkoutRequest, false
+		}
+	}
+	checkoutRequest.Destination, err = checkoutRequest.OrderAddressRequest.resolve(r.Context(), getCustomerID(r))
+	if err == nil {
+		err = validateShipping(r.Context(), checkoutRequest.Destination, checkoutRequest.ShippingMethod)
+	}
+	if err == nil {
+		err = validatePayment(r.Context(), getCustomerID(r), checkoutRequest.Payment)
+	}
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return checkoutRequest, false
+	}
+	return checkoutRequest, true
+}
+
+// writeCartCheckout checks out the owner's cart and writes the new order ID or the error response
+func writeCartCheckout(w http.ResponseWriter, r *http.Request, owner cartOwner, req CartCheckoutRequest) {
+	orderID, err := checkoutCart(r.Context(), owner, req)
+	if err == errCartEmpty {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if errors.Is(err, errInsufficientStock) || err == errReservationNotFound {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err == errReservationMismatch || err == errShippingAddressNotFound || err == errBillingAddressNotFound ||
+		err == errUnknownShippingMethod || err == errNoShippingOptions || errors.Is(err, errShippingRestricted) ||
+		errors.Is(err, errInvalidCoupon) || errors.Is(err, errInvalidPoints) {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err != nil {
+		log.Println("Error checking out cart:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writePlacedOrder(w, r, orderID, req.Payment)
+}
+
+// writeCartItemResult writes the error response for a cart item update and reports whether it succeeded
+func writeCartItemResult(w http.ResponseWriter, result sql.Result, err error) bool {
+	if err != nil {
+		log.Println("Error updating cart item:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return false
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Cart item not found")
+		return false
+	}
+	return true
+}
+
+func writeCart(ctx context.Context, w http.ResponseWriter, status int, owner cartOwner) {
+	cart, err := getCart(ctx, owner)
+	if err != nil {
+		log.Println("Error retrieving cart:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, status, cart)
+}
+
+// findCartID returns the owner's cart ID, or 0 when the owner has no cart yet
+func findCartID(ctx context.Context, owner cartOwner) (int, error) {
+	var cartID int
+	var err error
+	if owner.CartID != 0 {
+		err = db.QueryRowContext(ctx, "SELECT id FROM carts WHERE id = $1 AND customer_id = $2", owner.CartID, owner.CustomerID).Scan(&cartID)
+	} else if owner.CustomerID != 0 {
+		err = db.QueryRowContext(ctx, "SELECT id FROM carts WHERE customer_id = $1 AND active", owner.CustomerID).Scan(&cartID)
+	} else {
+		err = db.QueryRowContext(ctx, "SELECT id FROM carts WHERE guest_token_hash = $1", owner.GuestTokenHash).Scan(&cartID)
+	}
+	if isNoRows(err) {
+		return 0, nil
+	}
+	return cartID, err
+}
+
+func getOrCreateCartID(ctx context.Context, owner cartOwner) (int, error) {
+	var cartID int
+	var err error
+	if owner.CustomerID != 0 {
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO carts (customer_id)
+			VALUES ($1)
+			ON CONFLICT (customer_id) WHERE active DO UPDATE SET updated_at = NOW()
+			RETURNING id
+		`, owner.CustomerID).Scan(&cartID)
+	} else {
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO carts (guest_token_hash)
+			VALUES ($1)
+			ON CONFLICT (guest_token_hash) DO UPDATE SET updated_at = NOW()
+			RETURNING id
+		`, owner.GuestTokenHash).Scan(&cartID)
+	}
+	return cartID, err
+}
+
+// addCartItem also records the current price, which /cart/validate compares against later
+func addCartItem(ctx context.Context, cartID int, req CartItemRequest) error {
+	var customerID sql.NullInt64
+	var price sql.NullFloat64
+	err := db.QueryRowContext(ctx, `
+		SELECT customer_id, COALESCE(
+			(SELECT price FROM product_variants WHERE id = $2),
+			(SELECT price FROM products WHERE id = $3)
+		)
+		FROM carts WHERE id = $1
+	`, cartID, req.VariantID, req.ProductID).Scan(&customerID, &price)
+	if err != nil {
+		return err
+	}
+	pricing, err := currentPricing(ctx, db, int(customerID.Int64))
+	if err != nil {
+		return err
+	}
+	if price.Valid {
+		price.Float64 = pricing.price(req.ProductID, price.Float64)
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO cart_items (cart_id, product_id, variant_id, quantity, unit_price)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (cart_id, product_id, COALESCE(variant_id, 0))
+		DO UPDATE SET quantity = LEAST(cart_items.quantity + EXCLUDED.quantity, $6), unit_price = EXCLUDED.unit_price
+	`, cartID, req.ProductID, req.VariantID, req.Quantity, price, maxCartItemQuantity)
+	return err
+}
+
+// getCart returns the owner's cart with current prices; an owner without a cart gets an empty one
+func getCart(ctx context.Context, owner cartOwner) (*Cart, error) {
+	cart := &Cart{Items: make([]CartItem, 0)}
+	cartID, err := findCartID(ctx, owner)
+	if err != nil || cartID == 0 {
+		return cart, err
+	}
+	cart.ID = cartID
+	var couponID *int
+	if err := db.QueryRowContext(ctx, "SELECT name, coupon_id FROM carts WHERE id = $1", cartID).Scan(&cart.Name, &couponID); err != nil {
+		return nil, err
+	}
+
+	cart.Items, err = getCartItems(ctx, cart.ID, owner.CustomerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range cart.Items {
+		cart.Subtotal += item.LineTotal
+	}
+
+	// A coupon replaces the promotions unless they combine
+	cart.Promotions = make([]AppliedPromotion, 0)
+	if couponID == nil || discountConfig.CouponWithPromotions {
+		cart.Promotions, err = applyPromotions(ctx, db, cart.promotionLines())
+		if err != nil {
+			return nil, err
+		}
+	}
+	cart.Discount = promotionsDiscount(cart.Promotions)
+	if couponID != nil {
+		coupon, err := getCoupon(ctx, db, *couponID)
+		if err != nil {
+			return nil, err
+		}
+		cart.CouponCode = coupon.Code
+		discount, err := coupon.evaluate(ctx, db, owner.CustomerID, cart.productAmounts())
+		if errors.Is(err, errInvalidCoupon) {
+			discount, err = 0, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		cart.Discount = roundCents(math.Min(cart.Discount+discount, cart.Subtotal))
+	}
+	return cart, nil
+}
+
+// getCartItems returns the cart's items at what they cost the customer now
+func getCartItems(ctx context.Context, cartID, customerID int) ([]CartItem, error) {
+	pricing, err := currentPricing(ctx, db, customerID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT ci.id, ci.quantity, ci.unit_price,
+			   p.id, COALESCE(p.sku, ''), p.name, p.price, COALESCE(p.description, ''), COALESCE(p.image_url, ''), p.category_id,
+			   v.id, v.sku, v.options, v.price
+		FROM cart_items ci
+		JOIN products p ON ci.product_id = p.id
+		LEFT JOIN product_variants v ON ci.variant_id = v.id
+		WHERE ci.cart_id = $1
+		ORDER BY ci.id
+	`, cartID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]CartItem, 0)
+	for rows.Next() {
+		var item CartItem
+		var variant orderLineVariant
+		if err := rows.Scan(&item.ID, &item.Quantity, &item.seenPrice,
+			&item.Product.ID, &item.Product.SKU, &item.Product.Name, &item.Product.Price, &item.Product.Description, &item.Product.ImageURL, &item.Product.CategoryID,
+			&variant.ID, &variant.SKU, &variant.Options, &variant.Price); err != nil {
+			return nil, err
+		}
+		if err := variant.applyTo(&item.Product); err != nil {
+			return nil, err
+		}
+		pricing.apply(&item.Product)
+		item.LineTotal = item.Product.Price * float64(item.Quantity)
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// checkoutCart turns the cart into order lines and places the order. The checked out
+// items are removed in the same transaction, so the cart only empties if the order exists.
+func checkoutCart(ctx context.Context, owner cartOwner, req CartCheckoutRequest) (int, error) {
+	cart, err := getCart(ctx, owner)
+	if err != nil {
+		return 0, err
+	}
+	if len(cart.Items) == 0 {
+		return 0, errCartEmpty
+	}
+
+	orderRequest := OrderRequest{
+		CustomerID:          owner.CustomerID,
+		ReservationToken:    req.ReservationToken,
+		OrderAddressRequest: req.OrderAddressRequest,
+		Destination:         req.Destination,
+		ShippingMethod:      req.ShippingMethod,
+		CouponCode:          cart.CouponCode,
+		RedeemPoints:        req.RedeemPoints,
+		Payment:             req.Payment,
+	}
+	itemIDs := make([]int, 0, len(cart.Items))
+	for _, item := range cart.Items {
+		line := OrderLineRequest{ProductID: item.Product.ID, Quantity: item.Quantity}
+		if item.Product.Variant != nil {
+			line.VariantID = &item.Product.Variant.ID
+		}
+		orderRequest.Products = append(orderRequest.Products, line)
+		itemIDs = append(itemIDs, item.ID)
+	}
+	if err := checkShippingRestrictions(ctx, orderRequest); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	orderID, err := placeOrderTx(ctx, tx, orderRequest)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM cart_items WHERE id = ANY($1)", pq.Array(itemIDs)); err != nil {
+		return 0, err
+	}
+
+	return orderID, tx.Commit()
+}
+
+// deleteStaleCarts deletes carts that no item was added to within the retention period, and
+// guest carts whose cookie has expired. Reservations the customer made before the cart was
+// abandoned belong to its checkout, so they are released and their stock is returned.
+func deleteStaleCarts(ctx context.Context) {
+	_, err := db.ExecContext(ctx, `
+		WITH stale AS (
+			DELETE FROM carts
+			WHERE updated_at < NOW() - make_interval(secs => $1)
+			   OR (customer_id IS NULL AND updated_at < NOW() - make_interval(secs => $2))
+			RETURNING customer_id, updated_at
+		), abandoned AS (
+			DELETE FROM stock_reservations sr
+			USING stale
+			WHERE sr.customer_id = stale.customer_id AND sr.created_at <= stale.updated_at
+			RETURNING sr.product_id, sr.quantity
+		), released AS (
+			SELECT product_id, SUM(quantity) AS quantity
+			FROM abandoned
+			GROUP BY product_id
+		), updated AS (
+			UPDATE products p
+			SET stock = p.stock + released.quantity
+			FROM released
+			WHERE p.id = released.product_id
+			RETURNING p.id, released.quantity, p.stock
+		)
+		INSERT INTO stock_movements (product_id, change, stock_after, reason)
+		SELECT id, quantity, stock, $3
+		FROM updated
+	`, cartConfig.Retention.Seconds(), guestCartTTL.Seconds(), stockReasonReservationReleased)
+	if err != nil {
+		log.Println("Error deleting stale carts:", err)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/hanifmasy/simple-commerce/handlers"
+	"github.com/hanifmasy/simple-commerce/repository"
+	"github.com/hanifmasy/simple-commerce/service"
+)
+
+// newCategoryService wires the category service to the database
+func newCategoryService() *service.CategoryService {
+	return service.NewCategoryService(repository.NewCategoryRepository(db))
+}
+
+func newCategoryHandlers() *handlers.CategoryHandlers {
+	return &handlers.CategoryHandlers{Categories: newCategoryService()}
+}
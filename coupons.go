@@ -0,0 +1,638 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const (
+	// couponTypePercent takes Value percent off the subtotal
+	couponTypePercent = "percent"
+	// couponTypeFixed takes Value off the subtotal, at most the whole subtotal
+	couponTypeFixed = "fixed"
+)
+
+// errInvalidCoupon is returned, wrapped with the reason, for a coupon code that can't be used
+var errInvalidCoupon = handlers.NewFieldError("coupon_code", "coupon_code is not valid")
+
+// Coupon is a discount code customers enter at checkout
+type Coupon struct {
+	ID    int     `json:"coupon_id"`
+	Code  string  `json:"code"`
+	Type  string  `json:"type"`
+	Value float64 `json:"value"`
+	// MaxUses caps how many orders can use the coupon; nil is unlimited
+	MaxUses *int `json:"max_uses"`
+	// Uses counts the orders placed with the coupon, not counting cancelled ones
+	Uses int `json:"uses"`
+	// PerCustomerLimit caps how many orders each customer can use the coupon on; nil is unlimited
+	PerCustomerLimit *int `json:"per_customer_limit"`
+	// MinSubtotal is the subtotal an order needs for the coupon to apply
+	MinSubtotal *float64 `json:"min_subtotal"`
+	// ProductIDs and CategoryIDs, with their subcategories, limit the discount to those
+	// products; with neither, the whole subtotal is discounted
+	ProductIDs  []int64 `json:"product_ids"`
+	CategoryIDs []int64 `json:"category_ids"`
+	// CustomerID is the only customer who can use the coupon, for coupons given as rewards
+	CustomerID *int `json:"customer_id,omitempty"`
+	// ExpiresAt is when the coupon stops working; nil never expires
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type CouponRequest struct {
+	Code             string     `json:"code"`
+	Type             string     `json:"type"`
+	Value            float64    `json:"value"`
+	MaxUses          *int       `json:"max_uses"`
+	PerCustomerLimit *int       `json:"per_customer_limit"`
+	MinSubtotal      *float64   `json:"min_subtotal"`
+	ProductIDs       []int64    `json:"product_ids"`
+	CategoryIDs      []int64    `json:"category_ids"`
+	ExpiresAt        *time.Time `json:"expires_at"`
+}
+
+// querier is a *sql.DB or *sql.Tx
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type ApplyCouponRequest struct {
+	CouponCode string `json:"coupon_code"`
+}
+
+// CART COUPON
+// ApplyCouponHandler puts the coupon on the cart, replacing the one already there. The coupon
+// is checked again when the cart is checked out.
+func ApplyCouponHandler(w http.ResponseWriter, r *http.Request) {
+	var applyRequest ApplyCouponRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &applyRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	owner, err := resolveCartOwner(w, r, false)
+	var cartID int
+	if err == nil {
+		cartID, err = findCartID(r.Context(), owner)
+	}
+	if err != nil {
+		log.Println("Error retrieving cart:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if cartID == 0 {
+		handlers.WriteValidationError(w, errCartEmpty)
+		return
+	}
+
+	// The coupon must apply to the cart as it is now; the cart shows no discount if it stops
+	// applying later
+	var cart *Cart
+	coupon, err := findCoupon(r.Context(), db, applyRequest.CouponCode, false)
+	if err == nil {
+		cart, err = getCart(r.Context(), owner)
+	}
+	if err == nil {
+		_, err = coupon.evaluate(r.Context(), db, owner.CustomerID, cart.productAmounts())
+	}
+	if errors.Is(err, errInvalidCoupon) {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err == nil {
+		_, err = db.ExecContext(r.Context(), "UPDATE carts SET coupon_id = $1 WHERE id = $2", coupon.ID, cartID)
+	}
+	if err != nil {
+		log.Println("Error applying coupon:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeCart(r.Context(), w, http.StatusOK, owner)
+}
+
+func RemoveCouponHandler(w http.ResponseWriter, r *http.Request) {
+	owner, err := resolveCartOwner(w, r, false)
+	var cartID int
+	if err == nil {
+		cartID, err = findCartID(r.Context(), owner)
+	}
+	if err == nil && cartID != 0 {
+		_, err = db.ExecContext(r.Context(), "UPDATE carts SET coupon_id = NULL WHERE id = $1", cartID)
+	}
+	if err != nil {
+		log.Println("Error removing coupon:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeCart(r.Context(), w, http.StatusOK, owner)
+}
+
+// ADMIN COUPONS
+func AdminCouponsHandler(w http.ResponseWriter, r *http.Request) {
+	coupons, err := getCoupons(r.Context())
+	if err != nil {
+		log.Println("Error retrieving coupons:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, coupons)
+}
+
+func AdminCreateCouponHandler(w http.ResponseWriter, r *http.Request) {
+	couponRequest, ok := readCouponRequest(w, r)
+	if !ok {
+		return
+	}
+
+	coupon, err := saveCoupon(r.Context(), 0, couponRequest)
+	if isUniqueViolation(err) {
+		handlers.WriteError(w, http.StatusConflict, "Coupon code already exists")
+		return
+	}
+	if err != nil {
+		log.Println("Error creating coupon:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, coupon)
+}
+
+// AdminUpdateCouponHandler changes the coupon for orders placed from now on; orders already
+// placed keep their discount
+func AdminUpdateCouponHandler(w http.ResponseWriter, r *http.Request) {
+	couponID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid coupon ID")
+		return
+	}
+
+	couponRequest, ok := readCouponRequest(w, r)
+	if !ok {
+		return
+	}
+
+	coupon, err := saveCoupon(r.Context(), couponID, couponRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Coupon not found")
+		return
+	}
+	if isUniqueViolation(err) {
+		handlers.WriteError(w, http.StatusConflict, "Coupon code already exists")
+		return
+	}
+	if err != nil {
+		log.Println("Error updating coupon:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, coupon)
+}
+
+// AdminDeleteCouponHandler deletes the coupon and takes it off carts. Orders placed with it
+// keep their discount and coupon code.
+func AdminDeleteCouponHandler(w http.ResponseWriter, r *http.Request) {
+	couponID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid coupon ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM coupons WHERE id = $1", couponID)
+	if err != nil {
+		log.Println("Error deleting coupon:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Coupon not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func readCouponRequest(w http.ResponseWriter, r *http.Request) (CouponRequest, bool) {
+	var couponRequest CouponRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return couponRequest, false
+	}
+
+	err = json.Unmarshal(body, &couponRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return couponRequest, false
+	}
+
+	couponRequest.Code = normalizeCouponCode(couponRequest.Code)
+	couponRequest.Type = strings.ToLower(strings.TrimSpace(couponRequest.Type))
+
+	var validationErr error
+	switch {
+	case couponRequest.Code == "" || len(couponRequest.Code) > 50:
+		validationErr = handlers.NewFieldError("code", "code is required and must be at most 50 characters")
+	case couponRequest.Type != couponTypePercent && couponRequest.Type != couponTypeFixed:
+		validationErr = handlers.NewFieldError("type", "type must be percent or fixed")
+	case couponRequest.Value <= 0:
+		validationErr = handlers.NewFieldError("value", "value must be positive")
+	case couponRequest.Type == couponTypePercent && couponRequest.Value > 100:
+		validationErr = handlers.NewFieldError("value", "value must be at most 100 for a percent coupon")
+	case couponRequest.MaxUses != nil && *couponRequest.MaxUses < 1:
+		validationErr = handlers.NewFieldError("max_uses", "max_uses must be at least 1")
+	case couponRequest.PerCustomerLimit != nil && *couponRequest.PerCustomerLimit < 1:
+		validationErr = handlers.NewFieldError("per_customer_limit", "per_customer_limit must be at least 1")
+	case couponRequest.MinSubtotal != nil && *couponRequest.MinSubtotal < 0:
+		validationErr = handlers.NewFieldError("min_subtotal", "min_subtotal must not be negative")
+	}
+	if validationErr == nil {
+		validationErr, err = checkCouponScope(r.Context(), couponRequest)
+		if err != nil {
+			log.Println("Error checking coupon products:", err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return couponRequest, false
+		}
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return couponRequest, false
+	}
+
+	return couponRequest, true
+}
+
+// checkCouponScope returns a validation error when one of the coupon's products or categories
+// doesn't exist
+func checkCouponScope(ctx context.Context, req CouponRequest) (error, error) {
+	for _, scope := range []struct {
+		Field string
+		Table string
+		IDs   []int64
+	}{{"product_ids", "products", req.ProductIDs}, {"category_ids", "categories", req.CategoryIDs}} {
+		if len(scope.IDs) == 0 {
+			continue
+		}
+		var missing sql.NullInt64
+		err := db.QueryRowContext(ctx, `
+			SELECT MIN(id) FROM UNNEST($1::INT[]) AS id
+			WHERE id NOT IN (SELECT id FROM `+scope.Table+`)
+		`, pq.Array(scope.IDs)).Scan(&missing)
+		if err != nil {
+			return nil, err
+		}
+		if missing.Valid {
+			return handlers.FieldErrorf(scope.Field, "%s: %d does not exist", scope.Field, missing.Int64), nil
+		}
+	}
+	return nil, nil
+}
+
+// normalizeCouponCode makes codes case-insensitive
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// saveCoupon inserts a new coupon when couponID is 0, otherwise updates it
+func saveCoupon(ctx context.Context, couponID int, req CouponRequest) (*Coupon, error) {
+	var err error
+	if couponID == 0 {
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO coupons (code, type, value, max_uses, expires_at, per_customer_limit, min_subtotal, product_ids, category_ids)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			RETURNING id
+		`, req.Code, req.Type, req.Value, req.MaxUses, req.ExpiresAt, req.PerCustomerLimit, req.MinSubtotal,
+			pq.Array(nonNilIDs(req.ProductIDs)), pq.Array(nonNilIDs(req.CategoryIDs))).Scan(&couponID)
+	} else {
+		err = db.QueryRowContext(ctx, `
+			UPDATE coupons
+			SET code = $1, type = $2, value = $3, max_uses = $4, expires_at = $5,
+				per_customer_limit = $6, min_subtotal = $7, product_ids = $8, category_ids = $9
+			WHERE id = $10
+			RETURNING id
+		`, req.Code, req.Type, req.Value, req.MaxUses, req.ExpiresAt, req.PerCustomerLimit, req.MinSubtotal,
+			pq.Array(nonNilIDs(req.ProductIDs)), pq.Array(nonNilIDs(req.CategoryIDs)), couponID).Scan(&couponID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return getCoupon(ctx, db, couponID)
+}
+
+// nonNilIDs stores a missing list of IDs as an empty array
+func nonNilIDs(ids []int64) []int64 {
+	if ids == nil {
+		return []int64{}
+	}
+	return ids
+}
+
+const couponColumnsSQL = `
+	c.id, c.code, c.type, c.value, c.max_uses,
+	(SELECT COUNT(*) FROM coupon_redemptions r WHERE r.coupon_id = c.id),
+	c.per_customer_limit, c.min_subtotal, c.product_ids, c.category_ids, c.expires_at, c.created_at, c.customer_id
+`
+
+func scanCoupon(row interface{ Scan(...interface{}) error }) (*Coupon, error) {
+	coupon := &Coupon{}
+	var maxUses, perCustomerLimit sql.NullInt64
+	var minSubtotal sql.NullFloat64
+	var expiresAt sql.NullTime
+	err := row.Scan(&coupon.ID, &coupon.Code, &coupon.Type, &coupon.Value, &maxUses,
+		&coupon.Uses, &perCustomerLimit, &minSubtotal, pq.Array(&coupon.ProductIDs), pq.Array(&coupon.CategoryIDs),
+		&expiresAt, &coupon.CreatedAt, &coupon.CustomerID)
+	if err != nil {
+		return nil, err
+	}
+	if maxUses.Valid {
+		n := int(maxUses.Int64)
+		coupon.MaxUses = &n
+	}
+	if perCustomerLimit.Valid {
+		n := int(perCustomerLimit.Int64)
+		coupon.PerCustomerLimit = &n
+	}
+	if minSubtotal.Valid {
+		coupon.MinSubtotal = &minSubtotal.Float64
+	}
+	if expiresAt.Valid {
+		coupon.ExpiresAt = &expiresAt.Time
+	}
+	return coupon, nil
+}
+
+func getCoupon(ctx context.Context, q querier, couponID int) (*Coupon, error) {
+	return scanCoupon(q.QueryRowContext(ctx, "SELECT "+couponColumnsSQL+" FROM coupons c WHERE c.id = $1", couponID))
+}
+
+func getCoupons(ctx context.Context) ([]Coupon, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+couponColumnsSQL+`
+		FROM coupons c
+		ORDER BY c.created_at DESC, c.id DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	coupons := make([]Coupon, 0)
+	for rows.Next() {
+		coupon, err := scanCoupon(rows)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, *coupon)
+	}
+
+	return coupons, rows.Err()
+}
+
+// findCoupon looks the coupon up by its code, locking it with forUpdate. An unknown code
+// returns an error wrapping errInvalidCoupon.
+func findCoupon(ctx context.Context, q querier, code string, forUpdate bool) (*Coupon, error) {
+	query := "SELECT " + couponColumnsSQL + " FROM coupons c WHERE c.code = $1"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	coupon, err := scanCoupon(q.QueryRowContext(ctx, query, normalizeCouponCode(code)))
+	if isNoRows(err) {
+		return nil, fmt.Errorf("%w: no coupon has this code", errInvalidCoupon)
+	}
+	return coupon, err
+}
+
+// checkUsable fails with an error wrapping errInvalidCoupon when the coupon has expired or
+// has been used up
+func (c *Coupon) checkUsable(now time.Time) error {
+	if c.ExpiresAt != nil && !now.Before(*c.ExpiresAt) {
+		return fmt.Errorf("%w: it has expired", errInvalidCoupon)
+	}
+	if c.MaxUses != nil && c.Uses >= *c.MaxUses {
+		return fmt.Errorf("%w: it has reached its usage limit", errInvalidCoupon)
+	}
+	return nil
+}
+
+// checkCustomerUses fails with an error wrapping errInvalidCoupon when the coupon is another
+// customer's or the customer has used it as many times as they may. Guests, with customerID 0,
+// aren't limited until they log in to check out.
+func (c *Coupon) checkCustomerUses(ctx context.Context, q querier, customerID int) error {
+	if c.CustomerID != nil && *c.CustomerID != customerID {
+		return fmt.Errorf("%w: it was given to another customer", errInvalidCoupon)
+	}
+	if c.PerCustomerLimit == nil || customerID == 0 {
+		return nil
+	}
+	var uses int
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM coupon_redemptions WHERE coupon_id = $1 AND customer_id = $2", c.ID, customerID).Scan(&uses)
+	if err != nil {
+		return err
+	}
+	if uses >= *c.PerCustomerLimit {
+		return fmt.Errorf("%w: you have already used it as many times as allowed", errInvalidCoupon)
+	}
+	return nil
+}
+
+// validateCoupon checks that the customer can use the coupon code now. Whether it applies to
+// the order's products is checked when the order is priced.
+func validateCoupon(ctx context.Context, code string, customerID int) error {
+	coupon, err := findCoupon(ctx, db, code, false)
+	if err != nil {
+		return err
+	}
+	if err := coupon.checkUsable(time.Now()); err != nil {
+		return err
+	}
+	return coupon.checkCustomerUses(ctx, db, customerID)
+}
+
+// evaluate checks that the customer can use the coupon on an order of the amounts (product
+// ID -> price of its units) and returns the discount. It fails with an error wrapping
+// errInvalidCoupon when the coupon has expired or is used up, or doesn't apply to the order.
+func (c *Coupon) evaluate(ctx context.Context, q querier, customerID int, amounts map[int]float64) (float64, error) {
+	if err := c.checkUsable(time.Now()); err != nil {
+		return 0, err
+	}
+	if err := c.checkCustomerUses(ctx, q, customerID); err != nil {
+		return 0, err
+	}
+	return c.orderDiscount(ctx, q, amounts)
+}
+
+// orderDiscount returns the coupon's discount on an order of the amounts. It fails with an
+// error wrapping errInvalidCoupon when the order's subtotal is under the minimum or none of
+// its products are ones the coupon is limited to.
+func (c *Coupon) orderDiscount(ctx context.Context, q querier, amounts map[int]float64) (float64, error) {
+	var subtotal float64
+	productIDs := make([]int, 0, len(amounts))
+	for productID, amount := range amounts {
+		subtotal += amount
+		productIDs = append(productIDs, productID)
+	}
+	if c.MinSubtotal != nil && roundCents(subtotal) < *c.MinSubtotal {
+		return 0, fmt.Errorf("%w: it needs a subtotal of at least %.2f", errInvalidCoupon, *c.MinSubtotal)
+	}
+	if len(c.ProductIDs) == 0 && len(c.CategoryIDs) == 0 {
+		return c.discount(subtotal), nil
+	}
+
+	scoped, err := scopedProductIDs(ctx, q, productIDs, c.ProductIDs, c.CategoryIDs)
+	if err != nil {
+		return 0, err
+	}
+	var eligible float64
+	for productID := range scoped {
+		eligible += amounts[productID]
+	}
+	if eligible <= 0 {
+		return 0, fmt.Errorf("%w: it doesn't apply to any of the products", errInvalidCoupon)
+	}
+	return c.discount(eligible), nil
+}
+
+// scopedProductIDs returns which of the products are among scopeProducts or in one of
+// scopeCategories or their subcategories
+func scopedProductIDs(ctx context.Context, q querier, productIDs []int, scopeProducts, scopeCategories []int64) (map[int]bool, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT id
+		FROM products
+		WHERE id = ANY($1) AND (id = ANY($2) OR category_id IN (
+			WITH RECURSIVE tree AS (
+				SELECT id FROM categories WHERE id = ANY($3)
+				UNION
+				SELECT c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+			)
+			SELECT id FROM tree
+		))
+	`, pq.Array(productIDs), pq.Array(scopeProducts), pq.Array(scopeCategories))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scoped := make(map[int]bool)
+	for rows.Next() {
+		var productID int
+		if err := rows.Scan(&productID); err != nil {
+			return nil, err
+		}
+		scoped[productID] = true
+	}
+
+	return scoped, rows.Err()
+}
+
+// discount returns what the coupon takes off the eligible subtotal
+func (c *Coupon) discount(subtotal float64) float64 {
+	discount := c.Value
+	if c.Type == couponTypePercent {
+		discount = subtotal * c.Value / 100
+	}
+	return roundCents(math.Max(0, math.Min(discount, subtotal)))
+}
+
+// applyDiscount takes the discount of the promotions and coupon off the quote, never more
+// than the subtotal. Tax is charged on the discounted subtotal.
+func applyDiscount(quote *Quote, couponCode string, discount float64) {
+	quote.CouponCode = couponCode
+	quote.Discount = roundCents(math.Min(discount, quote.Subtotal))
+	quote.Tax = roundCents((quote.Subtotal - quote.Discount) * quote.TaxRate)
+	quote.Total = roundCents(quote.Subtotal - quote.Discount + quote.Tax + quote.Shipping)
+}
+
+// redeemCoupon records the order's use of the coupon and returns its discount on the order.
+// The coupon is locked, so concurrent orders can't both take its last use.
+func redeemCoupon(ctx context.Context, tx *sql.Tx, orderID, customerID int, code string) (*Coupon, float64, error) {
+	coupon, err := findCoupon(ctx, tx, code, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	amounts, err := orderProductAmounts(ctx, tx, orderID)
+	if err != nil {
+		return nil, 0, err
+	}
+	discount, err := coupon.evaluate(ctx, tx, customerID, amounts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO coupon_redemptions (coupon_id, order_id, customer_id)
+		VALUES ($1, $2, $3)
+	`, coupon.ID, orderID, customerID)
+	if err != nil {
+		return nil, 0, err
+	}
+	coupon.Uses++
+	return coupon, discount, nil
+}
+
+// orderProductAmounts returns the price of each product's units on the order
+func orderProductAmounts(ctx context.Context, q querier, orderID int) (map[int]float64, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT product_id, SUM(unit_price_at_purchase * quantity)
+		FROM order_products
+		WHERE order_id = $1
+		GROUP BY product_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	amounts := make(map[int]float64)
+	for rows.Next() {
+		var productID int
+		var amount float64
+		if err := rows.Scan(&productID, &amount); err != nil {
+			return nil, err
+		}
+		amounts[productID] = amount
+	}
+
+	return amounts, rows.Err()
+}
+
+// productAmounts returns the price of each product's units in the cart
+func (c *Cart) productAmounts() map[int]float64 {
+	amounts := make(map[int]float64)
+	for _, item := range c.Items {
+		amounts[item.Product.ID] += item.LineTotal
+	}
+	return amounts
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errUnknownCustomerGroup = handlers.NewFieldError("group_id", "group_id does not exist")
+
+// errInvalidGroupPrice is returned, wrapped with the reason, when a group price can't be saved
+var errInvalidGroupPrice = handlers.NewFieldError("prices", "prices is not valid")
+
+// CustomerGroup prices products for its customers, such as wholesale buyers: a product's group
+// price replaces its price, and other products are DiscountPercent off
+type CustomerGroup struct {
+	ID              int          `json:"group_id"`
+	Name            string       `json:"name"`
+	DiscountPercent float64      `json:"discount_percent"`
+	Prices          []GroupPrice `json:"prices"`
+	CreatedAt       time.Time    `json:"created_at"`
+}
+
+// GroupPrice is a customer group's price for a product and all its variants
+type GroupPrice struct {
+	ProductID int     `json:"product_id"`
+	Price     float64 `json:"price"`
+}
+
+type CustomerGroupRequest struct {
+	Name            string       `json:"name"`
+	DiscountPercent float64      `json:"discount_percent"`
+	Prices          []GroupPrice `json:"prices"`
+}
+
+type AssignGroupRequest struct {
+	// GroupID is nil to take the customer out of their group
+	GroupID *int `json:"group_id"`
+}
+
+// groupPricing is what a customer's group does to prices; nil prices as usual
+type groupPricing struct {
+	DiscountPercent float64
+	Prices          map[int]float64
+}
+
+// ADMIN CUSTOMER GROUPS
+func AdminCustomerGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	groups, err := getCustomerGroups(r.Context())
+	if err != nil {
+		log.Println("Error retrieving customer groups:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, groups)
+}
+
+func AdminCreateCustomerGroupHandler(w http.ResponseWriter, r *http.Request) {
+	groupRequest, ok := readCustomerGroupRequest(w, r)
+	if !ok {
+		return
+	}
+
+	group, err := saveCustomerGroup(r.Context(), 0, groupRequest)
+	if isUniqueViolation(err) {
+		handlers.WriteError(w, http.StatusConflict, "Customer group name already exists")
+		return
+	}
+	if errors.Is(err, errInvalidGroupPrice) {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err != nil {
+		log.Println("Error creating customer group:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, group)
+}
+
+// AdminUpdateCustomerGroupHandler replaces the group's name, discount and prices. Orders
+// already placed keep the prices they were placed with.
+func AdminUpdateCustomerGroupHandler(w http.ResponseWriter, r *http.Request) {
+	groupID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid customer group ID")
+		return
+	}
+
+	groupRequest, ok := readCustomerGroupRequest(w, r)
+	if !ok {
+		return
+	}
+
+	group, err := saveCustomerGroup(r.Context(), groupID, groupRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Customer group not found")
+		return
+	}
+	if isUniqueViolation(err) {
+		handlers.WriteError(w, http.StatusConflict, "Customer group name already exists")
+		return
+	}
+	if errors.Is(err, errInvalidGroupPrice) {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err != nil {
+		log.Println("Error updating customer group:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, group)
+}
+
+// AdminDeleteCustomerGroupHandler deletes the group; its customers go back to the usual prices
+func AdminDeleteCustomerGroupHandler(w http.ResponseWriter, r *http.Request) {
+	groupID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid customer group ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM customer_groups WHERE id = $1", groupID)
+	if err != nil {
+		log.Println("Error deleting customer group:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Customer group not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func AdminAssignCustomerGroupHandler(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid customer ID")
+		return
+	}
+
+	var assignRequest AssignGroupRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &assignRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	err = db.QueryRowContext(r.Context(), "UPDATE customers SET group_id = $1 WHERE id = $2 RETURNING id", assignRequest.GroupID, customerID).Scan(&customerID)
+	if isForeignKeyViolation(err) {
+		handlers.WriteValidationError(w, errUnknownCustomerGroup)
+		return
+	}
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Customer not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error assigning customer group:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Customer group assigned successfully"))
+}
+
+func readCustomerGroupRequest(w http.ResponseWriter, r *http.Request) (CustomerGroupRequest, bool) {
+	var groupRequest CustomerGroupRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return groupRequest, false
+	}
+
+	err = json.Unmarshal(body, &groupRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return groupRequest, false
+	}
+
+	groupRequest.Name = strings.TrimSpace(groupRequest.Name)
+
+	var validationErr error
+	switch {
+	case groupRequest.Name == "" || len(groupRequest.Name) > 100:
+		validationErr = handlers.NewFieldError("name", "name is required and must be at most 100 characters")
+	case groupRequest.DiscountPercent < 0 || groupRequest.DiscountPercent > 100:
+		validationErr = handlers.NewFieldError("discount_percent", "discount_percent must be between 0 and 100")
+	}
+	seen := make(map[int]bool)
+	for i, price := range groupRequest.Prices {
+		if validationErr != nil {
+			break
+		}
+		switch {
+		case price.Price < 0:
+			validationErr = handlers.NestFieldError(fmt.Sprintf("prices[%d]", i), handlers.NewFieldError("price", "price must not be negative"))
+		case seen[price.ProductID]:
+			validationErr = handlers.NestFieldError(fmt.Sprintf("prices[%d]", i), handlers.FieldErrorf("product_id", "product %d has more than one price", price.ProductID))
+		}
+		seen[price.ProductID] = true
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return groupRequest, false
+	}
+
+	return groupRequest, true
+}
+
+// saveCustomerGroup inserts a new group when groupID is 0, otherwise updates it, replacing its
+// prices
+func saveCustomerGroup(ctx context.Context, groupID int, req CustomerGroupRequest) (*CustomerGroup, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if groupID == 0 {
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO customer_groups (name, discount_percent)
+			VALUES ($1, $2)
+			RETURNING id
+		`, req.Name, req.DiscountPercent).Scan(&groupID)
+	} else {
+		err = tx.QueryRowContext(ctx, `
+			UPDATE customer_groups SET name = $1, discount_percent = $2
+			WHERE id = $3
+			RETURNING id
+		`, req.Name, req.DiscountPercent, groupID).Scan(&groupID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM customer_group_prices WHERE group_id = $1", groupID); err != nil {
+		return nil, err
+	}
+	for i, price := range req.Prices {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO customer_group_prices (group_id, product_id, price)
+			VALUES ($1, $2, $3)
+		`, groupID, price.ProductID, roundCents(price.Price))
+		if isForeignKeyViolation(err) {
+			return nil, fmt.Errorf("%w: prices[%d]: product %d does not exist", errInvalidGroupPrice, i, price.ProductID)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	groups, err := getCustomerGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range groups {
+		if groups[i].ID == groupID {
+			return &groups[i], nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func getCustomerGroups(ctx context.Context) ([]CustomerGroup, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT g.id, g.name, g.discount_percent, g.created_at, gp.product_id, gp.price
+		FROM customer_groups g
+		LEFT JOIN customer_group_prices gp ON gp.group_id = g.id
+		ORDER BY g.name, g.id, gp.product_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make([]CustomerGroup, 0)
+	for rows.Next() {
+		var group CustomerGroup
+		var productID sql.NullInt64
+		var price sql.NullFloat64
+		if err := rows.Scan(&group.ID, &group.Name, &group.DiscountPercent, &group.CreatedAt, &productID, &price); err != nil {
+			return nil, err
+		}
+		if len(groups) == 0 || groups[len(groups)-1].ID != group.ID {
+			group.Prices = make([]GroupPrice, 0)
+			groups = append(groups, group)
+		}
+		if productID.Valid {
+			last := &groups[len(groups)-1]
+			last.Prices = append(last.Prices, GroupPrice{ProductID: int(productID.Int64), Price: price.Float64})
+		}
+	}
+
+	return groups, rows.Err()
+}
+
+// customerGroupPricing returns the pricing of the customer's group, or nil for guests and
+// customers without a group
+func customerGroupPricing(ctx context.Context, q querier, customerID int) (*groupPricing, error) {
+	if customerID == 0 {
+		return nil, nil
+	}
+	rows, err := q.QueryContext(ctx, `
+		SELECT g.discount_percent, gp.product_id, gp.price
+		FROM customers c
+		JOIN customer_groups g ON g.id = c.group_id
+		LEFT JOIN customer_group_prices gp ON gp.group_id = g.id
+		WHERE c.id = $1
+	`, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pricing *groupPricing
+	for rows.Next() {
+		if pricing == nil {
+			pricing = &groupPricing{Prices: make(map[int]float64)}
+		}
+		var productID sql.NullInt64
+		var price sql.NullFloat64
+		if err := rows.Scan(&pricing.DiscountPercent, &productID, &price); err != nil {
+			return nil, err
+		}
+		if productID.Valid {
+			pricing.Prices[int(productID.Int64)] = price.Float64
+		}
+	}
+
+	return pricing, rows.Err()
+}
+
+// price returns what the group pays for a unit of the product usually priced at price
+func (g *groupPricing) price(productID int, price float64) float64 {
+	if g == nil {
+		return price
+	}
+	if groupPrice, ok := g.Prices[productID]; ok {
+		return groupPrice
+	}
+	return roundCents(price * (1 - g.DiscountPercent/100))
+}
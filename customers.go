@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const minPasswordLength = 8
+
+var errEmailTaken = handlers.NewFieldError("email", "email is already registered")
+
+// dummyPasswordHash is compared against when the email is unknown,
+// so a login for a missing account takes as long as a wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+type Customer struct {
+	ID    int    `json:"customer_id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type LoginResponse struct {
+	Token            string    `json:"token"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+	Customer         Customer  `json:"customer"`
+}
+
+type RegisterRequest struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// ReferralCode is optional and attributes the signup to the customer who shared it
+	ReferralCode string `json:"referral_code"`
+}
+
+// CUSTOMER REGISTRATION
+func RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	var registerRequest RegisterRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &registerRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	registerRequest.Name = strings.TrimSpace(registerRequest.Name)
+	registerRequest.Email = normalizeEmail(registerRequest.Email)
+
+	if err := validateRegisterRequest(registerRequest); err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+
+	referrerID, err := findReferrer(r.Context(), registerRequest.ReferralCode)
+	if err == errUnknownReferralCode {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	var customer *Customer
+	if err == nil {
+		customer, err = createCustomer(r.Context(), registerRequest.Name, registerRequest.Email, registerRequest.Password, referrerID)
+	}
+	if err == errEmailTaken {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error creating customer:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, customer)
+}
+
+func validateRegisterRequest(req RegisterRequest) error {
+	if req.Name == "" {
+		return handlers.NewFieldError("name", "name is required")
+	}
+	if req.Email == "" {
+		return handlers.NewFieldError("email", "email is required")
+	}
+	if _, err := mail.ParseAddress(req.Email); err != nil {
+		return handlers.NewFieldError("email", "email is not a valid address")
+	}
+	if len(req.Password) < minPasswordLength {
+		return handlers.NewFieldError("password", "password must be at least 8 characters")
+	}
+	// bcrypt only uses the first 72 bytes of a password
+	if len(req.Password) > 72 {
+		return handlers.NewFieldError("password", "password must be at most 72 characters")
+	}
+	return nil
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// createCustomer registers the customer, as referred by referrerID unless it is 0
+func createCustomer(ctx context.Context, name, email, password string, referrerID int) (*Customer, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	customer := &Customer{Name: name, Email: email}
+	err = db.QueryRowContext(ctx, `
+		WITH customer AS (
+			INSERT INTO customers (name, email, password)
+			VALUES ($1, $2, $3)
+			RETURNING id, role
+		), referral AS (
+			INSERT INTO referrals (referrer_id, referred_id)
+			SELECT $4, id FROM customer WHERE $4 > 0
+		)
+		SELECT id, role FROM customer
+	`, name, email, string(hash), referrerID).Scan(&customer.ID, &customer.Role)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, errEmailTaken
+		}
+		return nil, err
+	}
+
+	return customer, nil
+}
+
+// CUSTOMER LOGIN
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	var loginRequest LoginRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &loginRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	loginRequest.Email = normalizeEmail(loginRequest.Email)
+	if loginRequest.Email == "" || loginRequest.Password == "" {
+		handlers.WriteValidationError(w, errors.New("email and password are required"))
+		return
+	}
+
+	ip := clientIP(r)
+	lockedUntil, status, err := loginLockedUntil(r.Context(), loginRequest.Email, ip)
+	if err != nil {
+		log.Println("Error checking login lockout:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if !lockedUntil.IsZero() {
+		writeLockedResponse(w, lockedUntil, status)
+		return
+	}
+
+	customer, passwordHash, err := getCustomerByEmail(r.Context(), loginRequest.Email)
+	if err != nil && !isNoRows(err) {
+		log.Println("Error retrieving customer:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if err != nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(loginRequest.Password))
+		recordFailedLogin(r.Context(), loginRequest.Email, ip)
+		handlers.WriteError(w, http.StatusUnauthorized, "Invalid email or password")
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(loginRequest.Password)); err != nil {
+		recordFailedLogin(r.Context(), loginRequest.Email, ip)
+		handlers.WriteError(w, http.StatusUnauthorized, "Invalid email or password")
+		return
+	}
+	clearFailedLogins(r.Context(), loginRequest.Email)
+
+	if err := mergeGuestCart(w, r, customer.ID); err != nil {
+		// The cookie is kept, so the merge is retried on the next cart request
+		log.Println("Error merging guest cart:", err)
+	}
+
+	response, err := issueSession(r.Context(), customer)
+	if err != nil {
+		log.Println("Error issuing token:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, response)
+}
+
+func getCustomerByEmail(ctx context.Context, email string) (*Customer, string, error) {
+	var customer Customer
+	var passwordHash string
+	err := db.QueryRowContext(ctx, `
+		SELECT id, name, email, role, password
+		FROM customers
+		WHERE email = $1
+	`, email).Scan(&customer.ID, &customer.Name, &customer.Email, &customer.Role, &passwordHash)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &customer, passwordHash, nil
+}
+
+func getCustomer(ctx context.Context, customerID int) (*Customer, error) {
+	var customer Customer
+	err := db.QueryRowContext(ctx, `
+		SELECT id, name, email, role
+		FROM customers
+		WHERE id = $1
+	`, customerID).Scan(&customer.ID, &customer.Name, &customer.Email, &customer.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	return &customer, nil
+}
+
+// getCustomers returns the customers by ID, in one query
+func getCustomers(ctx context.Context, customerIDs []int) (map[int]Customer, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, name, email, role
+		FROM customers
+		WHERE id = ANY($1)
+	`, pq.Array(customerIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	customers := make(map[int]Customer)
+	for rows.Next() {
+		var customer Customer
+		if err := rows.Scan(&customer.ID, &customer.Name, &customer.Email, &customer.Role); err != nil {
+			return nil, err
+		}
+		customers[customer.ID] = customer
+	}
+
+	return customers, rows.Err()
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint violation
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// isNoRows reports whether err means the queried row does not exist
+func isNoRows(err error) bool {
+	return errors.Is(err, sql.ErrNoRows)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// DashboardPeriod sums up the orders and sign-ups since the start of a period
+type DashboardPeriod struct {
+	// Orders counts the orders placed that weren't cancelled, and Revenue adds up those that were paid
+	Orders       int     `json:"orders"`
+	Revenue      float64 `json:"revenue"`
+	NewCustomers int     `json:"new_customers"`
+}
+
+// Dashboard is the overview of the store's sales for admin UIs
+type Dashboard struct {
+	Currency  string          `json:"currency"`
+	Today     DashboardPeriod `json:"today"`
+	ThisWeek  DashboardPeriod `json:"this_week"`
+	ThisMonth DashboardPeriod `json:"this_month"`
+	// PendingOrders counts the orders waiting for payment, whenever they were placed
+	PendingOrders int `json:"pending_orders"`
+}
+
+// ADMIN DASHBOARD
+// AdminDashboardHandler returns today's, this week's and this month's sales in server time.
+// Weeks start on Monday.
+func AdminDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	dashboard, err := getDashboard(r.Context(), time.Now())
+	if err != nil {
+		log.Println("Error computing dashboard:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, dashboard)
+}
+
+func getDashboard(ctx context.Context, now time.Time) (*Dashboard, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	week := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	dashboard := &Dashboard{Currency: paymentConfig.Currency}
+
+	// Orders that are pending, awaiting payment or cancelled bring in no revenue
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FILTER (WHERE date >= $1 AND status <> $6),
+			   COALESCE(SUM(total) FILTER (WHERE date >= $1 AND status NOT IN ($4, $5, $6)), 0),
+			   COUNT(*) FILTER (WHERE date >= $2 AND status <> $6),
+			   COALESCE(SUM(total) FILTER (WHERE date >= $2 AND status NOT IN ($4, $5, $6)), 0),
+			   COUNT(*) FILTER (WHERE date >= $3 AND status <> $6),
+			   COALESCE(SUM(total) FILTER (WHERE date >= $3 AND status NOT IN ($4, $5, $6)), 0),
+			   COUNT(*) FILTER (WHERE status IN ($4, $5))
+		FROM orders
+	`, today, week, month, orderStatusPending, orderStatusAwaitingPayment, orderStatusCancelled).Scan(
+		&dashboard.Today.Orders, &dashboard.Today.Revenue,
+		&dashboard.ThisWeek.Orders, &dashboard.ThisWeek.Revenue,
+		&dashboard.ThisMonth.Orders, &dashboard.ThisMonth.Revenue,
+		&dashboard.PendingOrders)
+	if err != nil {
+		return nil, err
+	}
+
+	// Customers who signed up before sign-up times were recorded have none and aren't counted
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FILTER (WHERE created_at >= $1),
+			   COUNT(*) FILTER (WHERE created_at >= $2),
+			   COUNT(*)
+		FROM customers
+		WHERE created_at >= $3
+	`, today, week, month).Scan(&dashboard.Today.NewCustomers, &dashboard.ThisWeek.NewCustomers, &dashboard.ThisMonth.NewCustomers)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, period := range []*DashboardPeriod{&dashboard.Today, &dashboard.ThisWeek, &dashboard.ThisMonth} {
+		period.Revenue = roundCents(period.Revenue)
+	}
+	return dashboard, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// Database settings, loaded from environment variables by loadDatabaseConfig
+var databaseConfig = struct {
+	// QueryTimeout is how long Postgres lets a statement run before cancelling it. Queries are
+	// also cancelled when the request they run for is, such as when its client goes away.
+	QueryTimeout time.Duration
+}{
+	QueryTimeout: 30 * time.Second,
+}
+
+func loadDatabaseConfig() {
+	if v := os.Getenv("DB_QUERY_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Millisecond {
+			log.Fatalf("Invalid DB_QUERY_TIMEOUT %q", v)
+		}
+		databaseConfig.QueryTimeout = d
+	}
+}
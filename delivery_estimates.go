@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const dateLayout = "2006-01-02"
+
+// DeliveryEstimate is the range of dates, as YYYY-MM-DD, a package is expected to arrive on
+type DeliveryEstimate struct {
+	Earliest string `json:"earliest"`
+	Latest   string `json:"latest"`
+}
+
+// shipOrigin is when a warehouse gets orders out: orders placed after its cutoff time, or
+// on a weekend, ship the next business day, after HandlingDays more business days of picking
+// and packing
+type shipOrigin struct {
+	Location *time.Location
+	// Cutoff is the local time of day orders must be placed by, as "15:04"; empty means
+	// orders placed on a business day ship that day
+	Cutoff       string
+	HandlingDays int
+}
+
+// defaultShipOrigin is where products not stocked in any warehouse ship from
+func defaultShipOrigin() shipOrigin {
+	return shipOrigin{Location: shippingConfig.Location, Cutoff: shippingConfig.CutoffTime}
+}
+
+func validTimezone(name string) bool {
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+func isBusinessDay(day time.Time) bool {
+	return day.Weekday() != time.Saturday && day.Weekday() != time.Sunday
+}
+
+// addBusinessDays returns the day n business days after day
+func addBusinessDays(day time.Time, n int) time.Time {
+	for n > 0 {
+		day = day.AddDate(0, 0, 1)
+		if isBusinessDay(day) {
+			n--
+		}
+	}
+	return day
+}
+
+// shipDay returns the date an order placed at now leaves the origin, at midnight UTC
+func (o shipOrigin) shipDay(now time.Time) time.Time {
+	local := now.In(o.Location)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+	if !isBusinessDay(day) || (o.Cutoff != "" && local.Format("15:04") >= o.Cutoff) {
+		day = addBusinessDays(day, 1)
+	}
+	return addBusinessDays(day, o.HandlingDays)
+}
+
+// latestShipDay is the day the last of the origins ships an order placed at now; the order
+// arrives with its last package
+func latestShipDay(now time.Time, origins []shipOrigin) time.Time {
+	var latest time.Time
+	for _, origin := range origins {
+		if day := origin.shipDay(now); day.After(latest) {
+			latest = day
+		}
+	}
+	return latest
+}
+
+// estimateDelivery returns when a package shipped on shipDay arrives by the window's business
+// days in transit, or nil when the window is unknown
+func estimateDelivery(shipDay time.Time, window *DeliveryWindow) *DeliveryEstimate {
+	if window == nil {
+		return nil
+	}
+	return &DeliveryEstimate{
+		Earliest: addBusinessDays(shipDay, window.MinDays).Format(dateLayout),
+		Latest:   addBusinessDays(shipDay, window.MaxDays).Format(dateLayout),
+	}
+}
+
+// addDeliveryEstimates estimates the delivery of each of the quote's shipping options, and of
+// the chosen one, for an order shipping from the origins
+func addDeliveryEstimates(quote *Quote, origins []shipOrigin) {
+	shipDay := latestShipDay(time.Now(), origins)
+	for i := range quote.ShippingOptions {
+		option := &quote.ShippingOptions[i]
+		option.EstimatedDelivery = estimateDelivery(shipDay, option.DeliveryWindow)
+		if option.Code == quote.ShippingMethod {
+			quote.EstimatedDelivery = option.EstimatedDelivery
+		}
+	}
+}
+
+// cartShipOrigins returns the warehouses that would ship the units (product ID -> quantity),
+// picked as allocateOrder picks them
+func cartShipOrigins(ctx context.Context, units map[int]int) ([]shipOrigin, error) {
+	productIDs := make([]int, 0, len(units))
+	for productID := range units {
+		productIDs = append(productIDs, productID)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT ws.product_id, ws.warehouse_id, ws.quantity
+		FROM warehouse_stock ws
+		JOIN warehouses w ON w.id = ws.warehouse_id
+		WHERE ws.product_id = ANY($1)
+		ORDER BY w.priority, w.id
+	`, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stock := make(map[int][]WarehouseStock)
+	for rows.Next() {
+		var productID int
+		var warehouseStock WarehouseStock
+		if err := rows.Scan(&productID, &warehouseStock.WarehouseID, &warehouseStock.Quantity); err != nil {
+			return nil, err
+		}
+		stock[productID] = append(stock[productID], warehouseStock)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var warehouseIDs []int
+	unstocked := false
+	for productID, quantity := range units {
+		allocations := planAllocation(stock[productID], quantity)
+		if len(allocations) == 0 {
+			// Not in any warehouse, or short of stock, which checkout reports on its own
+			unstocked = true
+			continue
+		}
+		for warehouseID := range allocations {
+			warehouseIDs = append(warehouseIDs, warehouseID)
+		}
+	}
+
+	return getShipOrigins(db.Query, warehouseIDs, unstocked)
+}
+
+// orderShipOrigins returns the warehouses the order was allocated to
+func orderShipOrigins(ctx context.Context, tx *sql.Tx, orderID int) ([]shipOrigin, error) {
+	var allocated []int64
+	var unstocked bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(array_agg(DISTINCT a.warehouse_id) FILTER (WHERE a.warehouse_id IS NOT NULL), '{}'),
+			   COALESCE(bool_or(a.warehouse_id IS NULL), FALSE)
+		FROM order_products op
+		LEFT JOIN order_allocations a ON a.order_id = op.order_id AND a.product_id = op.product_id
+		WHERE op.order_id = $1
+	`, orderID).Scan(pq.Array(&allocated), &unstocked)
+	if err != nil {
+		return nil, err
+	}
+	warehouseIDs := make([]int, len(allocated))
+	for i, warehouseID := range allocated {
+		warehouseIDs[i] = int(warehouseID)
+	}
+
+	return getShipOrigins(tx.Query, warehouseIDs, unstocked)
+}
+
+// getShipOrigins loads the warehouses' origins, adding the default origin when withDefault is
+// set or there are no warehouses
+func getShipOrigins(query func(string, ...interface{}) (*sql.Rows, error), warehouseIDs []int, withDefault bool) ([]shipOrigin, error) {
+	var origins []shipOrigin
+	if withDefault || len(warehouseIDs) == 0 {
+		origins = append(origins, defaultShipOrigin())
+	}
+	if len(warehouseIDs) == 0 {
+		return origins, nil
+	}
+
+	rows, err := query(`
+		SELECT timezone, COALESCE(cutoff_time, ''), handling_days
+		FROM warehouses
+		WHERE id = ANY($1)
+	`, pq.Array(warehouseIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var origin shipOrigin
+		var timezone string
+		if err := rows.Scan(&timezone, &origin.Cutoff, &origin.HandlingDays); err != nil {
+			return nil, err
+		}
+		origin.Location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, err
+		}
+		origins = append(origins, origin)
+	}
+
+	return origins, rows.Err()
+}
+
+// addOrderDelivery sets the delivery estimates the orders were placed with, and the location
+// of pickup orders
+func addOrderDelivery(ctx context.Context, orders map[int]*OrderWithProducts) error {
+	orderIDs := make([]int, 0, len(orders))
+	for orderID := range orders {
+		orderIDs = append(orderIDs, orderID)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, estimated_delivery_earliest, estimated_delivery_latest, pickup_location_id
+		FROM orders
+		WHERE id = ANY($1) AND (estimated_delivery_earliest IS NOT NULL OR pickup_location_id IS NOT NULL)
+	`, pq.Array(orderIDs))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	pickupOrders := make(map[int][]int)
+	for rows.Next() {
+		var orderID int
+		var earliest, latest *time.Time
+		var locationID *int
+		if err := rows.Scan(&orderID, &earliest, &latest, &locationID); err != nil {
+			return err
+		}
+		if earliest != nil && latest != nil {
+			orders[orderID].EstimatedDelivery = &DeliveryEstimate{
+				Earliest: earliest.Format(dateLayout),
+				Latest:   latest.Format(dateLayout),
+			}
+		}
+		if locationID != nil {
+			pickupOrders[*locationID] = append(pickupOrders[*locationID], orderID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(pickupOrders) == 0 {
+		return nil
+	}
+
+	locations, err := getPickupLocations(ctx, false)
+	if err != nil {
+		return err
+	}
+	for i := range locations {
+		for _, orderID := range pickupOrders[locations[i].ID] {
+			orders[orderID].PickupLocation = &locations[i]
+		}
+	}
+	return nil
+}
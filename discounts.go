@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// Discount types of an order's discount breakdown, in the order they are applied
+const (
+	discountTypePromotion  = "promotion"
+	discountTypeCoupon     = "coupon"
+	discountTypeFirstOrder = "first_order"
+	discountTypePoints     = "points"
+)
+
+// Discount stacking settings, loaded from environment variables by loadDiscountConfig
+var discountConfig = struct {
+	// CouponWithPromotions lets a coupon's discount add to the promotions'; otherwise a coupon
+	// replaces the promotions
+	CouponWithPromotions bool
+	// PointsWithDiscounts lets loyalty points be redeemed on an order that got another discount
+	PointsWithDiscounts bool
+}{
+	CouponWithPromotions: true,
+	PointsWithDiscounts:  true,
+}
+
+// AppliedDiscount is one step of an order's discount
+type AppliedDiscount struct {
+	Type string `json:"type"`
+	// Name is the promotion's name or the coupon's code; empty for the other types
+	Name   string  `json:"name,omitempty"`
+	Amount float64 `json:"amount"`
+}
+
+// discountBreakdown adds up an order's discounts in the order they are applied, each taking
+// off at most what the ones before it left of the subtotal
+type discountBreakdown struct {
+	subtotal  float64
+	discounts []AppliedDiscount
+}
+
+func loadDiscountConfig() {
+	if v := os.Getenv("DISCOUNT_COUPON_WITH_PROMOTIONS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid DISCOUNT_COUPON_WITH_PROMOTIONS %q", v)
+		}
+		discountConfig.CouponWithPromotions = b
+	}
+	if v := os.Getenv("DISCOUNT_POINTS_WITH_DISCOUNTS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid DISCOUNT_POINTS_WITH_DISCOUNTS %q", v)
+		}
+		discountConfig.PointsWithDiscounts = b
+	}
+}
+
+// add applies the discount, capped at what is left of the subtotal, and returns what it took off
+func (b *discountBreakdown) add(discountType, name string, amount float64) float64 {
+	amount = roundCents(math.Min(amount, b.remaining()))
+	if amount <= 0 {
+		return 0
+	}
+	b.discounts = append(b.discounts, AppliedDiscount{Type: discountType, Name: name, Amount: amount})
+	return amount
+}
+
+// remaining returns what the discounts so far leave of the subtotal
+func (b *discountBreakdown) remaining() float64 {
+	return math.Max(0, roundCents(b.subtotal-b.total()))
+}
+
+func (b *discountBreakdown) total() float64 {
+	var total float64
+	for _, discount := range b.discounts {
+		total += discount.Amount
+	}
+	return roundCents(total)
+}
+
+// saveOrderDiscounts replaces the order's discount breakdown
+func saveOrderDiscounts(ctx context.Context, tx *sql.Tx, orderID int, b *discountBreakdown) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM order_discounts WHERE order_id = $1", orderID); err != nil {
+		return err
+	}
+	for _, discount := range b.discounts {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO order_discounts (order_id, type, name, amount)
+			VALUES ($1, $2, NULLIF($3, ''), $4)
+		`, orderID, discount.Type, discount.Name, discount.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addOrderDiscounts fills in the discount breakdown of the orders
+func addOrderDiscounts(ctx context.Context, orders map[int]*OrderWithProducts) error {
+	orderIDs := make([]int, 0, len(orders))
+	for orderID := range orders {
+		orderIDs = append(orderIDs, orderID)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT order_id, type, COALESCE(name, ''), amount
+		FROM order_discounts
+		WHERE order_id = ANY($1)
+		ORDER BY order_id, id
+	`, pq.Array(orderIDs))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID int
+		var discount AppliedDiscount
+		if err := rows.Scan(&orderID, &discount.Type, &discount.Name, &discount.Amount); err != nil {
+			return err
+		}
+		orders[orderID].Discounts = append(orders[orderID].Discounts, discount)
+	}
+
+	return rows.Err()
+}
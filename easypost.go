@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const easyPostAPIURL = "https://api.easypost.com/v2"
+
+// EasyPost measures parcels in ounces and inches
+const (
+	ouncesPerKg        = 35.27396
+	centimetersPerInch = 2.54
+)
+
+// easyPostCarrier buys labels through EasyPost, which resells the postage of many carriers
+type easyPostCarrier struct {
+	apiKey string
+	// webhookSecret signs the tracking webhooks EasyPost sends
+	webhookSecret string
+	client        *http.Client
+}
+
+type easyPostAddress struct {
+	Name    string `json:"name"`
+	Street1 string `json:"street1"`
+	Street2 string `json:"street2,omitempty"`
+	City    string `json:"city"`
+	State   string `json:"state,omitempty"`
+	Zip     string `json:"zip,omitempty"`
+	Country string `json:"country"`
+	Phone   string `json:"phone,omitempty"`
+}
+
+type easyPostParcel struct {
+	Weight float64 `json:"weight"`
+	Length float64 `json:"length,omitempty"`
+	Width  float64 `json:"width,omitempty"`
+	Height float64 `json:"height,omitempty"`
+}
+
+type easyPostRate struct {
+	ID       string `json:"id"`
+	Carrier  string `json:"carrier"`
+	Service  string `json:"service"`
+	Rate     string `json:"rate"`
+	Currency string `json:"currency"`
+}
+
+type easyPostShipment struct {
+	ID           string         `json:"id"`
+	TrackingCode string         `json:"tracking_code"`
+	Rates        []easyPostRate `json:"rates"`
+	SelectedRate *easyPostRate  `json:"selected_rate"`
+	PostageLabel *struct {
+		LabelURL string `json:"label_url"`
+	} `json:"postage_label"`
+}
+
+func newEasyPostCarrier(apiKey, webhookSecret string) *easyPostCarrier {
+	return &easyPostCarrier{apiKey: apiKey, webhookSecret: webhookSecret, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func toEasyPostAddress(a PostalAddress) easyPostAddress {
+	return easyPostAddress{
+		Name:    a.Name,
+		Street1: a.Line1,
+		Street2: a.Line2,
+		City:    a.City,
+		State:   a.Region,
+		Zip:     a.PostalCode,
+		Country: a.Country,
+		Phone:   a.Phone,
+	}
+}
+
+// BuyLabel creates an EasyPost shipment, which comes back with the carriers' rates, and buys
+// the chosen rate
+func (c *easyPostCarrier) BuyLabel(ctx context.Context, label LabelRequest) (*ShippingLabel, error) {
+	request := map[string]interface{}{
+		"shipment": map[string]interface{}{
+			"from_address": toEasyPostAddress(label.From),
+			"to_address":   toEasyPostAddress(label.To),
+			"parcel": easyPostParcel{
+				// EasyPost rejects weightless parcels
+				Weight: math.Max(label.Parcel.Weight*ouncesPerKg, 0.1),
+				Length: label.Parcel.Length / centimetersPerInch,
+				Width:  label.Parcel.Width / centimetersPerInch,
+				Height: label.Parcel.Height / centimetersPerInch,
+			},
+			"reference": strconv.Itoa(label.ShipmentID),
+		},
+	}
+
+	var shipment easyPostShipment
+	if err := c.do(ctx, http.MethodPost, "/shipments", request, &shipment); err != nil {
+		return nil, err
+	}
+
+	rate, err := pickEasyPostRate(shipment.Rates, label.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	request = map[string]interface{}{"rate": map[string]string{"id": rate.ID}}
+	if err := c.do(ctx, http.MethodPost, "/shipments/"+url.PathEscape(shipment.ID)+"/buy", request, &shipment); err != nil {
+		return nil, err
+	}
+	if shipment.PostageLabel == nil || shipment.SelectedRate == nil {
+		return nil, fmt.Errorf("easypost bought shipment %s without a label", shipment.ID)
+	}
+
+	cost, err := strconv.ParseFloat(shipment.SelectedRate.Rate, 64)
+	if err != nil {
+		return nil, fmt.Errorf("easypost returned rate %q: %v", shipment.SelectedRate.Rate, err)
+	}
+	return &ShippingLabel{
+		Carrier:        shipment.SelectedRate.Carrier,
+		Service:        shipment.SelectedRate.Service,
+		TrackingNumber: shipment.TrackingCode,
+		LabelURL:       shipment.PostageLabel.LabelURL,
+		Cost:           cost,
+		Currency:       strings.ToUpper(shipment.SelectedRate.Currency),
+		Reference:      shipment.ID,
+	}, nil
+}
+
+// pickEasyPostRate returns the rate of the service, or the cheapest rate when service is empty
+func pickEasyPostRate(rates []easyPostRate, service string) (*easyPostRate, error) {
+	var picked *easyPostRate
+	var pickedPrice float64
+	for i := range rates {
+		rate := &rates[i]
+		if service != "" && !strings.EqualFold(rate.Service, service) {
+			continue
+		}
+		price, err := strconv.ParseFloat(rate.Rate, 64)
+		if err != nil {
+			continue
+		}
+		if picked == nil || price < pickedPrice {
+			picked, pickedPrice = rate, price
+		}
+	}
+	if picked == nil && service != "" {
+		return nil, fmt.Errorf("easypost offered no %s rate for the parcel", service)
+	}
+	if picked == nil {
+		return nil, fmt.Errorf("easypost offered no rates for the parcel")
+	}
+	return picked, nil
+}
+
+func (c *easyPostCarrier) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, easyPostAPIURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.apiKey, "")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+			return fmt.Errorf("easypost responded with %s", resp.Status)
+		}
+		return fmt.Errorf("easypost responded with %s: %s %s", resp.Status, apiErr.Error.Code, apiErr.Error.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type easyPostTracker struct {
+	TrackingCode    string `json:"tracking_code"`
+	Carrier         string `json:"carrier"`
+	Status          string `json:"status"`
+	TrackingDetails []struct {
+		Message          string    `json:"message"`
+		Status           string    `json:"status"`
+		Datetime         time.Time `json:"datetime"`
+		TrackingLocation struct {
+			City    string `json:"city"`
+			State   string `json:"state"`
+			Country string `json:"country"`
+		} `json:"tracking_location"`
+	} `json:"tracking_details"`
+}
+
+// Track creates an EasyPost tracker for the package; EasyPost returns the existing tracker when
+// the tracking number is already followed
+func (c *easyPostCarrier) Track(ctx context.Context, carrier, trackingNumber string) (*TrackingInfo, error) {
+	request := map[string]interface{}{
+		"tracker": map[string]string{"tracking_code": trackingNumber, "carrier": carrier},
+	}
+
+	var tracker easyPostTracker
+	if err := c.do(ctx, http.MethodPost, "/trackers", request, &tracker); err != nil {
+		return nil, err
+	}
+	return tracker.trackingInfo(), nil
+}
+
+func (tracker *easyPostTracker) trackingInfo() *TrackingInfo {
+	info := &TrackingInfo{Status: easyPostTrackingStatus(tracker.Status), Events: make([]TrackingEvent, 0, len(tracker.TrackingDetails))}
+	for _, detail := range tracker.TrackingDetails {
+		var location []string
+		for _, part := range []string{detail.TrackingLocation.City, detail.TrackingLocation.State, detail.TrackingLocation.Country} {
+			if part != "" {
+				location = append(location, part)
+			}
+		}
+		info.Events = append(info.Events, TrackingEvent{
+			Status:      easyPostTrackingStatus(detail.Status),
+			Description: detail.Message,
+			Location:    strings.Join(location, ", "),
+			OccurredAt:  detail.Datetime.UTC(),
+		})
+	}
+	return info
+}
+
+// ParseWebhook verifies the event's HMAC signature with the webhook secret and returns the
+// tracker of tracker.updated events
+func (c *easyPostCarrier) ParseWebhook(r *http.Request, body []byte) (*ShippingEvent, error) {
+	if c.webhookSecret == "" {
+		return nil, errors.New("EASYPOST_WEBHOOK_SECRET is not set")
+	}
+
+	signature := strings.TrimPrefix(r.Header.Get("X-Hmac-Signature"), "hmac-sha256-hex=")
+	mac := hmac.New(sha256.New, []byte(c.webhookSecret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(expected)) {
+		return nil, errInvalidWebhookSignature
+	}
+
+	var event struct {
+		ID          string          `json:"id"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+
+	parsed := &ShippingEvent{ID: event.ID}
+	if event.Description != "tracker.updated" && event.Description != "tracker.created" {
+		return parsed, nil
+	}
+	var tracker easyPostTracker
+	if err := json.Unmarshal(event.Result, &tracker); err != nil {
+		return nil, err
+	}
+	parsed.Carrier = tracker.Carrier
+	parsed.TrackingNumber = tracker.TrackingCode
+	parsed.Tracking = tracker.trackingInfo()
+	return parsed, nil
+}
+
+// easyPostTrackingStatus maps EasyPost's tracker statuses onto ours
+func easyPostTrackingStatus(status string) string {
+	switch status {
+	case "pre_transit":
+		return trackingStatusPreTransit
+	case "in_transit":
+		return trackingStatusInTransit
+	case "out_for_delivery":
+		return trackingStatusOutForDelivery
+	case "available_for_pickup":
+		return trackingStatusAvailableForPickup
+	case "delivered":
+		return trackingStatusDelivered
+	case "return_to_sender":
+		return trackingStatusReturned
+	case "failure", "cancelled", "error":
+		return trackingStatusFailure
+	}
+	return trackingStatusUnknown
+}
+
+type easyPostVerifiedAddress struct {
+	easyPostAddress
+	Verifications struct {
+		Delivery struct {
+			Success bool `json:"success"`
+			Errors  []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"delivery"`
+	} `json:"verifications"`
+}
+
+// VerifyAddress has EasyPost check that the address can be delivered to
+func (c *easyPostCarrier) VerifyAddress(ctx context.Context, address PostalAddress) (*PostalAddress, error) {
+	request := map[string]interface{}{
+		"address": toEasyPostAddress(address),
+		"verify":  []string{"delivery"},
+	}
+
+	var verified easyPostVerifiedAddress
+	if err := c.do(ctx, http.MethodPost, "/addresses", request, &verified); err != nil {
+		return nil, err
+	}
+
+	delivery := verified.Verifications.Delivery
+	if !delivery.Success {
+		if len(delivery.Errors) > 0 {
+			return nil, fmt.Errorf("%w: %s", errUndeliverableAddress, delivery.Errors[0].Message)
+		}
+		return nil, errUndeliverableAddress
+	}
+
+	return &PostalAddress{
+		Name:       address.Name,
+		Line1:      verified.Street1,
+		Line2:      verified.Street2,
+		City:       verified.City,
+		Region:     verified.State,
+		PostalCode: verified.Zip,
+		Country:    verified.Country,
+		Phone:      address.Phone,
+	}, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Email queue settings, loaded from environment variables by loadEmailQueueConfig
+var emailQueueConfig = struct {
+	// MaxAttempts is how often an email is tried before it is given up
+	MaxAttempts int
+	// RetryBackoff is the wait after the first failed attempt; it doubles with every attempt
+	RetryBackoff time.Duration
+	// MaxBackoff caps the wait between attempts
+	MaxBackoff time.Duration
+	// Retention is how long sent emails are kept in the outbox
+	Retention time.Duration
+}{
+	MaxAttempts:  8,
+	RetryBackoff: time.Minute,
+	MaxBackoff:   6 * time.Hour,
+	Retention:    30 * 24 * time.Hour,
+}
+
+// emailBatchSize is how many due emails the background task sends at once
+const emailBatchSize = 50
+
+// emailSendLease is how long a claimed email is kept from other workers while it is sent
+const emailSendLease = 5 * time.Minute
+
+// queuedEmail is an email of the outbox that is due to be sent
+type queuedEmail struct {
+	ID        int
+	Recipient string
+	Attempts  int
+	Message   emailMessage
+}
+
+func loadEmailQueueConfig() {
+	if v := os.Getenv("EMAIL_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid EMAIL_MAX_ATTEMPTS %q", v)
+		}
+		emailQueueConfig.MaxAttempts = n
+	}
+	if v := os.Getenv("EMAIL_RETRY_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid EMAIL_RETRY_BACKOFF %q", v)
+		}
+		emailQueueConfig.RetryBackoff = d
+	}
+}
+
+// sendEmail renders the named email template with the data and queues it for the background
+// task to send. key identifies the notification, e.g. "order_cancelled:12": an email with the
+// key of one already queued for the recipient isn't queued again, so a task that stops midway
+// and runs again doesn't email anyone twice. An empty key is never deduplicated. Emails the
+// recipient opted out of, and emails to addresses that bounced or complained, are dropped.
+func sendEmail(ctx context.Context, to, name, key string, data interface{}, attachments ...emailAttachment) error {
+	suppressed, err := emailSuppressed(ctx, to)
+	if err != nil || suppressed {
+		return err
+	}
+
+	allowed, err := notificationAllowed(ctx, to, name)
+	if err != nil || !allowed {
+		return err
+	}
+
+	email, err := renderEmail(name, data)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var emailID int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO email_outbox (recipient, template, dedupe_key, subject, text_body, html_body)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6)
+		ON CONFLICT (recipient, dedupe_key) DO NOTHING
+		RETURNING id
+	`, to, name, key, email.Subject, email.Text, email.HTML).Scan(&emailID)
+	if isNoRows(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, attachment := range attachments {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO email_attachments (email_id, filename, content_type, content) VALUES ($1, $2, $3, $4)
+		`, emailID, attachment.Filename, attachment.ContentType, attachment.Content)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sendQueuedEmails sends the emails that are due, and schedules the next attempt of those that
+// failed with exponential backoff
+func sendQueuedEmails(ctx context.Context) {
+	emails, err := claimQueuedEmails(ctx)
+	if err != nil {
+		log.Println("Error claiming queued emails:", err)
+		return
+	}
+
+	for _, email := range emails {
+		// Only sending is held to the timeout; recording the outcome has the job's context
+		sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := mailer.Send(sendCtx, emailConfig.From, email.Recipient, &email.Message)
+		cancel()
+
+		if err == nil {
+			_, err = db.ExecContext(ctx, "UPDATE email_outbox SET sent_at = NOW(), attempts = attempts + 1, last_error = NULL WHERE id = $1", email.ID)
+			if err != nil {
+				log.Printf("Error marking email %d sent: %v", email.ID, err)
+			}
+			continue
+		}
+
+		log.Printf("Error sending email %d to %s (attempt %d): %v", email.ID, email.Recipient, email.Attempts+1, err)
+		_, err = db.ExecContext(ctx, `
+			UPDATE email_outbox
+			SET attempts = attempts + 1, last_error = $2, next_attempt_at = NOW() + $3 * INTERVAL '1 second'
+			WHERE id = $1
+		`, email.ID, err.Error(), retryBackoff(emailQueueConfig.RetryBackoff, emailQueueConfig.MaxBackoff, email.Attempts+1).Seconds())
+		if err != nil {
+			log.Printf("Error rescheduling email %d: %v", email.ID, err)
+		}
+	}
+}
+
+// claimQueuedEmails returns the oldest due emails after leasing them so that another
+// worker doesn't send them as well. An email whose worker stopped while sending it is tried
+// again once the lease ends.
+func claimQueuedEmails(ctx context.Context) ([]queuedEmail, error) {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE email_outbox SET next_attempt_at = NOW() + $3 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id FROM email_outbox
+			WHERE sent_at IS NULL AND attempts < $1 AND next_attempt_at <= NOW()
+			ORDER BY id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, recipient, attempts, subject, text_body, html_body
+	`, emailQueueConfig.MaxAttempts, emailBatchSize, emailSendLease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []queuedEmail
+	var emailIDs []int
+	for rows.Next() {
+		var email queuedEmail
+		if err := rows.Scan(&email.ID, &email.Recipient, &email.Attempts, &email.Message.Subject, &email.Message.Text, &email.Message.HTML); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+		emailIDs = append(emailIDs, email.ID)
+	}
+	if err := rows.Err(); err != nil || len(emails) == 0 {
+		return emails, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT email_id, filename, content_type, content FROM email_attachments
+		WHERE email_id = ANY($1)
+		ORDER BY id
+	`, pq.Array(emailIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attachments := make(map[int][]emailAttachment)
+	for rows.Next() {
+		var emailID int
+		var attachment emailAttachment
+		if err := rows.Scan(&emailID, &attachment.Filename, &attachment.ContentType, &attachment.Content); err != nil {
+			return nil, err
+		}
+		attachments[emailID] = append(attachments[emailID], attachment)
+	}
+	for i := range emails {
+		emails[i].Message.Attachments = attachments[emails[i].ID]
+	}
+
+	return emails, rows.Err()
+}
+
+// orderCancelledEmailKey is the key of the email telling the customer their order was
+// cancelled, however it was
+func orderCancelledEmailKey(orderID int) string {
+	return fmt.Sprintf("order_cancelled:%d", orderID)
+}
+
+// paymentEmailKey is the key of an email about a change of the payment, so the webhook and the
+// retry task reporting the same change email the customer once
+func paymentEmailKey(name string, paymentID int) string {
+	return fmt.Sprintf("%s:%d", name, paymentID)
+}
+
+// retryBackoff is the wait after the given number of failed attempts: base after the first,
+// doubling with every attempt up to max
+func retryBackoff(base, max time.Duration, attempts int) time.Duration {
+	backoff := float64(base) * math.Pow(2, float64(attempts-1))
+	return time.Duration(math.Min(backoff, float64(max)))
+}
+
+// deleteSentEmails removes the sent emails older than the retention period
+func deleteSentEmails(ctx context.Context) {
+	_, err := db.ExecContext(ctx, `
+		DELETE FROM email_outbox WHERE sent_at < NOW() - $1 * INTERVAL '1 second'
+	`, emailQueueConfig.Retention.Seconds())
+	if err != nil {
+		log.Println("Error deleting sent emails:", err)
+	}
+}
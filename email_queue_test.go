@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// recordingMailer accepts every email and remembers who it was sent to
+type recordingMailer struct {
+	sent []string
+}
+
+func (m *recordingMailer) Send(ctx context.Context, from, to string, message *emailMessage) error {
+	m.sent = append(m.sent, to)
+	return nil
+}
+
+func TestSendQueuedEmailsMarksEmailSent(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	previous := mailer
+	recorder := &recordingMailer{}
+	mailer = recorder
+	t.Cleanup(func() { mailer = previous })
+
+	recipient := fmt.Sprintf("outbox-%d@example.com", time.Now().UnixNano())
+	var emailID int
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO email_outbox (recipient, template, subject, text_body, html_body, next_attempt_at)
+		VALUES ($1, 'test', 'Subject', 'Text', '<p>HTML</p>', NOW() - INTERVAL '1 hour')
+		RETURNING id
+	`, recipient).Scan(&emailID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendQueuedEmails(ctx)
+
+	found := false
+	for _, to := range recorder.sent {
+		found = found || to == recipient
+	}
+	if !found {
+		t.Fatalf("sent to %v, want %s among them", recorder.sent, recipient)
+	}
+	var sentAt sql.NullTime
+	var attempts int
+	if err := db.QueryRowContext(ctx, "SELECT sent_at, attempts FROM email_outbox WHERE id = $1", emailID).Scan(&sentAt, &attempts); err != nil {
+		t.Fatal(err)
+	}
+	if !sentAt.Valid || attempts != 1 {
+		t.Errorf("sent_at = %v, attempts = %d; want the email marked sent after 1 attempt", sentAt, attempts)
+	}
+
+	// A sent email isn't claimed again
+	recorder.sent = nil
+	sendQueuedEmails(ctx)
+	for _, to := range recorder.sent {
+		if to == recipient {
+			t.Errorf("email %d was sent again", emailID)
+		}
+	}
+}
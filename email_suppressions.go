@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Reasons an address is suppressed
+const (
+	emailSuppressionBounce    = "bounce"
+	emailSuppressionComplaint = "complaint"
+)
+
+// emailEventParser is implemented by mailers whose provider reports bounces and complaints
+type emailEventParser interface {
+	// ParseEmailEvents verifies the request's signature and returns the bounces and complaints
+	// it carries; other events are left out
+	ParseEmailEvents(ctx context.Context, r *http.Request, body []byte) ([]EmailEvent, error)
+}
+
+// EmailEvent is a provider's report that an address can't or shouldn't be emailed
+type EmailEvent struct {
+	// Type is one of the emailSuppression constants
+	Type   string
+	Email  string
+	Detail string
+}
+
+// EmailSuppression is an address no email is sent to
+type EmailSuppression struct {
+	Email     string    `json:"email"`
+	Reason    string    `json:"reason"`
+	Detail    string    `json:"detail"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// EMAIL EVENTS
+// EmailEventsHandler receives bounce and complaint notifications from the email provider and
+// suppresses the addresses they concern
+func EmailEventsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	parser, ok := mailer.(emailEventParser)
+	if !ok {
+		handlers.WriteError(w, http.StatusServiceUnavailable, "The email provider doesn't report bounces")
+		return
+	}
+
+	events, err := parser.ParseEmailEvents(r.Context(), r, body)
+	if err != nil {
+		log.Println("Error verifying email events:", err)
+		handlers.WriteError(w, http.StatusBadRequest, errInvalidWebhookSignature.Error())
+		return
+	}
+
+	// On errors the provider sends the events again, and suppressing an address twice is harmless
+	for _, event := range events {
+		if err := suppressEmail(r.Context(), event); err != nil {
+			log.Printf("Error suppressing %s: %v", event.Email, err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// ADMIN EMAIL SUPPRESSIONS
+func AdminEmailSuppressionsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT email, reason, COALESCE(detail, ''), created_at FROM email_suppressions ORDER BY created_at DESC
+	`)
+	if err != nil {
+		log.Println("Error retrieving email suppressions:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	defer rows.Close()
+
+	suppressions := make([]EmailSuppression, 0)
+	for rows.Next() {
+		var suppression EmailSuppression
+		if err := rows.Scan(&suppression.Email, &suppression.Reason, &suppression.Detail, &suppression.CreatedAt); err != nil {
+			log.Println("Error scanning email suppression:", err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		suppressions = append(suppressions, suppression)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error retrieving email suppressions:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, suppressions)
+}
+
+// AdminDeleteEmailSuppressionHandler lets the address get emails again, e.g. after the customer
+// fixed their mailbox
+func AdminDeleteEmailSuppressionHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := db.ExecContext(r.Context(), "DELETE FROM email_suppressions WHERE email = $1", normalizeEmail(mux.Vars(r)["email"]))
+	if err != nil {
+		log.Println("Error deleting email suppression:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Email suppression not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// suppressEmail marks the event's address undeliverable and drops the emails still queued for it
+func suppressEmail(ctx context.Context, event EmailEvent) error {
+	email := normalizeEmail(event.Email)
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO email_suppressions (email, reason, detail) VALUES ($1, $2, NULLIF($3, ''))
+		ON CONFLICT (email) DO NOTHING
+	`, email, event.Type, event.Detail)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "DELETE FROM email_outbox WHERE LOWER(recipient) = $1 AND sent_at IS NULL", email)
+	return err
+}
+
+// emailSuppressed reports whether the address bounced or complained
+func emailSuppressed(ctx context.Context, to string) (bool, error) {
+	var suppressed bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM email_suppressions WHERE email = $1)
+	`, normalizeEmail(to)).Scan(&suppressed)
+	return suppressed, err
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"path"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Email templates live in templates/email. Each message has a name.txt text template, which
+// defines its "subject" and the "content" of the plain text part, and a name.html template,
+// which defines the "content" of the HTML part within layout.html.
+//
+//go:embed templates/email
+var emailTemplateFS embed.FS
+
+// Names of the email templates
+const (
+	emailOrderReminder        = "order_reminder"
+	emailOrderCancelled       = "order_cancelled"
+	emailUnpaidOrderCancelled = "unpaid_order_cancelled"
+	emailPaymentReceived      = "payment_received"
+	emailPaymentFailed        = "payment_failed"
+	emailPaymentRetryFailed   = "payment_retry_failed"
+	emailPaymentDisputed      = "payment_disputed"
+	emailReadyForPickup       = "ready_for_pickup"
+	emailOutForDelivery       = "out_for_delivery"
+	emailPackageDelivered     = "package_delivered"
+	emailGiftCard             = "gift_card"
+	emailReferralReward       = "referral_reward"
+	emailReferralWelcome      = "referral_welcome"
+	emailPasswordReset        = "password_reset"
+	emailLowStockAlert        = "low_stock_alert"
+	emailSalesDigest          = "sales_digest"
+	emailReportSubscription   = "report_subscription"
+)
+
+// emailTemplate is a message's parsed templates
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *template.Template
+}
+
+// emailTemplates are the parsed templates by name, loaded by loadEmailTemplates
+var emailTemplates = map[string]*emailTemplate{}
+
+// emailMessage is a rendered email
+type emailMessage struct {
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []emailAttachment
+}
+
+// emailAttachment is a file sent along with an email
+type emailAttachment struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+// orderEmail is the data of the emails about an order
+type orderEmail struct {
+	OrderID int
+}
+
+// unpaidOrderEmail is the data of the email about an order cancelled after its payment
+// retries failed
+type unpaidOrderEmail struct {
+	OrderID  int
+	Attempts int
+}
+
+// paymentRetryEmail is the data of the email sent when a payment retry failed
+type paymentRetryEmail struct {
+	OrderID       int
+	Attempt       int
+	Attempts      int
+	RetryInterval time.Duration
+	// PayLink is where the customer can pay the order themselves; empty when not configured
+	PayLink string
+}
+
+// pickupEmail is the data of the email sent when an order is ready for pickup
+type pickupEmail struct {
+	OrderID  int
+	Location *PickupLocation
+	// Address is the location's address on one line
+	Address string
+}
+
+// trackingEmail is the data of the emails about a package of an order
+type trackingEmail struct {
+	OrderID        int
+	TrackingNumber string
+}
+
+// giftCardEmail is the data of the email delivering a gift card
+type giftCardEmail struct {
+	// OrderID is the order that bought the card; 0 when an admin issued it
+	OrderID  int
+	Code     string
+	Balance  float64
+	Currency string
+	Note     string
+}
+
+// referralRewardEmail is the data of the emails giving the referrer and the new customer their
+// reward coupons
+type referralRewardEmail struct {
+	ReferredName string
+	CouponCode   string
+	Amount       float64
+}
+
+// passwordResetEmail is the data of the password reset email
+type passwordResetEmail struct {
+	Name string
+	Link string
+	TTL  time.Duration
+}
+
+// lowStockEmail is the data of the low-stock alert
+type lowStockEmail struct {
+	Threshold int
+	Products  []LowStockProduct
+}
+
+func loadEmailTemplates() {
+	layout, err := template.ParseFS(emailTemplateFS, "templates/email/layout.html")
+	if err != nil {
+		log.Fatalf("Error parsing email layout: %v", err)
+	}
+	files, err := fs.Glob(emailTemplateFS, "templates/email/*.txt")
+	if err != nil {
+		log.Fatalf("Error listing email templates: %v", err)
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".txt")
+		text, err := texttemplate.ParseFS(emailTemplateFS, file)
+		if err != nil {
+			log.Fatalf("Error parsing email template %s: %v", file, err)
+		}
+		html, err := template.Must(layout.Clone()).ParseFS(emailTemplateFS, "templates/email/"+name+".html")
+		if err != nil {
+			log.Fatalf("Error parsing email template %s: %v", name, err)
+		}
+		emailTemplates[name] = &emailTemplate{text: text, html: html}
+	}
+}
+
+// renderEmail executes the named message's templates with the data
+func renderEmail(name string, data interface{}) (*emailMessage, error) {
+	tmpl, ok := emailTemplates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown email template %q", name)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := tmpl.text.ExecuteTemplate(&text, "content", data); err != nil {
+		return nil, err
+	}
+	if err := tmpl.html.ExecuteTemplate(&html, "layout", data); err != nil {
+		return nil, err
+	}
+
+	return &emailMessage{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    html.String(),
+	}, nil
+}
+
+// build encodes the message as a multipart/alternative email from the sender to the recipient,
+// with the plain text part first so clients without HTML fall back to it. With attachments it is
+// wrapped in a multipart/mixed email, the attachments following it.
+func (m *emailMessage) build(from, to string) ([]byte, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	parts := []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", m.Text},
+		{"text/html; charset=UTF-8", m.HTML},
+	}
+	for _, part := range parts {
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	content, contentType := body.Bytes(), "multipart/alternative; boundary="+writer.Boundary()
+
+	if len(m.Attachments) > 0 {
+		var mixed bytes.Buffer
+		mixedWriter := multipart.NewWriter(&mixed)
+		w, err := mixedWriter.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+		for _, attachment := range m.Attachments {
+			w, err := mixedWriter.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {mime.FormatMediaType(attachment.ContentType, map[string]string{"name": attachment.Filename})},
+				"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})},
+				"Content-Transfer-Encoding": {"base64"},
+			})
+			if err != nil {
+				return nil, err
+			}
+			// Lines of base64 are kept within the 76 characters MIME allows
+			encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+			for len(encoded) > 76 {
+				fmt.Fprintf(w, "%s\r\n", encoded[:76])
+				encoded = encoded[76:]
+			}
+			fmt.Fprintf(w, "%s\r\n", encoded)
+		}
+		if err := mixedWriter.Close(); err != nil {
+			return nil, err
+		}
+		content, contentType = mixed.Bytes(), "multipart/mixed; boundary="+mixedWriter.Boundary()
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", to)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", m.Subject))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: %s\r\n\r\n", contentType)
+	message.Write(content)
+	return message.Bytes(), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// writeCacheableJSON answers 200 with v and an ETag of its encoding, or 304 without a body when
+// the request's If-None-Match already has that ETag. The ETag covers the whole response, so it
+// changes with the prices of the customer asking too.
+//
+// Responses vary with the caller's customer group and flash sale prices, so they vary by the
+// credentials, and those of a signed-in caller are kept out of shared caches.
+func writeCacheableJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Error encoding response to JSON:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.Header().Set("Vary", "Authorization, X-API-Key")
+	if r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != "" {
+		w.Header().Set("Cache-Control", "private")
+	}
+
+	sum := sha256.Sum256(response)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// writeCacheableListJSON answers like writeListJSON, with an ETag like writeCacheableJSON
+func writeCacheableListJSON(w http.ResponseWriter, r *http.Request, page interface{}, key string, fields []string) {
+	selected, err := selectListFields(page, key, fields)
+	if err != nil {
+		log.Println("Error selecting list fields:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	writeCacheableJSON(w, r, selected)
+}
+
+// etagMatches reports whether an If-None-Match header lists the ETag, or is *. It compares
+// weakly, as RFC 9110 has If-None-Match do, so a W/ prefix is ignored.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteCacheableJSONVariesByCaller(t *testing.T) {
+	product := map[string]interface{}{"id": 1, "price": 9.5}
+
+	anonymous := httptest.NewRequest(http.MethodGet, "/products/1", nil)
+	rec := httptest.NewRecorder()
+	writeCacheableJSON(rec, anonymous, product)
+	if got := rec.Header().Get("Vary"); got != "Authorization, X-API-Key" {
+		t.Errorf("Vary = %q, want Authorization, X-API-Key", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "" {
+		t.Errorf("anonymous Cache-Control = %q, want none", got)
+	}
+	etag := rec.Header().Get("ETag")
+
+	signedIn := httptest.NewRequest(http.MethodGet, "/products/1", nil)
+	signedIn.Header.Set("Authorization", "Bearer token")
+	signedIn.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	writeCacheableJSON(rec, signedIn, product)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotModified)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "private" {
+		t.Errorf("signed-in Cache-Control = %q, want private", got)
+	}
+}
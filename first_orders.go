@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errFirstOrderCardUsed is returned when an order with the first-order discount is paid with a
+// card that already got another customer the discount
+var errFirstOrderCardUsed = errors.New("this card was already used for another account's first order discount")
+
+// First-order discount settings, loaded from environment variables by loadFirstOrderConfig
+var firstOrderConfig = struct {
+	// Percent is taken off a customer's first order; 0 turns the discount off
+	Percent float64
+	// MaxDiscount caps the discount; 0 means no cap
+	MaxDiscount float64
+}{}
+
+// paymentFingerprinter is implemented by gateways that can tell which card a payment token
+// belongs to, so one card is recognised across tokens and customers
+type paymentFingerprinter interface {
+	Fingerprint(ctx context.Context, token string) (string, error)
+}
+
+func loadFirstOrderConfig() {
+	if v := os.Getenv("FIRST_ORDER_DISCOUNT_PERCENT"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < 0 || n > 100 {
+			log.Fatalf("Invalid FIRST_ORDER_DISCOUNT_PERCENT %q", v)
+		}
+		firstOrderConfig.Percent = n
+	}
+	if v := os.Getenv("FIRST_ORDER_DISCOUNT_MAX"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid FIRST_ORDER_DISCOUNT_MAX %q", v)
+		}
+		firstOrderConfig.MaxDiscount = n
+	}
+}
+
+// emailKey reduces an email address to the mailbox it delivers to, so aliases like
+// jane+shop@gmail.com and j.ane@gmail.com count as jane@gmail.com
+func emailKey(email string) string {
+	email = normalizeEmail(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], email[at+1:]
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	if domain == "gmail.com" || domain == "googlemail.com" {
+		local, domain = strings.ReplaceAll(local, ".", ""), "gmail.com"
+	}
+	return local + "@" + domain
+}
+
+// fingerprintPayment looks up the fingerprint of the card the payment is made with, when its
+// gateway can tell. A lookup that fails leaves it empty.
+func fingerprintPayment(ctx context.Context, req *PaymentRequest) {
+	fingerprinter, ok := paymentGateways[req.Provider].(paymentFingerprinter)
+	if !ok || req.PaymentMethod == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	fingerprint, err := fingerprinter.Fingerprint(ctx, req.PaymentMethod)
+	if err != nil {
+		log.Printf("Error fingerprinting %s payment method: %v", req.Provider, err)
+		return
+	}
+	req.fingerprint = fingerprint
+}
+
+// applyFirstOrderDiscount gives the new order the first-order discount off remaining when the
+// customer has no other paid order or discounted first order, and neither their email address
+// nor the payment's card got another customer the discount. Cancelled orders don't count.
+func applyFirstOrderDiscount(ctx context.Context, tx *sql.Tx, orderID, customerID int, payment *PaymentRequest, remaining float64) (float64, error) {
+	if firstOrderConfig.Percent <= 0 || remaining <= 0 {
+		return 0, nil
+	}
+	var fingerprint string
+	if payment != nil {
+		fingerprint = payment.fingerprint
+	}
+
+	// Locking the customer keeps two orders placed at once from both getting the discount
+	var email string
+	if err := tx.QueryRowContext(ctx, "SELECT email FROM customers WHERE id = $1 FOR UPDATE", customerID).Scan(&email); err != nil {
+		return 0, err
+	}
+	key := emailKey(email)
+
+	var eligible bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT NOT EXISTS (
+			SELECT 1 FROM orders o
+			WHERE o.customer_id = $2 AND o.id <> $1 AND o.status <> $6
+				AND (o.status NOT IN ($4, $5) OR EXISTS (SELECT 1 FROM first_order_discounts f WHERE f.order_id = o.id))
+		) AND NOT EXISTS (
+			SELECT 1 FROM first_order_discounts f
+			JOIN orders o ON o.id = f.order_id
+			WHERE f.customer_id <> $2 AND o.status <> $6
+				AND (f.email_key = $3 OR f.payment_fingerprint = NULLIF($7, ''))
+		)
+	`, orderID, customerID, key, orderStatusPending, orderStatusAwaitingPayment, orderStatusCancelled, fingerprint).Scan(&eligible)
+	if err != nil || !eligible {
+		return 0, err
+	}
+
+	discount := remaining * firstOrderConfig.Percent / 100
+	if firstOrderConfig.MaxDiscount > 0 {
+		discount = math.Min(discount, firstOrderConfig.MaxDiscount)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO first_order_discounts (order_id, customer_id, email_key, payment_fingerprint)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+	`, orderID, customerID, key, fingerprint)
+	return roundCents(discount), err
+}
+
+// checkFirstOrderPayment refuses paying an order that got the first-order discount with a card
+// that got another customer the discount, and records the card on the order otherwise
+func checkFirstOrderPayment(ctx context.Context, orderID int, req PaymentRequest) error {
+	if req.fingerprint == "" {
+		return nil
+	}
+	var used bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM first_order_discounts f
+			JOIN first_order_discounts other ON other.payment_fingerprint = $2 AND other.customer_id <> f.customer_id
+			JOIN orders o ON o.id = other.order_id
+			WHERE f.order_id = $1 AND o.status <> $3
+		)
+	`, orderID, req.fingerprint, orderStatusCancelled).Scan(&used)
+	if err != nil {
+		return err
+	}
+	if used {
+		return errFirstOrderCardUsed
+	}
+	_, err = db.ExecContext(ctx, "UPDATE first_order_discounts SET payment_fingerprint = $1 WHERE order_id = $2", req.fingerprint, orderID)
+	return err
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// errInvalidSalePrice is returned, wrapped with the reason, when a sale price can't be saved
+var errInvalidSalePrice = handlers.NewFieldError("prices", "prices is not valid")
+
+// FlashSale lowers the prices of its products between StartsAt and EndsAt
+type FlashSale struct {
+	ID        int         `json:"flash_sale_id"`
+	Name      string      `json:"name"`
+	StartsAt  time.Time   `json:"starts_at"`
+	EndsAt    time.Time   `json:"ends_at"`
+	Prices    []SalePrice `json:"prices"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// SalePrice is a flash sale's price for a product and all its variants
+type SalePrice struct {
+	ProductID int     `json:"product_id"`
+	Price     float64 `json:"price"`
+}
+
+type FlashSaleRequest struct {
+	Name     string      `json:"name"`
+	StartsAt time.Time   `json:"starts_at"`
+	EndsAt   time.Time   `json:"ends_at"`
+	Prices   []SalePrice `json:"prices"`
+}
+
+// flashSaleCache keeps the prices of the running flash sales in memory until the next sale
+// starts or ends, or a sale is changed, so pricing a product doesn't reach Postgres each time
+var flashSaleCache = struct {
+	sync.Mutex
+	// prices is nil when the cache needs loading
+	prices    map[int]float64
+	expiresAt time.Time
+}{}
+
+// productPricing is what a customer pays for products right now: flash sale prices, then
+// their customer group's prices
+type productPricing struct {
+	sales map[int]float64
+	group *groupPricing
+}
+
+// ADMIN FLASH SALES
+func AdminFlashSalesHandler(w http.ResponseWriter, r *http.Request) {
+	sales, err := getFlashSales(r.Context())
+	if err != nil {
+		log.Println("Error retrieving flash sales:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, sales)
+}
+
+func AdminCreateFlashSaleHandler(w http.ResponseWriter, r *http.Request) {
+	saleRequest, ok := readFlashSaleRequest(w, r)
+	if !ok {
+		return
+	}
+
+	sale, err := saveFlashSale(r.Context(), 0, saleRequest)
+	if errors.Is(err, errInvalidSalePrice) {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err != nil {
+		log.Println("Error creating flash sale:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, sale)
+}
+
+// AdminUpdateFlashSaleHandler replaces the sale's name, window and prices. Orders already
+// placed keep the prices they were placed with.
+func AdminUpdateFlashSaleHandler(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid flash sale ID")
+		return
+	}
+
+	saleRequest, ok := readFlashSaleRequest(w, r)
+	if !ok {
+		return
+	}
+
+	sale, err := saveFlashSale(r.Context(), saleID, saleRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Flash sale not found")
+		return
+	}
+	if errors.Is(err, errInvalidSalePrice) {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err != nil {
+		log.Println("Error updating flash sale:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, sale)
+}
+
+// AdminDeleteFlashSaleHandler deletes the sale, ending it at once if it is running
+func AdminDeleteFlashSaleHandler(w http.ResponseWriter, r *http.Request) {
+	saleID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid flash sale ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM flash_sales WHERE id = $1", saleID)
+	if err != nil {
+		log.Println("Error deleting flash sale:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Flash sale not found")
+		return
+	}
+	invalidateFlashSaleCache()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func readFlashSaleRequest(w http.ResponseWriter, r *http.Request) (FlashSaleRequest, bool) {
+	var saleRequest FlashSaleRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return saleRequest, false
+	}
+
+	err = json.Unmarshal(body, &saleRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return saleRequest, false
+	}
+
+	saleRequest.Name = strings.TrimSpace(saleRequest.Name)
+
+	var validationErr error
+	switch {
+	case saleRequest.Name == "" || len(saleRequest.Name) > 255:
+		validationErr = handlers.NewFieldError("name", "name is required and must be at most 255 characters")
+	case saleRequest.StartsAt.IsZero() || saleRequest.EndsAt.IsZero():
+		validationErr = errors.New("starts_at and ends_at are required")
+	case !saleRequest.EndsAt.After(saleRequest.StartsAt):
+		validationErr = handlers.NewFieldError("ends_at", "ends_at must be after starts_at")
+	case !saleRequest.EndsAt.After(time.Now()):
+		validationErr = handlers.NewFieldError("ends_at", "ends_at must be in the future")
+	case len(saleRequest.Prices) == 0:
+		validationErr = handlers.NewFieldError("prices", "at least one price is required")
+	}
+	seen := make(map[int]bool)
+	for i, price := range saleRequest.Prices {
+		if validationErr != nil {
+			break
+		}
+		switch {
+		case price.Price < 0:
+			validationErr = handlers.NestFieldError(fmt.Sprintf("prices[%d]", i), handlers.NewFieldError("price", "price must not be negative"))
+		case seen[price.ProductID]:
+			validationErr = handlers.NestFieldError(fmt.Sprintf("prices[%d]", i), handlers.FieldErrorf("product_id", "product %d has more than one price", price.ProductID))
+		}
+		seen[price.ProductID] = true
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return saleRequest, false
+	}
+
+	return saleRequest, true
+}
+
+// saveFlashSale inserts a new sale when saleID is 0, otherwise updates it, replacing its prices
+func saveFlashSale(ctx context.Context, saleID int, req FlashSaleRequest) (*FlashSale, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if saleID == 0 {
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO flash_sales (name, starts_at, ends_at)
+			VALUES ($1, $2, $3)
+			RETURNING id
+		`, req.Name, req.StartsAt, req.EndsAt).Scan(&saleID)
+	} else {
+		err = tx.QueryRowContext(ctx, `
+			UPDATE flash_sales SET name = $1, starts_at = $2, ends_at = $3
+			WHERE id = $4
+			RETURNING id
+		`, req.Name, req.StartsAt, req.EndsAt, saleID).Scan(&saleID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM flash_sale_prices WHERE sale_id = $1", saleID); err != nil {
+		return nil, err
+	}
+	for i, price := range req.Prices {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO flash_sale_prices (sale_id, product_id, price)
+			VALUES ($1, $2, $3)
+		`, saleID, price.ProductID, roundCents(price.Price))
+		if isForeignKeyViolation(err) {
+			return nil, fmt.Errorf("%w: prices[%d]: product %d does not exist", errInvalidSalePrice, i, price.ProductID)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	invalidateFlashSaleCache()
+
+	sales, err := getFlashSales(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sales {
+		if sales[i].ID == saleID {
+			return &sales[i], nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// getFlashSales returns every flash sale, the latest to start first
+func getFlashSales(ctx context.Context) ([]FlashSale, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT s.id, s.name, s.starts_at, s.ends_at, s.created_at, sp.product_id, sp.price
+		FROM flash_sales s
+		LEFT JOIN flash_sale_prices sp ON sp.sale_id = s.id
+		ORDER BY s.starts_at DESC, s.id DESC, sp.product_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sales := make([]FlashSale, 0)
+	for rows.Next() {
+		var sale FlashSale
+		var productID sql.NullInt64
+		var price sql.NullFloat64
+		if err := rows.Scan(&sale.ID, &sale.Name, &sale.StartsAt, &sale.EndsAt, &sale.CreatedAt, &productID, &price); err != nil {
+			return nil, err
+		}
+		if len(sales) == 0 || sales[len(sales)-1].ID != sale.ID {
+			sale.Prices = make([]SalePrice, 0)
+			sales = append(sales, sale)
+		}
+		if productID.Valid {
+			last := &sales[len(sales)-1]
+			last.Prices = append(last.Prices, SalePrice{ProductID: int(productID.Int64), Price: price.Float64})
+		}
+	}
+
+	return sales, rows.Err()
+}
+
+// invalidateFlashSaleCache has the next price lookup load the running sales again
+func invalidateFlashSaleCache() {
+	flashSaleCache.Lock()
+	flashSaleCache.prices = nil
+	flashSaleCache.Unlock()
+}
+
+// runningSalePrices returns the lowest running sale price of each product on sale. The prices
+// are cached until the next sale starts or ends.
+func runningSalePrices(ctx context.Context) (map[int]float64, error) {
+	flashSaleCache.Lock()
+	defer flashSaleCache.Unlock()
+	if flashSaleCache.prices != nil && time.Now().Before(flashSaleCache.expiresAt) {
+		return flashSaleCache.prices, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT sp.product_id, MIN(sp.price)
+		FROM flash_sales s
+		JOIN flash_sale_prices sp ON sp.sale_id = s.id
+		WHERE s.starts_at <= NOW() AND s.ends_at > NOW()
+		GROUP BY sp.product_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := make(map[int]float64)
+	for rows.Next() {
+		var productID int
+		var price float64
+		if err := rows.Scan(&productID, &price); err != nil {
+			return nil, err
+		}
+		prices[productID] = price
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The prices hold until the next sale starts or ends
+	var next sql.NullTime
+	err = db.QueryRowContext(ctx, `
+		SELECT MIN(t) FROM (
+			SELECT starts_at AS t FROM flash_sales WHERE starts_at > NOW()
+			UNION ALL
+			SELECT ends_at FROM flash_sales WHERE ends_at > NOW()
+		) boundaries
+	`).Scan(&next)
+	if err != nil {
+		return nil, err
+	}
+	flashSaleCache.prices = prices
+	flashSaleCache.expiresAt = time.Now().Add(24 * time.Hour)
+	if next.Valid && next.Time.Before(flashSaleCache.expiresAt) {
+		flashSaleCache.expiresAt = next.Time
+	}
+	return prices, nil
+}
+
+// currentPricing returns what the customer pays for products now; guests have customerID 0
+func currentPricing(ctx context.Context, q querier, customerID int) (*productPricing, error) {
+	sales, err := runningSalePrices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	group, err := customerGroupPricing(ctx, q, customerID)
+	if err != nil {
+		return nil, err
+	}
+	return &productPricing{sales: sales, group: group}, nil
+}
+
+// price returns what a unit of the product usually priced at price costs now. A running sale
+// replaces the price when it is lower, and the customer's group prices the result, never above it.
+func (p *productPricing) price(productID int, price float64) float64 {
+	if sale, ok := p.sales[productID]; ok && sale < price {
+		price = sale
+	}
+	return math.Min(p.group.price(productID, price), price)
+}
+
+// apply sets the product's price to what it costs now, keeping the usual price of a product on
+// sale as its RegularPrice
+func (p *productPricing) apply(product *Product) {
+	price := p.price(product.ID, product.Price)
+	if _, onSale := p.sales[product.ID]; onSale && price < product.Price {
+		regular := product.Price
+		product.RegularPrice = &regular
+	}
+	product.Price = price
+}
+
+func (p *productPricing) applyTo(products []Product) {
+	for i := range products {
+		p.apply(&products[i])
+	}
+}
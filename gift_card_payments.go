@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// paymentProviderGiftCard pays with a gift card's balance. It is combined with another
+// provider, which pays whatever the gift card doesn't cover.
+const paymentProviderGiftCard = "gift_card"
+
+var errGiftCardNotFound = handlers.NewFieldError("payment.gift_card_code", "payment.gift_card_code is not a valid gift card")
+
+// validateGiftCardTender checks that the gift card exists and has a balance to pay with
+func validateGiftCardTender(ctx context.Context, code string) error {
+	var balance float64
+	var currency string
+	err := db.QueryRowContext(ctx, "SELECT balance, currency FROM gift_cards WHERE code = $1", code).Scan(&balance, &currency)
+	if isNoRows(err) {
+		return errGiftCardNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if currency != paymentConfig.Currency {
+		return handlers.NewFieldError("payment.gift_card_code", "payment.gift_card_code is in another currency")
+	}
+	if roundCents(balance) <= 0 {
+		return handlers.NewFieldError("payment.gift_card_code", "payment.gift_card_code has no balance left")
+	}
+	return nil
+}
+
+// payOrderSplit redeems the request's gift card first and charges what it doesn't cover
+// through the provider. It returns the gift card payment and the provider's payment, either
+// of which is nil when it wasn't needed.
+func payOrderSplit(ctx context.Context, orderID int, req PaymentRequest) (*Payment, *Payment, error) {
+	var giftCardPayment *Payment
+	if req.GiftCardCode != "" {
+		var err error
+		giftCardPayment, err = redeemGiftCard(ctx, orderID, req.GiftCardCode)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if req.Provider == "" {
+		return giftCardPayment, nil, nil
+	}
+
+	var due float64
+	if err := db.QueryRowContext(ctx, "SELECT "+amountDueSQL+" FROM orders WHERE id = $1", orderID).Scan(&due); err != nil {
+		return giftCardPayment, nil, err
+	}
+	if roundCents(due) <= 0 {
+		return giftCardPayment, nil, nil
+	}
+
+	payment, err := payOrder(ctx, orderID, req)
+	return giftCardPayment, payment, err
+}
+
+// redeemGiftCard takes as much of the order's amount due as the gift card's balance covers
+// and records it as a captured payment. It returns nil when there was nothing to take.
+func redeemGiftCard(ctx context.Context, orderID int, code string) (*Payment, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var due float64
+	if err := tx.QueryRowContext(ctx, "SELECT "+amountDueSQL+" FROM orders WHERE id = $1 FOR UPDATE", orderID).Scan(&due); err != nil {
+		return nil, err
+	}
+
+	var giftCardID int
+	var balance float64
+	payment := &Payment{OrderID: orderID, Provider: paymentProviderGiftCard, Status: paymentStatusCaptured}
+	err = tx.QueryRowContext(ctx, "SELECT id, balance, currency FROM gift_cards WHERE code = $1 FOR UPDATE", code).Scan(&giftCardID, &balance, &payment.Currency)
+	if isNoRows(err) {
+		return nil, errGiftCardNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	payment.Amount = roundCents(math.Min(balance, due))
+	if payment.Amount <= 0 {
+		return nil, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE gift_cards SET balance = balance - $1 WHERE id = $2", payment.Amount, giftCardID); err != nil {
+		return nil, err
+	}
+	if err := recordGiftCardTransaction(ctx, tx, giftCardID, giftCardTransactionRedeem, -payment.Amount, &orderID); err != nil {
+		return nil, err
+	}
+	// The code is the payment's reference, so a refund can put the amount back on the card
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO payments (order_id, provider, reference, amount, currency, status)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, orderID, payment.Provider, code, payment.Amount, payment.Currency, payment.Status).Scan(&payment.ID, &payment.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordCharge(ctx, tx, payment.ID, 0); err != nil {
+		return nil, err
+	}
+	if err := settleOrder(ctx, tx, orderID); err != nil {
+		return nil, err
+	}
+
+	return payment, tx.Commit()
+}
+
+// refundGiftCardPayments puts what the order's gift cards paid, less what was already refunded,
+// back on the cards, for an order that is cancelled before the rest of it is paid
+func refundGiftCardPayments(ctx context.Context, tx *sql.Tx, orderID int) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT p.id, p.reference, p.currency,
+			   p.amount - COALESCE((SELECT SUM(amount) FROM refunds WHERE payment_id = p.id AND status <> $2), 0)
+		FROM payments p
+		WHERE p.order_id = $1 AND p.provider = $3 AND p.status = $4 AND p.reference IS NOT NULL
+		ORDER BY p.id
+	`, orderID, refundStatusFailed, paymentProviderGiftCard, paymentStatusCaptured)
+	if err != nil {
+		return err
+	}
+
+	type giftCardRefund struct {
+		Refund
+		code string
+	}
+	var refunds []giftCardRefund
+	for rows.Next() {
+		refund := giftCardRefund{Refund: Refund{OrderID: orderID, Reason: "Order cancelled", Status: refundStatusSucceeded}}
+		if err := rows.Scan(&refund.PaymentID, &refund.code, &refund.Currency, &refund.Amount); err != nil {
+			rows.Close()
+			return err
+		}
+		refund.Amount = roundCents(refund.Amount)
+		if refund.Amount > 0 {
+			refunds = append(refunds, refund)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, refund := range refunds {
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO refunds (order_id, payment_id, amount, reason, status)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id
+		`, orderID, refund.PaymentID, refund.Amount, refund.Reason, refund.Status).Scan(&refund.ID)
+		if err != nil {
+			return err
+		}
+		if err := recordRefund(ctx, tx, refund.Refund); err != nil {
+			return err
+		}
+		if err := creditGiftCard(ctx, tx, refund.code, refund.Amount, orderID); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE payments SET status = $1, updated_at = NOW() WHERE id = $2", paymentStatusRefunded, refund.PaymentID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Gift card transaction types. Amounts are positive for issue and refund, negative for redeem.
+const (
+	giftCardTransactionIssue  = "issue"
+	giftCardTransactionRedeem = "redeem"
+	giftCardTransactionRefund = "refund"
+)
+
+// codeAlphabet leaves out characters that are easily mistaken for each other
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// maxGiftCardAmount guards against typos when admins issue cards
+const maxGiftCardAmount = 10000
+
+// GiftCard is a code customers pay with until its balance runs out. Cards are bought as gift
+// card products or issued by admins.
+type GiftCard struct {
+	ID             int     `json:"gift_card_id"`
+	Code           string  `json:"code"`
+	InitialBalance float64 `json:"initial_balance"`
+	Balance        float64 `json:"balance"`
+	Currency       string  `json:"currency"`
+	// OrderID is the order the card was bought with; issued cards have none
+	OrderID    *int `json:"order_id,omitempty"`
+	CustomerID *int `json:"customer_id,omitempty"`
+	// RecipientEmail is who an issued card was sent to; bought cards go to the buyer
+	RecipientEmail string     `json:"recipient_email,omitempty"`
+	Note           string     `json:"note,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	// Transactions are only included in admin gift card responses
+	Transactions []GiftCardTransaction `json:"transactions,omitempty"`
+}
+
+type GiftCardTransaction struct {
+	Type      string    `json:"type"`
+	Amount    float64   `json:"amount"`
+	OrderID   *int      `json:"order_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GiftCardBalance is what anyone holding a code can see of its card
+type GiftCardBalance struct {
+	Code     string  `json:"code"`
+	Balance  float64 `json:"balance"`
+	Currency string  `json:"currency"`
+}
+
+type IssueGiftCardRequest struct {
+	Amount         float64 `json:"amount"`
+	RecipientEmail string  `json:"recipient_email"`
+	Note           string  `json:"note"`
+}
+
+// GIFT CARD BALANCE
+func GiftCardBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	var balance GiftCardBalance
+	err := db.QueryRowContext(r.Context(), `
+		SELECT code, balance, currency FROM gift_cards WHERE code = $1
+	`, strings.ToUpper(strings.TrimSpace(mux.Vars(r)["code"]))).Scan(&balance.Code, &balance.Balance, &balance.Currency)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Gift card not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error retrieving gift card:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, balance)
+}
+
+// CUSTOMER GIFT CARDS
+// CustomerGiftCardsHandler lists the gift cards the customer bought
+func CustomerGiftCardsHandler(w http.ResponseWriter, r *http.Request) {
+	cards, err := getGiftCards(r.Context(), getCustomerID(r))
+	if err != nil {
+		log.Println("Error retrieving gift cards:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, cards)
+}
+
+// ADMIN GIFT CARDS
+func AdminGiftCardsHandler(w http.ResponseWriter, r *http.Request) {
+	cards, err := getGiftCards(r.Context(), 0)
+	if err != nil {
+		log.Println("Error retrieving gift cards:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, cards)
+}
+
+func AdminGetGiftCardHandler(w http.ResponseWriter, r *http.Request) {
+	giftCardID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid gift card ID")
+		return
+	}
+
+	card, err := getGiftCard(r.Context(), giftCardID)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Gift card not found")
+		return
+	}
+	if err == nil {
+		card.Transactions, err = getGiftCardTransactions(r.Context(), giftCardID)
+	}
+	if err != nil {
+		log.Println("Error retrieving gift card:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, card)
+}
+
+// AdminIssueGiftCardHandler issues a promotional gift card and emails its code to the
+// recipient, when there is one
+func AdminIssueGiftCardHandler(w http.ResponseWriter, r *http.Request) {
+	var issueRequest IssueGiftCardRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &issueRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	issueRequest.Amount = roundCents(issueRequest.Amount)
+	issueRequest.RecipientEmail = strings.TrimSpace(issueRequest.RecipientEmail)
+	issueRequest.Note = strings.TrimSpace(issueRequest.Note)
+
+	var validationErr error
+	switch {
+	case issueRequest.Amount <= 0 || issueRequest.Amount > maxGiftCardAmount:
+		validationErr = handlers.FieldErrorf("amount", "amount must be positive and at most %d", maxGiftCardAmount)
+	case issueRequest.RecipientEmail != "" && !validEmail(issueRequest.RecipientEmail):
+		validationErr = handlers.NewFieldError("recipient_email", "recipient_email is not a valid email address")
+	case len(issueRequest.Note) > maxOrderLineNoteLength:
+		validationErr = handlers.FieldErrorf("note", "note must be at most %d characters", maxOrderLineNoteLength)
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	var card *GiftCard
+	if err == nil {
+		defer tx.Rollback()
+		card, err = createGiftCard(r.Context(), tx, issueRequest.Amount, nil, nil, issueRequest.RecipientEmail, issueRequest.Note)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Error issuing gift card:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// A failed email is retried by the background task
+	if card.RecipientEmail != "" {
+		if err := deliverGiftCard(r.Context(), card, card.RecipientEmail); err != nil {
+			log.Printf("Error emailing gift card %d: %v", card.ID, err)
+		}
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, card)
+}
+
+func validEmail(email string) bool {
+	_, err := mail.ParseAddress(email)
+	return err == nil
+}
+
+// generateCode returns a random code of length characters in groups of four, like
+// "ABCD-EFGH-JKLM-NPQR" for 16
+func generateCode(length int) (string, error) {
+	var code strings.Builder
+	for i := 0; i < length; i++ {
+		if i > 0 && i%4 == 0 {
+			code.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code.WriteByte(codeAlphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
+
+// createGiftCard issues a card worth amount in the store's currency with a new unique code
+func createGiftCard(ctx context.Context, tx *sql.Tx, amount float64, customerID, orderID *int, recipientEmail, note string) (*GiftCard, error) {
+	card := &GiftCard{
+		InitialBalance: amount,
+		Balance:        amount,
+		Currency:       paymentConfig.Currency,
+		OrderID:        orderID,
+		CustomerID:     customerID,
+		RecipientEmail: recipientEmail,
+		Note:           note,
+	}
+
+	// A code that is already taken inserts nothing, and another one is tried
+	for attempt := 0; card.ID == 0; attempt++ {
+		if attempt == 5 {
+			return nil, errors.New("could not generate a unique gift card code")
+		}
+		code, err := generateCode(16)
+		if err != nil {
+			return nil, err
+		}
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO gift_cards (code, initial_balance, balance, currency, order_id, customer_id, recipient_email, note)
+			VALUES ($1, $2, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''))
+			ON CONFLICT (code) DO NOTHING
+			RETURNING id, created_at
+		`, code, amount, card.Currency, orderID, customerID, recipientEmail, note).Scan(&card.ID, &card.CreatedAt)
+		if isNoRows(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		card.Code = code
+	}
+
+	return card, recordGiftCardTransaction(ctx, tx, card.ID, giftCardTransactionIssue, amount, orderID)
+}
+
+func recordGiftCardTransaction(ctx context.Context, tx *sql.Tx, giftCardID int, transactionType string, amount float64, orderID *int) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO gift_card_transactions (gift_card_id, type, amount, order_id)
+		VALUES ($1, $2, $3, $4)
+	`, giftCardID, transactionType, amount, orderID)
+	return err
+}
+
+// creditGiftCard puts a refunded amount back on the card
+func creditGiftCard(ctx context.Context, tx *sql.Tx, code string, amount float64, orderID int) error {
+	var giftCardID int
+	err := tx.QueryRowContext(ctx, "UPDATE gift_cards SET balance = balance + $1 WHERE code = $2 RETURNING id", amount, code).Scan(&giftCardID)
+	if err != nil {
+		return err
+	}
+	return recordGiftCardTransaction(ctx, tx, giftCardID, giftCardTransactionRefund, amount, &orderID)
+}
+
+// issueOrderGiftCards issues a card for every gift card unit on the paid order, worth the
+// price paid for it. The cards are emailed to the buyer by deliverGiftCards.
+func issueOrderGiftCards(ctx context.Context, tx *sql.Tx, orderID int) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT o.customer_id, op.unit_price_at_purchase, op.quantity, COALESCE(op.gift_message, '')
+		FROM order_products op
+		JOIN orders o ON o.id = op.order_id
+		JOIN products p ON p.id = op.product_id
+		WHERE op.order_id = $1 AND p.is_gift_card
+		  AND NOT EXISTS (SELECT 1 FROM gift_cards WHERE order_id = $1)
+	`, orderID)
+	if err != nil {
+		return err
+	}
+
+	type giftCardLine struct {
+		CustomerID *int
+		Amount     float64
+		Quantity   int
+		Message    string
+	}
+	var lines []giftCardLine
+	for rows.Next() {
+		var line giftCardLine
+		if err := rows.Scan(&line.CustomerID, &line.Amount, &line.Quantity, &line.Message); err != nil {
+			rows.Close()
+			return err
+		}
+		lines = append(lines, line)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		for i := 0; i < line.Quantity; i++ {
+			if _, err := createGiftCard(ctx, tx, line.Amount, line.CustomerID, &orderID, "", line.Message); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deliverGiftCards emails the codes of gift cards that haven't been sent yet: bought cards to
+// the customer who ordered them and issued cards to their recipient
+func deliverGiftCards(ctx context.Context) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT g.id, g.code, g.balance, g.currency, g.order_id, COALESCE(g.note, ''), COALESCE(g.recipient_email, c.email)
+		FROM gift_cards g
+		LEFT JOIN orders o ON o.id = g.order_id
+		LEFT JOIN customers c ON c.id = o.customer_id
+		WHERE g.delivered_at IS NULL AND COALESCE(g.recipient_email, c.email) IS NOT NULL
+		ORDER BY g.id
+	`)
+	if err != nil {
+		log.Println("Error querying undelivered gift cards:", err)
+		return
+	}
+
+	type delivery struct {
+		Card  GiftCard
+		Email string
+	}
+	var deliveries []delivery
+	for rows.Next() {
+		var d delivery
+		if err := rows.Scan(&d.Card.ID, &d.Card.Code, &d.Card.Balance, &d.Card.Currency, &d.Card.OrderID, &d.Card.Note, &d.Email); err != nil {
+			log.Println("Error scanning gift card:", err)
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Println("Error querying undelivered gift cards:", err)
+	}
+
+	for _, d := range deliveries {
+		if err := deliverGiftCard(ctx, &d.Card, d.Email); err != nil {
+			log.Printf("Error emailing gift card %d: %v", d.Card.ID, err)
+		}
+	}
+}
+
+// deliverGiftCard emails the card's code and marks it delivered
+func deliverGiftCard(ctx context.Context, card *GiftCard, email string) error {
+	data := giftCardEmail{Code: card.Code, Balance: card.Balance, Currency: card.Currency, Note: card.Note}
+	if card.OrderID != nil {
+		data.OrderID = *card.OrderID
+	}
+	if err := sendEmail(ctx, email, emailGiftCard, fmt.Sprintf("gift_card:%d", card.ID), data); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "UPDATE gift_cards SET delivered_at = NOW() WHERE id = $1", card.ID)
+	return err
+}
+
+const giftCardColumnsSQL = `
+	id, code, COALESCE(initial_balance, balance), balance, currency, order_id, customer_id,
+	COALESCE(recipient_email, ''), COALESCE(note, ''), delivered_at, created_at
+`
+
+func scanGiftCard(row interface{ Scan(...interface{}) error }) (*GiftCard, error) {
+	card := &GiftCard{}
+	err := row.Scan(&card.ID, &card.Code, &card.InitialBalance, &card.Balance, &card.Currency, &card.OrderID, &card.CustomerID,
+		&card.RecipientEmail, &card.Note, &card.DeliveredAt, &card.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return card, nil
+}
+
+func getGiftCard(ctx context.Context, giftCardID int) (*GiftCard, error) {
+	return scanGiftCard(db.QueryRowContext(ctx, "SELECT "+giftCardColumnsSQL+" FROM gift_cards WHERE id = $1", giftCardID))
+}
+
+// getGiftCards returns the cards the customer bought, or every card when customerID is 0
+func getGiftCards(ctx context.Context, customerID int) ([]GiftCard, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+giftCardColumnsSQL+`
+		FROM gift_cards
+		WHERE customer_id = $1 OR $1 = 0
+		ORDER BY created_at DESC, id DESC
+	`, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := make([]GiftCard, 0)
+	for rows.Next() {
+		card, err := scanGiftCard(rows)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, *card)
+	}
+
+	return cards, rows.Err()
+}
+
+func getGiftCardTransactions(ctx context.Context, giftCardID int) ([]GiftCardTransaction, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT type, amount, order_id, created_at
+		FROM gift_card_transactions
+		WHERE gift_card_id = $1
+		ORDER BY created_at, id
+	`, giftCardID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := make([]GiftCardTransaction, 0)
+	for rows.Next() {
+		var transaction GiftCardTransaction
+		if err := rows.Scan(&transaction.Type, &transaction.Amount, &transaction.OrderID, &transaction.CreatedAt); err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	return transactions, rows.Err()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDeliverGiftCardsEmailsBuyer(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+
+	email := fmt.Sprintf("gift-%d@example.com", time.Now().UnixNano())
+	var customerID, orderID int
+	err := db.QueryRowContext(ctx, "INSERT INTO customers (name, email, password) VALUES ('Test', $1, 'x') RETURNING id", email).Scan(&customerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRowContext(ctx, "INSERT INTO orders (customer_id, date, status, total) VALUES ($1, NOW(), $2, 25) RETURNING id",
+		customerID, orderStatusPaid).Scan(&orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, err := createGiftCard(ctx, tx, 25, &customerID, &orderID, "", "")
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	deliverGiftCards(ctx)
+
+	var deliveredAt sql.NullTime
+	if err := db.QueryRowContext(ctx, "SELECT delivered_at FROM gift_cards WHERE id = $1", card.ID).Scan(&deliveredAt); err != nil {
+		t.Fatal(err)
+	}
+	if !deliveredAt.Valid {
+		t.Errorf("gift card %d wasn't marked delivered", card.ID)
+	}
+	var queued int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM email_outbox WHERE recipient = $1 AND dedupe_key = $2",
+		email, fmt.Sprintf("gift_card:%d", card.ID)).Scan(&queued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 1 {
+		t.Errorf("%d gift card emails queued for %s, want 1", queued, email)
+	}
+}
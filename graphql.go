@@ -0,0 +1,885 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	graphql "github.com/graph-gophers/graphql-go"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+	"github.com/hanifmasy/simple-commerce/models"
+)
+
+// graphqlSchemaSDL describes what /graphql serves. Products and categories are public; orders
+// and customers are scoped like their REST endpoints.
+const graphqlSchemaSDL = `
+	schema {
+		query: Query
+	}
+
+	scalar Time
+
+	type Query {
+		products(search: String, category: ID, minPrice: Float, maxPrice: Float, sort: String, page: Int, limit: Int): ProductPage!
+		product(id: ID!): Product
+		categories: [Category!]!
+		me: Customer
+		orders(customerId: ID, status: [String!], dateFrom: String, dateTo: String, sort: String, page: Int, limit: Int): OrderPage!
+		order(id: ID!): Order
+		customer(id: ID!): Customer
+	}
+
+	type ProductPage {
+		products: [Product!]!
+		page: Int!
+		limit: Int!
+		total: Int!
+	}
+
+	type Product {
+		id: ID!
+		sku: String
+		name: String!
+		price: Float!
+		regularPrice: Float
+		description: String!
+		imageUrl: String!
+		categoryId: ID
+		giftCard: Boolean!
+		variants: [ProductVariant!]!
+		images: [ProductImage!]!
+		# stock needs the products.manage permission
+		stock: Int
+	}
+
+	type ProductVariant {
+		id: ID!
+		sku: String!
+		price: Float!
+		options: [VariantOption!]!
+	}
+
+	type VariantOption {
+		name: String!
+		value: String!
+	}
+
+	type ProductImage {
+		id: ID!
+		url: String!
+		position: Int!
+	}
+
+	type Category {
+		id: ID!
+		name: String!
+		parentId: ID
+	}
+
+	type Customer {
+		id: ID!
+		name: String!
+		email: String!
+		role: String!
+		orders(status: [String!], dateFrom: String, dateTo: String, sort: String, page: Int, limit: Int): OrderPage!
+	}
+
+	type OrderPage {
+		orders: [Order!]!
+		page: Int!
+		limit: Int!
+		total: Int!
+	}
+
+	type Order {
+		id: ID!
+		customer: Customer
+		date: Time!
+		status: String!
+		lines: [OrderLine!]!
+		subtotal: Float!
+		discount: Float!
+		couponCode: String
+		tax: Float!
+		shipping: Float!
+		total: Float!
+		shippingMethod: String
+	}
+
+	type OrderLine {
+		productId: ID!
+		name: String!
+		sku: String
+		quantity: Int!
+		price: Float!
+		variant: ProductVariant
+	}
+`
+
+// graphqlMaxDepth bounds how deeply queries nest, as customers and orders refer to each other
+const graphqlMaxDepth = 8
+
+// graphqlMaxNodes bounds how many objects a query may load. Nested lists multiply, so a page of
+// orders each listing its customer's orders would otherwise load thousands of rows; pages
+// count at their limit, before they are loaded.
+const graphqlMaxNodes = 2000
+
+// apiKeyContextKey holds the API key a GraphQL request authenticated with
+const apiKeyContextKey contextKey = "api_key"
+
+// graphqlExecutionContextKey holds the graphqlExecution of a GraphQL request
+const graphqlExecutionContextKey contextKey = "graphql_execution"
+
+// Errors GraphQL responses carry in place of a status
+var (
+	errGraphQLUnauthorized = errors.New("authentication required")
+	errGraphQLForbidden    = errors.New("forbidden")
+	errGraphQLInternal     = errors.New("internal server error")
+	errGraphQLTooComplex   = errors.New("query loads too many objects; ask for fewer fields or smaller pages")
+)
+
+// graphqlExecution is what the resolvers of one query share: the objects it has loaded so far
+// and the permissions already checked. Resolvers run in parallel, so mu guards both.
+type graphqlExecution struct {
+	mu          sync.Mutex
+	nodes       int
+	permissions map[string]bool
+}
+
+var graphqlSchema = graphql.MustParseSchema(graphqlSchemaSDL, &graphqlResolver{}, graphql.MaxDepth(graphqlMaxDepth))
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// GRAPHQL
+func GraphQLHandler(w http.ResponseWriter, r *http.Request) {
+	// Credentials are optional, as guests can query the catalog; each field checks the
+	// permission it needs
+	ctx := r.Context()
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+		ctx = context.WithValue(ctx, apiKeyContextKey, apiKey)
+	} else if token := bearerToken(r); token != "" {
+		claims, err := ParseToken(token)
+		if err != nil {
+			log.Println("Invalid token:", err)
+			handlers.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		ctx = context.WithValue(ctx, claimsContextKey, claims)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	var req graphqlRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		handlers.WriteFieldError(w, "query", "query is required")
+		return
+	}
+
+	ctx = context.WithValue(ctx, graphqlExecutionContextKey, &graphqlExecution{permissions: make(map[string]bool)})
+	handlers.WriteJSON(w, http.StatusOK, graphqlSchema.Exec(ctx, req.Query, req.OperationName, req.Variables))
+}
+
+// graphqlSpend counts n more objects against the query's graphqlMaxNodes
+func graphqlSpend(ctx context.Context, n int) error {
+	execution, ok := ctx.Value(graphqlExecutionContextKey).(*graphqlExecution)
+	if !ok {
+		return nil
+	}
+	execution.mu.Lock()
+	defer execution.mu.Unlock()
+	execution.nodes += n
+	if execution.nodes > graphqlMaxNodes {
+		return errGraphQLTooComplex
+	}
+	return nil
+}
+
+// graphqlCustomerID is the customer the request acts for, or 0 for guests and API keys
+func graphqlCustomerID(ctx context.Context) int {
+	if claims, ok := claimsFromContext(ctx); ok {
+		return claims.CustomerID
+	}
+	return 0
+}
+
+// graphqlCan checks the permission of the request's API key or customer. Each permission is
+// looked up once per query, however many of its objects need it.
+func graphqlCan(ctx context.Context, permission string) (bool, error) {
+	execution, _ := ctx.Value(graphqlExecutionContextKey).(*graphqlExecution)
+	if execution != nil {
+		execution.mu.Lock()
+		allowed, ok := execution.permissions[permission]
+		execution.mu.Unlock()
+		if ok {
+			return allowed, nil
+		}
+	}
+
+	var allowed bool
+	var err error
+	if apiKey, ok := ctx.Value(apiKeyContextKey).(string); ok {
+		allowed, err = apiKeyHasScope(ctx, apiKey, permission)
+	} else if customerID := graphqlCustomerID(ctx); customerID != 0 {
+		allowed, err = customerHasPermission(ctx, customerID, permission)
+	}
+	if err == nil && execution != nil {
+		execution.mu.Lock()
+		execution.permissions[permission] = allowed
+		execution.mu.Unlock()
+	}
+	return allowed, err
+}
+
+// graphqlOrderScope is the customer whose orders the request may read, or nil for every
+// customer's
+func graphqlOrderScope(ctx context.Context) (*int, error) {
+	viewAll, err := graphqlCan(ctx, PermViewAllOrders)
+	if err != nil {
+		return nil, graphqlInternalError("Error checking permission:", err)
+	}
+	if viewAll {
+		return nil, nil
+	}
+
+	customerID := graphqlCustomerID(ctx)
+	if customerID == 0 {
+		if _, ok := ctx.Value(apiKeyContextKey).(string); ok {
+			return nil, errGraphQLForbidden
+		}
+		return nil, errGraphQLUnauthorized
+	}
+	viewOwn, err := graphqlCan(ctx, PermViewOwnOrders)
+	if err != nil {
+		return nil, graphqlInternalError("Error checking permission:", err)
+	}
+	if !viewOwn {
+		return nil, errGraphQLForbidden
+	}
+	return &customerID, nil
+}
+
+// graphqlInternalError logs err and hides it from the response
+func graphqlInternalError(message string, err error) error {
+	log.Println(message, err)
+	return errGraphQLInternal
+}
+
+// parseGraphQLID parses the ID of a row
+func parseGraphQLID(id graphql.ID, name string) (int, error) {
+	n, err := strconv.Atoi(string(id))
+	if err != nil || n <= 0 {
+		return 0, errors.New(name + " must be a positive integer")
+	}
+	return n, nil
+}
+
+func graphqlID(id int) graphql.ID {
+	return graphql.ID(strconv.Itoa(id))
+}
+
+// graphqlListArgs are the arguments order lists take, passed on as the REST query parameters
+type graphqlListArgs struct {
+	Status   *[]string
+	DateFrom *string
+	DateTo   *string
+	Sort     *string
+	Page     *int32
+	Limit    *int32
+}
+
+func (args graphqlListArgs) query() url.Values {
+	query := url.Values{}
+	if args.Status != nil {
+		query.Set("status", strings.Join(*args.Status, ","))
+	}
+	if args.DateFrom != nil {
+		query.Set("date_from", *args.DateFrom)
+	}
+	if args.DateTo != nil {
+		query.Set("date_to", *args.DateTo)
+	}
+	if args.Sort != nil {
+		query.Set("sort", *args.Sort)
+	}
+	if args.Page != nil {
+		query.Set("page", strconv.Itoa(int(*args.Page)))
+	}
+	if args.Limit != nil {
+		query.Set("limit", strconv.Itoa(int(*args.Limit)))
+	}
+	return query
+}
+
+type graphqlResolver struct{}
+
+func (*graphqlResolver) Products(ctx context.Context, args struct {
+	Search   *string
+	Category *graphql.ID
+	MinPrice *float64
+	MaxPrice *float64
+	Sort     *string
+	Page     *int32
+	Limit    *int32
+}) (*productPageResolver, error) {
+	query := graphqlListArgs{Sort: args.Sort, Page: args.Page, Limit: args.Limit}.query()
+	if args.Category != nil {
+		query.Set("category", string(*args.Category))
+	}
+	if args.MinPrice != nil {
+		query.Set("min_price", strconv.FormatFloat(*args.MinPrice, 'f', -1, 64))
+	}
+	if args.MaxPrice != nil {
+		query.Set("max_price", strconv.FormatFloat(*args.MaxPrice, 'f', -1, 64))
+	}
+	filter, err := parseProductFilter(query)
+	if err != nil {
+		return nil, err
+	}
+	if err := graphqlSpend(ctx, filter.Limit); err != nil {
+		return nil, err
+	}
+
+	var products []Product
+	var total int
+	if args.Search != nil {
+		tsQuery := buildPrefixTSQuery(*args.Search)
+		if tsQuery == "" {
+			return nil, handlers.NewFieldError("search", "search must contain at least one word")
+		}
+		products, total, err = searchProducts(ctx, tsQuery, filter)
+	} else {
+		products, total, err = listProducts(ctx, filter)
+	}
+	var pricing *productPricing
+	if err == nil {
+		pricing, err = currentPricing(ctx, db, graphqlCustomerID(ctx))
+	}
+	if err != nil {
+		return nil, graphqlInternalError("Error retrieving products:", err)
+	}
+
+	pricing.applyTo(products)
+	return &productPageResolver{
+		page:  ProductPage{Products: products, Page: filter.Page, Limit: filter.Limit, Total: total},
+		batch: newProductBatch(products),
+	}, nil
+}
+
+func (*graphqlResolver) Product(ctx context.Context, args struct{ ID graphql.ID }) (*productResolver, error) {
+	productID, err := parseGraphQLID(args.ID, "id")
+	if err != nil {
+		return nil, err
+	}
+	if err := graphqlSpend(ctx, 1); err != nil {
+		return nil, err
+	}
+
+	product, err := getProduct(ctx, productID)
+	if isNoRows(err) {
+		return nil, nil
+	}
+	var pricing *productPricing
+	if err == nil {
+		pricing, err = currentPricing(ctx, db, graphqlCustomerID(ctx))
+	}
+	if err != nil {
+		return nil, graphqlInternalError("Error retrieving product:", err)
+	}
+
+	pricing.apply(product)
+	return &productResolver{product: *product, batch: newProductBatch([]Product{*product})}, nil
+}
+
+func (*graphqlResolver) Categories(ctx context.Context) ([]*categoryResolver, error) {
+	categories, err := newCategoryService().List(ctx)
+	if err != nil {
+		return nil, graphqlInternalError("Error retrieving categories:", err)
+	}
+	if err := graphqlSpend(ctx, len(categories)); err != nil {
+		return nil, err
+	}
+
+	resolvers := make([]*categoryResolver, len(categories))
+	for i := range categories {
+		resolvers[i] = &categoryResolver{category: categories[i]}
+	}
+	return resolvers, nil
+}
+
+func (*graphqlResolver) Me(ctx context.Context) (*customerResolver, error) {
+	customerID := graphqlCustomerID(ctx)
+	if customerID == 0 {
+		return nil, nil
+	}
+	return resolveCustomer(ctx, customerID)
+}
+
+func (*graphqlResolver) Orders(ctx context.Context, args struct {
+	CustomerID *graphql.ID
+	Status     *[]string
+	DateFrom   *string
+	DateTo     *string
+	Sort       *string
+	Page       *int32
+	Limit      *int32
+}) (*orderPageResolver, error) {
+	var customerID *int
+	if args.CustomerID != nil {
+		id, err := parseGraphQLID(*args.CustomerID, "customerId")
+		if err != nil {
+			return nil, err
+		}
+		customerID = &id
+	}
+	return resolveOrders(ctx, customerID, graphqlListArgs{
+		Status: args.Status, DateFrom: args.DateFrom, DateTo: args.DateTo, Sort: args.Sort, Page: args.Page, Limit: args.Limit,
+	})
+}
+
+func (*graphqlResolver) Order(ctx context.Context, args struct{ ID graphql.ID }) (*orderResolver, error) {
+	orderID, err := parseGraphQLID(args.ID, "id")
+	if err != nil {
+		return nil, err
+	}
+	scope, err := graphqlOrderScope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := graphqlSpend(ctx, 1); err != nil {
+		return nil, err
+	}
+
+	orders, err := getOrdersWithProducts(ctx, []int{orderID})
+	if err != nil {
+		return nil, graphqlInternalError("Error retrieving order:", err)
+	}
+	// Another customer's order reads as missing, like it does over REST
+	if len(orders) == 0 || (scope != nil && orders[0].CustomerID != *scope) {
+		return nil, nil
+	}
+	return &orderResolver{order: orders[0], batch: newOrderBatch(orders)}, nil
+}
+
+func (*graphqlResolver) Customer(ctx context.Context, args struct{ ID graphql.ID }) (*customerResolver, error) {
+	customerID, err := parseGraphQLID(args.ID, "id")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCustomerAccess(ctx, customerID); err != nil {
+		return nil, err
+	}
+	return resolveCustomer(ctx, customerID)
+}
+
+// checkCustomerAccess lets customers read themselves, and whoever may view every order read
+// any customer
+func checkCustomerAccess(ctx context.Context, customerID int) error {
+	if customerID == graphqlCustomerID(ctx) {
+		return nil
+	}
+	allowed, err := graphqlCan(ctx, PermViewAllOrders)
+	if err != nil {
+		return graphqlInternalError("Error checking permission:", err)
+	}
+	if !allowed {
+		if graphqlCustomerID(ctx) == 0 && ctx.Value(apiKeyContextKey) == nil {
+			return errGraphQLUnauthorized
+		}
+		return errGraphQLForbidden
+	}
+	return nil
+}
+
+func resolveCustomer(ctx context.Context, customerID int) (*customerResolver, error) {
+	if err := graphqlSpend(ctx, 1); err != nil {
+		return nil, err
+	}
+	customer, err := getCustomer(ctx, customerID)
+	if isNoRows(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, graphqlInternalError("Error retrieving customer:", err)
+	}
+	return &customerResolver{customer: *customer}, nil
+}
+
+// resolveOrders lists the orders of the customer, or of every customer with a nil customerID,
+// that the request may read
+func resolveOrders(ctx context.Context, customerID *int, args graphqlListArgs) (*orderPageResolver, error) {
+	scope, err := graphqlOrderScope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if scope != nil {
+		if customerID != nil && *customerID != *scope {
+			return nil, errGraphQLForbidden
+		}
+		customerID = scope
+	}
+
+	filter, err := parseOrderFilter(args.query())
+	if err != nil {
+		return nil, err
+	}
+	filter.CustomerID = customerID
+	if err := graphqlSpend(ctx, filter.Limit); err != nil {
+		return nil, err
+	}
+
+	orderIDs, total, err := searchOrders(ctx, filter)
+	var orders []OrderWithProducts
+	if err == nil {
+		orders, err = getOrdersWithProducts(ctx, orderIDs)
+	}
+	if err != nil {
+		return nil, graphqlInternalError("Error retrieving orders:", err)
+	}
+
+	return &orderPageResolver{
+		page:  OrderPage{Orders: orders, Page: filter.Page, Limit: filter.Limit, Total: total},
+		batch: newOrderBatch(orders),
+	}, nil
+}
+
+// productBatch loads the variants, images or stock of every product of a list in one query,
+// the first time any of its products asks for them
+type productBatch struct {
+	productIDs []int
+
+	variantsOnce sync.Once
+	variants     map[int][]ProductVariant
+	variantsErr  error
+
+	imagesOnce sync.Once
+	images     map[int][]ProductImage
+	imagesErr  error
+
+	stockOnce sync.Once
+	stock     map[int]int
+	stockErr  error
+}
+
+func newProductBatch(products []Product) *productBatch {
+	batch := &productBatch{productIDs: make([]int, len(products))}
+	for i, product := range products {
+		batch.productIDs[i] = product.ID
+	}
+	return batch
+}
+
+func (b *productBatch) loadVariants(ctx context.Context) (map[int][]ProductVariant, error) {
+	b.variantsOnce.Do(func() {
+		b.variants, b.variantsErr = getVariantsOfProducts(ctx, b.productIDs)
+	})
+	return b.variants, b.variantsErr
+}
+
+func (b *productBatch) loadImages(ctx context.Context) (map[int][]ProductImage, error) {
+	b.imagesOnce.Do(func() {
+		b.images, b.imagesErr = getImagesOfProducts(ctx, b.productIDs)
+	})
+	return b.images, b.imagesErr
+}
+
+func (b *productBatch) loadStock(ctx context.Context) (map[int]int, error) {
+	b.stockOnce.Do(func() {
+		b.stock, b.stockErr = getProductStock(ctx, b.productIDs)
+	})
+	return b.stock, b.stockErr
+}
+
+// orderBatch loads the customers of every order of a list in one query, the first time any of
+// its orders asks for its customer
+type orderBatch struct {
+	customerIDs []int
+
+	customersOnce sync.Once
+	customers     map[int]Customer
+	customersErr  error
+}
+
+func newOrderBatch(orders []OrderWithProducts) *orderBatch {
+	batch := &orderBatch{customerIDs: make([]int, len(orders))}
+	for i, order := range orders {
+		batch.customerIDs[i] = order.CustomerID
+	}
+	return batch
+}
+
+func (b *orderBatch) loadCustomers(ctx context.Context) (map[int]Customer, error) {
+	b.customersOnce.Do(func() {
+		b.customers, b.customersErr = getCustomers(ctx, b.customerIDs)
+	})
+	return b.customers, b.customersErr
+}
+
+type productPageResolver struct {
+	page  ProductPage
+	batch *productBatch
+}
+
+func (r *productPageResolver) Products() []*productResolver {
+	resolvers := make([]*productResolver, len(r.page.Products))
+	for i := range r.page.Products {
+		resolvers[i] = &productResolver{product: r.page.Products[i], batch: r.batch}
+	}
+	return resolvers
+}
+
+func (r *productPageResolver) Page() int32  { return int32(r.page.Page) }
+func (r *productPageResolver) Limit() int32 { return int32(r.page.Limit) }
+func (r *productPageResolver) Total() int32 { return int32(r.page.Total) }
+
+type productResolver struct {
+	product Product
+	batch   *productBatch
+}
+
+func (r *productResolver) ID() graphql.ID          { return graphqlID(r.product.ID) }
+func (r *productResolver) SKU() *string            { return optionalString(r.product.SKU) }
+func (r *productResolver) Name() string            { return r.product.Name }
+func (r *productResolver) Price() float64          { return r.product.Price }
+func (r *productResolver) RegularPrice() *float64  { return r.product.RegularPrice }
+func (r *productResolver) Description() string     { return r.product.Description }
+func (r *productResolver) ImageURL() string        { return r.product.ImageURL }
+func (r *productResolver) GiftCard() bool          { return r.product.GiftCard }
+func (r *productResolver) CategoryID() *graphql.ID { return optionalID(r.product.CategoryID) }
+
+func (r *productResolver) Variants(ctx context.Context) ([]*variantResolver, error) {
+	variantsByProduct, err := r.batch.loadVariants(ctx)
+	if err != nil {
+		return nil, graphqlInternalError("Error retrieving product variants:", err)
+	}
+	variants := variantsByProduct[r.product.ID]
+	if err := graphqlSpend(ctx, len(variants)); err != nil {
+		return nil, err
+	}
+
+	resolvers := make([]*variantResolver, len(variants))
+	for i := range variants {
+		resolvers[i] = &variantResolver{variant: variants[i]}
+	}
+	return resolvers, nil
+}
+
+func (r *productResolver) Images(ctx context.Context) ([]*productImageResolver, error) {
+	imagesByProduct, err := r.batch.loadImages(ctx)
+	if err != nil {
+		return nil, graphqlInternalError("Error retrieving product images:", err)
+	}
+	images := imagesByProduct[r.product.ID]
+	if err := graphqlSpend(ctx, len(images)); err != nil {
+		return nil, err
+	}
+
+	resolvers := make([]*productImageResolver, len(images))
+	for i := range images {
+		resolvers[i] = &productImageResolver{image: images[i]}
+	}
+	return resolvers, nil
+}
+
+func (r *productResolver) Stock(ctx context.Context) (*int32, error) {
+	allowed, err := graphqlCan(ctx, PermManageProducts)
+	if err != nil {
+		return nil, graphqlInternalError("Error checking permission:", err)
+	}
+	if !allowed {
+		return nil, errGraphQLForbidden
+	}
+	// Product lists don't load stock, so the field reads it for the whole list
+	if r.product.Stock != nil {
+		stock := int32(*r.product.Stock)
+		return &stock, nil
+	}
+	stockByProduct, err := r.batch.loadStock(ctx)
+	if err != nil {
+		return nil, graphqlInternalError("Error retrieving product stock:", err)
+	}
+	quantity, ok := stockByProduct[r.product.ID]
+	if !ok {
+		return nil, nil
+	}
+	stock := int32(quantity)
+	return &stock, nil
+}
+
+type variantResolver struct {
+	variant ProductVariant
+}
+
+func (r *variantResolver) ID() graphql.ID { return graphqlID(r.variant.ID) }
+func (r *variantResolver) SKU() string    { return r.variant.SKU }
+func (r *variantResolver) Price() float64 { return r.variant.Price }
+
+// Options are sorted by name, as maps have no order
+func (r *variantResolver) Options() []*variantOptionResolver {
+	names := make([]string, 0, len(r.variant.Options))
+	for name := range r.variant.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	resolvers := make([]*variantOptionResolver, len(names))
+	for i, name := range names {
+		resolvers[i] = &variantOptionResolver{name: name, value: r.variant.Options[name]}
+	}
+	return resolvers
+}
+
+type variantOptionResolver struct {
+	name, value string
+}
+
+func (r *variantOptionResolver) Name() string  { return r.name }
+func (r *variantOptionResolver) Value() string { return r.value }
+
+type productImageResolver struct {
+	image ProductImage
+}
+
+func (r *productImageResolver) ID() graphql.ID { return graphqlID(r.image.ID) }
+func (r *productImageResolver) URL() string    { return r.image.URL }
+func (r *productImageResolver) Position() int32 {
+	return int32(r.image.Position)
+}
+
+type categoryResolver struct {
+	category models.Category
+}
+
+func (r *categoryResolver) ID() graphql.ID        { return graphqlID(r.category.ID) }
+func (r *categoryResolver) Name() string          { return r.category.Name }
+func (r *categoryResolver) ParentID() *graphql.ID { return optionalID(r.category.ParentID) }
+
+type customerResolver struct {
+	customer Customer
+}
+
+func (r *customerResolver) ID() graphql.ID { return graphqlID(r.customer.ID) }
+func (r *customerResolver) Name() string   { return r.customer.Name }
+func (r *customerResolver) Email() string  { return r.customer.Email }
+func (r *customerResolver) Role() string   { return r.customer.Role }
+
+func (r *customerResolver) Orders(ctx context.Context, args graphqlListArgs) (*orderPageResolver, error) {
+	return resolveOrders(ctx, &r.customer.ID, args)
+}
+
+type orderPageResolver struct {
+	page  OrderPage
+	batch *orderBatch
+}
+
+func (r *orderPageResolver) Orders() []*orderResolver {
+	resolvers := make([]*orderResolver, len(r.page.Orders))
+	for i := range r.page.Orders {
+		resolvers[i] = &orderResolver{order: r.page.Orders[i], batch: r.batch}
+	}
+	return resolvers
+}
+
+func (r *orderPageResolver) Page() int32  { return int32(r.page.Page) }
+func (r *orderPageResolver) Limit() int32 { return int32(r.page.Limit) }
+func (r *orderPageResolver) Total() int32 { return int32(r.page.Total) }
+
+type orderResolver struct {
+	order OrderWithProducts
+	batch *orderBatch
+}
+
+func (r *orderResolver) ID() graphql.ID          { return graphqlID(r.order.ID) }
+func (r *orderResolver) Date() graphql.Time      { return graphql.Time{Time: r.order.Date} }
+func (r *orderResolver) Status() string          { return r.order.Status }
+func (r *orderResolver) Subtotal() float64       { return r.order.Subtotal }
+func (r *orderResolver) Discount() float64       { return r.order.Discount }
+func (r *orderResolver) CouponCode() *string     { return optionalString(r.order.CouponCode) }
+func (r *orderResolver) Tax() float64            { return r.order.Tax }
+func (r *orderResolver) Shipping() float64       { return r.order.Shipping }
+func (r *orderResolver) Total() float64          { return r.order.Total }
+func (r *orderResolver) ShippingMethod() *string { return optionalString(r.order.ShippingMethod) }
+
+func (r *orderResolver) Customer(ctx context.Context) (*customerResolver, error) {
+	if err := checkCustomerAccess(ctx, r.order.CustomerID); err != nil {
+		return nil, err
+	}
+	if err := graphqlSpend(ctx, 1); err != nil {
+		return nil, err
+	}
+	customers, err := r.batch.loadCustomers(ctx)
+	if err != nil {
+		return nil, graphqlInternalError("Error retrieving customers:", err)
+	}
+	customer, ok := customers[r.order.CustomerID]
+	if !ok {
+		return nil, nil
+	}
+	return &customerResolver{customer: customer}, nil
+}
+
+func (r *orderResolver) Lines(ctx context.Context) ([]*orderLineResolver, error) {
+	if err := graphqlSpend(ctx, len(r.order.Products)); err != nil {
+		return nil, err
+	}
+
+	resolvers := make([]*orderLineResolver, len(r.order.Products))
+	for i := range r.order.Products {
+		resolvers[i] = &orderLineResolver{line: r.order.Products[i]}
+	}
+	return resolvers, nil
+}
+
+type orderLineResolver struct {
+	line Product
+}
+
+func (r *orderLineResolver) ProductID() graphql.ID { return graphqlID(r.line.ID) }
+func (r *orderLineResolver) Name() string          { return r.line.Name }
+func (r *orderLineResolver) SKU() *string          { return optionalString(r.line.SKU) }
+func (r *orderLineResolver) Quantity() int32       { return int32(r.line.Quantity) }
+func (r *orderLineResolver) Price() float64        { return r.line.Price }
+
+func (r *orderLineResolver) Variant() *variantResolver {
+	if r.line.Variant == nil {
+		return nil
+	}
+	return &variantResolver{variant: *r.line.Variant}
+}
+
+// optionalString is nil for an empty string, which the REST responses omit
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func optionalID(id *int) *graphql.ID {
+	if id == nil {
+		return nil
+	}
+	gid := graphqlID(*id)
+	return &gid
+}
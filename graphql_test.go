@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// failingReader fails like a client that drops the connection mid-body
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestGraphQLHandlerRejectsUnreadableBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/graphql", failingReader{})
+	rec := httptest.NewRecorder()
+	GraphQLHandler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGraphQLSpendLimitsNodes(t *testing.T) {
+	ctx := context.WithValue(context.Background(), graphqlExecutionContextKey, &graphqlExecution{permissions: make(map[string]bool)})
+
+	// A page of 100 orders, each listing 100 of its customer's orders, is over the limit
+	if err := graphqlSpend(ctx, 100); err != nil {
+		t.Fatalf("first page: %v", err)
+	}
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		err = graphqlSpend(ctx, 100)
+	}
+	if err != errGraphQLTooComplex {
+		t.Errorf("error = %v, want %v", err, errGraphQLTooComplex)
+	}
+}
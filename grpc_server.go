@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/hanifmasy/simple-commerce/commercepb"
+)
+
+// gRPC settings, loaded from environment variables by loadGRPCConfig
+var grpcConfig = struct {
+	// Addr is where the gRPC service listens, such as :9090; empty leaves it off
+	Addr string
+}{}
+
+// grpcMethodPermissions are the API key scopes the RPCs need. An empty scope makes the RPC
+// public, like the catalog is over HTTP; an RPC missing from the map is denied, so a new one
+// isn't served before its scope is decided.
+var grpcMethodPermissions = map[string]string{
+	commercepb.CommerceService_GetOrder_FullMethodName:     PermViewAllOrders,
+	commercepb.CommerceService_ListOrders_FullMethodName:   PermViewAllOrders,
+	commercepb.CommerceService_GetProduct_FullMethodName:   "",
+	commercepb.CommerceService_ListProducts_FullMethodName: "",
+}
+
+func loadGRPCConfig() {
+	grpcConfig.Addr = os.Getenv("GRPC_ADDR")
+}
+
+// serveGRPC serves the CommerceService until ctx is done, then lets the RPCs in flight finish
+func serveGRPC(ctx context.Context) {
+	listener, err := net.Listen("tcp", grpcConfig.Addr)
+	if err != nil {
+		log.Fatalf("Error listening for gRPC on %s: %v", grpcConfig.Addr, err)
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(grpcAuthInterceptor))
+	commercepb.RegisterCommerceServiceServer(server, &commerceServer{})
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	log.Println("Serving gRPC on", grpcConfig.Addr)
+	if err := server.Serve(listener); err != nil {
+		log.Println("Error serving gRPC:", err)
+		return
+	}
+	<-stopped
+}
+
+// grpcAuthInterceptor checks the x-api-key metadata of RPCs that need a scope, like
+// AuthMiddleware checks X-API-Key, and denies RPCs grpcMethodPermissions doesn't list
+func grpcAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	permission, ok := grpcMethodPermissions[info.FullMethod]
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, info.FullMethod+" is not served")
+	}
+	if permission == "" {
+		return handler(ctx, req)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get("x-api-key")
+	if len(keys) == 0 || keys[0] == "" {
+		return nil, status.Error(codes.Unauthenticated, "x-api-key metadata is required")
+	}
+	allowed, err := apiKeyHasScope(ctx, keys[0], permission)
+	if err != nil {
+		log.Println("Error checking API key:", err)
+		return nil, status.Error(codes.Internal, "Internal Server Error")
+	}
+	if !allowed {
+		return nil, status.Error(codes.PermissionDenied, "API key lacks the "+permission+" scope")
+	}
+
+	return handler(ctx, req)
+}
+
+// commerceServer implements the CommerceService with the queries the HTTP handlers use
+type commerceServer struct {
+	commercepb.UnimplementedCommerceServiceServer
+}
+
+func (s *commerceServer) GetOrder(ctx context.Context, req *commercepb.GetOrderRequest) (*commercepb.Order, error) {
+	orders, err := getOrdersWithProducts(ctx, []int{int(req.GetOrderId())})
+	if err != nil {
+		log.Println("Error retrieving order:", err)
+		return nil, status.Error(codes.Internal, "Internal Server Error")
+	}
+	if len(orders) == 0 {
+		return nil, status.Error(codes.NotFound, "Order not found")
+	}
+
+	return orderToProto(orders[0]), nil
+}
+
+func (s *commerceServer) ListOrders(ctx context.Context, req *commercepb.ListOrdersRequest) (*commercepb.ListOrdersResponse, error) {
+	// The request is checked like the query parameters of GET /admin/orders
+	query := grpcListQuery(req.GetSort(), req.GetPage(), req.GetLimit())
+	if len(req.GetStatuses()) > 0 {
+		query.Set("status", strings.Join(req.GetStatuses(), ","))
+	}
+	if req.GetDateFrom() != "" {
+		query.Set("date_from", req.GetDateFrom())
+	}
+	if req.GetDateTo() != "" {
+		query.Set("date_to", req.GetDateTo())
+	}
+	if req.CustomerId != nil {
+		query.Set("customer_id", strconv.FormatInt(req.GetCustomerId(), 10))
+	}
+	if req.ProductId != nil {
+		query.Set("product_id", strconv.FormatInt(req.GetProductId(), 10))
+	}
+	if req.GetCustomerEmail() != "" {
+		query.Set("customer_email", req.GetCustomerEmail())
+	}
+	filter, err := parseOrderFilter(query)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	orderIDs, total, err := searchOrders(ctx, filter)
+	var orders []OrderWithProducts
+	if err == nil {
+		orders, err = getOrdersWithProducts(ctx, orderIDs)
+	}
+	if err != nil {
+		log.Println("Error retrieving orders:", err)
+		return nil, status.Error(codes.Internal, "Internal Server Error")
+	}
+
+	response := &commercepb.ListOrdersResponse{Page: int32(filter.Page), Limit: int32(filter.Limit), Total: int32(total)}
+	for _, order := range orders {
+		response.Orders = append(response.Orders, orderToProto(order))
+	}
+	return response, nil
+}
+
+func (s *commerceServer) GetProduct(ctx context.Context, req *commercepb.GetProductRequest) (*commercepb.Product, error) {
+	product, err := getProduct(ctx, int(req.GetProductId()))
+	if isNoRows(err) {
+		return nil, status.Error(codes.NotFound, "Product not found")
+	}
+	if err == nil {
+		product.Variants, err = getProductVariants(ctx, product.ID)
+	}
+	if err == nil {
+		product.Images, err = getProductImages(ctx, product.ID)
+	}
+	if err != nil {
+		log.Println("Error retrieving product:", err)
+		return nil, status.Error(codes.Internal, "Internal Server Error")
+	}
+
+	return productToProto(*product), nil
+}
+
+func (s *commerceServer) ListProducts(ctx context.Context, req *commercepb.ListProductsRequest) (*commercepb.ListProductsResponse, error) {
+	query := grpcListQuery(req.GetSort(), req.GetPage(), req.GetLimit())
+	if req.CategoryId != nil {
+		query.Set("category", strconv.FormatInt(req.GetCategoryId(), 10))
+	}
+	if req.MinPrice != nil {
+		query.Set("min_price", strconv.FormatFloat(req.GetMinPrice(), 'f', -1, 64))
+	}
+	if req.MaxPrice != nil {
+		query.Set("max_price", strconv.FormatFloat(req.GetMaxPrice(), 'f', -1, 64))
+	}
+	filter, err := parseProductFilter(query)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var products []Product
+	var total int
+	if req.GetSearch() != "" {
+		tsQuery := buildPrefixTSQuery(req.GetSearch())
+		if tsQuery == "" {
+			return nil, status.Error(codes.InvalidArgument, "search must contain at least one word")
+		}
+		products, total, err = searchProducts(ctx, tsQuery, filter)
+	} else {
+		products, total, err = listProducts(ctx, filter)
+	}
+	if err != nil {
+		log.Println("Error retrieving products:", err)
+		return nil, status.Error(codes.Internal, "Internal Server Error")
+	}
+
+	response := &commercepb.ListProductsResponse{Page: int32(filter.Page), Limit: int32(filter.Limit), Total: int32(total)}
+	for _, product := range products {
+		response.Products = append(response.Products, productToProto(product))
+	}
+	return response, nil
+}
+
+// grpcListQuery passes a list request's paging on as the query parameters of the HTTP list;
+// zero values keep the defaults
+func grpcListQuery(sort string, page, limit int32) url.Values {
+	query := url.Values{}
+	if sort != "" {
+		query.Set("sort", sort)
+	}
+	if page != 0 {
+		query.Set("page", strconv.Itoa(int(page)))
+	}
+	if limit != 0 {
+		query.Set("limit", strconv.Itoa(int(limit)))
+	}
+	return query
+}
+
+func orderToProto(order OrderWithProducts) *commercepb.Order {
+	result := &commercepb.Order{
+		OrderId:        int64(order.ID),
+		CustomerId:     int64(order.CustomerID),
+		Date:           timestamppb.New(order.Date),
+		Status:         order.Status,
+		Subtotal:       order.Subtotal,
+		Discount:       order.Discount,
+		CouponCode:     order.CouponCode,
+		Tax:            order.Tax,
+		Shipping:       order.Shipping,
+		Total:          order.Total,
+		ShippingMethod: order.ShippingMethod,
+	}
+	for _, line := range order.Products {
+		protoLine := &commercepb.OrderLine{
+			ProductId:   int64(line.ID),
+			Sku:         line.SKU,
+			ProductName: line.Name,
+			Quantity:    int32(line.Quantity),
+			Price:       line.Price,
+		}
+		if line.Variant != nil {
+			protoLine.Variant = variantToProto(*line.Variant)
+		}
+		result.Lines = append(result.Lines, protoLine)
+	}
+	return result
+}
+
+func productToProto(product Product) *commercepb.Product {
+	result := &commercepb.Product{
+		ProductId:   int64(product.ID),
+		Sku:         product.SKU,
+		ProductName: product.Name,
+		Price:       product.Price,
+		Description: product.Description,
+		ImageUrl:    product.ImageURL,
+		GiftCard:    product.GiftCard,
+	}
+	if product.CategoryID != nil {
+		categoryID := int64(*product.CategoryID)
+		result.CategoryId = &categoryID
+	}
+	for _, variant := range product.Variants {
+		result.Variants = append(result.Variants, variantToProto(variant))
+	}
+	for _, image := range product.Images {
+		result.Images = append(result.Images, &commercepb.ProductImage{
+			ImageId:  int64(image.ID),
+			Url:      image.URL,
+			Position: int32(image.Position),
+		})
+	}
+	return result
+}
+
+func variantToProto(variant ProductVariant) *commercepb.ProductVariant {
+	return &commercepb.ProductVariant{
+		VariantId: int64(variant.ID),
+		Sku:       variant.SKU,
+		Options:   variant.Options,
+		Price:     variant.Price,
+	}
+}
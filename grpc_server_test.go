@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hanifmasy/simple-commerce/commercepb"
+)
+
+func TestGRPCAuthInterceptorDeniesUnlistedMethods(t *testing.T) {
+	called := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/commerce.CommerceService/DeleteOrder"}
+	_, err := grpcAuthInterceptor(context.Background(), nil, info, handler)
+	if status.Code(err) != codes.PermissionDenied || called {
+		t.Errorf("unlisted method: code = %v, handler called = %v; want PermissionDenied without calling it", status.Code(err), called)
+	}
+
+	info = &grpc.UnaryServerInfo{FullMethod: commercepb.CommerceService_ListProducts_FullMethodName}
+	if _, err := grpcAuthInterceptor(context.Background(), nil, info, handler); err != nil || !called {
+		t.Errorf("public method: error = %v, handler called = %v; want it served without an API key", err, called)
+	}
+
+	info = &grpc.UnaryServerInfo{FullMethod: commercepb.CommerceService_GetOrder_FullMethodName}
+	if _, err := grpcAuthInterceptor(context.Background(), nil, info, handler); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("scoped method without a key: code = %v, want Unauthenticated", status.Code(err))
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	guestCartCookie = "cart_token"
+	// guestCartTTL is how long an untouched guest cart is kept
+	guestCartTTL = 30 * 24 * time.Hour
+)
+
+// cartOwner identifies a cart by its customer, or by the hashed cookie token of a guest
+type cartOwner struct {
+	CustomerID int
+	// CartID picks one of the customer's named carts instead of their active cart
+	CartID         int
+	GuestTokenHash string
+}
+
+// resolveCartOwner returns the owner of the request's cart. An authenticated customer owns
+// their own cart, and any guest cart from before they logged in is merged into it. A guest
+// owns the cart of their cookie; with create set, a guest without one is given a new cookie.
+func resolveCartOwner(w http.ResponseWriter, r *http.Request, create bool) (cartOwner, error) {
+	if customerID := getCustomerID(r); customerID != 0 {
+		return cartOwner{CustomerID: customerID}, mergeGuestCart(w, r, customerID)
+	}
+
+	if tokenHash := guestCartTokenHash(r); tokenHash != "" {
+		return cartOwner{GuestTokenHash: tokenHash}, nil
+	}
+	if !create {
+		return cartOwner{}, nil
+	}
+
+	token, err := generateToken(32)
+	if err != nil {
+		return cartOwner{}, err
+	}
+	setGuestCartCookie(w, r, token)
+	return cartOwner{GuestTokenHash: hashToken(token)}, nil
+}
+
+// guestCartTokenHash returns the stored hash of the request's guest cart token,
+// or "" if there is no cookie or its signature doesn't match
+func guestCartTokenHash(r *http.Request) string {
+	cookie, err := r.Cookie(guestCartCookie)
+	if err != nil {
+		return ""
+	}
+	token, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signGuestCartToken(token))) {
+		return ""
+	}
+	return hashToken(token)
+}
+
+// signGuestCartToken signs the token with the JWT secret so clients can't forge cart cookies
+func signGuestCartToken(token string) string {
+	mac := hmac.New(sha256.New, jwtConfig.Secret)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func setGuestCartCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     guestCartCookie,
+		Value:    token + "." + signGuestCartToken(token),
+		Path:     "/",
+		MaxAge:   int(guestCartTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// mergeGuestCart moves the request's guest cart into the customer's cart and clears the cookie
+func mergeGuestCart(w http.ResponseWriter, r *http.Request, customerID int) error {
+	tokenHash := guestCartTokenHash(r)
+	if tokenHash == "" {
+		return nil
+	}
+
+	if err := mergeCarts(r.Context(), tokenHash, customerID); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{Name: guestCartCookie, Path: "/", MaxAge: -1})
+	return nil
+}
+
+// mergeCarts moves the guest cart's items into the customer's active cart and deletes the guest cart.
+// A product that is in both carts keeps the larger quantity rather than the sum, since it is
+// usually the same item added once before and once after logging in.
+func mergeCarts(ctx context.Context, guestTokenHash string, customerID int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var guestCartID int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM carts WHERE guest_token_hash = $1 FOR UPDATE", guestTokenHash).Scan(&guestCartID)
+	if isNoRows(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var cartID int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO carts (customer_id)
+		VALUES ($1)
+		ON CONFLICT (customer_id) WHERE active DO UPDATE SET updated_at = NOW()
+		RETURNING id
+	`, customerID).Scan(&cartID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO cart_items (cart_id, product_id, variant_id, quantity, unit_price)
+		SELECT $1, product_id, variant_id, quantity, unit_price
+		FROM cart_items
+		WHERE cart_id = $2
+		ON CONFLICT (cart_id, product_id, COALESCE(variant_id, 0))
+		DO UPDATE SET quantity = GREATEST(cart_items.quantity, EXCLUDED.quantity)
+	`, cartID, guestCartID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM carts WHERE id = $1", guestCartID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/models"
+	"github.com/hanifmasy/simple-commerce/service"
+)
+
+type CategoryHandlers struct {
+	Categories *service.CategoryService
+}
+
+// CATEGORIES
+func (h *CategoryHandlers) List(w http.ResponseWriter, r *http.Request) {
+	categories, err := h.Categories.List(r.Context())
+	if err != nil {
+		log.Println("Error retrieving categories:", err)
+		WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, categories)
+}
+
+// ADMIN CATEGORIES
+func (h *CategoryHandlers) Create(w http.ResponseWriter, r *http.Request) {
+	categoryRequest, ok := readCategoryRequest(w, r)
+	if !ok {
+		return
+	}
+
+	category, err := h.Categories.Save(r.Context(), 0, categoryRequest)
+	if err == service.ErrUnknownParentCategory {
+		WriteFieldError(w, "parent_id", err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error creating category:", err)
+		WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	WriteJSON(w, http.StatusCreated, category)
+}
+
+func (h *CategoryHandlers) Update(w http.ResponseWriter, r *http.Request) {
+	categoryID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+
+	categoryRequest, ok := readCategoryRequest(w, r)
+	if !ok {
+		return
+	}
+
+	category, err := h.Categories.Save(r.Context(), categoryID, categoryRequest)
+	if err == service.ErrCategoryNotFound {
+		WriteError(w, http.StatusNotFound, "Category not found")
+		return
+	}
+	if err == service.ErrCategoryCycle || err == service.ErrUnknownParentCategory {
+		WriteFieldError(w, "parent_id", err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error updating category:", err)
+		WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, category)
+}
+
+func (h *CategoryHandlers) Delete(w http.ResponseWriter, r *http.Request) {
+	categoryID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+
+	err = h.Categories.Delete(r.Context(), categoryID)
+	if err == service.ErrCategoryNotFound {
+		WriteError(w, http.StatusNotFound, "Category not found")
+		return
+	}
+	if err == service.ErrCategoryInUse {
+		WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error deleting category:", err)
+		WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func readCategoryRequest(w http.ResponseWriter, r *http.Request) (models.CategoryRequest, bool) {
+	var categoryRequest models.CategoryRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		WriteError(w, http.StatusBadRequest, "Bad Request")
+		return categoryRequest, false
+	}
+
+	err = json.Unmarshal(body, &categoryRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		WriteInvalidJSON(w)
+		return categoryRequest, false
+	}
+
+	categoryRequest.Name = strings.TrimSpace(categoryRequest.Name)
+	if categoryRequest.Name == "" || len(categoryRequest.Name) > 255 {
+		WriteFieldError(w, "name", "name is required and must be at most 255 characters")
+		return categoryRequest, false
+	}
+
+	return categoryRequest, true
+}
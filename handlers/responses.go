@@ -0,0 +1,116 @@
+// Package handlers serves the HTTP API, decoding requests for the service layer and encoding its
+// results and errors
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Error codes that are more specific than the response's status
+const (
+	ErrorCodeValidation  = "validation_error"
+	ErrorCodeInvalidJSON = "invalid_json"
+)
+
+// APIError is the body of every error response
+type APIError struct {
+	// Code identifies the error for clients: the snake_case status text, such as not_found, or a
+	// more specific code such as validation_error
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details lists the fields a validation error is about
+	Details []FieldError `json:"details,omitempty"`
+}
+
+// FieldError is a validation error of one request field. Validators return it as their error,
+// so the response can name the field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+
+	// cause is the error NestFieldError put under the field
+	cause error
+}
+
+func (e *FieldError) Error() string {
+	return e.Message
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.cause
+}
+
+// NewFieldError returns a validation error of the field
+func NewFieldError(field, message string) *FieldError {
+	return &FieldError{Field: field, Message: message}
+}
+
+// FieldErrorf returns a validation error of the field with a formatted message
+func FieldErrorf(field, format string, args ...interface{}) *FieldError {
+	return &FieldError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// NestFieldError puts a validation error under the field it was found in, such as products[2]:
+// a FieldError of quantity becomes one of products[2].quantity. Any other error, such as a
+// failed query, is returned as it is so it isn't answered as the client's mistake.
+func NestFieldError(field string, err error) error {
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) {
+		return err
+	}
+	return &FieldError{Field: field + "." + fieldErr.Field, Message: field + ": " + err.Error(), cause: err}
+}
+
+// WriteJSON encodes v as the JSON response body with the given status code
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Error encoding response to JSON:", err)
+		WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+// WriteError answers with the status and an APIError carrying the message, coded by the status
+func WriteError(w http.ResponseWriter, status int, message string) {
+	code := strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	WriteAPIError(w, status, APIError{Code: code, Message: message})
+}
+
+// WriteInvalidJSON answers 400 with an invalid_json error, for a request body that doesn't decode
+func WriteInvalidJSON(w http.ResponseWriter) {
+	WriteAPIError(w, http.StatusBadRequest, APIError{Code: ErrorCodeInvalidJSON, Message: "Invalid JSON format"})
+}
+
+// WriteValidationError answers 400 with a validation_error, detailing the field of the
+// FieldError in err's chain when there is one
+func WriteValidationError(w http.ResponseWriter, err error) {
+	apiErr := APIError{Code: ErrorCodeValidation, Message: err.Error()}
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		apiErr.Details = []FieldError{{Field: fieldErr.Field, Message: fieldErr.Message}}
+	}
+	WriteAPIError(w, http.StatusBadRequest, apiErr)
+}
+
+// WriteFieldError answers 400 with a validation_error of the field
+func WriteFieldError(w http.ResponseWriter, field, message string) {
+	WriteValidationError(w, NewFieldError(field, message))
+}
+
+func WriteAPIError(w http.ResponseWriter, status int, apiErr APIError) {
+	// An APIError always encodes
+	response, _ := json.Marshal(apiErr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
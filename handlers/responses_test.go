@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestWriteValidationError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want APIError
+	}{
+		{
+			"field error",
+			NewFieldError("quantity", "quantity must not be negative"),
+			APIError{Code: ErrorCodeValidation, Message: "quantity must not be negative",
+				Details: []FieldError{{Field: "quantity", Message: "quantity must not be negative"}}},
+		},
+		{
+			"nested field error",
+			NestFieldError("products[2]", NewFieldError("quantity", "quantity must be at least 1")),
+			APIError{Code: ErrorCodeValidation, Message: "products[2]: quantity must be at least 1",
+				Details: []FieldError{{Field: "products[2].quantity", Message: "products[2]: quantity must be at least 1"}}},
+		},
+		{
+			// A message that reads like it names a field isn't parsed for one
+			"plain error",
+			errors.New("email and password are required"),
+			APIError{Code: ErrorCodeValidation, Message: "email and password are required"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			WriteValidationError(rec, tt.err)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+			var got APIError
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("body = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNestFieldErrorKeepsOtherErrors(t *testing.T) {
+	// A failed query under a line is still a failed query, not the line's validation error
+	err := errors.New("pq: connection refused")
+	if got := NestFieldError("products[0]", err); got != err {
+		t.Errorf("NestFieldError = %v, want the error unchanged", got)
+	}
+}
+
+func TestWriteErrorCodes(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteInvalidJSON(rec)
+	var got APIError
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Code != ErrorCodeInvalidJSON {
+		t.Errorf("WriteInvalidJSON code = %q, want %q", got.Code, ErrorCodeInvalidJSON)
+	}
+
+	// The code comes from the status, whatever the message says
+	rec = httptest.NewRecorder()
+	WriteError(rec, http.StatusBadRequest, "Invalid JSON format")
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Code != "bad_request" {
+		t.Errorf("WriteError code = %q, want bad_request", got.Code)
+	}
+}
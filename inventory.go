@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Inventory settings, loaded from environment variables by loadInventoryConfig
+var inventoryConfig = struct {
+	// LowStockThreshold flags products with fewer units than this
+	LowStockThreshold int
+	// LowStockWebhookURL, when set, also receives the alert as a JSON POST
+	LowStockWebhookURL string
+	// ReservationTTL is how long a checkout holds stock before it is released
+	ReservationTTL time.Duration
+	// AvailabilityCacheTTL is how long /products/{id}/availability answers from memory
+	AvailabilityCacheTTL time.Duration
+}{
+	LowStockThreshold:    5,
+	ReservationTTL:       15 * time.Minute,
+	AvailabilityCacheTTL: 10 * time.Second,
+}
+
+type LowStockProduct struct {
+	ID    int    `json:"product_id"`
+	SKU   string `json:"sku,omitempty"`
+	Name  string `json:"product_name"`
+	Stock int    `json:"stock"`
+}
+
+func loadInventoryConfig() {
+	if v := os.Getenv("LOW_STOCK_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid LOW_STOCK_THRESHOLD %q", v)
+		}
+		inventoryConfig.LowStockThreshold = n
+	}
+	inventoryConfig.LowStockWebhookURL = os.Getenv("LOW_STOCK_WEBHOOK_URL")
+	if v := os.Getenv("RESERVATION_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid RESERVATION_TTL %q", v)
+		}
+		inventoryConfig.ReservationTTL = d
+	}
+	if v := os.Getenv("AVAILABILITY_CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid AVAILABILITY_CACHE_TTL %q", v)
+		}
+		inventoryConfig.AvailabilityCacheTTL = d
+	}
+}
+
+// SendLowStockAlerts emails one summary of every low-stock product to the customers
+// allowed to manage products, and posts it to the webhook if one is configured
+func SendLowStockAlerts(ctx context.Context) {
+	products, err := getLowStockProducts(ctx, inventoryConfig.LowStockThreshold)
+	if err != nil {
+		log.Println("Error querying low-stock products:", err)
+		return
+	}
+	if len(products) == 0 {
+		return
+	}
+
+	if inventoryConfig.LowStockWebhookURL != "" {
+		if err := postLowStockWebhook(products); err != nil {
+			log.Println("Error sending low-stock webhook:", err)
+		}
+	}
+
+	recipients, err := getPermissionEmails(ctx, PermManageProducts)
+	if err != nil {
+		log.Println("Error querying low-stock alert recipients:", err)
+		return
+	}
+
+	alert := lowStockEmail{Threshold: inventoryConfig.LowStockThreshold, Products: products}
+	key := "low_stock_alert:" + time.Now().Format("2006-01-02")
+	for _, to := range recipients {
+		if err := sendEmail(ctx, to, emailLowStockAlert, key, alert); err != nil {
+			log.Printf("Error sending low-stock alert to %s: %v", to, err)
+		}
+	}
+}
+
+func getLowStockProducts(ctx context.Context, threshold int) ([]LowStockProduct, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, COALESCE(sku, ''), name, stock
+		FROM products
+		WHERE stock < $1
+		ORDER BY stock, id
+	`, threshold)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := make([]LowStockProduct, 0)
+	for rows.Next() {
+		var product LowStockProduct
+		if err := rows.Scan(&product.ID, &product.SKU, &product.Name, &product.Stock); err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+
+	return products, rows.Err()
+}
+
+func postLowStockWebhook(products []LowStockProduct) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"threshold": inventoryConfig.LowStockThreshold,
+		"products":  products,
+	})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(inventoryConfig.LowStockWebhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const maxInventorySyncSize = 10 << 20
+
+// InventorySyncItem is the on-hand quantity of one SKU reported by the warehouse system
+type InventorySyncItem struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+}
+
+// InventorySyncResult is one line of the diff report
+type InventorySyncResult struct {
+	SKU       string `json:"sku"`
+	ProductID int    `json:"product_id,omitempty"`
+	// Previous and Stock are the sellable stock before and after the sync
+	Previous int    `json:"previous"`
+	Stock    int    `json:"stock"`
+	Change   int    `json:"change"`
+	Reserved int    `json:"reserved"`
+	Error    string `json:"error,omitempty"`
+}
+
+type InventorySyncReport struct {
+	Applied bool                  `json:"applied"`
+	Changed int                   `json:"changed"`
+	Results []InventorySyncResult `json:"results"`
+}
+
+// ADMIN INVENTORY SYNC
+// AdminInventorySyncHandler sets stock from a warehouse system's on-hand quantities.
+// The body is CSV (Content-Type text/csv, columns sku,quantity) or a JSON array of
+// {"sku", "quantity"}. Either every SKU is applied or, if any line is invalid, none is.
+func AdminInventorySyncHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxInventorySyncSize))
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	var items []InventorySyncItem
+	if strings.Contains(r.Header.Get("Content-Type"), "csv") {
+		items, err = parseInventoryCSV(body)
+	} else {
+		err = json.Unmarshal(body, &items)
+	}
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if len(items) == 0 {
+		handlers.WriteValidationError(w, errors.New("at least one sku is required"))
+		return
+	}
+
+	report, err := syncInventory(r.Context(), items)
+	if err != nil {
+		log.Println("Error syncing inventory:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if !report.Applied {
+		handlers.WriteJSON(w, http.StatusBadRequest, report)
+		return
+	}
+	handlers.WriteJSON(w, http.StatusOK, report)
+}
+
+func parseInventoryCSV(body []byte) ([]InventorySyncItem, error) {
+	reader := csv.NewReader(strings.NewReader(string(body)))
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("CSV header row is missing")
+	}
+	skuColumn, quantityColumn := -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "sku":
+			skuColumn = i
+		case "quantity":
+			quantityColumn = i
+		}
+	}
+	if skuColumn < 0 || quantityColumn < 0 {
+		return nil, errors.New("CSV header must include the \"sku\" and \"quantity\" columns")
+	}
+
+	var items []InventorySyncItem
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		quantity, err := strconv.Atoi(strings.TrimSpace(record[quantityColumn]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: quantity must be an integer", line)
+		}
+		items = append(items, InventorySyncItem{SKU: record[skuColumn], Quantity: quantity})
+	}
+	return items, nil
+}
+
+// syncInventory validates every item and applies them in one transaction. Units held
+// by checkout reservations are already taken from stock, so the new sellable stock is
+// the reported quantity minus what is reserved.
+func syncInventory(ctx context.Context, items []InventorySyncItem) (*InventorySyncReport, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	skus := make([]string, 0, len(items))
+	for i := range items {
+		items[i].SKU = strings.TrimSpace(items[i].SKU)
+		skus = append(skus, items[i].SKU)
+	}
+
+	products, err := lockProductsBySKU(ctx, tx, skus)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &InventorySyncReport{Results: make([]InventorySyncResult, 0, len(items))}
+	seen := make(map[string]bool)
+	valid := true
+	for _, item := range items {
+		result := InventorySyncResult{SKU: item.SKU}
+		product, ok := products[item.SKU]
+		switch {
+		case item.SKU == "":
+			result.Error = "sku is required"
+		case seen[item.SKU]:
+			result.Error = "sku is listed more than once"
+		case !ok:
+			result.Error = "unknown sku"
+		case item.Quantity < 0:
+			result.Error = "quantity must not be negative"
+		}
+		seen[item.SKU] = true
+
+		if result.Error == "" {
+			result.ProductID = product.ID
+			result.Previous = product.Stock
+			result.Reserved = product.Reserved
+			result.Stock = item.Quantity - product.Reserved
+			if result.Stock < 0 {
+				result.Stock = 0
+			}
+			result.Change = result.Stock - result.Previous
+		} else {
+			valid = false
+		}
+		report.Results = append(report.Results, result)
+	}
+	if !valid {
+		return report, nil
+	}
+
+	for _, result := range report.Results {
+		if result.Change == 0 {
+			continue
+		}
+		if _, err := adjustStock(ctx, tx, result.ProductID, result.Change, stockReasonInventorySync, nil, ""); err != nil {
+			return nil, err
+		}
+		report.Changed++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	report.Applied = true
+	return report, nil
+}
+
+type syncedProduct struct {
+	ID       int
+	Stock    int
+	Reserved int
+}
+
+// lockProductsBySKU locks the products with the given SKUs, keyed by SKU
+func lockProductsBySKU(ctx context.Context, tx *sql.Tx, skus []string) (map[string]syncedProduct, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT p.id, p.sku, p.stock,
+			COALESCE((SELECT SUM(quantity) FROM stock_reservations sr WHERE sr.product_id = p.id AND sr.expires_at > NOW()), 0)
+		FROM products p
+		WHERE p.sku = ANY($1)
+		ORDER BY p.id
+		FOR UPDATE OF p
+	`, pq.Array(skus))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := make(map[string]syncedProduct)
+	for rows.Next() {
+		var product syncedProduct
+		var sku string
+		if err := rows.Scan(&product.ID, &sku, &product.Stock, &product.Reserved); err != nil {
+			return nil, err
+		}
+		products[sku] = product
+	}
+
+	return products, rows.Err()
+}
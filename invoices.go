@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Store details printed on invoices, loaded from environment variables by loadInvoiceConfig
+var invoiceConfig = struct {
+	StoreName string
+	// StoreAddress is printed one comma-separated part per line
+	StoreAddress []string
+	StoreEmail   string
+	// StoreTaxID is the store's VAT or sales tax registration number, if it has one
+	StoreTaxID string
+}{}
+
+// Invoice is the invoice of a paid order. Its number is assigned the first time it is
+// downloaded, so numbers follow the order invoices are issued in.
+type Invoice struct {
+	Number   string
+	IssuedAt time.Time
+	Order    *OrderWithProducts
+	TaxRate  float64
+	Currency string
+	// CustomerName and CustomerEmail are billed when the order has no billing address
+	CustomerName  string
+	CustomerEmail string
+}
+
+func loadInvoiceConfig() {
+	invoiceConfig.StoreName = os.Getenv("STORE_NAME")
+	for _, line := range strings.Split(os.Getenv("STORE_ADDRESS"), ",") {
+		if line = strings.TrimSpace(line); line != "" {
+			invoiceConfig.StoreAddress = append(invoiceConfig.StoreAddress, line)
+		}
+	}
+	invoiceConfig.StoreEmail = os.Getenv("STORE_EMAIL")
+	if invoiceConfig.StoreEmail == "" {
+		invoiceConfig.StoreEmail = emailConfig.From
+	}
+	invoiceConfig.StoreTaxID = os.Getenv("STORE_TAX_ID")
+}
+
+// CUSTOMER INVOICE
+func CustomerOrderInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	writeOrderInvoice(w, r, orderID, getCustomerID(r))
+}
+
+// ADMIN INVOICE
+func AdminOrderInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var customerID int
+	err = db.QueryRowContext(r.Context(), "SELECT customer_id FROM orders WHERE id = $1", orderID).Scan(&customerID)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error retrieving order:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeOrderInvoice(w, r, orderID, customerID)
+}
+
+// writeOrderInvoice responds with the PDF invoice of the customer's order, or a signed link to it
+// with delivery=link. Orders that aren't paid yet, or were cancelled, have no invoice.
+func writeOrderInvoice(w http.ResponseWriter, r *http.Request, orderID, customerID int) {
+	link, err := parseDelivery(r)
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+
+	order, err := getOrderDetails(r.Context(), orderID, customerID)
+	if err != nil {
+		log.Println("Error retrieving order:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if order.Date.IsZero() {
+		handlers.WriteError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	switch order.Status {
+	case orderStatusPending, orderStatusAwaitingPayment, orderStatusCancelled:
+		handlers.WriteError(w, http.StatusConflict, "Order has no invoice until it is paid")
+		return
+	}
+
+	invoice, err := getInvoice(r.Context(), order)
+	if err != nil {
+		log.Println("Error retrieving invoice:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	var pdf bytes.Buffer
+	if err := invoice.render(&pdf); err != nil {
+		log.Println("Error rendering invoice:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	filename := "invoice-" + invoice.Number + ".pdf"
+	if link {
+		uploadReport(w, r.Context(), filename, "application/pdf", pdf.Bytes())
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(pdf.Bytes())
+}
+
+// getInvoice issues the order's invoice number unless it has one, and collects what the
+// invoice shows besides the order
+func getInvoice(ctx context.Context, order *OrderWithProducts) (*Invoice, error) {
+	invoice := &Invoice{Order: order, Currency: paymentConfig.Currency}
+
+	// The insert only runs for orders without a number, which keeps the numbers free of gaps
+	// unless two first downloads race
+	var number int
+	err := db.QueryRowContext(ctx, "SELECT number, issued_at FROM invoices WHERE order_id = $1", order.ID).Scan(&number, &invoice.IssuedAt)
+	if isNoRows(err) {
+		_, err = db.ExecContext(ctx, "INSERT INTO invoices (order_id) VALUES ($1) ON CONFLICT (order_id) DO NOTHING", order.ID)
+		if err != nil {
+			return nil, err
+		}
+		err = db.QueryRowContext(ctx, "SELECT number, issued_at FROM invoices WHERE order_id = $1", order.ID).Scan(&number, &invoice.IssuedAt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	invoice.Number = fmt.Sprintf("INV-%06d", number)
+
+	err = db.QueryRowContext(ctx, `
+		SELECT COALESCE(o.tax_rate, 0), c.name, c.email
+		FROM orders o
+		JOIN customers c ON c.id = o.customer_id
+		WHERE o.id = $1
+	`, order.ID).Scan(&invoice.TaxRate, &invoice.CustomerName, &invoice.CustomerEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	return invoice, nil
+}
+
+// render writes the invoice as an A4 PDF
+func (invoice *Invoice) render(w io.Writer) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(20, 20, 20)
+	pdf.SetAutoPageBreak(true, 20)
+	pdf.AddPage()
+	// The core fonts are Latin-1, so names and addresses are translated from UTF-8
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	order := invoice.Order
+
+	// Store details on the left, invoice details on the right
+	pdf.SetFont("Helvetica", "B", 20)
+	pdf.CellFormat(100, 10, tr("INVOICE"), "", 0, "L", false, 0, "")
+	pdf.Ln(12)
+	top := pdf.GetY()
+	storeLines := append([]string{invoiceConfig.StoreName}, invoiceConfig.StoreAddress...)
+	if invoiceConfig.StoreEmail != "" {
+		storeLines = append(storeLines, invoiceConfig.StoreEmail)
+	}
+	if invoiceConfig.StoreTaxID != "" {
+		storeLines = append(storeLines, "Tax ID: "+invoiceConfig.StoreTaxID)
+	}
+	for i, line := range storeLines {
+		if i == 0 {
+			pdf.SetFont("Helvetica", "B", 10)
+		} else {
+			pdf.SetFont("Helvetica", "", 10)
+		}
+		pdf.CellFormat(100, 5, tr(line), "", 1, "L", false, 0, "")
+	}
+	bottom := pdf.GetY()
+	pdf.SetY(top)
+	details := [][2]string{
+		{"Invoice number", invoice.Number},
+		{"Invoice date", invoice.IssuedAt.Format("Jan 2, 2006")},
+		{"Order", "#" + strconv.Itoa(order.ID)},
+		{"Order date", order.Date.Format("Jan 2, 2006")},
+	}
+	for _, detail := range details {
+		pdf.SetX(120)
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.CellFormat(35, 5, tr(detail[0]), "", 0, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.CellFormat(35, 5, tr(detail[1]), "", 1, "R", false, 0, "")
+	}
+	if pdf.GetY() < bottom {
+		pdf.SetY(bottom)
+	}
+
+	// Billing and shipping addresses side by side
+	pdf.Ln(8)
+	billTo := addressLines(order.BillingAddress)
+	if billTo == nil {
+		billTo = []string{invoice.CustomerName, invoice.CustomerEmail}
+	}
+	shipTo := addressLines(order.ShippingAddress)
+	top = pdf.GetY()
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.CellFormat(85, 6, tr("Bill to"), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	for _, line := range billTo {
+		pdf.CellFormat(85, 5, tr(line), "", 1, "L", false, 0, "")
+	}
+	bottom = pdf.GetY()
+	if shipTo != nil {
+		pdf.SetXY(105, top)
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.CellFormat(85, 6, tr("Ship to"), "", 1, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 10)
+		for _, line := range shipTo {
+			pdf.SetX(105)
+			pdf.CellFormat(85, 5, tr(line), "", 1, "L", false, 0, "")
+		}
+	}
+	if pdf.GetY() < bottom {
+		pdf.SetY(bottom)
+	}
+
+	// Line items
+	pdf.Ln(8)
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.SetFillColor(235, 235, 235)
+	pdf.CellFormat(95, 7, tr("Item"), "B", 0, "L", true, 0, "")
+	pdf.CellFormat(15, 7, tr("Qty"), "B", 0, "R", true, 0, "")
+	pdf.CellFormat(30, 7, tr("Unit price"), "B", 0, "R", true, 0, "")
+	pdf.CellFormat(30, 7, tr("Amount"), "B", 1, "R", true, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	for _, product := range order.Products {
+		pdf.CellFormat(95, 7, tr(product.Name), "B", 0, "L", false, 0, "")
+		pdf.CellFormat(15, 7, strconv.Itoa(product.Quantity), "B", 0, "R", false, 0, "")
+		pdf.CellFormat(30, 7, invoice.money(product.Price), "B", 0, "R", false, 0, "")
+		pdf.CellFormat(30, 7, invoice.money(roundCents(product.Price*float64(product.Quantity))), "B", 1, "R", false, 0, "")
+	}
+
+	// Totals, with each discount and the tax on their own line
+	pdf.Ln(4)
+	totals := [][2]string{{"Subtotal", invoice.money(order.Subtotal)}}
+	for _, discount := range order.Discounts {
+		totals = append(totals, [2]string{discountLabel(discount), invoice.money(-discount.Amount)})
+	}
+	if len(order.Discounts) == 0 && order.Discount > 0 {
+		totals = append(totals, [2]string{"Discount", invoice.money(-order.Discount)})
+	}
+	if order.Shipping > 0 || order.ShippingMethod != "" {
+		totals = append(totals, [2]string{"Shipping", invoice.money(order.Shipping)})
+	}
+	totals = append(totals, [2]string{invoice.taxLabel(), invoice.money(order.Tax)})
+	for _, total := range totals {
+		pdf.SetX(110)
+		pdf.CellFormat(50, 6, tr(total[0]), "", 0, "L", false, 0, "")
+		pdf.CellFormat(30, 6, tr(total[1]), "", 1, "R", false, 0, "")
+	}
+	pdf.SetX(110)
+	pdf.SetFont("Helvetica", "B", 11)
+	pdf.CellFormat(50, 8, tr("Total"), "T", 0, "L", false, 0, "")
+	pdf.CellFormat(30, 8, invoice.money(order.Total), "T", 1, "R", false, 0, "")
+
+	return pdf.Output(w)
+}
+
+// taxLabel names the tax line after its rate and where it was charged
+func (invoice *Invoice) taxLabel() string {
+	rate := strconv.FormatFloat(roundCents(invoice.TaxRate*100), 'f', -1, 64) + "%"
+	address := invoice.Order.ShippingAddress
+	if address == nil {
+		return "Tax (" + rate + ")"
+	}
+	jurisdiction := address.Country
+	if address.Region != "" {
+		jurisdiction = address.Region + ", " + address.Country
+	}
+	return "Tax (" + jurisdiction + " " + rate + ")"
+}
+
+func (invoice *Invoice) money(amount float64) string {
+	return fmt.Sprintf("%.2f %s", amount, invoice.Currency)
+}
+
+// discountLabel describes an applied discount on its invoice line
+func discountLabel(discount AppliedDiscount) string {
+	switch discount.Type {
+	case discountTypePromotion:
+		return "Promotion: " + discount.Name
+	case discountTypeCoupon:
+		return "Coupon " + discount.Name
+	case discountTypeFirstOrder:
+		return "First order discount"
+	case discountTypePoints:
+		return "Loyalty points"
+	}
+	return "Discount"
+}
+
+// addressLines lays the address out as it is printed; nil without an address
+func addressLines(address *PostalAddress) []string {
+	if address == nil {
+		return nil
+	}
+	lines := []string{address.Name, address.Line1}
+	if address.Line2 != "" {
+		lines = append(lines, address.Line2)
+	}
+	city := address.City
+	if address.Region != "" {
+		city += ", " + address.Region
+	}
+	if address.PostalCode != "" {
+		city += " " + address.PostalCode
+	}
+	return append(lines, city, address.Country)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// ListParams are the query parameters list endpoints share: sort, status, date_from and
+// date_to (also accepted as from and to), page, limit and fields
+type ListParams struct {
+	Sort string
+	// Statuses match any of the comma-separated statuses, ignoring case
+	Statuses []string
+	DateFrom *time.Time
+	DateTo   *time.Time
+	Page     int
+	Limit    int
+	// Fields are the comma-separated fields of each item to respond with; every field when empty
+	Fields []string
+}
+
+// listColumns is what a list endpoint applies the shared parameters to. Only these SQL
+// fragments reach the query; the parameters' values are always bound as arguments.
+type listColumns struct {
+	// Sorts maps the values of sort to ORDER BY clauses; "" is the default order
+	Sorts map[string]string
+	// Status is the column status filters, and Date the column date_from and date_to filter;
+	// empty when the list can't be filtered by it
+	Status string
+	Date   string
+	// Item is a value of the list's item type, whose JSON fields fields selects
+	Item interface{}
+}
+
+// sqlFilter collects the conditions of a query's WHERE clause and their arguments
+type sqlFilter struct {
+	conditions []string
+	args       []interface{}
+}
+
+// parseListParams reads the shared parameters of a list from its query, rejecting those the
+// list doesn't support
+func parseListParams(query url.Values, columns listColumns) (ListParams, error) {
+	params := ListParams{Sort: query.Get("sort"), Page: 1, Limit: defaultProductPageSize}
+
+	if _, ok := columns.Sorts[params.Sort]; !ok {
+		var sorts []string
+		for value := range columns.Sorts {
+			if value != "" {
+				sorts = append(sorts, value)
+			}
+		}
+		sort.Strings(sorts)
+		return params, handlers.NewFieldError("sort", "sort must be one of "+strings.Join(sorts, ", "))
+	}
+	if v := strings.TrimSpace(query.Get("status")); v != "" {
+		if columns.Status == "" {
+			return params, handlers.NewFieldError("status", "status is not supported by this list")
+		}
+		for _, status := range strings.Split(v, ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				params.Statuses = append(params.Statuses, status)
+			}
+		}
+	}
+	var err error
+	if params.DateFrom, err = parseListDate(query, columns, false, "date_from", "from"); err != nil {
+		return params, err
+	}
+	if params.DateTo, err = parseListDate(query, columns, true, "date_to", "to"); err != nil {
+		return params, err
+	}
+	if params.DateFrom != nil && params.DateTo != nil && params.DateFrom.After(*params.DateTo) {
+		return params, handlers.NewFieldError("date_from", "date_from must not be after date_to")
+	}
+	if v := query.Get("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return params, handlers.NewFieldError("page", "page must be a positive integer")
+		}
+		params.Page = page
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxProductPageSize {
+			return params, handlers.FieldErrorf("limit", "limit must be between 1 and %d", maxProductPageSize)
+		}
+		params.Limit = limit
+	}
+	if v := strings.TrimSpace(query.Get("fields")); v != "" {
+		if columns.Item == nil {
+			return params, handlers.NewFieldError("fields", "fields is not supported by this list")
+		}
+		known := jsonFieldNames(reflect.TypeOf(columns.Item))
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			if !known[field] {
+				names := make([]string, 0, len(known))
+				for name := range known {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				return params, handlers.NewFieldError("fields", "fields must be among "+strings.Join(names, ", "))
+			}
+			params.Fields = append(params.Fields, field)
+		}
+	}
+
+	return params, nil
+}
+
+// jsonFieldNames are the names encoding/json gives the fields of a struct type, including those
+// of its embedded structs
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		switch {
+		case name == "-":
+		case field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct:
+			for embedded := range jsonFieldNames(field.Type) {
+				names[embedded] = true
+			}
+		case !field.IsExported():
+		case name == "":
+			names[field.Name] = true
+		default:
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// writeListJSON answers 200 with a page of a list, trimming the items under key to the fields
+// the list's fields parameter selected
+func writeListJSON(w http.ResponseWriter, page interface{}, key string, fields []string) {
+	selected, err := selectListFields(page, key, fields)
+	if err != nil {
+		log.Println("Error selecting list fields:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	handlers.WriteJSON(w, http.StatusOK, selected)
+}
+
+// selectListFields trims the items under key of a page to the fields; the page itself without
+// any fields
+func selectListFields(page interface{}, key string, fields []string) (interface{}, error) {
+	if len(fields) == 0 {
+		return page, nil
+	}
+
+	var object map[string]json.RawMessage
+	var items []map[string]json.RawMessage
+	body, err := json.Marshal(page)
+	if err == nil {
+		err = json.Unmarshal(body, &object)
+	}
+	if err == nil {
+		err = json.Unmarshal(object[key], &items)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make([]map[string]json.RawMessage, len(items))
+	for i, item := range items {
+		selected[i] = map[string]json.RawMessage{}
+		for _, field := range fields {
+			if value, ok := item[field]; ok {
+				selected[i][field] = value
+			}
+		}
+	}
+	trimmed, err := json.Marshal(selected)
+	if err != nil {
+		return nil, err
+	}
+	object[key] = trimmed
+	return object, nil
+}
+
+// parseListDate reads the first of the named date parameters that is set; nil without any
+func parseListDate(query url.Values, columns listColumns, endOfDay bool, names ...string) (*time.Time, error) {
+	for _, name := range names {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		if columns.Date == "" {
+			return nil, errors.New(name + " is not supported by this list")
+		}
+		t, err := parseDateParam(v, endOfDay)
+		if err != nil {
+			return nil, errors.New(name + " must be a date (YYYY-MM-DD) or an RFC 3339 timestamp")
+		}
+		return &t, nil
+	}
+	return nil, nil
+}
+
+// add appends a condition, whose ? placeholders are bound to args in turn
+func (f *sqlFilter) add(condition string, args ...interface{}) {
+	for _, arg := range args {
+		f.args = append(f.args, arg)
+		condition = strings.Replace(condition, "?", "$"+strconv.Itoa(len(f.args)), 1)
+	}
+	f.conditions = append(f.conditions, condition)
+}
+
+// addList appends the conditions of the list's status and date filters
+func (f *sqlFilter) addList(params ListParams, columns listColumns) {
+	if len(params.Statuses) > 0 {
+		lowered := make([]string, len(params.Statuses))
+		for i, status := range params.Statuses {
+			lowered[i] = strings.ToLower(status)
+		}
+		f.add("LOWER("+columns.Status+") = ANY(?)", pq.Array(lowered))
+	}
+	if params.DateFrom != nil {
+		f.add(columns.Date+" >= ?", *params.DateFrom)
+	}
+	if params.DateTo != nil {
+		f.add(columns.Date+" <= ?", *params.DateTo)
+	}
+}
+
+// where is the WHERE clause of the conditions, or empty without any
+func (f *sqlFilter) where() string {
+	if len(f.conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(f.conditions, " AND ")
+}
+
+// page is the ORDER BY, LIMIT and OFFSET clauses of the list's page, whose arguments follow
+// the conditions'. It is appended last, after counting the matches with the conditions alone.
+func (f *sqlFilter) page(params ListParams, columns listColumns) string {
+	f.args = append(f.args, params.Limit, (params.Page-1)*params.Limit)
+	return "ORDER BY " + columns.Sorts[params.Sort] +
+		" LIMIT $" + strconv.Itoa(len(f.args)-1) + " OFFSET $" + strconv.Itoa(len(f.args))
+}
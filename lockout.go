@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Brute-force protection settings, loaded from environment variables by loadLockoutConfig
+var lockoutConfig = struct {
+	// MaxFailures locks an account after this many failed logins within Window
+	MaxFailures int
+	// MaxIPFailures blocks a client IP after this many failed logins within Window, across all emails
+	MaxIPFailures int
+	// Window is both the counting window and how long a lock lasts
+	Window time.Duration
+}{
+	MaxFailures:   5,
+	MaxIPFailures: 20,
+	Window:        15 * time.Minute,
+}
+
+func loadLockoutConfig() {
+	if v := os.Getenv("LOGIN_MAX_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid LOGIN_MAX_FAILURES %q", v)
+		}
+		lockoutConfig.MaxFailures = n
+	}
+	if v := os.Getenv("LOGIN_MAX_IP_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid LOGIN_MAX_IP_FAILURES %q", v)
+		}
+		lockoutConfig.MaxIPFailures = n
+	}
+	if v := os.Getenv("LOGIN_LOCKOUT_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid LOGIN_LOCKOUT_WINDOW %q: %v", v, err)
+		}
+		lockoutConfig.Window = d
+	}
+}
+
+// clientIP returns the remote address without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginLockedUntil returns when the email or IP may try again, or the zero time if neither is locked.
+// The returned status is 423 for a locked account and 429 for a blocked IP.
+func loginLockedUntil(ctx context.Context, email, ip string) (time.Time, int, error) {
+	until, err := failureLockedUntil(ctx, "email", email, lockoutConfig.MaxFailures)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if !until.IsZero() {
+		return until, http.StatusLocked, nil
+	}
+
+	until, err = failureLockedUntil(ctx, "ip", ip, lockoutConfig.MaxIPFailures)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if !until.IsZero() {
+		return until, http.StatusTooManyRequests, nil
+	}
+
+	return time.Time{}, 0, nil
+}
+
+// failureLockedUntil finds the oldest of the last maxFailures failures inside the window;
+// the lock lasts until that failure ages out of the window
+func failureLockedUntil(ctx context.Context, column, value string, maxFailures int) (time.Time, error) {
+	var attemptedAt time.Time
+	err := db.QueryRowContext(ctx, `
+		SELECT attempted_at FROM login_attempts
+		WHERE `+column+` = $1 AND attempted_at > $2
+		ORDER BY attempted_at DESC
+		OFFSET $3 LIMIT 1
+	`, value, time.Now().Add(-lockoutConfig.Window), maxFailures-1).Scan(&attemptedAt)
+	if isNoRows(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return attemptedAt.Add(lockoutConfig.Window), nil
+}
+
+func recordFailedLogin(ctx context.Context, email, ip string) {
+	_, err := db.ExecContext(ctx, "INSERT INTO login_attempts (email, ip, attempted_at) VALUES ($1, $2, $3)", email, ip, time.Now())
+	if err != nil {
+		log.Println("Error recording failed login:", err)
+	}
+
+	// Attempts outside the window no longer count, so there's no reason to keep them
+	_, err = db.ExecContext(ctx, "DELETE FROM login_attempts WHERE attempted_at < $1", time.Now().Add(-lockoutConfig.Window))
+	if err != nil {
+		log.Println("Error pruning login attempts:", err)
+	}
+}
+
+// clearFailedLogins resets the account's failure count after a successful login
+func clearFailedLogins(ctx context.Context, email string) {
+	_, err := db.ExecContext(ctx, "DELETE FROM login_attempts WHERE email = $1", email)
+	if err != nil {
+		log.Println("Error clearing failed logins:", err)
+	}
+}
+
+func writeLockedResponse(w http.ResponseWriter, until time.Time, status int) {
+	retryAfter := int(time.Until(until).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	if status == http.StatusLocked {
+		handlers.WriteError(w, status, "Account temporarily locked after too many failed logins, retry in "+strconv.Itoa(retryAfter)+" seconds")
+	} else {
+		handlers.WriteError(w, status, "Too many failed logins, retry in "+strconv.Itoa(retryAfter)+" seconds")
+	}
+}
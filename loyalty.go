@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Loyalty point transaction types. Points are positive for earn and return, negative for redeem.
+const (
+	loyaltyTransactionEarn   = "earn"
+	loyaltyTransactionRedeem = "redeem"
+	// loyaltyTransactionReturn gives back the points redeemed on a cancelled order
+	loyaltyTransactionReturn = "return"
+)
+
+// errInvalidPoints is returned, wrapped with the reason, when an order can't redeem the points
+// it asks for
+var errInvalidPoints = handlers.NewFieldError("redeem_points", "redeem_points is not valid")
+
+// Loyalty settings, loaded from environment variables by loadLoyaltyConfig
+var loyaltyConfig = struct {
+	// PointsPerUnit is how many points each currency unit of a paid order's total earns; 0
+	// turns earning off
+	PointsPerUnit float64
+	// PointValue is what a redeemed point takes off an order; 0 turns redeeming off
+	PointValue float64
+}{
+	PointsPerUnit: 1,
+	PointValue:    0.01,
+}
+
+// LoyaltyPoints is a customer's point balance and its history, newest first
+type LoyaltyPoints struct {
+	Points int `json:"points"`
+	// Value is what the points take off an order when redeemed
+	Value   float64              `json:"value"`
+	History []LoyaltyTransaction `json:"history"`
+}
+
+type LoyaltyTransaction struct {
+	Type      string    `json:"type"`
+	Points    int       `json:"points"`
+	OrderID   *int      `json:"order_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func loadLoyaltyConfig() {
+	if v := os.Getenv("LOYALTY_POINTS_PER_UNIT"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid LOYALTY_POINTS_PER_UNIT %q", v)
+		}
+		loyaltyConfig.PointsPerUnit = n
+	}
+	if v := os.Getenv("LOYALTY_POINT_VALUE"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid LOYALTY_POINT_VALUE %q", v)
+		}
+		loyaltyConfig.PointValue = n
+	}
+}
+
+// CUSTOMER LOYALTY POINTS
+func CustomerLoyaltyPointsHandler(w http.ResponseWriter, r *http.Request) {
+	customerID := getCustomerID(r)
+	loyalty := LoyaltyPoints{History: make([]LoyaltyTransaction, 0)}
+	err := db.QueryRowContext(r.Context(), "SELECT loyalty_points FROM customers WHERE id = $1", customerID).Scan(&loyalty.Points)
+	var rows *sql.Rows
+	if err == nil {
+		rows, err = db.QueryContext(r.Context(), `
+			SELECT type, points, order_id, created_at
+			FROM loyalty_transactions
+			WHERE customer_id = $1
+			ORDER BY created_at DESC, id DESC
+		`, customerID)
+	}
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var transaction LoyaltyTransaction
+			if err = rows.Scan(&transaction.Type, &transaction.Points, &transaction.OrderID, &transaction.CreatedAt); err != nil {
+				break
+			}
+			loyalty.History = append(loyalty.History, transaction)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+	}
+	if err != nil {
+		log.Println("Error retrieving loyalty points:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	loyalty.Value = roundCents(float64(loyalty.Points) * loyaltyConfig.PointValue)
+	handlers.WriteJSON(w, http.StatusOK, loyalty)
+}
+
+// validateRedeemPoints checks that the customer has the points to redeem. Whether they are
+// all needed is decided when the order is priced.
+func validateRedeemPoints(ctx context.Context, customerID, points int) error {
+	if points == 0 {
+		return nil
+	}
+	if points < 0 {
+		return fmt.Errorf("%w: it must not be negative", errInvalidPoints)
+	}
+	if loyaltyConfig.PointValue <= 0 {
+		return fmt.Errorf("%w: loyalty points can't be redeemed", errInvalidPoints)
+	}
+	var balance int
+	if err := db.QueryRowContext(ctx, "SELECT loyalty_points FROM customers WHERE id = $1", customerID).Scan(&balance); err != nil {
+		return err
+	}
+	if points > balance {
+		return fmt.Errorf("%w: you have %d points", errInvalidPoints, balance)
+	}
+	return nil
+}
+
+// adjustLoyaltyPoints adds points, or takes them off when negative, from the customer's
+// balance and records the transaction. Taking more points than the customer has fails with an
+// error wrapping errInvalidPoints.
+func adjustLoyaltyPoints(ctx context.Context, tx *sql.Tx, customerID, points int, transactionType string, orderID int) error {
+	result, err := tx.ExecContext(ctx, `
+		UPDATE customers SET loyalty_points = loyalty_points + $1
+		WHERE id = $2 AND loyalty_points + $1 >= 0
+	`, points, customerID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w: you don't have %d points", errInvalidPoints, -points)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO loyalty_transactions (customer_id, order_id, type, points)
+		VALUES ($1, $2, $3, $4)
+	`, customerID, orderID, transactionType, points)
+	return err
+}
+
+// redeemOrderPoints takes up to the requested points off the customer's balance for a discount
+// on the new order, only as many as it takes to cover remaining, and returns the points
+// redeemed and their discount
+func redeemOrderPoints(ctx context.Context, tx *sql.Tx, orderID, customerID, requested int, remaining float64) (int, float64, error) {
+	if requested <= 0 || remaining <= 0 {
+		return 0, 0, nil
+	}
+	if loyaltyConfig.PointValue <= 0 {
+		return 0, 0, fmt.Errorf("%w: loyalty points can't be redeemed", errInvalidPoints)
+	}
+
+	points := requested
+	if needed := int(math.Ceil(remaining/loyaltyConfig.PointValue - 1e-9)); needed < points {
+		points = needed
+	}
+	if err := adjustLoyaltyPoints(ctx, tx, customerID, -points, loyaltyTransactionRedeem, orderID); err != nil {
+		return 0, 0, err
+	}
+	return points, roundCents(math.Min(float64(points)*loyaltyConfig.PointValue, remaining)), nil
+}
+
+// earnOrderPoints awards the customer points for the paid order's total
+func earnOrderPoints(ctx context.Context, tx *sql.Tx, orderID int) error {
+	if loyaltyConfig.PointsPerUnit <= 0 {
+		return nil
+	}
+	var customerID int
+	var total float64
+	if err := tx.QueryRowContext(ctx, "SELECT customer_id, COALESCE(total, 0) FROM orders WHERE id = $1", orderID).Scan(&customerID, &total); err != nil {
+		return err
+	}
+	points := int(math.Floor(total * loyaltyConfig.PointsPerUnit))
+	if points <= 0 {
+		return nil
+	}
+	return adjustLoyaltyPoints(ctx, tx, customerID, points, loyaltyTransactionEarn, orderID)
+}
+
+// returnOrderPoints gives back the points redeemed on the cancelled order
+func returnOrderPoints(ctx context.Context, tx *sql.Tx, orderID int) error {
+	var customerID, points int
+	if err := tx.QueryRowContext(ctx, "SELECT customer_id, points_redeemed FROM orders WHERE id = $1", orderID).Scan(&customerID, &points); err != nil {
+		return err
+	}
+	if points <= 0 {
+		return nil
+	}
+	return adjustLoyaltyPoints(ctx, tx, customerID, points, loyaltyTransactionReturn, orderID)
+}
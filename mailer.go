@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// Email providers EMAIL_PROVIDER selects between
+const (
+	emailProviderSMTP     = "smtp"
+	emailProviderSendGrid = "sendgrid"
+	emailProviderSES      = "ses"
+)
+
+const sendGridAPIURL = "https://api.sendgrid.com/v3/mail/send"
+
+// snsHost matches the hosts Amazon SNS serves its signing certificates and subscription
+// confirmations from
+var snsHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// Mailer delivers rendered emails through an email provider
+type Mailer interface {
+	Send(ctx context.Context, from, to string, message *emailMessage) error
+}
+
+// Email settings, loaded from environment variables by loadMailer
+var emailConfig = struct {
+	// From is the sender address; it defaults to SMTP_USERNAME with the SMTP provider
+	From string
+}{}
+
+// mailer is the provider EMAIL_PROVIDER selects, SMTP by default
+var mailer Mailer
+
+// smtpMailer sends through the SMTP server configured by the SMTP_* variables
+type smtpMailer struct{}
+
+// sendGridMailer sends through the SendGrid v3 mail API
+type sendGridMailer struct {
+	apiKey string
+	client *http.Client
+	// webhookKey verifies the signed event webhook; nil when SENDGRID_WEBHOOK_PUBLIC_KEY is unset
+	webhookKey *ecdsa.PublicKey
+}
+
+// sesMailer sends through Amazon SES, with the credentials of the default AWS chain. Bounces
+// and complaints arrive through the SNS topic SES publishes them to.
+type sesMailer struct {
+	client   *sesv2.Client
+	topicARN string
+	http     *http.Client
+
+	certsMu sync.Mutex
+	certs   map[string]*x509.Certificate
+}
+
+// snsMessage is a message Amazon SNS posts to a subscribed HTTPS endpoint
+type snsMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL"`
+}
+
+func loadMailer() {
+	emailConfig.From = os.Getenv("EMAIL_FROM")
+
+	switch provider := os.Getenv("EMAIL_PROVIDER"); provider {
+	case "", emailProviderSMTP:
+		if emailConfig.From == "" {
+			emailConfig.From = smtpConfig.SMTPUsername
+		}
+		mailer = smtpMailer{}
+	case emailProviderSendGrid:
+		key := os.Getenv("SENDGRID_API_KEY")
+		if key == "" {
+			log.Fatal("SENDGRID_API_KEY is required when EMAIL_PROVIDER is sendgrid")
+		}
+		sendGrid := &sendGridMailer{apiKey: key, client: &http.Client{Timeout: 30 * time.Second}}
+		if v := os.Getenv("SENDGRID_WEBHOOK_PUBLIC_KEY"); v != "" {
+			der, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				log.Fatalf("Invalid SENDGRID_WEBHOOK_PUBLIC_KEY: %v", err)
+			}
+			publicKey, err := x509.ParsePKIXPublicKey(der)
+			webhookKey, ok := publicKey.(*ecdsa.PublicKey)
+			if err != nil || !ok {
+				log.Fatal("Invalid SENDGRID_WEBHOOK_PUBLIC_KEY: not an ECDSA public key")
+			}
+			sendGrid.webhookKey = webhookKey
+		}
+		mailer = sendGrid
+	case emailProviderSES:
+		cfg, err := awsconfig.LoadDefaultConfig(context.Background(), awsconfig.WithRegion(os.Getenv("SES_REGION")))
+		if err != nil {
+			log.Fatalf("Error loading AWS configuration: %v", err)
+		}
+		mailer = &sesMailer{
+			client:   sesv2.NewFromConfig(cfg),
+			topicARN: os.Getenv("SES_SNS_TOPIC_ARN"),
+			http:     &http.Client{Timeout: 10 * time.Second},
+			certs:    map[string]*x509.Certificate{},
+		}
+	default:
+		log.Fatalf("Invalid EMAIL_PROVIDER %q", provider)
+	}
+
+	if emailConfig.From == "" {
+		log.Fatal("EMAIL_FROM is required")
+	}
+}
+
+// Send delivers the message with net/smtp, which takes no context
+func (smtpMailer) Send(ctx context.Context, from, to string, message *emailMessage) error {
+	raw, err := message.build(from, to)
+	if err != nil {
+		return err
+	}
+	auth := smtp.PlainAuth("", smtpConfig.SMTPUsername, smtpConfig.SMTPPassword, smtpConfig.SMTPServer)
+	return smtp.SendMail(fmt.Sprintf("%s:%d", smtpConfig.SMTPServer, smtpConfig.SMTPPort), auth, from, []string{to}, raw)
+}
+
+func (m *sendGridMailer) Send(ctx context.Context, from, to string, message *emailMessage) error {
+	type address struct {
+		Email string `json:"email"`
+	}
+	type content struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	type attachment struct {
+		Content     string `json:"content"`
+		Type        string `json:"type"`
+		Filename    string `json:"filename"`
+		Disposition string `json:"disposition"`
+	}
+	mail := map[string]interface{}{
+		"personalizations": []map[string]interface{}{{"to": []address{{Email: to}}}},
+		"from":             address{Email: from},
+		"subject":          message.Subject,
+		// SendGrid wants the plain text content first
+		"content": []content{
+			{Type: "text/plain", Value: message.Text},
+			{Type: "text/html", Value: message.HTML},
+		},
+	}
+	if len(message.Attachments) > 0 {
+		attachments := make([]attachment, len(message.Attachments))
+		for i, a := range message.Attachments {
+			attachments[i] = attachment{base64.StdEncoding.EncodeToString(a.Content), a.ContentType, a.Filename, "attachment"}
+		}
+		mail["attachments"] = attachments
+	}
+	payload, err := json.Marshal(mail)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sendGridAPIURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("sendgrid responded with %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// Send uses SES's simple content, or the raw email when there are attachments, which simple
+// content can't carry
+func (m *sesMailer) Send(ctx context.Context, from, to string, message *emailMessage) error {
+	if len(message.Attachments) > 0 {
+		raw, err := message.build(from, to)
+		if err != nil {
+			return err
+		}
+		_, err = m.client.SendEmail(ctx, &sesv2.SendEmailInput{
+			FromEmailAddress: aws.String(from),
+			Destination:      &types.Destination{ToAddresses: []string{to}},
+			Content:          &types.EmailContent{Raw: &types.RawMessage{Data: raw}},
+		})
+		return err
+	}
+
+	utf8 := aws.String("UTF-8")
+	_, err := m.client.SendEmail(ctx, &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(from),
+		Destination:      &types.Destination{ToAddresses: []string{to}},
+		Content: &types.EmailContent{
+			Simple: &types.Message{
+				Subject: &types.Content{Data: aws.String(message.Subject), Charset: utf8},
+				Body: &types.Body{
+					Text: &types.Content{Data: aws.String(message.Text), Charset: utf8},
+					Html: &types.Content{Data: aws.String(message.HTML), Charset: utf8},
+				},
+			},
+		},
+	})
+	return err
+}
+
+// ParseEmailEvents verifies the event webhook's ECDSA signature, made over the timestamp header
+// followed by the body, and returns its hard bounces and spam reports
+func (m *sendGridMailer) ParseEmailEvents(ctx context.Context, r *http.Request, body []byte) ([]EmailEvent, error) {
+	if m.webhookKey == nil {
+		return nil, errors.New("SENDGRID_WEBHOOK_PUBLIC_KEY is not set")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Twilio-Email-Event-Webhook-Signature"))
+	if err != nil {
+		return nil, errInvalidWebhookSignature
+	}
+	digest := sha256.Sum256(append([]byte(r.Header.Get("X-Twilio-Email-Event-Webhook-Timestamp")), body...))
+	if !ecdsa.VerifyASN1(m.webhookKey, digest[:], signature) {
+		return nil, errInvalidWebhookSignature
+	}
+
+	var payload []struct {
+		Email  string `json:"email"`
+		Event  string `json:"event"`
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	var events []EmailEvent
+	for _, event := range payload {
+		switch {
+		// Blocked messages are temporary rejections, which SendGrid reports as bounces too
+		case event.Event == "bounce" && event.Type != "blocked":
+			events = append(events, EmailEvent{Type: emailSuppressionBounce, Email: event.Email, Detail: event.Reason})
+		case event.Event == "spamreport":
+			events = append(events, EmailEvent{Type: emailSuppressionComplaint, Email: event.Email})
+		}
+	}
+	return events, nil
+}
+
+// ParseEmailEvents verifies the SNS message's signature and topic, confirms the topic
+// subscription when SNS asks to, and returns the permanent bounces and complaints SES
+// published
+func (m *sesMailer) ParseEmailEvents(ctx context.Context, r *http.Request, body []byte) ([]EmailEvent, error) {
+	if m.topicARN == "" {
+		return nil, errors.New("SES_SNS_TOPIC_ARN is not set")
+	}
+
+	var message snsMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		return nil, err
+	}
+	// Anyone can create a topic, so a valid signature only counts on the configured one
+	if message.TopicArn != m.topicARN {
+		return nil, fmt.Errorf("%w: unexpected topic %s", errInvalidWebhookSignature, message.TopicArn)
+	}
+	if err := m.verifySNSMessage(ctx, &message); err != nil {
+		return nil, err
+	}
+
+	if message.Type == "SubscriptionConfirmation" {
+		return nil, m.getSNS(ctx, message.SubscribeURL)
+	}
+	if message.Type != "Notification" {
+		return nil, nil
+	}
+
+	// SES notifications name their type notificationType, and configuration set events eventType
+	var notification struct {
+		NotificationType string `json:"notificationType"`
+		EventType        string `json:"eventType"`
+		Bounce           struct {
+			BounceType        string `json:"bounceType"`
+			BouncedRecipients []struct {
+				EmailAddress   string `json:"emailAddress"`
+				DiagnosticCode string `json:"diagnosticCode"`
+			} `json:"bouncedRecipients"`
+		} `json:"bounce"`
+		Complaint struct {
+			ComplainedRecipients []struct {
+				EmailAddress string `json:"emailAddress"`
+			} `json:"complainedRecipients"`
+			ComplaintFeedbackType string `json:"complaintFeedbackType"`
+		} `json:"complaint"`
+	}
+	if err := json.Unmarshal([]byte(message.Message), &notification); err != nil {
+		return nil, err
+	}
+
+	var events []EmailEvent
+	switch notification.NotificationType + notification.EventType {
+	case "Bounce":
+		// Transient bounces, such as full mailboxes, may be delivered on a later try
+		if notification.Bounce.BounceType != "Permanent" {
+			break
+		}
+		for _, recipient := range notification.Bounce.BouncedRecipients {
+			events = append(events, EmailEvent{Type: emailSuppressionBounce, Email: recipient.EmailAddress, Detail: recipient.DiagnosticCode})
+		}
+	case "Complaint":
+		for _, recipient := range notification.Complaint.ComplainedRecipients {
+			events = append(events, EmailEvent{Type: emailSuppressionComplaint, Email: recipient.EmailAddress, Detail: notification.Complaint.ComplaintFeedbackType})
+		}
+	}
+	return events, nil
+}
+
+// verifySNSMessage checks the message's RSA signature with the SNS certificate it names
+func (m *sesMailer) verifySNSMessage(ctx context.Context, message *snsMessage) error {
+	var hash crypto.Hash
+	var digest []byte
+	switch message.SignatureVersion {
+	case "1":
+		sum := sha1.Sum([]byte(message.stringToSign()))
+		hash, digest = crypto.SHA1, sum[:]
+	case "2":
+		sum := sha256.Sum256([]byte(message.stringToSign()))
+		hash, digest = crypto.SHA256, sum[:]
+	default:
+		return fmt.Errorf("%w: unknown signature version %q", errInvalidWebhookSignature, message.SignatureVersion)
+	}
+
+	cert, err := m.signingCert(ctx, message.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: signing certificate has no RSA key", errInvalidWebhookSignature)
+	}
+	signature, err := base64.StdEncoding.DecodeString(message.Signature)
+	if err != nil {
+		return errInvalidWebhookSignature
+	}
+	if err := rsa.VerifyPKCS1v15(publicKey, hash, digest, signature); err != nil {
+		return errInvalidWebhookSignature
+	}
+	return nil
+}
+
+// signingCert returns the SNS certificate at the URL, which is only fetched once
+func (m *sesMailer) signingCert(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	m.certsMu.Lock()
+	cert, ok := m.certs[certURL]
+	m.certsMu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	if !isSNSURL(certURL) {
+		return nil, fmt.Errorf("%w: untrusted signing certificate URL %s", errInvalidWebhookSignature, certURL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, certURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching SNS signing certificate: %s", resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("SNS signing certificate is not PEM encoded")
+	}
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	m.certsMu.Lock()
+	m.certs[certURL] = cert
+	m.certsMu.Unlock()
+	return cert, nil
+}
+
+// getSNS visits an SNS URL, such as the one confirming a subscription
+func (m *sesMailer) getSNS(ctx context.Context, snsURL string) error {
+	if !isSNSURL(snsURL) {
+		return fmt.Errorf("untrusted SNS URL %s", snsURL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, snsURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("confirming SNS subscription: %s", resp.Status)
+	}
+	return nil
+}
+
+// stringToSign is the text SNS signs: the message's fields, which depend on its type, in
+// alphabetical order as name and value lines
+func (message *snsMessage) stringToSign() string {
+	fields := []string{"Message", message.Message, "MessageId", message.MessageID}
+	if message.Type == "Notification" {
+		if message.Subject != "" {
+			fields = append(fields, "Subject", message.Subject)
+		}
+		fields = append(fields, "Timestamp", message.Timestamp, "TopicArn", message.TopicArn, "Type", message.Type)
+	} else {
+		fields = append(fields, "SubscribeURL", message.SubscribeURL, "Timestamp", message.Timestamp,
+			"Token", message.Token, "TopicArn", message.TopicArn, "Type", message.Type)
+	}
+	return strings.Join(fields, "\n") + "\n"
+}
+
+// isSNSURL reports whether the URL is an HTTPS URL of Amazon SNS
+func isSNSURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Scheme == "https" && snsHost.MatchString(u.Host)
+}
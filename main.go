@@ -1,30 +1,29 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-  "encoding/csv"
   "encoding/json"
+	"errors"
   "io/ioutil"
 	"fmt"
 	"log"
 	"net/http"
-  "net/smtp"
   "os"
-  "strconv"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
   "github.com/golang/time/rate"
-	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
 )
 
 var db *sql.DB
 
-// Advise: This token only as examples, change for better encryption
-var customerToken = "customer_token"
-var adminToken = "admin_token"
-
 // Limiter for Request per minute
 var rateLimiter = NewRateLimiter(100, time.Minute)
 
@@ -37,18 +36,71 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
+	loadDatabaseConfig()
 	initDB()
+	loadMigrationConfig()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+	if migrationConfig.AutoMigrate {
+		if err := migrateUp(); err != nil {
+			log.Fatal("Error migrating: ", err)
+		}
+	}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/place-order", RateLimitMiddleware(AuthMiddleware(PlaceOrderHandler, "customer"))).Methods("POST")
-  r.HandleFunc("/customer/orders", AuthMiddleware(CustomerOrdersHandler, "customer")).Methods("GET")
-	r.HandleFunc("/admin/orders", RateLimitMiddleware(AuthMiddleware(AdminOrdersHandler, "admin"))).Methods("GET")
-
-	go BackgroundTask()
+	loadJWTConfig()
+	loadPasswordResetConfig()
+	loadGoogleOAuthConfig()
+	loadRefreshTokenConfig()
+	loadLockoutConfig()
+	loadObjectStorage()
+	loadInventoryConfig()
+	loadCartConfig()
+	loadShippingConfig()
+	loadPaymentConfig()
+	loadCarrierConfig()
+	loadTrackingConfig()
+	loadLoyaltyConfig()
+	loadReferralConfig()
+	loadFirstOrderConfig()
+	loadDiscountConfig()
+	loadEmailTemplates()
+	loadMailer()
+	loadEmailQueueConfig()
+	loadWebhookConfig()
+	loadSalesDigestConfig()
+	loadInvoiceConfig()
+	loadReportConfig()
+	loadAPIDocsConfig()
+	loadGRPCConfig()
+	loadServerConfig()
+
+	r := newRouter()
+
+	// SIGTERM or SIGINT starts a graceful shutdown; a second one stops at once
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	var tasks sync.WaitGroup
+	tasks.Add(1)
+	go func() {
+		defer tasks.Done()
+		BackgroundTask(ctx)
+	}()
+	if grpcConfig.Addr != "" {
+		tasks.Add(1)
+		go func() {
+			defer tasks.Done()
+			serveGRPC(ctx)
+		}()
+	}
 
-  http.Handle("/", r)
 	serverPort := os.Getenv("SERVER_PORT")
-	log.Fatal(http.ListenAndServe(":"+serverPort, nil))
+	runServer(ctx, ":"+serverPort, r, &tasks)
 }
 
 // Configure SMTP settings using environment variables
@@ -74,7 +126,9 @@ func initDB() {
 		DBName     string `env:"DB_NAME"`
 	}
 
-	connectionString := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable", envConfig.DBUsername, envConfig.DBPassword, envConfig.DBName)
+	// Every connection gets the query timeout, so Postgres cancels statements that run too long
+	connectionString := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable statement_timeout=%d",
+		envConfig.DBUsername, envConfig.DBPassword, envConfig.DBName, databaseConfig.QueryTimeout.Milliseconds())
 
 	var err error
 	db, err = sql.Open("postgres", connectionString)
@@ -86,45 +140,6 @@ func initDB() {
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	// Initialize database schema (create tables)
-	createTableSQL := `
-		CREATE TABLE IF NOT EXISTS products (
-			id SERIAL PRIMARY KEY,
-			name VARCHAR(255) NOT NULL,
-			price DECIMAL NOT NULL,
-			description TEXT,
-			image_url VARCHAR(255)
-		);
-
-		CREATE TABLE IF NOT EXISTS customers (
-			id SERIAL PRIMARY KEY,
-			name VARCHAR(255) NOT NULL,
-			email VARCHAR(255) NOT NULL,
-			password VARCHAR(255) NOT NULL
-		);
-
-		CREATE TABLE IF NOT EXISTS orders (
-			id SERIAL PRIMARY KEY,
-			customer_id INT NOT NULL,
-			date TIMESTAMP NOT NULL,
-			status VARCHAR(50) NOT NULL,
-			FOREIGN KEY (customer_id) REFERENCES customers(id)
-		);
-
-		CREATE TABLE IF NOT EXISTS order_products (
-			order_id INT NOT NULL,
-			product_id INT NOT NULL,
-			PRIMARY KEY (order_id, product_id),
-			FOREIGN KEY (order_id) REFERENCES orders(id),
-			FOREIGN KEY (product_id) REFERENCES products(id)
-		);
-	`
-
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatal(err)
-	}
 }
 
 
@@ -136,106 +151,69 @@ func PlaceOrderHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Println("Error reading request body:", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Bad Request"))
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
 		return
 	}
 
 	err = json.Unmarshal(body, &orderRequest)
 	if err != nil {
 		log.Println("Error decoding JSON:", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid JSON format"))
+		handlers.WriteInvalidJSON(w)
 		return
 	}
 
-	if err := validateOrderRequest(orderRequest); err != nil {
-		log.Println("Validation error:", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Validation error: " + err.Error()))
+	// Orders are always placed for the authenticated customer
+	orderRequest.CustomerID = getCustomerID(r)
+	orderRequest.Products = normalizeOrderLines(orderRequest.Products)
+
+	if err := validateOrderRequest(r.Context(), &orderRequest); err != nil {
+		if isOrderValidationError(err) {
+			handlers.WriteValidationError(w, err)
+			return
+		}
+		log.Println("Error validating order:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
 
 	// Create a new order in the database
-	orderID, err := createOrder(orderRequest)
-	if err != nil {
-		log.Println("Error creating order:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Internal Server Error"))
+	orderID, err := placeOrder(r.Context(), orderRequest)
+	if errors.Is(err, errInsufficientStock) || err == errReservationNotFound {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err == errReservationMismatch || err == errShippingAddressNotFound || err == errBillingAddressNotFound ||
+		err == errUnknownShippingMethod || err == errNoShippingOptions || errors.Is(err, errInvalidCoupon) ||
+		errors.Is(err, errInvalidPoints) {
+		handlers.WriteValidationError(w, err)
 		return
 	}
-
-	// Associate the ordered products with the order
-	err = associateProducts(orderID, orderRequest.Products)
 	if err != nil {
-		log.Println("Error associating products with order:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Internal Server Error"))
+		log.Println("Error creating order:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
 
-	// Generate CSV report
-	err = GenerateCSVReport(orderID, orderRequest.CustomerID)
-	if err != nil {
-		log.Println("Error generating CSV report:", err)
+	if orderRequest.Payment != nil {
+		writePlacedOrder(w, r, orderID, orderRequest.Payment)
+		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("Order placed successfully"))
 }
 
-func GenerateCSVReport(orderID, customerID int) error {
-  // Query order details for the CSV report
-	order, err := getOrderDetails(orderID, customerID)
-	if err != nil {
-		return err
-	}
-
-	// Open a new CSV file for writing
-	file, err := os.Create("order_report.csv")
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	// Create a CSV writer
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	// Write header
-	header := []string{"Order ID", "Customer ID", "Date", "Status", "Product ID", "Product Name", "Price", "Quantity"}
-	if err := writer.Write(header); err != nil {
-		return err
-	}
-
-	// Write order details
-	for _, product := range order.Products {
-		row := []string{
-			strconv.Itoa(order.ID),
-			strconv.Itoa(order.CustomerID),
-			order.Date.Format("2006-01-02 15:04:05"),
-			order.Status,
-			strconv.Itoa(product.ID),
-			product.Name,
-			strconv.FormatFloat(product.Price, 'f', 2, 64),
-			strconv.Itoa(product.Quantity),
-		}
-		if err := writer.Write(row); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func getOrderDetails(orderID, customerID int) (*OrderWithProducts, error) {
+func getOrderDetails(ctx context.Context, orderID, customerID int) (*OrderWithProducts, error) {
   // Query order details with products
-	rows, err := db.Query(`
+	rows, err := db.QueryContext(ctx, `
 		SELECT o.id as order_id, o.customer_id, o.date, o.status,
-			   p.id as product_id, p.name as product_name, p.price, op.quantity
+			   COALESCE(o.subtotal, 0), o.discount, COALESCE(o.coupon_code, ''), COALESCE(o.tax, 0), COALESCE(o.shipping, 0), COALESCE(o.total, 0), COALESCE(o.shipping_method, ''),
+			   p.id as product_id, p.name as product_name, COALESCE(op.unit_price_at_purchase, v.price, p.price), op.quantity,
+			   COALESCE(op.note, ''), op.gift_wrap, COALESCE(op.gift_message, '')
 		FROM orders o
 		JOIN order_products op ON o.id = op.order_id
 		JOIN products p ON op.product_id = p.id
+		LEFT JOIN product_variants v ON op.variant_id = v.id
 		WHERE o.id = $1 AND o.customer_id = $2
 	`, orderID, customerID)
 	if err != nil {
@@ -252,11 +230,26 @@ func getOrderDetails(orderID, customerID int) (*OrderWithProducts, error) {
 	for rows.Next() {
 		var product Product
 		if err := rows.Scan(&order.ID, &order.CustomerID, &order.Date, &order.Status,
-			&product.ID, &product.Name, &product.Price, &product.Quantity); err != nil {
+			&order.Subtotal, &order.Discount, &order.CouponCode, &order.Tax, &order.Shipping, &order.Total, &order.ShippingMethod,
+			&product.ID, &product.Name, &product.Price, &product.Quantity,
+			&product.Note, &product.GiftWrap, &product.GiftMessage); err != nil {
 			return nil, err
 		}
 		order.Products = append(order.Products, product)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := addOrderAddresses(ctx, map[int]*OrderWithProducts{orderID: order}); err != nil {
+		return nil, err
+	}
+	if err := addOrderDelivery(ctx, map[int]*OrderWithProducts{orderID: order}); err != nil {
+		return nil, err
+	}
+	if err := addOrderDiscounts(ctx, map[int]*OrderWithProducts{orderID: order}); err != nil {
+		return nil, err
+	}
 
 	return order, nil
 }
@@ -264,146 +257,94 @@ func getOrderDetails(orderID, customerID int) (*OrderWithProducts, error) {
 
 
 // CUSTOMER VIEW ORDERS
+// CustomerOrdersHandler returns one page of the customer's orders with product details,
+// filtered and sorted like /admin/orders
 func CustomerOrdersHandler(w http.ResponseWriter, r *http.Request) {
-    // Retrieve customer orders with product details
-  	customerID := getCustomerID(r)
-  	orders, err := getCustomerOrdersWithProducts(customerID)
-  	if err != nil {
-  		log.Println("Error retrieving customer orders:", err)
-  		w.WriteHeader(http.StatusInternalServerError)
-  		w.Write([]byte("Internal Server Error"))
-  		return
-  	}
-
-  	// Convert orders to JSON
-  	response, err := json.Marshal(orders)
-  	if err != nil {
-  		log.Println("Error encoding customer orders to JSON:", err)
-  		w.WriteHeader(http.StatusInternalServerError)
-  		w.Write([]byte("Internal Server Error"))
-  		return
-  	}
-
-  	// Respond with the list of customer orders
-  	w.Header().Set("Content-Type", "application/json")
-  	w.WriteHeader(http.StatusOK)
-  	w.Write(response)
+	filter, err := parseOrderFilter(r.URL.Query())
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	customerID := getCustomerID(r)
+	filter.CustomerID = &customerID
+	filter.CustomerEmail = ""
+
+	orderIDs, total, err := searchOrders(r.Context(), filter)
+	var orders []OrderWithProducts
+	if err == nil {
+		orders, err = getOrdersWithProducts(r.Context(), orderIDs)
+	}
+	if err != nil {
+		log.Println("Error retrieving customer orders:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	setPageLinks(w, r, filter.Page, filter.Limit, total)
+	writeListJSON(w, OrderPage{
+		Orders: orders,
+		Page:   filter.Page,
+		Limit:  filter.Limit,
+		Total:  total,
+	}, "orders", filter.Fields)
 }
 
 func getCustomerID(r *http.Request) int {
-  // Assume a custom header 'X-Customer-ID' in the request.
-	customerIDHeader := r.Header.Get("X-Customer-ID")
-
-	// Parse the customer ID from the header
-	customerID, err := strconv.Atoi(customerIDHeader)
-	if err != nil {
-		// Handle the error or return a default value
+	// The customer ID comes from the verified token claims set by AuthMiddleware
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
 		return 0
 	}
 
-	return customerID
+	return claims.CustomerID
 }
 
-func getCustomerOrdersWithProducts(customerID int) ([]OrderWithProducts, error) {
-  // Query customer orders with product details
-	rows, err := db.Query(`
-		SELECT o.id as order_id, o.date, o.status,
-			   p.id as product_id, p.name as product_name, p.price, p.description, p.image_url
-		FROM orders o
-		JOIN order_products op ON o.id = op.order_id
-		JOIN products p ON op.product_id = p.id
-		WHERE o.customer_id = $1
-	`, customerID)
+// ADMIN VIEW ALL ORDERS
+func AdminOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseOrderFilter(r.URL.Query())
 	if err != nil {
-		return nil, err
+		handlers.WriteValidationError(w, err)
+		return
 	}
-	defer rows.Close()
-
-	orders := make(map[int]*OrderWithProducts)
-	for rows.Next() {
-		var orderID int
-		var orderDate time.Time
-		var orderStatus, productName, productDescription, imageURL string
-		var productID int
-		var productPrice float64
 
-		if err := rows.Scan(&orderID, &orderDate, &orderStatus,
-			&productID, &productName, &productPrice, &productDescription, &imageURL); err != nil {
-			return nil, err
-		}
-
-		if order, ok := orders[orderID]; ok {
-			// Order already exists, add product to it
-			order.Products = append(order.Products, Product{
-				ID:          productID,
-				Name:        productName,
-				Price:       productPrice,
-				Description: productDescription,
-				ImageURL:    imageURL,
-			})
-		} else {
-			// Create a new order and add the product
-			orders[orderID] = &OrderWithProducts{
-				ID:      orderID,
-				Date:    orderDate,
-				Status:  orderStatus,
-				Products: []Product{{
-					ID:          productID,
-					Name:        productName,
-					Price:       productPrice,
-					Description: productDescription,
-					ImageURL:    imageURL,
-				}},
-			}
-		}
+	// Retrieve one page of matching orders with product details
+	orderIDs, total, err := searchOrders(r.Context(), filter)
+	var orders []OrderWithProducts
+	if err == nil {
+		orders, err = getOrdersWithProducts(r.Context(), orderIDs)
 	}
-
-	// Convert map to slice
-	var result []OrderWithProducts
-	for _, order := range orders {
-		result = append(result, *order)
+	if err != nil {
+		log.Println("Error retrieving orders:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
 	}
 
-	return result, nil
+	setPageLinks(w, r, filter.Page, filter.Limit, total)
+	writeListJSON(w, OrderPage{
+		Orders: orders,
+		Page:   filter.Page,
+		Limit:  filter.Limit,
+		Total:  total,
+	}, "orders", filter.Fields)
 }
 
-
-
-// ADMIN VIEW ALL ORDERS
-func AdminOrdersHandler(w http.ResponseWriter, r *http.Request) {
-  // Retrieve all orders with product details
-  	orders, err := getAllOrdersWithProducts()
-  	if err != nil {
-  		log.Println("Error retrieving orders:", err)
-  		w.WriteHeader(http.StatusInternalServerError)
-  		w.Write([]byte("Internal Server Error"))
-  		return
-  	}
-
-  	// Convert orders to JSON
-  	response, err := json.Marshal(orders)
-  	if err != nil {
-  		log.Println("Error encoding orders to JSON:", err)
-  		w.WriteHeader(http.StatusInternalServerError)
-  		w.Write([]byte("Internal Server Error"))
-  		return
-  	}
-
-  	// Respond with the list of orders
-  	w.Header().Set("Content-Type", "application/json")
-  	w.WriteHeader(http.StatusOK)
-  	w.Write(response)
-}
-
-func getAllOrdersWithProducts() ([]OrderWithProducts, error) {
-	// Query all orders with product details
-	rows, err := db.Query(`
+// getOrdersWithProducts returns the orders with product details, in the order of orderIDs
+func getOrdersWithProducts(ctx context.Context, orderIDs []int) ([]OrderWithProducts, error) {
+	// Query the orders with product details
+	rows, err := db.QueryContext(ctx, `
 		SELECT o.id as order_id, o.customer_id, o.date, o.status,
-			   p.id as product_id, p.name as product_name, p.price, p.description, p.image_url
+			   COALESCE(o.subtotal, 0), o.discount, COALESCE(o.coupon_code, ''), COALESCE(o.tax, 0), COALESCE(o.shipping, 0), COALESCE(o.total, 0), COALESCE(o.shipping_method, ''),
+			   p.id as product_id, p.name as product_name, p.price, COALESCE(p.description, ''), COALESCE(p.image_url, ''),
+			   v.id, v.sku, v.options, v.price,
+			   op.quantity, COALESCE(op.unit_price_at_purchase, v.price, p.price),
+			   COALESCE(op.note, ''), op.gift_wrap, COALESCE(op.gift_message, '')
 		FROM orders o
 		JOIN order_products op ON o.id = op.order_id
 		JOIN products p ON op.product_id = p.id
-	`)
+		LEFT JOIN product_variants v ON op.variant_id = v.id
+		WHERE o.id = ANY($1)
+		ORDER BY op.product_id, op.variant_id NULLS FIRST
+	`, pq.Array(orderIDs))
 	if err != nil {
 		return nil, err
 	}
@@ -416,43 +357,74 @@ func getAllOrdersWithProducts() ([]OrderWithProducts, error) {
 		var orderStatus, productName, productDescription, imageURL string
 		var productID int
 		var productPrice float64
+		var variant orderLineVariant
+		var quantity int
+		var unitPrice float64
+		var note, giftMessage string
+		var giftWrap bool
+		var totals OrderTotals
 
 		if err := rows.Scan(&orderID, &customerID, &orderDate, &orderStatus,
-			&productID, &productName, &productPrice, &productDescription, &imageURL); err != nil {
+			&totals.Subtotal, &totals.Discount, &totals.CouponCode, &totals.Tax, &totals.Shipping, &totals.Total, &totals.ShippingMethod,
+			&productID, &productName, &productPrice, &productDescription, &imageURL,
+			&variant.ID, &variant.SKU, &variant.Options, &variant.Price,
+			&quantity, &unitPrice,
+			&note, &giftWrap, &giftMessage); err != nil {
 			return nil, err
 		}
 
+		product := Product{
+			ID:          productID,
+			Name:        productName,
+			Price:       productPrice,
+			Description: productDescription,
+			ImageURL:    imageURL,
+			Note:        note,
+			GiftWrap:    giftWrap,
+			GiftMessage: giftMessage,
+		}
+		if err := variant.applyTo(&product); err != nil {
+			return nil, err
+		}
+		product.Quantity = quantity
+		product.Price = unitPrice
+
 		if order, ok := orders[orderID]; ok {
 			// Order already exists, add product to it
-			order.Products = append(order.Products, Product{
-				ID:          productID,
-				Name:        productName,
-				Price:       productPrice,
-				Description: productDescription,
-				ImageURL:    imageURL,
-			})
+			order.Products = append(order.Products, product)
 		} else {
 			// Create a new order and add the product
 			orders[orderID] = &OrderWithProducts{
-				ID:        orderID,
-				CustomerID: customerID,
-				Date:      orderDate,
-				Status:    orderStatus,
-				Products: []Product{{
-					ID:          productID,
-					Name:        productName,
-					Price:       productPrice,
-					Description: productDescription,
-					ImageURL:    imageURL,
-				}},
+				ID:          orderID,
+				CustomerID:  customerID,
+				Date:        orderDate,
+				Status:      orderStatus,
+				Products:    []Product{product},
+				OrderTotals: totals,
 			}
 		}
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := addOrderAddresses(ctx, orders); err != nil {
+		return nil, err
+	}
+	if err := addOrderDelivery(ctx, orders); err != nil {
+		return nil, err
+	}
+	if err := addOrderDiscounts(ctx, orders); err != nil {
+		return nil, err
+	}
+
 	// Convert map to slice
-	var result []OrderWithProducts
-	for _, order := range orders {
-		result = append(result, *order)
+	result := make([]OrderWithProducts, 0, len(orderIDs))
+	for _, orderID := range orderIDs {
+		if order, ok := orders[orderID]; ok {
+			result = append(result, *order)
+		}
 	}
 
 	return result, nil
@@ -464,38 +436,113 @@ type OrderWithProducts struct {
 	Date       time.Time `json:"date"`
 	Status     string    `json:"status"`
 	Products   []Product `json:"products"`
+	OrderTotals
+	// ShippingAddress and BillingAddress are copied at placement; older orders have none
+	ShippingAddress *PostalAddress `json:"shipping_address,omitempty"`
+	BillingAddress  *PostalAddress `json:"billing_address,omitempty"`
+	// EstimatedDelivery is the delivery window promised when the order was placed
+	EstimatedDelivery *DeliveryEstimate `json:"estimated_delivery,omitempty"`
+	// PickupLocation is where a pickup order is collected
+	PickupLocation *PickupLocation `json:"pickup_location,omitempty"`
+}
+
+// OrderTotals are stored when the order is placed, so later price and rate changes don't alter them
+type OrderTotals struct {
+	Subtotal float64 `json:"subtotal"`
+	// Discount is taken off the subtotal by the order's promotions, coupon, first-order discount
+	// and loyalty points, before tax
+	Discount       float64 `json:"discount"`
+	CouponCode     string  `json:"coupon_code,omitempty"`
+	Tax            float64 `json:"tax"`
+	Shipping       float64 `json:"shipping"`
+	Total          float64 `json:"total"`
+	ShippingMethod string  `json:"shipping_method,omitempty"`
+	// Discounts break Discount down in the order the discounts were applied
+	Discounts []AppliedDiscount `json:"discounts,omitempty"`
 }
 
 type Product struct {
 	ID          int     `json:"product_id"`
+	SKU         string  `json:"sku,omitempty"`
 	Name        string  `json:"product_name"`
 	Price       float64 `json:"price"`
 	Description string  `json:"description"`
 	ImageURL    string  `json:"image_url"`
+	CategoryID  *int    `json:"category_id,omitempty"`
+	// Stock is only included in admin responses
+	Stock *int `json:"stock,omitempty"`
+	// Weight (kg) and Length, Width and Height (cm) are only included in admin responses
+	Weight *float64 `json:"weight,omitempty"`
+	Length *float64 `json:"length,omitempty"`
+	Width  *float64 `json:"width,omitempty"`
+	Height *float64 `json:"height,omitempty"`
+	// RestrictedCountries are the country codes the product can't ship to, only included in
+	// admin responses
+	RestrictedCountries []string `json:"restricted_countries,omitempty"`
+	// GiftCard marks a product that issues a gift card for each unit bought
+	GiftCard bool `json:"gift_card,omitempty"`
+	// RegularPrice is the usual price of a product on a flash sale, where Price is the sale's
+	RegularPrice *float64 `json:"regular_price,omitempty"`
+	// Variant is the ordered variant on order lines
+	Variant *ProductVariant `json:"variant,omitempty"`
+	// Quantity is the number of units on order lines, where Price is the price paid per unit
+	Quantity int `json:"quantity,omitempty"`
+	// Note, GiftWrap and GiftMessage are the customer's options on admin order lines
+	Note        string `json:"note,omitempty"`
+	GiftWrap    bool   `json:"gift_wrap,omitempty"`
+	GiftMessage string `json:"gift_message,omitempty"`
+	// Variants lists every variant in product detail responses
+	Variants []ProductVariant `json:"variants,omitempty"`
+	// Images lists every uploaded image in product detail responses
+	Images []ProductImage `json:"images,omitempty"`
+	// Warehouses lists the stock per warehouse in admin product responses
+	Warehouses []WarehouseStock `json:"warehouses,omitempty"`
 }
 
 
 
 // BACKGROUND TASK
-func BackgroundTask() {
+// BackgroundTask runs the minutely jobs, such as price schedules, reservations and queued
+// emails, and the daily reminders and alerts until ctx is done, finishing the pass it is in
+func BackgroundTask(ctx context.Context) {
+	// A pass isn't cut short by shutdown, so its queries don't stop when ctx is done
+	passCtx := context.WithoutCancel(ctx)
+	nextReminder := time.Now()
 	for {
-		if taskLimiter.Allow("background-task") {
-			SendPendingOrderReminders()
-
-			// Sleep for the remaining time until the next day
+		applyDuePriceSchedules(passCtx)
+		releaseExpiredReservations(passCtx)
+		pruneAvailabilityCache()
+		retryFailedPayments(passCtx)
+		pollShipmentTracking(passCtx)
+		deliverGiftCards(passCtx)
+		notifyReferralRewards(passCtx)
+		sendReportSubscriptions(passCtx)
+		sendQueuedEmails(passCtx)
+		deliverWebhooks(passCtx)
+
+		if !time.Now().Before(nextReminder) && taskLimiter.Allow("background-task") {
+			SendPendingOrderReminders(passCtx)
+			SendLowStockAlerts(passCtx)
+			deleteStaleCarts(passCtx)
+			refreshRelatedProducts(passCtx)
+			deleteSentEmails(passCtx)
+			SendSalesDigest(passCtx)
+
+			// Wait until the next day for the next reminders
 			now := time.Now()
-			nextMidnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
-			timeUntilMidnight := nextMidnight.Sub(now)
-			time.Sleep(timeUntilMidnight)
-		} else {
-			// If the rate limit is exceeded, sleep for a shorter time before trying again
-			time.Sleep(1 * time.Hour)
+			nextReminder = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(priceScheduleInterval):
 		}
 	}
 }
 
-func SendPendingOrderReminders() {
-	rows, err := db.Query("SELECT id, customer_email FROM orders WHERE status = 'Pending'")
+func SendPendingOrderReminders(ctx context.Context) {
+	rows, err := db.QueryContext(ctx, "SELECT id, customer_email FROM orders WHERE status = 'Pending'")
 	if err != nil {
 		log.Println("Error querying pending orders:", err)
 		return
@@ -512,18 +559,14 @@ func SendPendingOrderReminders() {
 		}
 
 		// Send email using SMTP
-		SendEmailReminder(customerEmail, orderID)
+		SendEmailReminder(ctx, customerEmail, orderID)
 	}
 }
 
-func SendEmailReminder(to string, orderID int) {
-	subject := "Pending Order Reminder"
-	body := fmt.Sprintf("Dear customer, your order (ID: %d) is pending. Please complete your checkout process.", orderID)
-
-	message := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s", to, subject, body)
-
-	auth := smtp.PlainAuth("", smtpConfig.SMTPUsername, smtpConfig.SMTPPassword, smtpConfig.SMTPServer)
-	err := smtp.SendMail(fmt.Sprintf("%s:%d", smtpConfig.SMTPServer, smtpConfig.SMTPPort), auth, smtpConfig.SMTPUsername, []string{to}, []byte(message))
+func SendEmailReminder(ctx context.Context, to string, orderID int) {
+	// One reminder a day
+	key := fmt.Sprintf("order_reminder:%d:%s", orderID, time.Now().Format("2006-01-02"))
+	err := sendEmail(ctx, to, emailOrderReminder, key, orderEmail{OrderID: orderID})
 	if err != nil {
 		log.Printf("Error sending email to %s for order %d: %v", to, orderID, err)
 	}
@@ -531,31 +574,68 @@ func SendEmailReminder(to string, orderID int) {
 
 
 
+
 // AUTH & LIMITER
-func AuthMiddleware(next http.HandlerFunc, role string) http.HandlerFunc {
+// AuthMiddleware authenticates the bearer token and checks that the
+// customer's role grants the required permission
+func AuthMiddleware(next http.HandlerFunc, permission string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Authorization")
-
-		switch role {
-		case "customer":
-			if token != customerToken {
-				w.WriteHeader(http.StatusUnauthorized)
-				w.Write([]byte("Unauthorized"))
+		// Integrations authenticate with an API key instead of a customer token
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			allowed, err := apiKeyHasScope(r.Context(), apiKey, permission)
+			if err != nil {
+				log.Println("Error checking API key:", err)
+				handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
 				return
 			}
-		case "admin":
-			if token != adminToken {
-				w.WriteHeader(http.StatusUnauthorized)
-				w.Write([]byte("Unauthorized"))
+			if !allowed {
+				handlers.WriteError(w, http.StatusUnauthorized, "Unauthorized")
 				return
 			}
-		default:
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Internal Server Error"))
+
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		token := bearerToken(r)
+		if token == "" {
+			handlers.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		claims, err := ParseToken(token)
+		if err != nil {
+			log.Println("Invalid token:", err)
+			handlers.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		allowed, err := customerHasPermission(r.Context(), claims.CustomerID, permission)
+		if err != nil {
+			log.Println("Error checking permission:", err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		if !allowed {
+			handlers.WriteError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// OptionalAuthMiddleware lets anonymous requests through as guests, and checks credentials
+// like AuthMiddleware when the request carries them
+func OptionalAuthMiddleware(next http.HandlerFunc, permission string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") == "" && bearerToken(r) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		AuthMiddleware(next, permission)(w, r)
 	}
 }
 
@@ -563,8 +643,7 @@ func AuthMiddleware(next http.HandlerFunc, role string) http.HandlerFunc {
 func RateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !rateLimiter.Allow(r.RemoteAddr) {
-			w.WriteHeader(http.StatusTooManyRequests)
-			w.Write([]byte("Rate limit exceeded"))
+			handlers.WriteError(w, http.StatusTooManyRequests, "Rate limit exceeded")
 			return
 		}
 
@@ -576,3 +655,4 @@ func RateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
 func NewRateLimiter(limit int, window time.Duration) *rate.Limiter {
 	return rate.NewLimiter(rate.Limit(limit), int(window.Seconds()))
 }
+
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Migrations live in migrations as numbered pairs of files, 0005_name.up.sql and
+// 0005_name.down.sql. Up migrations are applied in order and recorded in schema_migrations;
+// a migration that has been released is never edited, a new one changes it.
+//
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// Migration settings, loaded from environment variables by loadMigrationConfig
+var migrationConfig = struct {
+	// AutoMigrate applies pending migrations at startup; without it they are applied by the
+	// migrate command
+	AutoMigrate bool
+}{
+	AutoMigrate: true,
+}
+
+// migrationLockID is the Postgres advisory lock held while migrating, so instances starting at
+// the same time don't apply a migration twice
+const migrationLockID = 72710413
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migration is a schema change and the SQL that reverts it
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	Version   int
+	Name      string
+	AppliedAt string
+}
+
+func loadMigrationConfig() {
+	if v := os.Getenv("AUTO_MIGRATE"); v != "" {
+		autoMigrate, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid AUTO_MIGRATE %q", v)
+		}
+		migrationConfig.AutoMigrate = autoMigrate
+	}
+}
+
+// loadMigrations reads the embedded migrations in version order. Every migration needs both an
+// up and a down file.
+func loadMigrations() ([]migration, error) {
+	files, err := migrationFS.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, file := range files {
+		match := migrationFilePattern.FindStringSubmatch(file.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file %s isn't named like 0001_name.up.sql", file.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		sqlText, err := migrationFS.ReadFile(path.Join("migrations", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(sqlText)
+		} else {
+			m.Down = string(sqlText)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// withMigrationLock runs fn on a connection holding the migration lock, after making sure
+// schema_migrations exists. Migrations and waiting for the lock aren't held to the query timeout.
+func withMigrationLock(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SET statement_timeout = 0"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "RESET statement_timeout")
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+func getAppliedMigrations(conn *sql.Conn) ([]appliedMigration, error) {
+	rows, err := conn.QueryContext(context.Background(), `
+		SELECT version, name, TO_CHAR(applied_at, 'YYYY-MM-DD"T"HH24:MI:SSOF')
+		FROM schema_migrations
+		ORDER BY version
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []appliedMigration
+	for rows.Next() {
+		var m appliedMigration
+		if err := rows.Scan(&m.Version, &m.Name, &m.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, m)
+	}
+	return applied, rows.Err()
+}
+
+// runMigration runs a migration's SQL and records it in one transaction, so a failed migration
+// leaves neither the schema change nor the record behind
+func runMigration(conn *sql.Conn, m migration, up bool) error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if up {
+		_, err = tx.ExecContext(ctx, m.Up)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+		}
+	} else {
+		_, err = tx.ExecContext(ctx, m.Down)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+	}
+
+	return tx.Commit()
+}
+
+// migrateUp applies the migrations that haven't been applied yet, in order
+func migrateUp() error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := getAppliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		done := map[int]bool{}
+		for _, m := range applied {
+			done[m.Version] = true
+		}
+
+		for _, m := range migrations {
+			if done[m.Version] {
+				continue
+			}
+			if err := runMigration(conn, m, true); err != nil {
+				return err
+			}
+			log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+		}
+		return nil
+	})
+}
+
+// migrateDown reverts the last steps applied migrations, newest first
+func migrateDown(steps int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	byVersion := map[int]migration{}
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+
+	return withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := getAppliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(applied) - 1; i >= 0 && steps > 0; i, steps = i-1, steps-1 {
+			m, ok := byVersion[applied[i].Version]
+			if !ok {
+				return fmt.Errorf("migration %04d_%s is applied but this build doesn't have it", applied[i].Version, applied[i].Name)
+			}
+			if err := runMigration(conn, m, false); err != nil {
+				return err
+			}
+			log.Printf("Reverted migration %04d_%s", m.Version, m.Name)
+		}
+		return nil
+	})
+}
+
+// printMigrationStatus lists every migration with when it was applied, or pending
+func printMigrationStatus() error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := getAppliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		appliedAt := map[int]string{}
+		for _, m := range applied {
+			appliedAt[m.Version] = m.AppliedAt
+		}
+
+		for _, m := range migrations {
+			status, ok := appliedAt[m.Version]
+			if !ok {
+				status = "pending"
+			}
+			fmt.Printf("%04d_%s\t%s\n", m.Version, m.Name, status)
+		}
+		return nil
+	})
+}
+
+// runMigrateCommand runs `migrate up`, `migrate down [steps]` or `migrate status`. down reverts
+// one migration unless given the number to revert.
+func runMigrateCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: migrate up | down [steps] | status")
+	}
+
+	var err error
+	switch args[0] {
+	case "up":
+		err = migrateUp()
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("Invalid number of steps %q", args[1])
+			}
+		}
+		err = migrateDown(steps)
+	case "status":
+		err = printMigrationStatus()
+	default:
+		log.Fatalf("Unknown migrate command %q", args[0])
+	}
+	if err != nil {
+		log.Fatal("Error migrating: ", err)
+	}
+}
@@ -0,0 +1,803 @@
+-- The schema as it was before migrations. It only creates what is missing, so databases that
+-- initDB set up adopt it unchanged. Later schema changes go in new migrations, not here.
+
+CREATE TABLE IF NOT EXISTS products (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	price DECIMAL NOT NULL,
+	description TEXT,
+	image_url VARCHAR(255)
+);
+
+CREATE TABLE IF NOT EXISTS customers (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	email VARCHAR(255) NOT NULL,
+	password VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS orders (
+	id SERIAL PRIMARY KEY,
+	customer_id INT NOT NULL,
+	date TIMESTAMP NOT NULL,
+	status VARCHAR(50) NOT NULL,
+	FOREIGN KEY (customer_id) REFERENCES customers(id)
+);
+
+CREATE TABLE IF NOT EXISTS order_products (
+	order_id INT NOT NULL,
+	product_id INT NOT NULL,
+	PRIMARY KEY (order_id, product_id),
+	FOREIGN KEY (order_id) REFERENCES orders(id),
+	FOREIGN KEY (product_id) REFERENCES products(id)
+);
+
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS role VARCHAR(50) NOT NULL DEFAULT 'customer';
+CREATE UNIQUE INDEX IF NOT EXISTS customers_email_key ON customers (email);
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS google_id VARCHAR(255) UNIQUE;
+
+CREATE TABLE IF NOT EXISTS password_resets (
+	id SERIAL PRIMARY KEY,
+	customer_id INT NOT NULL,
+	token_hash VARCHAR(64) NOT NULL UNIQUE,
+	expires_at TIMESTAMP NOT NULL,
+	used_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	FOREIGN KEY (customer_id) REFERENCES customers(id)
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(50) NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(100) NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+	role_id INT NOT NULL,
+	permission_id INT NOT NULL,
+	PRIMARY KEY (role_id, permission_id),
+	FOREIGN KEY (role_id) REFERENCES roles(id),
+	FOREIGN KEY (permission_id) REFERENCES permissions(id)
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	key_hash VARCHAR(64) NOT NULL UNIQUE,
+	prefix VARCHAR(20) NOT NULL,
+	scopes TEXT[] NOT NULL,
+	created_by INT,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	last_used_at TIMESTAMP,
+	revoked_at TIMESTAMP,
+	FOREIGN KEY (created_by) REFERENCES customers(id)
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id SERIAL PRIMARY KEY,
+	customer_id INT NOT NULL,
+	token_hash VARCHAR(64) NOT NULL UNIQUE,
+	family VARCHAR(32) NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	revoked_at TIMESTAMP,
+	replaced_by INT,
+	FOREIGN KEY (customer_id) REFERENCES customers(id),
+	FOREIGN KEY (replaced_by) REFERENCES refresh_tokens(id)
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens (family);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+	id SERIAL PRIMARY KEY,
+	email VARCHAR(255) NOT NULL,
+	ip VARCHAR(64) NOT NULL,
+	attempted_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS login_attempts_email_idx ON login_attempts (email, attempted_at);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts (ip, attempted_at);
+
+CREATE TABLE IF NOT EXISTS categories (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	parent_id INT,
+	FOREIGN KEY (parent_id) REFERENCES categories(id)
+);
+ALTER TABLE products ADD COLUMN IF NOT EXISTS category_id INT REFERENCES categories(id);
+CREATE INDEX IF NOT EXISTS products_category_idx ON products (category_id);
+-- SKU identifies a product in CSV imports; NULLs don't collide, so it stays optional
+ALTER TABLE products ADD COLUMN IF NOT EXISTS sku VARCHAR(100) UNIQUE;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS stock INT NOT NULL DEFAULT 0 CHECK (stock >= 0);
+ALTER TABLE products ADD COLUMN IF NOT EXISTS weight DECIMAL CHECK (weight >= 0);
+ALTER TABLE products ADD COLUMN IF NOT EXISTS length DECIMAL CHECK (length >= 0);
+ALTER TABLE products ADD COLUMN IF NOT EXISTS width DECIMAL CHECK (width >= 0);
+ALTER TABLE products ADD COLUMN IF NOT EXISTS height DECIMAL CHECK (height >= 0);
+
+CREATE TABLE IF NOT EXISTS product_variants (
+	id SERIAL PRIMARY KEY,
+	product_id INT NOT NULL,
+	sku VARCHAR(100) NOT NULL UNIQUE,
+	options JSONB NOT NULL DEFAULT '{}',
+	price DECIMAL NOT NULL,
+	FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+ALTER TABLE order_products ADD COLUMN IF NOT EXISTS variant_id INT REFERENCES product_variants(id);
+-- Several variants of one product can be on the same order, so the line key includes the variant
+ALTER TABLE order_products DROP CONSTRAINT IF EXISTS order_products_pkey;
+CREATE UNIQUE INDEX IF NOT EXISTS order_products_line_key ON order_products (order_id, product_id, COALESCE(variant_id, 0));
+
+CREATE TABLE IF NOT EXISTS product_images (
+	id SERIAL PRIMARY KEY,
+	product_id INT NOT NULL,
+	url VARCHAR(1024) NOT NULL,
+	object_key VARCHAR(255) NOT NULL,
+	position INT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS price_schedules (
+	id SERIAL PRIMARY KEY,
+	product_id INT NOT NULL,
+	price DECIMAL NOT NULL,
+	effective_at TIMESTAMPTZ NOT NULL,
+	applied_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS price_schedules_due_idx ON price_schedules (effective_at) WHERE applied_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS product_price_history (
+	id SERIAL PRIMARY KEY,
+	product_id INT NOT NULL,
+	old_price DECIMAL,
+	new_price DECIMAL NOT NULL,
+	changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS product_price_history_product_idx ON product_price_history (product_id, changed_at);
+
+CREATE TABLE IF NOT EXISTS stock_reservations (
+	id SERIAL PRIMARY KEY,
+	token_hash VARCHAR(64) NOT NULL,
+	customer_id INT NOT NULL,
+	product_id INT NOT NULL,
+	quantity INT NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	FOREIGN KEY (customer_id) REFERENCES customers(id),
+	FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS stock_reservations_token_idx ON stock_reservations (token_hash);
+CREATE INDEX IF NOT EXISTS stock_reservations_expires_idx ON stock_reservations (expires_at);
+
+CREATE TABLE IF NOT EXISTS warehouses (
+	id SERIAL PRIMARY KEY,
+	code VARCHAR(50) NOT NULL UNIQUE,
+	name VARCHAR(255) NOT NULL,
+	priority INT NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS warehouse_stock (
+	product_id INT NOT NULL,
+	warehouse_id INT NOT NULL,
+	quantity INT NOT NULL CHECK (quantity >= 0),
+	PRIMARY KEY (product_id, warehouse_id),
+	FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+	FOREIGN KEY (warehouse_id) REFERENCES warehouses(id)
+);
+CREATE TABLE IF NOT EXISTS order_allocations (
+	id SERIAL PRIMARY KEY,
+	order_id INT NOT NULL,
+	product_id INT NOT NULL,
+	warehouse_id INT NOT NULL,
+	quantity INT NOT NULL,
+	FOREIGN KEY (order_id) REFERENCES orders(id),
+	FOREIGN KEY (product_id) REFERENCES products(id),
+	FOREIGN KEY (warehouse_id) REFERENCES warehouses(id)
+);
+CREATE INDEX IF NOT EXISTS order_allocations_order_idx ON order_allocations (order_id);
+
+CREATE TABLE IF NOT EXISTS stock_movements (
+	id SERIAL PRIMARY KEY,
+	product_id INT NOT NULL,
+	change INT NOT NULL,
+	stock_after INT NOT NULL,
+	reason VARCHAR(50) NOT NULL,
+	order_id INT,
+	note VARCHAR(255),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+	FOREIGN KEY (order_id) REFERENCES orders(id)
+);
+CREATE INDEX IF NOT EXISTS stock_movements_product_idx ON stock_movements (product_id, created_at);
+CREATE INDEX IF NOT EXISTS stock_movements_created_idx ON stock_movements (created_at);
+
+ALTER TABLE order_products ADD COLUMN IF NOT EXISTS quantity INT NOT NULL DEFAULT 1;
+ALTER TABLE order_products ADD COLUMN IF NOT EXISTS note TEXT;
+ALTER TABLE order_products ADD COLUMN IF NOT EXISTS gift_wrap BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE order_products ADD COLUMN IF NOT EXISTS gift_message TEXT;
+ALTER TABLE order_products ADD COLUMN IF NOT EXISTS unit_price_at_purchase DECIMAL;
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS subtotal DECIMAL;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS tax DECIMAL;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipping DECIMAL;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS total DECIMAL;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipping_method VARCHAR(50);
+UPDATE orders o
+SET subtotal = lines.subtotal, tax = 0, shipping = 0, total = lines.subtotal
+FROM (
+	SELECT op.order_id, SUM(COALESCE(op.unit_price_at_purchase, v.price, p.price) * op.quantity) AS subtotal
+	FROM order_products op
+	JOIN products p ON op.product_id = p.id
+	LEFT JOIN product_variants v ON op.variant_id = v.id
+	GROUP BY op.order_id
+) lines
+WHERE o.id = lines.order_id AND o.subtotal IS NULL;
+
+CREATE TABLE IF NOT EXISTS carts (
+	id SERIAL PRIMARY KEY,
+	customer_id INT UNIQUE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	FOREIGN KEY (customer_id) REFERENCES customers(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS cart_items (
+	id SERIAL PRIMARY KEY,
+	cart_id INT NOT NULL,
+	product_id INT NOT NULL,
+	variant_id INT,
+	quantity INT NOT NULL CHECK (quantity > 0),
+	added_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	FOREIGN KEY (cart_id) REFERENCES carts(id) ON DELETE CASCADE,
+	FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+	FOREIGN KEY (variant_id) REFERENCES product_variants(id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS cart_items_line_key ON cart_items (cart_id, product_id, COALESCE(variant_id, 0));
+
+ALTER TABLE carts ADD COLUMN IF NOT EXISTS guest_token_hash VARCHAR(64) UNIQUE;
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS unit_price DECIMAL;
+
+ALTER TABLE carts ADD COLUMN IF NOT EXISTS name VARCHAR(100) NOT NULL DEFAULT 'Cart';
+ALTER TABLE carts ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE carts DROP CONSTRAINT IF EXISTS carts_customer_id_key;
+CREATE UNIQUE INDEX IF NOT EXISTS carts_active_customer_key ON carts (customer_id) WHERE active;
+
+CREATE TABLE IF NOT EXISTS wishlists (
+	id SERIAL PRIMARY KEY,
+	customer_id INT NOT NULL,
+	product_id INT NOT NULL,
+	variant_id INT,
+	quantity INT NOT NULL DEFAULT 1 CHECK (quantity > 0),
+	saved_price DECIMAL NOT NULL,
+	saved_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	FOREIGN KEY (customer_id) REFERENCES customers(id) ON DELETE CASCADE,
+	FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+	FOREIGN KEY (variant_id) REFERENCES product_variants(id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS wishlists_line_key ON wishlists (customer_id, product_id, COALESCE(variant_id, 0));
+
+CREATE TABLE IF NOT EXISTS tax_rates (
+	id SERIAL PRIMARY KEY,
+	country CHAR(2) NOT NULL,
+	region VARCHAR(100) NOT NULL DEFAULT '',
+	rate DECIMAL NOT NULL CHECK (rate >= 0 AND rate < 1),
+	UNIQUE (country, region)
+);
+
+CREATE TABLE IF NOT EXISTS related_products (
+	product_id INT NOT NULL,
+	related_product_id INT NOT NULL,
+	orders INT NOT NULL,
+	PRIMARY KEY (product_id, related_product_id),
+	FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+	FOREIGN KEY (related_product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS shipments (
+	id SERIAL PRIMARY KEY,
+	order_id INT NOT NULL,
+	tracking_number VARCHAR(100),
+	shipped_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	FOREIGN KEY (order_id) REFERENCES orders(id)
+);
+CREATE INDEX IF NOT EXISTS shipments_order_idx ON shipments (order_id);
+
+CREATE TABLE IF NOT EXISTS shipment_items (
+	shipment_id INT NOT NULL,
+	product_id INT NOT NULL,
+	variant_id INT,
+	quantity INT NOT NULL CHECK (quantity > 0),
+	FOREIGN KEY (shipment_id) REFERENCES shipments(id) ON DELETE CASCADE,
+	FOREIGN KEY (product_id) REFERENCES products(id),
+	FOREIGN KEY (variant_id) REFERENCES product_variants(id)
+);
+CREATE INDEX IF NOT EXISTS shipment_items_shipment_idx ON shipment_items (shipment_id);
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS tax_rate DECIMAL;
+UPDATE orders SET tax_rate = CASE WHEN subtotal > 0 THEN tax / subtotal ELSE 0 END
+WHERE tax_rate IS NULL AND subtotal IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS orders_customer_idx ON orders (customer_id);
+CREATE INDEX IF NOT EXISTS orders_date_idx ON orders (date);
+CREATE INDEX IF NOT EXISTS order_products_product_idx ON order_products (product_id);
+
+CREATE TABLE IF NOT EXISTS payments (
+	id SERIAL PRIMARY KEY,
+	order_id INT NOT NULL,
+	provider VARCHAR(20) NOT NULL,
+	-- reference is the provider's payment ID, capture_reference the ID of the captured funds
+	reference VARCHAR(255),
+	capture_reference VARCHAR(255),
+	amount DECIMAL NOT NULL,
+	currency CHAR(3) NOT NULL,
+	status VARCHAR(20) NOT NULL,
+	failure_reason TEXT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	FOREIGN KEY (order_id) REFERENCES orders(id)
+);
+CREATE INDEX IF NOT EXISTS payments_order_idx ON payments (order_id);
+CREATE INDEX IF NOT EXISTS payments_reference_idx ON payments (reference);
+CREATE INDEX IF NOT EXISTS payments_capture_reference_idx ON payments (capture_reference);
+-- source is the provider's payment method token the payment was charged to, kept for retries
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS source VARCHAR(255);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS customer_reference VARCHAR(255);
+
+CREATE TABLE IF NOT EXISTS payment_events (
+	provider VARCHAR(20) NOT NULL,
+	event_id VARCHAR(255) NOT NULL,
+	event_type VARCHAR(20),
+	received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (provider, event_id)
+);
+
+CREATE TABLE IF NOT EXISTS refunds (
+	id SERIAL PRIMARY KEY,
+	order_id INT NOT NULL,
+	payment_id INT NOT NULL,
+	amount DECIMAL NOT NULL CHECK (amount > 0),
+	reason TEXT,
+	-- reference is the provider's refund ID
+	reference VARCHAR(255),
+	status VARCHAR(20) NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	FOREIGN KEY (order_id) REFERENCES orders(id),
+	FOREIGN KEY (payment_id) REFERENCES payments(id)
+);
+CREATE INDEX IF NOT EXISTS refunds_payment_idx ON refunds (payment_id);
+
+CREATE TABLE IF NOT EXISTS payment_customers (
+	customer_id INT NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+	provider VARCHAR(20) NOT NULL,
+	-- reference is the provider's customer ID
+	reference VARCHAR(255) NOT NULL,
+	PRIMARY KEY (customer_id, provider)
+);
+
+CREATE TABLE IF NOT EXISTS saved_payment_methods (
+	id SERIAL PRIMARY KEY,
+	customer_id INT NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+	provider VARCHAR(20) NOT NULL,
+	-- token is the provider's payment method ID; card numbers are never stored
+	token VARCHAR(255) NOT NULL,
+	brand VARCHAR(50),
+	last4 CHAR(4),
+	exp_month INT,
+	exp_year INT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	UNIQUE (provider, token)
+);
+CREATE INDEX IF NOT EXISTS saved_payment_methods_customer_idx ON saved_payment_methods (customer_id);
+
+CREATE TABLE IF NOT EXISTS payment_methods (
+	id SERIAL PRIMARY KEY,
+	-- code is what customers send as the payment's provider
+	code VARCHAR(20) NOT NULL UNIQUE,
+	name VARCHAR(255) NOT NULL,
+	type VARCHAR(20) NOT NULL,
+	instructions TEXT,
+	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS gift_cards (
+	id SERIAL PRIMARY KEY,
+	code VARCHAR(32) NOT NULL UNIQUE,
+	balance DECIMAL NOT NULL CHECK (balance >= 0),
+	currency CHAR(3) NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS payment_transactions (
+	id SERIAL PRIMARY KEY,
+	payment_id INT NOT NULL REFERENCES payments(id),
+	refund_id INT REFERENCES refunds(id),
+	order_id INT NOT NULL,
+	provider VARCHAR(20) NOT NULL,
+	-- type is charge, refund or fee; amount is always positive
+	type VARCHAR(20) NOT NULL,
+	amount DECIMAL NOT NULL,
+	currency CHAR(3) NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS payment_transactions_created_idx ON payment_transactions (created_at);
+CREATE INDEX IF NOT EXISTS payment_transactions_payment_idx ON payment_transactions (payment_id);
+
+CREATE TABLE IF NOT EXISTS payment_retries (
+	order_id INT PRIMARY KEY REFERENCES orders(id),
+	attempts INT NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS addresses (
+	id SERIAL PRIMARY KEY,
+	customer_id INT NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+	name VARCHAR(255) NOT NULL,
+	line1 VARCHAR(255) NOT NULL,
+	line2 VARCHAR(255),
+	city VARCHAR(100) NOT NULL,
+	region VARCHAR(100),
+	postal_code VARCHAR(20),
+	country CHAR(2) NOT NULL,
+	phone VARCHAR(50),
+	is_default_shipping BOOLEAN NOT NULL DEFAULT FALSE,
+	is_default_billing BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS addresses_customer_idx ON addresses (customer_id);
+CREATE UNIQUE INDEX IF NOT EXISTS addresses_default_shipping_idx ON addresses (customer_id) WHERE is_default_shipping;
+CREATE UNIQUE INDEX IF NOT EXISTS addresses_default_billing_idx ON addresses (customer_id) WHERE is_default_billing;
+
+-- order_addresses copies the addresses an order was placed with
+CREATE TABLE IF NOT EXISTS order_addresses (
+	order_id INT NOT NULL REFERENCES orders(id),
+	type VARCHAR(20) NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	line1 VARCHAR(255) NOT NULL,
+	line2 VARCHAR(255),
+	city VARCHAR(100) NOT NULL,
+	region VARCHAR(100),
+	postal_code VARCHAR(20),
+	country CHAR(2) NOT NULL,
+	phone VARCHAR(50),
+	PRIMARY KEY (order_id, type)
+);
+
+-- A shipping zone without countries covers the rest of the world
+CREATE TABLE IF NOT EXISTS shipping_zones (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	countries VARCHAR(2)[] NOT NULL DEFAULT '{}'
+);
+
+CREATE TABLE IF NOT EXISTS shipping_rates (
+	id SERIAL PRIMARY KEY,
+	zone_id INT NOT NULL REFERENCES shipping_zones(id) ON DELETE CASCADE,
+	-- code is the shipping_method customers choose; name is shown to them
+	code VARCHAR(50) NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	base_price DECIMAL NOT NULL DEFAULT 0,
+	price_per_kg DECIMAL NOT NULL DEFAULT 0,
+	min_weight DECIMAL NOT NULL DEFAULT 0,
+	max_weight DECIMAL,
+	free_above DECIMAL
+);
+CREATE INDEX IF NOT EXISTS shipping_rates_zone_idx ON shipping_rates (zone_id);
+
+ALTER TABLE shipments ADD COLUMN IF NOT EXISTS carrier VARCHAR(50);
+ALTER TABLE shipments ADD COLUMN IF NOT EXISTS service VARCHAR(100);
+ALTER TABLE shipments ADD COLUMN IF NOT EXISTS label_url TEXT;
+ALTER TABLE shipments ADD COLUMN IF NOT EXISTS label_cost DECIMAL;
+ALTER TABLE shipments ADD COLUMN IF NOT EXISTS label_currency CHAR(3);
+-- label_reference is the carrier API's ID for the bought shipment
+ALTER TABLE shipments ADD COLUMN IF NOT EXISTS label_reference VARCHAR(255);
+
+-- tracking_status is the latest normalized status reported by the carrier
+ALTER TABLE shipments ADD COLUMN IF NOT EXISTS tracking_status VARCHAR(30);
+ALTER TABLE shipments ADD COLUMN IF NOT EXISTS tracking_checked_at TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS shipment_events (
+	id SERIAL PRIMARY KEY,
+	shipment_id INT NOT NULL REFERENCES shipments(id) ON DELETE CASCADE,
+	status VARCHAR(30) NOT NULL,
+	description TEXT NOT NULL,
+	location VARCHAR(255),
+	occurred_at TIMESTAMP NOT NULL,
+	UNIQUE (shipment_id, status, occurred_at)
+);
+
+-- A shipping method's code matches the code of its shipping_rates
+CREATE TABLE IF NOT EXISTS shipping_methods (
+	id SERIAL PRIMARY KEY,
+	code VARCHAR(50) NOT NULL UNIQUE,
+	name VARCHAR(255) NOT NULL,
+	price DECIMAL NOT NULL DEFAULT 0,
+	free_above DECIMAL,
+	min_days INT,
+	max_days INT,
+	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Warehouses ship orders placed before their local cutoff_time ("15:04") that business day
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS timezone VARCHAR(64) NOT NULL DEFAULT 'UTC';
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS cutoff_time VARCHAR(5);
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS handling_days INT NOT NULL DEFAULT 0;
+ALTER TABLE shipping_rates ADD COLUMN IF NOT EXISTS min_days INT;
+ALTER TABLE shipping_rates ADD COLUMN IF NOT EXISTS max_days INT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS estimated_delivery_earliest DATE;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS estimated_delivery_latest DATE;
+
+CREATE TABLE IF NOT EXISTS pickup_locations (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	line1 VARCHAR(255) NOT NULL,
+	line2 VARCHAR(255),
+	city VARCHAR(100) NOT NULL,
+	region VARCHAR(100),
+	postal_code VARCHAR(20),
+	country CHAR(2) NOT NULL,
+	phone VARCHAR(50),
+	hours VARCHAR(255),
+	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS pickup_location_id INT REFERENCES pickup_locations(id);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS ready_for_pickup_at TIMESTAMP;
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS restricted_countries TEXT[] NOT NULL DEFAULT '{}';
+
+-- Coupon codes are stored uppercased; value is a percentage or an amount by type
+CREATE TABLE IF NOT EXISTS coupons (
+	id SERIAL PRIMARY KEY,
+	code VARCHAR(50) NOT NULL UNIQUE,
+	type VARCHAR(20) NOT NULL CHECK (type IN ('percent', 'fixed')),
+	value DECIMAL NOT NULL CHECK (value > 0),
+	max_uses INT CHECK (max_uses > 0),
+	expires_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+	id SERIAL PRIMARY KEY,
+	coupon_id INT NOT NULL REFERENCES coupons(id) ON DELETE CASCADE,
+	order_id INT NOT NULL UNIQUE REFERENCES orders(id) ON DELETE CASCADE,
+	customer_id INT NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+ALTER TABLE carts ADD COLUMN IF NOT EXISTS coupon_id INT REFERENCES coupons(id) ON DELETE SET NULL;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS discount DECIMAL NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS coupon_code VARCHAR(50);
+
+-- A coupon limited to product_ids or category_ids (and their subcategories) only discounts those products
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS per_customer_limit INT CHECK (per_customer_limit > 0);
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS min_subtotal DECIMAL CHECK (min_subtotal >= 0);
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS product_ids INT[] NOT NULL DEFAULT '{}';
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS category_ids INT[] NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS coupon_redemptions_customer_idx ON coupon_redemptions (coupon_id, customer_id);
+
+-- Gift cards are bought as is_gift_card products, issued one per unit once the order is paid, or issued by admins
+ALTER TABLE products ADD COLUMN IF NOT EXISTS is_gift_card BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE gift_cards ADD COLUMN IF NOT EXISTS initial_balance DECIMAL;
+ALTER TABLE gift_cards ADD COLUMN IF NOT EXISTS order_id INT REFERENCES orders(id) ON DELETE SET NULL;
+ALTER TABLE gift_cards ADD COLUMN IF NOT EXISTS customer_id INT REFERENCES customers(id) ON DELETE SET NULL;
+ALTER TABLE gift_cards ADD COLUMN IF NOT EXISTS recipient_email VARCHAR(255);
+ALTER TABLE gift_cards ADD COLUMN IF NOT EXISTS note TEXT;
+ALTER TABLE gift_cards ADD COLUMN IF NOT EXISTS delivered_at TIMESTAMPTZ;
+CREATE TABLE IF NOT EXISTS gift_card_transactions (
+	id SERIAL PRIMARY KEY,
+	gift_card_id INT NOT NULL REFERENCES gift_cards(id) ON DELETE CASCADE,
+	type VARCHAR(20) NOT NULL,
+	amount DECIMAL NOT NULL,
+	order_id INT REFERENCES orders(id) ON DELETE SET NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS gift_card_transactions_gift_card_idx ON gift_card_transactions (gift_card_id);
+
+-- Promotions apply automatically in priority order; order_promotions records what each took off an order
+CREATE TABLE IF NOT EXISTS promotions (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	type VARCHAR(20) NOT NULL,
+	discount_type VARCHAR(10) NOT NULL,
+	value DECIMAL NOT NULL CHECK (value > 0),
+	min_subtotal DECIMAL CHECK (min_subtotal >= 0),
+	buy_quantity INT CHECK (buy_quantity > 0),
+	get_quantity INT CHECK (get_quantity > 0),
+	product_ids INT[] NOT NULL DEFAULT '{}',
+	category_ids INT[] NOT NULL DEFAULT '{}',
+	priority INT NOT NULL DEFAULT 0,
+	exclusive BOOLEAN NOT NULL DEFAULT FALSE,
+	active BOOLEAN NOT NULL DEFAULT TRUE,
+	starts_at TIMESTAMPTZ,
+	ends_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS order_promotions (
+	id SERIAL PRIMARY KEY,
+	order_id INT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+	promotion_id INT REFERENCES promotions(id) ON DELETE SET NULL,
+	name VARCHAR(255) NOT NULL,
+	discount DECIMAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS order_promotions_order_idx ON order_promotions (order_id);
+
+-- Loyalty points are earned on paid orders and redeemed as a discount; loyalty_transactions is the history of each balance
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS loyalty_points INT NOT NULL DEFAULT 0 CHECK (loyalty_points >= 0);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS points_redeemed INT NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS points_discount DECIMAL NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS loyalty_transactions (
+	id SERIAL PRIMARY KEY,
+	customer_id INT NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+	order_id INT REFERENCES orders(id) ON DELETE SET NULL,
+	type VARCHAR(20) NOT NULL,
+	points INT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS loyalty_transactions_customer_idx ON loyalty_transactions (customer_id);
+
+-- A referral is rewarded with a coupon for each party, only usable by its customer, once the referred customer's first order is paid
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS referral_code VARCHAR(20) UNIQUE;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS customer_id INT REFERENCES customers(id) ON DELETE CASCADE;
+CREATE TABLE IF NOT EXISTS referrals (
+	id SERIAL PRIMARY KEY,
+	referrer_id INT NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+	referred_id INT NOT NULL UNIQUE REFERENCES customers(id) ON DELETE CASCADE,
+	order_id INT REFERENCES orders(id) ON DELETE SET NULL,
+	referrer_coupon_id INT REFERENCES coupons(id) ON DELETE SET NULL,
+	referred_coupon_id INT REFERENCES coupons(id) ON DELETE SET NULL,
+	rewarded_at TIMESTAMPTZ,
+	notified_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS referrals_referrer_idx ON referrals (referrer_id);
+
+-- Customers in a group pay its price for a product, or the group's percentage off the usual price
+CREATE TABLE IF NOT EXISTS customer_groups (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(100) NOT NULL UNIQUE,
+	discount_percent DECIMAL NOT NULL DEFAULT 0 CHECK (discount_percent BETWEEN 0 AND 100),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS customer_group_prices (
+	group_id INT NOT NULL REFERENCES customer_groups(id) ON DELETE CASCADE,
+	product_id INT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+	price DECIMAL NOT NULL CHECK (price >= 0),
+	PRIMARY KEY (group_id, product_id)
+);
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS group_id INT REFERENCES customer_groups(id) ON DELETE SET NULL;
+
+-- Orders that got the first-order discount, with the mailbox and card that got it
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS first_order_discount DECIMAL NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS first_order_discounts (
+	order_id INT PRIMARY KEY REFERENCES orders(id) ON DELETE CASCADE,
+	customer_id INT NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+	email_key VARCHAR(255) NOT NULL,
+	payment_fingerprint VARCHAR(255),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS first_order_discounts_email_key_idx ON first_order_discounts (email_key);
+CREATE INDEX IF NOT EXISTS first_order_discounts_fingerprint_idx ON first_order_discounts (payment_fingerprint);
+
+-- Flash sales lower their products' prices between starts_at and ends_at
+CREATE TABLE IF NOT EXISTS flash_sales (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	starts_at TIMESTAMPTZ NOT NULL,
+	ends_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	CHECK (ends_at > starts_at)
+);
+CREATE TABLE IF NOT EXISTS flash_sale_prices (
+	sale_id INT NOT NULL REFERENCES flash_sales(id) ON DELETE CASCADE,
+	product_id INT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+	price DECIMAL NOT NULL CHECK (price >= 0),
+	PRIMARY KEY (sale_id, product_id)
+);
+
+-- An order's discount broken down in the order each part was applied
+CREATE TABLE IF NOT EXISTS order_discounts (
+	id SERIAL PRIMARY KEY,
+	order_id INT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+	type VARCHAR(20) NOT NULL,
+	name VARCHAR(255),
+	amount DECIMAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS order_discounts_order_idx ON order_discounts (order_id);
+
+-- Rendered emails waiting to be sent; a dedupe key is queued once per recipient
+CREATE TABLE IF NOT EXISTS email_outbox (
+	id SERIAL PRIMARY KEY,
+	recipient VARCHAR(255) NOT NULL,
+	template VARCHAR(50) NOT NULL,
+	dedupe_key VARCHAR(255),
+	subject TEXT NOT NULL,
+	text_body TEXT NOT NULL,
+	html_body TEXT NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	last_error TEXT,
+	sent_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	UNIQUE (recipient, dedupe_key)
+);
+CREATE INDEX IF NOT EXISTS email_outbox_due_idx ON email_outbox (next_attempt_at) WHERE sent_at IS NULL;
+
+-- The notifications a customer turned off; customers without a row get all of them
+CREATE TABLE IF NOT EXISTS notification_preferences (
+	customer_id INT PRIMARY KEY REFERENCES customers(id) ON DELETE CASCADE,
+	order_updates BOOLEAN NOT NULL DEFAULT TRUE,
+	reminders BOOLEAN NOT NULL DEFAULT TRUE,
+	marketing BOOLEAN NOT NULL DEFAULT TRUE,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Endpoints order events are posted to, and each event's delivery to them
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+	id SERIAL PRIMARY KEY,
+	url TEXT NOT NULL,
+	secret VARCHAR(100) NOT NULL,
+	events TEXT[] NOT NULL,
+	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id SERIAL PRIMARY KEY,
+	endpoint_id INT NOT NULL REFERENCES webhook_endpoints(id) ON DELETE CASCADE,
+	event VARCHAR(50) NOT NULL,
+	payload TEXT NOT NULL,
+	status VARCHAR(20) NOT NULL DEFAULT 'pending',
+	attempts INT NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	response_status INT,
+	last_error TEXT,
+	delivered_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_endpoint_idx ON webhook_deliveries (endpoint_id, id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+
+-- Addresses the email provider reported as bouncing or complaining; nothing is sent to them
+CREATE TABLE IF NOT EXISTS email_suppressions (
+	email VARCHAR(255) PRIMARY KEY,
+	reason VARCHAR(20) NOT NULL,
+	detail TEXT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Invoice numbers, issued in sequence when an order's invoice is first downloaded
+CREATE TABLE IF NOT EXISTS invoices (
+	order_id INT PRIMARY KEY REFERENCES orders(id),
+	number SERIAL UNIQUE,
+	issued_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- When customers signed up; those who signed up before it was recorded have none
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ;
+ALTER TABLE customers ALTER COLUMN created_at SET DEFAULT NOW();
+
+-- Files sent along with queued emails, such as subscribed reports
+CREATE TABLE IF NOT EXISTS email_attachments (
+	id SERIAL PRIMARY KEY,
+	email_id INT NOT NULL REFERENCES email_outbox(id) ON DELETE CASCADE,
+	filename VARCHAR(255) NOT NULL,
+	content_type VARCHAR(255) NOT NULL,
+	content BYTEA NOT NULL
+);
+CREATE INDEX IF NOT EXISTS email_attachments_email_idx ON email_attachments (email_id);
+
+-- Reports emailed to admins every day, week or month
+CREATE TABLE IF NOT EXISTS report_subscriptions (
+	id SERIAL PRIMARY KEY,
+	report VARCHAR(20) NOT NULL,
+	group_by VARCHAR(10),
+	frequency VARCHAR(10) NOT NULL,
+	format VARCHAR(10) NOT NULL,
+	recipients TEXT[] NOT NULL,
+	next_run_at TIMESTAMPTZ NOT NULL,
+	last_run_at TIMESTAMPTZ,
+	created_by INT REFERENCES customers(id) ON DELETE SET NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
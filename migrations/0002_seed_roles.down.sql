@@ -0,0 +1,9 @@
+DELETE FROM role_permissions
+WHERE role_id IN (SELECT id FROM roles WHERE name IN ('customer', 'admin'));
+
+DELETE FROM roles WHERE name IN ('customer', 'admin');
+
+DELETE FROM permissions WHERE name IN (
+	'orders.place', 'orders.view_own', 'orders.view', 'orders.refund', 'orders.fulfill',
+	'payments.manage', 'products.manage', 'roles.manage', 'api_keys.manage', 'reports.view'
+);
@@ -0,0 +1,19 @@
+-- Creates the built-in roles and grants them their default permissions
+
+INSERT INTO permissions (name) VALUES
+	('orders.place'), ('orders.view_own'), ('orders.view'), ('orders.refund'), ('orders.fulfill'),
+	('payments.manage'), ('products.manage'), ('roles.manage'), ('api_keys.manage'), ('reports.view')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO roles (name) VALUES ('customer'), ('admin')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT r.id, p.id FROM roles r, permissions p
+WHERE r.name = 'customer' AND p.name IN ('orders.place', 'orders.view_own')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT r.id, p.id FROM roles r, permissions p
+WHERE r.name = 'admin' AND p.name IN ('orders.view', 'orders.refund', 'orders.fulfill', 'payments.manage', 'products.manage', 'roles.manage', 'api_keys.manage', 'reports.view')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,9 @@
+-- Adds the weighted search vector (name ranks above description) and its index. The column is
+-- generated, so Postgres keeps it up to date on every insert and update.
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector tsvector
+	GENERATED ALWAYS AS (
+		setweight(to_tsvector('english', COALESCE(name, '')), 'A') ||
+		setweight(to_tsvector('english', COALESCE(description, '')), 'B')
+	) STORED;
+CREATE INDEX IF NOT EXISTS products_search_idx ON products USING GIN (search_vector);
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS products_price_history ON products;
+DROP FUNCTION IF EXISTS record_product_price();
@@ -0,0 +1,18 @@
+-- Records every product price, whether it was set by an admin, an import or a schedule. The
+-- first row of a product has no old_price.
+
+CREATE OR REPLACE FUNCTION record_product_price() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'UPDATE' AND OLD.price IS NOT DISTINCT FROM NEW.price THEN
+		RETURN NEW;
+	END IF;
+	INSERT INTO product_price_history (product_id, old_price, new_price)
+	VALUES (NEW.id, CASE WHEN TG_OP = 'UPDATE' THEN OLD.price END, NEW.price);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS products_price_history ON products;
+CREATE TRIGGER products_price_history
+	AFTER INSERT OR UPDATE OF price ON products
+	FOR EACH ROW EXECUTE FUNCTION record_product_price();
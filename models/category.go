@@ -0,0 +1,14 @@
+// Package models holds the types the handlers, service and repository layers pass between them,
+// which are also the API's JSON shapes
+package models
+
+type Category struct {
+	ID       int    `json:"category_id"`
+	Name     string `json:"name"`
+	ParentID *int   `json:"parent_id"`
+}
+
+type CategoryRequest struct {
+	Name     string `json:"name"`
+	ParentID *int   `json:"parent_id"`
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errCartNotFound = errors.New("cart not found")
+
+// CartSummary lists one of a customer's carts. The active cart is the one /cart works on.
+type CartSummary struct {
+	ID        int       `json:"cart_id"`
+	Name      string    `json:"name"`
+	Active    bool      `json:"active"`
+	ItemCount int       `json:"item_count"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CartNameRequest struct {
+	Name string `json:"name"`
+}
+
+// CARTS
+func CartsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT c.id, c.name, c.active, COUNT(ci.id), c.updated_at
+		FROM carts c
+		LEFT JOIN cart_items ci ON ci.cart_id = c.id
+		WHERE c.customer_id = $1
+		GROUP BY c.id
+		ORDER BY c.active DESC, c.updated_at DESC
+	`, getCustomerID(r))
+	if err != nil {
+		log.Println("Error retrieving carts:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	defer rows.Close()
+
+	carts := make([]CartSummary, 0)
+	for rows.Next() {
+		var cart CartSummary
+		if err := rows.Scan(&cart.ID, &cart.Name, &cart.Active, &cart.ItemCount, &cart.UpdatedAt); err != nil {
+			log.Println("Error scanning cart:", err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		carts = append(carts, cart)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error retrieving carts:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, carts)
+}
+
+// CreateCartHandler creates an empty named cart. It becomes the active cart only if the
+// customer doesn't have one yet.
+func CreateCartHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := readCartName(w, r)
+	if !ok {
+		return
+	}
+
+	customerID := getCustomerID(r)
+	var cartID int
+	err := db.QueryRowContext(r.Context(), `
+		INSERT INTO carts (customer_id, name, active)
+		VALUES ($1, $2, NOT EXISTS (SELECT 1 FROM carts WHERE customer_id = $1 AND active))
+		RETURNING id
+	`, customerID, name).Scan(&cartID)
+	if err != nil {
+		log.Println("Error creating cart:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeCart(r.Context(), w, http.StatusCreated, cartOwner{CustomerID: customerID, CartID: cartID})
+}
+
+func NamedCartHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := namedCartOwner(w, r)
+	if !ok {
+		return
+	}
+
+	cartID, err := findCartID(r.Context(), owner)
+	if err != nil {
+		log.Println("Error retrieving cart:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if cartID == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Cart not found")
+		return
+	}
+
+	writeCart(r.Context(), w, http.StatusOK, owner)
+}
+
+func RenameCartHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := namedCartOwner(w, r)
+	if !ok {
+		return
+	}
+	name, ok := readCartName(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "UPDATE carts SET name = $1 WHERE id = $2 AND customer_id = $3", name, owner.CartID, owner.CustomerID)
+	if !writeCartResult(w, result, err) {
+		return
+	}
+
+	writeCart(r.Context(), w, http.StatusOK, owner)
+}
+
+// ActivateCartHandler switches the customer's active cart, which /cart and /cart/items work on
+func ActivateCartHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := namedCartOwner(w, r)
+	if !ok {
+		return
+	}
+
+	err := activateCart(r.Context(), owner)
+	if err == errCartNotFound {
+		handlers.WriteError(w, http.StatusNotFound, "Cart not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error switching cart:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeCart(r.Context(), w, http.StatusOK, owner)
+}
+
+// DeleteNamedCartHandler deletes a cart and its items. Deleting the active cart leaves the
+// customer without one until they add an item or activate another cart.
+func DeleteNamedCartHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := namedCartOwner(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM carts WHERE id = $1 AND customer_id = $2", owner.CartID, owner.CustomerID)
+	if !writeCartResult(w, result, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// NamedCartCheckoutHandler places an order for a specific cart, active or not
+func NamedCartCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := namedCartOwner(w, r)
+	if !ok {
+		return
+	}
+	checkoutRequest, ok := readCartCheckoutRequest(w, r)
+	if !ok {
+		return
+	}
+
+	cartID, err := findCartID(r.Context(), owner)
+	if err != nil {
+		log.Println("Error retrieving cart:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if cartID == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Cart not found")
+		return
+	}
+
+	writeCartCheckout(w, r, owner, checkoutRequest)
+}
+
+// namedCartOwner reads the cart ID from the path; the cart must belong to the authenticated customer
+func namedCartOwner(w http.ResponseWriter, r *http.Request) (cartOwner, bool) {
+	cartID, err := strconv.Atoi(mux.Vars(r)["cartID"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid cart ID")
+		return cartOwner{}, false
+	}
+	return cartOwner{CustomerID: getCustomerID(r), CartID: cartID}, true
+}
+
+func readCartName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var nameRequest CartNameRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return "", false
+	}
+
+	err = json.Unmarshal(body, &nameRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return "", false
+	}
+
+	name := strings.TrimSpace(nameRequest.Name)
+	if name == "" || len(name) > 100 {
+		handlers.WriteFieldError(w, "name", "name is required and must be at most 100 characters")
+		return "", false
+	}
+	return name, true
+}
+
+// writeCartResult writes the error response for a cart update and reports whether it succeeded
+func writeCartResult(w http.ResponseWriter, result sql.Result, err error) bool {
+	if err != nil {
+		log.Println("Error updating cart:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return false
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Cart not found")
+		return false
+	}
+	return true
+}
+
+// activateCart deactivates the customer's current cart and activates the given one in one
+// transaction, so the customer never has two active carts
+func activateCart(ctx context.Context, owner cartOwner) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE carts SET active = FALSE WHERE customer_id = $1 AND active AND id <> $2", owner.CustomerID, owner.CartID); err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, "UPDATE carts SET active = TRUE WHERE id = $1 AND customer_id = $2", owner.CartID, owner.CustomerID)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return errCartNotFound
+	}
+
+	return tx.Commit()
+}
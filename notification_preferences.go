@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Notification categories customers can opt out of. Emails in no category, like password
+// resets and gift cards, are always sent.
+const (
+	notificationOrderUpdates = "order_updates"
+	notificationReminders    = "reminders"
+	notificationMarketing    = "marketing"
+)
+
+// emailCategories puts each email template in the notification category that can turn it off
+var emailCategories = map[string]string{
+	emailOrderCancelled:       notificationOrderUpdates,
+	emailUnpaidOrderCancelled: notificationOrderUpdates,
+	emailPaymentReceived:      notificationOrderUpdates,
+	emailPaymentFailed:        notificationOrderUpdates,
+	emailPaymentRetryFailed:   notificationOrderUpdates,
+	emailPaymentDisputed:      notificationOrderUpdates,
+	emailReadyForPickup:       notificationOrderUpdates,
+	emailOutForDelivery:       notificationOrderUpdates,
+	emailPackageDelivered:     notificationOrderUpdates,
+	emailOrderReminder:        notificationReminders,
+	emailReferralReward:       notificationMarketing,
+	emailReferralWelcome:      notificationMarketing,
+}
+
+// NotificationPreferences are the kinds of notifications a customer gets; all are on until
+// the customer turns them off
+type NotificationPreferences struct {
+	OrderUpdates bool `json:"order_updates"`
+	Reminders    bool `json:"reminders"`
+	Marketing    bool `json:"marketing"`
+}
+
+// NotificationPreferencesRequest changes the preferences that are given and keeps the others
+type NotificationPreferencesRequest struct {
+	OrderUpdates *bool `json:"order_updates"`
+	Reminders    *bool `json:"reminders"`
+	Marketing    *bool `json:"marketing"`
+}
+
+// CUSTOMER NOTIFICATION PREFERENCES
+func CustomerNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	preferences, err := getNotificationPreferences(r.Context(), getCustomerID(r))
+	if err != nil {
+		log.Println("Error retrieving notification preferences:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, preferences)
+}
+
+func CustomerUpdateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	var preferencesRequest NotificationPreferencesRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &preferencesRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	customerID := getCustomerID(r)
+	_, err = db.ExecContext(r.Context(), `
+		INSERT INTO notification_preferences (customer_id, order_updates, reminders, marketing)
+		VALUES ($1, COALESCE($2, TRUE), COALESCE($3, TRUE), COALESCE($4, TRUE))
+		ON CONFLICT (customer_id) DO UPDATE
+		SET order_updates = COALESCE($2, notification_preferences.order_updates),
+			reminders = COALESCE($3, notification_preferences.reminders),
+			marketing = COALESCE($4, notification_preferences.marketing),
+			updated_at = NOW()
+	`, customerID, preferencesRequest.OrderUpdates, preferencesRequest.Reminders, preferencesRequest.Marketing)
+	if err != nil {
+		log.Println("Error updating notification preferences:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	preferences, err := getNotificationPreferences(r.Context(), customerID)
+	if err != nil {
+		log.Println("Error retrieving notification preferences:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, preferences)
+}
+
+func getNotificationPreferences(ctx context.Context, customerID int) (*NotificationPreferences, error) {
+	preferences := NotificationPreferences{OrderUpdates: true, Reminders: true, Marketing: true}
+	err := db.QueryRowContext(ctx, `
+		SELECT order_updates, reminders, marketing FROM notification_preferences WHERE customer_id = $1
+	`, customerID).Scan(&preferences.OrderUpdates, &preferences.Reminders, &preferences.Marketing)
+	if isNoRows(err) {
+		return &preferences, nil
+	}
+	return &preferences, err
+}
+
+// notificationAllowed reports whether the email template may be sent to the address, which is
+// not the case when the customer with the address turned off the template's category.
+// Addresses without an account, such as admins', always get it.
+func notificationAllowed(ctx context.Context, to, name string) (bool, error) {
+	category, ok := emailCategories[name]
+	if !ok {
+		return true, nil
+	}
+
+	// category is one of the constants above, which are also the column names
+	var optedOut bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM notification_preferences p
+			JOIN customers c ON c.id = p.customer_id
+			WHERE c.email = $1 AND NOT p.`+category+`
+		)
+	`, normalizeEmail(to)).Scan(&optedOut)
+	return !optedOut, err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const (
+	oauthStateCookie  = "oauth_state"
+	googleUserInfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+)
+
+// googleOAuthConfig is nil when GOOGLE_CLIENT_ID is not set, which disables Google login
+var googleOAuthConfig *oauth2.Config
+
+// oauthStateCookiePath scopes the state cookie to the callback's path in GOOGLE_REDIRECT_URL,
+// which may be versioned or not
+var oauthStateCookiePath = "/"
+
+var errEmailNotVerified = errors.New("google account email is not verified")
+
+type GoogleUserInfo struct {
+	Subject       string `json:"sub"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+func loadGoogleOAuthConfig() {
+	clientID := os.Getenv("GOOGLE_CLIENT_ID")
+	if clientID == "" {
+		return
+	}
+
+	googleOAuthConfig = &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
+		Scopes:       []string{"openid", "email", "profile"},
+		Endpoint:     google.Endpoint,
+	}
+	if redirectURL, err := url.Parse(googleOAuthConfig.RedirectURL); err == nil && redirectURL.Path != "" {
+		oauthStateCookiePath = redirectURL.Path
+	}
+}
+
+// GOOGLE LOGIN
+func GoogleLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if googleOAuthConfig == nil {
+		handlers.WriteError(w, http.StatusNotFound, "Google login is not configured")
+		return
+	}
+
+	state, err := generateToken(16)
+	if err != nil {
+		log.Println("Error generating OAuth state:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// The callback compares the state parameter with this cookie to block forged callbacks
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     oauthStateCookiePath,
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, googleOAuthConfig.AuthCodeURL(state), http.StatusFound)
+}
+
+func GoogleCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if googleOAuthConfig == nil {
+		handlers.WriteError(w, http.StatusNotFound, "Google login is not configured")
+		return
+	}
+
+	stateCookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || stateCookie.Value == "" || stateCookie.Value != r.URL.Query().Get("state") {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid OAuth state")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: oauthStateCookiePath, MaxAge: -1})
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		handlers.WriteError(w, http.StatusBadRequest, "Missing authorization code")
+		return
+	}
+
+	oauthToken, err := googleOAuthConfig.Exchange(r.Context(), code)
+	if err != nil {
+		log.Println("Error exchanging Google authorization code:", err)
+		handlers.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	userInfo, err := getGoogleUserInfo(r, oauthToken)
+	if err != nil {
+		log.Println("Error retrieving Google user info:", err)
+		handlers.WriteError(w, http.StatusBadGateway, "Error contacting Google")
+		return
+	}
+
+	customer, err := findOrCreateGoogleCustomer(r.Context(), userInfo)
+	if err == errEmailNotVerified {
+		handlers.WriteError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error linking Google account:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if err := mergeGuestCart(w, r, customer.ID); err != nil {
+		// The cookie is kept, so the merge is retried on the next cart request
+		log.Println("Error merging guest cart:", err)
+	}
+
+	response, err := issueSession(r.Context(), customer)
+	if err != nil {
+		log.Println("Error issuing token:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, response)
+}
+
+func getGoogleUserInfo(r *http.Request, token *oauth2.Token) (*GoogleUserInfo, error) {
+	client := googleOAuthConfig.Client(r.Context(), token)
+	resp, err := client.Get(googleUserInfoURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("userinfo request failed: " + resp.Status)
+	}
+
+	var userInfo GoogleUserInfo
+	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+		return nil, err
+	}
+
+	return &userInfo, nil
+}
+
+// findOrCreateGoogleCustomer returns the customer linked to the Google account,
+// linking an existing customer with the same email or creating a new one
+func findOrCreateGoogleCustomer(ctx context.Context, userInfo *GoogleUserInfo) (*Customer, error) {
+	if !userInfo.EmailVerified {
+		return nil, errEmailNotVerified
+	}
+	email := normalizeEmail(userInfo.Email)
+
+	name := userInfo.Name
+	if name == "" {
+		name = email
+	}
+
+	// Google-only accounts get an empty password, which never matches a bcrypt hash on /login
+	var customer Customer
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO customers (name, email, password, google_id)
+		VALUES ($1, $2, '', $3)
+		ON CONFLICT (email) DO UPDATE SET google_id = COALESCE(customers.google_id, EXCLUDED.google_id)
+		RETURNING id, name, email, role
+	`, name, email, userInfo.Subject).Scan(&customer.ID, &customer.Name, &customer.Email, &customer.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	return &customer, nil
+}
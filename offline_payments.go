@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// orderStatusAwaitingPayment is an order paid offline whose payment hasn't been confirmed yet
+const orderStatusAwaitingPayment = "Awaiting Payment"
+
+// Kinds of offline payment a store can offer
+const (
+	offlinePaymentCashOnDelivery = "cash_on_delivery"
+	offlinePaymentBankTransfer   = "bank_transfer"
+)
+
+var offlinePaymentTypes = map[string]bool{
+	offlinePaymentCashOnDelivery: true,
+	offlinePaymentBankTransfer:   true,
+}
+
+var offlinePaymentCodePattern = regexp.MustCompile(`^[a-z0-9_]{1,20}$`)
+
+var errPaymentMethodCodeTaken = handlers.NewFieldError("code", "code is already used by another payment method")
+var errOrderNotAwaitingPayment = errors.New("order has no offline payment awaiting confirmation")
+
+// OfflinePaymentMethod is a payment the store collects itself, such as cash on delivery or a
+// bank transfer. Customers pick it by its code as the payment's provider.
+type OfflinePaymentMethod struct {
+	ID   int    `json:"payment_method_id"`
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Instructions are shown to the customer after ordering, e.g. the bank account to pay into
+	Instructions string    `json:"instructions,omitempty"`
+	Enabled      bool      `json:"enabled"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type OfflinePaymentMethodRequest struct {
+	Code         string `json:"code"`
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	Instructions string `json:"instructions"`
+	// Enabled defaults to true
+	Enabled *bool `json:"enabled"`
+}
+
+// AvailablePaymentMethod is a way to pay that customers can currently choose
+type AvailablePaymentMethod struct {
+	Provider     string `json:"provider"`
+	Name         string `json:"name"`
+	Instructions string `json:"instructions,omitempty"`
+}
+
+type MarkPaidRequest struct {
+	// Reference is the store's own note of the payment, e.g. the bank transfer's reference
+	Reference string `json:"reference"`
+}
+
+// PAYMENT METHODS
+// PaymentMethodsHandler lists the providers a customer can pick when placing an order
+func PaymentMethodsHandler(w http.ResponseWriter, r *http.Request) {
+	methods := make([]AvailablePaymentMethod, 0)
+	if _, ok := paymentGateways[paymentProviderCard]; ok {
+		methods = append(methods, AvailablePaymentMethod{Provider: paymentProviderCard, Name: "Card"})
+	}
+	if _, ok := paymentGateways[paymentProviderPayPal]; ok {
+		methods = append(methods, AvailablePaymentMethod{Provider: paymentProviderPayPal, Name: "PayPal"})
+	}
+
+	offline, err := getOfflinePaymentMethods(r.Context(), true)
+	if err != nil {
+		log.Println("Error retrieving payment methods:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	for _, method := range offline {
+		methods = append(methods, AvailablePaymentMethod{Provider: method.Code, Name: method.Name, Instructions: method.Instructions})
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, methods)
+}
+
+// ADMIN PAYMENT METHODS
+func AdminPaymentMethodsHandler(w http.ResponseWriter, r *http.Request) {
+	methods, err := getOfflinePaymentMethods(r.Context(), false)
+	if err != nil {
+		log.Println("Error retrieving payment methods:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, methods)
+}
+
+func AdminCreatePaymentMethodHandler(w http.ResponseWriter, r *http.Request) {
+	methodRequest, ok := readOfflinePaymentMethodRequest(w, r)
+	if !ok {
+		return
+	}
+
+	method, err := saveOfflinePaymentMethod(r.Context(), 0, methodRequest)
+	if err == errPaymentMethodCodeTaken {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error creating payment method:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, method)
+}
+
+func AdminUpdatePaymentMethodHandler(w http.ResponseWriter, r *http.Request) {
+	methodID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid payment method ID")
+		return
+	}
+
+	methodRequest, ok := readOfflinePaymentMethodRequest(w, r)
+	if !ok {
+		return
+	}
+
+	method, err := saveOfflinePaymentMethod(r.Context(), methodID, methodRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Payment method not found")
+		return
+	}
+	if err == errPaymentMethodCodeTaken {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error updating payment method:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, method)
+}
+
+// AdminDeletePaymentMethodHandler removes the method; orders already placed with it keep
+// their payments and can still be marked as paid
+func AdminDeletePaymentMethodHandler(w http.ResponseWriter, r *http.Request) {
+	methodID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid payment method ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM payment_methods WHERE id = $1", methodID)
+	if err != nil {
+		log.Println("Error deleting payment method:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Payment method not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Payment method deleted"))
+}
+
+// ADMIN MARK ORDER PAID
+// AdminMarkOrderPaidHandler confirms the offline payment of an order once the store has
+// received the money
+func AdminMarkOrderPaidHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var markRequest MarkPaidRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	// The body is optional; it only carries the payment's reference
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &markRequest); err != nil {
+			log.Println("Error decoding JSON:", err)
+			handlers.WriteInvalidJSON(w)
+			return
+		}
+	}
+	markRequest.Reference = strings.TrimSpace(markRequest.Reference)
+	if len(markRequest.Reference) > 255 {
+		handlers.WriteFieldError(w, "reference", "reference must be at most 255 characters")
+		return
+	}
+
+	payment, err := markOrderPaid(r.Context(), orderID, markRequest.Reference)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if err == errOrderNotAwaitingPayment {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error marking order as paid:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, payment)
+}
+
+func readOfflinePaymentMethodRequest(w http.ResponseWriter, r *http.Request) (OfflinePaymentMethodRequest, bool) {
+	var methodRequest OfflinePaymentMethodRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return methodRequest, false
+	}
+
+	err = json.Unmarshal(body, &methodRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return methodRequest, false
+	}
+
+	methodRequest.Code = strings.ToLower(strings.TrimSpace(methodRequest.Code))
+	methodRequest.Name = strings.TrimSpace(methodRequest.Name)
+	methodRequest.Type = strings.ToLower(strings.TrimSpace(methodRequest.Type))
+	methodRequest.Instructions = strings.TrimSpace(methodRequest.Instructions)
+
+	var validationErr error
+	switch {
+	case !offlinePaymentCodePattern.MatchString(methodRequest.Code):
+		validationErr = handlers.NewFieldError("code", "code is required and must be at most 20 lowercase letters, digits or underscores")
+	case methodRequest.Code == paymentProviderCard || methodRequest.Code == paymentProviderPayPal || methodRequest.Code == paymentProviderGiftCard:
+		validationErr = handlers.NewFieldError("code", "code is reserved for a payment provider")
+	case methodRequest.Name == "" || len(methodRequest.Name) > 255:
+		validationErr = handlers.NewFieldError("name", "name is required and must be at most 255 characters")
+	case !offlinePaymentTypes[methodRequest.Type]:
+		validationErr = handlers.NewFieldError("type", "type must be cash_on_delivery or bank_transfer")
+	case len(methodRequest.Instructions) > 2000:
+		validationErr = handlers.NewFieldError("instructions", "instructions must be at most 2000 characters")
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return methodRequest, false
+	}
+
+	return methodRequest, true
+}
+
+// saveOfflinePaymentMethod inserts a new method when methodID is 0, otherwise updates it
+func saveOfflinePaymentMethod(ctx context.Context, methodID int, req OfflinePaymentMethodRequest) (*OfflinePaymentMethod, error) {
+	method := &OfflinePaymentMethod{Code: req.Code, Name: req.Name, Type: req.Type, Instructions: req.Instructions, Enabled: true}
+	if req.Enabled != nil {
+		method.Enabled = *req.Enabled
+	}
+
+	var err error
+	if methodID == 0 {
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO payment_methods (code, name, type, instructions, enabled)
+			VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+			RETURNING id, created_at
+		`, method.Code, method.Name, method.Type, method.Instructions, method.Enabled).Scan(&method.ID, &method.CreatedAt)
+	} else {
+		err = db.QueryRowContext(ctx, `
+			UPDATE payment_methods
+			SET code = $1, name = $2, type = $3, instructions = NULLIF($4, ''), enabled = $5
+			WHERE id = $6
+			RETURNING id, created_at
+		`, method.Code, method.Name, method.Type, method.Instructions, method.Enabled, methodID).Scan(&method.ID, &method.CreatedAt)
+	}
+	if isUniqueViolation(err) {
+		return nil, errPaymentMethodCodeTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return method, nil
+}
+
+func getOfflinePaymentMethods(ctx context.Context, enabledOnly bool) ([]OfflinePaymentMethod, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, code, name, type, COALESCE(instructions, ''), enabled, created_at
+		FROM payment_methods
+		WHERE enabled OR NOT $1
+		ORDER BY name, id
+	`, enabledOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	methods := make([]OfflinePaymentMethod, 0)
+	for rows.Next() {
+		var method OfflinePaymentMethod
+		if err := rows.Scan(&method.ID, &method.Code, &method.Name, &method.Type,
+			&method.Instructions, &method.Enabled, &method.CreatedAt); err != nil {
+			return nil, err
+		}
+		methods = append(methods, method)
+	}
+
+	return methods, rows.Err()
+}
+
+// getEnabledOfflinePaymentMethod returns the enabled offline method with the code, or nil
+func getEnabledOfflinePaymentMethod(ctx context.Context, code string) (*OfflinePaymentMethod, error) {
+	var method OfflinePaymentMethod
+	err := db.QueryRowContext(ctx, `
+		SELECT id, code, name, type, COALESCE(instructions, ''), enabled, created_at
+		FROM payment_methods
+		WHERE code = $1 AND enabled
+	`, code).Scan(&method.ID, &method.Code, &method.Name, &method.Type, &method.Instructions, &method.Enabled, &method.CreatedAt)
+	if isNoRows(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &method, nil
+}
+
+// payOrderOffline records the order's offline payment as pending and leaves the order
+// awaiting payment until an admin marks it as paid
+func payOrderOffline(ctx context.Context, orderID int, method *OfflinePaymentMethod) (*Payment, error) {
+	payment := &Payment{OrderID: orderID, Provider: method.Code, Currency: paymentConfig.Currency,
+		Status: paymentStatusPending, Instructions: method.Instructions}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO payments (order_id, provider, amount, currency, status)
+		SELECT id, $2, `+amountDueSQL+`, $3, $4 FROM orders WHERE id = $1
+		RETURNING id, amount, created_at
+	`, orderID, payment.Provider, payment.Currency, payment.Status).Scan(&payment.ID, &payment.Amount, &payment.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	result, err := tx.ExecContext(ctx, "UPDATE orders SET status = $1 WHERE id = $2 AND status = $3", orderStatusAwaitingPayment, orderID, orderStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		if err := queueOrderEvent(ctx, tx, orderEventStatusChanged, orderID); err != nil {
+			return nil, err
+		}
+	}
+
+	return payment, tx.Commit()
+}
+
+// markOrderPaid captures the order's pending offline payment. An order awaiting payment
+// becomes paid once nothing is due; one already shipped, as with cash on delivery, keeps its
+// status.
+func markOrderPaid(ctx context.Context, orderID int, reference string) (*Payment, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	if err := tx.QueryRowContext(ctx, "SELECT status FROM orders WHERE id = $1 FOR UPDATE", orderID).Scan(&status); err != nil {
+		return nil, err
+	}
+	if err := checkOrderStatusTransition(status, orderStatusPaid); err != nil {
+		return nil, err
+	}
+
+	// Offline payments are the pending ones no provider has a reference for
+	var payment Payment
+	err = tx.QueryRowContext(ctx, `
+		UPDATE payments
+		SET status = $1, reference = NULLIF($2, ''), failure_reason = NULL, updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM payments
+			WHERE order_id = $3 AND status = $4 AND reference IS NULL
+			ORDER BY id DESC
+			LIMIT 1
+		)
+		RETURNING id, order_id, provider, amount, currency, status, created_at
+	`, paymentStatusCaptured, reference, orderID, paymentStatusPending).Scan(&payment.ID, &payment.OrderID,
+		&payment.Provider, &payment.Amount, &payment.Currency, &payment.Status, &payment.CreatedAt)
+	if isNoRows(err) {
+		return nil, errOrderNotAwaitingPayment
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := recordCharge(ctx, tx, payment.ID, 0); err != nil {
+		return nil, err
+	}
+	if err := settleOrder(ctx, tx, orderID); err != nil {
+		return nil, err
+	}
+
+	return &payment, tx.Commit()
+}
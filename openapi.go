@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Authentication of an API operation
+const (
+	authNone = iota
+	// authOptional operations also serve guests, but act for the customer whose token they get
+	authOptional
+	authRequired
+)
+
+// API docs settings, loaded from environment variables by loadAPIDocsConfig
+var apiDocsConfig = struct {
+	// SwaggerUI serves Swagger UI for the OpenAPI document at /docs
+	SwaggerUI bool
+}{}
+
+// apiOperation documents an operation of the API in the OpenAPI document. The document is
+// generated from the routes registerV1Routes adds and the types their operations name here.
+type apiOperation struct {
+	Summary string
+	Auth    int
+	// Permission is what the customer's role or API key needs, with Auth authRequired
+	Permission string
+	// Query names the query parameters. They are strings, or of the type queryParamTypes gives
+	// their name, which a name:type entry overrides.
+	Query []string
+	// Request is a value of the JSON body's type; Upload names the form field of a
+	// multipart/form-data body's file instead, or files with UploadMany
+	Request    interface{}
+	Upload     string
+	UploadMany bool
+	// RequestCSV also takes the body as CSV
+	RequestCSV bool
+	// Status is the success status, 200 by default. Response is a value of its JSON body's
+	// type, or ResponseType the media type of another body.
+	Status       int
+	Response     interface{}
+	ResponseType string
+	// Download also answers with CSV, or XLSX with format=xlsx; Link uploads the download with
+	// delivery=link and answers 201 with a ReportLink
+	Download bool
+	Link     bool
+	// Cacheable answers with an ETag, and 304 to an If-None-Match that has it
+	Cacheable bool
+}
+
+// Responses handlers build as maps, described for the OpenAPI document
+type placedOrderResponse struct {
+	OrderID         int      `json:"order_id"`
+	GiftCardPayment *Payment `json:"gift_card_payment,omitempty"`
+	Payment         *Payment `json:"payment,omitempty"`
+}
+
+type orderStatusResponse struct {
+	OrderID int    `json:"order_id"`
+	Status  string `json:"status"`
+}
+
+// queryParamTypes are the OpenAPI types of the query parameters that aren't strings
+var queryParamTypes = map[string]string{
+	"page":        "integer",
+	"limit":       "integer",
+	"customer_id": "integer",
+	"product_id":  "integer",
+	"category":    "integer",
+	"days":        "integer",
+	"lead_time":   "integer",
+	"min_price":   "number",
+	"max_price":   "number",
+	"date":        "date",
+	"date_from":   "date",
+	"date_to":     "date",
+	"from":        "date",
+	"to":          "date",
+}
+
+// routeVariablePattern matches a mux route variable and its pattern, if any
+var routeVariablePattern = regexp.MustCompile(`\{([^}:]+)(?::([^}]+))?\}`)
+
+var (
+	openAPIDocument     []byte
+	openAPIDocumentOnce sync.Once
+)
+
+// openAPISchemas collects the named types the document refers to as components
+type openAPISchemas map[string]interface{}
+
+// swaggerUIPage loads Swagger UI from a CDN and points it at the OpenAPI document
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Simple Commerce API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>
+SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`
+
+func loadAPIDocsConfig() {
+	if v := os.Getenv("API_DOCS_SWAGGER_UI"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid API_DOCS_SWAGGER_UI %q", v)
+		}
+		apiDocsConfig.SwaggerUI = b
+	}
+}
+
+// OPENAPI DOCUMENT
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	openAPIDocumentOnce.Do(func() {
+		var err error
+		if openAPIDocument, err = buildOpenAPIDocument(); err != nil {
+			log.Println("Error building OpenAPI document:", err)
+		}
+	})
+	if openAPIDocument == nil {
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPIDocument)
+}
+
+func SwaggerUIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(swaggerUIPage))
+}
+
+// buildOpenAPIDocument describes the routes of version 1 of the API
+func buildOpenAPIDocument() ([]byte, error) {
+	v1 := mux.NewRouter()
+	registerV1Routes(v1)
+
+	schemas := openAPISchemas{}
+	schemas.schema(reflect.TypeOf(handlers.APIError{}))
+	paths := map[string]map[string]interface{}{}
+	err := v1.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+
+		// OpenAPI paths name their parameters without mux's patterns
+		var params []interface{}
+		for _, match := range routeVariablePattern.FindAllStringSubmatch(template, -1) {
+			paramType := "string"
+			if match[2] == "[0-9]+" {
+				paramType = "integer"
+			}
+			params = append(params, map[string]interface{}{
+				"name": match[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": paramType},
+			})
+		}
+		path := routeVariablePattern.ReplaceAllString(template, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		for _, method := range methods {
+			operation, ok := apiOperations[method+" "+path]
+			if !ok {
+				log.Printf("OpenAPI document has no operation for %s %s", method, path)
+			}
+			paths[path][strings.ToLower(method)] = schemas.operation(operation, path, params)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": "Simple Commerce API", "version": "1"},
+		"servers": []interface{}{map[string]interface{}{"url": apiV1Prefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey":     map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	})
+}
+
+// operation is the OpenAPI operation object of the operation at path
+func (s openAPISchemas) operation(operation apiOperation, path string, pathParams []interface{}) map[string]interface{} {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	result := map[string]interface{}{
+		"summary": operation.Summary,
+		"tags":    []string{segments[0]},
+	}
+	if operation.Summary != "" {
+		result["operationId"] = operationID(operation.Summary)
+	}
+
+	params := append([]interface{}{}, pathParams...)
+	for _, name := range operation.Query {
+		paramType := queryParamTypes[name]
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, paramType = name[:i], name[i+1:]
+		}
+		schema := map[string]interface{}{"type": "string"}
+		switch paramType {
+		case "integer", "number", "boolean":
+			schema["type"] = paramType
+		case "date":
+			schema["format"] = "date"
+		}
+		params = append(params, map[string]interface{}{"name": name, "in": "query", "schema": schema})
+	}
+	if operation.Cacheable {
+		params = append(params, map[string]interface{}{"name": "If-None-Match", "in": "header", "schema": map[string]interface{}{"type": "string"}})
+	}
+	if len(params) > 0 {
+		result["parameters"] = params
+	}
+
+	content := map[string]interface{}{}
+	if operation.Request != nil {
+		content["application/json"] = map[string]interface{}{"schema": s.schema(reflect.TypeOf(operation.Request))}
+	}
+	if operation.RequestCSV {
+		content["text/csv"] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+	}
+	if operation.Upload != "" {
+		file := map[string]interface{}{"type": "string", "format": "binary"}
+		if operation.UploadMany {
+			file = map[string]interface{}{"type": "array", "items": file}
+		}
+		content["multipart/form-data"] = map[string]interface{}{"schema": map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{operation.Upload: file},
+			"required":   []string{operation.Upload},
+		}}
+	}
+	if len(content) > 0 {
+		result["requestBody"] = map[string]interface{}{"required": true, "content": content}
+	}
+
+	status := operation.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	content = map[string]interface{}{}
+	if operation.Response != nil {
+		content["application/json"] = map[string]interface{}{"schema": s.schema(reflect.TypeOf(operation.Response))}
+	}
+	if operation.ResponseType != "" {
+		content[operation.ResponseType] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+	}
+	if operation.Download {
+		for _, contentType := range reportContentTypes {
+			contentType, _, _ = strings.Cut(contentType, ";")
+			content[contentType] = map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}
+		}
+	}
+	if len(content) > 0 {
+		success["content"] = content
+	}
+	if operation.Cacheable {
+		success["headers"] = map[string]interface{}{"ETag": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+	}
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/APIError"}},
+		},
+	}
+	responses := map[string]interface{}{strconv.Itoa(status): success, "default": errorResponse}
+	if operation.Cacheable {
+		responses[strconv.Itoa(http.StatusNotModified)] = map[string]interface{}{"description": "Not Modified: the If-None-Match has the ETag"}
+	}
+	if operation.Link {
+		responses[strconv.Itoa(http.StatusCreated)] = map[string]interface{}{
+			"description": "Uploaded with delivery=link",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": s.schema(reflect.TypeOf(ReportLink{}))},
+			},
+		}
+	}
+	result["responses"] = responses
+
+	switch operation.Auth {
+	case authRequired:
+		result["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}, map[string]interface{}{"apiKey": []string{}}}
+		result["description"] = "Requires the " + operation.Permission + " permission."
+		responses[strconv.Itoa(http.StatusUnauthorized)] = errorResponse
+		responses[strconv.Itoa(http.StatusForbidden)] = errorResponse
+	case authOptional:
+		// An empty requirement lets guests call it too
+		result["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}, map[string]interface{}{}}
+	}
+	return result
+}
+
+// schema is the JSON schema of the values of t as encoding/json encodes them. Named structs
+// are added to the components and referred to.
+func (s openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := s.schema(t.Elem())
+		if _, ok := schema["$ref"]; ok {
+			// A $ref ignores its siblings, so a nullable reference needs allOf
+			return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+		name := schemaName(t)
+		if _, ok := s[name]; !ok {
+			// Registered before its fields, so types that contain themselves end
+			s[name] = map[string]interface{}{}
+			s[name] = s.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (s openAPISchemas) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			options := strings.Split(tag, ",")
+			name := options[0]
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				addFields(field.Type)
+				continue
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			schema := s.schema(field.Type)
+			omitEmpty := false
+			for _, option := range options[1:] {
+				switch option {
+				case "string":
+					schema = map[string]interface{}{"type": "string"}
+				case "omitempty":
+					omitEmpty = true
+				}
+			}
+			properties[name] = schema
+			if !omitEmpty && field.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// schemaName names a type's component schema, exported like the document's other names
+func schemaName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+// operationID turns a summary such as "List products" into listProducts
+func operationID(summary string) string {
+	var id strings.Builder
+	for i, word := range strings.Fields(summary) {
+		word = strings.ToLower(word)
+		if i > 0 {
+			word = strings.ToUpper(word[:1]) + word[1:]
+		}
+		id.WriteString(word)
+	}
+	return id.String()
+}
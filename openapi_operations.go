@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/hanifmasy/simple-commerce/models"
+)
+
+// Query parameters lists take, by the columns they filter
+var (
+	listPageQuery   = []string{"sort", "page", "limit", "fields"}
+	orderListQuery  = []string{"sort", "status", "date_from", "date_to", "page", "limit", "fields", "product_id"}
+	reportRangeTail = []string{"from", "to", "format", "delivery"}
+)
+
+// apiOperations documents the operations of registerV1Routes, by method and OpenAPI path
+var apiOperations = map[string]apiOperation{
+	"POST /register":               {Summary: "Register", Request: RegisterRequest{}, Status: http.StatusCreated, Response: Customer{}},
+	"POST /login":                  {Summary: "Log in", Request: LoginRequest{}, Response: LoginResponse{}},
+	"POST /password-reset/request": {Summary: "Request password reset", Request: PasswordResetRequest{}, Status: http.StatusAccepted, ResponseType: "text/plain"},
+	"POST /password-reset/confirm": {Summary: "Confirm password reset", Request: PasswordResetConfirmRequest{}, ResponseType: "text/plain"},
+	"POST /token/refresh":          {Summary: "Refresh token", Request: RefreshTokenRequest{}, Response: LoginResponse{}},
+	"POST /token/revoke":           {Summary: "Revoke token", Request: RefreshTokenRequest{}, ResponseType: "text/plain"},
+	"GET /auth/google":             {Summary: "Log in with Google", Status: http.StatusFound},
+	"GET /auth/google/callback":    {Summary: "Google login callback", Query: []string{"state", "code"}, Response: LoginResponse{}},
+	"POST /webhooks/payments":      {Summary: "Receive payment events", Request: map[string]interface{}{}},
+	"POST /webhooks/shipping":      {Summary: "Receive shipping events", Request: map[string]interface{}{}},
+	"POST /webhooks/email":         {Summary: "Receive email events", Request: []map[string]interface{}{}},
+	"GET /payment-methods":         {Summary: "List payment methods", Response: []AvailablePaymentMethod{}},
+
+	"GET /products":                   {Summary: "List products", Auth: authOptional, Query: append([]string{"min_price", "max_price", "category"}, listPageQuery...), Response: ProductPage{}, Cacheable: true},
+	"GET /products/search":            {Summary: "Search products", Auth: authOptional, Query: append([]string{"q", "min_price", "max_price", "category"}, listPageQuery...), Response: ProductPage{}, Cacheable: true},
+	"GET /products/{id}/availability": {Summary: "Get product availability", Response: Availability{}},
+	"GET /products/{id}/related":      {Summary: "List related products", Query: []string{"limit"}, Response: []RelatedProduct{}},
+	"GET /categories":                 {Summary: "List categories", Response: []models.Category{}},
+	"GET /pickup-locations":           {Summary: "List pickup locations", Response: []PickupLocation{}},
+	"GET /gift-cards/{code}":          {Summary: "Get gift card balance", Response: GiftCardBalance{}},
+
+	"POST /checkout":    {Summary: "Start checkout", Auth: authRequired, Permission: PermPlaceOrder, Request: OrderRequest{}, Status: http.StatusCreated, Response: Reservation{}},
+	"POST /place-order": {Summary: "Place order", Auth: authRequired, Permission: PermPlaceOrder, Request: OrderRequest{}, Status: http.StatusCreated, Response: placedOrderResponse{}},
+
+	"GET /cart":                                  {Summary: "Get cart", Auth: authOptional, Response: Cart{}},
+	"POST /cart/items":                           {Summary: "Add cart item", Auth: authOptional, Request: CartItemRequest{}, Status: http.StatusCreated, Response: Cart{}},
+	"PUT /cart/items/{itemID}":                   {Summary: "Update cart item", Auth: authOptional, Request: CartItemRequest{}, Response: Cart{}},
+	"DELETE /cart/items/{itemID}":                {Summary: "Remove cart item", Auth: authOptional, Response: Cart{}},
+	"POST /cart/items/{itemID}/save-for-later":   {Summary: "Save cart item for later", Auth: authRequired, Permission: PermPlaceOrder, Response: []WishlistItem{}},
+	"POST /cart/quote":                           {Summary: "Quote cart", Auth: authOptional, Request: QuoteRequest{}, Response: Quote{}},
+	"POST /cart/validate":                        {Summary: "Validate cart", Auth: authOptional, Query: []string{"country"}, Response: CartValidation{}},
+	"POST /cart/apply-coupon":                    {Summary: "Apply coupon", Auth: authOptional, Request: ApplyCouponRequest{}, Response: Cart{}},
+	"DELETE /cart/coupon":                        {Summary: "Remove coupon", Auth: authOptional, Response: Cart{}},
+	"POST /cart/checkout":                        {Summary: "Check out cart", Auth: authRequired, Permission: PermPlaceOrder, Request: CartCheckoutRequest{}, Status: http.StatusCreated, Response: placedOrderResponse{}},
+	"GET /wishlist":                              {Summary: "Get wishlist", Auth: authRequired, Permission: PermPlaceOrder, Response: []WishlistItem{}},
+	"POST /wishlist/items":                       {Summary: "Add wishlist item", Auth: authRequired, Permission: PermPlaceOrder, Request: CartItemRequest{}, Status: http.StatusCreated, Response: []WishlistItem{}},
+	"DELETE /wishlist/items/{itemID}":            {Summary: "Remove wishlist item", Auth: authRequired, Permission: PermPlaceOrder, Response: []WishlistItem{}},
+	"POST /wishlist/items/{itemID}/move-to-cart": {Summary: "Move wishlist item to cart", Auth: authRequired, Permission: PermPlaceOrder, Response: Cart{}},
+
+	"GET /carts":                    {Summary: "List carts", Auth: authRequired, Permission: PermPlaceOrder, Response: []CartSummary{}},
+	"POST /carts":                   {Summary: "Create cart", Auth: authRequired, Permission: PermPlaceOrder, Request: CartNameRequest{}, Status: http.StatusCreated, Response: Cart{}},
+	"GET /carts/{cartID}":           {Summary: "Get named cart", Auth: authRequired, Permission: PermPlaceOrder, Response: Cart{}},
+	"PUT /carts/{cartID}":           {Summary: "Rename cart", Auth: authRequired, Permission: PermPlaceOrder, Request: CartNameRequest{}, Response: Cart{}},
+	"DELETE /carts/{cartID}":        {Summary: "Delete cart", Auth: authRequired, Permission: PermPlaceOrder, Status: http.StatusNoContent},
+	"POST /carts/{cartID}/activate": {Summary: "Activate cart", Auth: authRequired, Permission: PermPlaceOrder, Response: Cart{}},
+	"POST /carts/{cartID}/checkout": {Summary: "Check out named cart", Auth: authRequired, Permission: PermPlaceOrder, Request: CartCheckoutRequest{}, Status: http.StatusCreated, Response: placedOrderResponse{}},
+
+	"GET /customer/orders":                       {Summary: "List own orders", Auth: authRequired, Permission: PermViewOwnOrders, Query: orderListQuery, Response: OrderPage{}},
+	"POST /customer/orders/{id}/cancel":          {Summary: "Cancel own order", Auth: authRequired, Permission: PermPlaceOrder, Response: orderStatusResponse{}},
+	"POST /customer/orders/{id}/payment":         {Summary: "Pay own order", Auth: authRequired, Permission: PermPlaceOrder, Request: PaymentRequest{}, Status: http.StatusCreated, Response: placedOrderResponse{}},
+	"POST /customer/orders/{id}/payment/capture": {Summary: "Capture own order payment", Auth: authRequired, Permission: PermPlaceOrder, Response: Payment{}},
+	"POST /customer/orders/{id}/reorder":         {Summary: "Reorder", Auth: authRequired, Permission: PermPlaceOrder, Response: Reorder{}},
+	"GET /customer/orders/{id}/shipments":        {Summary: "List own order shipments", Auth: authRequired, Permission: PermViewOwnOrders, Response: OrderFulfillment{}},
+	"GET /customer/orders/{id}/tracking":         {Summary: "Track own order", Auth: authRequired, Permission: PermViewOwnOrders, Response: []ShipmentTracking{}},
+	"GET /customer/orders/{id}/invoice.pdf":      {Summary: "Get own order invoice", Auth: authRequired, Permission: PermViewOwnOrders, Query: []string{"delivery"}, ResponseType: "application/pdf", Link: true},
+	"GET /customer/addresses":                    {Summary: "List addresses", Auth: authRequired, Permission: PermPlaceOrder, Response: []Address{}},
+	"POST /customer/addresses":                   {Summary: "Create address", Auth: authRequired, Permission: PermPlaceOrder, Request: AddressRequest{}, Status: http.StatusCreated, Response: Address{}},
+	"PUT /customer/addresses/{id}":               {Summary: "Update address", Auth: authRequired, Permission: PermPlaceOrder, Request: AddressRequest{}, Response: Address{}},
+	"DELETE /customer/addresses/{id}":            {Summary: "Delete address", Auth: authRequired, Permission: PermPlaceOrder, Status: http.StatusNoContent},
+	"GET /customer/payment-methods":              {Summary: "List saved payment methods", Auth: authRequired, Permission: PermPlaceOrder, Response: []SavedPaymentMethod{}},
+	"POST /customer/payment-methods":             {Summary: "Save payment method", Auth: authRequired, Permission: PermPlaceOrder, Request: SavePaymentMethodRequest{}, Status: http.StatusCreated, Response: SavedPaymentMethod{}},
+	"DELETE /customer/payment-methods/{id}":      {Summary: "Delete saved payment method", Auth: authRequired, Permission: PermPlaceOrder, ResponseType: "text/plain"},
+	"GET /customer/gift-cards":                   {Summary: "List own gift cards", Auth: authRequired, Permission: PermViewOwnOrders, Response: []GiftCard{}},
+	"GET /customer/loyalty-points":               {Summary: "Get loyalty points", Auth: authRequired, Permission: PermViewOwnOrders, Response: LoyaltyPoints{}},
+	"GET /customer/referral":                     {Summary: "Get referral", Auth: authRequired, Permission: PermPlaceOrder, Response: Referral{}},
+	"GET /customer/notification-preferences":     {Summary: "Get notification preferences", Auth: authRequired, Permission: PermPlaceOrder, Response: NotificationPreferences{}},
+	"PUT /customer/notification-preferences":     {Summary: "Update notification preferences", Auth: authRequired, Permission: PermPlaceOrder, Request: NotificationPreferencesRequest{}, Response: NotificationPreferences{}},
+
+	"GET /admin/orders":                        {Summary: "List orders", Auth: authRequired, Permission: PermViewAllOrders, Query: append([]string{"customer_id", "customer_email"}, orderListQuery...), Response: OrderPage{}},
+	"POST /admin/orders/bulk-status":           {Summary: "Update order statuses", Auth: authRequired, Permission: PermFulfillOrders, Request: BulkOrderStatusRequest{}, Response: BulkOrderStatusResponse{}},
+	"GET /admin/orders/export":                 {Summary: "Export orders", Auth: authRequired, Permission: PermViewAllOrders, Query: reportRangeTail, Download: true, Link: true},
+	"PATCH /admin/orders/{id}":                 {Summary: "Edit order", Auth: authRequired, Permission: PermFulfillOrders, Request: OrderEditRequest{}, Response: OrderWithProducts{}},
+	"POST /admin/orders/{id}/mark-paid":        {Summary: "Mark order paid", Auth: authRequired, Permission: PermManagePayments, Request: MarkPaidRequest{}, Response: Payment{}},
+	"POST /admin/orders/{id}/refund":           {Summary: "Refund order", Auth: authRequired, Permission: PermRefundOrders, Request: RefundRequest{}, Status: http.StatusCreated, Response: []Refund{}},
+	"GET /admin/orders/{id}/shipments":         {Summary: "List order shipments", Auth: authRequired, Permission: PermViewAllOrders, Response: OrderFulfillment{}},
+	"GET /admin/orders/{id}/invoice.pdf":       {Summary: "Get order invoice", Auth: authRequired, Permission: PermViewAllOrders, Query: []string{"delivery"}, ResponseType: "application/pdf", Link: true},
+	"POST /admin/orders/{id}/shipments":        {Summary: "Create shipment", Auth: authRequired, Permission: PermFulfillOrders, Request: ShipmentRequest{}, Status: http.StatusCreated, Response: Shipment{}},
+	"POST /admin/orders/{id}/ready-for-pickup": {Summary: "Mark order ready for pickup", Auth: authRequired, Permission: PermFulfillOrders, Response: orderStatusResponse{}},
+	"POST /admin/shipments/{id}/label":         {Summary: "Buy shipping label", Auth: authRequired, Permission: PermFulfillOrders, Request: LabelPurchaseRequest{}, Status: http.StatusCreated, Response: Shipment{}},
+
+	"POST /admin/products":                                     {Summary: "Create product", Auth: authRequired, Permission: PermManageProducts, Request: ProductRequest{}, Status: http.StatusCreated, Response: Product{}},
+	"POST /admin/products/import":                              {Summary: "Import products", Auth: authRequired, Permission: PermManageProducts, Upload: importFormField, Response: ImportReport{}},
+	"GET /admin/products/{id}":                                 {Summary: "Get product", Auth: authRequired, Permission: PermManageProducts, Response: Product{}, Cacheable: true},
+	"PUT /admin/products/{id}":                                 {Summary: "Update product", Auth: authRequired, Permission: PermManageProducts, Request: ProductRequest{}, Response: Product{}},
+	"DELETE /admin/products/{id}":                              {Summary: "Delete product", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+	"GET /admin/products/{id}/variants":                        {Summary: "List variants", Auth: authRequired, Permission: PermManageProducts, Response: []ProductVariant{}},
+	"POST /admin/products/{id}/variants":                       {Summary: "Create variant", Auth: authRequired, Permission: PermManageProducts, Request: VariantRequest{}, Status: http.StatusCreated, Response: ProductVariant{}},
+	"PUT /admin/products/{id}/variants/{variantID}":            {Summary: "Update variant", Auth: authRequired, Permission: PermManageProducts, Request: VariantRequest{}, Response: ProductVariant{}},
+	"DELETE /admin/products/{id}/variants/{variantID}":         {Summary: "Delete variant", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+	"POST /admin/products/{id}/images":                         {Summary: "Upload product images", Auth: authRequired, Permission: PermManageProducts, Upload: imageFormField, UploadMany: true, Status: http.StatusCreated, Response: []ProductImage{}},
+	"DELETE /admin/products/{id}/images/{imageID}":             {Summary: "Delete product image", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+	"GET /admin/products/{id}/price-schedules":                 {Summary: "List price schedules", Auth: authRequired, Permission: PermManageProducts, Response: []PriceSchedule{}},
+	"POST /admin/products/{id}/price-schedules":                {Summary: "Create price schedule", Auth: authRequired, Permission: PermManageProducts, Request: PriceScheduleRequest{}, Status: http.StatusCreated, Response: PriceSchedule{}},
+	"DELETE /admin/products/{id}/price-schedules/{scheduleID}": {Summary: "Delete price schedule", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+	"GET /admin/products/{id}/price-history":                   {Summary: "List price history", Auth: authRequired, Permission: PermManageProducts, Response: []PriceChange{}},
+	"PUT /admin/products/{id}/warehouses/{warehouseID}":        {Summary: "Set warehouse stock", Auth: authRequired, Permission: PermManageProducts, Request: WarehouseStockRequest{}, Response: []WarehouseStock{}},
+	"POST /admin/products/{id}/stock-adjustments":              {Summary: "Adjust stock", Auth: authRequired, Permission: PermManageProducts, Request: StockAdjustmentRequest{}, Status: http.StatusCreated, Response: StockMovement{}},
+	"GET /admin/stock-movements":                               {Summary: "List stock movements", Auth: authRequired, Permission: PermManageProducts, Query: []string{"product_id", "sort", "date_from", "date_to", "page", "limit", "fields"}, Response: StockMovementPage{}},
+	"POST /admin/inventory/sync":                               {Summary: "Sync inventory", Auth: authRequired, Permission: PermManageProducts, Request: []InventorySyncItem{}, RequestCSV: true, Response: InventorySyncReport{}},
+
+	"GET /admin/reports/reconciliation":       {Summary: "Get reconciliation report", Auth: authRequired, Permission: PermViewReports, Query: []string{"date"}, Response: ReconciliationReport{}},
+	"GET /admin/reports/inventory-forecast":   {Summary: "Get inventory forecast", Auth: authRequired, Permission: PermViewReports, Query: []string{"days", "lead_time"}, Response: []InventoryForecast{}},
+	"GET /admin/reports/sales":                {Summary: "Get sales report", Auth: authRequired, Permission: PermViewReports, Query: append([]string{"group_by"}, reportRangeTail...), Response: []SalesReportBucket{}, Download: true, Link: true},
+	"GET /admin/reports/products":             {Summary: "Get product report", Auth: authRequired, Permission: PermViewReports, Query: []string{"metric", "order", "period:integer", "limit"}, Response: []ProductSales{}},
+	"GET /admin/reports/customers":            {Summary: "Get customer report", Auth: authRequired, Permission: PermViewReports, Query: []string{"group_by", "sort", "page", "limit"}, Response: CustomerValuePage{}},
+	"GET /admin/reports/tax":                  {Summary: "Get tax report", Auth: authRequired, Permission: PermViewReports, Query: []string{"period", "format", "delivery"}, Response: TaxReport{}, Download: true, Link: true},
+	"GET /admin/dashboard":                    {Summary: "Get dashboard", Auth: authRequired, Permission: PermViewReports, Response: Dashboard{}},
+	"GET /admin/report-subscriptions":         {Summary: "List report subscriptions", Auth: authRequired, Permission: PermViewReports, Response: []ReportSubscription{}},
+	"POST /admin/report-subscriptions":        {Summary: "Create report subscription", Auth: authRequired, Permission: PermViewReports, Request: ReportSubscriptionRequest{}, Status: http.StatusCreated, Response: ReportSubscription{}},
+	"PUT /admin/report-subscriptions/{id}":    {Summary: "Update report subscription", Auth: authRequired, Permission: PermViewReports, Request: ReportSubscriptionRequest{}, Response: ReportSubscription{}},
+	"DELETE /admin/report-subscriptions/{id}": {Summary: "Delete report subscription", Auth: authRequired, Permission: PermViewReports, Status: http.StatusNoContent},
+
+	"GET /admin/tax-rates":                  {Summary: "List tax rates", Auth: authRequired, Permission: PermManageProducts, Response: []TaxRate{}},
+	"POST /admin/tax-rates":                 {Summary: "Set tax rate", Auth: authRequired, Permission: PermManageProducts, Request: TaxRateRequest{}, Response: TaxRate{}},
+	"DELETE /admin/tax-rates/{id}":          {Summary: "Delete tax rate", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+	"GET /admin/shipping-zones":             {Summary: "List shipping zones", Auth: authRequired, Permission: PermManageProducts, Response: []ShippingZone{}},
+	"POST /admin/shipping-zones":            {Summary: "Create shipping zone", Auth: authRequired, Permission: PermManageProducts, Request: ShippingZoneRequest{}, Status: http.StatusCreated, Response: ShippingZone{}},
+	"PUT /admin/shipping-zones/{id}":        {Summary: "Update shipping zone", Auth: authRequired, Permission: PermManageProducts, Request: ShippingZoneRequest{}, Response: ShippingZone{}},
+	"DELETE /admin/shipping-zones/{id}":     {Summary: "Delete shipping zone", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+	"POST /admin/shipping-zones/{id}/rates": {Summary: "Create shipping rate", Auth: authRequired, Permission: PermManageProducts, Request: ShippingRateRequest{}, Status: http.StatusCreated, Response: ShippingRate{}},
+	"PUT /admin/shipping-rates/{id}":        {Summary: "Update shipping rate", Auth: authRequired, Permission: PermManageProducts, Request: ShippingRateRequest{}, Response: ShippingRate{}},
+	"DELETE /admin/shipping-rates/{id}":     {Summary: "Delete shipping rate", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+	"GET /admin/shipping-methods":           {Summary: "List shipping methods", Auth: authRequired, Permission: PermManageProducts, Response: []ShippingMethod{}},
+	"POST /admin/shipping-methods":          {Summary: "Create shipping method", Auth: authRequired, Permission: PermManageProducts, Request: ShippingMethodRequest{}, Status: http.StatusCreated, Response: ShippingMethod{}},
+	"PUT /admin/shipping-methods/{id}":      {Summary: "Update shipping method", Auth: authRequired, Permission: PermManageProducts, Request: ShippingMethodRequest{}, Response: ShippingMethod{}},
+	"DELETE /admin/shipping-methods/{id}":   {Summary: "Delete shipping method", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+
+	"GET /admin/coupons":             {Summary: "List coupons", Auth: authRequired, Permission: PermManageProducts, Response: []Coupon{}},
+	"POST /admin/coupons":            {Summary: "Create coupon", Auth: authRequired, Permission: PermManageProducts, Request: CouponRequest{}, Status: http.StatusCreated, Response: Coupon{}},
+	"PUT /admin/coupons/{id}":        {Summary: "Update coupon", Auth: authRequired, Permission: PermManageProducts, Request: CouponRequest{}, Response: Coupon{}},
+	"DELETE /admin/coupons/{id}":     {Summary: "Delete coupon", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+	"GET /admin/promotions":          {Summary: "List promotions", Auth: authRequired, Permission: PermManageProducts, Response: []Promotion{}},
+	"POST /admin/promotions":         {Summary: "Create promotion", Auth: authRequired, Permission: PermManageProducts, Request: PromotionRequest{}, Status: http.StatusCreated, Response: Promotion{}},
+	"PUT /admin/promotions/{id}":     {Summary: "Update promotion", Auth: authRequired, Permission: PermManageProducts, Request: PromotionRequest{}, Response: Promotion{}},
+	"DELETE /admin/promotions/{id}":  {Summary: "Delete promotion", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+	"GET /admin/flash-sales":         {Summary: "List flash sales", Auth: authRequired, Permission: PermManageProducts, Response: []FlashSale{}},
+	"POST /admin/flash-sales":        {Summary: "Create flash sale", Auth: authRequired, Permission: PermManageProducts, Request: FlashSaleRequest{}, Status: http.StatusCreated, Response: FlashSale{}},
+	"PUT /admin/flash-sales/{id}":    {Summary: "Update flash sale", Auth: authRequired, Permission: PermManageProducts, Request: FlashSaleRequest{}, Response: FlashSale{}},
+	"DELETE /admin/flash-sales/{id}": {Summary: "Delete flash sale", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+
+	"GET /admin/customer-groups":          {Summary: "List customer groups", Auth: authRequired, Permission: PermManageProducts, Response: []CustomerGroup{}},
+	"POST /admin/customer-groups":         {Summary: "Create customer group", Auth: authRequired, Permission: PermManageProducts, Request: CustomerGroupRequest{}, Status: http.StatusCreated, Response: CustomerGroup{}},
+	"PUT /admin/customer-groups/{id}":     {Summary: "Update customer group", Auth: authRequired, Permission: PermManageProducts, Request: CustomerGroupRequest{}, Response: CustomerGroup{}},
+	"DELETE /admin/customer-groups/{id}":  {Summary: "Delete customer group", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+	"GET /admin/gift-cards":               {Summary: "List gift cards", Auth: authRequired, Permission: PermManagePayments, Response: []GiftCard{}},
+	"POST /admin/gift-cards":              {Summary: "Issue gift card", Auth: authRequired, Permission: PermManagePayments, Request: IssueGiftCardRequest{}, Status: http.StatusCreated, Response: GiftCard{}},
+	"GET /admin/gift-cards/{id}":          {Summary: "Get gift card", Auth: authRequired, Permission: PermManagePayments, Response: GiftCard{}},
+	"GET /admin/pickup-locations":         {Summary: "List all pickup locations", Auth: authRequired, Permission: PermManageProducts, Response: []PickupLocation{}},
+	"POST /admin/pickup-locations":        {Summary: "Create pickup location", Auth: authRequired, Permission: PermManageProducts, Request: PickupLocationRequest{}, Status: http.StatusCreated, Response: PickupLocation{}},
+	"PUT /admin/pickup-locations/{id}":    {Summary: "Update pickup location", Auth: authRequired, Permission: PermManageProducts, Request: PickupLocationRequest{}, Response: PickupLocation{}},
+	"DELETE /admin/pickup-locations/{id}": {Summary: "Delete pickup location", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+	"GET /admin/warehouses":               {Summary: "List warehouses", Auth: authRequired, Permission: PermManageProducts, Response: []Warehouse{}},
+	"POST /admin/warehouses":              {Summary: "Create warehouse", Auth: authRequired, Permission: PermManageProducts, Request: WarehouseRequest{}, Status: http.StatusCreated, Response: Warehouse{}},
+	"PUT /admin/warehouses/{id}":          {Summary: "Update warehouse", Auth: authRequired, Permission: PermManageProducts, Request: WarehouseRequest{}, Response: Warehouse{}},
+	"POST /admin/categories":              {Summary: "Create category", Auth: authRequired, Permission: PermManageProducts, Request: models.CategoryRequest{}, Status: http.StatusCreated, Response: models.Category{}},
+	"PUT /admin/categories/{id}":          {Summary: "Update category", Auth: authRequired, Permission: PermManageProducts, Request: models.CategoryRequest{}, Response: models.Category{}},
+	"DELETE /admin/categories/{id}":       {Summary: "Delete category", Auth: authRequired, Permission: PermManageProducts, Status: http.StatusNoContent},
+	"GET /admin/payment-methods":          {Summary: "List offline payment methods", Auth: authRequired, Permission: PermManagePayments, Response: []OfflinePaymentMethod{}},
+	"POST /admin/payment-methods":         {Summary: "Create offline payment method", Auth: authRequired, Permission: PermManagePayments, Request: OfflinePaymentMethodRequest{}, Status: http.StatusCreated, Response: OfflinePaymentMethod{}},
+	"PUT /admin/payment-methods/{id}":     {Summary: "Update offline payment method", Auth: authRequired, Permission: PermManagePayments, Request: OfflinePaymentMethodRequest{}, Response: OfflinePaymentMethod{}},
+	"DELETE /admin/payment-methods/{id}":  {Summary: "Delete offline payment method", Auth: authRequired, Permission: PermManagePayments, ResponseType: "text/plain"},
+
+	"GET /admin/roles":                         {Summary: "List roles", Auth: authRequired, Permission: PermManageRoles, Response: []Role{}},
+	"POST /admin/roles":                        {Summary: "Create role", Auth: authRequired, Permission: PermManageRoles, Request: Role{}, Response: Role{}},
+	"PUT /admin/roles/{name}":                  {Summary: "Update role", Auth: authRequired, Permission: PermManageRoles, Request: Role{}, Response: Role{}},
+	"PUT /admin/customers/{id}/role":           {Summary: "Assign role", Auth: authRequired, Permission: PermManageRoles, Request: AssignRoleRequest{}, ResponseType: "text/plain"},
+	"PUT /admin/customers/{id}/group":          {Summary: "Assign customer group", Auth: authRequired, Permission: PermManageRoles, Request: AssignGroupRequest{}, ResponseType: "text/plain"},
+	"GET /admin/api-keys":                      {Summary: "List API keys", Auth: authRequired, Permission: PermManageAPIKeys, Response: []APIKey{}},
+	"POST /admin/api-keys":                     {Summary: "Create API key", Auth: authRequired, Permission: PermManageAPIKeys, Request: CreateAPIKeyRequest{}, Status: http.StatusCreated, Response: CreateAPIKeyResponse{}},
+	"DELETE /admin/api-keys/{id}":              {Summary: "Revoke API key", Auth: authRequired, Permission: PermManageAPIKeys, ResponseType: "text/plain"},
+	"GET /admin/webhooks":                      {Summary: "List webhooks", Auth: authRequired, Permission: PermManageAPIKeys, Response: []WebhookEndpoint{}},
+	"POST /admin/webhooks":                     {Summary: "Create webhook", Auth: authRequired, Permission: PermManageAPIKeys, Request: WebhookEndpointRequest{}, Status: http.StatusCreated, Response: CreateWebhookEndpointResponse{}},
+	"PUT /admin/webhooks/{id}":                 {Summary: "Update webhook", Auth: authRequired, Permission: PermManageAPIKeys, Request: WebhookEndpointRequest{}, Response: WebhookEndpoint{}},
+	"DELETE /admin/webhooks/{id}":              {Summary: "Delete webhook", Auth: authRequired, Permission: PermManageAPIKeys, Status: http.StatusNoContent},
+	"GET /admin/webhooks/{id}/deliveries":      {Summary: "List webhook deliveries", Auth: authRequired, Permission: PermManageAPIKeys, Response: []WebhookDelivery{}},
+	"GET /admin/email-suppressions":            {Summary: "List email suppressions", Auth: authRequired, Permission: PermManageRoles, Response: []EmailSuppression{}},
+	"DELETE /admin/email-suppressions/{email}": {Summary: "Delete email suppression", Auth: authRequired, Permission: PermManageRoles, Status: http.StatusNoContent},
+}
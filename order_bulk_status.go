@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// maxBulkOrderStatusOrders limits how many orders one bulk status update moves
+const maxBulkOrderStatusOrders = 100
+
+// bulkOrderStatusUpdates move one order to the status they are keyed by, with the rules and side
+// effects of that status's single-order endpoint. Statuses that need more than the order, such
+// as Shipped with its tracking number, aren't offered in bulk.
+var bulkOrderStatusUpdates = map[string]func(ctx context.Context, orderID int) error{
+	orderStatusCancelled:      bulkCancelOrder,
+	orderStatusReadyForPickup: bulkMarkReadyForPickup,
+	orderStatusPaid:           bulkMarkOrderPaid,
+}
+
+// bulkOrderStatusPermissions are what moving orders to a status needs beyond orders.fulfill,
+// like its single-order endpoint does
+var bulkOrderStatusPermissions = map[string]string{
+	orderStatusPaid: PermManagePayments,
+}
+
+type BulkOrderStatusRequest struct {
+	OrderIDs []int  `json:"order_ids"`
+	Status   string `json:"status"`
+}
+
+// BulkOrderStatusResult is the outcome for one order; Status is its status afterwards, which
+// is the one it stayed in when it couldn't move
+type BulkOrderStatusResult struct {
+	OrderID int                `json:"order_id"`
+	Success bool               `json:"success"`
+	Status  string             `json:"status,omitempty"`
+	Error   *handlers.APIError `json:"error,omitempty"`
+}
+
+type BulkOrderStatusResponse struct {
+	Status  string                  `json:"status"`
+	Updated int                     `json:"updated"`
+	Failed  int                     `json:"failed"`
+	Results []BulkOrderStatusResult `json:"results"`
+}
+
+// ADMIN BULK ORDER STATUS
+// AdminBulkOrderStatusHandler moves each of the orders to the status on its own, so one order
+// that can't move doesn't stop the others
+func AdminBulkOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var bulkRequest BulkOrderStatusRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &bulkRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	// Statuses are matched ignoring case, like status filters
+	status := ""
+	var statuses []string
+	for s := range bulkOrderStatusUpdates {
+		if strings.EqualFold(s, strings.TrimSpace(bulkRequest.Status)) {
+			status = s
+		}
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	if status == "" {
+		handlers.WriteValidationError(w, handlers.NewFieldError("status", "status must be one of "+strings.Join(statuses, ", ")))
+		return
+	}
+
+	if len(bulkRequest.OrderIDs) == 0 || len(bulkRequest.OrderIDs) > maxBulkOrderStatusOrders {
+		handlers.WriteValidationError(w, handlers.FieldErrorf("order_ids", "order_ids must list 1 to %d orders", maxBulkOrderStatusOrders))
+		return
+	}
+	seen := make(map[int]bool)
+	for i, orderID := range bulkRequest.OrderIDs {
+		if orderID <= 0 {
+			handlers.WriteValidationError(w, handlers.FieldErrorf(fmt.Sprintf("order_ids[%d]", i), "order_ids[%d] must be a positive integer", i))
+			return
+		}
+		if seen[orderID] {
+			handlers.WriteValidationError(w, handlers.FieldErrorf(fmt.Sprintf("order_ids[%d]", i), "order_ids[%d] repeats order %d", i, orderID))
+			return
+		}
+		seen[orderID] = true
+	}
+
+	if permission, ok := bulkOrderStatusPermissions[status]; ok {
+		allowed, err := requestHasPermission(r, permission)
+		if err != nil {
+			log.Println("Error checking permission:", err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		if !allowed {
+			handlers.WriteError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+	}
+
+	response := BulkOrderStatusResponse{Status: status, Results: make([]BulkOrderStatusResult, 0, len(bulkRequest.OrderIDs))}
+	for _, orderID := range bulkRequest.OrderIDs {
+		result := BulkOrderStatusResult{OrderID: orderID}
+		// The order's current status is held to the single-order endpoint's transitions before
+		// anything else; the endpoint's function checks it again as it moves the order
+		err := db.QueryRowContext(r.Context(), "SELECT status FROM orders WHERE id = $1", orderID).Scan(&result.Status)
+		if err == nil {
+			err = checkOrderStatusTransition(result.Status, status)
+		}
+		if err == nil {
+			err = bulkOrderStatusUpdates[status](r.Context(), orderID)
+		}
+		if err == nil {
+			err = db.QueryRowContext(r.Context(), "SELECT status FROM orders WHERE id = $1", orderID).Scan(&result.Status)
+		}
+		switch {
+		case err == nil:
+			result.Success = true
+			response.Updated++
+		case isNoRows(err):
+			result.Status = ""
+			result.Error = &handlers.APIError{Code: "not_found", Message: "Order not found"}
+		case errors.Is(err, errOrderNotPending) || errors.Is(err, errNotPickupOrder) ||
+			errors.Is(err, errOrderNotReadyForPickup) || errors.Is(err, errOrderNotAwaitingPayment):
+			result.Error = &handlers.APIError{Code: "conflict", Message: err.Error()}
+		default:
+			log.Printf("Error moving order %d to %s: %v", orderID, status, err)
+			result.Error = &handlers.APIError{Code: "internal_server_error", Message: "Internal Server Error"}
+		}
+		if !result.Success {
+			response.Failed++
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, response)
+}
+
+// bulkCancelOrder cancels the order like its customer can, and emails them
+func bulkCancelOrder(ctx context.Context, orderID int) error {
+	email, err := cancelOrder(ctx, orderID, nil)
+	if err != nil {
+		return err
+	}
+	if err := sendEmail(ctx, email, emailOrderCancelled, orderCancelledEmailKey(orderID), orderEmail{OrderID: orderID}); err != nil {
+		log.Printf("Error sending cancellation email to %s for order %d: %v", email, orderID, err)
+	}
+	return nil
+}
+
+func bulkMarkReadyForPickup(ctx context.Context, orderID int) error {
+	email, location, err := markReadyForPickup(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	sendReadyForPickupEmail(ctx, email, orderID, location)
+	return nil
+}
+
+// bulkMarkOrderPaid confirms the order's offline payment without a reference
+func bulkMarkOrderPaid(ctx context.Context, orderID int) error {
+	_, err := markOrderPaid(ctx, orderID, "")
+	return err
+}
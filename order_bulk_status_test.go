@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckOrderStatusTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     error
+	}{
+		{orderStatusPending, orderStatusCancelled, nil},
+		{orderStatusAwaitingPayment, orderStatusCancelled, nil},
+		{orderStatusDelivered, orderStatusCancelled, errOrderNotPending},
+		{orderStatusPaid, orderStatusReadyForPickup, nil},
+		{orderStatusShipped, orderStatusReadyForPickup, errOrderNotReadyForPickup},
+		{orderStatusDelivered, orderStatusPaid, nil},
+		{orderStatusCancelled, orderStatusPaid, errOrderNotAwaitingPayment},
+	}
+	for _, tt := range tests {
+		if err := checkOrderStatusTransition(tt.from, tt.to); err != tt.want {
+			t.Errorf("checkOrderStatusTransition(%q, %q) = %v, want %v", tt.from, tt.to, err, tt.want)
+		}
+	}
+
+	// Statuses without a single-order endpoint can't be reached in bulk either
+	err := checkOrderStatusTransition(orderStatusDelivered, orderStatusPending)
+	if err == nil || errors.Is(err, errOrderNotPending) {
+		t.Errorf("checkOrderStatusTransition(Delivered, Pending) = %v, want an error", err)
+	}
+}
+
+func TestBulkOrderStatusesHaveTransitions(t *testing.T) {
+	for status := range bulkOrderStatusUpdates {
+		if _, ok := orderStatusTransitions[status]; !ok {
+			t.Errorf("bulk status %q has no transition rules", status)
+		}
+	}
+}
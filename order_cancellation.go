@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const orderStatusCancelled = "Cancelled"
+
+var errOrderNotPending = errors.New("only pending or unpaid orders can be cancelled")
+
+// CUSTOMER CANCEL ORDER
+// CustomerCancelOrderHandler cancels one of the customer's pending orders and returns its stock
+func CustomerCancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	customerID := getCustomerID(r)
+	email, err := cancelOrder(r.Context(), orderID, &customerID)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if err == errOrderNotPending {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error cancelling order:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if err := sendEmail(r.Context(), email, emailOrderCancelled, orderCancelledEmailKey(orderID), orderEmail{OrderID: orderID}); err != nil {
+		log.Printf("Error sending cancellation email to %s for order %d: %v", email, orderID, err)
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, map[string]interface{}{"order_id": orderID, "status": orderStatusCancelled})
+}
+
+// cancelOrder marks the customer's pending order as cancelled, puts its units back into stock
+// and into the warehouses they were allocated from, voids its pending payments and refunds what
+// gift cards already paid of it. A nil customerID cancels any customer's order. It returns the
+// customer's email.
+func cancelOrder(ctx context.Context, orderID int, customerID *int) (string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var status, email string
+	err = tx.QueryRowContext(ctx, `
+		SELECT o.status, c.email
+		FROM orders o
+		JOIN customers c ON o.customer_id = c.id
+		WHERE o.id = $1 AND ($2::INTEGER IS NULL OR o.customer_id = $2)
+		FOR UPDATE OF o
+	`, orderID, customerID).Scan(&status, &email)
+	if err != nil {
+		return "", err
+	}
+	if err := checkOrderStatusTransition(status, orderStatusCancelled); err != nil {
+		return "", err
+	}
+
+	if err := setOrderStatus(ctx, tx, orderID, orderStatusCancelled); err != nil {
+		return "", err
+	}
+	if err := restockOrder(ctx, tx, orderID); err != nil {
+		return "", err
+	}
+	// The coupon's use is given back; the order keeps its discount
+	if _, err := tx.ExecContext(ctx, "DELETE FROM coupon_redemptions WHERE order_id = $1", orderID); err != nil {
+		return "", err
+	}
+	if err := returnOrderPoints(ctx, tx, orderID); err != nil {
+		return "", err
+	}
+	// A payment the customer hasn't finished yet is refunded by refundLateCapture if its
+	// provider still reports it captured
+	_, err = tx.ExecContext(ctx, "UPDATE payments SET status = $1, updated_at = NOW() WHERE order_id = $2 AND status = $3",
+		paymentStatusVoided, orderID, paymentStatusPending)
+	if err != nil {
+		return "", err
+	}
+	// A split payment whose card charge failed has already taken the gift card's part
+	if err := refundGiftCardPayments(ctx, tx, orderID); err != nil {
+		return "", err
+	}
+
+	return email, tx.Commit()
+}
+
+// refundLateCapture refunds what was captured of an order after it was cancelled, such as a
+// PayPal payment approved once the order was gone. A refund its provider rejects is left for an
+// admin to retry with Admin Refund Order.
+func refundLateCapture(ctx context.Context, orderID int) {
+	if _, err := refundOrder(ctx, orderID, RefundRequest{Reason: "Order cancelled"}); err != nil {
+		log.Printf("Error refunding payment captured after order %d was cancelled: %v", orderID, err)
+	}
+}
+
+// restockOrder returns the order's units to stock and releases its warehouse allocations
+func restockOrder(ctx context.Context, tx *sql.Tx, orderID int) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT product_id, SUM(quantity)
+		FROM order_products
+		WHERE order_id = $1
+		GROUP BY product_id
+		ORDER BY product_id
+	`, orderID)
+	if err != nil {
+		return err
+	}
+	units := make(map[int]int)
+	var productIDs []int
+	for rows.Next() {
+		var productID, quantity int
+		if err := rows.Scan(&productID, &quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		units[productID] = quantity
+		productIDs = append(productIDs, productID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, productID := range productIDs {
+		if _, err := adjustStock(ctx, tx, productID, units[productID], stockReasonOrderCancelled, &orderID, ""); err != nil {
+			return err
+		}
+	}
+
+	return releaseAllocations(ctx, tx, orderID)
+}
+
+// releaseAllocations returns the order's allocated units to their warehouses
+func releaseAllocations(ctx context.Context, tx *sql.Tx, orderID int) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE warehouse_stock ws
+		SET quantity = ws.quantity + oa.quantity
+		FROM order_allocations oa
+		WHERE oa.order_id = $1 AND ws.product_id = oa.product_id AND ws.warehouse_id = oa.warehouse_id
+	`, orderID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM order_allocations WHERE order_id = $1", orderID)
+	return err
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// openTestDB connects to the database named by TEST_DATABASE_URL and migrates it, or skips the
+// test without one. The tests leave their rows behind, so point it at a throwaway database.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	var err error
+	db, err = sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrateUp(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingGateway declines every charge
+type failingGateway struct{}
+
+func (failingGateway) Charge(ctx context.Context, charge PaymentCharge) (*PaymentResult, error) {
+	return nil, errors.New("card declined")
+}
+
+func (failingGateway) Capture(ctx context.Context, reference string) (*PaymentResult, error) {
+	return nil, errors.New("card declined")
+}
+
+func (failingGateway) Refund(ctx context.Context, refund PaymentRefund) (string, error) {
+	return "", errors.New("card declined")
+}
+
+func TestCancelOrderRefundsSplitGiftCardPayment(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	paymentGateways["test_failing"] = failingGateway{}
+	t.Cleanup(func() { delete(paymentGateways, "test_failing") })
+
+	suffix := time.Now().UnixNano()
+	var customerID, orderID int
+	err := db.QueryRowContext(ctx, "INSERT INTO customers (name, email, password) VALUES ('Test', $1, 'x') RETURNING id",
+		fmt.Sprintf("split-%d@example.com", suffix)).Scan(&customerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRowContext(ctx, "INSERT INTO orders (customer_id, date, status, total) VALUES ($1, NOW(), $2, 50) RETURNING id",
+		customerID, orderStatusPending).Scan(&orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := fmt.Sprintf("SPLIT%d", suffix)
+	_, err = db.ExecContext(ctx, "INSERT INTO gift_cards (code, initial_balance, balance, currency) VALUES ($1, 30, 30, $2)",
+		code, paymentConfig.Currency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance := func() float64 {
+		t.Helper()
+		var balance float64
+		if err := db.QueryRowContext(ctx, "SELECT balance FROM gift_cards WHERE code = $1", code).Scan(&balance); err != nil {
+			t.Fatal(err)
+		}
+		return balance
+	}
+
+	giftCardPayment, cardPayment, err := payOrderSplit(ctx, orderID, PaymentRequest{Provider: "test_failing", GiftCardCode: code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if giftCardPayment == nil || giftCardPayment.Amount != 30 {
+		t.Fatalf("gift card payment = %+v, want 30 captured", giftCardPayment)
+	}
+	if cardPayment == nil || cardPayment.Status != paymentStatusFailed {
+		t.Fatalf("card payment = %+v, want failed", cardPayment)
+	}
+	if got := balance(); got != 0 {
+		t.Fatalf("balance after split payment = %v, want 0", got)
+	}
+
+	if _, err := cancelOrder(ctx, orderID, &customerID); err != nil {
+		t.Fatal(err)
+	}
+	if got := balance(); got != 30 {
+		t.Errorf("balance after cancelling = %v, want 30", got)
+	}
+	var paymentStatus string
+	if err := db.QueryRowContext(ctx, "SELECT status FROM payments WHERE id = $1", giftCardPayment.ID).Scan(&paymentStatus); err != nil {
+		t.Fatal(err)
+	}
+	if paymentStatus != paymentStatusRefunded {
+		t.Errorf("gift card payment status = %q, want %q", paymentStatus, paymentStatusRefunded)
+	}
+
+	// Cancelling refunds the card once, so a second attempt has nothing left to give back
+	if _, err := cancelOrder(ctx, orderID, &customerID); err != errOrderNotPending {
+		t.Errorf("second cancel error = %v, want %v", err, errOrderNotPending)
+	}
+	if got := balance(); got != 30 {
+		t.Errorf("balance after second cancel = %v, want 30", got)
+	}
+}
+
+// refundingGateway accepts every refund and remembers what it refunded
+type refundingGateway struct {
+	failingGateway
+	refunded []PaymentRefund
+}
+
+func (g *refundingGateway) Refund(ctx context.Context, refund PaymentRefund) (string, error) {
+	g.refunded = append(g.refunded, refund)
+	return fmt.Sprintf("re_%d", refund.RefundID), nil
+}
+
+func TestCancelOrderRefundsLateCapture(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	gateway := &refundingGateway{}
+	paymentGateways["test_refunding"] = gateway
+	t.Cleanup(func() { delete(paymentGateways, "test_refunding") })
+
+	suffix := time.Now().UnixNano()
+	var customerID, orderID, paymentID int
+	err := db.QueryRowContext(ctx, "INSERT INTO customers (name, email, password) VALUES ('Test', $1, 'x') RETURNING id",
+		fmt.Sprintf("late-%d@example.com", suffix)).Scan(&customerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRowContext(ctx, "INSERT INTO orders (customer_id, date, status, total) VALUES ($1, NOW(), $2, 40) RETURNING id",
+		customerID, orderStatusPending).Scan(&orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference := fmt.Sprintf("pay_%d", suffix)
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO payments (order_id, provider, reference, amount, currency, status)
+		VALUES ($1, 'test_refunding', $2, 40, $3, $4)
+		RETURNING id
+	`, orderID, reference, paymentConfig.Currency, paymentStatusPending).Scan(&paymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paymentStatus := func() string {
+		t.Helper()
+		var status string
+		if err := db.QueryRowContext(ctx, "SELECT status FROM payments WHERE id = $1", paymentID).Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	if _, err := cancelOrder(ctx, orderID, &customerID); err != nil {
+		t.Fatal(err)
+	}
+	if got := paymentStatus(); got != paymentStatusVoided {
+		t.Fatalf("payment status after cancelling = %q, want %q", got, paymentStatusVoided)
+	}
+
+	// The customer finishes paying after all, and the provider reports the capture
+	event := &PaymentEvent{ID: fmt.Sprintf("evt_%d", suffix), Type: paymentEventSucceeded, Reference: reference,
+		CaptureReference: fmt.Sprintf("cap_%d", suffix)}
+	notification, cancelledOrderID, err := processPaymentEvent(ctx, "test_refunding", event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notification != nil || cancelledOrderID != orderID {
+		t.Fatalf("processPaymentEvent() = %+v, %d; want no email and order %d to refund", notification, cancelledOrderID, orderID)
+	}
+	refundLateCapture(ctx, cancelledOrderID)
+
+	if len(gateway.refunded) != 1 || gateway.refunded[0].Amount != 40 || gateway.refunded[0].CaptureReference != event.CaptureReference {
+		t.Errorf("refunds = %+v, want 40 of %s", gateway.refunded, event.CaptureReference)
+	}
+	if got := paymentStatus(); got != paymentStatusRefunded {
+		t.Errorf("payment status after the late capture = %q, want %q", got, paymentStatusRefunded)
+	}
+	var orderStatus string
+	if err := db.QueryRowContext(ctx, "SELECT status FROM orders WHERE id = $1", orderID).Scan(&orderStatus); err != nil {
+		t.Fatal(err)
+	}
+	if orderStatus != orderStatusCancelled {
+		t.Errorf("order status = %q, want it to stay %q", orderStatus, orderStatusCancelled)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errInvalidOrderEdit = errors.New("invalid order edit")
+var errOrderNotEditable = errors.New("only pending orders can be edited")
+
+// OrderEditRequest is the body of PATCH /admin/orders/{id}
+type OrderEditRequest struct {
+	Products []OrderLineEdit `json:"products"`
+}
+
+// OrderLineEdit sets the quantity of one order line. A line the order doesn't have yet is
+// added at the current price; quantity 0 removes the line.
+type OrderLineEdit struct {
+	ProductID int  `json:"product_id"`
+	VariantID *int `json:"variant_id"`
+	Quantity  *int `json:"quantity"`
+}
+
+// ADMIN EDIT ORDER
+// AdminEditOrderHandler changes the lines of a pending order. Stock, warehouse allocations
+// and the order totals are updated in the same transaction.
+func AdminEditOrderHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var editRequest OrderEditRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &editRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	if err := validateOrderEdit(r.Context(), editRequest); err != nil {
+		if isOrderValidationError(err) {
+			handlers.WriteValidationError(w, err)
+			return
+		}
+		log.Println("Error validating order edit:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	customerID, err := editOrder(r.Context(), orderID, editRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if errors.Is(err, errInvalidOrderEdit) {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err == errOrderNotEditable || errors.Is(err, errInsufficientStock) {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error editing order:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	order, err := getOrderDetails(r.Context(), orderID, customerID)
+	if err != nil {
+		log.Println("Error retrieving order details:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, order)
+}
+
+func validateOrderEdit(ctx context.Context, req OrderEditRequest) error {
+	if len(req.Products) == 0 {
+		return handlers.NewFieldError("products", "at least one product is required")
+	}
+
+	seen := make(map[[2]int]bool)
+	for i, edit := range req.Products {
+		if edit.Quantity == nil || *edit.Quantity < 0 {
+			return handlers.NestFieldError(fmt.Sprintf("products[%d]", i), handlers.NewFieldError("quantity", "quantity is required and must not be negative"))
+		}
+		key := productVariantKey(edit.ProductID, edit.VariantID)
+		if seen[key] {
+			return handlers.NestFieldError(fmt.Sprintf("products[%d]", i), handlers.FieldErrorf("product_id", "product %d is listed twice", edit.ProductID))
+		}
+		seen[key] = true
+
+		if *edit.Quantity > 0 {
+			line := OrderLineRequest{ProductID: edit.ProductID, VariantID: edit.VariantID, Quantity: *edit.Quantity}
+			if err := validateOrderLine(ctx, line); err != nil {
+				return handlers.NestFieldError(fmt.Sprintf("products[%d]", i), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// editOrder applies the edits to a pending order, takes or returns the difference in stock,
+// reallocates the order across warehouses and recomputes its totals. Existing lines keep the
+// price they were ordered at. It returns the order's customer ID.
+func editOrder(ctx context.Context, orderID int, req OrderEditRequest) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var customerID int
+	var status string
+	err = tx.QueryRowContext(ctx, "SELECT customer_id, status FROM orders WHERE id = $1 FOR UPDATE", orderID).Scan(&customerID, &status)
+	if err != nil {
+		return 0, err
+	}
+	if status != orderStatusPending {
+		return 0, errOrderNotEditable
+	}
+
+	before, err := getOrderUnits(ctx, tx, orderID)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, edit := range req.Products {
+		var result sql.Result
+		if *edit.Quantity == 0 {
+			result, err = tx.ExecContext(ctx, `
+				DELETE FROM order_products
+				WHERE order_id = $1 AND product_id = $2 AND variant_id IS NOT DISTINCT FROM $3
+			`, orderID, edit.ProductID, edit.VariantID)
+		} else {
+			result, err = tx.ExecContext(ctx, `
+				UPDATE order_products SET quantity = $4
+				WHERE order_id = $1 AND product_id = $2 AND variant_id IS NOT DISTINCT FROM $3
+			`, orderID, edit.ProductID, edit.VariantID, *edit.Quantity)
+		}
+		if err != nil {
+			return 0, err
+		}
+		changed, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if changed > 0 {
+			continue
+		}
+		if *edit.Quantity == 0 {
+			return 0, fmt.Errorf("%w: products[%d]: product %d is not on the order", errInvalidOrderEdit, i, edit.ProductID)
+		}
+
+		line := OrderLineRequest{ProductID: edit.ProductID, VariantID: edit.VariantID, Quantity: *edit.Quantity}
+		if err := associateProducts(ctx, tx, orderID, []OrderLineRequest{line}); err != nil {
+			return 0, err
+		}
+	}
+
+	after, err := getOrderUnits(ctx, tx, orderID)
+	if err != nil {
+		return 0, err
+	}
+	if len(after) == 0 {
+		return 0, fmt.Errorf("%w: an order must keep at least one product", errInvalidOrderEdit)
+	}
+
+	if err := adjustOrderStock(ctx, tx, orderID, before, after); err != nil {
+		return 0, err
+	}
+	if err := releaseAllocations(ctx, tx, orderID); err != nil {
+		return 0, err
+	}
+	if err := allocateOrder(ctx, tx, orderID, after); err != nil {
+		return 0, err
+	}
+	if err := recalculateOrderTotals(ctx, tx, orderID); err != nil {
+		return 0, err
+	}
+	if err := queueOrderEvent(ctx, tx, orderEventUpdated, orderID); err != nil {
+		return 0, err
+	}
+
+	return customerID, tx.Commit()
+}
+
+// getOrderUnits returns the number of units ordered per product
+func getOrderUnits(ctx context.Context, tx *sql.Tx, orderID int) (map[int]int, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT product_id, SUM(quantity) FROM order_products WHERE order_id = $1 GROUP BY product_id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	units := make(map[int]int)
+	for rows.Next() {
+		var productID, quantity int
+		if err := rows.Scan(&productID, &quantity); err != nil {
+			return nil, err
+		}
+		units[productID] = quantity
+	}
+
+	return units, rows.Err()
+}
+
+// adjustOrderStock takes the extra units an edit added and returns the units it removed
+func adjustOrderStock(ctx context.Context, tx *sql.Tx, orderID int, before, after map[int]int) error {
+	taken := make(map[int]int)
+	returned := make(map[int]int)
+	for productID, quantity := range after {
+		if quantity > before[productID] {
+			taken[productID] = quantity - before[productID]
+		}
+	}
+	for productID, quantity := range before {
+		if quantity > after[productID] {
+			returned[productID] = quantity - after[productID]
+		}
+	}
+
+	if len(taken) > 0 {
+		if err := takeStock(ctx, tx, taken, stockReasonOrderEdited, &orderID); err != nil {
+			return err
+		}
+	}
+	productIDs := make([]int, 0, len(returned))
+	for productID := range returned {
+		productIDs = append(productIDs, productID)
+	}
+	sort.Ints(productIDs)
+	for _, productID := range productIDs {
+		if _, err := adjustStock(ctx, tx, productID, returned[productID], stockReasonOrderEdited, &orderID, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recalculateOrderTotals recomputes the totals of an edited order with the tax rate it was
+// placed with and its shipping method at the current rates. The shipping stays as it was when
+// the method no longer ships the order. The order's promotions and coupon are applied to the
+// edited order, and drop off if the order no longer meets their conditions; without the
+// coupon, as when it was deleted since, its discount is kept, as is the discount of redeemed
+// loyalty points. The discounts apply in the order they did when it was placed, and never take
+// off more than the subtotal.
+func recalculateOrderTotals(ctx context.Context, tx *sql.Tx, orderID int) error {
+	var subtotal, taxRate, shipping, discount, promotionDiscount, pointsDiscount, firstOrderDiscount float64
+	var shippingMethod, couponCode string
+	var destination Destination
+	var couponID sql.NullInt64
+	err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE((SELECT SUM(unit_price_at_purchase * quantity) FROM order_products WHERE order_id = o.id), 0),
+			   COALESCE(o.tax_rate, 0), COALESCE(o.shipping, 0), COALESCE(o.shipping_method, ''), o.discount, COALESCE(o.coupon_code, ''), o.points_discount, o.first_order_discount,
+			   (SELECT COALESCE(SUM(discount), 0) FROM order_promotions WHERE order_id = o.id),
+			   COALESCE(a.country, ''), COALESCE(a.region, ''), COALESCE(a.postal_code, ''),
+			   (SELECT coupon_id FROM coupon_redemptions WHERE order_id = o.id)
+		FROM orders o
+		LEFT JOIN order_addresses a ON a.order_id = o.id AND a.type = $2
+		WHERE o.id = $1
+	`, orderID, addressTypeShipping).Scan(&subtotal, &taxRate, &shipping, &shippingMethod, &discount, &couponCode, &pointsDiscount, &firstOrderDiscount, &promotionDiscount,
+		&destination.Country, &destination.Region, &destination.PostalCode, &couponID)
+	if err != nil {
+		return err
+	}
+
+	// Picking up stays free
+	if shippingMethod != shippingPickup {
+		weight, err := orderWeight(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+		options, err := shippingOptions(ctx, subtotal, weight, destination)
+		if err != nil && err != errNoShippingOptions {
+			return err
+		}
+		for _, option := range options {
+			if option.Code == shippingMethod {
+				shipping = option.Price
+			}
+		}
+	}
+	subtotal = roundCents(subtotal)
+	// What the order's discount took off besides its promotions, first-order discount and points
+	// is the coupon's
+	couponDiscount := math.Max(0, discount-promotionDiscount-firstOrderDiscount-pointsDiscount)
+	if couponID.Valid {
+		coupon, err := getCoupon(ctx, tx, int(couponID.Int64))
+		if err != nil {
+			return err
+		}
+		amounts, err := orderProductAmounts(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+		couponDiscount, err = coupon.orderDiscount(ctx, tx, amounts)
+		if errors.Is(err, errInvalidCoupon) {
+			couponDiscount, err = 0, nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := reapplyOrderPromotions(ctx, tx, orderID); err != nil {
+		return err
+	}
+
+	// The discounts apply again in the order they were placed with
+	breakdown := &discountBreakdown{subtotal: subtotal}
+	promotions, err := tx.QueryContext(ctx, "SELECT name, discount FROM order_promotions WHERE order_id = $1 ORDER BY id", orderID)
+	if err != nil {
+		return err
+	}
+	for promotions.Next() {
+		var name string
+		var amount float64
+		if err := promotions.Scan(&name, &amount); err != nil {
+			promotions.Close()
+			return err
+		}
+		breakdown.add(discountTypePromotion, name, amount)
+	}
+	promotions.Close()
+	if err := promotions.Err(); err != nil {
+		return err
+	}
+	breakdown.add(discountTypeCoupon, couponCode, couponDiscount)
+	firstOrderDiscount = breakdown.add(discountTypeFirstOrder, "", firstOrderDiscount)
+	pointsDiscount = breakdown.add(discountTypePoints, "", pointsDiscount)
+	if err := saveOrderDiscounts(ctx, tx, orderID, breakdown); err != nil {
+		return err
+	}
+	discount = breakdown.total()
+	tax := roundCents((subtotal - discount) * taxRate)
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE orders
+		SET subtotal = $1, discount = $2, tax = $3, shipping = $4, total = $5, first_order_discount = $7, points_discount = $8
+		WHERE id = $6
+	`, subtotal, discount, tax, shipping, roundCents(subtotal-discount+tax+shipping), orderID, firstOrderDiscount, pointsDiscount)
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// orderSortColumns maps the public sort parameter to a safe ORDER BY clause
+var orderSortColumns = map[string]string{
+	"":           "o.date DESC, o.id DESC",
+	"newest":     "o.date DESC, o.id DESC",
+	"oldest":     "o.date ASC, o.id ASC",
+	"total_asc":  "COALESCE(o.total, 0) ASC, o.id ASC",
+	"total_desc": "COALESCE(o.total, 0) DESC, o.id DESC",
+}
+
+// orderListColumns are what the shared list parameters of order lists apply to
+var orderListColumns = listColumns{Sorts: orderSortColumns, Status: "o.status", Date: "o.date", Item: OrderWithProducts{}}
+
+type OrderFilter struct {
+	ListParams
+	CustomerID *int
+	// CustomerEmail matches any part of the customer's email, ignoring case
+	CustomerEmail string
+	// ProductID matches orders with a line for the product
+	ProductID *int
+}
+
+type OrderPage struct {
+	Orders []OrderWithProducts `json:"orders"`
+	Page   int                 `json:"page"`
+	Limit  int                 `json:"limit"`
+	Total  int                 `json:"total"`
+}
+
+func parseOrderFilter(query url.Values) (OrderFilter, error) {
+	params, err := parseListParams(query, orderListColumns)
+	filter := OrderFilter{ListParams: params, CustomerEmail: strings.TrimSpace(query.Get("customer_email"))}
+	if err != nil {
+		return filter, err
+	}
+
+	if v := query.Get("customer_id"); v != "" {
+		customerID, err := strconv.Atoi(v)
+		if err != nil {
+			return filter, handlers.NewFieldError("customer_id", "customer_id must be an integer")
+		}
+		filter.CustomerID = &customerID
+	}
+	if v := query.Get("product_id"); v != "" {
+		productID, err := strconv.Atoi(v)
+		if err != nil {
+			return filter, handlers.NewFieldError("product_id", "product_id must be an integer")
+		}
+		filter.ProductID = &productID
+	}
+
+	return filter, nil
+}
+
+// searchOrders returns the IDs of one page of orders matching the filter, in the filter's
+// sort order, and the total number of matches
+func searchOrders(ctx context.Context, filter OrderFilter) ([]int, int, error) {
+	var conditions sqlFilter
+	conditions.addList(filter.ListParams, orderListColumns)
+	if filter.CustomerID != nil {
+		conditions.add("o.customer_id = ?", *filter.CustomerID)
+	}
+	if filter.CustomerEmail != "" {
+		conditions.add("c.email ILIKE '%' || ? || '%'", filter.CustomerEmail)
+	}
+	if filter.ProductID != nil {
+		conditions.add("EXISTS (SELECT 1 FROM order_products op WHERE op.order_id = o.id AND op.product_id = ?)", *filter.ProductID)
+	}
+	from := "FROM orders o JOIN customers c ON o.customer_id = c.id "
+
+	var total int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) "+from+conditions.where(), conditions.args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT o.id
+		`+from+conditions.where()+`
+		`+conditions.page(filter.ListParams, orderListColumns), conditions.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	orderIDs := make([]int, 0)
+	for rows.Next() {
+		var orderID int
+		if err := rows.Scan(&orderID); err != nil {
+			return nil, 0, err
+		}
+		orderIDs = append(orderIDs, orderID)
+	}
+
+	return orderIDs, total, rows.Err()
+}
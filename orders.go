@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const orderStatusPending = "Pending"
+
+// maxOrderLineNoteLength limits line notes and gift messages
+const maxOrderLineNoteLength = 500
+
+// OrderRequest is the body of POST /place-order
+type OrderRequest struct {
+	// CustomerID is taken from the auth token, never from the request body
+	CustomerID int                `json:"-"`
+	Products   []OrderLineRequest `json:"products"`
+	// ReservationToken is optional and comes from POST /checkout; without it stock is taken at placement
+	ReservationToken string `json:"reservation_token"`
+	OrderAddressRequest
+	// Destination is the shipping address's, which decides the tax rate
+	Destination *Destination `json:"-"`
+	// ShippingMethod defaults to the cheapest shipping option
+	ShippingMethod string `json:"shipping_method"`
+	// CouponCode is optional and takes the coupon's discount off the order
+	CouponCode string `json:"coupon_code"`
+	// RedeemPoints is optional and takes up to that many of the customer's loyalty points off
+	// the order
+	RedeemPoints int `json:"redeem_points"`
+	// Payment is optional; without it the order stays pending until it is paid another way
+	Payment *PaymentRequest `json:"payment"`
+}
+
+// OrderLineRequest identifies one ordered product, optionally a specific variant of it
+type OrderLineRequest struct {
+	ProductID int  `json:"product_id"`
+	VariantID *int `json:"variant_id"`
+	// Quantity defaults to 1 when omitted
+	Quantity int `json:"quantity"`
+	// Note, GiftWrap and GiftMessage are optional and stored on the order line
+	Note        string `json:"note"`
+	GiftWrap    bool   `json:"gift_wrap"`
+	GiftMessage string `json:"gift_message"`
+}
+
+// orderLineKey identifies lines that can be merged: the same product and variant with the same note and gift options
+type orderLineKey struct {
+	ProductID   int
+	VariantID   int
+	Note        string
+	GiftWrap    bool
+	GiftMessage string
+}
+
+// normalizeOrderLines defaults missing quantities to 1 and merges lines for the same
+// product and variant, since an order has one line per product and variant
+func normalizeOrderLines(lines []OrderLineRequest) []OrderLineRequest {
+	merged := make([]OrderLineRequest, 0, len(lines))
+	index := make(map[orderLineKey]int)
+	for _, line := range lines {
+		if line.Quantity == 0 {
+			line.Quantity = 1
+		}
+		line.Note = strings.TrimSpace(line.Note)
+		line.GiftMessage = strings.TrimSpace(line.GiftMessage)
+		key := orderLineKey{ProductID: line.ProductID, Note: line.Note, GiftWrap: line.GiftWrap, GiftMessage: line.GiftMessage}
+		if line.VariantID != nil {
+			key.VariantID = *line.VariantID
+		}
+		if i, ok := index[key]; ok && line.Quantity > 0 && merged[i].Quantity > 0 {
+			merged[i].Quantity += line.Quantity
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, line)
+	}
+	return merged
+}
+
+// validateOrderRequest checks the order and fills in its addresses and destination
+func validateOrderRequest(ctx context.Context, req *OrderRequest) error {
+	if req.CustomerID == 0 {
+		return handlers.NewFieldError("customer_id", "customer is required")
+	}
+	if len(req.Products) == 0 {
+		return handlers.NewFieldError("products", "at least one product is required")
+	}
+	destination, err := req.OrderAddressRequest.resolve(ctx, req.CustomerID)
+	if err != nil {
+		return err
+	}
+	req.Destination = destination
+	if err := validateShipping(ctx, req.Destination, req.ShippingMethod); err != nil {
+		return err
+	}
+	if err := validatePayment(ctx, req.CustomerID, req.Payment); err != nil {
+		return err
+	}
+	if req.CouponCode != "" {
+		if err := validateCoupon(ctx, req.CouponCode, req.CustomerID); err != nil {
+			return err
+		}
+	}
+	if err := validateRedeemPoints(ctx, req.CustomerID, req.RedeemPoints); err != nil {
+		return err
+	}
+
+	// Lines that normalizeOrderLines couldn't merge differ in their note or gift options
+	seen := make(map[[2]int]bool)
+	for i, line := range req.Products {
+		key := [2]int{line.ProductID, 0}
+		if line.VariantID != nil {
+			key[1] = *line.VariantID
+		}
+		if seen[key] {
+			return handlers.NestFieldError(fmt.Sprintf("products[%d]", i), handlers.NewFieldError("note", "lines for the same product and variant must have the same note and gift options"))
+		}
+		seen[key] = true
+	}
+
+	if err := validateOrderLines(ctx, req.Products); err != nil {
+		return err
+	}
+	return checkShippingRestrictions(ctx, *req)
+}
+
+// isOrderValidationError reports whether err, from validating an order or its lines, is about
+// the request. Any other error is a failure to check it, such as a failed query.
+func isOrderValidationError(err error) bool {
+	var fieldErr *handlers.FieldError
+	return errors.As(err, &fieldErr) || errors.Is(err, errShippingRestricted)
+}
+
+// validateOrderLines checks the quantities and that every product and variant exists
+func validateOrderLines(ctx context.Context, lines []OrderLineRequest) error {
+	for i, line := range lines {
+		if err := validateOrderLine(ctx, line); err != nil {
+			return handlers.NestFieldError(fmt.Sprintf("products[%d]", i), err)
+		}
+	}
+
+	return nil
+}
+
+func validateOrderLine(ctx context.Context, line OrderLineRequest) error {
+	if line.Quantity < 1 {
+		return handlers.NewFieldError("quantity", "quantity must be at least 1")
+	}
+	if len(line.Note) > maxOrderLineNoteLength || len(line.GiftMessage) > maxOrderLineNoteLength {
+		return handlers.FieldErrorf("note", "note and gift_message must be at most %d characters", maxOrderLineNoteLength)
+	}
+	if line.VariantID != nil {
+		_, err := getVariant(ctx, line.ProductID, *line.VariantID)
+		if isNoRows(err) {
+			return handlers.FieldErrorf("variant_id", "variant %d does not exist for product %d", *line.VariantID, line.ProductID)
+		}
+		return err
+	}
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)", line.ProductID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return handlers.FieldErrorf("product_id", "product %d does not exist", line.ProductID)
+	}
+	return nil
+}
+
+// placeOrder takes the stock for the order, either from the checkout reservation or directly,
+// and records the order, its lines and its warehouse allocations in one transaction
+func placeOrder(ctx context.Context, req OrderRequest) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	orderID, err := placeOrderTx(ctx, tx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	return orderID, tx.Commit()
+}
+
+// placeOrderTx does the work of placeOrder inside the caller's transaction
+func placeOrderTx(ctx context.Context, tx *sql.Tx, req OrderRequest) (int, error) {
+	orderID, err := createOrder(ctx, tx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	if req.ReservationToken != "" {
+		err = consumeReservation(ctx, tx, req.CustomerID, req.ReservationToken, req.Products)
+	} else {
+		err = takeStock(ctx, tx, orderUnits(req.Products), stockReasonOrder, &orderID)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Associate the ordered products with the order
+	if err := associateProducts(ctx, tx, orderID, req.Products); err != nil {
+		return 0, err
+	}
+
+	if err := allocateOrder(ctx, tx, orderID, orderUnits(req.Products)); err != nil {
+		return 0, err
+	}
+
+	if err := saveOrderAddresses(ctx, tx, orderID, req.CustomerID, req.OrderAddressRequest); err != nil {
+		return 0, err
+	}
+
+	if err := saveOrderTotals(ctx, tx, orderID, req); err != nil {
+		return 0, err
+	}
+
+	if err := queueOrderEvent(ctx, tx, orderEventCreated, orderID); err != nil {
+		return 0, err
+	}
+
+	return orderID, nil
+}
+
+// orderStatusTransitions are the statuses an order can be moved to by hand, with the statuses
+// it can be in beforehand and the error of any other. The single-order endpoints and the bulk
+// status update both hold to them.
+var orderStatusTransitions = map[string]struct {
+	From []string
+	Err  error
+}{
+	orderStatusCancelled:      {[]string{orderStatusPending, orderStatusAwaitingPayment}, errOrderNotPending},
+	orderStatusReadyForPickup: {[]string{orderStatusPending, orderStatusAwaitingPayment, orderStatusPaid}, errOrderNotReadyForPickup},
+	// Confirming an offline payment doesn't make a shipped order, as with cash on delivery, paid
+	orderStatusPaid: {[]string{orderStatusPending, orderStatusAwaitingPayment, orderStatusReadyForPickup,
+		orderStatusPartiallyShipped, orderStatusShipped, orderStatusDelivered}, errOrderNotAwaitingPayment},
+}
+
+// checkOrderStatusTransition returns the error of moving an order in status from to status to,
+// or nil when it can move
+func checkOrderStatusTransition(from, to string) error {
+	transition, ok := orderStatusTransitions[to]
+	if !ok {
+		return fmt.Errorf("orders aren't moved to %s by hand", to)
+	}
+	for _, status := range transition.From {
+		if status == from {
+			return nil
+		}
+	}
+	return transition.Err
+}
+
+// setOrderStatus moves the order to the status, queueing an order.status_changed event when
+// it wasn't in it already
+func setOrderStatus(ctx context.Context, tx *sql.Tx, orderID int, status string) error {
+	result, err := tx.ExecContext(ctx, "UPDATE orders SET status = $1 WHERE id = $2 AND status <> $1", status, orderID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	return queueOrderEvent(ctx, tx, orderEventStatusChanged, orderID)
+}
+
+func createOrder(ctx context.Context, tx *sql.Tx, req OrderRequest) (int, error) {
+	var orderID int
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO orders (customer_id, date, status, pickup_location_id)
+		VALUES ($1, $2, $3, NULLIF($4, 0))
+		RETURNING id
+	`, req.CustomerID, time.Now(), orderStatusPending, req.PickupLocationID).Scan(&orderID)
+	return orderID, err
+}
+
+// associateProducts records the order lines with the price each unit sells for now to the
+// order's customer, so later price changes don't alter the order
+func associateProducts(ctx context.Context, tx *sql.Tx, orderID int, lines []OrderLineRequest) error {
+	var customerID int
+	if err := tx.QueryRowContext(ctx, "SELECT customer_id FROM orders WHERE id = $1", orderID).Scan(&customerID); err != nil {
+		return err
+	}
+	pricing, err := currentPricing(ctx, tx, customerID)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		var price sql.NullFloat64
+		err := tx.QueryRowContext(ctx, `
+			SELECT COALESCE(
+				(SELECT price FROM product_variants WHERE id = $1),
+				(SELECT price FROM products WHERE id = $2)
+			)
+		`, line.VariantID, line.ProductID).Scan(&price)
+		if err != nil {
+			return err
+		}
+		if price.Valid {
+			price.Float64 = pricing.price(line.ProductID, price.Float64)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO order_products (order_id, product_id, variant_id, quantity, unit_price_at_purchase, note, gift_wrap, gift_message)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, NULLIF($8, ''))
+		`, orderID, line.ProductID, line.VariantID, line.Quantity, price, line.Note, line.GiftWrap, line.GiftMessage)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveOrderTotals stores the order's subtotal, discount, tax, shipping and total, so they don't change
+// when prices, tax rates or shipping rates change later
+func saveOrderTotals(ctx context.Context, tx *sql.Tx, orderID int, req OrderRequest) error {
+	var subtotal float64
+	err := tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(unit_price_at_purchase * quantity), 0) FROM order_products WHERE order_id = $1", orderID).Scan(&subtotal)
+	if err != nil {
+		return err
+	}
+
+	weight, err := orderWeight(ctx, tx, orderID)
+	if err != nil {
+		return err
+	}
+
+	var destination Destination
+	if req.Destination != nil {
+		destination = *req.Destination
+	}
+	var totals *Quote
+	if req.PickupLocationID != 0 {
+		totals, err = pricePickupOrder(ctx, subtotal, destination)
+	} else {
+		totals, err = priceOrder(ctx, subtotal, weight, destination, req.ShippingMethod)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Discounts apply in a fixed order, each off what the ones before it left of the subtotal:
+	// promotions, the coupon, the first-order discount and points
+	breakdown := &discountBreakdown{subtotal: totals.Subtotal}
+	promotions := make([]AppliedPromotion, 0)
+	if req.CouponCode == "" || discountConfig.CouponWithPromotions {
+		lines, err := orderPromotionLines(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+		promotions, err = applyPromotions(ctx, tx, lines)
+		if err != nil {
+			return err
+		}
+		if err := saveOrderPromotions(ctx, tx, orderID, promotions); err != nil {
+			return err
+		}
+		for _, promotion := range promotions {
+			breakdown.add(discountTypePromotion, promotion.Name, promotion.Discount)
+		}
+	}
+	var couponCode string
+	if req.CouponCode != "" {
+		coupon, couponDiscount, err := redeemCoupon(ctx, tx, orderID, req.CustomerID, req.CouponCode)
+		if err != nil {
+			return err
+		}
+		couponCode = coupon.Code
+		breakdown.add(discountTypeCoupon, coupon.Code, couponDiscount)
+	}
+	firstOrderDiscount, err := applyFirstOrderDiscount(ctx, tx, orderID, req.CustomerID, req.Payment, breakdown.remaining())
+	if err != nil {
+		return err
+	}
+	firstOrderDiscount = breakdown.add(discountTypeFirstOrder, "", firstOrderDiscount)
+	if req.RedeemPoints > 0 && !discountConfig.PointsWithDiscounts && breakdown.total() > 0 {
+		return fmt.Errorf("%w: loyalty points can't be combined with other discounts", errInvalidPoints)
+	}
+	pointsRedeemed, pointsDiscount, err := redeemOrderPoints(ctx, tx, orderID, req.CustomerID, req.RedeemPoints, breakdown.remaining())
+	if err != nil {
+		return err
+	}
+	pointsDiscount = breakdown.add(discountTypePoints, "", pointsDiscount)
+	if err := saveOrderDiscounts(ctx, tx, orderID, breakdown); err != nil {
+		return err
+	}
+	if discount := breakdown.total(); discount > 0 || couponCode != "" {
+		applyDiscount(totals, couponCode, discount)
+		totals.Promotions = promotions
+	}
+
+	// The delivery estimate is promised to the customer from the warehouses the order was
+	// allocated to
+	origins, err := orderShipOrigins(ctx, tx, orderID)
+	if err != nil {
+		return err
+	}
+	addDeliveryEstimates(totals, origins)
+	var earliest, latest *string
+	if totals.EstimatedDelivery != nil {
+		earliest, latest = &totals.EstimatedDelivery.Earliest, &totals.EstimatedDelivery.Latest
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE orders
+		SET subtotal = $1, tax_rate = $2, tax = $3, shipping = $4, total = $5, shipping_method = $6,
+			estimated_delivery_earliest = $7, estimated_delivery_latest = $8, discount = $9, coupon_code = NULLIF($10, ''),
+			points_redeemed = $12, points_discount = $13, first_order_discount = $14
+		WHERE id = $11
+	`, totals.Subtotal, totals.TaxRate, totals.Tax, totals.Shipping, totals.Total, totals.ShippingMethod,
+		earliest, latest, totals.Discount, totals.CouponCode, orderID, pointsRedeemed, pointsDiscount, firstOrderDiscount)
+	return err
+}
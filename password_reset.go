@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Password reset settings, loaded from environment variables by loadPasswordResetConfig
+var passwordResetConfig struct {
+	// URL is the frontend page that receives the reset token as a "token" query parameter
+	URL string
+	// TTL is how long a reset token stays valid
+	TTL time.Duration
+}
+
+var errInvalidResetToken = errors.New("reset token is invalid or expired")
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func loadPasswordResetConfig() {
+	passwordResetConfig.URL = os.Getenv("PASSWORD_RESET_URL")
+	if passwordResetConfig.URL == "" {
+		log.Fatal("PASSWORD_RESET_URL must be set")
+	}
+
+	passwordResetConfig.TTL = time.Hour
+	if ttl := os.Getenv("PASSWORD_RESET_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Invalid PASSWORD_RESET_TTL %q: %v", ttl, err)
+		}
+		passwordResetConfig.TTL = d
+	}
+}
+
+// PASSWORD RESET
+func PasswordResetRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var resetRequest PasswordResetRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &resetRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	resetRequest.Email = normalizeEmail(resetRequest.Email)
+	if resetRequest.Email == "" {
+		handlers.WriteFieldError(w, "email", "email is required")
+		return
+	}
+
+	// Always answer the same way so the endpoint can't be used to discover registered emails
+	customer, _, err := getCustomerByEmail(r.Context(), resetRequest.Email)
+	if err == nil {
+		if err := createPasswordReset(r.Context(), customer); err != nil {
+			log.Println("Error creating password reset:", err)
+		}
+	} else if !isNoRows(err) {
+		log.Println("Error retrieving customer:", err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("If the email is registered, a reset link has been sent"))
+}
+
+func PasswordResetConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	var confirmRequest PasswordResetConfirmRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &confirmRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	if confirmRequest.Token == "" {
+		handlers.WriteFieldError(w, "token", "token is required")
+		return
+	}
+	if len(confirmRequest.Password) < minPasswordLength || len(confirmRequest.Password) > 72 {
+		handlers.WriteFieldError(w, "password", "password must be 8-72 characters")
+		return
+	}
+
+	err = confirmPasswordReset(r.Context(), confirmRequest.Token, confirmRequest.Password)
+	if err == errInvalidResetToken {
+		handlers.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error resetting password:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Password has been reset"))
+}
+
+// createPasswordReset stores a new one-time token for the customer and emails the reset link
+func createPasswordReset(ctx context.Context, customer *Customer) error {
+	token, err := generateToken(32)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO password_resets (customer_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+	`, customer.ID, hashToken(token), time.Now().Add(passwordResetConfig.TTL))
+	if err != nil {
+		return err
+	}
+
+	return sendEmail(ctx, customer.Email, emailPasswordReset, "", passwordResetEmail{
+		Name: customer.Name,
+		Link: passwordResetConfig.URL + "?token=" + url.QueryEscape(token),
+		TTL:  passwordResetConfig.TTL,
+	})
+}
+
+// confirmPasswordReset consumes a reset token and replaces the customer's password
+func confirmPasswordReset(ctx context.Context, token, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var resetID, customerID int
+	err = tx.QueryRowContext(ctx, `
+		UPDATE password_resets
+		SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING id, customer_id
+	`, hashToken(token)).Scan(&resetID, &customerID)
+	if isNoRows(err) {
+		return errInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE customers SET password = $1 WHERE id = $2", string(hash), customerID)
+	if err != nil {
+		return err
+	}
+
+	// Log out every existing session, the old password may have been compromised
+	if err := revokeCustomerRefreshTokens(ctx, tx, customerID); err != nil {
+		return err
+	}
+
+	// Any other outstanding reset tokens for this customer are no longer needed
+	_, err = tx.ExecContext(ctx, `
+		UPDATE password_resets SET used_at = NOW()
+		WHERE customer_id = $1 AND used_at IS NULL AND id <> $2
+	`, customerID, resetID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Kinds of money movement in the payment ledger. Amounts are positive; the kind gives the direction.
+const (
+	transactionCharge = "charge"
+	transactionRefund = "refund"
+	transactionFee    = "fee"
+)
+
+// settlementReporter is implemented by gateways that can report what they settled, to
+// reconcile the ledger against
+type settlementReporter interface {
+	// Settlement totals the provider's charges, refunds and fees made in [from, to), and the
+	// payouts it sent to the bank in that time
+	Settlement(ctx context.Context, from, to time.Time) (*ProviderSettlement, error)
+}
+
+// ProviderSettlement is a payment provider's own account of a day
+type ProviderSettlement struct {
+	Charges float64 `json:"charges"`
+	Refunds float64 `json:"refunds"`
+	Fees    float64 `json:"fees"`
+	Net     float64 `json:"net"`
+	Payouts float64 `json:"payouts"`
+}
+
+// LedgerTotals sums a provider's ledger transactions
+type LedgerTotals struct {
+	Charges float64 `json:"charges"`
+	Refunds float64 `json:"refunds"`
+	Fees    float64 `json:"fees"`
+	Net     float64 `json:"net"`
+}
+
+// Reconciliation compares the ledger of one provider with what the provider reports
+type Reconciliation struct {
+	Provider string              `json:"provider"`
+	Currency string              `json:"currency"`
+	Ledger   LedgerTotals        `json:"ledger"`
+	Gateway  *ProviderSettlement `json:"gateway,omitempty"`
+	// Difference is the ledger's net less the provider's; anything but 0 needs a look
+	Difference   *float64 `json:"difference,omitempty"`
+	GatewayError string   `json:"gateway_error,omitempty"`
+}
+
+type ReconciliationReport struct {
+	Date      string           `json:"date"`
+	Providers []Reconciliation `json:"providers"`
+}
+
+// recordCharge adds a captured payment and the provider's fee for it to the ledger. A payment
+// is only recorded once, however often its capture is reported.
+func recordCharge(ctx context.Context, tx *sql.Tx, paymentID int, fee float64) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_transactions (payment_id, order_id, provider, type, amount, currency)
+		SELECT id, order_id, provider, $2, amount, currency FROM payments
+		WHERE id = $1 AND NOT EXISTS (
+			SELECT 1 FROM payment_transactions WHERE payment_id = $1 AND type = $2
+		)
+	`, paymentID, transactionCharge)
+	if err != nil || roundCents(fee) <= 0 {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO payment_transactions (payment_id, order_id, provider, type, amount, currency)
+		SELECT id, order_id, provider, $2, $3, currency FROM payments
+		WHERE id = $1 AND NOT EXISTS (
+			SELECT 1 FROM payment_transactions WHERE payment_id = $1 AND type = $2
+		)
+	`, paymentID, transactionFee, roundCents(fee))
+	return err
+}
+
+// recordRefund adds a succeeded refund to the ledger
+func recordRefund(ctx context.Context, tx *sql.Tx, refund Refund) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_transactions (payment_id, refund_id, order_id, provider, type, amount, currency)
+		SELECT id, $2, order_id, provider, $3, $4, currency FROM payments
+		WHERE id = $1
+	`, refund.PaymentID, refund.ID, transactionRefund, refund.Amount)
+	return err
+}
+
+// ADMIN RECONCILIATION REPORT
+// AdminReconciliationHandler compares the ledger's totals for a day (UTC, yesterday by
+// default) with what each payment provider reports having settled
+func AdminReconciliationHandler(w http.ResponseWriter, r *http.Request) {
+	from := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	if v := r.URL.Query().Get("date"); v != "" {
+		date, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			handlers.WriteFieldError(w, "date", "date must be YYYY-MM-DD")
+			return
+		}
+		from = date
+	}
+	to := from.AddDate(0, 0, 1)
+
+	report, err := getReconciliation(r.Context(), from, to)
+	if err != nil {
+		log.Println("Error computing reconciliation report:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, report)
+}
+
+func getReconciliation(ctx context.Context, from, to time.Time) (*ReconciliationReport, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT provider, currency,
+			   COALESCE(SUM(amount) FILTER (WHERE type = $3), 0),
+			   COALESCE(SUM(amount) FILTER (WHERE type = $4), 0),
+			   COALESCE(SUM(amount) FILTER (WHERE type = $5), 0)
+		FROM payment_transactions
+		WHERE created_at >= $1 AND created_at < $2
+		GROUP BY provider, currency
+	`, from, to, transactionCharge, transactionRefund, transactionFee)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byProvider := make(map[string]*Reconciliation)
+	for rows.Next() {
+		line := &Reconciliation{}
+		if err := rows.Scan(&line.Provider, &line.Currency, &line.Ledger.Charges, &line.Ledger.Refunds, &line.Ledger.Fees); err != nil {
+			return nil, err
+		}
+		line.Ledger.Net = roundCents(line.Ledger.Charges - line.Ledger.Refunds - line.Ledger.Fees)
+		byProvider[line.Provider] = line
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Providers that settled something the ledger is missing still show up
+	for provider, gateway := range paymentGateways {
+		reporter, ok := gateway.(settlementReporter)
+		if !ok {
+			continue
+		}
+		line, ok := byProvider[provider]
+		if !ok {
+			line = &Reconciliation{Provider: provider, Currency: paymentConfig.Currency}
+			byProvider[provider] = line
+		}
+
+		settlement, err := reporter.Settlement(ctx, from, to)
+		if err != nil {
+			log.Printf("Error retrieving %s settlement: %v", provider, err)
+			line.GatewayError = "provider settlement is unavailable"
+			continue
+		}
+		line.Gateway = settlement
+		difference := roundCents(line.Ledger.Net - settlement.Net)
+		line.Difference = &difference
+	}
+
+	report := &ReconciliationReport{Date: from.Format("2006-01-02"), Providers: make([]Reconciliation, 0, len(byProvider))}
+	for _, line := range byProvider {
+		report.Providers = append(report.Providers, *line)
+	}
+	sort.Slice(report.Providers, func(i, j int) bool {
+		return report.Providers[i].Provider < report.Providers[j].Provider
+	})
+	return report, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errOrderNotPayable = errors.New("only pending orders without a payment in progress can be paid")
+
+// paymentRetry is an order whose card payment failed and is due to be charged again
+type paymentRetry struct {
+	OrderID           int
+	CustomerID        int
+	Email             string
+	Attempts          int
+	Source            string
+	CustomerReference string
+}
+
+// CUSTOMER PAY ORDER
+// CustomerPayOrderHandler pays for one of the customer's pending orders, e.g. from the payment
+// link sent after a payment failed
+func CustomerPayOrderHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var paymentRequest PaymentRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &paymentRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	customerID := getCustomerID(r)
+	if err := validatePayment(r.Context(), customerID, &paymentRequest); err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+
+	err = checkOrderPayable(r.Context(), orderID, customerID)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if err == nil {
+		err = checkFirstOrderPayment(r.Context(), orderID, paymentRequest)
+	}
+	if err == errOrderNotPayable || err == errFirstOrderCardUsed {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error checking order:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	giftCardPayment, payment, err := payOrderSplit(r.Context(), orderID, paymentRequest)
+	if err != nil {
+		log.Printf("Error paying for order %d: %v", orderID, err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	response := map[string]interface{}{"order_id": orderID}
+	if giftCardPayment != nil {
+		response["gift_card_payment"] = giftCardPayment
+	}
+	if payment != nil {
+		response["payment"] = payment
+		if payment.Status == paymentStatusFailed {
+			handlers.WriteJSON(w, http.StatusPaymentRequired, response)
+			return
+		}
+	}
+	handlers.WriteJSON(w, http.StatusCreated, response)
+}
+
+// checkOrderPayable checks that the customer's order is pending and has no payment still in
+// progress. Captured payments, such as a gift card's, only lower the amount charged.
+func checkOrderPayable(ctx context.Context, orderID, customerID int) error {
+	var status string
+	var paying bool
+	err := db.QueryRowContext(ctx, `
+		SELECT o.status, EXISTS (SELECT 1 FROM payments WHERE order_id = o.id AND status = $3)
+		FROM orders o
+		WHERE o.id = $1 AND o.customer_id = $2
+	`, orderID, customerID, paymentStatusPending).Scan(&status, &paying)
+	if err != nil {
+		return err
+	}
+	if status != orderStatusPending || paying {
+		return errOrderNotPayable
+	}
+	return nil
+}
+
+// retryFailedPayments charges pending orders whose last card payment failed again, every
+// RetryInterval. The customer is emailed a payment link after each failed attempt, and the
+// order is cancelled after the last one.
+func retryFailedPayments(ctx context.Context) {
+	if paymentConfig.RetryAttempts == 0 {
+		return
+	}
+	if _, ok := paymentGateways[paymentProviderCard]; !ok {
+		return
+	}
+
+	// Orders that were paid some other way or cancelled need no more retries
+	_, err := db.ExecContext(ctx, `
+		DELETE FROM payment_retries r USING orders o
+		WHERE r.order_id = o.id AND o.status <> $1
+	`, orderStatusPending)
+	if err != nil {
+		log.Println("Error clearing payment retries:", err)
+		return
+	}
+
+	// Schedule the first retry of card payments that failed since the last run
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO payment_retries (order_id, next_attempt_at)
+		SELECT o.id, p.updated_at + $4 * INTERVAL '1 second'
+		FROM orders o
+		JOIN LATERAL (
+			SELECT provider, status, source, updated_at FROM payments
+			WHERE order_id = o.id
+			ORDER BY id DESC
+			LIMIT 1
+		) p ON TRUE
+		WHERE o.status = $1 AND p.provider = $2 AND p.status = $3 AND p.source IS NOT NULL
+		ON CONFLICT (order_id) DO NOTHING
+	`, orderStatusPending, paymentProviderCard, paymentStatusFailed, paymentConfig.RetryInterval.Seconds())
+	if err != nil {
+		log.Println("Error scheduling payment retries:", err)
+		return
+	}
+
+	retries, err := getDuePaymentRetries(ctx)
+	if err != nil {
+		log.Println("Error retrieving payment retries:", err)
+		return
+	}
+	for _, retry := range retries {
+		retryPayment(ctx, retry)
+	}
+}
+
+func getDuePaymentRetries(ctx context.Context) ([]paymentRetry, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT r.order_id, o.customer_id, c.email, r.attempts, p.source, COALESCE(p.customer_reference, '')
+		FROM payment_retries r
+		JOIN orders o ON r.order_id = o.id
+		JOIN customers c ON o.customer_id = c.id
+		JOIN LATERAL (
+			SELECT status, source, customer_reference FROM payments
+			WHERE order_id = o.id AND provider = $2
+			ORDER BY id DESC
+			LIMIT 1
+		) p ON TRUE
+		WHERE r.next_attempt_at <= NOW() AND o.status = $1 AND p.status = $3 AND p.source IS NOT NULL
+		ORDER BY r.next_attempt_at
+	`, orderStatusPending, paymentProviderCard, paymentStatusFailed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var retries []paymentRetry
+	for rows.Next() {
+		var retry paymentRetry
+		if err := rows.Scan(&retry.OrderID, &retry.CustomerID, &retry.Email, &retry.Attempts,
+			&retry.Source, &retry.CustomerReference); err != nil {
+			return nil, err
+		}
+		retries = append(retries, retry)
+	}
+
+	return retries, rows.Err()
+}
+
+// retryPayment charges the order again with the card that failed
+func retryPayment(ctx context.Context, retry paymentRetry) {
+	// Claiming the attempt first keeps a slow charge from being retried twice
+	result, err := db.ExecContext(ctx, `
+		UPDATE payment_retries
+		SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+		WHERE order_id = $1 AND attempts = $3
+	`, retry.OrderID, paymentConfig.RetryInterval.Seconds(), retry.Attempts)
+	if err != nil {
+		log.Printf("Error claiming payment retry of order %d: %v", retry.OrderID, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return
+	}
+	attempt := retry.Attempts + 1
+
+	// The charge and what follows it keep the job's context, held to a minute
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	payment, err := payOrder(ctx, retry.OrderID, PaymentRequest{
+		Provider:          paymentProviderCard,
+		PaymentMethod:     retry.Source,
+		customerReference: retry.CustomerReference,
+	})
+	if err != nil {
+		log.Printf("Error retrying payment of order %d: %v", retry.OrderID, err)
+		return
+	}
+	if payment.Status == paymentStatusCaptured {
+		if _, err := db.ExecContext(ctx, "DELETE FROM payment_retries WHERE order_id = $1", retry.OrderID); err != nil {
+			log.Println("Error clearing payment retry:", err)
+		}
+		if err := sendEmail(ctx, retry.Email, emailPaymentReceived, paymentEmailKey(emailPaymentReceived, payment.ID), orderEmail{OrderID: retry.OrderID}); err != nil {
+			log.Printf("Error sending payment email to %s: %v", retry.Email, err)
+		}
+		return
+	}
+
+	// A pending payment needs the customer to authenticate it, so it isn't retried or
+	// cancelled; they are only sent the link
+	if payment.Status == paymentStatusFailed && attempt >= paymentConfig.RetryAttempts {
+		cancelUnpaidOrder(ctx, retry)
+		return
+	}
+	sendDunningEmail(ctx, retry, attempt)
+}
+
+func sendDunningEmail(ctx context.Context, retry paymentRetry, attempt int) {
+	data := paymentRetryEmail{
+		OrderID:       retry.OrderID,
+		Attempt:       attempt,
+		Attempts:      paymentConfig.RetryAttempts,
+		RetryInterval: paymentConfig.RetryInterval,
+	}
+	if paymentConfig.LinkURL != "" {
+		data.PayLink = fmt.Sprintf("%s?order_id=%d", paymentConfig.LinkURL, retry.OrderID)
+	}
+	if err := sendEmail(ctx, retry.Email, emailPaymentRetryFailed, fmt.Sprintf("payment_retry_failed:%d:%d", retry.OrderID, attempt), data); err != nil {
+		log.Printf("Error sending dunning email to %s for order %d: %v", retry.Email, retry.OrderID, err)
+	}
+}
+
+// cancelUnpaidOrder cancels the order after its last payment attempt failed
+func cancelUnpaidOrder(ctx context.Context, retry paymentRetry) {
+	_, err := cancelOrder(ctx, retry.OrderID, &retry.CustomerID)
+	if err == errOrderNotPending {
+		return
+	}
+	if err != nil {
+		log.Printf("Error cancelling unpaid order %d: %v", retry.OrderID, err)
+		return
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM payment_retries WHERE order_id = $1", retry.OrderID); err != nil {
+		log.Println("Error clearing payment retry:", err)
+	}
+
+	data := unpaidOrderEmail{OrderID: retry.OrderID, Attempts: paymentConfig.RetryAttempts}
+	if err := sendEmail(ctx, retry.Email, emailUnpaidOrderCancelled, orderCancelledEmailKey(retry.OrderID), data); err != nil {
+		log.Printf("Error sending cancellation email to %s for order %d: %v", retry.Email, retry.OrderID, err)
+	}
+}
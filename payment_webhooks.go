@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const (
+	orderStatusDisputed   = "Disputed"
+	paymentStatusDisputed = "disputed"
+)
+
+// Payment events the store acts on; providers' other events are acknowledged and ignored
+const (
+	paymentEventSucceeded  = "succeeded"
+	paymentEventFailed     = "failed"
+	paymentEventChargeback = "chargeback"
+)
+
+var errInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// paymentWebhookParser is implemented by gateways whose provider sends payment webhooks
+type paymentWebhookParser interface {
+	// ParseWebhook verifies the request's signature and returns the event it carries
+	ParseWebhook(ctx context.Context, r *http.Request, body []byte) (*PaymentEvent, error)
+}
+
+// PaymentEvent is a provider webhook event. The payment is matched by Reference or
+// CaptureReference, whichever the provider sent.
+type PaymentEvent struct {
+	// ID is the provider's event ID; an event is only processed once
+	ID string
+	// Type is one of the paymentEvent constants, or empty for events the store ignores
+	Type             string
+	Reference        string
+	CaptureReference string
+	FailureReason    string
+}
+
+// paymentNotification is the email sent to the customer after an event changed their payment
+type paymentNotification struct {
+	Email    string
+	Template string
+	Key      string
+	Data     interface{}
+}
+
+// PAYMENT WEBHOOKS
+// PaymentWebhookHandler receives payment events from Stripe and PayPal. The provider is told
+// apart by its signature header, and the signature is verified before anything changes.
+func PaymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	var provider string
+	switch {
+	case r.Header.Get("Stripe-Signature") != "":
+		provider = paymentProviderCard
+	case r.Header.Get("Paypal-Transmission-Sig") != "":
+		provider = paymentProviderPayPal
+	}
+	parser, ok := paymentGateways[provider].(paymentWebhookParser)
+	if !ok {
+		handlers.WriteError(w, http.StatusBadRequest, "Unknown payment provider")
+		return
+	}
+
+	event, err := parser.ParseWebhook(r.Context(), r, body)
+	if err != nil {
+		log.Printf("Error verifying %s webhook: %v", provider, err)
+		handlers.WriteError(w, http.StatusBadRequest, errInvalidWebhookSignature.Error())
+		return
+	}
+
+	// On errors the provider retries the event later
+	notification, cancelledOrderID, err := processPaymentEvent(r.Context(), provider, event)
+	if err != nil {
+		log.Printf("Error processing %s webhook event %s: %v", provider, event.ID, err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if notification != nil {
+		if err := sendEmail(r.Context(), notification.Email, notification.Template, notification.Key, notification.Data); err != nil {
+			log.Printf("Error sending payment email to %s: %v", notification.Email, err)
+		}
+	}
+	// The event is recorded, so the refund goes ahead even if the provider hangs up
+	if cancelledOrderID != 0 {
+		refundLateCapture(context.WithoutCancel(r.Context()), cancelledOrderID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// processPaymentEvent applies the event to its payment and order. The event ID is recorded in
+// the same transaction, so a redelivered event changes nothing. It returns the email to send
+// when the payment changed, and the order to refund when a payment was captured after its
+// order was cancelled.
+func processPaymentEvent(ctx context.Context, provider string, event *PaymentEvent) (*paymentNotification, int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_events (provider, event_id, event_type)
+		VALUES ($1, $2, NULLIF($3, ''))
+		ON CONFLICT (provider, event_id) DO NOTHING
+	`, provider, event.ID, event.Type)
+	if err != nil {
+		return nil, 0, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return nil, 0, err
+	}
+	if inserted == 0 || event.Type == "" {
+		return nil, 0, tx.Commit()
+	}
+
+	var paymentID, orderID int
+	var status, orderStatus, email string
+	err = tx.QueryRowContext(ctx, `
+		SELECT p.id, p.order_id, p.status, o.status, c.email
+		FROM payments p
+		JOIN orders o ON p.order_id = o.id
+		JOIN customers c ON o.customer_id = c.id
+		WHERE p.provider = $1
+		  AND ((p.reference = NULLIF($2, '')) OR (p.capture_reference = NULLIF($3, '')))
+		ORDER BY p.id DESC
+		LIMIT 1
+		FOR UPDATE OF p, o
+	`, provider, event.Reference, event.CaptureReference).Scan(&paymentID, &orderID, &status, &orderStatus, &email)
+	if isNoRows(err) {
+		log.Printf("Ignoring %s webhook event %s: no payment matches it", provider, event.ID)
+		return nil, 0, tx.Commit()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var notification *paymentNotification
+	var cancelledOrderID int
+	switch event.Type {
+	case paymentEventSucceeded:
+		if status == paymentStatusCaptured {
+			break
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE payments
+			SET status = $1, capture_reference = COALESCE(NULLIF($2, ''), capture_reference), failure_reason = NULL, updated_at = NOW()
+			WHERE id = $3
+		`, paymentStatusCaptured, event.CaptureReference, paymentID)
+		if err == nil {
+			err = recordCharge(ctx, tx, paymentID, 0)
+		}
+		// A payment captured after its order was cancelled is refunded instead of settling it
+		if orderStatus == orderStatusCancelled {
+			cancelledOrderID = orderID
+			break
+		}
+		if err == nil {
+			err = settleOrder(ctx, tx, orderID)
+		}
+		notification = &paymentNotification{Email: email, Template: emailPaymentReceived, Key: paymentEmailKey(emailPaymentReceived, paymentID),
+			Data: orderEmail{OrderID: orderID}}
+	case paymentEventFailed:
+		if status != paymentStatusPending {
+			break
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE payments SET status = $1, failure_reason = NULLIF($2, ''), updated_at = NOW() WHERE id = $3
+		`, paymentStatusFailed, event.FailureReason, paymentID)
+		notification = &paymentNotification{Email: email, Template: emailPaymentFailed, Key: paymentEmailKey(emailPaymentFailed, paymentID),
+			Data: orderEmail{OrderID: orderID}}
+	case paymentEventChargeback:
+		if status == paymentStatusDisputed {
+			break
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE payments SET status = $1, updated_at = NOW() WHERE id = $2", paymentStatusDisputed, paymentID)
+		if err == nil {
+			err = setOrderStatus(ctx, tx, orderID, orderStatusDisputed)
+		}
+		notification = &paymentNotification{Email: email, Template: emailPaymentDisputed, Key: paymentEmailKey(emailPaymentDisputed, paymentID),
+			Data: orderEmail{OrderID: orderID}}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return notification, cancelledOrderID, tx.Commit()
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const orderStatusPaid = "Paid"
+
+// Payment providers a customer can pick when placing an order
+const (
+	paymentProviderCard   = "card"
+	paymentProviderPayPal = "paypal"
+)
+
+const (
+	paymentStatusPending  = "pending"
+	paymentStatusCaptured = "captured"
+	paymentStatusFailed   = "failed"
+	paymentStatusRefunded = "refunded"
+	// paymentStatusVoided payments were still pending when their order was cancelled
+	paymentStatusVoided = "voided"
+)
+
+var errPaymentNotFound = errors.New("order has no pending payment")
+var errPaymentNotApproved = errors.New("payment has not been approved yet")
+
+// PaymentGateway charges orders through a payment provider
+type PaymentGateway interface {
+	// Charge starts a payment of amount for the order, using source when the provider needs
+	// one (e.g. a tokenized card). A payment the customer still has to approve comes back
+	// pending and is finished by Capture.
+	Charge(ctx context.Context, charge PaymentCharge) (*PaymentResult, error)
+	// Capture finishes a pending payment once the customer has approved it
+	Capture(ctx context.Context, reference string) (*PaymentResult, error)
+	// Refund returns part or all of a captured payment and returns the provider's refund ID
+	Refund(ctx context.Context, refund PaymentRefund) (string, error)
+}
+
+// PaymentCharge is what a gateway is asked to charge
+type PaymentCharge struct {
+	OrderID   int
+	PaymentID int
+	Amount    float64
+	Currency  string
+	Source    string
+	// CustomerReference is the provider's customer the saved Source belongs to, if any
+	CustomerReference string
+}
+
+// PaymentRefund is what a gateway is asked to refund
+type PaymentRefund struct {
+	RefundID         int
+	CaptureReference string
+	Amount           float64
+	Currency         string
+}
+
+// PaymentResult is the outcome of a gateway call. Declined payments are a failed result,
+// not an error; errors mean the provider couldn't be reached or rejected the request.
+type PaymentResult struct {
+	// Reference is the provider's ID for the payment
+	Reference string
+	// CaptureReference is the provider's ID for the captured funds, used for refunds
+	CaptureReference string
+	Status           string
+	FailureReason    string
+	// ApprovalURL is where the customer approves a pending PayPal payment
+	ApprovalURL string
+	// ClientSecret lets the storefront finish a pending card payment, e.g. 3-D Secure
+	ClientSecret string
+	// Fee is what the provider keeps of a captured payment, when it reports it
+	Fee float64
+}
+
+// Payment is one attempt to pay for an order
+type Payment struct {
+	ID            int     `json:"payment_id"`
+	OrderID       int     `json:"order_id"`
+	Provider      string  `json:"provider"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	Status        string  `json:"status"`
+	FailureReason string  `json:"failure_reason,omitempty"`
+	ApprovalURL   string  `json:"approval_url,omitempty"`
+	ClientSecret  string  `json:"client_secret,omitempty"`
+	// Instructions tell the customer how to pay an offline payment
+	Instructions string    `json:"instructions,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// PaymentRequest picks how an order is paid
+type PaymentRequest struct {
+	Provider string `json:"provider"`
+	// PaymentMethod is the card's payment method token from the storefront; PayPal doesn't use it
+	PaymentMethod string `json:"payment_method"`
+	// SavedPaymentMethodID charges one of the customer's saved payment methods instead
+	SavedPaymentMethodID int `json:"saved_payment_method_id"`
+	// GiftCardCode pays with the gift card's balance first; the provider pays the rest
+	GiftCardCode string `json:"gift_card_code"`
+
+	// customerReference is the provider's customer of the saved payment method
+	customerReference string
+	// offline is the offline payment method the provider names, if it is one
+	offline *OfflinePaymentMethod
+	// fingerprint identifies the card across tokens, when the gateway can tell
+	fingerprint string
+}
+
+// Payment settings, loaded from environment variables by loadPaymentConfig
+var paymentConfig = struct {
+	Currency string
+	// RetryAttempts is how often a failed card payment is retried before the order is
+	// cancelled; 0 turns retries off
+	RetryAttempts int
+	RetryInterval time.Duration
+	// LinkURL is the frontend page where a customer pays for an order, sent after a failed payment
+	LinkURL string
+}{
+	Currency:      "USD",
+	RetryAttempts: 3,
+	RetryInterval: 24 * time.Hour,
+}
+
+// paymentGateways holds the enabled providers; a provider without credentials is left out
+var paymentGateways = map[string]PaymentGateway{}
+
+func loadPaymentConfig() {
+	if v := os.Getenv("PAYMENT_CURRENCY"); v != "" {
+		if len(v) != 3 {
+			log.Fatalf("Invalid PAYMENT_CURRENCY %q", v)
+		}
+		paymentConfig.Currency = strings.ToUpper(v)
+	}
+	if v := os.Getenv("PAYMENT_RETRY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid PAYMENT_RETRY_ATTEMPTS %q", v)
+		}
+		paymentConfig.RetryAttempts = n
+	}
+	if v := os.Getenv("PAYMENT_RETRY_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid PAYMENT_RETRY_INTERVAL %q", v)
+		}
+		paymentConfig.RetryInterval = d
+	}
+	paymentConfig.LinkURL = os.Getenv("PAYMENT_LINK_URL")
+
+	if key := os.Getenv("STRIPE_SECRET_KEY"); key != "" {
+		paymentGateways[paymentProviderCard] = newStripeGateway(key, os.Getenv("STRIPE_WEBHOOK_SECRET"))
+	}
+	if clientID := os.Getenv("PAYPAL_CLIENT_ID"); clientID != "" {
+		returnURL := os.Getenv("PAYPAL_RETURN_URL")
+		if returnURL == "" {
+			log.Fatal("PAYPAL_RETURN_URL is required when PAYPAL_CLIENT_ID is set")
+		}
+		paymentGateways[paymentProviderPayPal] = newPayPalGateway(clientID, os.Getenv("PAYPAL_CLIENT_SECRET"), os.Getenv("PAYPAL_API_URL"), returnURL, os.Getenv("PAYPAL_CANCEL_URL"), os.Getenv("PAYPAL_WEBHOOK_ID"))
+	}
+}
+
+// validatePayment checks the optional payment of the customer's order and looks up the
+// saved payment method it chose
+func validatePayment(ctx context.Context, customerID int, req *PaymentRequest) error {
+	if req == nil {
+		return nil
+	}
+	req.Provider = strings.ToLower(strings.TrimSpace(req.Provider))
+	req.GiftCardCode = strings.ToUpper(strings.TrimSpace(req.GiftCardCode))
+	if req.GiftCardCode != "" {
+		if err := validateGiftCardTender(ctx, req.GiftCardCode); err != nil {
+			return err
+		}
+		// Without a provider, what the gift card doesn't cover is paid later with Pay Order
+		if req.Provider == "" && req.SavedPaymentMethodID == 0 {
+			return nil
+		}
+	}
+	if req.SavedPaymentMethodID != 0 {
+		if err := resolveSavedPaymentMethod(ctx, customerID, req); err != nil {
+			return err
+		}
+	} else if req.PaymentMethod != "" {
+		if err := validatePaymentToken(req.PaymentMethod); err != nil {
+			return fmt.Errorf("payment.%w", err)
+		}
+	}
+	if _, ok := paymentGateways[req.Provider]; !ok {
+		offline, err := getEnabledOfflinePaymentMethod(ctx, req.Provider)
+		if err != nil {
+			return err
+		}
+		if offline == nil {
+			return handlers.NewFieldError("payment.provider", "payment.provider is not an enabled payment provider")
+		}
+		req.offline = offline
+	}
+	if req.Provider == paymentProviderCard && req.PaymentMethod == "" {
+		return handlers.NewFieldError("payment.payment_method", "payment.payment_method is required for card payments")
+	}
+	// Only the first-order discount needs to know the card
+	if firstOrderConfig.Percent > 0 {
+		fingerprintPayment(ctx, req)
+	}
+	return nil
+}
+
+// payOrder charges the order's amount due through the chosen provider. The payment is
+// recorded before the gateway is called, so every attempt is kept even when the call fails.
+// The order is paid once its captured payments cover the total.
+func payOrder(ctx context.Context, orderID int, req PaymentRequest) (*Payment, error) {
+	if req.offline != nil {
+		return payOrderOffline(ctx, orderID, req.offline)
+	}
+
+	payment := &Payment{OrderID: orderID, Provider: req.Provider, Currency: paymentConfig.Currency, Status: paymentStatusPending}
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO payments (order_id, provider, amount, currency, status, source, customer_reference)
+		SELECT id, $2, `+amountDueSQL+`, $3, $4, NULLIF($5, ''), NULLIF($6, '') FROM orders WHERE id = $1
+		RETURNING id, amount, created_at
+	`, orderID, payment.Provider, payment.Currency, payment.Status, req.PaymentMethod, req.customerReference).Scan(&payment.ID, &payment.Amount, &payment.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := paymentGateways[req.Provider].Charge(ctx, PaymentCharge{
+		OrderID:           orderID,
+		PaymentID:         payment.ID,
+		Amount:            payment.Amount,
+		Currency:          payment.Currency,
+		Source:            req.PaymentMethod,
+		CustomerReference: req.customerReference,
+	})
+	if err != nil {
+		result = &PaymentResult{Status: paymentStatusFailed, FailureReason: "payment provider error"}
+		log.Printf("Error charging order %d with %s: %v", orderID, req.Provider, err)
+	}
+
+	return payment, savePaymentResult(ctx, payment, result)
+}
+
+// savePaymentResult records the gateway's answer on the payment and settles the order once
+// the payment is captured
+func savePaymentResult(ctx context.Context, payment *Payment, result *PaymentResult) error {
+	payment.Status = result.Status
+	payment.FailureReason = result.FailureReason
+	payment.ApprovalURL = result.ApprovalURL
+	payment.ClientSecret = result.ClientSecret
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE payments
+		SET status = $1, reference = COALESCE(NULLIF($2, ''), reference),
+			capture_reference = COALESCE(NULLIF($3, ''), capture_reference),
+			failure_reason = NULLIF($4, ''), updated_at = NOW()
+		WHERE id = $5
+	`, result.Status, result.Reference, result.CaptureReference, result.FailureReason, payment.ID)
+	if err != nil {
+		return err
+	}
+	if result.Status == paymentStatusCaptured {
+		if err := recordCharge(ctx, tx, payment.ID, result.Fee); err != nil {
+			return err
+		}
+		if err := settleOrder(ctx, tx, payment.OrderID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CUSTOMER CAPTURE PAYMENT
+// CustomerCapturePaymentHandler finishes the pending payment of the customer's order after
+// they approved it with the provider, e.g. when PayPal redirects them back to the store
+func CustomerCapturePaymentHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	payment, err := capturePayment(r.Context(), orderID, getCustomerID(r))
+	if err == errPaymentNotFound {
+		handlers.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err == errPaymentNotApproved {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error capturing payment:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if payment.Status == paymentStatusFailed {
+		handlers.WriteJSON(w, http.StatusPaymentRequired, payment)
+		return
+	}
+	handlers.WriteJSON(w, http.StatusOK, payment)
+}
+
+func capturePayment(ctx context.Context, orderID, customerID int) (*Payment, error) {
+	var payment Payment
+	var reference string
+	err := db.QueryRowContext(ctx, `
+		SELECT p.id, p.order_id, p.provider, p.amount, p.currency, p.status, p.created_at, COALESCE(p.reference, '')
+		FROM payments p
+		JOIN orders o ON p.order_id = o.id
+		WHERE p.order_id = $1 AND o.customer_id = $2 AND p.status = $3
+		ORDER BY p.created_at DESC, p.id DESC
+		LIMIT 1
+	`, orderID, customerID, paymentStatusPending).Scan(&payment.ID, &payment.OrderID, &payment.Provider, &payment.Amount,
+		&payment.Currency, &payment.Status, &payment.CreatedAt, &reference)
+	if isNoRows(err) {
+		return nil, errPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	gateway, ok := paymentGateways[payment.Provider]
+	// Offline payments have no provider; they wait for an admin to mark the order as paid
+	if !ok && reference == "" {
+		return nil, errPaymentNotApproved
+	}
+	if !ok || reference == "" {
+		return nil, fmt.Errorf("payment %d can't be captured: provider %q is not enabled or the payment has no reference", payment.ID, payment.Provider)
+	}
+	result, err := gateway.Capture(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+	if result.Status == paymentStatusPending {
+		return nil, errPaymentNotApproved
+	}
+
+	return &payment, savePaymentResult(ctx, &payment, result)
+}
+
+// amountDueSQL selects an order's total less what its captured payments already paid, in a
+// query over the orders table
+const amountDueSQL = `COALESCE(orders.total, 0) - (
+	SELECT COALESCE(SUM(amount), 0) FROM payments WHERE order_id = orders.id AND status = '` + paymentStatusCaptured + `')`
+
+// settleOrder marks a pending or unpaid order as paid once its captured payments cover the total,
+// issues the gift cards bought with it, awards its loyalty points and rewards the referral of a
+// customer's first order
+func settleOrder(ctx context.Context, tx *sql.Tx, orderID int) error {
+	result, err := tx.ExecContext(ctx, `
+		UPDATE orders SET status = $1
+		WHERE id = $2 AND status IN ($3, $4) AND `+amountDueSQL+` <= 0
+	`, orderStatusPaid, orderID, orderStatusPending, orderStatusAwaitingPayment)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	if err := queueOrderEvent(ctx, tx, orderEventStatusChanged, orderID); err != nil {
+		return err
+	}
+	if err := issueOrderGiftCards(ctx, tx, orderID); err != nil {
+		return err
+	}
+	if err := earnOrderPoints(ctx, tx, orderID); err != nil {
+		return err
+	}
+	return rewardReferral(ctx, tx, orderID)
+}
+
+// toMinorUnits converts an amount to cents, which card providers charge in
+func toMinorUnits(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// writePlacedOrder pays for the new order when the request chose a payment and responds with
+// the order ID and its payments
+func writePlacedOrder(w http.ResponseWriter, r *http.Request, orderID int, req *PaymentRequest) {
+	response := map[string]interface{}{"order_id": orderID}
+	if req != nil {
+		giftCardPayment, payment, err := payOrderSplit(r.Context(), orderID, *req)
+		if err != nil {
+			log.Printf("Error paying for order %d: %v", orderID, err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		if giftCardPayment != nil {
+			response["gift_card_payment"] = giftCardPayment
+		}
+		if payment != nil {
+			response["payment"] = payment
+		}
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, response)
+}
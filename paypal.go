@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const payPalSandboxURL = "https://api-m.sandbox.paypal.com"
+
+// payPalGateway takes PayPal payments with the Orders v2 API. Charge creates a PayPal order
+// the customer approves on PayPal; they are then sent to the return URL and the store
+// captures the payment.
+type payPalGateway struct {
+	clientID     string
+	clientSecret string
+	apiURL       string
+	returnURL    string
+	cancelURL    string
+	// webhookID is the ID PayPal gave the webhook, needed to verify its events
+	webhookID string
+	client    *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+type payPalOrder struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Links  []struct {
+		Href string `json:"href"`
+		Rel  string `json:"rel"`
+	} `json:"links"`
+	PurchaseUnits []struct {
+		Payments struct {
+			Captures []struct {
+				ID                        string `json:"id"`
+				Status                    string `json:"status"`
+				SellerReceivableBreakdown struct {
+					PayPalFee *payPalMoney `json:"paypal_fee"`
+				} `json:"seller_receivable_breakdown"`
+			} `json:"captures"`
+		} `json:"payments"`
+	} `json:"purchase_units"`
+}
+
+type payPalMoney struct {
+	CurrencyCode string `json:"currency_code"`
+	Value        string `json:"value"`
+}
+
+func (m *payPalMoney) amount() float64 {
+	if m == nil {
+		return 0
+	}
+	amount, _ := strconv.ParseFloat(m.Value, 64)
+	return amount
+}
+
+// payPalAPIError is an error response of the PayPal API
+type payPalAPIError struct {
+	StatusCode int
+	Name       string `json:"name"`
+	Message    string `json:"message"`
+	Details    []struct {
+		Issue       string `json:"issue"`
+		Description string `json:"description"`
+	} `json:"details"`
+}
+
+func (e *payPalAPIError) Error() string {
+	return fmt.Sprintf("paypal responded with %d %s: %s", e.StatusCode, e.Name, e.Message)
+}
+
+// issue returns the first detailed issue code, such as ORDER_NOT_APPROVED
+func (e *payPalAPIError) issue() string {
+	if len(e.Details) == 0 {
+		return ""
+	}
+	return e.Details[0].Issue
+}
+
+func newPayPalGateway(clientID, clientSecret, apiURL, returnURL, cancelURL, webhookID string) *payPalGateway {
+	if apiURL == "" {
+		apiURL = payPalSandboxURL
+	}
+	if cancelURL == "" {
+		cancelURL = returnURL
+	}
+	return &payPalGateway{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		apiURL:       strings.TrimSuffix(apiURL, "/"),
+		returnURL:    returnURL,
+		cancelURL:    cancelURL,
+		webhookID:    webhookID,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (g *payPalGateway) Charge(ctx context.Context, charge PaymentCharge) (*PaymentResult, error) {
+	body := map[string]interface{}{
+		"intent": "CAPTURE",
+		"purchase_units": []map[string]interface{}{{
+			"reference_id": strconv.Itoa(charge.OrderID),
+			"custom_id":    strconv.Itoa(charge.PaymentID),
+			"amount": map[string]string{
+				"currency_code": charge.Currency,
+				"value":         strconv.FormatFloat(charge.Amount, 'f', 2, 64),
+			},
+		}},
+		"application_context": map[string]string{
+			"return_url":  g.returnURL,
+			"cancel_url":  g.cancelURL,
+			"user_action": "PAY_NOW",
+		},
+	}
+
+	var order payPalOrder
+	if err := g.do(ctx, http.MethodPost, "/v2/checkout/orders", fmt.Sprintf("payment-%d", charge.PaymentID), body, &order); err != nil {
+		return nil, err
+	}
+
+	result := &PaymentResult{Reference: order.ID, Status: paymentStatusPending}
+	for _, link := range order.Links {
+		if link.Rel == "approve" || link.Rel == "payer-action" {
+			result.ApprovalURL = link.Href
+		}
+	}
+	return result, nil
+}
+
+func (g *payPalGateway) Capture(ctx context.Context, reference string) (*PaymentResult, error) {
+	var order payPalOrder
+	err := g.do(ctx, http.MethodPost, "/v2/checkout/orders/"+url.PathEscape(reference)+"/capture", "capture-"+reference, struct{}{}, &order)
+	var apiErr *payPalAPIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnprocessableEntity {
+		if apiErr.issue() == "ORDER_NOT_APPROVED" {
+			return &PaymentResult{Reference: reference, Status: paymentStatusPending}, nil
+		}
+		reason := apiErr.Message
+		if len(apiErr.Details) > 0 && apiErr.Details[0].Description != "" {
+			reason = apiErr.Details[0].Description
+		}
+		return &PaymentResult{Reference: reference, Status: paymentStatusFailed, FailureReason: reason}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PaymentResult{Reference: reference, Status: paymentStatusPending}
+	if len(order.PurchaseUnits) > 0 && len(order.PurchaseUnits[0].Payments.Captures) > 0 {
+		capture := order.PurchaseUnits[0].Payments.Captures[0]
+		result.CaptureReference = capture.ID
+		switch capture.Status {
+		case "COMPLETED":
+			result.Status = paymentStatusCaptured
+			result.Fee = capture.SellerReceivableBreakdown.PayPalFee.amount()
+		case "DECLINED", "FAILED":
+			result.Status = paymentStatusFailed
+			result.FailureReason = "PayPal declined the payment"
+		}
+	}
+	return result, nil
+}
+
+func (g *payPalGateway) Refund(ctx context.Context, refund PaymentRefund) (string, error) {
+	body := map[string]interface{}{
+		"amount": map[string]string{
+			"currency_code": refund.Currency,
+			"value":         strconv.FormatFloat(refund.Amount, 'f', 2, 64),
+		},
+	}
+
+	var response struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	path := "/v2/payments/captures/" + url.PathEscape(refund.CaptureReference) + "/refund"
+	if err := g.do(ctx, http.MethodPost, path, fmt.Sprintf("refund-%d", refund.RefundID), body, &response); err != nil {
+		return "", err
+	}
+	if response.Status == "FAILED" || response.Status == "CANCELLED" {
+		return "", fmt.Errorf("paypal refund %s %s", response.ID, response.Status)
+	}
+	return response.ID, nil
+}
+
+// Settlement sums the period's transactions from PayPal's transaction search. Event codes
+// T00xx are payments, T11xx refunds and T04xx withdrawals to the bank.
+func (g *payPalGateway) Settlement(ctx context.Context, from, to time.Time) (*ProviderSettlement, error) {
+	settlement := &ProviderSettlement{}
+	query := url.Values{}
+	query.Set("start_date", from.UTC().Format(time.RFC3339))
+	// end_date is inclusive
+	query.Set("end_date", to.Add(-time.Second).UTC().Format(time.RFC3339))
+	query.Set("fields", "transaction_info")
+	query.Set("page_size", "500")
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		var response struct {
+			TransactionDetails []struct {
+				TransactionInfo struct {
+					EventCode string       `json:"transaction_event_code"`
+					Amount    *payPalMoney `json:"transaction_amount"`
+					Fee       *payPalMoney `json:"fee_amount"`
+				} `json:"transaction_info"`
+			} `json:"transaction_details"`
+			TotalPages int `json:"total_pages"`
+		}
+		if err := g.do(ctx, http.MethodGet, "/v1/reporting/transactions?"+query.Encode(), "", nil, &response); err != nil {
+			return nil, err
+		}
+
+		for _, detail := range response.TransactionDetails {
+			info := detail.TransactionInfo
+			amount := info.Amount.amount()
+			// PayPal reports fees as negative amounts
+			fee := -info.Fee.amount()
+			switch {
+			case strings.HasPrefix(info.EventCode, "T00"):
+				settlement.Charges += amount
+			case strings.HasPrefix(info.EventCode, "T11"):
+				settlement.Refunds -= amount
+			case strings.HasPrefix(info.EventCode, "T04"):
+				settlement.Payouts -= amount
+				continue
+			default:
+				continue
+			}
+			settlement.Fees += fee
+			settlement.Net += amount - fee
+		}
+		if page >= response.TotalPages {
+			break
+		}
+	}
+
+	settlement.Charges = roundCents(settlement.Charges)
+	settlement.Refunds = roundCents(settlement.Refunds)
+	settlement.Fees = roundCents(settlement.Fees)
+	settlement.Net = roundCents(settlement.Net)
+	settlement.Payouts = roundCents(settlement.Payouts)
+	return settlement, nil
+}
+
+// accessToken returns a cached OAuth token, fetching a new one shortly before it expires
+func (g *payPalGateway) accessToken(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.token != "" && time.Now().Before(g.tokenExpiry) {
+		return g.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.apiURL+"/v1/oauth2/token", strings.NewReader("grant_type=client_credentials"))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(g.clientID, g.clientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("paypal token request responded with %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	g.token = token.AccessToken
+	g.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return g.token, nil
+}
+
+// do calls the PayPal API with a JSON body and decodes the JSON response into out. The
+// request ID makes PayPal answer a retried request with the original result.
+func (g *payPalGateway) do(ctx context.Context, method, path, requestID string, body, out interface{}) error {
+	token, err := g.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, g.apiURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	if requestID != "" {
+		req.Header.Set("PayPal-Request-Id", requestID)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := &payPalAPIError{StatusCode: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(apiErr)
+		return apiErr
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ParseWebhook has PayPal verify the event's transmission signature
+func (g *payPalGateway) ParseWebhook(ctx context.Context, r *http.Request, body []byte) (*PaymentEvent, error) {
+	if g.webhookID == "" {
+		return nil, errors.New("PAYPAL_WEBHOOK_ID is not set")
+	}
+
+	verification := map[string]interface{}{
+		"auth_algo":         r.Header.Get("Paypal-Auth-Algo"),
+		"cert_url":          r.Header.Get("Paypal-Cert-Url"),
+		"transmission_id":   r.Header.Get("Paypal-Transmission-Id"),
+		"transmission_sig":  r.Header.Get("Paypal-Transmission-Sig"),
+		"transmission_time": r.Header.Get("Paypal-Transmission-Time"),
+		"webhook_id":        g.webhookID,
+		"webhook_event":     json.RawMessage(body),
+	}
+	var verified struct {
+		VerificationStatus string `json:"verification_status"`
+	}
+	if err := g.do(ctx, http.MethodPost, "/v1/notifications/verify-webhook-signature", "", verification, &verified); err != nil {
+		return nil, err
+	}
+	if verified.VerificationStatus != "SUCCESS" {
+		return nil, errInvalidWebhookSignature
+	}
+
+	var event struct {
+		ID        string          `json:"id"`
+		EventType string          `json:"event_type"`
+		Resource  json.RawMessage `json:"resource"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+
+	paymentEvent := &PaymentEvent{ID: event.ID}
+	switch event.EventType {
+	case "PAYMENT.CAPTURE.COMPLETED", "PAYMENT.CAPTURE.DENIED":
+		var capture struct {
+			ID                string `json:"id"`
+			SupplementaryData struct {
+				RelatedIDs struct {
+					OrderID string `json:"order_id"`
+				} `json:"related_ids"`
+			} `json:"supplementary_data"`
+		}
+		if err := json.Unmarshal(event.Resource, &capture); err != nil {
+			return nil, err
+		}
+		paymentEvent.Reference = capture.SupplementaryData.RelatedIDs.OrderID
+		paymentEvent.CaptureReference = capture.ID
+		if event.EventType == "PAYMENT.CAPTURE.COMPLETED" {
+			paymentEvent.Type = paymentEventSucceeded
+		} else {
+			paymentEvent.Type = paymentEventFailed
+			paymentEvent.FailureReason = "PayPal declined the payment"
+		}
+	case "CUSTOMER.DISPUTE.CREATED":
+		var dispute struct {
+			DisputedTransactions []struct {
+				SellerTransactionID string `json:"seller_transaction_id"`
+			} `json:"disputed_transactions"`
+		}
+		if err := json.Unmarshal(event.Resource, &dispute); err != nil {
+			return nil, err
+		}
+		if len(dispute.DisputedTransactions) > 0 {
+			paymentEvent.Type = paymentEventChargeback
+			paymentEvent.CaptureReference = dispute.DisputedTransactions[0].SellerTransactionID
+		}
+	}
+	return paymentEvent, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Permissions checked by AuthMiddleware. Every permission is seeded in initDB.
+const (
+	PermPlaceOrder     = "orders.place"
+	PermViewOwnOrders  = "orders.view_own"
+	PermViewAllOrders  = "orders.view"
+	PermRefundOrders   = "orders.refund"
+	PermFulfillOrders  = "orders.fulfill"
+	PermManagePayments = "payments.manage"
+	PermManageProducts = "products.manage"
+	PermManageRoles    = "roles.manage"
+	PermManageAPIKeys  = "api_keys.manage"
+	PermViewReports    = "reports.view"
+)
+
+var errUnknownRole = handlers.NewFieldError("role", "role does not exist")
+var errUnknownPermission = handlers.NewFieldError("permission", "permission does not exist")
+
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+type AssignRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// customerHasPermission checks the customer's current role, so role changes apply without a new token
+func customerHasPermission(ctx context.Context, customerID int, permission string) (bool, error) {
+	var allowed bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1
+			FROM customers c
+			JOIN roles r ON r.name = c.role
+			JOIN role_permissions rp ON rp.role_id = r.id
+			JOIN permissions p ON p.id = rp.permission_id
+			WHERE c.id = $1 AND p.name = $2
+		)
+	`, customerID, permission).Scan(&allowed)
+	return allowed, err
+}
+
+// requestHasPermission checks the permission of the request's API key or customer, for handlers
+// whose permission depends on the request
+func requestHasPermission(r *http.Request, permission string) (bool, error) {
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+		return apiKeyHasScope(r.Context(), apiKey, permission)
+	}
+	customerID := getCustomerID(r)
+	if customerID == 0 {
+		return false, nil
+	}
+	return customerHasPermission(r.Context(), customerID, permission)
+}
+
+// getPermissionEmails returns the email of every customer whose role grants the permission
+func getPermissionEmails(ctx context.Context, permission string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.email
+		FROM customers c
+		JOIN roles r ON r.name = c.role
+		JOIN role_permissions rp ON rp.role_id = r.id
+		JOIN permissions p ON p.id = rp.permission_id
+		WHERE p.name = $1
+		ORDER BY c.id
+	`, permission)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+
+	return emails, rows.Err()
+}
+
+// ADMIN ROLES & PERMISSIONS
+func AdminRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := getRoles(r.Context())
+	if err != nil {
+		log.Println("Error retrieving roles:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, roles)
+}
+
+func AdminSaveRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var role Role
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &role)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	// PUT /admin/roles/{name} takes the name from the path
+	if name, ok := mux.Vars(r)["name"]; ok {
+		role.Name = name
+	}
+	role.Name = strings.TrimSpace(role.Name)
+	if role.Name == "" {
+		handlers.WriteFieldError(w, "name", "name is required")
+		return
+	}
+
+	err = saveRole(r.Context(), role)
+	if err == errUnknownPermission {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err != nil {
+		log.Println("Error saving role:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, role)
+}
+
+func AdminAssignRoleHandler(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid customer ID")
+		return
+	}
+
+	var assignRequest AssignRoleRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &assignRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	err = assignRole(r.Context(), customerID, assignRequest.Role)
+	if err == errUnknownRole {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Customer not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error assigning role:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Role assigned successfully"))
+}
+
+func getRoles(ctx context.Context) ([]Role, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT r.name, p.name
+		FROM roles r
+		LEFT JOIN role_permissions rp ON rp.role_id = r.id
+		LEFT JOIN permissions p ON p.id = rp.permission_id
+		ORDER BY r.name, p.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make([]Role, 0)
+	for rows.Next() {
+		var roleName string
+		var permission *string
+		if err := rows.Scan(&roleName, &permission); err != nil {
+			return nil, err
+		}
+
+		if len(roles) == 0 || roles[len(roles)-1].Name != roleName {
+			roles = append(roles, Role{Name: roleName, Permissions: make([]string, 0)})
+		}
+		if permission != nil {
+			last := &roles[len(roles)-1]
+			last.Permissions = append(last.Permissions, *permission)
+		}
+	}
+
+	return roles, rows.Err()
+}
+
+// saveRole creates the role if needed and replaces its permissions
+func saveRole(ctx context.Context, role Role) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var roleID int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO roles (name) VALUES ($1)
+		ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id
+	`, role.Name).Scan(&roleID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM role_permissions WHERE role_id = $1", roleID)
+	if err != nil {
+		return err
+	}
+
+	for _, permission := range role.Permissions {
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO role_permissions (role_id, permission_id)
+			SELECT $1, id FROM permissions WHERE name = $2
+			ON CONFLICT DO NOTHING
+		`, roleID, permission)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			var exists bool
+			if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM permissions WHERE name = $1)", permission).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				return errUnknownPermission
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func assignRole(ctx context.Context, customerID int, role string) error {
+	var exists bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)", role).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errUnknownRole
+	}
+
+	var id int
+	return db.QueryRowContext(ctx, "UPDATE customers SET role = $1 WHERE id = $2 RETURNING id", role, customerID).Scan(&id)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// shippingPickup is the shipping method of orders collected at a pickup location
+const shippingPickup = "pickup"
+
+const orderStatusReadyForPickup = "Ready for Pickup"
+
+var errPickupLocationNotFound = handlers.NewFieldError("pickup_location_id", "pickup_location_id is not an open pickup location")
+var errNotPickupOrder = errors.New("the order is not for pickup")
+var errOrderNotReadyForPickup = errors.New("only pending, unpaid or paid orders can be made ready for pickup")
+
+// PickupLocation is a store where customers collect their orders instead of having them
+// shipped. Its address's name is the location's name.
+type PickupLocation struct {
+	ID int `json:"pickup_location_id"`
+	PostalAddress
+	// Hours are the opening hours shown to customers, e.g. "Mon-Fri 9:00-18:00"
+	Hours     string    `json:"hours,omitempty"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PickupLocationRequest struct {
+	PostalAddress
+	Hours string `json:"hours"`
+	// Enabled defaults to true
+	Enabled *bool `json:"enabled"`
+}
+
+// PICKUP LOCATIONS
+// PickupLocationsHandler lists the locations customers can pick orders up from
+func PickupLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	locations, err := getPickupLocations(r.Context(), true)
+	if err != nil {
+		log.Println("Error retrieving pickup locations:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, locations)
+}
+
+// ADMIN PICKUP LOCATIONS
+func AdminPickupLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	locations, err := getPickupLocations(r.Context(), false)
+	if err != nil {
+		log.Println("Error retrieving pickup locations:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, locations)
+}
+
+func AdminCreatePickupLocationHandler(w http.ResponseWriter, r *http.Request) {
+	locationRequest, ok := readPickupLocationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	location, err := savePickupLocation(r.Context(), 0, locationRequest)
+	if err != nil {
+		log.Println("Error creating pickup location:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, location)
+}
+
+func AdminUpdatePickupLocationHandler(w http.ResponseWriter, r *http.Request) {
+	locationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid pickup location ID")
+		return
+	}
+
+	locationRequest, ok := readPickupLocationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	location, err := savePickupLocation(r.Context(), locationID, locationRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Pickup location not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error updating pickup location:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, location)
+}
+
+// AdminDeletePickupLocationHandler deletes a location no order was placed for; others can
+// only be disabled
+func AdminDeletePickupLocationHandler(w http.ResponseWriter, r *http.Request) {
+	locationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid pickup location ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM pickup_locations WHERE id = $1", locationID)
+	if isForeignKeyViolation(err) {
+		handlers.WriteError(w, http.StatusConflict, "Orders were placed for this pickup location; disable it instead")
+		return
+	}
+	if err != nil {
+		log.Println("Error deleting pickup location:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Pickup location not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ADMIN READY FOR PICKUP
+// AdminReadyForPickupHandler marks a pickup order as ready to collect and emails the customer
+// where to collect it
+func AdminReadyForPickupHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	email, location, err := markReadyForPickup(r.Context(), orderID)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if err == errNotPickupOrder || err == errOrderNotReadyForPickup {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error marking order ready for pickup:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	sendReadyForPickupEmail(r.Context(), email, orderID, location)
+
+	handlers.WriteJSON(w, http.StatusOK, map[string]interface{}{"order_id": orderID, "status": orderStatusReadyForPickup})
+}
+
+func readPickupLocationRequest(w http.ResponseWriter, r *http.Request) (PickupLocationRequest, bool) {
+	var locationRequest PickupLocationRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return locationRequest, false
+	}
+
+	err = json.Unmarshal(body, &locationRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return locationRequest, false
+	}
+
+	locationRequest.Hours = strings.TrimSpace(locationRequest.Hours)
+	if locationRequest.Enabled == nil {
+		enabled := true
+		locationRequest.Enabled = &enabled
+	}
+
+	err = validateAddress(&locationRequest.PostalAddress)
+	if err == nil && len(locationRequest.Hours) > 255 {
+		err = handlers.NewFieldError("hours", "hours must be at most 255 characters")
+	}
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return locationRequest, false
+	}
+
+	return locationRequest, true
+}
+
+// savePickupLocation inserts a new location when locationID is 0, otherwise updates it
+func savePickupLocation(ctx context.Context, locationID int, req PickupLocationRequest) (*PickupLocation, error) {
+	location := &PickupLocation{PostalAddress: req.PostalAddress, Hours: req.Hours, Enabled: *req.Enabled}
+	a := &req.PostalAddress
+
+	var err error
+	if locationID == 0 {
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO pickup_locations (name, line1, line2, city, region, postal_code, country, phone, hours, enabled)
+			VALUES ($1, $2, NULLIF($3, ''), $4, NULLIF($5, ''), NULLIF($6, ''), $7, NULLIF($8, ''), NULLIF($9, ''), $10)
+			RETURNING id, created_at
+		`, a.Name, a.Line1, a.Line2, a.City, a.Region, a.PostalCode, a.Country, a.Phone, req.Hours, *req.Enabled).Scan(&location.ID, &location.CreatedAt)
+	} else {
+		err = db.QueryRowContext(ctx, `
+			UPDATE pickup_locations
+			SET name = $1, line1 = $2, line2 = NULLIF($3, ''), city = $4, region = NULLIF($5, ''), postal_code = NULLIF($6, ''),
+				country = $7, phone = NULLIF($8, ''), hours = NULLIF($9, ''), enabled = $10
+			WHERE id = $11
+			RETURNING id, created_at
+		`, a.Name, a.Line1, a.Line2, a.City, a.Region, a.PostalCode, a.Country, a.Phone, req.Hours, *req.Enabled,
+			locationID).Scan(&location.ID, &location.CreatedAt)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return location, nil
+}
+
+const pickupLocationColumnsSQL = `
+	id, name, line1, COALESCE(line2, ''), city, COALESCE(region, ''), COALESCE(postal_code, ''),
+	country, COALESCE(phone, ''), COALESCE(hours, ''), enabled, created_at
+`
+
+func scanPickupLocation(row interface{ Scan(...interface{}) error }) (*PickupLocation, error) {
+	location := &PickupLocation{}
+	a := &location.PostalAddress
+	err := row.Scan(&location.ID, &a.Name, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode,
+		&a.Country, &a.Phone, &location.Hours, &location.Enabled, &location.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return location, nil
+}
+
+func getPickupLocations(ctx context.Context, enabledOnly bool) ([]PickupLocation, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+pickupLocationColumnsSQL+`
+		FROM pickup_locations
+		WHERE enabled OR NOT $1
+		ORDER BY name, id
+	`, enabledOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := make([]PickupLocation, 0)
+	for rows.Next() {
+		location, err := scanPickupLocation(rows)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, *location)
+	}
+
+	return locations, rows.Err()
+}
+
+// pickupDestination returns where the enabled pickup location is, which a pickup order is
+// taxed by
+func pickupDestination(ctx context.Context, locationID int) (*Destination, error) {
+	destination := &Destination{}
+	err := db.QueryRowContext(ctx, `
+		SELECT country, COALESCE(region, ''), COALESCE(postal_code, '')
+		FROM pickup_locations
+		WHERE id = $1 AND enabled
+	`, locationID).Scan(&destination.Country, &destination.Region, &destination.PostalCode)
+	if isNoRows(err) {
+		return nil, errPickupLocationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return destination, nil
+}
+
+// pricePickupOrder adds the tax at the pickup location to the subtotal; picking up is free
+func pricePickupOrder(ctx context.Context, subtotal float64, destination Destination) (*Quote, error) {
+	taxRate, err := getTaxRate(ctx, destination.Country, destination.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	quote := &Quote{
+		Subtotal:        roundCents(subtotal),
+		TaxRate:         taxRate,
+		Tax:             roundCents(subtotal * taxRate),
+		ShippingOptions: []ShippingOption{{Code: shippingPickup, Name: "Pickup"}},
+		ShippingMethod:  shippingPickup,
+	}
+	quote.Total = roundCents(quote.Subtotal + quote.Tax)
+	return quote, nil
+}
+
+// markReadyForPickup moves the pickup order to Ready for Pickup. It returns the customer's
+// email and the pickup location.
+func markReadyForPickup(ctx context.Context, orderID int) (string, *PickupLocation, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+
+	var status, email string
+	var locationID *int
+	err = tx.QueryRowContext(ctx, `
+		SELECT o.status, c.email, o.pickup_location_id
+		FROM orders o
+		JOIN customers c ON o.customer_id = c.id
+		WHERE o.id = $1
+		FOR UPDATE OF o
+	`, orderID).Scan(&status, &email, &locationID)
+	if err != nil {
+		return "", nil, err
+	}
+	if locationID == nil {
+		return "", nil, errNotPickupOrder
+	}
+	if err := checkOrderStatusTransition(status, orderStatusReadyForPickup); err != nil {
+		return "", nil, err
+	}
+
+	location, err := scanPickupLocation(tx.QueryRowContext(ctx, "SELECT "+pickupLocationColumnsSQL+" FROM pickup_locations WHERE id = $1", *locationID))
+	if err != nil {
+		return "", nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE orders
+		SET status = $1, ready_for_pickup_at = NOW()
+		WHERE id = $2
+	`, orderStatusReadyForPickup, orderID)
+	if err == nil {
+		err = queueOrderEvent(ctx, tx, orderEventStatusChanged, orderID)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return email, location, tx.Commit()
+}
+
+func sendReadyForPickupEmail(ctx context.Context, email string, orderID int, location *PickupLocation) {
+	address := location.Line1
+	if location.Line2 != "" {
+		address += ", " + location.Line2
+	}
+	address += ", " + location.City
+	if location.PostalCode != "" {
+		address += " " + location.PostalCode
+	}
+
+	data := pickupEmail{OrderID: orderID, Location: location, Address: address}
+	if err := sendEmail(ctx, email, emailReadyForPickup, fmt.Sprintf("ready_for_pickup:%d", orderID), data); err != nil {
+		log.Printf("Error sending ready for pickup email to %s for order %d: %v", email, orderID, err)
+	}
+}
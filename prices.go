@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// priceScheduleInterval is how often the background task looks for due price changes
+const priceScheduleInterval = time.Minute
+
+// PriceSchedule is a future price change, applied by the background task once effective_at has passed
+type PriceSchedule struct {
+	ID          int        `json:"schedule_id"`
+	ProductID   int        `json:"product_id"`
+	Price       float64    `json:"price"`
+	EffectiveAt time.Time  `json:"effective_at"`
+	AppliedAt   *time.Time `json:"applied_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+type PriceScheduleRequest struct {
+	Price       float64   `json:"price"`
+	EffectiveAt time.Time `json:"effective_at"`
+}
+
+type PriceChange struct {
+	OldPrice  *float64  `json:"old_price"`
+	NewPrice  float64   `json:"new_price"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// ADMIN PRICE SCHEDULES
+func AdminPriceSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	schedules, err := getPriceSchedules(r.Context(), productID)
+	if err != nil {
+		log.Println("Error retrieving price schedules:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, schedules)
+}
+
+func AdminCreatePriceScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	var scheduleRequest PriceScheduleRequest
+	err = json.Unmarshal(body, &scheduleRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	var validationErr error
+	switch {
+	case scheduleRequest.Price < 0:
+		validationErr = handlers.NewFieldError("price", "price must not be negative")
+	case !scheduleRequest.EffectiveAt.After(time.Now()):
+		validationErr = handlers.NewFieldError("effective_at", "effective_at must be in the future")
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return
+	}
+
+	schedule := PriceSchedule{ProductID: productID, Price: scheduleRequest.Price, EffectiveAt: scheduleRequest.EffectiveAt}
+	err = db.QueryRowContext(r.Context(), `
+		INSERT INTO price_schedules (product_id, price, effective_at)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, productID, scheduleRequest.Price, scheduleRequest.EffectiveAt).Scan(&schedule.ID, &schedule.CreatedAt)
+	if isForeignKeyViolation(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error creating price schedule:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, schedule)
+}
+
+func AdminDeletePriceScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+	scheduleID, err := strconv.Atoi(mux.Vars(r)["scheduleID"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid schedule ID")
+		return
+	}
+
+	var applied bool
+	err = db.QueryRowContext(r.Context(), `
+		WITH deleted AS (
+			DELETE FROM price_schedules
+			WHERE id = $1 AND product_id = $2 AND applied_at IS NULL
+			RETURNING id
+		)
+		SELECT NOT EXISTS (SELECT 1 FROM deleted)
+		FROM price_schedules
+		WHERE id = $1 AND product_id = $2
+	`, scheduleID, productID).Scan(&applied)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Price schedule not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error deleting price schedule:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if applied {
+		handlers.WriteError(w, http.StatusConflict, "price schedule has already been applied")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func AdminPriceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT old_price, new_price, changed_at
+		FROM product_price_history
+		WHERE product_id = $1
+		ORDER BY changed_at DESC, id DESC
+	`, productID)
+	if err != nil {
+		log.Println("Error retrieving price history:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	defer rows.Close()
+
+	history := make([]PriceChange, 0)
+	for rows.Next() {
+		var change PriceChange
+		if err := rows.Scan(&change.OldPrice, &change.NewPrice, &change.ChangedAt); err != nil {
+			log.Println("Error scanning price history:", err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		history = append(history, change)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error retrieving price history:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, history)
+}
+
+func getPriceSchedules(ctx context.Context, productID int) ([]PriceSchedule, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, product_id, price, effective_at, applied_at, created_at
+		FROM price_schedules
+		WHERE product_id = $1
+		ORDER BY effective_at, id
+	`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := make([]PriceSchedule, 0)
+	for rows.Next() {
+		var schedule PriceSchedule
+		if err := rows.Scan(&schedule.ID, &schedule.ProductID, &schedule.Price, &schedule.EffectiveAt, &schedule.AppliedAt, &schedule.CreatedAt); err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, rows.Err()
+}
+
+// applyDuePriceSchedules sets the price of every schedule whose effective_at has passed.
+// Schedules are applied oldest first, so the latest one due wins.
+func applyDuePriceSchedules(ctx context.Context) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Error starting price schedule transaction:", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// SKIP LOCKED lets several instances run the task without applying a schedule twice
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, product_id, price
+		FROM price_schedules
+		WHERE applied_at IS NULL AND effective_at <= NOW()
+		ORDER BY effective_at, id
+		FOR UPDATE SKIP LOCKED
+	`)
+	if err != nil {
+		log.Println("Error querying due price schedules:", err)
+		return
+	}
+
+	var due []PriceSchedule
+	for rows.Next() {
+		var schedule PriceSchedule
+		if err := rows.Scan(&schedule.ID, &schedule.ProductID, &schedule.Price); err != nil {
+			rows.Close()
+			log.Println("Error scanning price schedule:", err)
+			return
+		}
+		due = append(due, schedule)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Println("Error querying due price schedules:", err)
+		return
+	}
+
+	for _, schedule := range due {
+		if _, err := tx.ExecContext(ctx, "UPDATE products SET price = $1 WHERE id = $2", schedule.Price, schedule.ProductID); err != nil {
+			log.Printf("Error applying price schedule %d: %v", schedule.ID, err)
+			return
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE price_schedules SET applied_at = NOW() WHERE id = $1", schedule.ID); err != nil {
+			log.Printf("Error applying price schedule %d: %v", schedule.ID, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println("Error committing price schedules:", err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const (
+	maxImageSize   = 10 << 20
+	maxUploadSize  = 50 << 20
+	imageFormField = "images"
+)
+
+// imageExtensions lists the accepted image types, detected from the file content
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+type ProductImage struct {
+	ID        int       `json:"image_id"`
+	URL       string    `json:"url"`
+	Position  int       `json:"position"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ADMIN PRODUCT IMAGES
+func AdminUploadProductImagesHandler(w http.ResponseWriter, r *http.Request) {
+	if objectStorage == nil {
+		handlers.WriteError(w, http.StatusServiceUnavailable, "Image storage is not configured")
+		return
+	}
+
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	if _, err := getProduct(r.Context(), productID); isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Product not found")
+		return
+	} else if err != nil {
+		log.Println("Error retrieving product:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(maxImageSize); err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid multipart upload: "+err.Error())
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File[imageFormField]
+	if len(files) == 0 {
+		handlers.WriteFieldError(w, imageFormField, "at least one file is required in the \"images\" field")
+		return
+	}
+
+	images := make([]ProductImage, 0, len(files))
+	for _, fileHeader := range files {
+		image, validationErr, err := storeProductImage(r, productID, fileHeader)
+		if validationErr != "" {
+			handlers.WriteFieldError(w, imageFormField, fileHeader.Filename+": "+validationErr)
+			return
+		}
+		if err != nil {
+			log.Println("Error storing product image:", err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		images = append(images, *image)
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, images)
+}
+
+func AdminDeleteProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+	imageID, err := strconv.Atoi(mux.Vars(r)["imageID"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid image ID")
+		return
+	}
+
+	var objectKey string
+	err = db.QueryRowContext(r.Context(), "DELETE FROM product_images WHERE id = $1 AND product_id = $2 RETURNING object_key",
+		imageID, productID).Scan(&objectKey)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Image not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error deleting product image:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// The row is gone either way; a leftover object only costs storage
+	if objectStorage != nil {
+		if err := objectStorage.Delete(r.Context(), objectKey); err != nil {
+			log.Println("Error deleting image object:", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// storeProductImage validates one uploaded file, uploads it and records it on the product.
+// A non-empty validationErr means the file was rejected.
+func storeProductImage(r *http.Request, productID int, fileHeader *multipart.FileHeader) (*ProductImage, string, error) {
+	if fileHeader.Size > maxImageSize {
+		return nil, "file is larger than 10MB", nil
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType := http.DetectContentType(data)
+	extension, ok := imageExtensions[contentType]
+	if !ok {
+		return nil, "only JPEG, PNG, GIF and WebP images are accepted", nil
+	}
+
+	name, err := generateToken(16)
+	if err != nil {
+		return nil, "", err
+	}
+	objectKey := "products/" + strconv.Itoa(productID) + "/" + name + extension
+
+	url, err := objectStorage.Put(r.Context(), objectKey, bytes.NewReader(data), int64(len(data)), contentType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	image := &ProductImage{URL: url}
+	err = db.QueryRowContext(r.Context(), `
+		INSERT INTO product_images (product_id, url, object_key, position)
+		VALUES ($1, $2, $3, (SELECT COALESCE(MAX(position), -1) + 1 FROM product_images WHERE product_id = $1))
+		RETURNING id, position, created_at
+	`, productID, url, objectKey).Scan(&image.ID, &image.Position, &image.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Products without a main image use the first uploaded one
+	_, err = db.ExecContext(r.Context(), "UPDATE products SET image_url = $1 WHERE id = $2 AND COALESCE(image_url, '') = ''", url, productID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return image, "", nil
+}
+
+func getProductImages(ctx context.Context, productID int) ([]ProductImage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, url, position, created_at
+		FROM product_images
+		WHERE product_id = $1
+		ORDER BY position, id
+	`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := make([]ProductImage, 0)
+	for rows.Next() {
+		var image ProductImage
+		if err := rows.Scan(&image.ID, &image.URL, &image.Position, &image.CreatedAt); err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+
+	return images, rows.Err()
+}
+
+// getImagesOfProducts returns the images of each product, in one query
+func getImagesOfProducts(ctx context.Context, productIDs []int) (map[int][]ProductImage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT product_id, id, url, position, created_at
+		FROM product_images
+		WHERE product_id = ANY($1)
+		ORDER BY position, id
+	`, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := make(map[int][]ProductImage)
+	for rows.Next() {
+		var productID int
+		var image ProductImage
+		if err := rows.Scan(&productID, &image.ID, &image.URL, &image.Position, &image.CreatedAt); err != nil {
+			return nil, err
+		}
+		images[productID] = append(images[productID], image)
+	}
+
+	return images, rows.Err()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const (
+	maxImportSize   = 10 << 20
+	importFormField = "file"
+
+	importCreated = "created"
+	importUpdated = "updated"
+	importError   = "error"
+)
+
+// importColumns are the recognised CSV header names; sku, product_name and price are required
+var importColumns = []string{"sku", "product_name", "price", "description", "image_url", "category_id"}
+
+// ImportRowResult reports what happened to one CSV row. Row is the line number in the file.
+type ImportRowResult struct {
+	Row       int    `json:"row"`
+	SKU       string `json:"sku"`
+	Status    string `json:"status"`
+	ProductID int    `json:"product_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ImportReport struct {
+	Created int               `json:"created"`
+	Updated int               `json:"updated"`
+	Failed  int               `json:"failed"`
+	Rows    []ImportRowResult `json:"rows"`
+}
+
+// ADMIN PRODUCT IMPORT
+func AdminImportProductsHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(maxImportSize); err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid multipart upload: "+err.Error())
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, _, err := r.FormFile(importFormField)
+	if err != nil {
+		handlers.WriteFieldError(w, "file", "a CSV file is required in the \"file\" field")
+		return
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		handlers.WriteValidationError(w, errors.New("CSV header row is missing"))
+		return
+	}
+	columns, err := parseImportHeader(header)
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+
+	report, err := importProducts(r.Context(), reader, columns)
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			handlers.WriteValidationError(w, err)
+			return
+		}
+		log.Println("Error importing products:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, report)
+}
+
+// parseImportHeader maps each known column name to its index in the CSV
+func parseImportHeader(header []string) (map[string]int, error) {
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for _, known := range importColumns {
+			if name == known {
+				columns[name] = i
+			}
+		}
+	}
+
+	for _, required := range []string{"sku", "product_name", "price"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV header must include the %q column", required)
+		}
+	}
+	return columns, nil
+}
+
+// importProducts upserts every row by SKU in one transaction. A failing row is rolled back
+// to its savepoint and reported, so it doesn't undo the rows that succeeded.
+func importProducts(ctx context.Context, reader *csv.Reader, columns map[string]int) (*ImportReport, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	report := &ImportReport{Rows: make([]ImportRowResult, 0)}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		result := ImportRowResult{Row: line}
+		req, err := parseImportRow(record, columns)
+		if req.SKU != nil {
+			result.SKU = *req.SKU
+		}
+		if err != nil {
+			result.Status = importError
+			result.Error = err.Error()
+		} else {
+			var rowErr string
+			result.ProductID, result.Status, rowErr, err = upsertImportedProduct(ctx, tx, req)
+			if err != nil {
+				return nil, err
+			}
+			if rowErr != "" {
+				result.Status = importError
+				result.Error = rowErr
+			}
+		}
+
+		switch result.Status {
+		case importCreated:
+			report.Created++
+		case importUpdated:
+			report.Updated++
+		default:
+			report.Failed++
+		}
+		report.Rows = append(report.Rows, result)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func parseImportRow(record []string, columns map[string]int) (ProductRequest, error) {
+	field := func(name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var req ProductRequest
+	sku := field("sku")
+	req.SKU = &sku
+	if sku == "" {
+		return req, handlers.NewFieldError("sku", "sku is required")
+	}
+
+	req.Name = field("product_name")
+	req.Description = field("description")
+	req.ImageURL = field("image_url")
+
+	price, err := strconv.ParseFloat(field("price"), 64)
+	if err != nil {
+		return req, handlers.NewFieldError("price", "price must be a number")
+	}
+	req.Price = price
+
+	if value := field("category_id"); value != "" {
+		categoryID, err := strconv.Atoi(value)
+		if err != nil {
+			return req, handlers.NewFieldError("category_id", "category_id must be an integer")
+		}
+		req.CategoryID = &categoryID
+	}
+
+	return req, validateProductRequest(req)
+}
+
+// upsertImportedProduct inserts or updates the product with req.SKU inside a savepoint.
+// A non-empty rowErr means the database rejected the row and the savepoint was rolled back.
+func upsertImportedProduct(ctx context.Context, tx *sql.Tx, req ProductRequest) (int, string, string, error) {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT import_row"); err != nil {
+		return 0, "", "", err
+	}
+
+	var productID int
+	var inserted bool
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO products (sku, name, price, description, image_url, category_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (sku) DO UPDATE
+		SET name = EXCLUDED.name, price = EXCLUDED.price, description = EXCLUDED.description,
+			image_url = EXCLUDED.image_url, category_id = EXCLUDED.category_id
+		RETURNING id, (xmax = 0)
+	`, req.SKU, req.Name, req.Price, req.Description, req.ImageURL, req.CategoryID).Scan(&productID, &inserted)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT import_row"); err != nil {
+			return 0, "", "", err
+		}
+		if isForeignKeyViolation(pqErr) {
+			return 0, "", errUnknownCategory.Error(), nil
+		}
+		return 0, "", pqErr.Message, nil
+	}
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT import_row"); err != nil {
+		return 0, "", "", err
+	}
+
+	if inserted {
+		return productID, importCreated, "", nil
+	}
+	return productID, importUpdated, "", nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// PRODUCT SEARCH
+func ProductSearchHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseProductFilter(r.URL.Query())
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+
+	tsQuery := buildPrefixTSQuery(r.URL.Query().Get("q"))
+	if tsQuery == "" {
+		handlers.WriteFieldError(w, "q", "q must contain at least one word")
+		return
+	}
+
+	products, total, err := searchProducts(r.Context(), tsQuery, filter)
+	var pricing *productPricing
+	if err == nil {
+		pricing, err = currentPricing(r.Context(), db, getCustomerID(r))
+	}
+	if err != nil {
+		log.Println("Error searching products:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	pricing.applyTo(products)
+	writeCacheableListJSON(w, r, ProductPage{
+		Products: products,
+		Page:     filter.Page,
+		Limit:    filter.Limit,
+		Total:    total,
+	}, "products", filter.Fields)
+}
+
+// buildPrefixTSQuery turns free text into a tsquery where every word must match as a prefix,
+// e.g. "red sho" becomes "red:* & sho:*". Anything that isn't a letter or digit is dropped
+// so user input can never produce tsquery syntax errors.
+func buildPrefixTSQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		terms = append(terms, strings.ToLower(word)+":*")
+	}
+
+	return strings.Join(terms, " & ")
+}
+
+// searchProducts ranks matching products by relevance; the filter's sort is only used to break ties
+func searchProducts(ctx context.Context, tsQuery string, filter ProductFilter) ([]Product, int, error) {
+	var total int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM products
+		WHERE search_vector @@ to_tsquery('english', $1)
+	`, tsQuery).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, COALESCE(sku, ''), name, price, COALESCE(description, ''), COALESCE(image_url, ''), category_id
+		FROM products
+		WHERE search_vector @@ to_tsquery('english', $1)
+		ORDER BY ts_rank(search_vector, to_tsquery('english', $1)) DESC, `+productSortColumns[filter.Sort]+`
+		LIMIT $2 OFFSET $3
+	`, tsQuery, filter.Limit, (filter.Page-1)*filter.Limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	products := make([]Product, 0)
+	for rows.Next() {
+		var product Product
+		if err := rows.Scan(&product.ID, &product.SKU, &product.Name, &product.Price, &product.Description, &product.ImageURL, &product.CategoryID); err != nil {
+			return nil, 0, err
+		}
+		products = append(products, product)
+	}
+
+	return products, total, rows.Err()
+}
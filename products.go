@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errProductInUse = errors.New("product is referenced by existing orders")
+var errUnknownCategory = handlers.NewFieldError("category", "category does not exist")
+var errProductSKUTaken = handlers.NewFieldError("sku", "sku is already used by another product")
+
+type ProductRequest struct {
+	SKU         *string `json:"sku"`
+	Name        string  `json:"product_name"`
+	Price       float64 `json:"price"`
+	Description string  `json:"description"`
+	ImageURL    string  `json:"image_url"`
+	CategoryID  *int    `json:"category_id"`
+	// Stock is the units on hand; it is left unchanged on update when omitted
+	Stock *int `json:"stock"`
+	// Weight (kg) and the package's Length, Width and Height (cm) price weight-based
+	// shipping; each is left unchanged on update when omitted
+	Weight *float64 `json:"weight"`
+	Length *float64 `json:"length"`
+	Width  *float64 `json:"width"`
+	Height *float64 `json:"height"`
+	// RestrictedCountries are the country codes the product can't ship to; they are left
+	// unchanged on update when omitted
+	RestrictedCountries []string `json:"restricted_countries"`
+	// GiftCard marks a product that issues a gift card worth its price for each unit paid
+	// for; it is left unchanged on update when omitted
+	GiftCard *bool `json:"gift_card"`
+}
+
+// ADMIN PRODUCTS
+func AdminCreateProductHandler(w http.ResponseWriter, r *http.Request) {
+	productRequest, ok := readProductRequest(w, r)
+	if !ok {
+		return
+	}
+
+	product, err := createProduct(r.Context(), productRequest)
+	if err == errUnknownCategory {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err == errProductSKUTaken {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error creating product:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, product)
+}
+
+func AdminGetProductHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	product, err := getProduct(r.Context(), productID)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error retrieving product:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	product.Variants, err = getProductVariants(r.Context(), productID)
+	if err != nil {
+		log.Println("Error retrieving product variants:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	product.Images, err = getProductImages(r.Context(), productID)
+	if err != nil {
+		log.Println("Error retrieving product images:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	product.Warehouses, err = getWarehouseStock(r.Context(), productID)
+	if err != nil {
+		log.Println("Error retrieving warehouse stock:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeCacheableJSON(w, r, product)
+}
+
+func AdminUpdateProductHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	productRequest, ok := readProductRequest(w, r)
+	if !ok {
+		return
+	}
+
+	product, err := updateProduct(r.Context(), productID, productRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if err == errUnknownCategory {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err == errProductSKUTaken {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error updating product:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, product)
+}
+
+func AdminDeleteProductHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	err = deleteProduct(r.Context(), productID)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if err == errProductInUse {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error deleting product:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readProductRequest decodes and validates the request body, writing the error response on failure
+func readProductRequest(w http.ResponseWriter, r *http.Request) (ProductRequest, bool) {
+	var productRequest ProductRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return productRequest, false
+	}
+
+	err = json.Unmarshal(body, &productRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return productRequest, false
+	}
+
+	productRequest.Name = strings.TrimSpace(productRequest.Name)
+	productRequest.ImageURL = strings.TrimSpace(productRequest.ImageURL)
+	if productRequest.SKU != nil {
+		sku := strings.TrimSpace(*productRequest.SKU)
+		productRequest.SKU = &sku
+		// An empty SKU is stored as NULL so it doesn't collide with other products without one
+		if sku == "" {
+			productRequest.SKU = nil
+		}
+	}
+
+	if productRequest.RestrictedCountries != nil {
+		productRequest.RestrictedCountries, err = normalizeCountries(productRequest.RestrictedCountries)
+		if err != nil {
+			handlers.WriteValidationError(w, handlers.FieldErrorf("restricted_countries", "restricted_countries: %v", err))
+			return productRequest, false
+		}
+	}
+
+	if err := validateProductRequest(productRequest); err != nil {
+		handlers.WriteValidationError(w, err)
+		return productRequest, false
+	}
+
+	return productRequest, true
+}
+
+func validateProductRequest(req ProductRequest) error {
+	if req.Name == "" {
+		return handlers.NewFieldError("product_name", "product_name is required")
+	}
+	if len(req.Name) > 255 {
+		return handlers.NewFieldError("product_name", "product_name must be at most 255 characters")
+	}
+	if req.Price < 0 {
+		return handlers.NewFieldError("price", "price must not be negative")
+	}
+	if req.SKU != nil && len(*req.SKU) > 100 {
+		return handlers.NewFieldError("sku", "sku must be at most 100 characters")
+	}
+	if req.Stock != nil && *req.Stock < 0 {
+		return handlers.NewFieldError("stock", "stock must not be negative")
+	}
+	if len(req.ImageURL) > 255 {
+		return handlers.NewFieldError("image_url", "image_url must be at most 255 characters")
+	}
+	for _, measure := range []struct {
+		Name  string
+		Value *float64
+	}{{"weight", req.Weight}, {"length", req.Length}, {"width", req.Width}, {"height", req.Height}} {
+		if measure.Value != nil && *measure.Value < 0 {
+			return fmt.Errorf("%s must not be negative", measure.Name)
+		}
+	}
+	return nil
+}
+
+func getProduct(ctx context.Context, productID int) (*Product, error) {
+	var product Product
+	err := db.QueryRowContext(ctx, `
+		SELECT id, COALESCE(sku, ''), name, price, COALESCE(description, ''), COALESCE(image_url, ''), category_id, stock,
+			   weight, length, width, height, restricted_countries, is_gift_card
+		FROM products
+		WHERE id = $1
+	`, productID).Scan(&product.ID, &product.SKU, &product.Name, &product.Price, &product.Description, &product.ImageURL, &product.CategoryID, &product.Stock,
+		&product.Weight, &product.Length, &product.Width, &product.Height, pq.Array(&product.RestrictedCountries), &product.GiftCard)
+	if err != nil {
+		return nil, err
+	}
+
+	return &product, nil
+}
+
+func createProduct(ctx context.Context, req ProductRequest) (*Product, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var productID int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO products (sku, name, price, description, image_url, category_id, weight, length, width, height, restricted_countries, is_gift_card)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, COALESCE($11::TEXT[], '{}'), COALESCE($12, FALSE))
+		RETURNING id
+	`, req.SKU, req.Name, req.Price, req.Description, req.ImageURL, req.CategoryID,
+		req.Weight, req.Length, req.Width, req.Height, pq.Array(req.RestrictedCountries), req.GiftCard).Scan(&productID)
+	if isForeignKeyViolation(err) {
+		return nil, errUnknownCategory
+	}
+	if isUniqueViolation(err) {
+		return nil, errProductSKUTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The opening stock goes through the ledger like every other stock change
+	if req.Stock != nil && *req.Stock > 0 {
+		if _, err := adjustStock(ctx, tx, productID, *req.Stock, stockReasonManual, nil, "initial stock"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return getProduct(ctx, productID)
+}
+
+func updateProduct(ctx context.Context, productID int, req ProductRequest) (*Product, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE products
+		SET sku = $1, name = $2, price = $3, description = $4, image_url = $5, category_id = $6,
+			weight = COALESCE($8, weight), length = COALESCE($9, length), width = COALESCE($10, width), height = COALESCE($11, height),
+			restricted_countries = COALESCE($12, restricted_countries), is_gift_card = COALESCE($13, is_gift_card)
+		WHERE id = $7
+		RETURNING id
+	`, req.SKU, req.Name, req.Price, req.Description, req.ImageURL, req.CategoryID, productID,
+		req.Weight, req.Length, req.Width, req.Height, pq.Array(req.RestrictedCountries), req.GiftCard).Scan(&productID)
+	if isForeignKeyViolation(err) {
+		return nil, errUnknownCategory
+	}
+	if isUniqueViolation(err) {
+		return nil, errProductSKUTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Stock != nil {
+		if err := setStock(ctx, tx, productID, *req.Stock, stockReasonManual, "product update"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return getProduct(ctx, productID)
+}
+
+func deleteProduct(ctx context.Context, productID int) error {
+	err := db.QueryRowContext(ctx, "DELETE FROM products WHERE id = $1 RETURNING id", productID).Scan(&productID)
+	if isForeignKeyViolation(err) {
+		return errProductInUse
+	}
+	return err
+}
+
+// isForeignKeyViolation reports whether err is a Postgres foreign key violation
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+const (
+	defaultProductPageSize = 20
+	maxProductPageSize     = 100
+)
+
+// productSortColumns maps the public sort parameter to a safe ORDER BY clause
+var productSortColumns = map[string]string{
+	"":           "id ASC",
+	"price_asc":  "price ASC, id ASC",
+	"price_desc": "price DESC, id ASC",
+	"name_asc":   "name ASC, id ASC",
+	"name_desc":  "name DESC, id ASC",
+	"newest":     "id DESC",
+}
+
+// productListColumns are what the shared list parameters of the catalog apply to; products
+// have no status or date to filter by
+var productListColumns = listColumns{Sorts: productSortColumns, Item: Product{}}
+
+type ProductFilter struct {
+	ListParams
+	MinPrice *float64
+	MaxPrice *float64
+	// CategoryID also matches products in any subcategory
+	CategoryID *int
+}
+
+type ProductPage struct {
+	Products []Product `json:"products"`
+	Page     int       `json:"page"`
+	Limit    int       `json:"limit"`
+	Total    int       `json:"total"`
+}
+
+// PUBLIC PRODUCT CATALOG
+func ProductsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseProductFilter(r.URL.Query())
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+
+	products, total, err := listProducts(r.Context(), filter)
+	var pricing *productPricing
+	if err == nil {
+		pricing, err = currentPricing(r.Context(), db, getCustomerID(r))
+	}
+	if err != nil {
+		log.Println("Error retrieving products:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	pricing.applyTo(products)
+	writeCacheableListJSON(w, r, ProductPage{
+		Products: products,
+		Page:     filter.Page,
+		Limit:    filter.Limit,
+		Total:    total,
+	}, "products", filter.Fields)
+}
+
+func parseProductFilter(query url.Values) (ProductFilter, error) {
+	params, err := parseListParams(query, productListColumns)
+	filter := ProductFilter{ListParams: params}
+	if err != nil {
+		return filter, err
+	}
+
+	if v := query.Get("min_price"); v != "" {
+		price, err := strconv.ParseFloat(v, 64)
+		if err != nil || price < 0 {
+			return filter, handlers.NewFieldError("min_price", "min_price must be a non-negative number")
+		}
+		filter.MinPrice = &price
+	}
+	if v := query.Get("max_price"); v != "" {
+		price, err := strconv.ParseFloat(v, 64)
+		if err != nil || price < 0 {
+			return filter, handlers.NewFieldError("max_price", "max_price must be a non-negative number")
+		}
+		filter.MaxPrice = &price
+	}
+	if filter.MinPrice != nil && filter.MaxPrice != nil && *filter.MinPrice > *filter.MaxPrice {
+		return filter, handlers.NewFieldError("min_price", "min_price must not be greater than max_price")
+	}
+	if v := query.Get("category"); v != "" {
+		categoryID, err := strconv.Atoi(v)
+		if err != nil {
+			return filter, handlers.NewFieldError("category", "category must be a category ID")
+		}
+		filter.CategoryID = &categoryID
+	}
+	return filter, nil
+}
+
+// listProducts returns one page of products matching the filter and the total number of matches
+func listProducts(ctx context.Context, filter ProductFilter) ([]Product, int, error) {
+	var conditions sqlFilter
+	if filter.MinPrice != nil {
+		conditions.add("price >= ?", *filter.MinPrice)
+	}
+	if filter.MaxPrice != nil {
+		conditions.add("price <= ?", *filter.MaxPrice)
+	}
+	if filter.CategoryID != nil {
+		conditions.add(`category_id IN (
+			WITH RECURSIVE tree AS (
+				SELECT id FROM categories WHERE id = ?
+				UNION
+				SELECT c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+			)
+			SELECT id FROM tree
+		)`, *filter.CategoryID)
+	}
+
+	var total int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM products "+conditions.where(), conditions.args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, COALESCE(sku, ''), name, price, COALESCE(description, ''), COALESCE(image_url, ''), category_id
+		FROM products
+		`+conditions.where()+`
+		`+conditions.page(filter.ListParams, productListColumns), conditions.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	products := make([]Product, 0)
+	for rows.Next() {
+		var product Product
+		if err := rows.Scan(&product.ID, &product.SKU, &product.Name, &product.Price, &product.Description, &product.ImageURL, &product.CategoryID); err != nil {
+			return nil, 0, err
+		}
+		products = append(products, product)
+	}
+
+	return products, total, rows.Err()
+}
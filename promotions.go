@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const (
+	// promotionTypeSpendThreshold discounts orders whose eligible subtotal reaches MinSubtotal
+	promotionTypeSpendThreshold = "spend_threshold"
+	// promotionTypeBuyXGetY discounts GetQuantity units for every BuyQuantity units bought,
+	// the cheapest eligible units first
+	promotionTypeBuyXGetY = "buy_x_get_y"
+)
+
+// Promotion is a discount applied automatically to carts and orders that meet its rule, no
+// code needed. Promotions are applied in Priority order, lowest first.
+type Promotion struct {
+	ID   int    `json:"promotion_id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// DiscountType is percent or fixed, like a coupon's type. A spend threshold takes Value
+	// off the eligible subtotal; buy X get Y takes it off each discounted unit.
+	DiscountType string  `json:"discount_type"`
+	Value        float64 `json:"value"`
+	// MinSubtotal is the eligible subtotal a spend threshold promotion needs
+	MinSubtotal *float64 `json:"min_subtotal,omitempty"`
+	// BuyQuantity and GetQuantity are the units bought and discounted by buy X get Y
+	BuyQuantity *int `json:"buy_quantity,omitempty"`
+	GetQuantity *int `json:"get_quantity,omitempty"`
+	// ProductIDs and CategoryIDs, with their subcategories, limit the promotion to those
+	// products; with neither, every product is eligible
+	ProductIDs  []int64 `json:"product_ids"`
+	CategoryIDs []int64 `json:"category_ids"`
+	Priority    int     `json:"priority"`
+	// Exclusive stops promotions with a lower priority from applying once this one applies
+	Exclusive bool       `json:"exclusive"`
+	Active    bool       `json:"active"`
+	StartsAt  *time.Time `json:"starts_at"`
+	EndsAt    *time.Time `json:"ends_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type PromotionRequest struct {
+	Name         string     `json:"name"`
+	Type         string     `json:"type"`
+	DiscountType string     `json:"discount_type"`
+	Value        float64    `json:"value"`
+	MinSubtotal  *float64   `json:"min_subtotal"`
+	BuyQuantity  *int       `json:"buy_quantity"`
+	GetQuantity  *int       `json:"get_quantity"`
+	ProductIDs   []int64    `json:"product_ids"`
+	CategoryIDs  []int64    `json:"category_ids"`
+	Priority     int        `json:"priority"`
+	Exclusive    bool       `json:"exclusive"`
+	Active       *bool      `json:"active"`
+	StartsAt     *time.Time `json:"starts_at"`
+	EndsAt       *time.Time `json:"ends_at"`
+}
+
+// AppliedPromotion is what a promotion took off a cart or order
+type AppliedPromotion struct {
+	PromotionID int     `json:"promotion_id"`
+	Name        string  `json:"name"`
+	Discount    float64 `json:"discount"`
+}
+
+// promotionLine is a cart or order line as promotions see it
+type promotionLine struct {
+	ProductID int
+	UnitPrice float64
+	Quantity  int
+}
+
+// ADMIN PROMOTIONS
+func AdminPromotionsHandler(w http.ResponseWriter, r *http.Request) {
+	promotions, err := getPromotions(r.Context(), db, false)
+	if err != nil {
+		log.Println("Error retrieving promotions:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, promotions)
+}
+
+func AdminCreatePromotionHandler(w http.ResponseWriter, r *http.Request) {
+	promotionRequest, ok := readPromotionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	promotion, err := savePromotion(r.Context(), 0, promotionRequest)
+	if err != nil {
+		log.Println("Error creating promotion:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, promotion)
+}
+
+// AdminUpdatePromotionHandler changes the promotion for carts and orders from now on; orders
+// already placed keep their discount
+func AdminUpdatePromotionHandler(w http.ResponseWriter, r *http.Request) {
+	promotionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid promotion ID")
+		return
+	}
+
+	promotionRequest, ok := readPromotionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	promotion, err := savePromotion(r.Context(), promotionID, promotionRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Promotion not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error updating promotion:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, promotion)
+}
+
+// AdminDeletePromotionHandler deletes the promotion. Orders it was applied to keep their
+// discount.
+func AdminDeletePromotionHandler(w http.ResponseWriter, r *http.Request) {
+	promotionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid promotion ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM promotions WHERE id = $1", promotionID)
+	if err != nil {
+		log.Println("Error deleting promotion:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Promotion not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func readPromotionRequest(w http.ResponseWriter, r *http.Request) (PromotionRequest, bool) {
+	var promotionRequest PromotionRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return promotionRequest, false
+	}
+
+	err = json.Unmarshal(body, &promotionRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return promotionRequest, false
+	}
+
+	promotionRequest.Name = strings.TrimSpace(promotionRequest.Name)
+	promotionRequest.Type = strings.ToLower(strings.TrimSpace(promotionRequest.Type))
+	promotionRequest.DiscountType = strings.ToLower(strings.TrimSpace(promotionRequest.DiscountType))
+	// The fields of the other type don't apply
+	if promotionRequest.Type == promotionTypeSpendThreshold {
+		promotionRequest.BuyQuantity, promotionRequest.GetQuantity = nil, nil
+	} else {
+		promotionRequest.MinSubtotal = nil
+	}
+
+	var validationErr error
+	switch {
+	case promotionRequest.Name == "" || len(promotionRequest.Name) > 255:
+		validationErr = handlers.NewFieldError("name", "name is required and must be at most 255 characters")
+	case promotionRequest.Type != promotionTypeSpendThreshold && promotionRequest.Type != promotionTypeBuyXGetY:
+		validationErr = handlers.NewFieldError("type", "type must be spend_threshold or buy_x_get_y")
+	case promotionRequest.DiscountType != couponTypePercent && promotionRequest.DiscountType != couponTypeFixed:
+		validationErr = handlers.NewFieldError("discount_type", "discount_type must be percent or fixed")
+	case promotionRequest.Value <= 0:
+		validationErr = handlers.NewFieldError("value", "value must be positive")
+	case promotionRequest.DiscountType == couponTypePercent && promotionRequest.Value > 100:
+		validationErr = handlers.NewFieldError("value", "value must be at most 100 for a percent discount")
+	case promotionRequest.Type == promotionTypeSpendThreshold && (promotionRequest.MinSubtotal == nil || *promotionRequest.MinSubtotal < 0):
+		validationErr = handlers.NewFieldError("min_subtotal", "min_subtotal is required and must not be negative")
+	case promotionRequest.Type == promotionTypeBuyXGetY && (promotionRequest.BuyQuantity == nil || *promotionRequest.BuyQuantity < 1):
+		validationErr = handlers.NewFieldError("buy_quantity", "buy_quantity is required and must be at least 1")
+	case promotionRequest.Type == promotionTypeBuyXGetY && (promotionRequest.GetQuantity == nil || *promotionRequest.GetQuantity < 1):
+		validationErr = handlers.NewFieldError("get_quantity", "get_quantity is required and must be at least 1")
+	case promotionRequest.StartsAt != nil && promotionRequest.EndsAt != nil && !promotionRequest.EndsAt.After(*promotionRequest.StartsAt):
+		validationErr = handlers.NewFieldError("ends_at", "ends_at must be after starts_at")
+	}
+	if validationErr == nil {
+		validationErr, err = checkCouponScope(r.Context(), CouponRequest{ProductIDs: promotionRequest.ProductIDs, CategoryIDs: promotionRequest.CategoryIDs})
+		if err != nil {
+			log.Println("Error checking promotion products:", err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return promotionRequest, false
+		}
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return promotionRequest, false
+	}
+
+	return promotionRequest, true
+}
+
+// savePromotion inserts a new promotion when promotionID is 0, otherwise updates it
+func savePromotion(ctx context.Context, promotionID int, req PromotionRequest) (*Promotion, error) {
+	var err error
+	if promotionID == 0 {
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO promotions (name, type, discount_type, value, min_subtotal, buy_quantity, get_quantity,
+				product_ids, category_ids, priority, exclusive, active, starts_at, ends_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, COALESCE($12, TRUE), $13, $14)
+			RETURNING id
+		`, req.Name, req.Type, req.DiscountType, req.Value, req.MinSubtotal, req.BuyQuantity, req.GetQuantity,
+			pq.Array(nonNilIDs(req.ProductIDs)), pq.Array(nonNilIDs(req.CategoryIDs)), req.Priority, req.Exclusive,
+			req.Active, req.StartsAt, req.EndsAt).Scan(&promotionID)
+	} else {
+		err = db.QueryRowContext(ctx, `
+			UPDATE promotions
+			SET name = $1, type = $2, discount_type = $3, value = $4, min_subtotal = $5, buy_quantity = $6, get_quantity = $7,
+				product_ids = $8, category_ids = $9, priority = $10, exclusive = $11, active = COALESCE($12, active),
+				starts_at = $13, ends_at = $14
+			WHERE id = $15
+			RETURNING id
+		`, req.Name, req.Type, req.DiscountType, req.Value, req.MinSubtotal, req.BuyQuantity, req.GetQuantity,
+			pq.Array(nonNilIDs(req.ProductIDs)), pq.Array(nonNilIDs(req.CategoryIDs)), req.Priority, req.Exclusive,
+			req.Active, req.StartsAt, req.EndsAt, promotionID).Scan(&promotionID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return scanPromotion(db.QueryRowContext(ctx, "SELECT "+promotionColumnsSQL+" FROM promotions WHERE id = $1", promotionID))
+}
+
+const promotionColumnsSQL = `
+	id, name, type, discount_type, value, min_subtotal, buy_quantity, get_quantity,
+	product_ids, category_ids, priority, exclusive, active, starts_at, ends_at, created_at
+`
+
+func scanPromotion(row interface{ Scan(...interface{}) error }) (*Promotion, error) {
+	promotion := &Promotion{}
+	var minSubtotal sql.NullFloat64
+	var buyQuantity, getQuantity sql.NullInt64
+	var startsAt, endsAt sql.NullTime
+	err := row.Scan(&promotion.ID, &promotion.Name, &promotion.Type, &promotion.DiscountType, &promotion.Value,
+		&minSubtotal, &buyQuantity, &getQuantity, pq.Array(&promotion.ProductIDs), pq.Array(&promotion.CategoryIDs),
+		&promotion.Priority, &promotion.Exclusive, &promotion.Active, &startsAt, &endsAt, &promotion.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if minSubtotal.Valid {
+		promotion.MinSubtotal = &minSubtotal.Float64
+	}
+	if buyQuantity.Valid {
+		n := int(buyQuantity.Int64)
+		promotion.BuyQuantity = &n
+	}
+	if getQuantity.Valid {
+		n := int(getQuantity.Int64)
+		promotion.GetQuantity = &n
+	}
+	if startsAt.Valid {
+		promotion.StartsAt = &startsAt.Time
+	}
+	if endsAt.Valid {
+		promotion.EndsAt = &endsAt.Time
+	}
+	return promotion, nil
+}
+
+// getPromotions returns the promotions in the order they are applied, only those running now
+// with activeOnly
+func getPromotions(ctx context.Context, q querier, activeOnly bool) ([]Promotion, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT `+promotionColumnsSQL+`
+		FROM promotions
+		WHERE NOT $1 OR (active AND (starts_at IS NULL OR starts_at <= NOW()) AND (ends_at IS NULL OR ends_at > NOW()))
+		ORDER BY priority, id
+	`, activeOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	promotions := make([]Promotion, 0)
+	for rows.Next() {
+		promotion, err := scanPromotion(rows)
+		if err != nil {
+			return nil, err
+		}
+		promotions = append(promotions, *promotion)
+	}
+
+	return promotions, rows.Err()
+}
+
+// applyPromotions applies the running promotions to the lines in priority order and returns
+// those that took something off. An exclusive promotion that applies stops the rest, and the
+// discounts together never exceed the subtotal.
+func applyPromotions(ctx context.Context, q querier, lines []promotionLine) ([]AppliedPromotion, error) {
+	applied := make([]AppliedPromotion, 0)
+	if len(lines) == 0 {
+		return applied, nil
+	}
+	promotions, err := getPromotions(ctx, q, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var remaining float64
+	for _, line := range lines {
+		remaining += line.UnitPrice * float64(line.Quantity)
+	}
+	for i := range promotions {
+		promotion := &promotions[i]
+		discount, err := promotion.discount(ctx, q, lines)
+		if err != nil {
+			return nil, err
+		}
+		discount = roundCents(math.Min(discount, remaining))
+		if discount <= 0 {
+			continue
+		}
+		applied = append(applied, AppliedPromotion{PromotionID: promotion.ID, Name: promotion.Name, Discount: discount})
+		remaining -= discount
+		if promotion.Exclusive {
+			break
+		}
+	}
+	return applied, nil
+}
+
+// promotionsDiscount adds up what the promotions took off
+func promotionsDiscount(applied []AppliedPromotion) float64 {
+	var discount float64
+	for _, promotion := range applied {
+		discount += promotion.Discount
+	}
+	return roundCents(discount)
+}
+
+// discount returns what the promotion takes off the lines, 0 when they don't meet its rule
+func (p *Promotion) discount(ctx context.Context, q querier, lines []promotionLine) (float64, error) {
+	eligible := lines
+	if len(p.ProductIDs) > 0 || len(p.CategoryIDs) > 0 {
+		productIDs := make([]int, 0, len(lines))
+		for _, line := range lines {
+			productIDs = append(productIDs, line.ProductID)
+		}
+		scoped, err := scopedProductIDs(ctx, q, productIDs, p.ProductIDs, p.CategoryIDs)
+		if err != nil {
+			return 0, err
+		}
+		eligible = make([]promotionLine, 0, len(lines))
+		for _, line := range lines {
+			if scoped[line.ProductID] {
+				eligible = append(eligible, line)
+			}
+		}
+	}
+
+	switch p.Type {
+	case promotionTypeSpendThreshold:
+		var subtotal float64
+		for _, line := range eligible {
+			subtotal += line.UnitPrice * float64(line.Quantity)
+		}
+		if subtotal <= 0 || p.MinSubtotal == nil || roundCents(subtotal) < *p.MinSubtotal {
+			return 0, nil
+		}
+		return p.amountOff(subtotal), nil
+	case promotionTypeBuyXGetY:
+		if p.BuyQuantity == nil || p.GetQuantity == nil {
+			return 0, nil
+		}
+		var prices []float64
+		for _, line := range eligible {
+			for i := 0; i < line.Quantity; i++ {
+				prices = append(prices, line.UnitPrice)
+			}
+		}
+		// Each full set of buy + get units earns get units, and the cheapest units are the
+		// ones discounted
+		free := len(prices) / (*p.BuyQuantity + *p.GetQuantity) * *p.GetQuantity
+		sort.Float64s(prices)
+		var discount float64
+		for _, price := range prices[:free] {
+			discount += p.amountOff(price)
+		}
+		return discount, nil
+	}
+	return 0, nil
+}
+
+// amountOff returns what the promotion's discount takes off the amount
+func (p *Promotion) amountOff(amount float64) float64 {
+	discount := p.Value
+	if p.DiscountType == couponTypePercent {
+		discount = amount * p.Value / 100
+	}
+	return math.Max(0, math.Min(discount, amount))
+}
+
+// saveOrderPromotions records the promotions applied to the new order
+func saveOrderPromotions(ctx context.Context, tx *sql.Tx, orderID int, applied []AppliedPromotion) error {
+	for _, promotion := range applied {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO order_promotions (order_id, promotion_id, name, discount)
+			VALUES ($1, $2, $3, $4)
+		`, orderID, promotion.PromotionID, promotion.Name, promotion.Discount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reapplyOrderPromotions applies the promotions the order was placed with to its edited lines,
+// whether or not they are still running, and returns their discount. Promotions deleted since
+// keep the discount they gave.
+func reapplyOrderPromotions(ctx context.Context, tx *sql.Tx, orderID int) (float64, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, promotion_id, discount FROM order_promotions WHERE order_id = $1 ORDER BY id", orderID)
+	if err != nil {
+		return 0, err
+	}
+
+	type orderPromotion struct {
+		ID          int
+		PromotionID *int
+		Discount    float64
+	}
+	var recorded []orderPromotion
+	for rows.Next() {
+		var applied orderPromotion
+		if err := rows.Scan(&applied.ID, &applied.PromotionID, &applied.Discount); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		recorded = append(recorded, applied)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(recorded) == 0 {
+		return 0, nil
+	}
+
+	lines, err := orderPromotionLines(ctx, tx, orderID)
+	if err != nil {
+		return 0, err
+	}
+	var total float64
+	for _, applied := range recorded {
+		if applied.PromotionID != nil {
+			promotion, err := scanPromotion(tx.QueryRowContext(ctx, "SELECT "+promotionColumnsSQL+" FROM promotions WHERE id = $1", *applied.PromotionID))
+			if err != nil {
+				return 0, err
+			}
+			discount, err := promotion.discount(ctx, tx, lines)
+			if err != nil {
+				return 0, err
+			}
+			applied.Discount = roundCents(discount)
+			if _, err := tx.ExecContext(ctx, "UPDATE order_promotions SET discount = $1 WHERE id = $2", applied.Discount, applied.ID); err != nil {
+				return 0, err
+			}
+		}
+		total += applied.Discount
+	}
+	return roundCents(total), nil
+}
+
+// orderPromotionLines returns the order's lines as promotions see them
+func orderPromotionLines(ctx context.Context, q querier, orderID int) ([]promotionLine, error) {
+	rows, err := q.QueryContext(ctx, "SELECT product_id, unit_price_at_purchase, quantity FROM order_products WHERE order_id = $1", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := make([]promotionLine, 0)
+	for rows.Next() {
+		var line promotionLine
+		if err := rows.Scan(&line.ProductID, &line.UnitPrice, &line.Quantity); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
+
+// promotionLines returns the cart's lines as promotions see them
+func (c *Cart) promotionLines() []promotionLine {
+	lines := make([]promotionLine, 0, len(c.Items))
+	for _, item := range c.Items {
+		if item.Quantity > 0 {
+			lines = append(lines, promotionLine{ProductID: item.Product.ID, UnitPrice: item.LineTotal / float64(item.Quantity), Quantity: item.Quantity})
+		}
+	}
+	return lines
+}
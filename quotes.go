@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errUnknownShippingMethod = handlers.NewFieldError("shipping_method", "shipping_method is not one of the shipping options")
+
+// Destination is where an order ships to. Country is a 2-letter code like "US"; Region is
+// the state or province code, used for region-specific tax rates.
+type Destination struct {
+	Country    string `json:"country"`
+	Region     string `json:"region"`
+	PostalCode string `json:"postal_code"`
+}
+
+type QuoteRequest struct {
+	Destination Destination `json:"destination"`
+	// ShippingMethod picks the option the total is computed with; it defaults to the cheapest
+	ShippingMethod string `json:"shipping_method"`
+}
+
+// Quote is the estimated price of the cart shipped to a destination
+type Quote struct {
+	Subtotal        float64          `json:"subtotal"`
+	TaxRate         float64          `json:"tax_rate"`
+	Tax             float64          `json:"estimated_tax"`
+	ShippingOptions []ShippingOption `json:"shipping_options"`
+	ShippingMethod  string           `json:"shipping_method"`
+	Shipping        float64          `json:"shipping"`
+	// Discount is taken off the subtotal by the cart's promotions and coupon, before tax
+	Discount   float64            `json:"discount"`
+	Promotions []AppliedPromotion `json:"promotions,omitempty"`
+	CouponCode string             `json:"coupon_code,omitempty"`
+	Total      float64            `json:"total"`
+	// EstimatedDelivery is when the chosen shipping option is expected to deliver
+	EstimatedDelivery *DeliveryEstimate `json:"estimated_delivery,omitempty"`
+	// RestrictedProductIDs are the cart's products that can't ship to the destination;
+	// checkout is refused until they are removed
+	RestrictedProductIDs []int `json:"restricted_product_ids,omitempty"`
+}
+
+// CART QUOTE
+func CartQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	var quoteRequest QuoteRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &quoteRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	if err := validateDestination(&quoteRequest.Destination); err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+
+	owner, err := resolveCartOwner(w, r, false)
+	var cart *Cart
+	if err == nil {
+		cart, err = getCart(r.Context(), owner)
+	}
+	if err != nil {
+		log.Println("Error retrieving cart:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if len(cart.Items) == 0 {
+		handlers.WriteValidationError(w, errCartEmpty)
+		return
+	}
+
+	quote, err := quoteCart(r.Context(), cart, quoteRequest)
+	if err == errUnknownShippingMethod || err == errNoShippingOptions {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err != nil {
+		log.Println("Error quoting cart:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, quote)
+}
+
+// validateShipping checks the optional destination and shipping method of an order
+func validateShipping(ctx context.Context, destination *Destination, shippingMethod string) error {
+	if destination != nil {
+		if err := validateDestination(destination); err != nil {
+			return err
+		}
+	}
+	// Pickup orders aren't shipped; the method is checked when the order is priced
+	if shippingMethod == "" || shippingMethod == shippingPickup {
+		return nil
+	}
+	exists, err := shippingMethodExists(ctx, shippingMethod)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errUnknownShippingMethod
+	}
+	return nil
+}
+
+func validateDestination(destination *Destination) error {
+	destination.Country = strings.ToUpper(strings.TrimSpace(destination.Country))
+	destination.Region = strings.TrimSpace(destination.Region)
+	destination.PostalCode = strings.TrimSpace(destination.PostalCode)
+
+	if len(destination.Country) != 2 {
+		return handlers.NewFieldError("destination.country", "destination.country must be a 2-letter country code")
+	}
+	// The region and postal code are optional for estimates, but must be valid when given
+	var err error
+	destination.Region, destination.PostalCode, err = normalizeRegionAndPostalCode(destination.Country, destination.Region, destination.PostalCode, false)
+	if err != nil {
+		return handlers.NestFieldError("destination", err)
+	}
+	return nil
+}
+
+// quoteCart prices the cart at current prices and estimates when each shipping option
+// delivers it from the warehouses that would ship it
+func quoteCart(ctx context.Context, cart *Cart, req QuoteRequest) (*Quote, error) {
+	weight, err := cartWeight(ctx, cart)
+	if err != nil {
+		return nil, err
+	}
+	quote, err := priceOrder(ctx, cart.Subtotal, weight, req.Destination, req.ShippingMethod)
+	if err != nil {
+		return nil, err
+	}
+	if cart.Discount > 0 {
+		applyDiscount(quote, cart.CouponCode, cart.Discount)
+		quote.Promotions = cart.Promotions
+	}
+
+	units := make(map[int]int)
+	for _, item := range cart.Items {
+		units[item.Product.ID] += item.Quantity
+	}
+	origins, err := cartShipOrigins(ctx, units)
+	if err != nil {
+		return nil, err
+	}
+	addDeliveryEstimates(quote, origins)
+
+	quote.RestrictedProductIDs, err = cartRestrictedProductIDs(ctx, cart, req.Destination.Country)
+	if err != nil {
+		return nil, err
+	}
+	return quote, nil
+}
+
+// priceOrder adds tax and shipping to the subtotal, shipping the weight (kg) at the
+// destination's rates. Tax is charged on the subtotal, not on shipping; a destination without
+// a country isn't taxed.
+func priceOrder(ctx context.Context, subtotal, weight float64, destination Destination, shippingMethod string) (*Quote, error) {
+	taxRate, err := getTaxRate(ctx, destination.Country, destination.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := shippingOptions(ctx, subtotal, weight, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	quote := &Quote{
+		Subtotal:        roundCents(subtotal),
+		TaxRate:         taxRate,
+		Tax:             roundCents(subtotal * taxRate),
+		ShippingOptions: options,
+	}
+
+	selected := quote.ShippingOptions[0]
+	if shippingMethod != "" {
+		found := false
+		for _, option := range quote.ShippingOptions {
+			if option.Code == shippingMethod {
+				selected, found = option, true
+			}
+		}
+		if !found {
+			return nil, errUnknownShippingMethod
+		}
+	}
+	quote.ShippingMethod = selected.Code
+	quote.Shipping = selected.Price
+
+	quote.Total = roundCents(quote.Subtotal + quote.Tax + quote.Shipping)
+	return quote, nil
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
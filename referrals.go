@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errUnknownReferralCode = handlers.NewFieldError("referral_code", "referral_code is not valid")
+
+// Referral settings, loaded from environment variables by loadReferralConfig
+var referralConfig = struct {
+	// URL is the storefront's signup page; referral links add the code as its ref parameter
+	URL string
+	// RewardAmount is the value of the coupon the referrer and the new customer each get once
+	// the new customer's first order is paid; 0 turns rewards off
+	RewardAmount float64
+}{
+	RewardAmount: 10,
+}
+
+// Referral is a customer's referral code and what it has brought in
+type Referral struct {
+	Code string `json:"referral_code"`
+	Link string `json:"referral_link,omitempty"`
+	// Signups counts the customers who signed up with the code, and FirstOrders those of them
+	// who have had an order paid
+	Signups     int `json:"signups"`
+	FirstOrders int `json:"first_orders"`
+	// Coupons are the customer's reward coupons, from referring others or being referred
+	Coupons []Coupon `json:"coupons"`
+}
+
+func loadReferralConfig() {
+	referralConfig.URL = os.Getenv("REFERRAL_URL")
+	if v := os.Getenv("REFERRAL_REWARD_AMOUNT"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid REFERRAL_REWARD_AMOUNT %q", v)
+		}
+		referralConfig.RewardAmount = n
+	}
+}
+
+// CUSTOMER REFERRAL
+// CustomerReferralHandler returns the customer's referral code, giving them one the first time
+func CustomerReferralHandler(w http.ResponseWriter, r *http.Request) {
+	customerID := getCustomerID(r)
+	code, err := referralCode(r.Context(), customerID)
+	referral := Referral{Code: code}
+	if err == nil {
+		err = db.QueryRowContext(r.Context(), `
+			SELECT COUNT(*), COUNT(order_id) FROM referrals WHERE referrer_id = $1
+		`, customerID).Scan(&referral.Signups, &referral.FirstOrders)
+	}
+	if err == nil {
+		referral.Coupons, err = getCustomerCoupons(r.Context(), customerID)
+	}
+	if err != nil {
+		log.Println("Error retrieving referral:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if referralConfig.URL != "" {
+		referral.Link = referralConfig.URL + "?ref=" + referral.Code
+	}
+	handlers.WriteJSON(w, http.StatusOK, referral)
+}
+
+// referralCode returns the customer's referral code, generating it the first time
+func referralCode(ctx context.Context, customerID int) (string, error) {
+	var code sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT referral_code FROM customers WHERE id = $1", customerID).Scan(&code); err != nil {
+		return "", err
+	}
+	if code.Valid {
+		return code.String, nil
+	}
+
+	// A code that is already taken is retried; a code set concurrently is kept
+	for attempt := 0; attempt < 5; attempt++ {
+		newCode, err := generateCode(8)
+		if err != nil {
+			return "", err
+		}
+		err = db.QueryRowContext(ctx, `
+			UPDATE customers SET referral_code = COALESCE(referral_code, $1)
+			WHERE id = $2
+			RETURNING referral_code
+		`, newCode, customerID).Scan(&code)
+		if isUniqueViolation(err) {
+			continue
+		}
+		return code.String, err
+	}
+	return "", errors.New("could not generate a unique referral code")
+}
+
+// findReferrer returns the ID of the customer the referral code belongs to, or 0 without a
+// code
+func findReferrer(ctx context.Context, code string) (int, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return 0, nil
+	}
+	var referrerID int
+	err := db.QueryRowContext(ctx, "SELECT id FROM customers WHERE referral_code = $1", code).Scan(&referrerID)
+	if isNoRows(err) {
+		return 0, errUnknownReferralCode
+	}
+	return referrerID, err
+}
+
+// rewardReferral attributes the paid order to the referral of its customer when it is their
+// first, and gives the referrer and the customer a reward coupon each
+func rewardReferral(ctx context.Context, tx *sql.Tx, orderID int) error {
+	var referralID, referrerID, referredID int
+	err := tx.QueryRowContext(ctx, `
+		UPDATE referrals r SET order_id = o.id
+		FROM orders o
+		WHERE o.id = $1 AND r.referred_id = o.customer_id AND r.order_id IS NULL
+		RETURNING r.id, r.referrer_id, r.referred_id
+	`, orderID).Scan(&referralID, &referrerID, &referredID)
+	if isNoRows(err) {
+		return nil
+	}
+	if err != nil || referralConfig.RewardAmount <= 0 {
+		return err
+	}
+
+	referrerCouponID, err := createRewardCoupon(ctx, tx, referrerID)
+	if err != nil {
+		return err
+	}
+	referredCouponID, err := createRewardCoupon(ctx, tx, referredID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE referrals SET referrer_coupon_id = $1, referred_coupon_id = $2, rewarded_at = NOW()
+		WHERE id = $3
+	`, referrerCouponID, referredCouponID, referralID)
+	return err
+}
+
+// createRewardCoupon creates a single-use coupon only the customer can use
+func createRewardCoupon(ctx context.Context, tx *sql.Tx, customerID int) (int, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		code, err := generateCode(8)
+		if err != nil {
+			return 0, err
+		}
+		var couponID int
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO coupons (code, type, value, max_uses, customer_id)
+			VALUES ($1, $2, $3, 1, $4)
+			ON CONFLICT (code) DO NOTHING
+			RETURNING id
+		`, "REF-"+code, couponTypeFixed, referralConfig.RewardAmount, customerID).Scan(&couponID)
+		if isNoRows(err) {
+			continue
+		}
+		return couponID, err
+	}
+	return 0, errors.New("could not generate a unique coupon code")
+}
+
+// getCustomerCoupons returns the coupons only the customer can use, newest first
+func getCustomerCoupons(ctx context.Context, customerID int) ([]Coupon, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+couponColumnsSQL+`
+		FROM coupons c
+		WHERE c.customer_id = $1
+		ORDER BY c.created_at DESC, c.id DESC
+	`, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	coupons := make([]Coupon, 0)
+	for rows.Next() {
+		coupon, err := scanCoupon(rows)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, *coupon)
+	}
+
+	return coupons, rows.Err()
+}
+
+// notifyReferralRewards emails the referrer and the new customer their reward coupons once
+// the reward has been given
+func notifyReferralRewards(ctx context.Context) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT r.id, referrer.email, referrer_coupon.code, referred.email, referred_coupon.code, referred.name
+		FROM referrals r
+		JOIN customers referrer ON referrer.id = r.referrer_id
+		JOIN customers referred ON referred.id = r.referred_id
+		JOIN coupons referrer_coupon ON referrer_coupon.id = r.referrer_coupon_id
+		JOIN coupons referred_coupon ON referred_coupon.id = r.referred_coupon_id
+		WHERE r.rewarded_at IS NOT NULL AND r.notified_at IS NULL
+		ORDER BY r.id
+	`)
+	if err != nil {
+		log.Println("Error querying referral rewards:", err)
+		return
+	}
+
+	type reward struct {
+		ReferralID     int
+		ReferrerEmail  string
+		ReferrerCoupon string
+		ReferredEmail  string
+		ReferredCoupon string
+		ReferredName   string
+	}
+	var rewards []reward
+	for rows.Next() {
+		var rw reward
+		if err := rows.Scan(&rw.ReferralID, &rw.ReferrerEmail, &rw.ReferrerCoupon, &rw.ReferredEmail, &rw.ReferredCoupon, &rw.ReferredName); err != nil {
+			log.Println("Error scanning referral reward:", err)
+			continue
+		}
+		rewards = append(rewards, rw)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Println("Error querying referral rewards:", err)
+	}
+
+	for _, rw := range rewards {
+		// Marked first, so a failed email isn't sent again to the party that already got it
+		if _, err := db.ExecContext(ctx, "UPDATE referrals SET notified_at = NOW() WHERE id = $1", rw.ReferralID); err != nil {
+			log.Println("Error updating referral:", err)
+			continue
+		}
+
+		data := referralRewardEmail{ReferredName: rw.ReferredName, CouponCode: rw.ReferrerCoupon, Amount: referralConfig.RewardAmount}
+		if err := sendEmail(ctx, rw.ReferrerEmail, emailReferralReward, fmt.Sprintf("referral_reward:%d", rw.ReferralID), data); err != nil {
+			log.Printf("Error sending referral reward email to %s: %v", rw.ReferrerEmail, err)
+		}
+		data = referralRewardEmail{ReferredName: rw.ReferredName, CouponCode: rw.ReferredCoupon, Amount: referralConfig.RewardAmount}
+		if err := sendEmail(ctx, rw.ReferredEmail, emailReferralWelcome, fmt.Sprintf("referral_welcome:%d", rw.ReferralID), data); err != nil {
+			log.Printf("Error sending referral reward email to %s: %v", rw.ReferredEmail, err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// refreshTokenTTL is how long a refresh token stays valid, loaded by loadRefreshTokenConfig
+var refreshTokenTTL = 30 * 24 * time.Hour
+
+var errInvalidRefreshToken = errors.New("refresh token is invalid or expired")
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func loadRefreshTokenConfig() {
+	if ttl := os.Getenv("REFRESH_TOKEN_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Invalid REFRESH_TOKEN_TTL %q: %v", ttl, err)
+		}
+		refreshTokenTTL = d
+	}
+}
+
+// issueSession returns a new access token and starts a new refresh token family for the customer
+func issueSession(ctx context.Context, customer *Customer) (*LoginResponse, error) {
+	family, err := generateToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	refreshToken, refreshExpiresAt, _, err := insertRefreshToken(ctx, tx, customer.ID, family)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return newLoginResponse(customer, refreshToken, refreshExpiresAt)
+}
+
+func newLoginResponse(customer *Customer, refreshToken string, refreshExpiresAt time.Time) (*LoginResponse, error) {
+	token, expiresAt, err := IssueToken(customer.ID, customer.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginResponse{
+		Token:            token,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt,
+		Customer:         *customer,
+	}, nil
+}
+
+func insertRefreshToken(ctx context.Context, tx *sql.Tx, customerID int, family string) (string, time.Time, int, error) {
+	token, err := generateToken(32)
+	if err != nil {
+		return "", time.Time{}, 0, err
+	}
+	expiresAt := time.Now().Add(refreshTokenTTL)
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO refresh_tokens (customer_id, token_hash, family, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, customerID, hashToken(token), family, expiresAt).Scan(&id)
+	if err != nil {
+		return "", time.Time{}, 0, err
+	}
+
+	return token, expiresAt, id, nil
+}
+
+// TOKEN REFRESH & REVOCATION
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var refreshRequest RefreshTokenRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &refreshRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	if refreshRequest.RefreshToken == "" {
+		handlers.WriteFieldError(w, "refresh_token", "refresh_token is required")
+		return
+	}
+
+	response, err := rotateRefreshToken(r.Context(), refreshRequest.RefreshToken)
+	if err == errInvalidRefreshToken {
+		handlers.WriteError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error refreshing token:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, response)
+}
+
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var revokeRequest RefreshTokenRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &revokeRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	// Revoking the whole family logs out every token rotated from this one
+	_, err = db.ExecContext(r.Context(), `
+		UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE revoked_at IS NULL
+		AND family = (SELECT family FROM refresh_tokens WHERE token_hash = $1)
+	`, hashToken(revokeRequest.RefreshToken))
+	if err != nil {
+		log.Println("Error revoking refresh token:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Token revoked"))
+}
+
+// rotateRefreshToken exchanges a refresh token for a new access and refresh token.
+// Presenting a token that was already rotated means it leaked, so its whole family is revoked.
+func rotateRefreshToken(ctx context.Context, token string) (*LoginResponse, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var tokenID, customerID int
+	var family string
+	var expiresAt time.Time
+	var revokedAt *time.Time
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, customer_id, family, expires_at, revoked_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+		FOR UPDATE
+	`, hashToken(token)).Scan(&tokenID, &customerID, &family, &expiresAt, &revokedAt)
+	if isNoRows(err) {
+		return nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if revokedAt != nil {
+		log.Printf("Refresh token reuse detected for customer %d, revoking family", customerID)
+		_, err = tx.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = NOW() WHERE family = $1 AND revoked_at IS NULL", family)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, errInvalidRefreshToken
+	}
+	if time.Now().After(expiresAt) {
+		return nil, errInvalidRefreshToken
+	}
+
+	newToken, newExpiresAt, newID, err := insertRefreshToken(ctx, tx, customerID, family)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = NOW(), replaced_by = $1 WHERE id = $2", newID, tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the role again so the new access token reflects role changes
+	var customer Customer
+	err = tx.QueryRowContext(ctx, "SELECT id, name, email, role FROM customers WHERE id = $1", customerID).
+		Scan(&customer.ID, &customer.Name, &customer.Email, &customer.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return newLoginResponse(&customer, newToken, newExpiresAt)
+}
+
+// revokeCustomerRefreshTokens logs the customer out of every session
+func revokeCustomerRefreshTokens(ctx context.Context, tx *sql.Tx, customerID int) error {
+	_, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = NOW() WHERE customer_id = $1 AND revoked_at IS NULL", customerID)
+	return err
+}
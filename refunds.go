@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const (
+	orderStatusRefunded          = "Refunded"
+	orderStatusPartiallyRefunded = "Partially Refunded"
+)
+
+const (
+	refundStatusPending   = "pending"
+	refundStatusSucceeded = "succeeded"
+	refundStatusFailed    = "failed"
+)
+
+var errNoCapturedPayment = errors.New("order has no captured payment to refund")
+var errRefundTooLarge = handlers.NewFieldError("amount", "amount is more than the payment's refundable balance")
+var errRefundFailed = errors.New("payment provider rejected the refund")
+
+type Refund struct {
+	ID        int       `json:"refund_id"`
+	OrderID   int       `json:"order_id"`
+	PaymentID int       `json:"payment_id"`
+	Amount    float64   `json:"amount"`
+	Currency  string    `json:"currency"`
+	Reason    string    `json:"reason,omitempty"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type RefundRequest struct {
+	// Amount defaults to everything not refunded yet
+	Amount *float64 `json:"amount"`
+	Reason string   `json:"reason"`
+}
+
+// ADMIN REFUND ORDER
+// AdminRefundOrderHandler refunds all or part of what the order's captured payments paid,
+// through their payment providers
+func AdminRefundOrderHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var refundRequest RefundRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	// The body is optional; without it the whole remaining balance is refunded
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &refundRequest); err != nil {
+			log.Println("Error decoding JSON:", err)
+			handlers.WriteInvalidJSON(w)
+			return
+		}
+	}
+
+	refundRequest.Reason = strings.TrimSpace(refundRequest.Reason)
+	if refundRequest.Amount != nil && roundCents(*refundRequest.Amount) <= 0 {
+		handlers.WriteFieldError(w, "amount", "amount must be positive")
+		return
+	}
+	if len(refundRequest.Reason) > maxOrderLineNoteLength {
+		handlers.WriteValidationError(w, handlers.FieldErrorf("reason", "reason must be at most %d characters", maxOrderLineNoteLength))
+		return
+	}
+
+	refunds, err := refundOrder(r.Context(), orderID, refundRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if err == errNoCapturedPayment {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, errRefundTooLarge) {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if errors.Is(err, errRefundFailed) {
+		log.Printf("Error refunding order %d: %v", orderID, err)
+		handlers.WriteError(w, http.StatusBadGateway, errRefundFailed.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error refunding order:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, refunds)
+}
+
+// pendingRefund is the part of a refund taken from one payment, waiting for its provider
+type pendingRefund struct {
+	Refund
+	provider string
+	// captureReference is the provider's ID of the captured funds, or the gift card's code
+	captureReference string
+	// paymentRemaining is what was refundable on the payment before this refund
+	paymentRemaining float64
+	reference        string
+}
+
+// refundOrder records the refunds as pending before calling the providers, so concurrent
+// refunds can't together return more than was paid. A split payment is refunded to its card
+// first and then back onto the gift card. The order becomes "Refunded" once everything paid
+// is refunded, or "Partially Refunded" before that.
+func refundOrder(ctx context.Context, orderID int, req RefundRequest) ([]Refund, error) {
+	refunds, remaining, err := createRefunds(ctx, orderID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// After a provider rejects its part, the parts after it are given up too, so the admin can
+	// retry the remaining amount
+	var refundErr error
+	for i := range refunds {
+		refund := &refunds[i]
+		if refundErr == nil && refund.provider == paymentProviderGiftCard {
+			refund.Status = refundStatusSucceeded
+			continue
+		}
+		if refundErr == nil {
+			refund.reference, refundErr = paymentGateways[refund.provider].Refund(ctx, PaymentRefund{
+				RefundID:         refund.ID,
+				CaptureReference: refund.captureReference,
+				Amount:           refund.Amount,
+				Currency:         refund.Currency,
+			})
+			if refundErr == nil {
+				refund.Status = refundStatusSucceeded
+				continue
+			}
+			refundErr = fmt.Errorf("%w: %v", errRefundFailed, refundErr)
+		}
+		refund.Status = refundStatusFailed
+		if _, err := db.ExecContext(ctx, "UPDATE refunds SET status = $1 WHERE id = $2", refund.Status, refund.ID); err != nil {
+			log.Println("Error updating refund:", err)
+		}
+	}
+
+	succeeded, err := completeRefunds(ctx, orderID, refunds, remaining)
+	if err != nil {
+		return nil, err
+	}
+	if refundErr != nil {
+		return nil, refundErr
+	}
+	return succeeded, nil
+}
+
+// completeRefunds saves the refunds that succeeded and adds them to the ledger: gift cards get
+// their amount back, fully refunded payments are marked as refunded and the order's status
+// follows what is left.
+func completeRefunds(ctx context.Context, orderID int, refunds []pendingRefund, remaining float64) ([]Refund, error) {
+	succeeded := make([]Refund, 0, len(refunds))
+	refunded := 0.0
+	for _, refund := range refunds {
+		if refund.Status == refundStatusSucceeded {
+			succeeded = append(succeeded, refund.Refund)
+			refunded += refund.Amount
+		}
+	}
+	if len(succeeded) == 0 {
+		return succeeded, nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, refund := range refunds {
+		if refund.Status != refundStatusSucceeded {
+			continue
+		}
+		_, err := tx.ExecContext(ctx, "UPDATE refunds SET status = $1, reference = NULLIF($2, '') WHERE id = $3", refund.Status, refund.reference, refund.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := recordRefund(ctx, tx, refund.Refund); err != nil {
+			return nil, err
+		}
+		if refund.provider == paymentProviderGiftCard {
+			if err := creditGiftCard(ctx, tx, refund.captureReference, refund.Amount, orderID); err != nil {
+				return nil, err
+			}
+		}
+		if roundCents(refund.paymentRemaining-refund.Amount) <= 0 {
+			_, err := tx.ExecContext(ctx, "UPDATE payments SET status = $1, updated_at = NOW() WHERE id = $2", paymentStatusRefunded, refund.PaymentID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// A cancelled order stays cancelled when a payment captured after it is refunded
+	var current string
+	if err := tx.QueryRowContext(ctx, "SELECT status FROM orders WHERE id = $1 FOR UPDATE", orderID).Scan(&current); err != nil {
+		return nil, err
+	}
+	status := orderStatusPartiallyRefunded
+	if roundCents(remaining-refunded) <= 0 {
+		status = orderStatusRefunded
+	}
+	if current != orderStatusCancelled {
+		if err := setOrderStatus(ctx, tx, orderID, status); err != nil {
+			return nil, err
+		}
+	}
+
+	return succeeded, tx.Commit()
+}
+
+// createRefunds checks the amount against the order's captured payments and records a pending
+// refund for each payment it is taken from, card payments before gift cards. It also returns
+// the order's refundable balance before these refunds.
+func createRefunds(ctx context.Context, orderID int, req RefundRequest) ([]pendingRefund, float64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT TRUE FROM orders WHERE id = $1 FOR UPDATE", orderID).Scan(&exists); err != nil {
+		return nil, 0, err
+	}
+
+	// Gift card payments have no capture reference; the code in their reference identifies the card
+	rows, err := tx.QueryContext(ctx, `
+		SELECT p.id, p.provider, COALESCE(p.capture_reference, p.reference), p.amount, p.currency,
+			   COALESCE((SELECT SUM(amount) FROM refunds WHERE payment_id = p.id AND status <> $2), 0)
+		FROM payments p
+		WHERE p.order_id = $1 AND p.status = $3
+		  AND (p.capture_reference IS NOT NULL OR (p.provider = $4 AND p.reference IS NOT NULL))
+		ORDER BY p.provider = $4, p.id DESC
+	`, orderID, refundStatusFailed, paymentStatusCaptured, paymentProviderGiftCard)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var payments []pendingRefund
+	remaining := 0.0
+	for rows.Next() {
+		var payment pendingRefund
+		var paid, refunded float64
+		if err := rows.Scan(&payment.PaymentID, &payment.provider, &payment.captureReference, &paid,
+			&payment.Currency, &refunded); err != nil {
+			return nil, 0, err
+		}
+		payment.paymentRemaining = roundCents(paid - refunded)
+		if payment.paymentRemaining > 0 {
+			payments = append(payments, payment)
+			remaining += payment.paymentRemaining
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	remaining = roundCents(remaining)
+	if remaining <= 0 {
+		return nil, 0, errNoCapturedPayment
+	}
+	amount := remaining
+	if req.Amount != nil {
+		amount = roundCents(*req.Amount)
+	}
+	if amount > remaining {
+		return nil, 0, fmt.Errorf("%w (%.2f %s)", errRefundTooLarge, remaining, payments[0].Currency)
+	}
+
+	var refunds []pendingRefund
+	for _, refund := range payments {
+		if amount <= 0 {
+			break
+		}
+		if _, ok := paymentGateways[refund.provider]; !ok && refund.provider != paymentProviderGiftCard {
+			return nil, 0, fmt.Errorf("payment provider %q is not enabled", refund.provider)
+		}
+
+		refund.OrderID = orderID
+		refund.Reason = req.Reason
+		refund.Status = refundStatusPending
+		refund.Amount = roundCents(math.Min(amount, refund.paymentRemaining))
+		amount = roundCents(amount - refund.Amount)
+
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO refunds (order_id, payment_id, amount, reason, status)
+			VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+			RETURNING id, created_at
+		`, orderID, refund.PaymentID, refund.Amount, refund.Reason, refund.Status).Scan(&refund.ID, &refund.CreatedAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		refunds = append(refunds, refund)
+	}
+
+	return refunds, remaining, tx.Commit()
+}
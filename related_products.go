@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const (
+	defaultRelatedProducts = 5
+	// maxRelatedProducts is also how many related products are kept per product
+	maxRelatedProducts = 20
+)
+
+// RelatedProduct is a product often bought in the same order as another one
+type RelatedProduct struct {
+	Product
+	TimesBoughtTogether int `json:"times_bought_together"`
+}
+
+// RELATED PRODUCTS
+// RelatedProductsHandler returns the products most often bought together with the product.
+// The co-purchase counts are recomputed nightly by refreshRelatedProducts.
+func RelatedProductsHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	limit := defaultRelatedProducts
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxRelatedProducts {
+			handlers.WriteValidationError(w, handlers.NewFieldError("limit", "limit must be between 1 and "+strconv.Itoa(maxRelatedProducts)))
+			return
+		}
+	}
+
+	var exists bool
+	err = db.QueryRowContext(r.Context(), "SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)", productID).Scan(&exists)
+	if err == nil && !exists {
+		handlers.WriteError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+
+	var related []RelatedProduct
+	if err == nil {
+		related, err = getRelatedProducts(r.Context(), productID, limit)
+	}
+	var pricing *productPricing
+	if err == nil {
+		pricing, err = currentPricing(r.Context(), db, 0)
+	}
+	if err != nil {
+		log.Println("Error retrieving related products:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	for i := range related {
+		pricing.apply(&related[i].Product)
+	}
+	handlers.WriteJSON(w, http.StatusOK, related)
+}
+
+func getRelatedProducts(ctx context.Context, productID, limit int) ([]RelatedProduct, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.id, COALESCE(p.sku, ''), p.name, p.price, COALESCE(p.description, ''), COALESCE(p.image_url, ''), p.category_id, rp.orders
+		FROM related_products rp
+		JOIN products p ON rp.related_product_id = p.id
+		WHERE rp.product_id = $1
+		ORDER BY rp.orders DESC, p.id
+		LIMIT $2
+	`, productID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	related := make([]RelatedProduct, 0)
+	for rows.Next() {
+		var product RelatedProduct
+		if err := rows.Scan(&product.ID, &product.SKU, &product.Name, &product.Price, &product.Description, &product.ImageURL, &product.CategoryID, &product.TimesBoughtTogether); err != nil {
+			return nil, err
+		}
+		related = append(related, product)
+	}
+
+	return related, rows.Err()
+}
+
+// refreshRelatedProducts recounts how many orders contain each pair of products and keeps
+// the top maxRelatedProducts for every product. The table is rebuilt in one transaction, so
+// readers see either the old or the new counts.
+func refreshRelatedProducts(ctx context.Context) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Error refreshing related products:", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM related_products"); err != nil {
+		log.Println("Error refreshing related products:", err)
+		return
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO related_products (product_id, related_product_id, orders)
+		SELECT product_id, related_product_id, orders
+		FROM (
+			SELECT a.product_id, b.product_id AS related_product_id, COUNT(DISTINCT a.order_id) AS orders,
+				   ROW_NUMBER() OVER (PARTITION BY a.product_id ORDER BY COUNT(DISTINCT a.order_id) DESC, b.product_id) AS rank
+			FROM order_products a
+			JOIN order_products b ON a.order_id = b.order_id AND a.product_id <> b.product_id
+			GROUP BY a.product_id, b.product_id
+		) pairs
+		WHERE rank <= $1
+	`, maxRelatedProducts)
+	if err != nil {
+		log.Println("Error refreshing related products:", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println("Error refreshing related products:", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// ReorderItem reports how one line of the previous order was copied to the cart
+type ReorderItem struct {
+	ProductID int      `json:"product_id"`
+	VariantID *int     `json:"variant_id,omitempty"`
+	Ordered   int      `json:"ordered"`
+	Added     int      `json:"added"`
+	Issues    []string `json:"issues"`
+	// PreviousPrice is the unit price paid for the previous order, only set when the price changed
+	PreviousPrice *float64 `json:"previous_price,omitempty"`
+	Price         float64  `json:"price"`
+	Available     int      `json:"available"`
+}
+
+type Reorder struct {
+	Items []ReorderItem `json:"items"`
+	Cart  *Cart         `json:"cart"`
+}
+
+// reorderLine is a line of the previous order with its product's current price and stock
+type reorderLine struct {
+	ProductID int
+	VariantID *int
+	Quantity  int
+	PaidPrice float64
+	Price     float64
+	Stock     int
+}
+
+// CUSTOMER REORDER
+// CustomerReorderHandler copies the lines of one of the customer's orders into their active
+// cart at current prices. Out of stock lines are skipped and lines with too little stock are
+// added with what is left; both are reported along with price changes.
+func CustomerReorderHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	owner := cartOwner{CustomerID: getCustomerID(r)}
+	lines, err := getReorderLines(r.Context(), orderID, owner.CustomerID)
+	if err == nil && len(lines) == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	var reorder *Reorder
+	if err == nil {
+		reorder, err = reorderLines(r.Context(), owner, lines)
+	}
+	if err != nil {
+		log.Println("Error reordering:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, reorder)
+}
+
+// getReorderLines returns the lines of the customer's order; an order of another customer has none
+func getReorderLines(ctx context.Context, orderID, customerID int) ([]reorderLine, error) {
+	pricing, err := currentPricing(ctx, db, customerID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT op.product_id, op.variant_id, op.quantity,
+			   COALESCE(op.unit_price_at_purchase, v.price, p.price), COALESCE(v.price, p.price), p.stock
+		FROM orders o
+		JOIN order_products op ON o.id = op.order_id
+		JOIN products p ON op.product_id = p.id
+		LEFT JOIN product_variants v ON op.variant_id = v.id
+		WHERE o.id = $1 AND o.customer_id = $2
+		ORDER BY op.product_id, op.variant_id NULLS FIRST
+	`, orderID, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []reorderLine
+	for rows.Next() {
+		var line reorderLine
+		if err := rows.Scan(&line.ProductID, &line.VariantID, &line.Quantity, &line.PaidPrice, &line.Price, &line.Stock); err != nil {
+			return nil, err
+		}
+		line.Price = pricing.price(line.ProductID, line.Price)
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
+
+func reorderLines(ctx context.Context, owner cartOwner, lines []reorderLine) (*Reorder, error) {
+	cartID, err := getOrCreateCartID(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	// Variants of one product share its stock
+	added := make(map[int]int)
+	reorder := &Reorder{Items: make([]ReorderItem, 0, len(lines))}
+	for _, line := range lines {
+		item := ReorderItem{
+			ProductID: line.ProductID,
+			VariantID: line.VariantID,
+			Ordered:   line.Quantity,
+			Issues:    make([]string, 0),
+			Price:     line.Price,
+			Available: line.Stock - added[line.ProductID],
+		}
+		if line.PaidPrice != line.Price {
+			paid := line.PaidPrice
+			item.PreviousPrice = &paid
+			item.Issues = append(item.Issues, cartIssuePriceChanged)
+		}
+
+		item.Added = line.Quantity
+		switch {
+		case item.Available <= 0:
+			item.Added = 0
+			item.Issues = append(item.Issues, cartIssueOutOfStock)
+		case item.Available < line.Quantity:
+			item.Added = item.Available
+			item.Issues = append(item.Issues, cartIssueInsufficientStock)
+		}
+
+		if item.Added > 0 {
+			err := addCartItem(ctx, cartID, CartItemRequest{ProductID: line.ProductID, VariantID: line.VariantID, Quantity: item.Added})
+			if err != nil {
+				return nil, err
+			}
+			added[line.ProductID] += item.Added
+		}
+		reorder.Items = append(reorder.Items, item)
+	}
+
+	reorder.Cart, err = getCart(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	return reorder, nil
+}
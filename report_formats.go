@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Export formats of reports, selected with the format query parameter
+const (
+	reportFormatCSV  = "csv"
+	reportFormatXLSX = "xlsx"
+)
+
+// reportContentTypes are the export formats' media types
+var reportContentTypes = map[string]string{
+	reportFormatCSV:  "text/csv; charset=utf-8",
+	reportFormatXLSX: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// reportFlushRows is how many CSV rows are written between flushes to the client
+const reportFlushRows = 500
+
+// Report settings, loaded from environment variables by loadReportConfig
+var reportConfig = struct {
+	// LinkTTL is how long the signed link to an uploaded report works
+	LinkTTL time.Duration
+}{
+	LinkTTL: time.Hour,
+}
+
+// reportWriter writes a report's rows in an export format. Values are ints, strings, bools,
+// float64 amounts and time.Time; times at midnight are dates.
+type reportWriter interface {
+	Write(row []interface{}) error
+	// Close finishes the file; nothing is written after it
+	Close() error
+}
+
+// csvReportWriter writes rows through to its writer, flushing them to clients regularly
+type csvReportWriter struct {
+	w    io.Writer
+	csv  *csv.Writer
+	rows int
+}
+
+// xlsxReportWriter collects the rows in a single-sheet workbook, which excelize keeps on disk
+// once it grows large, and writes it on Close
+type xlsxReportWriter struct {
+	w         io.Writer
+	file      *excelize.File
+	stream    *excelize.StreamWriter
+	dateStyle int
+	timeStyle int
+	rows      int
+}
+
+// reportOptions are how the client wants a report delivered
+type reportOptions struct {
+	// Format is one of the reportFormat constants, or empty when none was requested
+	Format string
+	// Link uploads the report to report storage and answers with a signed link to it
+	// instead of the file
+	Link bool
+}
+
+// ReportLink is where an uploaded report can be downloaded until it expires
+type ReportLink struct {
+	URL       string    `json:"url"`
+	Filename  string    `json:"filename"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func loadReportConfig() {
+	if v := os.Getenv("REPORTS_LINK_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > 7*24*time.Hour {
+			log.Fatalf("Invalid REPORTS_LINK_TTL %q: must be positive and at most 168h", v)
+		}
+		reportConfig.LinkTTL = d
+	}
+}
+
+// parseReportOptions reads the format and delivery query parameters
+func parseReportOptions(r *http.Request) (reportOptions, error) {
+	var options reportOptions
+	switch format := r.URL.Query().Get("format"); format {
+	case "", reportFormatCSV, reportFormatXLSX:
+		options.Format = format
+	default:
+		return options, handlers.NewFieldError("format", "format must be csv or xlsx")
+	}
+
+	link, err := parseDelivery(r)
+	options.Link = link
+	return options, err
+}
+
+// parseDelivery reports whether delivery=link asked for a signed link instead of the file
+func parseDelivery(r *http.Request) (bool, error) {
+	switch r.URL.Query().Get("delivery") {
+	case "", "download":
+		return false, nil
+	case "link":
+		if reportStorage == nil {
+			return false, errors.New("delivery=link needs report storage, which is not configured")
+		}
+		return true, nil
+	}
+	return false, handlers.NewFieldError("delivery", "delivery must be download or link")
+}
+
+// writeReport generates the named report with writeRows in the requested format (CSV by
+// default) and sends it: as a download, whose headers go out before the rows so errors can only
+// cut it short, or uploaded to report storage and answered with a signed link.
+func writeReport(w http.ResponseWriter, r *http.Request, options reportOptions, name string, dateRange DateRange, writeRows func(reportWriter) error) {
+	format := options.Format
+	if format == "" {
+		format = reportFormatCSV
+	}
+	filename := dateRange.filename(name, format)
+
+	if !options.Link {
+		writer, err := newReportWriter(w, format, name)
+		if err != nil {
+			log.Printf("Error starting %s report: %v", name, err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		w.Header().Set("Content-Type", reportContentTypes[format])
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		w.WriteHeader(http.StatusOK)
+
+		if err := writeRows(writer); err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			log.Printf("Error writing %s report: %v", name, err)
+		}
+		return
+	}
+
+	// The report is uploaded while it is written, so it isn't held in memory either
+	reader, pipe := io.Pipe()
+	uploaded := make(chan error, 1)
+	key, err := reportKey(filename)
+	if err == nil {
+		go func() {
+			_, err := reportStorage.Put(r.Context(), key, reader, -1, reportContentTypes[format])
+			reader.CloseWithError(err)
+			uploaded <- err
+		}()
+
+		var writer reportWriter
+		if writer, err = newReportWriter(pipe, format, name); err == nil {
+			if err = writeRows(writer); err == nil {
+				err = writer.Close()
+			}
+		}
+		pipe.CloseWithError(err)
+		if uploadErr := <-uploaded; err == nil {
+			err = uploadErr
+		}
+	}
+	if err != nil {
+		log.Printf("Error uploading %s report: %v", name, err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeReportLink(w, r.Context(), key, filename)
+}
+
+// uploadReport stores a report that was generated in full, such as an invoice, and answers
+// with a signed link to it
+func uploadReport(w http.ResponseWriter, ctx context.Context, filename, contentType string, data []byte) {
+	key, err := reportKey(filename)
+	if err == nil {
+		_, err = reportStorage.Put(ctx, key, bytes.NewReader(data), int64(len(data)), contentType)
+	}
+	if err != nil {
+		log.Printf("Error uploading %s: %v", filename, err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeReportLink(w, ctx, key, filename)
+}
+
+func writeReportLink(w http.ResponseWriter, ctx context.Context, key, filename string) {
+	url, err := reportStorage.SignedURL(ctx, key, reportConfig.LinkTTL)
+	if err != nil {
+		log.Printf("Error signing link to %s: %v", key, err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, ReportLink{URL: url, Filename: filename, ExpiresAt: time.Now().Add(reportConfig.LinkTTL)})
+}
+
+// reportKey puts each upload under a random prefix, so its key can't be guessed and reports
+// with the same name don't overwrite each other
+func reportKey(filename string) (string, error) {
+	token, err := generateToken(16)
+	if err != nil {
+		return "", err
+	}
+	return "reports/" + token + "/" + filename, nil
+}
+
+// newReportWriter starts a report in the format on w
+func newReportWriter(w io.Writer, format, name string) (reportWriter, error) {
+	if format != reportFormatXLSX {
+		return &csvReportWriter{w: w, csv: csv.NewWriter(w)}, nil
+	}
+
+	file := excelize.NewFile()
+	if err := file.SetSheetName("Sheet1", name); err != nil {
+		return nil, err
+	}
+	stream, err := file.NewStreamWriter(name)
+	if err != nil {
+		return nil, err
+	}
+	dateFormat, timeFormat := "yyyy-mm-dd", "yyyy-mm-dd hh:mm:ss"
+	dateStyle, err := file.NewStyle(&excelize.Style{CustomNumFmt: &dateFormat})
+	if err != nil {
+		return nil, err
+	}
+	timeStyle, err := file.NewStyle(&excelize.Style{CustomNumFmt: &timeFormat})
+	if err != nil {
+		return nil, err
+	}
+	return &xlsxReportWriter{w: w, file: file, stream: stream, dateStyle: dateStyle, timeStyle: timeStyle}, nil
+}
+
+func (c *csvReportWriter) Write(row []interface{}) error {
+	record := make([]string, len(row))
+	for i, value := range row {
+		switch value := value.(type) {
+		case string:
+			record[i] = value
+		case int:
+			record[i] = strconv.Itoa(value)
+		case float64:
+			record[i] = strconv.FormatFloat(value, 'f', 2, 64)
+		case bool:
+			record[i] = strconv.FormatBool(value)
+		case time.Time:
+			if isMidnight(value) {
+				record[i] = value.Format("2006-01-02")
+			} else {
+				record[i] = value.Format("2006-01-02 15:04:05")
+			}
+		}
+	}
+	if err := c.csv.Write(record); err != nil {
+		return err
+	}
+
+	if c.rows++; c.rows%reportFlushRows == 0 {
+		c.csv.Flush()
+		if flusher, ok := c.w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+	return c.csv.Error()
+}
+
+func (c *csvReportWriter) Close() error {
+	c.csv.Flush()
+	return c.csv.Error()
+}
+
+func (x *xlsxReportWriter) Write(row []interface{}) error {
+	cells := make([]interface{}, len(row))
+	for i, value := range row {
+		if t, ok := value.(time.Time); ok {
+			style := x.timeStyle
+			if isMidnight(t) {
+				style = x.dateStyle
+			}
+			cells[i] = excelize.Cell{StyleID: style, Value: t}
+			continue
+		}
+		cells[i] = value
+	}
+
+	x.rows++
+	cell, err := excelize.CoordinatesToCellName(1, x.rows)
+	if err != nil {
+		return err
+	}
+	return x.stream.SetRow(cell, cells)
+}
+
+func (x *xlsxReportWriter) Close() error {
+	defer x.file.Close()
+	if err := x.stream.Flush(); err != nil {
+		return err
+	}
+	_, err := x.file.WriteTo(x.w)
+	return err
+}
+
+func isMidnight(t time.Time) bool {
+	return t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// How often subscribed reports are sent. Each covers the day, week (starting on Monday) or
+// month before it is sent, in the server's time zone.
+const (
+	reportFrequencyDaily   = "daily"
+	reportFrequencyWeekly  = "weekly"
+	reportFrequencyMonthly = "monthly"
+)
+
+// Reports that can be subscribed to, by their export's name
+var subscribableReports = map[string]string{
+	"orders": "Orders",
+	"sales":  "Sales",
+}
+
+// maxReportRecipients caps the recipients of a subscription
+const maxReportRecipients = 20
+
+// ReportSubscription emails a report to its recipients on a schedule
+type ReportSubscription struct {
+	ID         int                       `json:"subscription_id"`
+	Report     string                    `json:"report"`
+	Filters    ReportSubscriptionFilters `json:"filters"`
+	Frequency  string                    `json:"frequency"`
+	Format     string                    `json:"format"`
+	Recipients []string                  `json:"recipients"`
+	NextRunAt  time.Time                 `json:"next_run_at"`
+	LastRunAt  *time.Time                `json:"last_run_at"`
+	CreatedAt  time.Time                 `json:"created_at"`
+}
+
+// ReportSubscriptionFilters are the report's options besides its date range, which follows
+// from the frequency
+type ReportSubscriptionFilters struct {
+	// GroupBy is the sales report's period: day, week or month
+	GroupBy string `json:"group_by,omitempty"`
+}
+
+type ReportSubscriptionRequest struct {
+	Report     string                    `json:"report"`
+	Filters    ReportSubscriptionFilters `json:"filters"`
+	Frequency  string                    `json:"frequency"`
+	Format     string                    `json:"format"`
+	Recipients []string                  `json:"recipients"`
+}
+
+// reportSubscriptionEmail is the data of the email a subscribed report is attached to
+type reportSubscriptionEmail struct {
+	SubscriptionID int
+	// Report is the report's name, and Title its capitalized name
+	Report    string
+	Title     string
+	Frequency string
+	// Period describes the range the report covers, e.g. "January 2024"
+	Period   string
+	Filename string
+}
+
+// ADMIN REPORT SUBSCRIPTIONS
+func AdminReportSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, report, COALESCE(group_by, ''), frequency, format, recipients, next_run_at, last_run_at, created_at
+		FROM report_subscriptions
+		ORDER BY id
+	`)
+	if err != nil {
+		log.Println("Error retrieving report subscriptions:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	defer rows.Close()
+
+	subscriptions := make([]ReportSubscription, 0)
+	for rows.Next() {
+		var subscription ReportSubscription
+		if err := rows.Scan(&subscription.ID, &subscription.Report, &subscription.Filters.GroupBy, &subscription.Frequency,
+			&subscription.Format, pq.Array(&subscription.Recipients), &subscription.NextRunAt, &subscription.LastRunAt,
+			&subscription.CreatedAt); err != nil {
+			log.Println("Error scanning report subscription:", err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, subscriptions)
+}
+
+// AdminCreateReportSubscriptionHandler subscribes the recipients to the report. The first one
+// is sent once the current day, week or month is over.
+func AdminCreateReportSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptionRequest, ok := readReportSubscriptionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var subscription ReportSubscription
+	err := db.QueryRowContext(r.Context(), `
+		INSERT INTO report_subscriptions (report, group_by, frequency, format, recipients, next_run_at, created_by)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, NULLIF($7, 0))
+		RETURNING id, report, COALESCE(group_by, ''), frequency, format, recipients, next_run_at, last_run_at, created_at
+	`, subscriptionRequest.Report, subscriptionRequest.Filters.GroupBy, subscriptionRequest.Frequency, subscriptionRequest.Format,
+		pq.Array(subscriptionRequest.Recipients), nextReportRun(subscriptionRequest.Frequency, time.Now()), getCustomerID(r)).Scan(
+		&subscription.ID, &subscription.Report, &subscription.Filters.GroupBy, &subscription.Frequency, &subscription.Format,
+		pq.Array(&subscription.Recipients), &subscription.NextRunAt, &subscription.LastRunAt, &subscription.CreatedAt)
+	if err != nil {
+		log.Println("Error creating report subscription:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, subscription)
+}
+
+// AdminUpdateReportSubscriptionHandler replaces the subscription's settings. A changed frequency
+// reschedules its next report.
+func AdminUpdateReportSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid report subscription ID")
+		return
+	}
+
+	subscriptionRequest, ok := readReportSubscriptionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var subscription ReportSubscription
+	err = db.QueryRowContext(r.Context(), `
+		UPDATE report_subscriptions
+		SET report = $1, group_by = NULLIF($2, ''), format = $4, recipients = $5,
+			next_run_at = CASE WHEN frequency = $3 THEN next_run_at ELSE $6 END, frequency = $3
+		WHERE id = $7
+		RETURNING id, report, COALESCE(group_by, ''), frequency, format, recipients, next_run_at, last_run_at, created_at
+	`, subscriptionRequest.Report, subscriptionRequest.Filters.GroupBy, subscriptionRequest.Frequency, subscriptionRequest.Format,
+		pq.Array(subscriptionRequest.Recipients), nextReportRun(subscriptionRequest.Frequency, time.Now()), subscriptionID).Scan(
+		&subscription.ID, &subscription.Report, &subscription.Filters.GroupBy, &subscription.Frequency, &subscription.Format,
+		pq.Array(&subscription.Recipients), &subscription.NextRunAt, &subscription.LastRunAt, &subscription.CreatedAt)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Report subscription not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error updating report subscription:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, subscription)
+}
+
+func AdminDeleteReportSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid report subscription ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM report_subscriptions WHERE id = $1", subscriptionID)
+	if err != nil {
+		log.Println("Error deleting report subscription:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Report subscription not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func readReportSubscriptionRequest(w http.ResponseWriter, r *http.Request) (ReportSubscriptionRequest, bool) {
+	var subscriptionRequest ReportSubscriptionRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return subscriptionRequest, false
+	}
+
+	err = json.Unmarshal(body, &subscriptionRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return subscriptionRequest, false
+	}
+
+	if subscriptionRequest.Format == "" {
+		subscriptionRequest.Format = reportFormatCSV
+	}
+	if subscriptionRequest.Report == "sales" && subscriptionRequest.Filters.GroupBy == "" {
+		subscriptionRequest.Filters.GroupBy = "day"
+	}
+	recipients := make([]string, 0, len(subscriptionRequest.Recipients))
+	seen := make(map[string]bool)
+	for _, recipient := range subscriptionRequest.Recipients {
+		if recipient = strings.TrimSpace(recipient); !seen[normalizeEmail(recipient)] {
+			seen[normalizeEmail(recipient)] = true
+			recipients = append(recipients, recipient)
+		}
+	}
+	subscriptionRequest.Recipients = recipients
+
+	var validationErr error
+	switch {
+	case subscribableReports[subscriptionRequest.Report] == "":
+		validationErr = handlers.NewFieldError("report", "report must be orders or sales")
+	case subscriptionRequest.Report == "sales" && !salesReportPeriods[subscriptionRequest.Filters.GroupBy]:
+		validationErr = handlers.NewFieldError("filters.group_by", "filters.group_by must be one of day, week, month")
+	case subscriptionRequest.Report != "sales" && subscriptionRequest.Filters.GroupBy != "":
+		validationErr = handlers.NewFieldError("filters.group_by", "filters.group_by only applies to the sales report")
+	case subscriptionRequest.Frequency != reportFrequencyDaily && subscriptionRequest.Frequency != reportFrequencyWeekly &&
+		subscriptionRequest.Frequency != reportFrequencyMonthly:
+		validationErr = handlers.NewFieldError("frequency", "frequency must be daily, weekly or monthly")
+	case reportContentTypes[subscriptionRequest.Format] == "":
+		validationErr = handlers.NewFieldError("format", "format must be csv or xlsx")
+	case len(recipients) == 0:
+		validationErr = handlers.NewFieldError("recipients", "at least one recipient is required")
+	case len(recipients) > maxReportRecipients:
+		validationErr = handlers.FieldErrorf("recipients", "at most %d recipients are allowed", maxReportRecipients)
+	}
+	for _, recipient := range recipients {
+		if validationErr == nil && !validEmail(recipient) {
+			validationErr = handlers.FieldErrorf("recipients", "recipient %q is not a valid email address", recipient)
+		}
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return subscriptionRequest, false
+	}
+
+	return subscriptionRequest, true
+}
+
+// nextReportRun is when the first day, week or month starting after t starts, which is when
+// the report of the one t is in is sent
+func nextReportRun(frequency string, t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch frequency {
+	case reportFrequencyWeekly:
+		return day.AddDate(0, 0, 7-(int(day.Weekday())+6)%7)
+	case reportFrequencyMonthly:
+		return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+	}
+	return day.AddDate(0, 0, 1)
+}
+
+// reportPeriod is the day, week or month that ends when a report is sent at runAt
+func reportPeriod(frequency string, runAt time.Time) (DateRange, string) {
+	runAt = runAt.In(time.Local)
+	var from time.Time
+	var period string
+	switch frequency {
+	case reportFrequencyWeekly:
+		from = runAt.AddDate(0, 0, -7)
+		period = "the week of " + from.Format("Jan 2 2006")
+	case reportFrequencyMonthly:
+		from = runAt.AddDate(0, -1, 0)
+		period = from.Format("January 2006")
+	default:
+		from = runAt.AddDate(0, 0, -1)
+		period = from.Format("Mon, Jan 2 2006")
+	}
+	// Ranges include their end, like those given as dates
+	to := runAt.Add(-time.Nanosecond)
+	return DateRange{From: &from, To: &to}, period
+}
+
+// sendReportSubscriptions generates the reports that are due and queues them for their
+// recipients. Reports missed while the server was down aren't caught up on: each subscription
+// is sent the latest period it missed.
+func sendReportSubscriptions(ctx context.Context) {
+	for {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			log.Println("Error claiming report subscriptions:", err)
+			return
+		}
+
+		var subscription ReportSubscription
+		err = tx.QueryRowContext(ctx, `
+			SELECT id, report, COALESCE(group_by, ''), frequency, format, recipients, next_run_at
+			FROM report_subscriptions
+			WHERE next_run_at <= NOW()
+			ORDER BY next_run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		`).Scan(&subscription.ID, &subscription.Report, &subscription.Filters.GroupBy, &subscription.Frequency,
+			&subscription.Format, pq.Array(&subscription.Recipients), &subscription.NextRunAt)
+		if err != nil {
+			tx.Rollback()
+			if !isNoRows(err) {
+				log.Println("Error claiming report subscriptions:", err)
+			}
+			return
+		}
+
+		// The subscription stays due on errors, so the next run of the task tries it again; its
+		// emails are keyed by the period, so recipients already emailed aren't emailed twice
+		if err := sendSubscribedReport(ctx, &subscription); err != nil {
+			tx.Rollback()
+			log.Printf("Error sending report subscription %d: %v", subscription.ID, err)
+			return
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE report_subscriptions SET next_run_at = $2, last_run_at = NOW() WHERE id = $1
+		`, subscription.ID, nextReportRun(subscription.Frequency, time.Now()))
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Error rescheduling report subscription %d: %v", subscription.ID, err)
+			return
+		}
+	}
+}
+
+// sendSubscribedReport generates the subscription's report for the period ending at its
+// scheduled run and queues it for each recipient
+func sendSubscribedReport(ctx context.Context, subscription *ReportSubscription) error {
+	dateRange, period := reportPeriod(subscription.Frequency, subscription.NextRunAt)
+
+	var report bytes.Buffer
+	writer, err := newReportWriter(&report, subscription.Format, subscription.Report)
+	if err != nil {
+		return err
+	}
+	switch subscription.Report {
+	case "orders":
+		rows, err := queryOrderExport(ctx, dateRange)
+		if err != nil {
+			return err
+		}
+		err = writeOrderExport(writer, rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	case "sales":
+		buckets, err := getSalesReport(ctx, subscription.Filters.GroupBy, dateRange)
+		if err != nil {
+			return err
+		}
+		if err := writeSalesReport(writer, buckets); err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	attachment := emailAttachment{
+		Filename:    dateRange.filename(subscription.Report, subscription.Format),
+		ContentType: reportContentTypes[subscription.Format],
+		Content:     report.Bytes(),
+	}
+	email := reportSubscriptionEmail{
+		SubscriptionID: subscription.ID,
+		Report:         subscription.Report,
+		Title:          subscribableReports[subscription.Report],
+		Frequency:      subscription.Frequency,
+		Period:         period,
+		Filename:       attachment.Filename,
+	}
+	key := fmt.Sprintf("report_subscription:%d:%s", subscription.ID, dateRange.From.Format("2006-01-02"))
+	for _, to := range subscription.Recipients {
+		if err := sendEmail(ctx, to, emailReportSubscription, key, email, attachment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const (
+	defaultForecastWindowDays = 30
+	defaultForecastLeadDays   = 14
+	defaultProductReportDays  = 30
+)
+
+// productReportMetrics maps the product report's metric parameter to what it ranks by
+var productReportMetrics = map[string]string{
+	"units":   "COALESCE(sold.units, 0)",
+	"revenue": "COALESCE(sold.revenue, 0)",
+}
+
+var errInvalidTaxPeriod = handlers.NewFieldError("period", "period must be a month (YYYY-MM), quarter (YYYY-Q1) or year (YYYY)")
+
+// salesReportPeriods are the periods the sales report can group orders by
+var salesReportPeriods = map[string]bool{"day": true, "week": true, "month": true}
+
+// InventoryForecast projects how long a product's stock lasts at its recent sales rate
+type InventoryForecast struct {
+	ProductID int    `json:"product_id"`
+	SKU       string `json:"sku,omitempty"`
+	Name      string `json:"product_name"`
+	Stock     int    `json:"stock"`
+	UnitsSold int    `json:"units_sold"`
+	// DailyVelocity is the average units sold per day over the window
+	DailyVelocity float64 `json:"daily_velocity"`
+	// DaysRemaining is nil when the product hasn't sold in the window
+	DaysRemaining *float64 `json:"days_remaining"`
+	// Reorder is true when the stock runs out within the lead time
+	Reorder bool `json:"reorder"`
+}
+
+// SalesReportBucket is the sales of one day, week or month
+type SalesReportBucket struct {
+	// Period is when the bucket starts; weeks start on Monday
+	Period            time.Time `json:"period"`
+	Orders            int       `json:"orders"`
+	Revenue           float64   `json:"revenue"`
+	AverageOrderValue float64   `json:"average_order_value"`
+}
+
+// customerReportSortColumns maps the customer report's sort parameter to a safe ORDER BY clause
+var customerReportSortColumns = map[string]string{
+	"":       "total_spend DESC, c.id",
+	"spend":  "total_spend DESC, c.id",
+	"orders": "order_count DESC, c.id",
+	"recent": "last_order DESC, c.id",
+}
+
+// CustomerValue is what a customer has spent over all their paid orders
+type CustomerValue struct {
+	CustomerID     int       `json:"customer_id"`
+	Name           string    `json:"name"`
+	Email          string    `json:"email"`
+	Orders         int       `json:"orders"`
+	TotalSpend     float64   `json:"total_spend"`
+	FirstOrderDate time.Time `json:"first_order_date"`
+	LastOrderDate  time.Time `json:"last_order_date"`
+}
+
+type CustomerValuePage struct {
+	Customers []CustomerValue `json:"customers"`
+	Page      int             `json:"page"`
+	Limit     int             `json:"limit"`
+	Total     int             `json:"total"`
+}
+
+// CustomerCohort is the customers whose first paid order was in Month, and how they kept
+// buying in the months after
+type CustomerCohort struct {
+	Month     time.Time `json:"month"`
+	Customers int       `json:"customers"`
+	Orders    int       `json:"orders"`
+	Revenue   float64   `json:"revenue"`
+	// AverageLifetimeValue is the cohort's revenue per customer
+	AverageLifetimeValue float64 `json:"average_lifetime_value"`
+	// Months are the cohort's purchases by months since its first month, which is 0
+	Months []CohortMonth `json:"months"`
+}
+
+// CohortMonth is a cohort's purchases in one month
+type CohortMonth struct {
+	Offset          int     `json:"offset"`
+	ActiveCustomers int     `json:"active_customers"`
+	Orders          int     `json:"orders"`
+	Revenue         float64 `json:"revenue"`
+}
+
+// ProductSales is a product's place in the product report
+type ProductSales struct {
+	Rank      int     `json:"rank"`
+	ProductID int     `json:"product_id"`
+	SKU       string  `json:"sku,omitempty"`
+	Name      string  `json:"product_name"`
+	Units     int     `json:"units"`
+	Revenue   float64 `json:"revenue"`
+	Stock     int     `json:"stock"`
+}
+
+// TaxReport is the tax collected in a filing period, by where it was charged
+type TaxReport struct {
+	// Period is the period as requested, e.g. 2024-01, 2024-Q1 or 2024
+	Period        string            `json:"period"`
+	From          time.Time         `json:"from"`
+	To            time.Time         `json:"to"`
+	Currency      string            `json:"currency"`
+	Jurisdictions []TaxJurisdiction `json:"jurisdictions"`
+	Tax           float64           `json:"tax"`
+	RefundedTax   float64           `json:"refunded_tax"`
+	NetTax        float64           `json:"net_tax"`
+}
+
+// TaxJurisdiction is the tax charged at one rate in a country or one of its regions. Country is
+// empty for orders placed without a shipping address or pickup location.
+type TaxJurisdiction struct {
+	Country string  `json:"country"`
+	Region  string  `json:"region"`
+	TaxRate float64 `json:"tax_rate"`
+	Orders  int     `json:"orders"`
+	// TaxableAmount adds up the subtotals tax was charged on
+	TaxableAmount float64 `json:"taxable_amount"`
+	Tax           float64 `json:"tax"`
+	// RefundedTax is the share of the tax refunded along with the orders' totals
+	RefundedTax float64 `json:"refunded_tax"`
+	NetTax      float64 `json:"net_tax"`
+}
+
+// DateRange limits a report or export to orders placed between From and To; nil bounds are open
+type DateRange struct {
+	From *time.Time
+	To   *time.Time
+}
+
+// ADMIN REPORTS
+// AdminInventoryForecastHandler ranks products by how soon they run out, based on the units
+// sold over the last `days` days. Products that run out within `lead_time` days are flagged.
+func AdminInventoryForecastHandler(w http.ResponseWriter, r *http.Request) {
+	windowDays, err := parseDaysParam(r, "days", defaultForecastWindowDays)
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	leadDays, err := parseDaysParam(r, "lead_time", defaultForecastLeadDays)
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+
+	forecasts, err := getInventoryForecast(r.Context(), windowDays, leadDays)
+	if err != nil {
+		log.Println("Error computing inventory forecast:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, forecasts)
+}
+
+// AdminSalesReportHandler totals the revenue of the orders placed in the range per day, week or
+// month, as JSON or downloaded as CSV or XLSX, or uploaded with delivery=link. Orders that are pending, awaiting payment or
+// cancelled brought in no revenue and are left out.
+func AdminSalesReportHandler(w http.ResponseWriter, r *http.Request) {
+	groupBy := r.URL.Query().Get("group_by")
+	if groupBy == "" {
+		groupBy = "day"
+	}
+	if !salesReportPeriods[groupBy] {
+		handlers.WriteFieldError(w, "group_by", "group_by must be one of day, week, month")
+		return
+	}
+	dateRange, err := parseDateRange(r)
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	options, err := parseReportOptions(r)
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+
+	buckets, err := getSalesReport(r.Context(), groupBy, dateRange)
+	if err != nil {
+		log.Println("Error computing sales report:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if options.Format == "" && !options.Link {
+		handlers.WriteJSON(w, http.StatusOK, buckets)
+		return
+	}
+	writeReport(w, r, options, "sales", dateRange, func(writer reportWriter) error {
+		return writeSalesReport(writer, buckets)
+	})
+}
+
+func writeSalesReport(writer reportWriter, buckets []SalesReportBucket) error {
+	if err := writer.Write([]interface{}{"Period", "Orders", "Revenue", "Average Order Value"}); err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		if err := writer.Write([]interface{}{bucket.Period, bucket.Orders, bucket.Revenue, bucket.AverageOrderValue}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AdminProductReportHandler ranks products by the units sold or the revenue they brought in
+// over the last `period` days, best sellers first or, with order=asc, slow movers first.
+// Products that didn't sell at all are included, so slow movers show up.
+func AdminProductReportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	metric := query.Get("metric")
+	if metric == "" {
+		metric = "units"
+	}
+	if _, ok := productReportMetrics[metric]; !ok {
+		handlers.WriteFieldError(w, "metric", "metric must be units or revenue")
+		return
+	}
+	ascending := false
+	switch query.Get("order") {
+	case "", "desc":
+	case "asc":
+		ascending = true
+	default:
+		handlers.WriteFieldError(w, "order", "order must be asc or desc")
+		return
+	}
+	days, err := parseDaysParam(r, "period", defaultProductReportDays)
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	limit := defaultProductPageSize
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxProductPageSize {
+			handlers.WriteValidationError(w, handlers.NewFieldError("limit", "limit must be between 1 and "+strconv.Itoa(maxProductPageSize)))
+			return
+		}
+	}
+
+	products, err := getProductReport(r.Context(), metric, ascending, days, limit)
+	if err != nil {
+		log.Println("Error computing product report:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, products)
+}
+
+// AdminCustomerReportHandler lists customers by their lifetime value, or with group_by=cohort
+// groups them into monthly cohorts by their first order. Only paid orders count.
+func AdminCustomerReportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch query.Get("group_by") {
+	case "cohort":
+		cohorts, err := getCustomerCohorts(r.Context())
+		if err != nil {
+			log.Println("Error computing customer cohorts:", err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		handlers.WriteJSON(w, http.StatusOK, cohorts)
+		return
+	case "":
+	default:
+		handlers.WriteFieldError(w, "group_by", "group_by must be cohort")
+		return
+	}
+
+	sort := query.Get("sort")
+	if _, ok := customerReportSortColumns[sort]; !ok {
+		handlers.WriteFieldError(w, "sort", "sort must be one of spend, orders, recent")
+		return
+	}
+	page, limit := 1, defaultProductPageSize
+	if v := query.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			handlers.WriteFieldError(w, "page", "page must be a positive integer")
+			return
+		}
+		page = n
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxProductPageSize {
+			handlers.WriteValidationError(w, handlers.NewFieldError("limit", "limit must be between 1 and "+strconv.Itoa(maxProductPageSize)))
+			return
+		}
+		limit = n
+	}
+
+	customers, err := getCustomerValues(r.Context(), sort, page, limit)
+	if err != nil {
+		log.Println("Error computing customer report:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, customers)
+}
+
+// AdminTaxReportHandler sums up the tax of the orders placed in a month, quarter or year by
+// country, region and rate, from the amounts recorded when each order was placed. Orders that
+// are pending, awaiting payment or cancelled collected no tax and are left out.
+func AdminTaxReportHandler(w http.ResponseWriter, r *http.Request) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = time.Now().UTC().Format("2006-01")
+	}
+	dateRange, err := parseTaxPeriod(period)
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	options, err := parseReportOptions(r)
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+
+	report, err := getTaxReport(r.Context(), dateRange)
+	if err != nil {
+		log.Println("Error computing tax report:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	report.Period = period
+
+	if options.Format == "" && !options.Link {
+		handlers.WriteJSON(w, http.StatusOK, report)
+		return
+	}
+	writeReport(w, r, options, "tax", dateRange, func(writer reportWriter) error {
+		if err := writer.Write([]interface{}{"Country", "Region", "Tax Rate", "Orders", "Taxable Amount", "Tax", "Refunded Tax", "Net Tax"}); err != nil {
+			return err
+		}
+		for _, j := range report.Jurisdictions {
+			// Rates keep their precision; the writers round floats to cents
+			err := writer.Write([]interface{}{j.Country, j.Region, strconv.FormatFloat(j.TaxRate, 'f', -1, 64), j.Orders, j.TaxableAmount, j.Tax, j.RefundedTax, j.NetTax})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// parseTaxPeriod reads a filing period, a month (2024-01), quarter (2024-Q1) or year (2024),
+// as the range from its first to its last moment in UTC
+func parseTaxPeriod(period string) (DateRange, error) {
+	var from, to time.Time
+	if t, err := time.Parse("2006-01", period); err == nil {
+		from, to = t, t.AddDate(0, 1, 0)
+	} else if t, err := time.Parse("2006", period); err == nil {
+		from, to = t, t.AddDate(1, 0, 0)
+	} else if year, quarter, ok := strings.Cut(period, "-Q"); ok && len(quarter) == 1 && quarter >= "1" && quarter <= "4" {
+		t, err := time.Parse("2006", year)
+		if err != nil {
+			return DateRange{}, errInvalidTaxPeriod
+		}
+		from = t.AddDate(0, 3*int(quarter[0]-'1'), 0)
+		to = from.AddDate(0, 3, 0)
+	} else {
+		return DateRange{}, errInvalidTaxPeriod
+	}
+	to = to.Add(-time.Nanosecond)
+	return DateRange{From: &from, To: &to}, nil
+}
+
+func parseDaysParam(r *http.Request, name string, defaultDays int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return defaultDays, nil
+	}
+	days, err := strconv.Atoi(v)
+	if err != nil || days < 1 || days > 365 {
+		return 0, errors.New(name + " must be between 1 and 365")
+	}
+	return days, nil
+}
+
+func parseDateRange(r *http.Request) (DateRange, error) {
+	var dateRange DateRange
+	query := r.URL.Query()
+	if v := query.Get("from"); v != "" {
+		from, err := parseDateParam(v, false)
+		if err != nil {
+			return dateRange, handlers.NewFieldError("from", "from must be a date (YYYY-MM-DD) or an RFC 3339 timestamp")
+		}
+		dateRange.From = &from
+	}
+	if v := query.Get("to"); v != "" {
+		to, err := parseDateParam(v, true)
+		if err != nil {
+			return dateRange, handlers.NewFieldError("to", "to must be a date (YYYY-MM-DD) or an RFC 3339 timestamp")
+		}
+		dateRange.To = &to
+	}
+	if dateRange.From != nil && dateRange.To != nil && dateRange.From.After(*dateRange.To) {
+		return dateRange, handlers.NewFieldError("from", "from must not be after to")
+	}
+	return dateRange, nil
+}
+
+// filename names the download after the range, e.g. orders-2024-01-01-to-2024-01-31.csv
+func (d DateRange) filename(name, extension string) string {
+	if d.From != nil {
+		name += "-" + d.From.Format("2006-01-02")
+	}
+	if d.To != nil {
+		name += "-to-" + d.To.Format("2006-01-02")
+	}
+	return name + "." + extension
+}
+
+// getInventoryForecast measures sales from the stock ledger: units taken by orders and
+// checkout reservations and order edits, minus reservations that expired unused and cancelled orders
+func getInventoryForecast(ctx context.Context, windowDays, leadDays int) ([]InventoryForecast, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.id, COALESCE(p.sku, ''), p.name, p.stock, COALESCE(sold.units, 0)
+		FROM products p
+		LEFT JOIN (
+			SELECT product_id, -SUM(change) AS units
+			FROM stock_movements
+			WHERE reason IN ($1, $2, $3, $4, $5) AND created_at >= NOW() - make_interval(days => $6)
+			GROUP BY product_id
+		) sold ON sold.product_id = p.id
+		ORDER BY
+			CASE WHEN COALESCE(sold.units, 0) > 0 THEN p.stock::float / sold.units END ASC NULLS LAST,
+			p.id
+	`, stockReasonOrder, stockReasonReservation, stockReasonReservationReleased, stockReasonOrderCancelled, stockReasonOrderEdited, windowDays)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	forecasts := make([]InventoryForecast, 0)
+	for rows.Next() {
+		var forecast InventoryForecast
+		if err := rows.Scan(&forecast.ProductID, &forecast.SKU, &forecast.Name, &forecast.Stock, &forecast.UnitsSold); err != nil {
+			return nil, err
+		}
+
+		forecast.DailyVelocity = float64(forecast.UnitsSold) / float64(windowDays)
+		if forecast.UnitsSold > 0 {
+			days := float64(forecast.Stock) / forecast.DailyVelocity
+			forecast.DaysRemaining = &days
+			forecast.Reorder = days < float64(leadDays)
+		}
+		forecasts = append(forecasts, forecast)
+	}
+
+	return forecasts, rows.Err()
+}
+
+// getSalesReport groups the range's revenue by the period, which must be one of
+// salesReportPeriods. Periods without orders are left out.
+func getSalesReport(ctx context.Context, groupBy string, dateRange DateRange) ([]SalesReportBucket, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT date_trunc($1, date) AS period, COUNT(*), COALESCE(SUM(total), 0), COALESCE(AVG(total), 0)
+		FROM orders
+		WHERE status NOT IN ($2, $3, $4)
+			AND ($5::timestamp IS NULL OR date >= $5) AND ($6::timestamp IS NULL OR date <= $6)
+		GROUP BY period
+		ORDER BY period
+	`, groupBy, orderStatusPending, orderStatusAwaitingPayment, orderStatusCancelled, dateRange.From, dateRange.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := make([]SalesReportBucket, 0)
+	for rows.Next() {
+		var bucket SalesReportBucket
+		if err := rows.Scan(&bucket.Period, &bucket.Orders, &bucket.Revenue, &bucket.AverageOrderValue); err != nil {
+			return nil, err
+		}
+		bucket.Revenue = roundCents(bucket.Revenue)
+		bucket.AverageOrderValue = roundCents(bucket.AverageOrderValue)
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets, rows.Err()
+}
+
+// getProductReport ranks every product by the metric, one of productReportMetrics, over the
+// orders of the last days that were paid. Quantities and prices come from the order lines, so
+// later price changes don't alter past revenue.
+func getProductReport(ctx context.Context, metric string, ascending bool, days, limit int) ([]ProductSales, error) {
+	direction := "DESC"
+	if ascending {
+		direction = "ASC"
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT RANK() OVER (ORDER BY `+productReportMetrics[metric]+` DESC),
+			   p.id, COALESCE(p.sku, ''), p.name, COALESCE(sold.units, 0), COALESCE(sold.revenue, 0), p.stock
+		FROM products p
+		LEFT JOIN (
+			SELECT op.product_id, SUM(op.quantity) AS units,
+				   SUM(COALESCE(op.unit_price_at_purchase, v.price, pp.price) * op.quantity) AS revenue
+			FROM order_products op
+			JOIN orders o ON o.id = op.order_id
+			JOIN products pp ON pp.id = op.product_id
+			LEFT JOIN product_variants v ON v.id = op.variant_id
+			WHERE o.date >= $1 AND o.status NOT IN ($2, $3, $4)
+			GROUP BY op.product_id
+		) sold ON sold.product_id = p.id
+		ORDER BY `+productReportMetrics[metric]+` `+direction+`, p.id
+		LIMIT $5
+	`, time.Now().AddDate(0, 0, -days), orderStatusPending, orderStatusAwaitingPayment, orderStatusCancelled, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := make([]ProductSales, 0)
+	for rows.Next() {
+		var product ProductSales
+		if err := rows.Scan(&product.Rank, &product.ProductID, &product.SKU, &product.Name, &product.Units, &product.Revenue, &product.Stock); err != nil {
+			return nil, err
+		}
+		product.Revenue = roundCents(product.Revenue)
+		products = append(products, product)
+	}
+
+	return products, rows.Err()
+}
+
+// getCustomerValues returns one page of the customers with paid orders, in the sort's order
+func getCustomerValues(ctx context.Context, sort string, page, limit int) (*CustomerValuePage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.id, c.name, c.email, COUNT(*) AS order_count, COALESCE(SUM(o.total), 0) AS total_spend,
+			   MIN(o.date), MAX(o.date) AS last_order, COUNT(*) OVER ()
+		FROM customers c
+		JOIN orders o ON o.customer_id = c.id
+		WHERE o.status NOT IN ($1, $2, $3)
+		GROUP BY c.id
+		ORDER BY `+customerReportSortColumns[sort]+`
+		LIMIT $4 OFFSET $5
+	`, orderStatusPending, orderStatusAwaitingPayment, orderStatusCancelled, limit, (page-1)*limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &CustomerValuePage{Customers: make([]CustomerValue, 0), Page: page, Limit: limit}
+	for rows.Next() {
+		var customer CustomerValue
+		if err := rows.Scan(&customer.CustomerID, &customer.Name, &customer.Email, &customer.Orders, &customer.TotalSpend,
+			&customer.FirstOrderDate, &customer.LastOrderDate, &result.Total); err != nil {
+			return nil, err
+		}
+		customer.TotalSpend = roundCents(customer.TotalSpend)
+		result.Customers = append(result.Customers, customer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// A page past the end has no rows to carry the total
+	if len(result.Customers) == 0 && page > 1 {
+		err = db.QueryRowContext(ctx, `
+			SELECT COUNT(DISTINCT customer_id) FROM orders WHERE status NOT IN ($1, $2, $3)
+		`, orderStatusPending, orderStatusAwaitingPayment, orderStatusCancelled).Scan(&result.Total)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// getCustomerCohorts groups customers by the month of their first paid order, oldest cohort
+// first, with the purchases of each month after it
+func getCustomerCohorts(ctx context.Context) ([]CustomerCohort, error) {
+	rows, err := db.QueryContext(ctx, `
+		WITH paid AS (
+			SELECT customer_id, date_trunc('month', date) AS month, COALESCE(total, 0) AS total
+			FROM orders
+			WHERE status NOT IN ($1, $2, $3)
+		), cohorts AS (
+			SELECT customer_id, MIN(month) AS cohort FROM paid GROUP BY customer_id
+		)
+		SELECT c.cohort,
+			   ((EXTRACT(YEAR FROM p.month) - EXTRACT(YEAR FROM c.cohort)) * 12
+				+ EXTRACT(MONTH FROM p.month) - EXTRACT(MONTH FROM c.cohort))::int AS offset_months,
+			   COUNT(DISTINCT p.customer_id), COUNT(*), SUM(p.total)
+		FROM paid p
+		JOIN cohorts c ON c.customer_id = p.customer_id
+		GROUP BY c.cohort, offset_months
+		ORDER BY c.cohort, offset_months
+	`, orderStatusPending, orderStatusAwaitingPayment, orderStatusCancelled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cohorts := make([]CustomerCohort, 0)
+	for rows.Next() {
+		var cohortMonth time.Time
+		var month CohortMonth
+		if err := rows.Scan(&cohortMonth, &month.Offset, &month.ActiveCustomers, &month.Orders, &month.Revenue); err != nil {
+			return nil, err
+		}
+		month.Revenue = roundCents(month.Revenue)
+
+		// Every customer of a cohort bought in its first month, which comes first
+		if len(cohorts) == 0 || !cohorts[len(cohorts)-1].Month.Equal(cohortMonth) {
+			cohorts = append(cohorts, CustomerCohort{Month: cohortMonth, Customers: month.ActiveCustomers, Months: make([]CohortMonth, 0)})
+		}
+		cohort := &cohorts[len(cohorts)-1]
+		cohort.Orders += month.Orders
+		cohort.Revenue += month.Revenue
+		cohort.Months = append(cohort.Months, month)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range cohorts {
+		cohorts[i].Revenue = roundCents(cohorts[i].Revenue)
+		cohorts[i].AverageLifetimeValue = roundCents(cohorts[i].Revenue / float64(cohorts[i].Customers))
+	}
+	return cohorts, nil
+}
+
+// getTaxReport groups the tax of the orders placed in the range by where it was charged: the
+// pickup location of pickup orders, the shipping address of the others. Refunds are split
+// between tax and the rest in proportion to the order's total.
+func getTaxReport(ctx context.Context, dateRange DateRange) (*TaxReport, error) {
+	rows, err := db.QueryContext(ctx, `
+		WITH taxed AS (
+			SELECT COALESCE(o.tax_rate, 0) AS tax_rate, COALESCE(o.subtotal, 0) AS subtotal,
+				   COALESCE(o.tax, 0) AS tax, COALESCE(o.total, 0) AS total,
+				   UPPER(COALESCE(CASE WHEN o.pickup_location_id IS NOT NULL THEN pl.country ELSE a.country END, '')) AS country,
+				   UPPER(COALESCE(CASE WHEN o.pickup_location_id IS NOT NULL THEN pl.region ELSE a.region END, '')) AS region,
+				   (SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE order_id = o.id AND status = $4) AS refunded
+			FROM orders o
+			LEFT JOIN order_addresses a ON a.order_id = o.id AND a.type = $5
+			LEFT JOIN pickup_locations pl ON pl.id = o.pickup_location_id
+			WHERE o.status NOT IN ($1, $2, $3) AND o.date >= $6 AND o.date <= $7
+		)
+		SELECT country, region, tax_rate, COUNT(*), SUM(subtotal), SUM(tax),
+			   SUM(CASE WHEN total > 0 THEN tax * LEAST(refunded / total, 1) ELSE 0 END)
+		FROM taxed
+		GROUP BY country, region, tax_rate
+		ORDER BY country, region, tax_rate
+	`, orderStatusPending, orderStatusAwaitingPayment, orderStatusCancelled, refundStatusSucceeded, addressTypeShipping,
+		dateRange.From, dateRange.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &TaxReport{From: *dateRange.From, To: *dateRange.To, Currency: paymentConfig.Currency, Jurisdictions: make([]TaxJurisdiction, 0)}
+	for rows.Next() {
+		var j TaxJurisdiction
+		if err := rows.Scan(&j.Country, &j.Region, &j.TaxRate, &j.Orders, &j.TaxableAmount, &j.Tax, &j.RefundedTax); err != nil {
+			return nil, err
+		}
+		j.TaxableAmount = roundCents(j.TaxableAmount)
+		j.Tax = roundCents(j.Tax)
+		j.RefundedTax = roundCents(j.RefundedTax)
+		j.NetTax = roundCents(j.Tax - j.RefundedTax)
+		report.Jurisdictions = append(report.Jurisdictions, j)
+		report.Tax += j.Tax
+		report.RefundedTax += j.RefundedTax
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report.Tax = roundCents(report.Tax)
+	report.RefundedTax = roundCents(report.RefundedTax)
+	report.NetTax = roundCents(report.Tax - report.RefundedTax)
+	return report, nil
+}
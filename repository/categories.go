@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/hanifmasy/simple-commerce/models"
+)
+
+type CategoryRepository interface {
+	// List returns every category by name
+	List(ctx context.Context) ([]models.Category, error)
+	Exists(ctx context.Context, categoryID int) (bool, error)
+	Create(ctx context.Context, req models.CategoryRequest) (int, error)
+	// Update returns ErrNotFound for a category that doesn't exist
+	Update(ctx context.Context, categoryID int, req models.CategoryRequest) error
+	// Delete returns ErrNotFound for a category that doesn't exist, and ErrInUse for one that
+	// still has subcategories or products
+	Delete(ctx context.Context, categoryID int) error
+	// Descendants returns the category ID followed by the IDs of all its subcategories
+	Descendants(ctx context.Context, categoryID int) ([]int, error)
+}
+
+type postgresCategoryRepository struct {
+	db *sql.DB
+}
+
+func NewCategoryRepository(db *sql.DB) CategoryRepository {
+	return &postgresCategoryRepository{db: db}
+}
+
+func (r *postgresCategoryRepository) List(ctx context.Context) ([]models.Category, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT id, name, parent_id FROM categories ORDER BY name, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := make([]models.Category, 0)
+	for rows.Next() {
+		var category models.Category
+		if err := rows.Scan(&category.ID, &category.Name, &category.ParentID); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+
+	return categories, rows.Err()
+}
+
+func (r *postgresCategoryRepository) Exists(ctx context.Context, categoryID int) (bool, error) {
+	var exists bool
+	err := r.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM categories WHERE id = $1)", categoryID).Scan(&exists)
+	return exists, err
+}
+
+func (r *postgresCategoryRepository) Create(ctx context.Context, req models.CategoryRequest) (int, error) {
+	var categoryID int
+	err := r.db.QueryRowContext(ctx, "INSERT INTO categories (name, parent_id) VALUES ($1, $2) RETURNING id",
+		req.Name, req.ParentID).Scan(&categoryID)
+	return categoryID, err
+}
+
+func (r *postgresCategoryRepository) Update(ctx context.Context, categoryID int, req models.CategoryRequest) error {
+	err := r.db.QueryRowContext(ctx, "UPDATE categories SET name = $1, parent_id = $2 WHERE id = $3 RETURNING id",
+		req.Name, req.ParentID, categoryID).Scan(&categoryID)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (r *postgresCategoryRepository) Delete(ctx context.Context, categoryID int) error {
+	err := r.db.QueryRowContext(ctx, "DELETE FROM categories WHERE id = $1 RETURNING id", categoryID).Scan(&categoryID)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if isForeignKeyViolation(err) {
+		return ErrInUse
+	}
+	return err
+}
+
+func (r *postgresCategoryRepository) Descendants(ctx context.Context, categoryID int) ([]int, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		WITH RECURSIVE tree AS (
+			SELECT id FROM categories WHERE id = $1
+			UNION
+			SELECT c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+		)
+		SELECT id FROM tree
+	`, categoryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
@@ -0,0 +1,22 @@
+// Package repository reads and writes the database. Each repository is an interface with a
+// Postgres implementation, so the service layer can be tested against fakes instead.
+package repository
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// Errors repositories return in place of the database's
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrInUse is returned when other rows still refer to the row being deleted
+	ErrInUse = errors.New("still in use")
+)
+
+// isForeignKeyViolation reports whether err is a Postgres foreign key violation
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
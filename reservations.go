@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errInsufficientStock = errors.New("not enough stock")
+var errReservationNotFound = errors.New("reservation has expired or does not exist")
+var errReservationMismatch = errors.New("order products do not match the reservation")
+
+// Reservation holds stock for a checkout until the order is placed or ExpiresAt passes
+type Reservation struct {
+	Token     string      `json:"reservation_token"`
+	ExpiresAt time.Time   `json:"expires_at"`
+	Units     map[int]int `json:"units"`
+}
+
+// CHECKOUT
+// CheckoutHandler starts a checkout by reserving stock for the order lines.
+// The returned token is passed to /place-order as reservation_token.
+func CheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	var orderRequest OrderRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &orderRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	orderRequest.CustomerID = getCustomerID(r)
+	orderRequest.Products = normalizeOrderLines(orderRequest.Products)
+	if err := validateOrderRequest(r.Context(), &orderRequest); err != nil {
+		if isOrderValidationError(err) {
+			handlers.WriteValidationError(w, err)
+			return
+		}
+		log.Println("Error validating order:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	reservation, err := createReservation(r.Context(), orderRequest.CustomerID, orderRequest.Products)
+	if errors.Is(err, errInsufficientStock) {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error reserving stock:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, reservation)
+}
+
+// orderUnits counts the units of each product on the order lines
+func orderUnits(lines []OrderLineRequest) map[int]int {
+	units := make(map[int]int)
+	for _, line := range lines {
+		units[line.ProductID] += line.Quantity
+	}
+	return units
+}
+
+// takeStock decrements stock for every product, failing if any product has too few units.
+// The product rows are locked with SELECT ... FOR UPDATE in ID order before anything is
+// checked, so concurrent orders wait for each other instead of both taking the last unit,
+// and can't deadlock by locking the same products in a different order.
+func takeStock(ctx context.Context, tx *sql.Tx, units map[int]int, reason string, orderID *int) error {
+	productIDs := make([]int, 0, len(units))
+	for productID := range units {
+		productIDs = append(productIDs, productID)
+	}
+	sort.Ints(productIDs)
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, stock FROM products WHERE id = ANY($1) ORDER BY id FOR UPDATE", pq.Array(productIDs))
+	if err != nil {
+		return err
+	}
+	available := make(map[int]int)
+	for rows.Next() {
+		var productID, stock int
+		if err := rows.Scan(&productID, &stock); err != nil {
+			rows.Close()
+			return err
+		}
+		available[productID] = stock
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var shortages []string
+	for _, productID := range productIDs {
+		if available[productID] < units[productID] {
+			shortages = append(shortages, fmt.Sprintf("product %d (requested %d, available %d)", productID, units[productID], available[productID]))
+		}
+	}
+	if len(shortages) > 0 {
+		return fmt.Errorf("%w for %s", errInsufficientStock, strings.Join(shortages, ", "))
+	}
+
+	for _, productID := range productIDs {
+		if _, err := adjustStock(ctx, tx, productID, -units[productID], reason, orderID, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createReservation(ctx context.Context, customerID int, lines []OrderLineRequest) (*Reservation, error) {
+	token, err := generateToken(32)
+	if err != nil {
+		return nil, err
+	}
+	reservation := &Reservation{
+		Token:     token,
+		ExpiresAt: time.Now().Add(inventoryConfig.ReservationTTL),
+		Units:     orderUnits(lines),
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := takeStock(ctx, tx, reservation.Units, stockReasonReservation, nil); err != nil {
+		return nil, err
+	}
+
+	for productID, quantity := range reservation.Units {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO stock_reservations (token_hash, customer_id, product_id, quantity, expires_at)
+			VALUES ($1, $2, $3, $4, $5)
+		`, hashToken(token), customerID, productID, quantity, reservation.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+// consumeReservation turns the customer's reservation into sold stock. The reserved units
+// must match the order lines exactly; on error the caller rolls back and the reservation stays.
+func consumeReservation(ctx context.Context, tx *sql.Tx, customerID int, token string, lines []OrderLineRequest) error {
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM stock_reservations
+		WHERE token_hash = $1 AND customer_id = $2 AND expires_at > NOW()
+		RETURNING product_id, quantity
+	`, hashToken(token), customerID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	reserved := make(map[int]int)
+	for rows.Next() {
+		var productID, quantity int
+		if err := rows.Scan(&productID, &quantity); err != nil {
+			return err
+		}
+		reserved[productID] = quantity
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(reserved) == 0 {
+		return errReservationNotFound
+	}
+
+	units := orderUnits(lines)
+	if len(units) != len(reserved) {
+		return errReservationMismatch
+	}
+	for productID, quantity := range units {
+		if reserved[productID] != quantity {
+			return errReservationMismatch
+		}
+	}
+	return nil
+}
+
+// releaseExpiredReservations returns the stock of abandoned checkouts
+func releaseExpiredReservations(ctx context.Context) {
+	_, err := db.ExecContext(ctx, `
+		WITH expired AS (
+			DELETE FROM stock_reservations
+			WHERE expires_at <= NOW()
+			RETURNING product_id, quantity
+		), released AS (
+			SELECT product_id, SUM(quantity) AS quantity
+			FROM expired
+			GROUP BY product_id
+		), updated AS (
+			UPDATE products p
+			SET stock = p.stock + released.quantity
+			FROM released
+			WHERE p.id = released.product_id
+			RETURNING p.id, released.quantity, p.stock
+		)
+		INSERT INTO stock_movements (product_id, change, stock_after, reason)
+		SELECT id, quantity, stock, $1
+		FROM updated
+	`, stockReasonReservationReleased)
+	if err != nil {
+		log.Println("Error releasing expired reservations:", err)
+	}
+}
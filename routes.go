@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// apiV1Prefix is where version 1 of the API is mounted. A version that changes response shapes
+// is mounted beside it with its own registerVnRoutes, reusing the handlers that don't change.
+const apiV1Prefix = "/api/v1"
+
+// newRouter mounts each API version under its prefix, and version 1 once more at the unversioned
+// paths it was served at before versioning, which are deprecated
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+	registerV1Routes(r.PathPrefix(apiV1Prefix).Subrouter())
+	r.HandleFunc("/openapi.json", OpenAPIHandler).Methods("GET")
+	// GraphQL evolves its schema in place of versioning it
+	r.HandleFunc("/graphql", RateLimitMiddleware(GraphQLHandler)).Methods("POST")
+	if apiDocsConfig.SwaggerUI {
+		r.HandleFunc("/docs", SwaggerUIHandler).Methods("GET")
+	}
+
+	legacy := r.NewRoute().Subrouter()
+	legacy.Use(deprecatedAliasMiddleware(apiV1Prefix))
+	registerV1Routes(legacy)
+
+	r.NotFoundHandler = http.HandlerFunc(NotFoundHandler)
+	r.MethodNotAllowedHandler = http.HandlerFunc(MethodNotAllowedHandler)
+	return r
+}
+
+// deprecatedAliasMiddleware marks responses of the unversioned paths as deprecated, linking to
+// the same path under prefix
+func deprecatedAliasMiddleware(prefix string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			successor := prefix + r.URL.Path
+			if r.URL.RawQuery != "" {
+				successor += "?" + r.URL.RawQuery
+			}
+			w.Header().Set("Deprecation", "true")
+			w.Header().Add("Link", "<"+successor+`>; rel="successor-version"`)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// registerV1Routes adds the routes of version 1 of the API to r
+func registerV1Routes(r *mux.Router) {
+	categories := newCategoryHandlers()
+
+	r.HandleFunc("/register", RateLimitMiddleware(RegisterHandler)).Methods("POST")
+	r.HandleFunc("/login", RateLimitMiddleware(LoginHandler)).Methods("POST")
+	r.HandleFunc("/password-reset/request", RateLimitMiddleware(PasswordResetRequestHandler)).Methods("POST")
+	r.HandleFunc("/password-reset/confirm", RateLimitMiddleware(PasswordResetConfirmHandler)).Methods("POST")
+	r.HandleFunc("/token/refresh", RateLimitMiddleware(RefreshTokenHandler)).Methods("POST")
+	r.HandleFunc("/token/revoke", RateLimitMiddleware(RevokeTokenHandler)).Methods("POST")
+	r.HandleFunc("/auth/google", GoogleLoginHandler).Methods("GET")
+	r.HandleFunc("/auth/google/callback", RateLimitMiddleware(GoogleCallbackHandler)).Methods("GET")
+	r.HandleFunc("/webhooks/payments", PaymentWebhookHandler).Methods("POST")
+	r.HandleFunc("/webhooks/shipping", ShippingWebhookHandler).Methods("POST")
+	r.HandleFunc("/webhooks/email", EmailEventsHandler).Methods("POST")
+	r.HandleFunc("/payment-methods", RateLimitMiddleware(PaymentMethodsHandler)).Methods("GET")
+	r.HandleFunc("/products", RateLimitMiddleware(OptionalAuthMiddleware(ProductsHandler, PermPlaceOrder))).Methods("GET")
+	r.HandleFunc("/products/search", RateLimitMiddleware(OptionalAuthMiddleware(ProductSearchHandler, PermPlaceOrder))).Methods("GET")
+	r.HandleFunc("/products/{id:[0-9]+}/availability", RateLimitMiddleware(ProductAvailabilityHandler)).Methods("GET")
+	r.HandleFunc("/products/{id:[0-9]+}/related", RateLimitMiddleware(RelatedProductsHandler)).Methods("GET")
+	r.HandleFunc("/categories", RateLimitMiddleware(categories.List)).Methods("GET")
+	r.HandleFunc("/pickup-locations", RateLimitMiddleware(PickupLocationsHandler)).Methods("GET")
+	r.HandleFunc("/checkout", RateLimitMiddleware(AuthMiddleware(CheckoutHandler, PermPlaceOrder))).Methods("POST")
+	r.HandleFunc("/place-order", RateLimitMiddleware(AuthMiddleware(PlaceOrderHandler, PermPlaceOrder))).Methods("POST")
+	r.HandleFunc("/cart", OptionalAuthMiddleware(CartHandler, PermPlaceOrder)).Methods("GET")
+	r.HandleFunc("/cart/items", OptionalAuthMiddleware(AddCartItemHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/cart/items/{itemID:[0-9]+}", OptionalAuthMiddleware(UpdateCartItemHandler, PermPlaceOrder)).Methods("PUT")
+	r.HandleFunc("/cart/items/{itemID:[0-9]+}", OptionalAuthMiddleware(DeleteCartItemHandler, PermPlaceOrder)).Methods("DELETE")
+	r.HandleFunc("/cart/items/{itemID:[0-9]+}/save-for-later", AuthMiddleware(SaveForLaterHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/wishlist", AuthMiddleware(WishlistHandler, PermPlaceOrder)).Methods("GET")
+	r.HandleFunc("/wishlist/items", AuthMiddleware(AddWishlistItemHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/wishlist/items/{itemID:[0-9]+}", AuthMiddleware(DeleteWishlistItemHandler, PermPlaceOrder)).Methods("DELETE")
+	r.HandleFunc("/wishlist/items/{itemID:[0-9]+}/move-to-cart", AuthMiddleware(MoveToCartHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/cart/quote", OptionalAuthMiddleware(CartQuoteHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/cart/validate", OptionalAuthMiddleware(ValidateCartHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/cart/apply-coupon", RateLimitMiddleware(OptionalAuthMiddleware(ApplyCouponHandler, PermPlaceOrder))).Methods("POST")
+	r.HandleFunc("/cart/coupon", OptionalAuthMiddleware(RemoveCouponHandler, PermPlaceOrder)).Methods("DELETE")
+	r.HandleFunc("/gift-cards/{code}", RateLimitMiddleware(GiftCardBalanceHandler)).Methods("GET")
+	r.HandleFunc("/carts", AuthMiddleware(CartsHandler, PermPlaceOrder)).Methods("GET")
+	r.HandleFunc("/carts", AuthMiddleware(CreateCartHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/carts/{cartID:[0-9]+}", AuthMiddleware(NamedCartHandler, PermPlaceOrder)).Methods("GET")
+	r.HandleFunc("/carts/{cartID:[0-9]+}", AuthMiddleware(RenameCartHandler, PermPlaceOrder)).Methods("PUT")
+	r.HandleFunc("/carts/{cartID:[0-9]+}", AuthMiddleware(DeleteNamedCartHandler, PermPlaceOrder)).Methods("DELETE")
+	r.HandleFunc("/carts/{cartID:[0-9]+}/activate", AuthMiddleware(ActivateCartHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/carts/{cartID:[0-9]+}/checkout", RateLimitMiddleware(AuthMiddleware(NamedCartCheckoutHandler, PermPlaceOrder))).Methods("POST")
+	r.HandleFunc("/cart/checkout", RateLimitMiddleware(AuthMiddleware(CartCheckoutHandler, PermPlaceOrder))).Methods("POST")
+	r.HandleFunc("/customer/orders", AuthMiddleware(CustomerOrdersHandler, PermViewOwnOrders)).Methods("GET")
+	r.HandleFunc("/customer/orders/{id:[0-9]+}/cancel", AuthMiddleware(CustomerCancelOrderHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/customer/orders/{id:[0-9]+}/payment", AuthMiddleware(CustomerPayOrderHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/customer/orders/{id:[0-9]+}/payment/capture", AuthMiddleware(CustomerCapturePaymentHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/customer/orders/{id:[0-9]+}/reorder", AuthMiddleware(CustomerReorderHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/customer/orders/{id:[0-9]+}/shipments", AuthMiddleware(CustomerOrderShipmentsHandler, PermViewOwnOrders)).Methods("GET")
+	r.HandleFunc("/customer/orders/{id:[0-9]+}/tracking", AuthMiddleware(CustomerOrderTrackingHandler, PermViewOwnOrders)).Methods("GET")
+	r.HandleFunc("/customer/orders/{id:[0-9]+}/invoice.pdf", AuthMiddleware(CustomerOrderInvoiceHandler, PermViewOwnOrders)).Methods("GET")
+	r.HandleFunc("/customer/addresses", AuthMiddleware(CustomerAddressesHandler, PermPlaceOrder)).Methods("GET")
+	r.HandleFunc("/customer/addresses", AuthMiddleware(CustomerCreateAddressHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/customer/addresses/{id:[0-9]+}", AuthMiddleware(CustomerUpdateAddressHandler, PermPlaceOrder)).Methods("PUT")
+	r.HandleFunc("/customer/addresses/{id:[0-9]+}", AuthMiddleware(CustomerDeleteAddressHandler, PermPlaceOrder)).Methods("DELETE")
+	r.HandleFunc("/customer/payment-methods", AuthMiddleware(CustomerPaymentMethodsHandler, PermPlaceOrder)).Methods("GET")
+	r.HandleFunc("/customer/payment-methods", AuthMiddleware(CustomerSavePaymentMethodHandler, PermPlaceOrder)).Methods("POST")
+	r.HandleFunc("/customer/payment-methods/{id:[0-9]+}", AuthMiddleware(CustomerDeletePaymentMethodHandler, PermPlaceOrder)).Methods("DELETE")
+	r.HandleFunc("/customer/gift-cards", AuthMiddleware(CustomerGiftCardsHandler, PermViewOwnOrders)).Methods("GET")
+	r.HandleFunc("/customer/loyalty-points", AuthMiddleware(CustomerLoyaltyPointsHandler, PermViewOwnOrders)).Methods("GET")
+	r.HandleFunc("/customer/referral", AuthMiddleware(CustomerReferralHandler, PermPlaceOrder)).Methods("GET")
+	r.HandleFunc("/customer/notification-preferences", AuthMiddleware(CustomerNotificationPreferencesHandler, PermPlaceOrder)).Methods("GET")
+	r.HandleFunc("/customer/notification-preferences", AuthMiddleware(CustomerUpdateNotificationPreferencesHandler, PermPlaceOrder)).Methods("PUT")
+	r.HandleFunc("/admin/orders", RateLimitMiddleware(AuthMiddleware(AdminOrdersHandler, PermViewAllOrders))).Methods("GET")
+	r.HandleFunc("/admin/orders/export", AuthMiddleware(AdminExportOrdersHandler, PermViewAllOrders)).Methods("GET")
+	r.HandleFunc("/admin/orders/bulk-status", AuthMiddleware(AdminBulkOrderStatusHandler, PermFulfillOrders)).Methods("POST")
+	r.HandleFunc("/admin/orders/{id:[0-9]+}", AuthMiddleware(AdminEditOrderHandler, PermFulfillOrders)).Methods("PATCH")
+	r.HandleFunc("/admin/orders/{id:[0-9]+}/mark-paid", AuthMiddleware(AdminMarkOrderPaidHandler, PermManagePayments)).Methods("POST")
+	r.HandleFunc("/admin/orders/{id:[0-9]+}/refund", AuthMiddleware(AdminRefundOrderHandler, PermRefundOrders)).Methods("POST")
+	r.HandleFunc("/admin/orders/{id:[0-9]+}/shipments", AuthMiddleware(AdminOrderShipmentsHandler, PermViewAllOrders)).Methods("GET")
+	r.HandleFunc("/admin/orders/{id:[0-9]+}/invoice.pdf", AuthMiddleware(AdminOrderInvoiceHandler, PermViewAllOrders)).Methods("GET")
+	r.HandleFunc("/admin/orders/{id:[0-9]+}/shipments", AuthMiddleware(AdminCreateShipmentHandler, PermFulfillOrders)).Methods("POST")
+	r.HandleFunc("/admin/orders/{id:[0-9]+}/ready-for-pickup", AuthMiddleware(AdminReadyForPickupHandler, PermFulfillOrders)).Methods("POST")
+	r.HandleFunc("/admin/shipments/{id:[0-9]+}/label", AuthMiddleware(AdminBuyShippingLabelHandler, PermFulfillOrders)).Methods("POST")
+	r.HandleFunc("/admin/products", AuthMiddleware(AdminCreateProductHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/products/import", AuthMiddleware(AdminImportProductsHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/products/{id:[0-9]+}", AuthMiddleware(AdminGetProductHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/products/{id:[0-9]+}", AuthMiddleware(AdminUpdateProductHandler, PermManageProducts)).Methods("PUT")
+	r.HandleFunc("/admin/products/{id:[0-9]+}", AuthMiddleware(AdminDeleteProductHandler, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/products/{id:[0-9]+}/variants", AuthMiddleware(AdminProductVariantsHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/products/{id:[0-9]+}/variants", AuthMiddleware(AdminCreateVariantHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/products/{id:[0-9]+}/variants/{variantID:[0-9]+}", AuthMiddleware(AdminUpdateVariantHandler, PermManageProducts)).Methods("PUT")
+	r.HandleFunc("/admin/products/{id:[0-9]+}/variants/{variantID:[0-9]+}", AuthMiddleware(AdminDeleteVariantHandler, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/products/{id:[0-9]+}/images", AuthMiddleware(AdminUploadProductImagesHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/products/{id:[0-9]+}/images/{imageID:[0-9]+}", AuthMiddleware(AdminDeleteProductImageHandler, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/products/{id:[0-9]+}/price-schedules", AuthMiddleware(AdminPriceSchedulesHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/products/{id:[0-9]+}/price-schedules", AuthMiddleware(AdminCreatePriceScheduleHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/products/{id:[0-9]+}/price-schedules/{scheduleID:[0-9]+}", AuthMiddleware(AdminDeletePriceScheduleHandler, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/products/{id:[0-9]+}/price-history", AuthMiddleware(AdminPriceHistoryHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/products/{id:[0-9]+}/warehouses/{warehouseID:[0-9]+}", AuthMiddleware(AdminSetWarehouseStockHandler, PermManageProducts)).Methods("PUT")
+	r.HandleFunc("/admin/products/{id:[0-9]+}/stock-adjustments", AuthMiddleware(AdminAdjustStockHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/stock-movements", AuthMiddleware(AdminStockMovementsHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/inventory/sync", AuthMiddleware(AdminInventorySyncHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/reports/reconciliation", AuthMiddleware(AdminReconciliationHandler, PermViewReports)).Methods("GET")
+	r.HandleFunc("/admin/reports/inventory-forecast", AuthMiddleware(AdminInventoryForecastHandler, PermViewReports)).Methods("GET")
+	r.HandleFunc("/admin/reports/sales", AuthMiddleware(AdminSalesReportHandler, PermViewReports)).Methods("GET")
+	r.HandleFunc("/admin/reports/products", AuthMiddleware(AdminProductReportHandler, PermViewReports)).Methods("GET")
+	r.HandleFunc("/admin/reports/customers", AuthMiddleware(AdminCustomerReportHandler, PermViewReports)).Methods("GET")
+	r.HandleFunc("/admin/reports/tax", AuthMiddleware(AdminTaxReportHandler, PermViewReports)).Methods("GET")
+	r.HandleFunc("/admin/dashboard", AuthMiddleware(AdminDashboardHandler, PermViewReports)).Methods("GET")
+	r.HandleFunc("/admin/report-subscriptions", AuthMiddleware(AdminReportSubscriptionsHandler, PermViewReports)).Methods("GET")
+	r.HandleFunc("/admin/report-subscriptions", AuthMiddleware(AdminCreateReportSubscriptionHandler, PermViewReports)).Methods("POST")
+	r.HandleFunc("/admin/report-subscriptions/{id:[0-9]+}", AuthMiddleware(AdminUpdateReportSubscriptionHandler, PermViewReports)).Methods("PUT")
+	r.HandleFunc("/admin/report-subscriptions/{id:[0-9]+}", AuthMiddleware(AdminDeleteReportSubscriptionHandler, PermViewReports)).Methods("DELETE")
+	r.HandleFunc("/admin/tax-rates", AuthMiddleware(AdminTaxRatesHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/tax-rates", AuthMiddleware(AdminSetTaxRateHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/tax-rates/{id:[0-9]+}", AuthMiddleware(AdminDeleteTaxRateHandler, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/shipping-zones", AuthMiddleware(AdminShippingZonesHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/shipping-zones", AuthMiddleware(AdminCreateShippingZoneHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/shipping-zones/{id:[0-9]+}", AuthMiddleware(AdminUpdateShippingZoneHandler, PermManageProducts)).Methods("PUT")
+	r.HandleFunc("/admin/shipping-zones/{id:[0-9]+}", AuthMiddleware(AdminDeleteShippingZoneHandler, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/shipping-zones/{id:[0-9]+}/rates", AuthMiddleware(AdminCreateShippingRateHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/shipping-rates/{id:[0-9]+}", AuthMiddleware(AdminUpdateShippingRateHandler, PermManageProducts)).Methods("PUT")
+	r.HandleFunc("/admin/shipping-rates/{id:[0-9]+}", AuthMiddleware(AdminDeleteShippingRateHandler, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/shipping-methods", AuthMiddleware(AdminShippingMethodsHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/shipping-methods", AuthMiddleware(AdminCreateShippingMethodHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/shipping-methods/{id:[0-9]+}", AuthMiddleware(AdminUpdateShippingMethodHandler, PermManageProducts)).Methods("PUT")
+	r.HandleFunc("/admin/shipping-methods/{id:[0-9]+}", AuthMiddleware(AdminDeleteShippingMethodHandler, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/coupons", AuthMiddleware(AdminCouponsHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/coupons", AuthMiddleware(AdminCreateCouponHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/coupons/{id:[0-9]+}", AuthMiddleware(AdminUpdateCouponHandler, PermManageProducts)).Methods("PUT")
+	r.HandleFunc("/admin/coupons/{id:[0-9]+}", AuthMiddleware(AdminDeleteCouponHandler, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/promotions", AuthMiddleware(AdminPromotionsHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/promotions", AuthMiddleware(AdminCreatePromotionHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/promotions/{id:[0-9]+}", AuthMiddleware(AdminUpdatePromotionHandler, PermManageProducts)).Methods("PUT")
+	r.HandleFunc("/admin/promotions/{id:[0-9]+}", AuthMiddleware(AdminDeletePromotionHandler, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/flash-sales", AuthMiddleware(AdminFlashSalesHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/flash-sales", AuthMiddleware(AdminCreateFlashSaleHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/flash-sales/{id:[0-9]+}", AuthMiddleware(AdminUpdateFlashSaleHandler, PermManageProducts)).Methods("PUT")
+	r.HandleFunc("/admin/flash-sales/{id:[0-9]+}", AuthMiddleware(AdminDeleteFlashSaleHandler, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/customer-groups", AuthMiddleware(AdminCustomerGroupsHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/customer-groups", AuthMiddleware(AdminCreateCustomerGroupHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/customer-groups/{id:[0-9]+}", AuthMiddleware(AdminUpdateCustomerGroupHandler, PermManageProducts)).Methods("PUT")
+	r.HandleFunc("/admin/customer-groups/{id:[0-9]+}", AuthMiddleware(AdminDeleteCustomerGroupHandler, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/gift-cards", AuthMiddleware(AdminGiftCardsHandler, PermManagePayments)).Methods("GET")
+	r.HandleFunc("/admin/gift-cards", AuthMiddleware(AdminIssueGiftCardHandler, PermManagePayments)).Methods("POST")
+	r.HandleFunc("/admin/gift-cards/{id:[0-9]+}", AuthMiddleware(AdminGetGiftCardHandler, PermManagePayments)).Methods("GET")
+	r.HandleFunc("/admin/pickup-locations", AuthMiddleware(AdminPickupLocationsHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/pickup-locations", AuthMiddleware(AdminCreatePickupLocationHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/pickup-locations/{id:[0-9]+}", AuthMiddleware(AdminUpdatePickupLocationHandler, PermManageProducts)).Methods("PUT")
+	r.HandleFunc("/admin/pickup-locations/{id:[0-9]+}", AuthMiddleware(AdminDeletePickupLocationHandler, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/warehouses", AuthMiddleware(AdminWarehousesHandler, PermManageProducts)).Methods("GET")
+	r.HandleFunc("/admin/warehouses", AuthMiddleware(AdminCreateWarehouseHandler, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/warehouses/{id:[0-9]+}", AuthMiddleware(AdminUpdateWarehouseHandler, PermManageProducts)).Methods("PUT")
+	r.HandleFunc("/admin/categories", AuthMiddleware(categories.Create, PermManageProducts)).Methods("POST")
+	r.HandleFunc("/admin/categories/{id:[0-9]+}", AuthMiddleware(categories.Update, PermManageProducts)).Methods("PUT")
+	r.HandleFunc("/admin/categories/{id:[0-9]+}", AuthMiddleware(categories.Delete, PermManageProducts)).Methods("DELETE")
+	r.HandleFunc("/admin/payment-methods", AuthMiddleware(AdminPaymentMethodsHandler, PermManagePayments)).Methods("GET")
+	r.HandleFunc("/admin/payment-methods", AuthMiddleware(AdminCreatePaymentMethodHandler, PermManagePayments)).Methods("POST")
+	r.HandleFunc("/admin/payment-methods/{id:[0-9]+}", AuthMiddleware(AdminUpdatePaymentMethodHandler, PermManagePayments)).Methods("PUT")
+	r.HandleFunc("/admin/payment-methods/{id:[0-9]+}", AuthMiddleware(AdminDeletePaymentMethodHandler, PermManagePayments)).Methods("DELETE")
+	r.HandleFunc("/admin/roles", AuthMiddleware(AdminRolesHandler, PermManageRoles)).Methods("GET")
+	r.HandleFunc("/admin/roles", AuthMiddleware(AdminSaveRoleHandler, PermManageRoles)).Methods("POST")
+	r.HandleFunc("/admin/roles/{name}", AuthMiddleware(AdminSaveRoleHandler, PermManageRoles)).Methods("PUT")
+	r.HandleFunc("/admin/customers/{id:[0-9]+}/role", AuthMiddleware(AdminAssignRoleHandler, PermManageRoles)).Methods("PUT")
+	r.HandleFunc("/admin/customers/{id:[0-9]+}/group", AuthMiddleware(AdminAssignCustomerGroupHandler, PermManageRoles)).Methods("PUT")
+	r.HandleFunc("/admin/api-keys", AuthMiddleware(AdminAPIKeysHandler, PermManageAPIKeys)).Methods("GET")
+	r.HandleFunc("/admin/api-keys", AuthMiddleware(AdminCreateAPIKeyHandler, PermManageAPIKeys)).Methods("POST")
+	r.HandleFunc("/admin/api-keys/{id:[0-9]+}", AuthMiddleware(AdminRevokeAPIKeyHandler, PermManageAPIKeys)).Methods("DELETE")
+	r.HandleFunc("/admin/webhooks", AuthMiddleware(AdminWebhooksHandler, PermManageAPIKeys)).Methods("GET")
+	r.HandleFunc("/admin/webhooks", AuthMiddleware(AdminCreateWebhookHandler, PermManageAPIKeys)).Methods("POST")
+	r.HandleFunc("/admin/webhooks/{id:[0-9]+}", AuthMiddleware(AdminUpdateWebhookHandler, PermManageAPIKeys)).Methods("PUT")
+	r.HandleFunc("/admin/webhooks/{id:[0-9]+}", AuthMiddleware(AdminDeleteWebhookHandler, PermManageAPIKeys)).Methods("DELETE")
+	r.HandleFunc("/admin/webhooks/{id:[0-9]+}/deliveries", AuthMiddleware(AdminWebhookDeliveriesHandler, PermManageAPIKeys)).Methods("GET")
+	r.HandleFunc("/admin/email-suppressions", AuthMiddleware(AdminEmailSuppressionsHandler, PermManageRoles)).Methods("GET")
+	r.HandleFunc("/admin/email-suppressions/{email}", AuthMiddleware(AdminDeleteEmailSuppressionHandler, PermManageRoles)).Methods("DELETE")
+}
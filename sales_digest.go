@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// salesDigestTopProducts is how many best sellers the digest lists
+const salesDigestTopProducts = 5
+
+// Sales digest settings, loaded from environment variables by loadSalesDigestConfig
+var salesDigestConfig = struct {
+	// Recipients get the daily digest; without any it isn't sent
+	Recipients []string
+}{}
+
+// salesDigestEmail is the data of the daily sales digest
+type salesDigestEmail struct {
+	// Date is the day the digest covers
+	Date     time.Time
+	Currency string
+	// Orders counts the orders placed that day that weren't cancelled, and PaidOrders those of
+	// them that were paid, whose totals add up to Revenue
+	Orders      int
+	PaidOrders  int
+	Revenue     float64
+	TopProducts []salesDigestProduct
+	// AwaitingPayment counts the open orders that aren't paid yet, and AwaitingShipment the
+	// paid orders that haven't shipped in full, whatever day they were placed
+	AwaitingPayment  int
+	AwaitingShipment int
+	// OldestOpenOrder is when the oldest of those orders was placed; nil without any
+	OldestOpenOrder *time.Time
+}
+
+// salesDigestProduct is a best seller of the digest's day
+type salesDigestProduct struct {
+	ProductID int
+	Name      string
+	Units     int
+	Revenue   float64
+}
+
+func loadSalesDigestConfig() {
+	for _, recipient := range strings.Split(os.Getenv("SALES_DIGEST_RECIPIENTS"), ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			salesDigestConfig.Recipients = append(salesDigestConfig.Recipients, recipient)
+		}
+	}
+}
+
+// SendSalesDigest emails yesterday's sales and the open order backlog to the digest recipients
+func SendSalesDigest(ctx context.Context) {
+	if len(salesDigestConfig.Recipients) == 0 {
+		return
+	}
+
+	now := time.Now()
+	day := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, now.Location())
+	digest, err := getSalesDigest(ctx, day)
+	if err != nil {
+		log.Println("Error compiling sales digest:", err)
+		return
+	}
+
+	key := "sales_digest:" + day.Format("2006-01-02")
+	for _, to := range salesDigestConfig.Recipients {
+		if err := sendEmail(ctx, to, emailSalesDigest, key, digest); err != nil {
+			log.Printf("Error sending sales digest to %s: %v", to, err)
+		}
+	}
+}
+
+// getSalesDigest compiles the digest of the day starting at day
+func getSalesDigest(ctx context.Context, day time.Time) (*salesDigestEmail, error) {
+	digest := &salesDigestEmail{Date: day, Currency: paymentConfig.Currency, TopProducts: make([]salesDigestProduct, 0)}
+	end := day.AddDate(0, 0, 1)
+
+	// Orders that are pending, awaiting payment or cancelled bring in no revenue
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FILTER (WHERE status <> $5),
+			   COUNT(*) FILTER (WHERE status NOT IN ($3, $4, $5)),
+			   COALESCE(SUM(total) FILTER (WHERE status NOT IN ($3, $4, $5)), 0)
+		FROM orders
+		WHERE date >= $1 AND date < $2
+	`, day, end, orderStatusPending, orderStatusAwaitingPayment, orderStatusCancelled).Scan(&digest.Orders, &digest.PaidOrders, &digest.Revenue)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.id, p.name, SUM(op.quantity), COALESCE(SUM(op.unit_price_at_purchase * op.quantity), 0)
+		FROM order_products op
+		JOIN orders o ON o.id = op.order_id
+		JOIN products p ON p.id = op.product_id
+		WHERE o.date >= $1 AND o.date < $2 AND o.status NOT IN ($3, $4, $5)
+		GROUP BY p.id, p.name
+		ORDER BY SUM(op.quantity) DESC, p.id
+		LIMIT $6
+	`, day, end, orderStatusPending, orderStatusAwaitingPayment, orderStatusCancelled, salesDigestTopProducts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var product salesDigestProduct
+		if err := rows.Scan(&product.ProductID, &product.Name, &product.Units, &product.Revenue); err != nil {
+			return nil, err
+		}
+		digest.TopProducts = append(digest.TopProducts, product)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FILTER (WHERE status IN ($1, $2)),
+			   COUNT(*) FILTER (WHERE status IN ($3, $4)),
+			   MIN(date)
+		FROM orders
+		WHERE status IN ($1, $2, $3, $4)
+	`, orderStatusPending, orderStatusAwaitingPayment, orderStatusPaid, orderStatusPartiallyShipped).Scan(
+		&digest.AwaitingPayment, &digest.AwaitingShipment, &digest.OldestOpenOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	digest.Revenue = roundCents(digest.Revenue)
+	return digest, nil
+}
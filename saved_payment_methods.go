@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errPaymentMethodNotSupported = errors.New("payment methods can't be saved for this provider")
+
+// paymentMethodVault is implemented by gateways that can keep a customer's tokenized payment
+// methods for later orders
+type paymentMethodVault interface {
+	// SavePaymentMethod attaches the token to the customer at the provider. A customer without
+	// a Reference yet is created there first.
+	SavePaymentMethod(ctx context.Context, customer PaymentCustomer, token string) (*VaultedPaymentMethod, error)
+	// DeletePaymentMethod detaches the token from its customer at the provider
+	DeletePaymentMethod(ctx context.Context, token string) error
+}
+
+// PaymentCustomer is a store customer as known to a payment provider
+type PaymentCustomer struct {
+	ID    int
+	Email string
+	// Reference is the provider's customer ID, empty until the first method is saved
+	Reference string
+}
+
+// VaultedPaymentMethod is what the provider returns for a saved method
+type VaultedPaymentMethod struct {
+	CustomerReference string
+	Brand             string
+	Last4             string
+	ExpMonth          int
+	ExpYear           int
+}
+
+// SavedPaymentMethod is a payment method the customer saved. Only the provider's token and
+// the card's display details are stored, never the card number.
+type SavedPaymentMethod struct {
+	ID        int       `json:"payment_method_id"`
+	Provider  string    `json:"provider"`
+	Brand     string    `json:"brand,omitempty"`
+	Last4     string    `json:"last4,omitempty"`
+	ExpMonth  int       `json:"exp_month,omitempty"`
+	ExpYear   int       `json:"exp_year,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type SavePaymentMethodRequest struct {
+	Provider string `json:"provider"`
+	// PaymentMethod is the token the storefront got from the provider, e.g. from Stripe.js
+	PaymentMethod string `json:"payment_method"`
+}
+
+// CUSTOMER PAYMENT METHODS
+func CustomerPaymentMethodsHandler(w http.ResponseWriter, r *http.Request) {
+	methods, err := getSavedPaymentMethods(r.Context(), getCustomerID(r))
+	if err != nil {
+		log.Println("Error retrieving payment methods:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, methods)
+}
+
+// CUSTOMER SAVE PAYMENT METHOD
+func CustomerSavePaymentMethodHandler(w http.ResponseWriter, r *http.Request) {
+	var saveRequest SavePaymentMethodRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &saveRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	saveRequest.Provider = strings.ToLower(strings.TrimSpace(saveRequest.Provider))
+	saveRequest.PaymentMethod = strings.TrimSpace(saveRequest.PaymentMethod)
+	if err := validatePaymentToken(saveRequest.PaymentMethod); err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+
+	vault, ok := paymentGateways[saveRequest.Provider].(paymentMethodVault)
+	if !ok {
+		handlers.WriteValidationError(w, errPaymentMethodNotSupported)
+		return
+	}
+
+	method, err := savePaymentMethod(r.Context(), vault, getCustomerID(r), saveRequest)
+	var cardErr *stripeCardError
+	if errors.As(err, &cardErr) {
+		handlers.WriteError(w, http.StatusPaymentRequired, cardErr.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error saving payment method:", err)
+		handlers.WriteError(w, http.StatusBadGateway, "Payment provider error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, method)
+}
+
+// CUSTOMER DELETE PAYMENT METHOD
+func CustomerDeletePaymentMethodHandler(w http.ResponseWriter, r *http.Request) {
+	methodID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid payment method ID")
+		return
+	}
+
+	var provider, token string
+	err = db.QueryRowContext(r.Context(), `
+		DELETE FROM saved_payment_methods WHERE id = $1 AND customer_id = $2
+		RETURNING provider, token
+	`, methodID, getCustomerID(r)).Scan(&provider, &token)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Payment method not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error deleting payment method:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// The method is gone from the store either way; a token left at the provider can't be
+	// charged by the customer anymore
+	if vault, ok := paymentGateways[provider].(paymentMethodVault); ok {
+		if err := vault.DeletePaymentMethod(r.Context(), token); err != nil {
+			log.Printf("Error deleting payment method %d at %s: %v", methodID, provider, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Payment method deleted"))
+}
+
+// validatePaymentToken rejects empty tokens and anything that looks like a raw card number,
+// which must never be sent to or stored by the store
+func validatePaymentToken(token string) error {
+	if token == "" {
+		return handlers.NewFieldError("payment_method", "payment_method is required")
+	}
+	digits := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, token)
+	if _, err := strconv.ParseUint(digits, 10, 64); err == nil && len(digits) >= 12 {
+		return handlers.NewFieldError("payment_method", "payment_method must be a token from the payment provider, not a card number")
+	}
+	return nil
+}
+
+// savePaymentMethod saves the token with the provider and stores the method. The provider's
+// customer is reused for all of the customer's methods.
+func savePaymentMethod(ctx context.Context, vault paymentMethodVault, customerID int, req SavePaymentMethodRequest) (*SavedPaymentMethod, error) {
+	customer := PaymentCustomer{ID: customerID}
+	err := db.QueryRowContext(ctx, `
+		SELECT c.email, COALESCE(pc.reference, '')
+		FROM customers c
+		LEFT JOIN payment_customers pc ON pc.customer_id = c.id AND pc.provider = $2
+		WHERE c.id = $1
+	`, customerID, req.Provider).Scan(&customer.Email, &customer.Reference)
+	if err != nil {
+		return nil, err
+	}
+
+	vaulted, err := vault.SavePaymentMethod(ctx, customer, req.PaymentMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO payment_customers (customer_id, provider, reference)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (customer_id, provider) DO UPDATE SET reference = EXCLUDED.reference
+	`, customerID, req.Provider, vaulted.CustomerReference)
+	if err != nil {
+		return nil, err
+	}
+
+	method := &SavedPaymentMethod{
+		Provider: req.Provider,
+		Brand:    vaulted.Brand,
+		Last4:    vaulted.Last4,
+		ExpMonth: vaulted.ExpMonth,
+		ExpYear:  vaulted.ExpYear,
+	}
+	// Saving the same token again returns the method already stored
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO saved_payment_methods (customer_id, provider, token, brand, last4, exp_month, exp_year)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, 0), NULLIF($7, 0))
+		ON CONFLICT (provider, token) DO UPDATE SET brand = EXCLUDED.brand
+		WHERE saved_payment_methods.customer_id = EXCLUDED.customer_id
+		RETURNING id, created_at
+	`, customerID, method.Provider, req.PaymentMethod, method.Brand, method.Last4, method.ExpMonth, method.ExpYear).Scan(&method.ID, &method.CreatedAt)
+	if isNoRows(err) {
+		return nil, fmt.Errorf("payment method is saved by another customer")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return method, tx.Commit()
+}
+
+func getSavedPaymentMethods(ctx context.Context, customerID int) ([]SavedPaymentMethod, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, provider, COALESCE(brand, ''), COALESCE(last4, ''), COALESCE(exp_month, 0), COALESCE(exp_year, 0), created_at
+		FROM saved_payment_methods
+		WHERE customer_id = $1
+		ORDER BY created_at DESC, id DESC
+	`, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	methods := make([]SavedPaymentMethod, 0)
+	for rows.Next() {
+		var method SavedPaymentMethod
+		if err := rows.Scan(&method.ID, &method.Provider, &method.Brand, &method.Last4,
+			&method.ExpMonth, &method.ExpYear, &method.CreatedAt); err != nil {
+			return nil, err
+		}
+		methods = append(methods, method)
+	}
+
+	return methods, rows.Err()
+}
+
+// resolveSavedPaymentMethod fills in the provider, token and provider customer of the
+// customer's saved method chosen by the payment request
+func resolveSavedPaymentMethod(ctx context.Context, customerID int, req *PaymentRequest) error {
+	var provider string
+	err := db.QueryRowContext(ctx, `
+		SELECT m.provider, m.token, COALESCE(pc.reference, '')
+		FROM saved_payment_methods m
+		LEFT JOIN payment_customers pc ON pc.customer_id = m.customer_id AND pc.provider = m.provider
+		WHERE m.id = $1 AND m.customer_id = $2
+	`, req.SavedPaymentMethodID, customerID).Scan(&provider, &req.PaymentMethod, &req.customerReference)
+	if isNoRows(err) {
+		return handlers.NewFieldError("payment.saved_payment_method_id", "payment.saved_payment_method_id is not one of your saved payment methods")
+	}
+	if err != nil {
+		return err
+	}
+	if req.Provider != "" && req.Provider != provider {
+		return handlers.NewFieldError("payment.provider", "payment.provider doesn't match the saved payment method")
+	}
+	req.Provider = provider
+	return nil
+}
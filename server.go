@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Server settings, loaded from environment variables by loadServerConfig
+var serverConfig = struct {
+	// ShutdownTimeout is how long shutting down waits for in-flight requests, the background
+	// task's current pass and RPCs before closing the database anyway
+	ShutdownTimeout time.Duration
+}{
+	ShutdownTimeout: 30 * time.Second,
+}
+
+func loadServerConfig() {
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid SHUTDOWN_TIMEOUT %q", v)
+		}
+		serverConfig.ShutdownTimeout = d
+	}
+}
+
+// runServer serves HTTP on addr until ctx is done, then stops taking requests, drains those in
+// flight, waits for tasks to stop and closes the database
+func runServer(ctx context.Context, addr string, handler http.Handler, tasks *sync.WaitGroup) {
+	server := &http.Server{Addr: addr, Handler: handler}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	log.Println("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverConfig.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error draining HTTP requests:", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		tasks.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		log.Println("Background work didn't stop within", serverConfig.ShutdownTimeout)
+	}
+
+	if err := db.Close(); err != nil {
+		log.Println("Error closing database:", err)
+	}
+}
@@ -0,0 +1,84 @@
+// Package service holds the business rules, reaching the database only through the
+// repository interfaces
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/hanifmasy/simple-commerce/models"
+	"github.com/hanifmasy/simple-commerce/repository"
+)
+
+var ErrCategoryNotFound = errors.New("category not found")
+var ErrCategoryCycle = errors.New("a category can't be moved under itself or one of its subcategories")
+var ErrCategoryInUse = errors.New("category still has subcategories or products")
+var ErrUnknownParentCategory = errors.New("parent category does not exist")
+
+type CategoryService struct {
+	categories repository.CategoryRepository
+}
+
+func NewCategoryService(categories repository.CategoryRepository) *CategoryService {
+	return &CategoryService{categories: categories}
+}
+
+func (s *CategoryService) List(ctx context.Context) ([]models.Category, error) {
+	return s.categories.List(ctx)
+}
+
+// Save inserts a new category when categoryID is 0, otherwise updates it. The parent must exist,
+// and a category can't be moved under its own subtree.
+func (s *CategoryService) Save(ctx context.Context, categoryID int, req models.CategoryRequest) (*models.Category, error) {
+	if req.ParentID != nil {
+		exists, err := s.categories.Exists(ctx, *req.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrUnknownParentCategory
+		}
+	}
+
+	category := &models.Category{ID: categoryID, Name: req.Name, ParentID: req.ParentID}
+	if categoryID == 0 {
+		var err error
+		if category.ID, err = s.categories.Create(ctx, req); err != nil {
+			return nil, err
+		}
+		return category, nil
+	}
+
+	if req.ParentID != nil {
+		descendants, err := s.categories.Descendants(ctx, categoryID)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range descendants {
+			if id == *req.ParentID {
+				return nil, ErrCategoryCycle
+			}
+		}
+	}
+
+	err := s.categories.Update(ctx, categoryID, req)
+	if err == repository.ErrNotFound {
+		return nil, ErrCategoryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return category, nil
+}
+
+func (s *CategoryService) Delete(ctx context.Context, categoryID int) error {
+	switch err := s.categories.Delete(ctx, categoryID); err {
+	case repository.ErrNotFound:
+		return ErrCategoryNotFound
+	case repository.ErrInUse:
+		return ErrCategoryInUse
+	default:
+		return err
+	}
+}
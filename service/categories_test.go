@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/hanifmasy/simple-commerce/models"
+	"github.com/hanifmasy/simple-commerce/repository"
+)
+
+// memoryCategoryRepository keeps categories in a map, so the service is tested without Postgres
+type memoryCategoryRepository struct {
+	categories map[int]models.Category
+	nextID     int
+	// products are the categories products are filed under
+	products map[int]bool
+}
+
+func newMemoryCategoryRepository() *memoryCategoryRepository {
+	return &memoryCategoryRepository{categories: map[int]models.Category{}, products: map[int]bool{}}
+}
+
+func (r *memoryCategoryRepository) List(ctx context.Context) ([]models.Category, error) {
+	categories := make([]models.Category, 0, len(r.categories))
+	for _, category := range r.categories {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool { return categories[i].Name < categories[j].Name })
+	return categories, nil
+}
+
+func (r *memoryCategoryRepository) Exists(ctx context.Context, categoryID int) (bool, error) {
+	_, ok := r.categories[categoryID]
+	return ok, nil
+}
+
+func (r *memoryCategoryRepository) Create(ctx context.Context, req models.CategoryRequest) (int, error) {
+	r.nextID++
+	r.categories[r.nextID] = models.Category{ID: r.nextID, Name: req.Name, ParentID: req.ParentID}
+	return r.nextID, nil
+}
+
+func (r *memoryCategoryRepository) Update(ctx context.Context, categoryID int, req models.CategoryRequest) error {
+	if _, ok := r.categories[categoryID]; !ok {
+		return repository.ErrNotFound
+	}
+	r.categories[categoryID] = models.Category{ID: categoryID, Name: req.Name, ParentID: req.ParentID}
+	return nil
+}
+
+func (r *memoryCategoryRepository) Delete(ctx context.Context, categoryID int) error {
+	if _, ok := r.categories[categoryID]; !ok {
+		return repository.ErrNotFound
+	}
+	if r.products[categoryID] {
+		return repository.ErrInUse
+	}
+	for _, category := range r.categories {
+		if category.ParentID != nil && *category.ParentID == categoryID {
+			return repository.ErrInUse
+		}
+	}
+	delete(r.categories, categoryID)
+	return nil
+}
+
+func (r *memoryCategoryRepository) Descendants(ctx context.Context, categoryID int) ([]int, error) {
+	ids := []int{categoryID}
+	for i := 0; i < len(ids); i++ {
+		for _, category := range r.categories {
+			if category.ParentID != nil && *category.ParentID == ids[i] {
+				ids = append(ids, category.ID)
+			}
+		}
+	}
+	return ids, nil
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestCategoryServiceSave(t *testing.T) {
+	ctx := context.Background()
+	categories := NewCategoryService(newMemoryCategoryRepository())
+
+	root, err := categories.Save(ctx, 0, models.CategoryRequest{Name: "Clothing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := categories.Save(ctx, 0, models.CategoryRequest{Name: "Shirts", ParentID: intPtr(root.ID)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	grandchild, err := categories.Save(ctx, 0, models.CategoryRequest{Name: "Polos", ParentID: intPtr(child.ID)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		categoryID int
+		req        models.CategoryRequest
+		want       error
+	}{
+		{"unknown parent", 0, models.CategoryRequest{Name: "Shoes", ParentID: intPtr(99)}, ErrUnknownParentCategory},
+		{"under itself", root.ID, models.CategoryRequest{Name: "Clothing", ParentID: intPtr(root.ID)}, ErrCategoryCycle},
+		{"under its subcategory", root.ID, models.CategoryRequest{Name: "Clothing", ParentID: intPtr(grandchild.ID)}, ErrCategoryCycle},
+		{"missing category", 99, models.CategoryRequest{Name: "Shoes"}, ErrCategoryNotFound},
+		{"rename", child.ID, models.CategoryRequest{Name: "Tops", ParentID: intPtr(root.ID)}, nil},
+		{"move to the top", grandchild.ID, models.CategoryRequest{Name: "Polos"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			category, err := categories.Save(ctx, tt.categoryID, tt.req)
+			if err != tt.want {
+				t.Fatalf("Save() error = %v, want %v", err, tt.want)
+			}
+			if err == nil && (category.ID != tt.categoryID || category.Name != tt.req.Name) {
+				t.Errorf("Save() = %+v, want ID %d named %q", category, tt.categoryID, tt.req.Name)
+			}
+		})
+	}
+}
+
+func TestCategoryServiceDelete(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryCategoryRepository()
+	categories := NewCategoryService(repo)
+
+	root, _ := categories.Save(ctx, 0, models.CategoryRequest{Name: "Clothing"})
+	child, _ := categories.Save(ctx, 0, models.CategoryRequest{Name: "Shirts", ParentID: intPtr(root.ID)})
+	repo.products[child.ID] = true
+
+	if err := categories.Delete(ctx, 99); err != ErrCategoryNotFound {
+		t.Errorf("deleting a missing category: error = %v, want %v", err, ErrCategoryNotFound)
+	}
+	if err := categories.Delete(ctx, root.ID); err != ErrCategoryInUse {
+		t.Errorf("deleting a category with subcategories: error = %v, want %v", err, ErrCategoryInUse)
+	}
+	if err := categories.Delete(ctx, child.ID); err != ErrCategoryInUse {
+		t.Errorf("deleting a category with products: error = %v, want %v", err, ErrCategoryInUse)
+	}
+
+	delete(repo.products, child.ID)
+	if err := categories.Delete(ctx, child.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := categories.Delete(ctx, root.ID); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := categories.List(ctx); len(list) != 0 {
+		t.Errorf("List() = %v after deleting everything, want none", list)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+const (
+	orderStatusPartiallyShipped = "Partially Shipped"
+	orderStatusShipped          = "Shipped"
+	// orderStatusDelivered follows Shipped once the carrier reports every package delivered
+	orderStatusDelivered = "Delivered"
+)
+
+var errInvalidShipment = errors.New("invalid shipment")
+var errOrderNotShippable = errors.New("order is cancelled or already shipped")
+
+// Shipment is one package sent for an order, holding some or all of its units
+type Shipment struct {
+	ID             int    `json:"shipment_id"`
+	OrderID        int    `json:"order_id"`
+	TrackingNumber string `json:"tracking_number,omitempty"`
+	// Carrier is given with the shipment or set, along with Service and the label, once a
+	// label is bought through the carrier API
+	Carrier       string         `json:"carrier,omitempty"`
+	Service       string         `json:"service,omitempty"`
+	LabelURL      string         `json:"label_url,omitempty"`
+	LabelCost     float64        `json:"label_cost,omitempty"`
+	LabelCurrency string         `json:"label_currency,omitempty"`
+	ShippedAt     time.Time      `json:"shipped_at"`
+	Items         []ShipmentItem `json:"items"`
+}
+
+// ShipmentItem is a number of units of one order line in a shipment
+type ShipmentItem struct {
+	ProductID int  `json:"product_id"`
+	VariantID *int `json:"variant_id,omitempty"`
+	Quantity  int  `json:"quantity"`
+}
+
+type ShipmentRequest struct {
+	TrackingNumber string `json:"tracking_number"`
+	// Carrier names who carries the package, e.g. "USPS", so its tracking number can be followed
+	Carrier string         `json:"carrier"`
+	Items   []ShipmentItem `json:"items"`
+}
+
+// FulfillmentLine shows how much of an order line has shipped
+type FulfillmentLine struct {
+	ProductID   int    `json:"product_id"`
+	VariantID   *int   `json:"variant_id,omitempty"`
+	ProductName string `json:"product_name"`
+	Ordered     int    `json:"ordered"`
+	Shipped     int    `json:"shipped"`
+	Remaining   int    `json:"remaining"`
+}
+
+type OrderFulfillment struct {
+	OrderID   int               `json:"order_id"`
+	Status    string            `json:"status"`
+	Lines     []FulfillmentLine `json:"lines"`
+	Shipments []Shipment        `json:"shipments"`
+}
+
+// fulfillmentLinesSQL lists the order's lines with the units already shipped
+const fulfillmentLinesSQL = `
+	SELECT op.product_id, op.variant_id, p.name, op.quantity,
+		   COALESCE((
+			   SELECT SUM(si.quantity)
+			   FROM shipment_items si
+			   JOIN shipments s ON si.shipment_id = s.id
+			   WHERE s.order_id = op.order_id AND si.product_id = op.product_id
+				 AND COALESCE(si.variant_id, 0) = COALESCE(op.variant_id, 0)
+		   ), 0)
+	FROM order_products op
+	JOIN products p ON op.product_id = p.id
+	WHERE op.order_id = $1
+	ORDER BY op.product_id, op.variant_id NULLS FIRST
+`
+
+// ADMIN SHIPMENTS
+// AdminCreateShipmentHandler records a shipment of some of the order's units. The order becomes
+// "Partially Shipped", or "Shipped" once every unit has shipped.
+func AdminCreateShipmentHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var shipmentRequest ShipmentRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &shipmentRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	shipmentRequest.TrackingNumber = strings.TrimSpace(shipmentRequest.TrackingNumber)
+	shipmentRequest.Carrier = strings.TrimSpace(shipmentRequest.Carrier)
+	var validationErr error
+	switch {
+	case len(shipmentRequest.TrackingNumber) > 100:
+		validationErr = handlers.NewFieldError("tracking_number", "tracking_number must be at most 100 characters")
+	case len(shipmentRequest.Carrier) > 50:
+		validationErr = handlers.NewFieldError("carrier", "carrier must be at most 50 characters")
+	case len(shipmentRequest.Items) == 0:
+		validationErr = handlers.NewFieldError("items", "at least one item is required")
+	}
+	for i, item := range shipmentRequest.Items {
+		if validationErr == nil && item.Quantity < 1 {
+			validationErr = handlers.NestFieldError(fmt.Sprintf("items[%d]", i), handlers.NewFieldError("quantity", "quantity must be at least 1"))
+		}
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return
+	}
+
+	shipment, err := createShipment(r.Context(), orderID, shipmentRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if errors.Is(err, errInvalidShipment) {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err == errOrderNotShippable {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error creating shipment:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, shipment)
+}
+
+func AdminOrderShipmentsHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	writeOrderFulfillment(r.Context(), w, orderID)
+}
+
+// CUSTOMER SHIPMENTS
+// CustomerOrderShipmentsHandler shows which items of the customer's order have shipped
+func CustomerOrderShipmentsHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var owned bool
+	err = db.QueryRowContext(r.Context(), "SELECT EXISTS (SELECT 1 FROM orders WHERE id = $1 AND customer_id = $2)", orderID, getCustomerID(r)).Scan(&owned)
+	if err != nil {
+		log.Println("Error retrieving order:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if !owned {
+		handlers.WriteError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	writeOrderFulfillment(r.Context(), w, orderID)
+}
+
+func writeOrderFulfillment(ctx context.Context, w http.ResponseWriter, orderID int) {
+	fulfillment, err := getOrderFulfillment(ctx, orderID)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error retrieving shipments:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, fulfillment)
+}
+
+func createShipment(ctx context.Context, orderID int, req ShipmentRequest) (*Shipment, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, "SELECT status FROM orders WHERE id = $1 FOR UPDATE", orderID).Scan(&status)
+	if err != nil {
+		return nil, err
+	}
+	if status == orderStatusCancelled || status == orderStatusShipped || status == orderStatusDelivered {
+		return nil, errOrderNotShippable
+	}
+
+	rows, err := tx.QueryContext(ctx, fulfillmentLinesSQL, orderID)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := scanFulfillmentLines(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := make(map[[2]int]int)
+	for _, line := range lines {
+		remaining[productVariantKey(line.ProductID, line.VariantID)] = line.Remaining
+	}
+	for i, item := range req.Items {
+		key := productVariantKey(item.ProductID, item.VariantID)
+		left, ok := remaining[key]
+		if !ok {
+			return nil, fmt.Errorf("%w: items[%d]: product %d is not on the order", errInvalidShipment, i, item.ProductID)
+		}
+		if item.Quantity > left {
+			return nil, fmt.Errorf("%w: items[%d]: only %d units of product %d are left to ship", errInvalidShipment, i, left, item.ProductID)
+		}
+		remaining[key] = left - item.Quantity
+	}
+
+	shipment := &Shipment{OrderID: orderID, TrackingNumber: req.TrackingNumber, Carrier: req.Carrier, Items: req.Items}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO shipments (order_id, tracking_number, carrier)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''))
+		RETURNING id, shipped_at
+	`, orderID, req.TrackingNumber, req.Carrier).Scan(&shipment.ID, &shipment.ShippedAt)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range req.Items {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO shipment_items (shipment_id, product_id, variant_id, quantity)
+			VALUES ($1, $2, $3, $4)
+		`, shipment.ID, item.ProductID, item.VariantID, item.Quantity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	status = orderStatusShipped
+	for _, left := range remaining {
+		if left > 0 {
+			status = orderStatusPartiallyShipped
+		}
+	}
+	if err := setOrderStatus(ctx, tx, orderID, status); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return shipment, nil
+}
+
+func productVariantKey(productID int, variantID *int) [2]int {
+	key := [2]int{productID, 0}
+	if variantID != nil {
+		key[1] = *variantID
+	}
+	return key
+}
+
+func getOrderFulfillment(ctx context.Context, orderID int) (*OrderFulfillment, error) {
+	fulfillment := &OrderFulfillment{OrderID: orderID, Shipments: make([]Shipment, 0)}
+	err := db.QueryRowContext(ctx, "SELECT status FROM orders WHERE id = $1", orderID).Scan(&fulfillment.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, fulfillmentLinesSQL, orderID)
+	if err != nil {
+		return nil, err
+	}
+	fulfillment.Lines, err = scanFulfillmentLines(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT s.id, COALESCE(s.tracking_number, ''), COALESCE(s.carrier, ''), COALESCE(s.service, ''),
+			   COALESCE(s.label_url, ''), COALESCE(s.label_cost, 0), COALESCE(s.label_currency, ''),
+			   s.shipped_at, si.product_id, si.variant_id, si.quantity
+		FROM shipments s
+		JOIN shipment_items si ON si.shipment_id = s.id
+		WHERE s.order_id = $1
+		ORDER BY s.shipped_at, s.id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var shipment Shipment
+		var item ShipmentItem
+		if err := rows.Scan(&shipment.ID, &shipment.TrackingNumber, &shipment.Carrier, &shipment.Service,
+			&shipment.LabelURL, &shipment.LabelCost, &shipment.LabelCurrency,
+			&shipment.ShippedAt, &item.ProductID, &item.VariantID, &item.Quantity); err != nil {
+			return nil, err
+		}
+		last := len(fulfillment.Shipments) - 1
+		if last < 0 || fulfillment.Shipments[last].ID != shipment.ID {
+			shipment.OrderID = orderID
+			fulfillment.Shipments = append(fulfillment.Shipments, shipment)
+			last++
+		}
+		fulfillment.Shipments[last].Items = append(fulfillment.Shipments[last].Items, item)
+	}
+
+	return fulfillment, rows.Err()
+}
+
+func scanFulfillmentLines(rows *sql.Rows) ([]FulfillmentLine, error) {
+	defer rows.Close()
+
+	lines := make([]FulfillmentLine, 0)
+	for rows.Next() {
+		var line FulfillmentLine
+		if err := rows.Scan(&line.ProductID, &line.VariantID, &line.ProductName, &line.Ordered, &line.Shipped); err != nil {
+			return nil, err
+		}
+		line.Remaining = line.Ordered - line.Shipped
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
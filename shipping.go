@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	shippingStandard = "standard"
+	shippingExpress  = "express"
+)
+
+// shippingWeightSQL is the weight in kg a unit of product p is charged as: its weight, or its
+// volumetric weight (cm³ / 5000, as carriers charge bulky packages) when that is more
+const shippingWeightSQL = `GREATEST(COALESCE(p.weight, 0), COALESCE(p.length * p.width * p.height, 0) / 5000)`
+
+var errNoShippingOptions = errors.New("no shipping option delivers this order to the destination")
+
+// Shipping settings, loaded from environment variables by loadShippingConfig
+var shippingConfig = struct {
+	// StandardRate and ExpressRate are the flat prices of each shipping option
+	StandardRate float64
+	ExpressRate  float64
+	// FreeShippingThreshold makes standard shipping free from this subtotal; 0 disables it
+	FreeShippingThreshold float64
+	// Location and CutoffTime ("15:04") are when products not stocked in a warehouse ship
+	Location   *time.Location
+	CutoffTime string
+}{
+	StandardRate: 5,
+	ExpressRate:  15,
+	Location:     time.UTC,
+}
+
+// ShippingOption is a way an order can be shipped and what it costs
+type ShippingOption struct {
+	Code           string          `json:"code"`
+	Name           string          `json:"name"`
+	Price          float64         `json:"price"`
+	DeliveryWindow *DeliveryWindow `json:"delivery_window,omitempty"`
+	// EstimatedDelivery is set in quotes for options with a delivery window
+	EstimatedDelivery *DeliveryEstimate `json:"estimated_delivery,omitempty"`
+}
+
+func loadShippingConfig() {
+	shippingConfig.StandardRate = parseRateEnv("SHIPPING_STANDARD_RATE", shippingConfig.StandardRate)
+	shippingConfig.ExpressRate = parseRateEnv("SHIPPING_EXPRESS_RATE", shippingConfig.ExpressRate)
+	shippingConfig.FreeShippingThreshold = parseRateEnv("FREE_SHIPPING_THRESHOLD", shippingConfig.FreeShippingThreshold)
+
+	if v := os.Getenv("SHIPPING_TIMEZONE"); v != "" {
+		location, err := time.LoadLocation(v)
+		if err != nil {
+			log.Fatalf("Invalid SHIPPING_TIMEZONE %q", v)
+		}
+		shippingConfig.Location = location
+	}
+	if v := os.Getenv("SHIPPING_CUTOFF_TIME"); v != "" {
+		if !validClockTime(v) {
+			log.Fatalf("Invalid SHIPPING_CUTOFF_TIME %q", v)
+		}
+		shippingConfig.CutoffTime = v
+	}
+}
+
+// validClockTime reports whether v is a time of day written as "15:04"
+func validClockTime(v string) bool {
+	_, err := time.Parse("15:04", v)
+	return err == nil && len(v) == 5
+}
+
+func parseRateEnv(name string, defaultValue float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return defaultValue
+	}
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate < 0 {
+		log.Fatalf("Invalid %s %q", name, v)
+	}
+	return rate
+}
+
+// shippingOptions returns the options for shipping an order with the given subtotal and
+// weight (kg) to the destination, cheapest first. The rates of the destination's shipping
+// zone apply; until any zone is configured, every order ships by the enabled shipping methods
+// (see ShippingMethod).
+func shippingOptions(ctx context.Context, subtotal, weight float64, destination Destination) ([]ShippingOption, error) {
+	zoneID, err := getShippingZoneID(ctx, destination.Country)
+	if isNoRows(err) {
+		var configured bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM shipping_zones)").Scan(&configured); err != nil {
+			return nil, err
+		}
+		if !configured {
+			return methodShippingOptions(ctx, subtotal)
+		}
+		return nil, errNoShippingOptions
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Rates are offered unless their shipping method is disabled, and deliver within their own
+	// delivery window or else the method's
+	rows, err := db.QueryContext(ctx, `
+		SELECT r.code, r.name, r.base_price, r.price_per_kg, r.free_above,
+			   COALESCE(r.min_days, m.min_days), COALESCE(r.max_days, m.max_days)
+		FROM shipping_rates r
+		LEFT JOIN shipping_methods m ON m.code = r.code
+		WHERE r.zone_id = $1 AND r.min_weight <= $2 AND (r.max_weight IS NULL OR $2 < r.max_weight)
+		  AND COALESCE(m.enabled, TRUE)
+		ORDER BY r.id
+	`, zoneID, weight)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Overlapping weight brackets offer a method twice; the cheaper price wins
+	byCode := make(map[string]int)
+	options := make([]ShippingOption, 0)
+	for rows.Next() {
+		var option ShippingOption
+		var basePrice, pricePerKg float64
+		var freeAbove sql.NullFloat64
+		var minDays, maxDays sql.NullInt64
+		if err := rows.Scan(&option.Code, &option.Name, &basePrice, &pricePerKg, &freeAbove, &minDays, &maxDays); err != nil {
+			return nil, err
+		}
+		if minDays.Valid && maxDays.Valid {
+			option.DeliveryWindow = &DeliveryWindow{MinDays: int(minDays.Int64), MaxDays: int(maxDays.Int64)}
+		}
+		option.Price = roundCents(basePrice + pricePerKg*weight)
+		if freeAbove.Valid && subtotal >= freeAbove.Float64 {
+			option.Price = 0
+		}
+
+		if i, ok := byCode[option.Code]; ok {
+			if option.Price < options[i].Price {
+				options[i] = option
+			}
+			continue
+		}
+		byCode[option.Code] = len(options)
+		options = append(options, option)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(options) == 0 {
+		return nil, errNoShippingOptions
+	}
+
+	sort.SliceStable(options, func(i, j int) bool {
+		return options[i].Price < options[j].Price
+	})
+	return options, nil
+}
+
+// methodShippingOptions returns the enabled shipping methods at their own prices, or the flat
+// rates from the environment while no method exists
+func methodShippingOptions(ctx context.Context, subtotal float64) ([]ShippingOption, error) {
+	methods, err := getShippingMethods(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(methods) == 0 {
+		return flatShippingOptions(subtotal), nil
+	}
+
+	options := make([]ShippingOption, 0, len(methods))
+	for _, method := range methods {
+		if !method.Enabled {
+			continue
+		}
+		option := ShippingOption{Code: method.Code, Name: method.Name, Price: method.Price, DeliveryWindow: method.deliveryWindow()}
+		if method.FreeAbove != nil && subtotal >= *method.FreeAbove {
+			option.Price = 0
+		}
+		options = append(options, option)
+	}
+	if len(options) == 0 {
+		return nil, errNoShippingOptions
+	}
+
+	sort.SliceStable(options, func(i, j int) bool {
+		return options[i].Price < options[j].Price
+	})
+	return options, nil
+}
+
+// flatShippingOptions returns the flat rate options configured in the environment
+func flatShippingOptions(subtotal float64) []ShippingOption {
+	standard := ShippingOption{Code: shippingStandard, Name: "Standard shipping", Price: shippingConfig.StandardRate}
+	if shippingConfig.FreeShippingThreshold > 0 && subtotal >= shippingConfig.FreeShippingThreshold {
+		standard.Price = 0
+	}
+
+	return []ShippingOption{
+		standard,
+		{Code: shippingExpress, Name: "Express shipping", Price: shippingConfig.ExpressRate},
+	}
+}
+
+// getShippingZoneID returns the zone listing the country, or else the zone without
+// countries, which covers the rest of the world
+func getShippingZoneID(ctx context.Context, country string) (int, error) {
+	var zoneID int
+	err := db.QueryRowContext(ctx, `
+		SELECT id FROM shipping_zones
+		WHERE $1 = ANY(countries) OR cardinality(countries) = 0
+		ORDER BY cardinality(countries) = 0, id
+		LIMIT 1
+	`, country).Scan(&zoneID)
+	return zoneID, err
+}
+
+// shippingMethodExists reports whether any zone offers the shipping method or, when there are
+// no zones, whether it is an enabled method or one of the flat rates
+func shippingMethodExists(ctx context.Context, code string) (bool, error) {
+	var zoned, rated, methods, enabled bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM shipping_zones),
+			   EXISTS (
+				   SELECT 1 FROM shipping_rates r
+				   LEFT JOIN shipping_methods m ON m.code = r.code
+				   WHERE r.code = $1 AND COALESCE(m.enabled, TRUE)
+			   ),
+			   EXISTS (SELECT 1 FROM shipping_methods),
+			   EXISTS (SELECT 1 FROM shipping_methods WHERE code = $1 AND enabled)
+	`, code).Scan(&zoned, &rated, &methods, &enabled)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case zoned:
+		return rated, nil
+	case methods:
+		return enabled, nil
+	}
+	return code == shippingStandard || code == shippingExpress, nil
+}
+
+// cartWeight is the shipping weight of the cart's items in kg
+func cartWeight(ctx context.Context, cart *Cart) (float64, error) {
+	productIDs := make([]int, 0, len(cart.Items))
+	quantities := make([]int, 0, len(cart.Items))
+	for _, item := range cart.Items {
+		productIDs = append(productIDs, item.Product.ID)
+		quantities = append(quantities, item.Quantity)
+	}
+
+	var weight float64
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(`+shippingWeightSQL+` * items.quantity), 0)
+		FROM unnest($1::int[], $2::int[]) AS items (product_id, quantity)
+		JOIN products p ON p.id = items.product_id
+	`, pq.Array(productIDs), pq.Array(quantities)).Scan(&weight)
+	return weight, err
+}
+
+// orderWeight is the shipping weight of the order's lines in kg
+func orderWeight(ctx context.Context, tx *sql.Tx, orderID int) (float64, error) {
+	var weight float64
+	err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(`+shippingWeightSQL+` * op.quantity), 0)
+		FROM order_products op
+		JOIN products p ON op.product_id = p.id
+		WHERE op.order_id = $1
+	`, orderID).Scan(&weight)
+	return weight, err
+}
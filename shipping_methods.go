@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// ShippingMethod is a way of shipping offered at checkout. Without shipping zones, every
+// enabled method is offered at its Price; with zones, the zone's rates set the price and a
+// disabled method's rates aren't offered. Until any method exists, the flat rates from the
+// environment apply.
+type ShippingMethod struct {
+	ID    int     `json:"shipping_method_id"`
+	Code  string  `json:"code"`
+	Name  string  `json:"name"`
+	Price float64 `json:"price"`
+	// FreeAbove makes the method free from this subtotal
+	FreeAbove *float64 `json:"free_above"`
+	// MinDays and MaxDays are how many business days delivery takes once shipped
+	MinDays   *int      `json:"min_days"`
+	MaxDays   *int      `json:"max_days"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ShippingMethodRequest struct {
+	Code      string   `json:"code"`
+	Name      string   `json:"name"`
+	Price     float64  `json:"price"`
+	FreeAbove *float64 `json:"free_above"`
+	MinDays   *int     `json:"min_days"`
+	MaxDays   *int     `json:"max_days"`
+	// Enabled defaults to true
+	Enabled *bool `json:"enabled"`
+}
+
+// DeliveryWindow is how many business days a shipping option takes to deliver once shipped
+type DeliveryWindow struct {
+	MinDays int `json:"min_days"`
+	MaxDays int `json:"max_days"`
+}
+
+// ADMIN SHIPPING METHODS
+func AdminShippingMethodsHandler(w http.ResponseWriter, r *http.Request) {
+	methods, err := getShippingMethods(r.Context())
+	if err != nil {
+		log.Println("Error retrieving shipping methods:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, methods)
+}
+
+func AdminCreateShippingMethodHandler(w http.ResponseWriter, r *http.Request) {
+	methodRequest, ok := readShippingMethodRequest(w, r)
+	if !ok {
+		return
+	}
+
+	method, err := saveShippingMethod(r.Context(), 0, methodRequest)
+	if isUniqueViolation(err) {
+		handlers.WriteError(w, http.StatusConflict, "Shipping method code already exists")
+		return
+	}
+	if err != nil {
+		log.Println("Error creating shipping method:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, method)
+}
+
+func AdminUpdateShippingMethodHandler(w http.ResponseWriter, r *http.Request) {
+	methodID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid shipping method ID")
+		return
+	}
+
+	methodRequest, ok := readShippingMethodRequest(w, r)
+	if !ok {
+		return
+	}
+
+	method, err := saveShippingMethod(r.Context(), methodID, methodRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Shipping method not found")
+		return
+	}
+	if isUniqueViolation(err) {
+		handlers.WriteError(w, http.StatusConflict, "Shipping method code already exists")
+		return
+	}
+	if err != nil {
+		log.Println("Error updating shipping method:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, method)
+}
+
+// AdminDeleteShippingMethodHandler deletes the method. Zone rates with its code are offered
+// again without its delivery window; orders already placed keep their shipping.
+func AdminDeleteShippingMethodHandler(w http.ResponseWriter, r *http.Request) {
+	methodID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid shipping method ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM shipping_methods WHERE id = $1", methodID)
+	if err != nil {
+		log.Println("Error deleting shipping method:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Shipping method not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func readShippingMethodRequest(w http.ResponseWriter, r *http.Request) (ShippingMethodRequest, bool) {
+	var methodRequest ShippingMethodRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return methodRequest, false
+	}
+
+	err = json.Unmarshal(body, &methodRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return methodRequest, false
+	}
+
+	methodRequest.Code = strings.ToLower(strings.TrimSpace(methodRequest.Code))
+	methodRequest.Name = strings.TrimSpace(methodRequest.Name)
+	if methodRequest.Enabled == nil {
+		enabled := true
+		methodRequest.Enabled = &enabled
+	}
+
+	var validationErr error
+	switch {
+	case methodRequest.Code == "" || len(methodRequest.Code) > 50:
+		validationErr = handlers.NewFieldError("code", "code is required and must be at most 50 characters")
+	case methodRequest.Name == "" || len(methodRequest.Name) > 255:
+		validationErr = handlers.NewFieldError("name", "name is required and must be at most 255 characters")
+	case methodRequest.Price < 0:
+		validationErr = handlers.NewFieldError("price", "price must not be negative")
+	case methodRequest.FreeAbove != nil && *methodRequest.FreeAbove < 0:
+		validationErr = handlers.NewFieldError("free_above", "free_above must not be negative")
+	case (methodRequest.MinDays == nil) != (methodRequest.MaxDays == nil):
+		validationErr = errors.New("min_days and max_days must be given together")
+	case methodRequest.MinDays != nil && (*methodRequest.MinDays < 0 || *methodRequest.MaxDays < *methodRequest.MinDays):
+		validationErr = handlers.NewFieldError("min_days", "min_days must not be negative and max_days must be at least min_days")
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return methodRequest, false
+	}
+
+	return methodRequest, true
+}
+
+// saveShippingMethod inserts a new method when methodID is 0, otherwise updates it
+func saveShippingMethod(ctx context.Context, methodID int, req ShippingMethodRequest) (*ShippingMethod, error) {
+	method := &ShippingMethod{
+		Code:      req.Code,
+		Name:      req.Name,
+		Price:     req.Price,
+		FreeAbove: req.FreeAbove,
+		MinDays:   req.MinDays,
+		MaxDays:   req.MaxDays,
+		Enabled:   *req.Enabled,
+	}
+
+	var err error
+	if methodID == 0 {
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO shipping_methods (code, name, price, free_above, min_days, max_days, enabled)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING id, created_at
+		`, req.Code, req.Name, req.Price, req.FreeAbove, req.MinDays, req.MaxDays, *req.Enabled).Scan(&method.ID, &method.CreatedAt)
+	} else {
+		err = db.QueryRowContext(ctx, `
+			UPDATE shipping_methods
+			SET code = $1, name = $2, price = $3, free_above = $4, min_days = $5, max_days = $6, enabled = $7
+			WHERE id = $8
+			RETURNING id, created_at
+		`, req.Code, req.Name, req.Price, req.FreeAbove, req.MinDays, req.MaxDays, *req.Enabled, methodID).Scan(&method.ID, &method.CreatedAt)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return method, nil
+}
+
+func getShippingMethods(ctx context.Context) ([]ShippingMethod, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, code, name, price, free_above, min_days, max_days, enabled, created_at
+		FROM shipping_methods
+		ORDER BY price, name, id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	methods := make([]ShippingMethod, 0)
+	for rows.Next() {
+		var method ShippingMethod
+		var freeAbove sql.NullFloat64
+		var minDays, maxDays sql.NullInt64
+		if err := rows.Scan(&method.ID, &method.Code, &method.Name, &method.Price, &freeAbove, &minDays, &maxDays,
+			&method.Enabled, &method.CreatedAt); err != nil {
+			return nil, err
+		}
+		if freeAbove.Valid {
+			method.FreeAbove = &freeAbove.Float64
+		}
+		if minDays.Valid && maxDays.Valid {
+			min, max := int(minDays.Int64), int(maxDays.Int64)
+			method.MinDays, method.MaxDays = &min, &max
+		}
+		methods = append(methods, method)
+	}
+
+	return methods, rows.Err()
+}
+
+// deliveryWindow returns the method's delivery window, or nil when it has none
+func (m *ShippingMethod) deliveryWindow() *DeliveryWindow {
+	if m.MinDays == nil || m.MaxDays == nil {
+		return nil
+	}
+	return &DeliveryWindow{MinDays: *m.MinDays, MaxDays: *m.MaxDays}
+}
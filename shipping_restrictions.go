@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// errShippingRestricted is returned, wrapped with the product, when an order has a product
+// that can't ship to its destination
+var errShippingRestricted = errors.New("a product can't ship to the destination")
+
+// normalizeCountries uppercases, checks and deduplicates the country codes
+func normalizeCountries(countries []string) ([]string, error) {
+	seen := make(map[string]bool, len(countries))
+	normalized := make([]string, 0, len(countries))
+	for _, country := range countries {
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if !countryCodes[country] {
+			return nil, fmt.Errorf("%q is not a known country code", country)
+		}
+		if !seen[country] {
+			seen[country] = true
+			normalized = append(normalized, country)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// restrictedProducts returns the products, by ID, that can't ship to the country
+func restrictedProducts(ctx context.Context, productIDs []int, country string) ([]Product, error) {
+	products := make([]Product, 0)
+	if country == "" || len(productIDs) == 0 {
+		return products, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, name
+		FROM products
+		WHERE id = ANY($1) AND $2 = ANY(restricted_countries)
+		ORDER BY id
+	`, pq.Array(productIDs), country)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var product Product
+		if err := rows.Scan(&product.ID, &product.Name); err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+
+	return products, rows.Err()
+}
+
+// checkShippingRestrictions fails with errShippingRestricted when a product on the order
+// can't ship to its destination. Pickup orders aren't shipped, so they can have any product.
+func checkShippingRestrictions(ctx context.Context, req OrderRequest) error {
+	if req.Destination == nil || req.PickupLocationID != 0 {
+		return nil
+	}
+
+	productIDs := make([]int, 0, len(req.Products))
+	for _, line := range req.Products {
+		productIDs = append(productIDs, line.ProductID)
+	}
+	restricted, err := restrictedProducts(ctx, productIDs, req.Destination.Country)
+	if err != nil {
+		return err
+	}
+	if len(restricted) > 0 {
+		return fmt.Errorf("%w: product %d (%s) can't ship to %s", errShippingRestricted,
+			restricted[0].ID, restricted[0].Name, req.Destination.Country)
+	}
+	return nil
+}
+
+// cartRestrictedProductIDs returns the IDs of the cart's products that can't ship to the
+// country
+func cartRestrictedProductIDs(ctx context.Context, cart *Cart, country string) ([]int, error) {
+	productIDs := make([]int, 0, len(cart.Items))
+	for _, item := range cart.Items {
+		productIDs = append(productIDs, item.Product.ID)
+	}
+	restricted, err := restrictedProducts(ctx, productIDs, country)
+	if err != nil {
+		return nil, err
+	}
+
+	restrictedIDs := make([]int, 0, len(restricted))
+	for _, product := range restricted {
+		restrictedIDs = append(restrictedIDs, product.ID)
+	}
+	return restrictedIDs, nil
+}
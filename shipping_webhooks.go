@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// shippingWebhookParser is implemented by carriers that send tracking webhooks
+type shippingWebhookParser interface {
+	// ParseWebhook verifies the request's signature and returns the event it carries
+	ParseWebhook(r *http.Request, body []byte) (*ShippingEvent, error)
+}
+
+// ShippingEvent is a carrier webhook event about a package
+type ShippingEvent struct {
+	ID             string
+	Carrier        string
+	TrackingNumber string
+	// Tracking is nil for events the store ignores
+	Tracking *TrackingInfo
+}
+
+// SHIPPING WEBHOOKS
+// ShippingWebhookHandler receives tracking updates from the carrier, updates the shipment and
+// its order, and emails the customer when a package is out for delivery or delivered
+func ShippingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	parser, ok := shippingCarrier.(shippingWebhookParser)
+	if !ok {
+		handlers.WriteError(w, http.StatusServiceUnavailable, "No shipping carrier is configured")
+		return
+	}
+
+	event, err := parser.ParseWebhook(r, body)
+	if err != nil {
+		log.Println("Error verifying shipping webhook:", err)
+		handlers.WriteError(w, http.StatusBadRequest, errInvalidWebhookSignature.Error())
+		return
+	}
+	if event.Tracking == nil || event.TrackingNumber == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Packages the store didn't ship, such as returns sent by customers, are acknowledged
+	var shipmentID int
+	err = db.QueryRowContext(r.Context(), `
+		SELECT id FROM shipments
+		WHERE tracking_number = $1 AND (carrier IS NULL OR LOWER(carrier) = LOWER($2) OR $2 = '')
+		ORDER BY id DESC
+		LIMIT 1
+	`, event.TrackingNumber, event.Carrier).Scan(&shipmentID)
+	if isNoRows(err) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		log.Println("Error retrieving shipment:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// On errors the carrier retries the event later
+	notification, err := applyTracking(r.Context(), shipmentID, event.Tracking)
+	if err != nil {
+		log.Printf("Error processing shipping webhook event %s: %v", event.ID, err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	sendTrackingNotification(r.Context(), notification)
+
+	w.WriteHeader(http.StatusOK)
+}
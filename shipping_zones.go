@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errShippingZoneOverlap = errors.New("a country, or the rest of the world, is already in another shipping zone")
+
+// ShippingZone is a set of countries that share shipping rates. A zone without countries
+// covers every country that isn't in another zone.
+type ShippingZone struct {
+	ID        int            `json:"shipping_zone_id"`
+	Name      string         `json:"name"`
+	Countries []string       `json:"countries"`
+	Rates     []ShippingRate `json:"rates"`
+}
+
+type ShippingZoneRequest struct {
+	Name      string   `json:"name"`
+	Countries []string `json:"countries"`
+}
+
+// ShippingRate prices one shipping method in a zone as BasePrice plus PricePerKg for every kg
+// shipped. A flat rate has no PricePerKg; a rate only applies to orders weighing at least
+// MinWeight and less than MaxWeight, when set.
+type ShippingRate struct {
+	ID         int      `json:"shipping_rate_id"`
+	ZoneID     int      `json:"shipping_zone_id"`
+	Code       string   `json:"code"`
+	Name       string   `json:"name"`
+	BasePrice  float64  `json:"base_price"`
+	PricePerKg float64  `json:"price_per_kg"`
+	MinWeight  float64  `json:"min_weight"`
+	MaxWeight  *float64 `json:"max_weight"`
+	// FreeAbove makes the method free from this subtotal
+	FreeAbove *float64 `json:"free_above"`
+	// MinDays and MaxDays are how many business days delivery to the zone takes, overriding
+	// the shipping method's window
+	MinDays *int `json:"min_days"`
+	MaxDays *int `json:"max_days"`
+}
+
+type ShippingRateRequest struct {
+	Code       string   `json:"code"`
+	Name       string   `json:"name"`
+	BasePrice  float64  `json:"base_price"`
+	PricePerKg float64  `json:"price_per_kg"`
+	MinWeight  float64  `json:"min_weight"`
+	MaxWeight  *float64 `json:"max_weight"`
+	FreeAbove  *float64 `json:"free_above"`
+	MinDays    *int     `json:"min_days"`
+	MaxDays    *int     `json:"max_days"`
+}
+
+// ADMIN SHIPPING ZONES
+func AdminShippingZonesHandler(w http.ResponseWriter, r *http.Request) {
+	zones, err := getShippingZones(r.Context())
+	if err != nil {
+		log.Println("Error retrieving shipping zones:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, zones)
+}
+
+func AdminCreateShippingZoneHandler(w http.ResponseWriter, r *http.Request) {
+	zoneRequest, ok := readShippingZoneRequest(w, r)
+	if !ok {
+		return
+	}
+
+	zone, err := saveShippingZone(r.Context(), 0, zoneRequest)
+	if err == errShippingZoneOverlap {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error creating shipping zone:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, zone)
+}
+
+func AdminUpdateShippingZoneHandler(w http.ResponseWriter, r *http.Request) {
+	zoneID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid shipping zone ID")
+		return
+	}
+
+	zoneRequest, ok := readShippingZoneRequest(w, r)
+	if !ok {
+		return
+	}
+
+	zone, err := saveShippingZone(r.Context(), zoneID, zoneRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Shipping zone not found")
+		return
+	}
+	if err == errShippingZoneOverlap {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error updating shipping zone:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, zone)
+}
+
+// AdminDeleteShippingZoneHandler deletes the zone with its rates. Orders already placed keep
+// the shipping they were charged.
+func AdminDeleteShippingZoneHandler(w http.ResponseWriter, r *http.Request) {
+	zoneID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid shipping zone ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM shipping_zones WHERE id = $1", zoneID)
+	if err != nil {
+		log.Println("Error deleting shipping zone:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Shipping zone not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ADMIN SHIPPING RATES
+func AdminCreateShippingRateHandler(w http.ResponseWriter, r *http.Request) {
+	zoneID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid shipping zone ID")
+		return
+	}
+
+	rateRequest, ok := readShippingRateRequest(w, r)
+	if !ok {
+		return
+	}
+
+	rate, err := saveShippingRate(r.Context(), zoneID, 0, rateRequest)
+	if isForeignKeyViolation(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Shipping zone not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error creating shipping rate:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, rate)
+}
+
+func AdminUpdateShippingRateHandler(w http.ResponseWriter, r *http.Request) {
+	rateID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid shipping rate ID")
+		return
+	}
+
+	rateRequest, ok := readShippingRateRequest(w, r)
+	if !ok {
+		return
+	}
+
+	rate, err := saveShippingRate(r.Context(), 0, rateID, rateRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Shipping rate not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error updating shipping rate:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, rate)
+}
+
+func AdminDeleteShippingRateHandler(w http.ResponseWriter, r *http.Request) {
+	rateID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid shipping rate ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM shipping_rates WHERE id = $1", rateID)
+	if err != nil {
+		log.Println("Error deleting shipping rate:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Shipping rate not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func readShippingZoneRequest(w http.ResponseWriter, r *http.Request) (ShippingZoneRequest, bool) {
+	var zoneRequest ShippingZoneRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return zoneRequest, false
+	}
+
+	err = json.Unmarshal(body, &zoneRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return zoneRequest, false
+	}
+
+	zoneRequest.Name = strings.TrimSpace(zoneRequest.Name)
+	var validationErr error
+	if zoneRequest.Name == "" || len(zoneRequest.Name) > 255 {
+		validationErr = handlers.NewFieldError("name", "name is required and must be at most 255 characters")
+	}
+	countries := make([]string, 0, len(zoneRequest.Countries))
+	seen := make(map[string]bool)
+	for i, country := range zoneRequest.Countries {
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if validationErr == nil && len(country) != 2 {
+			validationErr = handlers.FieldErrorf(fmt.Sprintf("countries[%d]", i), "countries[%d] must be a 2-letter country code", i)
+		}
+		if !seen[country] {
+			seen[country] = true
+			countries = append(countries, country)
+		}
+	}
+	zoneRequest.Countries = countries
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return zoneRequest, false
+	}
+
+	return zoneRequest, true
+}
+
+func readShippingRateRequest(w http.ResponseWriter, r *http.Request) (ShippingRateRequest, bool) {
+	var rateRequest ShippingRateRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return rateRequest, false
+	}
+
+	err = json.Unmarshal(body, &rateRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return rateRequest, false
+	}
+
+	rateRequest.Code = strings.ToLower(strings.TrimSpace(rateRequest.Code))
+	rateRequest.Name = strings.TrimSpace(rateRequest.Name)
+
+	var validationErr error
+	switch {
+	case rateRequest.Code == "" || len(rateRequest.Code) > 50:
+		validationErr = handlers.NewFieldError("code", "code is required and must be at most 50 characters")
+	case rateRequest.Name == "" || len(rateRequest.Name) > 255:
+		validationErr = handlers.NewFieldError("name", "name is required and must be at most 255 characters")
+	case rateRequest.BasePrice < 0 || rateRequest.PricePerKg < 0:
+		validationErr = errors.New("base_price and price_per_kg must not be negative")
+	case rateRequest.MinWeight < 0:
+		validationErr = handlers.NewFieldError("min_weight", "min_weight must not be negative")
+	case rateRequest.MaxWeight != nil && *rateRequest.MaxWeight <= rateRequest.MinWeight:
+		validationErr = handlers.NewFieldError("max_weight", "max_weight must be more than min_weight")
+	case rateRequest.FreeAbove != nil && *rateRequest.FreeAbove < 0:
+		validationErr = handlers.NewFieldError("free_above", "free_above must not be negative")
+	case (rateRequest.MinDays == nil) != (rateRequest.MaxDays == nil):
+		validationErr = errors.New("min_days and max_days must be given together")
+	case rateRequest.MinDays != nil && (*rateRequest.MinDays < 0 || *rateRequest.MaxDays < *rateRequest.MinDays):
+		validationErr = handlers.NewFieldError("min_days", "min_days must not be negative and max_days must be at least min_days")
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return rateRequest, false
+	}
+
+	return rateRequest, true
+}
+
+// saveShippingZone inserts a new zone when zoneID is 0, otherwise updates it. Zones can't
+// share countries, and only one zone can cover the rest of the world.
+func saveShippingZone(ctx context.Context, zoneID int, req ShippingZoneRequest) (*ShippingZone, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Zones are compared with each other, so saves are serialized
+	if _, err := tx.ExecContext(ctx, "LOCK TABLE shipping_zones IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return nil, err
+	}
+
+	var overlap bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM shipping_zones
+			WHERE id <> $1 AND (countries && $2::varchar[] OR (cardinality(countries) = 0 AND cardinality($2::varchar[]) = 0))
+		)
+	`, zoneID, pq.Array(req.Countries)).Scan(&overlap)
+	if err != nil {
+		return nil, err
+	}
+	if overlap {
+		return nil, errShippingZoneOverlap
+	}
+
+	if zoneID == 0 {
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO shipping_zones (name, countries)
+			VALUES ($1, $2)
+			RETURNING id
+		`, req.Name, pq.Array(req.Countries)).Scan(&zoneID)
+	} else {
+		err = tx.QueryRowContext(ctx, `
+			UPDATE shipping_zones
+			SET name = $1, countries = $2
+			WHERE id = $3
+			RETURNING id
+		`, req.Name, pq.Array(req.Countries), zoneID).Scan(&zoneID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	zone := &ShippingZone{ID: zoneID, Name: req.Name, Countries: req.Countries}
+	zone.Rates, err = getShippingRates(ctx, zoneID)
+	if err != nil {
+		return nil, err
+	}
+	return zone, nil
+}
+
+// saveShippingRate adds a rate to the zone when rateID is 0, otherwise updates the rate
+func saveShippingRate(ctx context.Context, zoneID, rateID int, req ShippingRateRequest) (*ShippingRate, error) {
+	rate := &ShippingRate{
+		Code:       req.Code,
+		Name:       req.Name,
+		BasePrice:  req.BasePrice,
+		PricePerKg: req.PricePerKg,
+		MinWeight:  req.MinWeight,
+		MaxWeight:  req.MaxWeight,
+		FreeAbove:  req.FreeAbove,
+		MinDays:    req.MinDays,
+		MaxDays:    req.MaxDays,
+	}
+
+	var err error
+	if rateID == 0 {
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO shipping_rates (zone_id, code, name, base_price, price_per_kg, min_weight, max_weight, free_above, min_days, max_days)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			RETURNING id, zone_id
+		`, zoneID, req.Code, req.Name, req.BasePrice, req.PricePerKg, req.MinWeight, req.MaxWeight, req.FreeAbove,
+			req.MinDays, req.MaxDays).Scan(&rate.ID, &rate.ZoneID)
+	} else {
+		err = db.QueryRowContext(ctx, `
+			UPDATE shipping_rates
+			SET code = $1, name = $2, base_price = $3, price_per_kg = $4, min_weight = $5, max_weight = $6, free_above = $7,
+				min_days = $8, max_days = $9
+			WHERE id = $10
+			RETURNING id, zone_id
+		`, req.Code, req.Name, req.BasePrice, req.PricePerKg, req.MinWeight, req.MaxWeight, req.FreeAbove,
+			req.MinDays, req.MaxDays, rateID).Scan(&rate.ID, &rate.ZoneID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rate, nil
+}
+
+func getShippingZones(ctx context.Context) ([]ShippingZone, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, name, countries FROM shipping_zones ORDER BY cardinality(countries) = 0, name, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zones := make([]ShippingZone, 0)
+	for rows.Next() {
+		var zone ShippingZone
+		if err := rows.Scan(&zone.ID, &zone.Name, pq.Array(&zone.Countries)); err != nil {
+			return nil, err
+		}
+		if zone.Countries == nil {
+			zone.Countries = make([]string, 0)
+		}
+		zones = append(zones, zone)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range zones {
+		zones[i].Rates, err = getShippingRates(ctx, zones[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return zones, nil
+}
+
+func getShippingRates(ctx context.Context, zoneID int) ([]ShippingRate, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, zone_id, code, name, base_price, price_per_kg, min_weight, max_weight, free_above, min_days, max_days
+		FROM shipping_rates
+		WHERE zone_id = $1
+		ORDER BY code, min_weight, id
+	`, zoneID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := make([]ShippingRate, 0)
+	for rows.Next() {
+		var rate ShippingRate
+		var maxWeight, freeAbove sql.NullFloat64
+		var minDays, maxDays sql.NullInt64
+		if err := rows.Scan(&rate.ID, &rate.ZoneID, &rate.Code, &rate.Name, &rate.BasePrice, &rate.PricePerKg,
+			&rate.MinWeight, &maxWeight, &freeAbove, &minDays, &maxDays); err != nil {
+			return nil, err
+		}
+		if minDays.Valid && maxDays.Valid {
+			min, max := int(minDays.Int64), int(maxDays.Int64)
+			rate.MinDays, rate.MaxDays = &min, &max
+		}
+		if maxWeight.Valid {
+			rate.MaxWeight = &maxWeight.Float64
+		}
+		if freeAbove.Valid {
+			rate.FreeAbove = &freeAbove.Float64
+		}
+		rates = append(rates, rate)
+	}
+
+	return rates, rows.Err()
+}
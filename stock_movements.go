@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Reason codes recorded with every stock movement
+const (
+	stockReasonOrder               = "order"
+	stockReasonReservation         = "reservation"
+	stockReasonReservationReleased = "reservation_released"
+	stockReasonManual              = "manual"
+	stockReasonReturn              = "return"
+	stockReasonDamaged             = "damaged"
+	stockReasonWarehouseCount      = "warehouse_count"
+	stockReasonInventorySync       = "inventory_sync"
+	stockReasonOrderCancelled      = "order_cancelled"
+	stockReasonOrderEdited         = "order_edited"
+)
+
+// adjustmentReasons are the reason codes admins may use for a manual adjustment
+var adjustmentReasons = map[string]bool{
+	stockReasonManual:  true,
+	stockReasonReturn:  true,
+	stockReasonDamaged: true,
+}
+
+// StockMovement is one entry of the stock ledger
+type StockMovement struct {
+	ID         int       `json:"movement_id"`
+	ProductID  int       `json:"product_id"`
+	Change     int       `json:"change"`
+	StockAfter int       `json:"stock_after"`
+	Reason     string    `json:"reason"`
+	OrderID    *int      `json:"order_id,omitempty"`
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type StockAdjustmentRequest struct {
+	Change int    `json:"change"`
+	Reason string `json:"reason"`
+	Note   string `json:"note"`
+}
+
+// stockMovementListColumns are what the shared list parameters of the stock ledger apply to
+var stockMovementListColumns = listColumns{
+	Sorts: map[string]string{
+		"":       "created_at DESC, id DESC",
+		"newest": "created_at DESC, id DESC",
+		"oldest": "created_at ASC, id ASC",
+	},
+	Date: "created_at",
+	Item: StockMovement{},
+}
+
+type StockMovementFilter struct {
+	ListParams
+	ProductID *int
+}
+
+type StockMovementPage struct {
+	Movements []StockMovement `json:"movements"`
+	Page      int             `json:"page"`
+	Limit     int             `json:"limit"`
+	Total     int             `json:"total"`
+}
+
+// ADMIN STOCK MOVEMENTS
+func AdminStockMovementsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseStockMovementFilter(r)
+	if err != nil {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+
+	movements, total, err := listStockMovements(r.Context(), filter)
+	if err != nil {
+		log.Println("Error retrieving stock movements:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeListJSON(w, StockMovementPage{
+		Movements: movements,
+		Page:      filter.Page,
+		Limit:     filter.Limit,
+		Total:     total,
+	}, "movements", filter.Fields)
+}
+
+func AdminAdjustStockHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	var adjustmentRequest StockAdjustmentRequest
+	err = json.Unmarshal(body, &adjustmentRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	adjustmentRequest.Note = strings.TrimSpace(adjustmentRequest.Note)
+	var validationErr error
+	switch {
+	case adjustmentRequest.Change == 0:
+		validationErr = handlers.NewFieldError("change", "change must not be 0")
+	case !adjustmentReasons[adjustmentRequest.Reason]:
+		validationErr = handlers.NewFieldError("reason", "reason must be one of manual, return, damaged")
+	case len(adjustmentRequest.Note) > 255:
+		validationErr = handlers.NewFieldError("note", "note must be at most 255 characters")
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Error starting transaction:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	defer tx.Rollback()
+
+	movement, err := adjustStock(r.Context(), tx, productID, adjustmentRequest.Change, adjustmentRequest.Reason, nil, adjustmentRequest.Note)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if errors.Is(err, errInsufficientStock) {
+		// adjustStock can't tell a missing product from too little stock
+		if _, err := getProduct(r.Context(), productID); isNoRows(err) {
+			handlers.WriteError(w, http.StatusNotFound, "Product not found")
+			return
+		}
+		handlers.WriteError(w, http.StatusConflict, "stock can't go below zero")
+		return
+	}
+	if err != nil {
+		log.Println("Error adjusting stock:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, movement)
+}
+
+// adjustStock changes the product's stock by change and records the movement in the ledger.
+// It returns errInsufficientStock if the stock would go below zero or the product doesn't exist.
+func adjustStock(ctx context.Context, tx *sql.Tx, productID, change int, reason string, orderID *int, note string) (*StockMovement, error) {
+	movement := &StockMovement{ProductID: productID, Change: change, Reason: reason, OrderID: orderID, Note: note}
+	err := tx.QueryRowContext(ctx, `
+		WITH updated AS (
+			UPDATE products
+			SET stock = stock + $2
+			WHERE id = $1 AND stock + $2 >= 0
+			RETURNING id, stock
+		)
+		INSERT INTO stock_movements (product_id, change, stock_after, reason, order_id, note)
+		SELECT id, $2, stock, $3, $4, NULLIF($5, '')
+		FROM updated
+		RETURNING id, stock_after, created_at
+	`, productID, change, reason, orderID, note).Scan(&movement.ID, &movement.StockAfter, &movement.CreatedAt)
+	if isNoRows(err) {
+		return nil, fmt.Errorf("%w for product %d", errInsufficientStock, productID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return movement, nil
+}
+
+// setStock sets the product's stock to an absolute quantity through adjustStock
+func setStock(ctx context.Context, tx *sql.Tx, productID, stock int, reason, note string) error {
+	var current int
+	err := tx.QueryRowContext(ctx, "SELECT stock FROM products WHERE id = $1 FOR UPDATE", productID).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if stock == current {
+		return nil
+	}
+
+	_, err = adjustStock(ctx, tx, productID, stock-current, reason, nil, note)
+	return err
+}
+
+func parseStockMovementFilter(r *http.Request) (StockMovementFilter, error) {
+	params, err := parseListParams(r.URL.Query(), stockMovementListColumns)
+	filter := StockMovementFilter{ListParams: params}
+	if err != nil {
+		return filter, err
+	}
+
+	if v := r.URL.Query().Get("product_id"); v != "" {
+		productID, err := strconv.Atoi(v)
+		if err != nil {
+			return filter, handlers.NewFieldError("product_id", "product_id must be an integer")
+		}
+		filter.ProductID = &productID
+	}
+
+	return filter, nil
+}
+
+// parseDateParam accepts an RFC 3339 timestamp or a plain date. A plain date used as
+// the end of a range covers that whole day.
+func parseDateParam(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
+
+func listStockMovements(ctx context.Context, filter StockMovementFilter) ([]StockMovement, int, error) {
+	var conditions sqlFilter
+	conditions.addList(filter.ListParams, stockMovementListColumns)
+	if filter.ProductID != nil {
+		conditions.add("product_id = ?", *filter.ProductID)
+	}
+
+	var total int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM stock_movements "+conditions.where(), conditions.args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, product_id, change, stock_after, reason, order_id, COALESCE(note, ''), created_at
+		FROM stock_movements
+		`+conditions.where()+`
+		`+conditions.page(filter.ListParams, stockMovementListColumns), conditions.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	movements := make([]StockMovement, 0)
+	for rows.Next() {
+		var movement StockMovement
+		if err := rows.Scan(&movement.ID, &movement.ProductID, &movement.Change, &movement.StockAfter,
+			&movement.Reason, &movement.OrderID, &movement.Note, &movement.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		movements = append(movements, movement)
+	}
+
+	return movements, total, rows.Err()
+}
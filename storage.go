@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ObjectStorage stores uploaded files such as product images
+type ObjectStorage interface {
+	// Put uploads the object and returns the URL clients use to fetch it. A size of -1 uploads
+	// r until it ends.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error)
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a link that fetches the object without credentials until ttl passes
+	SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// objectStorage is nil when S3_BUCKET is not set, which disables uploads
+var objectStorage ObjectStorage
+
+// reportStorage keeps exported reports, which are private and only fetched through signed
+// links; nil when REPORTS_S3_BUCKET is not set
+var reportStorage ObjectStorage
+
+// s3Storage talks to AWS S3 or any S3-compatible service such as MinIO
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+	// publicURL is the base URL objects are served from, e.g. a CDN in front of the bucket;
+	// empty for the private report bucket
+	publicURL string
+}
+
+// loadObjectStorage connects the product image and report buckets, which share the S3_*
+// endpoint and credentials. Google Cloud Storage works through its S3 interoperability, with
+// S3_ENDPOINT=storage.googleapis.com and an HMAC key.
+func loadObjectStorage() {
+	bucket := os.Getenv("S3_BUCKET")
+	reportBucket := os.Getenv("REPORTS_S3_BUCKET")
+	if bucket == "" && reportBucket == "" {
+		return
+	}
+
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"), ""),
+		Secure: os.Getenv("S3_USE_SSL") != "false",
+		Region: os.Getenv("S3_REGION"),
+	})
+	if err != nil {
+		log.Fatalf("Error creating S3 client: %v", err)
+	}
+
+	if reportBucket != "" {
+		reportStorage = &s3Storage{client: client, bucket: reportBucket}
+	}
+	if bucket == "" {
+		return
+	}
+
+	publicURL := os.Getenv("S3_PUBLIC_URL")
+	if publicURL == "" {
+		scheme := "https://"
+		if os.Getenv("S3_USE_SSL") == "false" {
+			scheme = "http://"
+		}
+		publicURL = scheme + endpoint + "/" + bucket
+	}
+
+	objectStorage = &s3Storage{
+		client:    client,
+		bucket:    bucket,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+	}
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return "", err
+	}
+	return s.publicURL + "/" + key, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *s3Storage) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	signed, err := s.client.PresignedGetObject(ctx, s.bucket, key, ttl, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	return signed.String(), nil
+}
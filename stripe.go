@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const stripeAPIURL = "https://api.stripe.com/v1"
+
+// stripeWebhookTolerance is how old a signed webhook may be, which limits replays
+const stripeWebhookTolerance = 5 * time.Minute
+
+// stripeGateway takes card payments with Stripe PaymentIntents. The storefront tokenizes the
+// card with Stripe.js, so only the payment method ID reaches this server.
+type stripeGateway struct {
+	secretKey string
+	// webhookSecret signs the events Stripe posts to /webhooks/payments
+	webhookSecret string
+	client        *http.Client
+}
+
+type stripePaymentIntent struct {
+	ID               string `json:"id"`
+	Status           string `json:"status"`
+	ClientSecret     string `json:"client_secret"`
+	LastPaymentError *struct {
+		Message string `json:"message"`
+	} `json:"last_payment_error"`
+	// LatestCharge is the charge's ID, or the charge itself when the request expanded it
+	LatestCharge json.RawMessage `json:"latest_charge"`
+}
+
+// stripeBalanceTransaction is a movement of money in the Stripe balance, in minor units
+type stripeBalanceTransaction struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Amount int64  `json:"amount"`
+	Fee    int64  `json:"fee"`
+	Net    int64  `json:"net"`
+}
+
+// stripeCardError is a declined card, which Stripe answers with 402
+type stripeCardError struct {
+	Message       string
+	PaymentIntent *stripePaymentIntent
+}
+
+func (e *stripeCardError) Error() string {
+	return "card declined: " + e.Message
+}
+
+func newStripeGateway(secretKey, webhookSecret string) *stripeGateway {
+	return &stripeGateway{secretKey: secretKey, webhookSecret: webhookSecret, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (g *stripeGateway) Charge(ctx context.Context, charge PaymentCharge) (*PaymentResult, error) {
+	form := url.Values{}
+	form.Set("amount", strconv.FormatInt(toMinorUnits(charge.Amount), 10))
+	form.Set("currency", strings.ToLower(charge.Currency))
+	form.Set("payment_method", charge.Source)
+	if charge.CustomerReference != "" {
+		// A saved payment method can only be charged together with its customer
+		form.Set("customer", charge.CustomerReference)
+	}
+	form.Set("confirm", "true")
+	form.Set("automatic_payment_methods[enabled]", "true")
+	form.Set("automatic_payment_methods[allow_redirects]", "never")
+	form.Set("metadata[order_id]", strconv.Itoa(charge.OrderID))
+	form.Set("expand[]", "latest_charge.balance_transaction")
+
+	var intent stripePaymentIntent
+	// The payment ID makes retries of the same attempt safe
+	err := g.do(ctx, http.MethodPost, "/payment_intents", form, fmt.Sprintf("payment-%d", charge.PaymentID), &intent)
+	var cardErr *stripeCardError
+	if errors.As(err, &cardErr) {
+		result := &PaymentResult{Status: paymentStatusFailed, FailureReason: cardErr.Message}
+		if cardErr.PaymentIntent != nil {
+			result.Reference = cardErr.PaymentIntent.ID
+		}
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return intent.result(), nil
+}
+
+// Capture checks a pending card payment again, after the customer completed 3-D Secure
+func (g *stripeGateway) Capture(ctx context.Context, reference string) (*PaymentResult, error) {
+	var intent stripePaymentIntent
+	path := "/payment_intents/" + url.PathEscape(reference) + "?expand[]=latest_charge.balance_transaction"
+	if err := g.do(ctx, http.MethodGet, path, nil, "", &intent); err != nil {
+		return nil, err
+	}
+	return intent.result(), nil
+}
+
+func (g *stripeGateway) Refund(ctx context.Context, refund PaymentRefund) (string, error) {
+	form := url.Values{}
+	form.Set("payment_intent", refund.CaptureReference)
+	form.Set("amount", strconv.FormatInt(toMinorUnits(refund.Amount), 10))
+
+	var response struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := g.do(ctx, http.MethodPost, "/refunds", form, fmt.Sprintf("refund-%d", refund.RefundID), &response); err != nil {
+		return "", err
+	}
+	if response.Status == "failed" || response.Status == "canceled" {
+		return "", fmt.Errorf("stripe refund %s %s", response.ID, response.Status)
+	}
+	return response.ID, nil
+}
+
+// SavePaymentMethod attaches the payment method to a Stripe customer, so it can be charged
+// again for later orders
+func (g *stripeGateway) SavePaymentMethod(ctx context.Context, customer PaymentCustomer, token string) (*VaultedPaymentMethod, error) {
+	if customer.Reference == "" {
+		form := url.Values{}
+		form.Set("email", customer.Email)
+		form.Set("metadata[customer_id]", strconv.Itoa(customer.ID))
+		var created struct {
+			ID string `json:"id"`
+		}
+		if err := g.do(ctx, http.MethodPost, "/customers", form, fmt.Sprintf("customer-%d", customer.ID), &created); err != nil {
+			return nil, err
+		}
+		customer.Reference = created.ID
+	}
+
+	form := url.Values{}
+	form.Set("customer", customer.Reference)
+	var method struct {
+		Card *struct {
+			Brand    string `json:"brand"`
+			Last4    string `json:"last4"`
+			ExpMonth int    `json:"exp_month"`
+			ExpYear  int    `json:"exp_year"`
+		} `json:"card"`
+	}
+	if err := g.do(ctx, http.MethodPost, "/payment_methods/"+url.PathEscape(token)+"/attach", form, "", &method); err != nil {
+		return nil, err
+	}
+
+	vaulted := &VaultedPaymentMethod{CustomerReference: customer.Reference}
+	if method.Card != nil {
+		vaulted.Brand = method.Card.Brand
+		vaulted.Last4 = method.Card.Last4
+		vaulted.ExpMonth = method.Card.ExpMonth
+		vaulted.ExpYear = method.Card.ExpYear
+	}
+	return vaulted, nil
+}
+
+// Fingerprint returns the fingerprint Stripe gives the payment method's card, the same for
+// every token of one card number
+func (g *stripeGateway) Fingerprint(ctx context.Context, token string) (string, error) {
+	var method struct {
+		Card *struct {
+			Fingerprint string `json:"fingerprint"`
+		} `json:"card"`
+	}
+	if err := g.do(ctx, http.MethodGet, "/payment_methods/"+url.PathEscape(token), nil, "", &method); err != nil {
+		return "", err
+	}
+	if method.Card == nil {
+		return "", nil
+	}
+	return method.Card.Fingerprint, nil
+}
+
+func (g *stripeGateway) DeletePaymentMethod(ctx context.Context, token string) error {
+	var method struct {
+		ID string `json:"id"`
+	}
+	return g.do(ctx, http.MethodPost, "/payment_methods/"+url.PathEscape(token)+"/detach", url.Values{}, "", &method)
+}
+
+func (intent *stripePaymentIntent) result() *PaymentResult {
+	result := &PaymentResult{Reference: intent.ID}
+	switch intent.Status {
+	case "succeeded":
+		result.Status = paymentStatusCaptured
+		result.CaptureReference = intent.ID
+		// The fee is only there when the charge was expanded
+		var charge struct {
+			BalanceTransaction *stripeBalanceTransaction `json:"balance_transaction"`
+		}
+		if json.Unmarshal(intent.LatestCharge, &charge) == nil && charge.BalanceTransaction != nil {
+			result.Fee = float64(charge.BalanceTransaction.Fee) / 100
+		}
+	case "requires_payment_method", "canceled":
+		result.Status = paymentStatusFailed
+		result.FailureReason = "card was declined"
+		if intent.LastPaymentError != nil {
+			result.FailureReason = intent.LastPaymentError.Message
+		}
+	default:
+		result.Status = paymentStatusPending
+		result.ClientSecret = intent.ClientSecret
+	}
+	return result
+}
+
+// Settlement sums the balance transactions Stripe made for payments and refunds in the
+// period, and the payouts that arrived at the bank in it
+func (g *stripeGateway) Settlement(ctx context.Context, from, to time.Time) (*ProviderSettlement, error) {
+	var charges, refunds, fees, net int64
+	query := url.Values{}
+	query.Set("created[gte]", strconv.FormatInt(from.Unix(), 10))
+	query.Set("created[lt]", strconv.FormatInt(to.Unix(), 10))
+	query.Set("limit", "100")
+	for {
+		var page struct {
+			Data    []stripeBalanceTransaction `json:"data"`
+			HasMore bool                       `json:"has_more"`
+		}
+		if err := g.do(ctx, http.MethodGet, "/balance_transactions?"+query.Encode(), nil, "", &page); err != nil {
+			return nil, err
+		}
+		for _, transaction := range page.Data {
+			switch transaction.Type {
+			case "charge", "payment":
+				charges += transaction.Amount
+			case "refund", "payment_refund":
+				refunds -= transaction.Amount
+			default:
+				continue
+			}
+			fees += transaction.Fee
+			net += transaction.Net
+		}
+		if !page.HasMore || len(page.Data) == 0 {
+			break
+		}
+		query.Set("starting_after", page.Data[len(page.Data)-1].ID)
+	}
+
+	var payouts int64
+	query = url.Values{}
+	query.Set("arrival_date[gte]", strconv.FormatInt(from.Unix(), 10))
+	query.Set("arrival_date[lt]", strconv.FormatInt(to.Unix(), 10))
+	query.Set("limit", "100")
+	for {
+		var page struct {
+			Data []struct {
+				ID     string `json:"id"`
+				Amount int64  `json:"amount"`
+				Status string `json:"status"`
+			} `json:"data"`
+			HasMore bool `json:"has_more"`
+		}
+		if err := g.do(ctx, http.MethodGet, "/payouts?"+query.Encode(), nil, "", &page); err != nil {
+			return nil, err
+		}
+		for _, payout := range page.Data {
+			if payout.Status != "failed" && payout.Status != "canceled" {
+				payouts += payout.Amount
+			}
+		}
+		if !page.HasMore || len(page.Data) == 0 {
+			break
+		}
+		query.Set("starting_after", page.Data[len(page.Data)-1].ID)
+	}
+
+	return &ProviderSettlement{
+		Charges: float64(charges) / 100,
+		Refunds: float64(refunds) / 100,
+		Fees:    float64(fees) / 100,
+		Net:     float64(net) / 100,
+		Payouts: float64(payouts) / 100,
+	}, nil
+}
+
+// do calls the Stripe API with a form-encoded body and decodes the JSON response into out
+func (g *stripeGateway) do(ctx context.Context, method, path string, form url.Values, idempotencyKey string, out interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, stripeAPIURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(g.secretKey, "")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error struct {
+				Type          string               `json:"type"`
+				Message       string               `json:"message"`
+				PaymentIntent *stripePaymentIntent `json:"payment_intent"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+			return fmt.Errorf("stripe responded with %s", resp.Status)
+		}
+		if apiErr.Error.Type == "card_error" {
+			return &stripeCardError{Message: apiErr.Error.Message, PaymentIntent: apiErr.Error.PaymentIntent}
+		}
+		return fmt.Errorf("stripe responded with %s: %s", resp.Status, apiErr.Error.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ParseWebhook checks the Stripe-Signature header, an HMAC-SHA256 of the timestamp and body
+func (g *stripeGateway) ParseWebhook(ctx context.Context, r *http.Request, body []byte) (*PaymentEvent, error) {
+	if g.webhookSecret == "" {
+		return nil, errors.New("STRIPE_WEBHOOK_SECRET is not set")
+	}
+
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errInvalidWebhookSignature
+	}
+	if age := time.Since(time.Unix(sent, 0)); age > stripeWebhookTolerance || age < -stripeWebhookTolerance {
+		return nil, fmt.Errorf("%w: timestamp is outside the tolerance", errInvalidWebhookSignature)
+	}
+
+	mac := hmac.New(sha256.New, []byte(g.webhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	valid := false
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, errInvalidWebhookSignature
+	}
+
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object json.RawMessage `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+
+	paymentEvent := &PaymentEvent{ID: event.ID}
+	switch event.Type {
+	case "payment_intent.succeeded", "payment_intent.payment_failed":
+		var intent stripePaymentIntent
+		if err := json.Unmarshal(event.Data.Object, &intent); err != nil {
+			return nil, err
+		}
+		paymentEvent.Reference = intent.ID
+		if event.Type == "payment_intent.succeeded" {
+			paymentEvent.Type = paymentEventSucceeded
+			paymentEvent.CaptureReference = intent.ID
+		} else {
+			paymentEvent.Type = paymentEventFailed
+			if intent.LastPaymentError != nil {
+				paymentEvent.FailureReason = intent.LastPaymentError.Message
+			}
+		}
+	case "charge.dispute.created":
+		var dispute struct {
+			PaymentIntent string `json:"payment_intent"`
+		}
+		if err := json.Unmarshal(event.Data.Object, &dispute); err != nil {
+			return nil, err
+		}
+		paymentEvent.Type = paymentEventChargeback
+		paymentEvent.Reference = dispute.PaymentIntent
+	}
+	return paymentEvent, nil
+}
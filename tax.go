@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// TaxRate is the sales tax rate of a country, or of one region of it when Region is set
+type TaxRate struct {
+	ID      int     `json:"tax_rate_id"`
+	Country string  `json:"country"`
+	Region  string  `json:"region"`
+	Rate    float64 `json:"rate"`
+}
+
+type TaxRateRequest struct {
+	Country string  `json:"country"`
+	Region  string  `json:"region"`
+	Rate    float64 `json:"rate"`
+}
+
+// ADMIN TAX RATES
+func AdminTaxRatesHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), "SELECT id, country, region, rate FROM tax_rates ORDER BY country, region")
+	if err != nil {
+		log.Println("Error retrieving tax rates:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	defer rows.Close()
+
+	rates := make([]TaxRate, 0)
+	for rows.Next() {
+		var rate TaxRate
+		if err := rows.Scan(&rate.ID, &rate.Country, &rate.Region, &rate.Rate); err != nil {
+			log.Println("Error scanning tax rate:", err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		rates = append(rates, rate)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error retrieving tax rates:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, rates)
+}
+
+// AdminSetTaxRateHandler creates the rate for the country and region, or replaces it
+func AdminSetTaxRateHandler(w http.ResponseWriter, r *http.Request) {
+	var rateRequest TaxRateRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	err = json.Unmarshal(body, &rateRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+
+	rateRequest.Country = strings.ToUpper(strings.TrimSpace(rateRequest.Country))
+	rateRequest.Region = strings.ToUpper(strings.TrimSpace(rateRequest.Region))
+
+	var validationErr error
+	switch {
+	case len(rateRequest.Country) != 2:
+		validationErr = handlers.NewFieldError("country", "country must be a 2-letter country code")
+	case len(rateRequest.Region) > 100:
+		validationErr = handlers.NewFieldError("region", "region must be at most 100 characters")
+	case rateRequest.Rate < 0 || rateRequest.Rate >= 1:
+		validationErr = handlers.NewFieldError("rate", "rate must be a fraction between 0 and 1, e.g. 0.0725")
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return
+	}
+
+	rate := TaxRate{Country: rateRequest.Country, Region: rateRequest.Region, Rate: rateRequest.Rate}
+	err = db.QueryRowContext(r.Context(), `
+		INSERT INTO tax_rates (country, region, rate)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (country, region) DO UPDATE SET rate = EXCLUDED.rate
+		RETURNING id
+	`, rate.Country, rate.Region, rate.Rate).Scan(&rate.ID)
+	if err != nil {
+		log.Println("Error saving tax rate:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, rate)
+}
+
+func AdminDeleteTaxRateHandler(w http.ResponseWriter, r *http.Request) {
+	rateID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid tax rate ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM tax_rates WHERE id = $1", rateID)
+	if err != nil {
+		log.Println("Error deleting tax rate:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Tax rate not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getTaxRate returns the rate of the destination's region, falling back to the country-wide
+// rate; destinations without a configured rate aren't taxed
+func getTaxRate(ctx context.Context, country, region string) (float64, error) {
+	var rate float64
+	err := db.QueryRowContext(ctx, `
+		SELECT rate FROM tax_rates
+		WHERE country = $1 AND region IN ('', $2)
+		ORDER BY region DESC
+		LIMIT 1
+	`, strings.ToUpper(country), strings.ToUpper(region)).Scan(&rate)
+	if isNoRows(err) {
+		return 0, nil
+	}
+	return rate, err
+}
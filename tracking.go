@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Normalized tracking statuses, whatever the carrier calls them
+const (
+	trackingStatusUnknown            = "unknown"
+	trackingStatusPreTransit         = "pre_transit"
+	trackingStatusInTransit          = "in_transit"
+	trackingStatusOutForDelivery     = "out_for_delivery"
+	trackingStatusAvailableForPickup = "available_for_pickup"
+	trackingStatusDelivered          = "delivered"
+	trackingStatusReturned           = "returned"
+	trackingStatusFailure            = "failure"
+)
+
+// maxTrackingPolls limits how many shipments one background run asks the carrier about
+const maxTrackingPolls = 50
+
+// shipmentTracker is implemented by carriers that can report where a package is
+type shipmentTracker interface {
+	// Track returns the package's current status and every event so far
+	Track(ctx context.Context, carrier, trackingNumber string) (*TrackingInfo, error)
+}
+
+// TrackingInfo is a carrier's account of a package
+type TrackingInfo struct {
+	Status string
+	Events []TrackingEvent
+}
+
+// TrackingEvent is one step of a package's journey
+type TrackingEvent struct {
+	Status      string    `json:"status"`
+	Description string    `json:"description"`
+	Location    string    `json:"location,omitempty"`
+	OccurredAt  time.Time `json:"occurred_at"`
+}
+
+// ShipmentTracking is where one of an order's shipments is
+type ShipmentTracking struct {
+	ShipmentID     int             `json:"shipment_id"`
+	Carrier        string          `json:"carrier,omitempty"`
+	TrackingNumber string          `json:"tracking_number,omitempty"`
+	Status         string          `json:"status"`
+	ShippedAt      time.Time       `json:"shipped_at"`
+	Events         []TrackingEvent `json:"events"`
+}
+
+// Tracking settings, loaded from environment variables by loadTrackingConfig
+var trackingConfig = struct {
+	// PollInterval is how often an undelivered shipment is checked with the carrier; 0 turns
+	// polling off
+	PollInterval time.Duration
+	// PollWindow is how long after shipping a package is followed
+	PollWindow time.Duration
+}{
+	PollInterval: time.Hour,
+	PollWindow:   60 * 24 * time.Hour,
+}
+
+func loadTrackingConfig() {
+	if v := os.Getenv("TRACKING_POLL_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid TRACKING_POLL_INTERVAL %q", v)
+		}
+		trackingConfig.PollInterval = d
+	}
+}
+
+// CUSTOMER ORDER TRACKING
+// CustomerOrderTrackingHandler returns the tracking events of each of the customer's shipments
+func CustomerOrderTrackingHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var owned bool
+	err = db.QueryRowContext(r.Context(), "SELECT EXISTS (SELECT 1 FROM orders WHERE id = $1 AND customer_id = $2)", orderID, getCustomerID(r)).Scan(&owned)
+	if err != nil {
+		log.Println("Error retrieving order:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if !owned {
+		handlers.WriteError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	tracking, err := getOrderTracking(r.Context(), orderID)
+	if err != nil {
+		log.Println("Error retrieving tracking:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, tracking)
+}
+
+func getOrderTracking(ctx context.Context, orderID int) ([]ShipmentTracking, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, COALESCE(carrier, ''), COALESCE(tracking_number, ''), COALESCE(tracking_status, $2), shipped_at
+		FROM shipments
+		WHERE order_id = $1
+		ORDER BY shipped_at, id
+	`, orderID, trackingStatusUnknown)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tracking := make([]ShipmentTracking, 0)
+	index := make(map[int]int)
+	for rows.Next() {
+		shipment := ShipmentTracking{Events: make([]TrackingEvent, 0)}
+		if err := rows.Scan(&shipment.ShipmentID, &shipment.Carrier, &shipment.TrackingNumber, &shipment.Status, &shipment.ShippedAt); err != nil {
+			return nil, err
+		}
+		index[shipment.ShipmentID] = len(tracking)
+		tracking = append(tracking, shipment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT e.shipment_id, e.status, e.description, COALESCE(e.location, ''), e.occurred_at
+		FROM shipment_events e
+		JOIN shipments s ON e.shipment_id = s.id
+		WHERE s.order_id = $1
+		ORDER BY e.occurred_at DESC, e.id DESC
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var shipmentID int
+		var event TrackingEvent
+		if err := rows.Scan(&shipmentID, &event.Status, &event.Description, &event.Location, &event.OccurredAt); err != nil {
+			return nil, err
+		}
+		i := index[shipmentID]
+		tracking[i].Events = append(tracking[i].Events, event)
+	}
+
+	return tracking, rows.Err()
+}
+
+// pollShipmentTracking asks the carrier about shipments that haven't arrived yet, each at most
+// once per PollInterval
+func pollShipmentTracking(ctx context.Context) {
+	tracker, ok := shippingCarrier.(shipmentTracker)
+	if !ok || trackingConfig.PollInterval == 0 {
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, carrier, tracking_number
+		FROM shipments
+		WHERE tracking_number IS NOT NULL AND carrier IS NOT NULL
+		  AND COALESCE(tracking_status, '') NOT IN ($1, $2)
+		  AND shipped_at > NOW() - $3 * INTERVAL '1 second'
+		  AND (tracking_checked_at IS NULL OR tracking_checked_at <= NOW() - $4 * INTERVAL '1 second')
+		ORDER BY tracking_checked_at NULLS FIRST, id
+		LIMIT $5
+	`, trackingStatusDelivered, trackingStatusReturned, trackingConfig.PollWindow.Seconds(),
+		trackingConfig.PollInterval.Seconds(), maxTrackingPolls)
+	if err != nil {
+		log.Println("Error retrieving shipments to track:", err)
+		return
+	}
+
+	type trackedShipment struct {
+		ID             int
+		Carrier        string
+		TrackingNumber string
+	}
+	var shipments []trackedShipment
+	for rows.Next() {
+		var shipment trackedShipment
+		if err := rows.Scan(&shipment.ID, &shipment.Carrier, &shipment.TrackingNumber); err != nil {
+			rows.Close()
+			log.Println("Error scanning shipment:", err)
+			return
+		}
+		shipments = append(shipments, shipment)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Println("Error retrieving shipments to track:", err)
+		return
+	}
+
+	for _, shipment := range shipments {
+		// Only asking the carrier is held to the timeout; saving what it says has the job's context
+		trackCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		info, err := tracker.Track(trackCtx, shipment.Carrier, shipment.TrackingNumber)
+		cancel()
+		if err != nil {
+			log.Printf("Error tracking shipment %d: %v", shipment.ID, err)
+			// It is tried again after the next interval rather than on every run
+			if _, err := db.ExecContext(ctx, "UPDATE shipments SET tracking_checked_at = NOW() WHERE id = $1", shipment.ID); err != nil {
+				log.Println("Error updating shipment:", err)
+			}
+			continue
+		}
+		notification, err := applyTracking(ctx, shipment.ID, info)
+		if err != nil {
+			log.Printf("Error saving tracking of shipment %d: %v", shipment.ID, err)
+			continue
+		}
+		sendTrackingNotification(ctx, notification)
+	}
+}
+
+// trackingNotification is the email sent when a package is out for delivery or delivered
+type trackingNotification struct {
+	Email    string
+	Template string
+	Key      string
+	Data     trackingEmail
+}
+
+// applyTracking stores what the carrier reported about the shipment, marks the order
+// Delivered once all its shipments are, and returns the email to send when the package just
+// went out for delivery or was delivered. The shipment's row is locked, so a webhook and the
+// poller reporting the same change notify the customer once.
+func applyTracking(ctx context.Context, shipmentID int, info *TrackingInfo) (*trackingNotification, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var orderID int
+	var previous, trackingNumber, email string
+	err = tx.QueryRowContext(ctx, `
+		SELECT s.order_id, COALESCE(s.tracking_status, ''), COALESCE(s.tracking_number, ''), c.email
+		FROM shipments s
+		JOIN orders o ON s.order_id = o.id
+		JOIN customers c ON o.customer_id = c.id
+		WHERE s.id = $1
+		FOR UPDATE OF s
+	`, shipmentID).Scan(&orderID, &previous, &trackingNumber, &email)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveTrackingTx(ctx, tx, shipmentID, info); err != nil {
+		return nil, err
+	}
+
+	if info.Status == trackingStatusDelivered {
+		// Partially shipped orders still have units to ship
+		result, err := tx.ExecContext(ctx, `
+			UPDATE orders
+			SET status = $1
+			WHERE id = $2 AND status = $3
+			  AND NOT EXISTS (
+				  SELECT 1 FROM shipments
+				  WHERE order_id = $2 AND COALESCE(tracking_status, '') <> $4
+			  )
+		`, orderStatusDelivered, orderID, orderStatusShipped, trackingStatusDelivered)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			if err := queueOrderEvent(ctx, tx, orderEventStatusChanged, orderID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if info.Status == previous {
+		return nil, nil
+	}
+	switch info.Status {
+	case trackingStatusOutForDelivery:
+		return &trackingNotification{
+			Email:    email,
+			Template: emailOutForDelivery,
+			Key:      fmt.Sprintf("out_for_delivery:%d", shipmentID),
+			Data:     trackingEmail{OrderID: orderID, TrackingNumber: trackingNumber},
+		}, nil
+	case trackingStatusDelivered:
+		return &trackingNotification{
+			Email:    email,
+			Template: emailPackageDelivered,
+			Key:      fmt.Sprintf("package_delivered:%d", shipmentID),
+			Data:     trackingEmail{OrderID: orderID, TrackingNumber: trackingNumber},
+		}, nil
+	}
+	return nil, nil
+}
+
+func sendTrackingNotification(ctx context.Context, notification *trackingNotification) {
+	if notification == nil {
+		return
+	}
+	if err := sendEmail(ctx, notification.Email, notification.Template, notification.Key, notification.Data); err != nil {
+		log.Printf("Error sending tracking email to %s: %v", notification.Email, err)
+	}
+}
+
+func saveTrackingTx(ctx context.Context, tx *sql.Tx, shipmentID int, info *TrackingInfo) error {
+	for _, event := range info.Events {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO shipment_events (shipment_id, status, description, location, occurred_at)
+			VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+			ON CONFLICT (shipment_id, status, occurred_at) DO NOTHING
+		`, shipmentID, event.Status, event.Description, event.Location, event.OccurredAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		UPDATE shipments
+		SET tracking_status = $1, tracking_checked_at = NOW()
+		WHERE id = $2
+	`, info.Status, shipmentID)
+	return err
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errSKUTaken = handlers.NewFieldError("sku", "sku is already used by another variant")
+
+// ProductVariant is a purchasable option of a product (e.g. size M, color red) with its own SKU and price
+type ProductVariant struct {
+	ID        int               `json:"variant_id"`
+	ProductID int               `json:"product_id"`
+	SKU       string            `json:"sku"`
+	Options   map[string]string `json:"options"`
+	Price     float64           `json:"price"`
+}
+
+type VariantRequest struct {
+	SKU     string            `json:"sku"`
+	Options map[string]string `json:"options"`
+	Price   float64           `json:"price"`
+}
+
+// ADMIN PRODUCT VARIANTS
+func AdminProductVariantsHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	variants, err := getProductVariants(r.Context(), productID)
+	if err != nil {
+		log.Println("Error retrieving product variants:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, variants)
+}
+
+func AdminCreateVariantHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	variantRequest, ok := readVariantRequest(w, r)
+	if !ok {
+		return
+	}
+
+	variant, err := saveVariant(r.Context(), productID, 0, variantRequest)
+	if isForeignKeyViolation(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if err == errSKUTaken {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error creating variant:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, variant)
+}
+
+func AdminUpdateVariantHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+	variantID, err := strconv.Atoi(mux.Vars(r)["variantID"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid variant ID")
+		return
+	}
+
+	variantRequest, ok := readVariantRequest(w, r)
+	if !ok {
+		return
+	}
+
+	variant, err := saveVariant(r.Context(), productID, variantID, variantRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Variant not found")
+		return
+	}
+	if err == errSKUTaken {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error updating variant:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, variant)
+}
+
+func AdminDeleteVariantHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+	variantID, err := strconv.Atoi(mux.Vars(r)["variantID"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid variant ID")
+		return
+	}
+
+	err = db.QueryRowContext(r.Context(), "DELETE FROM product_variants WHERE id = $1 AND product_id = $2 RETURNING id",
+		variantID, productID).Scan(&variantID)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Variant not found")
+		return
+	}
+	if isForeignKeyViolation(err) {
+		handlers.WriteError(w, http.StatusConflict, "variant is referenced by existing orders")
+		return
+	}
+	if err != nil {
+		log.Println("Error deleting variant:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func readVariantRequest(w http.ResponseWriter, r *http.Request) (VariantRequest, bool) {
+	var variantRequest VariantRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return variantRequest, false
+	}
+
+	err = json.Unmarshal(body, &variantRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return variantRequest, false
+	}
+
+	variantRequest.SKU = strings.TrimSpace(variantRequest.SKU)
+	if variantRequest.Options == nil {
+		variantRequest.Options = map[string]string{}
+	}
+
+	var validationErr error
+	switch {
+	case variantRequest.SKU == "" || len(variantRequest.SKU) > 100:
+		validationErr = handlers.NewFieldError("sku", "sku is required and must be at most 100 characters")
+	case variantRequest.Price < 0:
+		validationErr = handlers.NewFieldError("price", "price must not be negative")
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return variantRequest, false
+	}
+
+	return variantRequest, true
+}
+
+func getProductVariants(ctx context.Context, productID int) ([]ProductVariant, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, product_id, sku, options, price
+		FROM product_variants
+		WHERE product_id = $1
+		ORDER BY id
+	`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := make([]ProductVariant, 0)
+	for rows.Next() {
+		var variant ProductVariant
+		var options []byte
+		if err := rows.Scan(&variant.ID, &variant.ProductID, &variant.SKU, &options, &variant.Price); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(options, &variant.Options); err != nil {
+			return nil, err
+		}
+		variants = append(variants, variant)
+	}
+
+	return variants, rows.Err()
+}
+
+// getVariantsOfProducts returns the variants of each product, in one query
+func getVariantsOfProducts(ctx context.Context, productIDs []int) (map[int][]ProductVariant, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, product_id, sku, options, price
+		FROM product_variants
+		WHERE product_id = ANY($1)
+		ORDER BY id
+	`, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := make(map[int][]ProductVariant)
+	for rows.Next() {
+		var variant ProductVariant
+		var options []byte
+		if err := rows.Scan(&variant.ID, &variant.ProductID, &variant.SKU, &options, &variant.Price); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(options, &variant.Options); err != nil {
+			return nil, err
+		}
+		variants[variant.ProductID] = append(variants[variant.ProductID], variant)
+	}
+
+	return variants, rows.Err()
+}
+
+// getVariant returns the variant only if it belongs to the given product
+func getVariant(ctx context.Context, productID, variantID int) (*ProductVariant, error) {
+	var variant ProductVariant
+	var options []byte
+	err := db.QueryRowContext(ctx, `
+		SELECT id, product_id, sku, options, price
+		FROM product_variants
+		WHERE id = $1 AND product_id = $2
+	`, variantID, productID).Scan(&variant.ID, &variant.ProductID, &variant.SKU, &options, &variant.Price)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(options, &variant.Options); err != nil {
+		return nil, err
+	}
+
+	return &variant, nil
+}
+
+// saveVariant inserts a new variant when variantID is 0, otherwise updates it
+func saveVariant(ctx context.Context, productID, variantID int, req VariantRequest) (*ProductVariant, error) {
+	options, err := json.Marshal(req.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	if variantID == 0 {
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO product_variants (product_id, sku, options, price)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id
+		`, productID, req.SKU, options, req.Price).Scan(&variantID)
+	} else {
+		err = db.QueryRowContext(ctx, `
+			UPDATE product_variants
+			SET sku = $1, options = $2, price = $3
+			WHERE id = $4 AND product_id = $5
+			RETURNING id
+		`, req.SKU, options, req.Price, variantID, productID).Scan(&variantID)
+	}
+	if isUniqueViolation(err) {
+		return nil, errSKUTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProductVariant{
+		ID:        variantID,
+		ProductID: productID,
+		SKU:       req.SKU,
+		Options:   req.Options,
+		Price:     req.Price,
+	}, nil
+}
+
+// orderLineVariant scans the nullable variant columns of an order line
+type orderLineVariant struct {
+	ID      *int
+	SKU     *string
+	Options []byte
+	Price   *float64
+}
+
+// applyTo attaches the variant to the order line product and uses the variant's price
+func (v orderLineVariant) applyTo(product *Product) error {
+	if v.ID == nil {
+		return nil
+	}
+
+	variant := &ProductVariant{ID: *v.ID, ProductID: product.ID, SKU: *v.SKU, Price: *v.Price}
+	if err := json.Unmarshal(v.Options, &variant.Options); err != nil {
+		return err
+	}
+
+	product.Variant = variant
+	product.Price = variant.Price
+	return nil
+}
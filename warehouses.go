@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+var errWarehouseCodeTaken = handlers.NewFieldError("code", "code is already used by another warehouse")
+
+type Warehouse struct {
+	ID   int    `json:"warehouse_id"`
+	Code string `json:"code"`
+	Name string `json:"name"`
+	// Priority decides which warehouse ships first; lower ships first
+	Priority int `json:"priority"`
+	// Timezone is the IANA timezone the warehouse works in; orders placed after CutoffTime
+	// ("15:04", optional) ship the next business day, after HandlingDays more
+	Timezone     string `json:"timezone"`
+	CutoffTime   string `json:"cutoff_time,omitempty"`
+	HandlingDays int    `json:"handling_days"`
+}
+
+type WarehouseRequest struct {
+	Code     string `json:"code"`
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	// Timezone defaults to UTC
+	Timezone     string `json:"timezone"`
+	CutoffTime   string `json:"cutoff_time"`
+	HandlingDays int    `json:"handling_days"`
+}
+
+// WarehouseStock is the quantity of one product on hand in one warehouse
+type WarehouseStock struct {
+	WarehouseID int    `json:"warehouse_id"`
+	Code        string `json:"code"`
+	Name        string `json:"name"`
+	Quantity    int    `json:"quantity"`
+}
+
+type WarehouseStockRequest struct {
+	Quantity int `json:"quantity"`
+}
+
+// ADMIN WAREHOUSES
+func AdminWarehousesHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, code, name, priority, timezone, COALESCE(cutoff_time, ''), handling_days
+		FROM warehouses
+		ORDER BY priority, id
+	`)
+	if err != nil {
+		log.Println("Error retrieving warehouses:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	defer rows.Close()
+
+	warehouses := make([]Warehouse, 0)
+	for rows.Next() {
+		var warehouse Warehouse
+		if err := rows.Scan(&warehouse.ID, &warehouse.Code, &warehouse.Name, &warehouse.Priority,
+			&warehouse.Timezone, &warehouse.CutoffTime, &warehouse.HandlingDays); err != nil {
+			log.Println("Error scanning warehouse:", err)
+			handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		warehouses = append(warehouses, warehouse)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error retrieving warehouses:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, warehouses)
+}
+
+func AdminCreateWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	warehouseRequest, ok := readWarehouseRequest(w, r)
+	if !ok {
+		return
+	}
+
+	warehouse, err := saveWarehouse(r.Context(), 0, warehouseRequest)
+	if err == errWarehouseCodeTaken {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error creating warehouse:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, warehouse)
+}
+
+func AdminUpdateWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	warehouseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid warehouse ID")
+		return
+	}
+
+	warehouseRequest, ok := readWarehouseRequest(w, r)
+	if !ok {
+		return
+	}
+
+	warehouse, err := saveWarehouse(r.Context(), warehouseID, warehouseRequest)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Warehouse not found")
+		return
+	}
+	if err == errWarehouseCodeTaken {
+		handlers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error updating warehouse:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, warehouse)
+}
+
+// AdminSetWarehouseStockHandler sets the quantity of a product in a warehouse.
+// The product's sellable stock moves by the same difference.
+func AdminSetWarehouseStockHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+	warehouseID, err := strconv.Atoi(mux.Vars(r)["warehouseID"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid warehouse ID")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	var stockRequest WarehouseStockRequest
+	err = json.Unmarshal(body, &stockRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+	if stockRequest.Quantity < 0 {
+		handlers.WriteFieldError(w, "quantity", "quantity must not be negative")
+		return
+	}
+
+	err = setWarehouseStock(r.Context(), productID, warehouseID, stockRequest.Quantity)
+	if isForeignKeyViolation(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Product or warehouse not found")
+		return
+	}
+	if errors.Is(err, errInsufficientStock) {
+		handlers.WriteError(w, http.StatusConflict, "quantity is lower than the units already reserved for checkouts")
+		return
+	}
+	if err != nil {
+		log.Println("Error setting warehouse stock:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	stock, err := getWarehouseStock(r.Context(), productID)
+	if err != nil {
+		log.Println("Error retrieving warehouse stock:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, stock)
+}
+
+func readWarehouseRequest(w http.ResponseWriter, r *http.Request) (WarehouseRequest, bool) {
+	var warehouseRequest WarehouseRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return warehouseRequest, false
+	}
+
+	err = json.Unmarshal(body, &warehouseRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return warehouseRequest, false
+	}
+
+	warehouseRequest.Code = strings.ToUpper(strings.TrimSpace(warehouseRequest.Code))
+	warehouseRequest.Name = strings.TrimSpace(warehouseRequest.Name)
+	warehouseRequest.Timezone = strings.TrimSpace(warehouseRequest.Timezone)
+	warehouseRequest.CutoffTime = strings.TrimSpace(warehouseRequest.CutoffTime)
+	if warehouseRequest.Timezone == "" {
+		warehouseRequest.Timezone = "UTC"
+	}
+
+	var validationErr error
+	switch {
+	case warehouseRequest.Code == "" || len(warehouseRequest.Code) > 50:
+		validationErr = handlers.NewFieldError("code", "code is required and must be at most 50 characters")
+	case warehouseRequest.Name == "" || len(warehouseRequest.Name) > 255:
+		validationErr = handlers.NewFieldError("name", "name is required and must be at most 255 characters")
+	case len(warehouseRequest.Timezone) > 64 || !validTimezone(warehouseRequest.Timezone):
+		validationErr = handlers.NewFieldError("timezone", "timezone must be an IANA timezone such as America/New_York")
+	case warehouseRequest.CutoffTime != "" && !validClockTime(warehouseRequest.CutoffTime):
+		validationErr = handlers.NewFieldError("cutoff_time", "cutoff_time must be a time of day such as 14:00")
+	case warehouseRequest.HandlingDays < 0 || warehouseRequest.HandlingDays > 30:
+		validationErr = handlers.NewFieldError("handling_days", "handling_days must be between 0 and 30")
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return warehouseRequest, false
+	}
+
+	return warehouseRequest, true
+}
+
+// saveWarehouse inserts a new warehouse when warehouseID is 0, otherwise updates it
+func saveWarehouse(ctx context.Context, warehouseID int, req WarehouseRequest) (*Warehouse, error) {
+	var err error
+	if warehouseID == 0 {
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO warehouses (code, name, priority, timezone, cutoff_time, handling_days)
+			VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)
+			RETURNING id
+		`, req.Code, req.Name, req.Priority, req.Timezone, req.CutoffTime, req.HandlingDays).Scan(&warehouseID)
+	} else {
+		err = db.QueryRowContext(ctx, `
+			UPDATE warehouses
+			SET code = $1, name = $2, priority = $3, timezone = $4, cutoff_time = NULLIF($5, ''), handling_days = $6
+			WHERE id = $7
+			RETURNING id
+		`, req.Code, req.Name, req.Priority, req.Timezone, req.CutoffTime, req.HandlingDays, warehouseID).Scan(&warehouseID)
+	}
+	if isUniqueViolation(err) {
+		return nil, errWarehouseCodeTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Warehouse{
+		ID:           warehouseID,
+		Code:         req.Code,
+		Name:         req.Name,
+		Priority:     req.Priority,
+		Timezone:     req.Timezone,
+		CutoffTime:   req.CutoffTime,
+		HandlingDays: req.HandlingDays,
+	}, nil
+}
+
+func setWarehouseStock(ctx context.Context, productID, warehouseID, quantity int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previous int
+	err = tx.QueryRowContext(ctx, `
+		SELECT quantity FROM warehouse_stock
+		WHERE product_id = $1 AND warehouse_id = $2
+		FOR UPDATE
+	`, productID, warehouseID).Scan(&previous)
+	if err != nil && !isNoRows(err) {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO warehouse_stock (product_id, warehouse_id, quantity)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (product_id, warehouse_id) DO UPDATE SET quantity = EXCLUDED.quantity
+	`, productID, warehouseID, quantity)
+	if err != nil {
+		return err
+	}
+
+	// Units already reserved for checkouts have been taken from stock, so it can't drop below zero
+	if quantity != previous {
+		note := "warehouse " + strconv.Itoa(warehouseID)
+		if _, err := adjustStock(ctx, tx, productID, quantity-previous, stockReasonWarehouseCount, nil, note); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// getWarehouseStock lists the product's quantity in every warehouse that stocks it
+func getWarehouseStock(ctx context.Context, productID int) ([]WarehouseStock, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT w.id, w.code, w.name, ws.quantity
+		FROM warehouse_stock ws
+		JOIN warehouses w ON w.id = ws.warehouse_id
+		WHERE ws.product_id = $1
+		ORDER BY w.priority, w.id
+	`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stock := make([]WarehouseStock, 0)
+	for rows.Next() {
+		var warehouseStock WarehouseStock
+		if err := rows.Scan(&warehouseStock.WarehouseID, &warehouseStock.Code, &warehouseStock.Name, &warehouseStock.Quantity); err != nil {
+			return nil, err
+		}
+		stock = append(stock, warehouseStock)
+	}
+
+	return stock, rows.Err()
+}
+
+// allocateOrder decides which warehouses ship the order and takes the units from them.
+// A product ships from the highest priority warehouse that holds all of its units, otherwise
+// it is split across warehouses in priority order. Products not stocked in any warehouse are skipped.
+func allocateOrder(ctx context.Context, tx *sql.Tx, orderID int, units map[int]int) error {
+	productIDs := make([]int, 0, len(units))
+	for productID := range units {
+		productIDs = append(productIDs, productID)
+	}
+	sort.Ints(productIDs)
+
+	for _, productID := range productIDs {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT ws.warehouse_id, ws.quantity
+			FROM warehouse_stock ws
+			JOIN warehouses w ON w.id = ws.warehouse_id
+			WHERE ws.product_id = $1
+			ORDER BY w.priority, w.id
+			FOR UPDATE OF ws
+		`, productID)
+		if err != nil {
+			return err
+		}
+
+		var available []WarehouseStock
+		for rows.Next() {
+			var stock WarehouseStock
+			if err := rows.Scan(&stock.WarehouseID, &stock.Quantity); err != nil {
+				rows.Close()
+				return err
+			}
+			available = append(available, stock)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(available) == 0 {
+			continue
+		}
+
+		allocations := planAllocation(available, units[productID])
+		if allocations == nil {
+			return fmt.Errorf("%w in warehouses for product %d", errInsufficientStock, productID)
+		}
+
+		for warehouseID, quantity := range allocations {
+			_, err := tx.ExecContext(ctx, "UPDATE warehouse_stock SET quantity = quantity - $1 WHERE product_id = $2 AND warehouse_id = $3",
+				quantity, productID, warehouseID)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO order_allocations (order_id, product_id, warehouse_id, quantity)
+				VALUES ($1, $2, $3, $4)
+			`, orderID, productID, warehouseID, quantity)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// planAllocation returns the quantity to take from each warehouse, or nil if
+// the warehouses don't hold enough units together
+func planAllocation(available []WarehouseStock, needed int) map[int]int {
+	for _, stock := range available {
+		if stock.Quantity >= needed {
+			return map[int]int{stock.WarehouseID: needed}
+		}
+	}
+
+	allocations := make(map[int]int)
+	for _, stock := range available {
+		if needed == 0 {
+			break
+		}
+		take := stock.Quantity
+		if take > needed {
+			take = needed
+		}
+		if take > 0 {
+			allocations[stock.WarehouseID] = take
+			needed -= take
+		}
+	}
+	if needed > 0 {
+		return nil
+	}
+	return allocations
+}
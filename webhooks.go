@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// Order events webhook endpoints can subscribe to
+const (
+	orderEventCreated       = "order.created"
+	orderEventUpdated       = "order.updated"
+	orderEventStatusChanged = "order.status_changed"
+)
+
+var orderEvents = []string{orderEventCreated, orderEventUpdated, orderEventStatusChanged}
+
+// Webhook delivery statuses
+const (
+	webhookDeliveryPending   = "pending"
+	webhookDeliveryDelivered = "delivered"
+	webhookDeliveryFailed    = "failed"
+)
+
+// webhookSecretPrefix marks the secrets webhook payloads are signed with
+const webhookSecretPrefix = "whsec_"
+
+// webhookBatchSize is how many due deliveries the background task sends at once
+const webhookBatchSize = 50
+
+// webhookDeliveryLease is how long a claimed delivery is kept from other workers while it is sent
+const webhookDeliveryLease = 5 * time.Minute
+
+// Webhook settings, loaded from environment variables by loadWebhookConfig
+var webhookConfig = struct {
+	// MaxAttempts is how often a delivery is tried before it is marked failed
+	MaxAttempts int
+	// RetryBackoff is the wait after the first failed attempt; it doubles with every attempt
+	RetryBackoff time.Duration
+	// MaxBackoff caps the wait between attempts
+	MaxBackoff time.Duration
+}{
+	MaxAttempts:  10,
+	RetryBackoff: time.Minute,
+	MaxBackoff:   12 * time.Hour,
+}
+
+var webhookClient = &http.Client{Timeout: 15 * time.Second}
+
+// WebhookEndpoint is a URL order events are posted to
+type WebhookEndpoint struct {
+	ID        int       `json:"webhook_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookEndpointRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Enabled defaults to true
+	Enabled *bool `json:"enabled"`
+}
+
+type CreateWebhookEndpointResponse struct {
+	WebhookEndpoint
+	// Secret signs the payloads; it is only returned once, when the endpoint is created
+	Secret string `json:"secret"`
+}
+
+// WebhookDelivery is an event posted, or still to be posted, to an endpoint
+type WebhookDelivery struct {
+	ID             int        `json:"delivery_id"`
+	Event          string     `json:"event"`
+	Payload        string     `json:"payload"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	ResponseStatus *int       `json:"response_status"`
+	LastError      *string    `json:"last_error"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// OrderEvent is the payload posted to webhook endpoints
+type OrderEvent struct {
+	Event      string         `json:"event"`
+	OccurredAt time.Time      `json:"occurred_at"`
+	Order      OrderEventData `json:"order"`
+}
+
+// OrderEventData is the order as it was when the event happened
+type OrderEventData struct {
+	ID         int     `json:"order_id"`
+	CustomerID int     `json:"customer_id"`
+	Status     string  `json:"status"`
+	Subtotal   float64 `json:"subtotal"`
+	Discount   float64 `json:"discount"`
+	Tax        float64 `json:"tax"`
+	Shipping   float64 `json:"shipping"`
+	Total      float64 `json:"total"`
+}
+
+// webhookDelivery is a delivery that is due to be posted
+type webhookDelivery struct {
+	ID       int
+	URL      string
+	Secret   string
+	Event    string
+	Payload  string
+	Attempts int
+}
+
+func loadWebhookConfig() {
+	if v := os.Getenv("WEBHOOK_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid WEBHOOK_MAX_ATTEMPTS %q", v)
+		}
+		webhookConfig.MaxAttempts = n
+	}
+	if v := os.Getenv("WEBHOOK_RETRY_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid WEBHOOK_RETRY_BACKOFF %q", v)
+		}
+		webhookConfig.RetryBackoff = d
+	}
+}
+
+// ADMIN WEBHOOKS
+func AdminWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	endpoints, err := getWebhookEndpoints(r.Context())
+	if err != nil {
+		log.Println("Error retrieving webhooks:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, endpoints)
+}
+
+func AdminCreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookRequest, ok := readWebhookEndpointRequest(w, r)
+	if !ok {
+		return
+	}
+
+	secret, err := generateToken(24)
+	if err != nil {
+		log.Println("Error generating webhook secret:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	response := CreateWebhookEndpointResponse{Secret: webhookSecretPrefix + secret}
+
+	err = db.QueryRowContext(r.Context(), `
+		INSERT INTO webhook_endpoints (url, secret, events, enabled)
+		VALUES ($1, $2, $3, COALESCE($4, TRUE))
+		RETURNING id, url, events, enabled, created_at
+	`, webhookRequest.URL, response.Secret, pq.Array(webhookRequest.Events), webhookRequest.Enabled).Scan(
+		&response.ID, &response.URL, pq.Array(&response.Events), &response.Enabled, &response.CreatedAt)
+	if err != nil {
+		log.Println("Error creating webhook:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusCreated, response)
+}
+
+// AdminUpdateWebhookHandler replaces the endpoint's URL and events. Its secret is kept, and
+// deliveries already queued go to the new URL.
+func AdminUpdateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	webhookRequest, ok := readWebhookEndpointRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var endpoint WebhookEndpoint
+	err = db.QueryRowContext(r.Context(), `
+		UPDATE webhook_endpoints SET url = $1, events = $2, enabled = COALESCE($3, enabled)
+		WHERE id = $4
+		RETURNING id, url, events, enabled, created_at
+	`, webhookRequest.URL, pq.Array(webhookRequest.Events), webhookRequest.Enabled, webhookID).Scan(
+		&endpoint.ID, &endpoint.URL, pq.Array(&endpoint.Events), &endpoint.Enabled, &endpoint.CreatedAt)
+	if isNoRows(err) {
+		handlers.WriteError(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error updating webhook:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, endpoint)
+}
+
+// AdminDeleteWebhookHandler deletes the endpoint with its delivery log
+func AdminDeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM webhook_endpoints WHERE id = $1", webhookID)
+	if err != nil {
+		log.Println("Error deleting webhook:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminWebhookDeliveriesHandler returns the endpoint's latest deliveries, newest first
+func AdminWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	var exists bool
+	err = db.QueryRowContext(r.Context(), "SELECT EXISTS (SELECT 1 FROM webhook_endpoints WHERE id = $1)", webhookID).Scan(&exists)
+	if err == nil && !exists {
+		handlers.WriteError(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+	var deliveries []WebhookDelivery
+	if err == nil {
+		deliveries, err = getWebhookDeliveries(r.Context(), webhookID)
+	}
+	if err != nil {
+		log.Println("Error retrieving webhook deliveries:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, http.StatusOK, deliveries)
+}
+
+func readWebhookEndpointRequest(w http.ResponseWriter, r *http.Request) (WebhookEndpointRequest, bool) {
+	var webhookRequest WebhookEndpointRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return webhookRequest, false
+	}
+
+	err = json.Unmarshal(body, &webhookRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return webhookRequest, false
+	}
+
+	webhookRequest.URL = strings.TrimSpace(webhookRequest.URL)
+	endpointURL, err := url.Parse(webhookRequest.URL)
+
+	var validationErr error
+	switch {
+	case err != nil || (endpointURL.Scheme != "https" && endpointURL.Scheme != "http") || endpointURL.Host == "":
+		validationErr = handlers.NewFieldError("url", "url must be an http or https URL")
+	case len(webhookRequest.URL) > 2048:
+		validationErr = handlers.NewFieldError("url", "url must be at most 2048 characters")
+	case len(webhookRequest.Events) == 0:
+		validationErr = handlers.NewFieldError("events", "at least one event is required")
+	}
+	seen := make(map[string]bool)
+	for _, event := range webhookRequest.Events {
+		if validationErr != nil {
+			break
+		}
+		if !isOrderEvent(event) {
+			validationErr = handlers.FieldErrorf("events", "unknown event %q, must be one of %s", event, strings.Join(orderEvents, ", "))
+		}
+		seen[event] = true
+	}
+	if validationErr != nil {
+		handlers.WriteValidationError(w, validationErr)
+		return webhookRequest, false
+	}
+
+	webhookRequest.Events = webhookRequest.Events[:0]
+	for _, event := range orderEvents {
+		if seen[event] {
+			webhookRequest.Events = append(webhookRequest.Events, event)
+		}
+	}
+	return webhookRequest, true
+}
+
+func isOrderEvent(event string) bool {
+	for _, e := range orderEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func getWebhookEndpoints(ctx context.Context) ([]WebhookEndpoint, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, url, events, enabled, created_at FROM webhook_endpoints ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	endpoints := make([]WebhookEndpoint, 0)
+	for rows.Next() {
+		var endpoint WebhookEndpoint
+		if err := rows.Scan(&endpoint.ID, &endpoint.URL, pq.Array(&endpoint.Events), &endpoint.Enabled, &endpoint.CreatedAt); err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return endpoints, rows.Err()
+}
+
+func getWebhookDeliveries(ctx context.Context, webhookID int) ([]WebhookDelivery, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, event, payload, status, attempts, response_status, last_error,
+			   CASE WHEN status = $2 THEN next_attempt_at END, delivered_at, created_at
+		FROM webhook_deliveries
+		WHERE endpoint_id = $1
+		ORDER BY id DESC
+		LIMIT 100
+	`, webhookID, webhookDeliveryPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var delivery WebhookDelivery
+		if err := rows.Scan(&delivery.ID, &delivery.Event, &delivery.Payload, &delivery.Status, &delivery.Attempts,
+			&delivery.ResponseStatus, &delivery.LastError, &delivery.NextAttemptAt, &delivery.DeliveredAt, &delivery.CreatedAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// queueOrderEvent queues the event with the order as it is in the transaction for every
+// enabled endpoint subscribed to it, so the event is only posted if the transaction commits
+func queueOrderEvent(ctx context.Context, tx *sql.Tx, event string, orderID int) error {
+	payload := OrderEvent{Event: event, OccurredAt: time.Now().UTC()}
+	order := &payload.Order
+	err := tx.QueryRowContext(ctx, `
+		SELECT id, customer_id, status, COALESCE(subtotal, 0), discount, COALESCE(tax, 0), COALESCE(shipping, 0), COALESCE(total, 0)
+		FROM orders WHERE id = $1
+	`, orderID).Scan(&order.ID, &order.CustomerID, &order.Status, &order.Subtotal, &order.Discount, &order.Tax, &order.Shipping, &order.Total)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (endpoint_id, event, payload)
+		SELECT id, $1, $2 FROM webhook_endpoints WHERE enabled AND $1 = ANY(events)
+	`, event, string(body))
+	return err
+}
+
+// deliverWebhooks posts the deliveries that are due, and schedules the next attempt of those
+// that failed with exponential backoff until they run out of attempts
+func deliverWebhooks(ctx context.Context) {
+	deliveries, err := claimWebhookDeliveries(ctx)
+	if err != nil {
+		log.Println("Error claiming webhook deliveries:", err)
+		return
+	}
+
+	for _, delivery := range deliveries {
+		responseStatus, err := postWebhook(ctx, delivery)
+		if err == nil {
+			_, err = db.ExecContext(ctx, `
+				UPDATE webhook_deliveries
+				SET status = $2, attempts = attempts + 1, response_status = $3, last_error = NULL, delivered_at = NOW()
+				WHERE id = $1
+			`, delivery.ID, webhookDeliveryDelivered, responseStatus)
+			if err != nil {
+				log.Printf("Error marking webhook delivery %d delivered: %v", delivery.ID, err)
+			}
+			continue
+		}
+
+		attempts := delivery.Attempts + 1
+		status := webhookDeliveryPending
+		if attempts >= webhookConfig.MaxAttempts {
+			status = webhookDeliveryFailed
+		}
+		_, err = db.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET status = $2, attempts = $3, response_status = NULLIF($4, 0), last_error = $5,
+				next_attempt_at = NOW() + $6 * INTERVAL '1 second'
+			WHERE id = $1
+		`, delivery.ID, status, attempts, responseStatus, err.Error(),
+			retryBackoff(webhookConfig.RetryBackoff, webhookConfig.MaxBackoff, attempts).Seconds())
+		if err != nil {
+			log.Printf("Error rescheduling webhook delivery %d: %v", delivery.ID, err)
+		}
+	}
+}
+
+// claimWebhookDeliveries returns the oldest due deliveries after leasing them so that another
+// worker doesn't post them as well
+func claimWebhookDeliveries(ctx context.Context) ([]webhookDelivery, error) {
+	rows, err := db.QueryContext(ctx, `
+		WITH due AS (
+			UPDATE webhook_deliveries SET next_attempt_at = NOW() + $3 * INTERVAL '1 second'
+			WHERE id IN (
+				SELECT id FROM webhook_deliveries
+				WHERE status = $1 AND next_attempt_at <= NOW()
+				ORDER BY id
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, endpoint_id, event, payload, attempts
+		)
+		SELECT due.id, e.url, e.secret, due.event, due.payload, due.attempts
+		FROM due
+		JOIN webhook_endpoints e ON e.id = due.endpoint_id
+		ORDER BY due.id
+	`, webhookDeliveryPending, webhookBatchSize, webhookDeliveryLease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []webhookDelivery
+	for rows.Next() {
+		var delivery webhookDelivery
+		if err := rows.Scan(&delivery.ID, &delivery.URL, &delivery.Secret, &delivery.Event, &delivery.Payload, &delivery.Attempts); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// postWebhook posts the delivery's payload signed with the endpoint's secret. The signature
+// header is "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<payload>">", so receivers can
+// reject old payloads as well as forged ones. Any 2xx response counts as delivered.
+func postWebhook(ctx context.Context, delivery webhookDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(delivery.Secret))
+	mac.Write([]byte(timestamp + "." + delivery.Payload))
+
+	ctx, cancel := context.WithTimeout(ctx, webhookClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Webhook-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hanifmasy/simple-commerce/handlers"
+)
+
+// WishlistItem is a product saved for later. SavedPrice is the price when it was saved,
+// so PriceChange shows how much the current Product.Price has moved since.
+type WishlistItem struct {
+	ID          int       `json:"item_id"`
+	Product     Product   `json:"product"`
+	Quantity    int       `json:"quantity"`
+	SavedPrice  float64   `json:"saved_price"`
+	PriceChange float64   `json:"price_change"`
+	SavedAt     time.Time `json:"saved_at"`
+}
+
+// WISHLIST
+func WishlistHandler(w http.ResponseWriter, r *http.Request) {
+	writeWishlist(r.Context(), w, http.StatusOK, getCustomerID(r))
+}
+
+func AddWishlistItemHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		handlers.WriteError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	var itemRequest CartItemRequest
+	err = json.Unmarshal(body, &itemRequest)
+	if err != nil {
+		log.Println("Error decoding JSON:", err)
+		handlers.WriteInvalidJSON(w)
+		return
+	}
+	if itemRequest.Quantity == 0 {
+		itemRequest.Quantity = 1
+	}
+
+	line := OrderLineRequest{ProductID: itemRequest.ProductID, VariantID: itemRequest.VariantID, Quantity: itemRequest.Quantity}
+	err = validateOrderLines(r.Context(), []OrderLineRequest{line})
+	if err == nil && itemRequest.Quantity > maxCartItemQuantity {
+		err = handlers.FieldErrorf("quantity", "quantity must be at most %d", maxCartItemQuantity)
+	}
+	if err != nil && isOrderValidationError(err) {
+		handlers.WriteValidationError(w, err)
+		return
+	}
+	if err != nil {
+		log.Println("Error validating item:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	_, err = db.ExecContext(r.Context(), `
+		INSERT INTO wishlists (customer_id, product_id, variant_id, quantity, saved_price)
+		VALUES ($1, $2, $3, $4, COALESCE(
+			(SELECT price FROM product_variants WHERE id = $3),
+			(SELECT price FROM products WHERE id = $2)
+		))
+		ON CONFLICT (customer_id, product_id, COALESCE(variant_id, 0))
+		DO UPDATE SET quantity = EXCLUDED.quantity, saved_price = EXCLUDED.saved_price, saved_at = NOW()
+	`, getCustomerID(r), itemRequest.ProductID, itemRequest.VariantID, itemRequest.Quantity)
+	if err != nil {
+		log.Println("Error saving wishlist item:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeWishlist(r.Context(), w, http.StatusCreated, getCustomerID(r))
+}
+
+func DeleteWishlistItemHandler(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.Atoi(mux.Vars(r)["itemID"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid item ID")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM wishlists WHERE id = $1 AND customer_id = $2", itemID, getCustomerID(r))
+	if !writeWishlistItemResult(w, result, err) {
+		return
+	}
+
+	writeWishlist(r.Context(), w, http.StatusOK, getCustomerID(r))
+}
+
+// SaveForLaterHandler moves a cart item to the wishlist, recording its current price
+func SaveForLaterHandler(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.Atoi(mux.Vars(r)["itemID"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid item ID")
+		return
+	}
+
+	owner, err := resolveCartOwner(w, r, false)
+	var cartID int
+	if err == nil {
+		cartID, err = findCartID(r.Context(), owner)
+	}
+
+	var result sql.Result
+	if err == nil {
+		result, err = db.ExecContext(r.Context(), `
+			WITH moved AS (
+				DELETE FROM cart_items
+				WHERE id = $1 AND cart_id = $2
+				RETURNING product_id, variant_id, quantity
+			)
+			INSERT INTO wishlists (customer_id, product_id, variant_id, quantity, saved_price)
+			SELECT $3, m.product_id, m.variant_id, m.quantity, COALESCE(v.price, p.price)
+			FROM moved m
+			JOIN products p ON m.product_id = p.id
+			LEFT JOIN product_variants v ON m.variant_id = v.id
+			ON CONFLICT (customer_id, product_id, COALESCE(variant_id, 0))
+			DO UPDATE SET quantity = EXCLUDED.quantity, saved_price = EXCLUDED.saved_price, saved_at = NOW()
+		`, itemID, cartID, owner.CustomerID)
+	}
+	if !writeCartItemResult(w, result, err) {
+		return
+	}
+
+	writeWishlist(r.Context(), w, http.StatusOK, owner.CustomerID)
+}
+
+// MoveToCartHandler moves a wishlist item back to the cart at the current price
+func MoveToCartHandler(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.Atoi(mux.Vars(r)["itemID"])
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, "Invalid item ID")
+		return
+	}
+
+	owner, err := resolveCartOwner(w, r, false)
+	var cartID int
+	if err == nil {
+		cartID, err = getOrCreateCartID(r.Context(), owner)
+	}
+
+	var result sql.Result
+	if err == nil {
+		result, err = db.ExecContext(r.Context(), `
+			WITH moved AS (
+				DELETE FROM wishlists
+				WHERE id = $1 AND customer_id = $2
+				RETURNING product_id, variant_id, quantity
+			)
+			INSERT INTO cart_items (cart_id, product_id, variant_id, quantity, unit_price)
+			SELECT $3, m.product_id, m.variant_id, m.quantity, COALESCE(v.price, p.price)
+			FROM moved m
+			JOIN products p ON m.product_id = p.id
+			LEFT JOIN product_variants v ON m.variant_id = v.id
+			ON CONFLICT (cart_id, product_id, COALESCE(variant_id, 0))
+			DO UPDATE SET quantity = LEAST(cart_items.quantity + EXCLUDED.quantity, $4), unit_price = EXCLUDED.unit_price
+		`, itemID, owner.CustomerID, cartID, maxCartItemQuantity)
+	}
+	if !writeWishlistItemResult(w, result, err) {
+		return
+	}
+
+	writeCart(r.Context(), w, http.StatusOK, owner)
+}
+
+// writeWishlistItemResult writes the error response for a wishlist item update and reports whether it succeeded
+func writeWishlistItemResult(w http.ResponseWriter, result sql.Result, err error) bool {
+	if err != nil {
+		log.Println("Error updating wishlist item:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return false
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		handlers.WriteError(w, http.StatusNotFound, "Wishlist item not found")
+		return false
+	}
+	return true
+}
+
+func writeWishlist(ctx context.Context, w http.ResponseWriter, status int, customerID int) {
+	items, err := getWishlist(ctx, customerID)
+	if err != nil {
+		log.Println("Error retrieving wishlist:", err)
+		handlers.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.WriteJSON(w, status, items)
+}
+
+func getWishlist(ctx context.Context, customerID int) ([]WishlistItem, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT wl.id, wl.quantity, wl.saved_price, wl.saved_at,
+			   p.id, COALESCE(p.sku, ''), p.name, p.price, COALESCE(p.description, ''), COALESCE(p.image_url, ''), p.category_id,
+			   v.id, v.sku, v.options, v.price
+		FROM wishlists wl
+		JOIN products p ON wl.product_id = p.id
+		LEFT JOIN product_variants v ON wl.variant_id = v.id
+		WHERE wl.customer_id = $1
+		ORDER BY wl.saved_at DESC, wl.id DESC
+	`, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]WishlistItem, 0)
+	for rows.Next() {
+		var item WishlistItem
+		var variant orderLineVariant
+		if err := rows.Scan(&item.ID, &item.Quantity, &item.SavedPrice, &item.SavedAt,
+			&item.Product.ID, &item.Product.SKU, &item.Product.Name, &item.Product.Price, &item.Product.Description, &item.Product.ImageURL, &item.Product.CategoryID,
+			&variant.ID, &variant.SKU, &variant.Options, &variant.Price); err != nil {
+			return nil, err
+		}
+		if err := variant.applyTo(&item.Product); err != nil {
+			return nil, err
+		}
+		item.PriceChange = item.Product.Price - item.SavedPrice
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}